@@ -0,0 +1,200 @@
+package ogem
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Features and limits of a model. Unset fields fall back to the built-in
+// capabilities of the model, and then to no restriction.
+type Capabilities struct {
+	// Whether the model can call tools and functions.
+	SupportsTools *bool `yaml:"supports_tools" json:"supports_tools,omitempty"`
+
+	// Whether the model accepts image inputs.
+	SupportsVision *bool `yaml:"supports_vision" json:"supports_vision,omitempty"`
+
+	// Whether the model accepts audio inputs and can respond with audio.
+	SupportsAudio *bool `yaml:"supports_audio" json:"supports_audio,omitempty"`
+
+	// Whether the model accepts the json_object and json_schema response
+	// formats.
+	SupportsJsonMode *bool `yaml:"supports_json_mode" json:"supports_json_mode,omitempty"`
+
+	// Whether the model can stream its response.
+	SupportsStreaming *bool `yaml:"supports_streaming" json:"supports_streaming,omitempty"`
+
+	// Whether the model can generate multiple choices for a request with n
+	// greater than 1.
+	SupportsMultipleChoices *bool `yaml:"supports_n" json:"supports_n,omitempty"`
+
+	// Whether the model can return the log probabilities of the output
+	// tokens.
+	SupportsLogprobs *bool `yaml:"supports_logprobs" json:"supports_logprobs,omitempty"`
+
+	// Maximum number of input and output tokens together. Zero if unknown.
+	MaxContextTokens int `yaml:"max_context_tokens" json:"max_context_tokens,omitempty"`
+
+	// Maximum number of output tokens. Zero if unknown.
+	MaxOutputTokens int `yaml:"max_output_tokens" json:"max_output_tokens,omitempty"`
+}
+
+func capabilities(tools, vision, jsonMode, multipleChoices, logprobs bool, maxContextTokens, maxOutputTokens int) Capabilities {
+	streaming := true
+	// Only the audio models, which are listed with withAudio, take audio.
+	audio := false
+	return Capabilities{
+		SupportsTools:           &tools,
+		SupportsVision:          &vision,
+		SupportsAudio:           &audio,
+		SupportsJsonMode:        &jsonMode,
+		SupportsStreaming:       &streaming,
+		SupportsMultipleChoices: &multipleChoices,
+		SupportsLogprobs:        &logprobs,
+		MaxContextTokens:        maxContextTokens,
+		MaxOutputTokens:         maxOutputTokens,
+	}
+}
+
+func withAudio(capabilities Capabilities) Capabilities {
+	audio := true
+	capabilities.SupportsAudio = &audio
+	return capabilities
+}
+
+// Capabilities of the known models, keyed by the model name. A key also
+// covers the dated versions of the model, such as gpt-4-0613 and
+// claude-3-5-sonnet@20240620, but not the other models that share its
+// prefix, such as gpt-4.1.
+var builtinCapabilities = map[string]Capabilities{
+	"gpt-4o-audio-preview":      withAudio(capabilities(true, false, true, true, false, 128_000, 16_384)),
+	"gpt-4o-mini-audio-preview": withAudio(capabilities(true, false, true, true, false, 128_000, 16_384)),
+	"gpt-4o":                    capabilities(true, true, true, true, true, 128_000, 16_384),
+	"gpt-4o-mini":               capabilities(true, true, true, true, true, 128_000, 16_384),
+	"gpt-4-turbo":               capabilities(true, true, true, true, true, 128_000, 4_096),
+	"gpt-4-0125-preview":        capabilities(true, false, true, true, true, 128_000, 4_096),
+	"gpt-4-1106-preview":        capabilities(true, false, true, true, true, 128_000, 4_096),
+	"gpt-4":                     capabilities(true, false, false, true, true, 8_192, 8_192),
+	"gpt-3.5-turbo":             capabilities(true, false, true, true, true, 16_385, 4_096),
+	"o1-mini":                   capabilities(false, false, false, true, false, 128_000, 65_536),
+	"o1-preview":                capabilities(false, false, false, true, false, 128_000, 32_768),
+	"o1":                        capabilities(true, true, true, true, false, 200_000, 100_000),
+	"o3":                        capabilities(true, true, true, true, false, 200_000, 100_000),
+	"o3-mini":                   capabilities(true, false, true, true, false, 200_000, 100_000),
+	"o4-mini":                   capabilities(true, true, true, true, false, 200_000, 100_000),
+	"claude-3-opus":             capabilities(true, true, false, false, false, 200_000, 4_096),
+	"claude-3-sonnet":           capabilities(true, true, false, false, false, 200_000, 4_096),
+	"claude-3-haiku":            capabilities(true, true, false, false, false, 200_000, 4_096),
+	"claude-3-5-sonnet":         capabilities(true, true, false, false, false, 200_000, 8_192),
+	"claude-3-5-haiku":          capabilities(true, true, false, false, false, 200_000, 8_192),
+	"claude-3-7-sonnet":         capabilities(true, true, false, false, false, 200_000, 64_000),
+	"gemini-1.0-pro":            capabilities(true, false, false, true, false, 30_720, 2_048),
+	"gemini-1.5-pro":            capabilities(true, true, true, true, false, 2_097_152, 8_192),
+	"gemini-1.5-flash":          capabilities(true, true, true, true, false, 1_048_576, 8_192),
+	"gemini-2.0-flash":          capabilities(true, true, true, true, false, 1_048_576, 8_192),
+	"gemini-2.0-flash-lite":     capabilities(true, true, true, true, false, 1_048_576, 8_192),
+	"gemini-2.5-pro":            capabilities(true, true, true, true, false, 1_048_576, 65_536),
+	"gemini-2.5-flash":          capabilities(true, true, true, true, false, 1_048_576, 65_536),
+}
+
+// Keys of builtinCapabilities, the longest first, so that gpt-4o-mini-2024-07-18
+// is matched by gpt-4o-mini rather than gpt-4o.
+var builtinModelNames = func() []string {
+	names := make([]string, 0, len(builtinCapabilities))
+	for name := range builtinCapabilities {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+	return names
+}()
+
+// Suffix of the versions of a model, made of the dates, revisions, and tags
+// separated by "-" or "@". E.g., -2024-08-06, -0613, -v2@20241022, -latest,
+// and -preview-05-06
+var versionSuffix = regexp.MustCompile(`^([-@]([0-9]+|v[0-9]+|latest|preview|exp))*$`)
+
+// Returns the built-in capabilities of the model. Unknown models have no
+// restriction.
+func BuiltinCapabilities(model string) Capabilities {
+	model = strings.TrimSuffix(model, "@batch")
+	for _, name := range builtinModelNames {
+		if strings.HasPrefix(model, name) && versionSuffix.MatchString(model[len(name):]) {
+			return builtinCapabilities[name]
+		}
+	}
+	return Capabilities{}
+}
+
+// Returns the capabilities of the model, the configured ones taking
+// precedence over the built-in ones field by field.
+func (model *SupportedModel) ResolvedCapabilities() Capabilities {
+	resolved := BuiltinCapabilities(model.Name)
+	configured := model.Capabilities
+	if configured == nil {
+		return resolved
+	}
+	if configured.SupportsTools != nil {
+		resolved.SupportsTools = configured.SupportsTools
+	}
+	if configured.SupportsVision != nil {
+		resolved.SupportsVision = configured.SupportsVision
+	}
+	if configured.SupportsAudio != nil {
+		resolved.SupportsAudio = configured.SupportsAudio
+	}
+	if configured.SupportsJsonMode != nil {
+		resolved.SupportsJsonMode = configured.SupportsJsonMode
+	}
+	if configured.SupportsStreaming != nil {
+		resolved.SupportsStreaming = configured.SupportsStreaming
+	}
+	if configured.SupportsMultipleChoices != nil {
+		resolved.SupportsMultipleChoices = configured.SupportsMultipleChoices
+	}
+	if configured.SupportsLogprobs != nil {
+		resolved.SupportsLogprobs = configured.SupportsLogprobs
+	}
+	if configured.MaxContextTokens != 0 {
+		resolved.MaxContextTokens = configured.MaxContextTokens
+	}
+	if configured.MaxOutputTokens != 0 {
+		resolved.MaxOutputTokens = configured.MaxOutputTokens
+	}
+	return resolved
+}
+
+// Whether the feature is supported. Unset features are assumed supported.
+func supported(feature *bool) bool {
+	return feature == nil || *feature
+}
+
+func (c Capabilities) ToolsSupported() bool {
+	return supported(c.SupportsTools)
+}
+
+func (c Capabilities) VisionSupported() bool {
+	return supported(c.SupportsVision)
+}
+
+func (c Capabilities) AudioSupported() bool {
+	return supported(c.SupportsAudio)
+}
+
+func (c Capabilities) JsonModeSupported() bool {
+	return supported(c.SupportsJsonMode)
+}
+
+func (c Capabilities) StreamingSupported() bool {
+	return supported(c.SupportsStreaming)
+}
+
+func (c Capabilities) MultipleChoicesSupported() bool {
+	return supported(c.SupportsMultipleChoices)
+}
+
+func (c Capabilities) LogprobsSupported() bool {
+	return supported(c.SupportsLogprobs)
+}
@@ -12,10 +12,8 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/rs/cors"
 	"github.com/valkey-io/valkey-go"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 
 	"github.com/yanolja/ogem"
 	"github.com/yanolja/ogem/server"
@@ -53,22 +51,30 @@ func loadConfig(path string, logger *zap.SugaredLogger) (*server.Config, error)
 	}
 
 	// Overrides config with the YAML data.
-	if err := yaml.Unmarshal(configData, &config); err != nil {
+	if err := server.ParseConfig(configData, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %v", err)
 	}
 
 	// Overrides config with environment variables.
 	// Therefore, the values from the environment variables precede the values from the YAML file.
 	config.ValkeyEndpoint = env.OptionalStringVariable("VALKEY_ENDPOINT", config.ValkeyEndpoint)
+	config.StateNamespace = env.OptionalStringVariable("STATE_NAMESPACE", config.StateNamespace)
 	config.OgemApiKey = env.OptionalStringVariable("OPEN_GEMINI_API_KEY", config.OgemApiKey)
 	config.GenaiStudioApiKey = env.OptionalStringVariable("GENAI_STUDIO_API_KEY", config.GenaiStudioApiKey)
 	config.GoogleCloudProject = env.OptionalStringVariable("GOOGLE_CLOUD_PROJECT", config.GoogleCloudProject)
 	config.OpenAiApiKey = env.OptionalStringVariable("OPENAI_API_KEY", config.OpenAiApiKey)
 	config.ClaudeApiKey = env.OptionalStringVariable("CLAUDE_API_KEY", config.ClaudeApiKey)
+	config.OpenRouterApiKey = env.OptionalStringVariable("OPENROUTER_API_KEY", config.OpenRouterApiKey)
+	config.VoyageApiKey = env.OptionalStringVariable("VOYAGE_API_KEY", config.VoyageApiKey)
+	config.CohereApiKey = env.OptionalStringVariable("COHERE_API_KEY", config.CohereApiKey)
+	config.BedrockRoleArn = env.OptionalStringVariable("BEDROCK_ROLE_ARN", config.BedrockRoleArn)
 	config.RetryInterval = env.OptionalStringVariable("RETRY_INTERVAL", config.RetryInterval)
 	config.PingInterval = env.OptionalStringVariable("PING_INTERVAL", config.PingInterval)
 	config.Port = env.OptionalIntVariable("PORT", config.Port)
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%v", err)
+	}
 	return &config, nil
 }
 
@@ -99,24 +105,41 @@ func fetchRemoteConfig(url string, token string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-func setupStateManager(valkeyEndpoint string) (state.Manager, func(), error) {
-	if valkeyEndpoint == "" {
+func setupStateManager(config *server.Config, logger *zap.SugaredLogger) (state.Manager, func(), error) {
+	if config.ValkeyEndpoint == "" {
 		// Maximum memory usage of 2GB.
 		memoryManager, cleanup := state.NewMemoryManager(2 * 1024 * 1024 * 1024)
 		return memoryManager, cleanup, nil
 	}
 
 	valkeyClient, err := valkey.NewClient(valkey.ClientOption{
-		InitAddress: []string{valkeyEndpoint},
+		InitAddress: []string{config.ValkeyEndpoint},
 	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create Valkey client: %v", err)
 	}
-	return state.NewValkeyManager(valkeyClient), nil, nil
+
+	var cooldown time.Duration
+	if config.ValkeyCooldown != "" {
+		if cooldown, err = time.ParseDuration(config.ValkeyCooldown); err != nil {
+			return nil, nil, fmt.Errorf("invalid valkey_cooldown: %v", err)
+		}
+	}
+	resilientManager, cleanup := state.NewResilientManager(
+		state.NewValkeyManagerWithOptions(valkeyClient, state.ValkeyOptions{
+			Namespace:   config.StateNamespace,
+			LegacyReads: config.StateNamespaceFallback,
+		}),
+		config.ValkeyFailureThreshold,
+		cooldown,
+		logger.With("component", "state"),
+	)
+	return resilientManager, cleanup, nil
 }
 
 func main() {
-	logger := utils.Must(zap.NewProduction())
+	loggerConfig := zap.NewProductionConfig()
+	logger := utils.Must(loggerConfig.Build())
 	defer logger.Sync()
 	sugar := logger.Sugar()
 
@@ -126,8 +149,11 @@ func main() {
 	if err != nil {
 		sugar.Fatalw("Failed to load config", "error", err)
 	}
+	if config.Debug {
+		loggerConfig.Level.SetLevel(zap.DebugLevel)
+	}
 
-	stateManager, cleanup, err := setupStateManager(config.ValkeyEndpoint)
+	stateManager, cleanup, err := setupStateManager(config, sugar)
 	if err != nil {
 		sugar.Fatalw("Failed to setup state manager", "error", err)
 	}
@@ -139,22 +165,12 @@ func main() {
 		sugar.Fatalw("Failed to create proxy server", "error", err)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/chat/completions", proxy.HandleAuthentication(proxy.HandleChatCompletions))
-
-	corsMiddleware := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"*"},
-		Debug:          false,
-	})
-
 	port := env.OptionalStringVariable("PORT", "8080")
 	address := fmt.Sprintf(":%s", port)
 
 	httpServer := &http.Server{
 		Addr:    address,
-		Handler: corsMiddleware.Handler(mux),
+		Handler: server.BuildMux(proxy),
 	}
 
 	shutdownSignal := make(chan os.Signal, 1)
@@ -163,12 +179,26 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if pingInterval := proxy.PingInterval(); pingInterval > 0 {
-		sugar.Infow("Starting ping loop", "interval", pingInterval)
-		go proxy.StartPingLoop(ctx)
-	} else {
-		sugar.Infow("Ping loop disabled")
+	// Starts from the health checks of the previous instances until the
+	// first ones of this instance.
+	if restored, err := proxy.RestoreRegionStatus(ctx); err != nil {
+		sugar.Warnw("Failed to restore region status", "error", err)
+	} else if restored > 0 {
+		sugar.Infow("Restored region status", "regions", restored)
 	}
+	go proxy.StartStatusPersistLoop(ctx)
+
+	// The server starts listening during the warm-up so that the readiness
+	// endpoint can report it.
+	go func() {
+		proxy.Warmup(ctx)
+		if pingInterval := proxy.PingInterval(); pingInterval > 0 {
+			sugar.Infow("Starting ping loop", "interval", pingInterval)
+		} else {
+			sugar.Infow("Ping loop disabled")
+		}
+		proxy.StartPingLoop(ctx)
+	}()
 
 	go func() {
 		<-shutdownSignal
@@ -0,0 +1,174 @@
+package e2etest_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem/e2etest"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/server"
+)
+
+// Two keys and two models of the fake provider. The flaky model always fails,
+// and the steady model echoes the last user message for $1 per million
+// tokens.
+const baseConfig = `
+api_keys:
+  - name: search
+    key: search-key
+  - name: ops
+    key: ops-key
+    admin: true
+providers:
+  fake:
+    regions:
+      flaky:
+        fake:
+          error_rate: 1
+        models:
+          - name: flaky-model
+      steady:
+        models:
+          - name: steady-model
+            input_price: 1
+            output_price: 1
+`
+
+const hello = `{"model": "steady-model", "messages": [{"role": "user", "content": "Hello there"}]}`
+
+func TestAuthentication(t *testing.T) {
+	t.Parallel()
+	harness := e2etest.Start(t, e2etest.Options{Config: baseConfig})
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		apiKey string
+		status int
+		code   string
+	}{
+		{"Missing key", "/v1/chat/completions", "", http.StatusUnauthorized, "missing_api_key"},
+		{"Unknown key", "/v1/chat/completions", "other-key", http.StatusUnauthorized, "invalid_api_key"},
+		{"Key", "/v1/chat/completions", "search-key", http.StatusOK, ""},
+		{"Admin key", "/v1/chat/completions", "ops-key", http.StatusOK, ""},
+		{"Key on an admin endpoint", "/v1/admin/limits", "search-key", http.StatusForbidden, "admin_required"},
+		{"Admin key on an admin endpoint", "/v1/admin/limits", "ops-key", http.StatusOK, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var response *e2etest.Response
+			if strings.HasPrefix(test.path, "/v1/admin/") {
+				response = harness.Get(t, test.path, test.apiKey)
+			} else {
+				response = harness.Post(t, test.path, test.apiKey, hello)
+			}
+			assert.Equal(t, test.status, response.Status, string(response.Body))
+			assert.Equal(t, test.code, response.ErrorCode())
+		})
+	}
+
+	response := harness.Post(t, "/v1/admin/keys/search/revoke", "ops-key", "")
+	assert.Equal(t, http.StatusOK, response.Status, string(response.Body))
+	response = harness.Post(t, "/v1/chat/completions", "search-key", hello)
+	assert.Equal(t, http.StatusUnauthorized, response.Status)
+	assert.Equal(t, "key_revoked", response.ErrorCode())
+}
+
+func TestChatWithFailover(t *testing.T) {
+	t.Parallel()
+	harness := e2etest.Start(t, e2etest.Options{Config: baseConfig})
+
+	response := harness.Post(t, "/v1/chat/completions", "search-key", `{"model": "flaky-model,steady-model", "messages": [{"role": "user", "content": "Hello there"}]}`)
+	assert.Equal(t, http.StatusOK, response.Status, string(response.Body))
+	assert.Equal(t, "fake/steady/steady-model", response.Header.Get("X-Ogem-Resolved-Model"))
+	var completion openai.ChatCompletionResponse
+	response.Json(t, &completion)
+	assert.Equal(t, "Hello there", *completion.Choices[0].Message.Content.String)
+
+	response = harness.Post(t, "/v1/chat/completions", "search-key", `{"model": "flaky-model", "messages": [{"role": "user", "content": "Hello there"}]}`)
+	assert.Equal(t, http.StatusInternalServerError, response.Status)
+}
+
+func TestStreaming(t *testing.T) {
+	t.Parallel()
+	harness := e2etest.Start(t, e2etest.Options{Config: baseConfig})
+
+	response := harness.Post(t, "/v1/completions", "search-key", `{"model": "steady-model", "prompt": "Hello there", "stream": true}`)
+	assert.Equal(t, http.StatusOK, response.Status, string(response.Body))
+	assert.True(t, strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream"))
+	events := strings.Split(strings.TrimSpace(string(response.Body)), "\n\n")
+	assert.Greater(t, len(events), 1)
+	assert.Contains(t, events[0], "Hello there")
+	assert.Equal(t, "data: [DONE]", events[len(events)-1])
+}
+
+func TestCacheHit(t *testing.T) {
+	t.Parallel()
+	// The cache is shared through Valkey.
+	harness := e2etest.Start(t, e2etest.Options{Config: baseConfig, Valkey: true})
+
+	request := `{"model": "steady-model", "temperature": 0, "messages": [{"role": "user", "content": "Hello there"}]}`
+	first := harness.Post(t, "/v1/chat/completions", "search-key", request)
+	second := harness.Post(t, "/v1/chat/completions", "search-key", request)
+	assert.Equal(t, http.StatusOK, second.Status, string(second.Body))
+	assert.Equal(t, string(first.Body), string(second.Body))
+	assert.NotEmpty(t, harness.Valkey.Keys())
+
+	var savings server.CacheSavingsResponse
+	harness.Get(t, "/v1/admin/cache-savings", "ops-key").Json(t, &savings)
+	assert.Len(t, savings.Savings, 1)
+	assert.Equal(t, "search", savings.Savings[0].ApiKey)
+	assert.Equal(t, int64(1), savings.Savings[0].Requests)
+	assert.Positive(t, savings.Savings[0].CostSaved)
+}
+
+func TestEndUserRateLimit(t *testing.T) {
+	t.Parallel()
+	harness := e2etest.Start(t, e2etest.Options{Config: baseConfig + `
+end_user_limits:
+  requests_per_day: 2
+`})
+
+	request := `{"model": "steady-model", "user": "user-1", "messages": [{"role": "user", "content": "Hello there"}]}`
+	for range 2 {
+		response := harness.Post(t, "/v1/chat/completions", "search-key", request)
+		assert.Equal(t, http.StatusOK, response.Status, string(response.Body))
+	}
+	response := harness.Post(t, "/v1/chat/completions", "search-key", request)
+	assert.Equal(t, http.StatusTooManyRequests, response.Status)
+	assert.Equal(t, "end_user_quota_exceeded", response.ErrorCode())
+
+	// Other users are not limited.
+	response = harness.Post(t, "/v1/chat/completions", "search-key", strings.Replace(request, "user-1", "user-2", 1))
+	assert.Equal(t, http.StatusOK, response.Status, string(response.Body))
+}
+
+func TestEndUserBudget(t *testing.T) {
+	t.Parallel()
+	// A request of about 10 tokens costs $0.00001.
+	harness := e2etest.Start(t, e2etest.Options{Config: baseConfig + `
+end_user_limits:
+  cost_per_day: 0.00002
+`})
+
+	request := `{"model": "steady-model", "user": "user-1", "messages": [{"role": "user", "content": "Hello there, how are you today?"}]}`
+	served := 0
+	for range 10 {
+		response := harness.Post(t, "/v1/chat/completions", "search-key", request)
+		if response.Status != http.StatusOK {
+			assert.Equal(t, http.StatusTooManyRequests, response.Status)
+			assert.Equal(t, "end_user_quota_exceeded", response.ErrorCode())
+			break
+		}
+		served++
+	}
+	assert.Positive(t, served)
+	assert.Less(t, served, 10)
+
+	var usage server.EndUserUsage
+	harness.Get(t, "/v1/admin/end-users/user-1/usage", "ops-key").Json(t, &usage)
+	assert.GreaterOrEqual(t, usage.Cost, 0.00002)
+	assert.Equal(t, int64(served), usage.Requests)
+}
@@ -0,0 +1,167 @@
+// Package e2etest runs the assembled proxy over HTTP for the end-to-end
+// tests: the routes of the server binary, a state manager, and the fake
+// provider configured in YAML, without any provider keys.
+//
+//	harness := e2etest.Start(t, e2etest.Options{Config: config})
+//	response := harness.Post(t, "/v1/chat/completions", "key", `{...}`)
+package e2etest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/goccy/go-json"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/server"
+	"github.com/yanolja/ogem/state"
+)
+
+type Options struct {
+	// Config in YAML, over the defaults of the harness. The providers are
+	// usually regions of the fake provider.
+	Config string
+
+	// Whether to keep the state in Valkey, served by miniredis, rather than
+	// in memory.
+	Valkey bool
+}
+
+// Proxy serving on a port of its own, stopped at the end of the test.
+type Harness struct {
+	// Base URL of the server. E.g., http://127.0.0.1:54321
+	Url string
+
+	Proxy *server.ModelProxy
+
+	// Nil unless the state is kept in Valkey.
+	Valkey *miniredis.Miniredis
+
+	client *http.Client
+}
+
+// Response read in full.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Starts the proxy with the config. Fails the test if the config is invalid.
+// Each harness listens on a port picked by the system, so the tests can run
+// in parallel.
+func Start(t testing.TB, options Options) *Harness {
+	t.Helper()
+	// Defaults of the server binary, except for the intervals that the tests
+	// would wait for.
+	config := server.Config{
+		RetryInterval: "100ms",
+		PingInterval:  "0s",
+		Port:          8080,
+		Providers:     ogem.ProvidersStatus{},
+	}
+	if err := server.ParseConfig([]byte(options.Config), &config); err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Invalid config:\n%v", err)
+	}
+
+	harness := &Harness{}
+	var stateManager state.Manager
+	var cleanup func()
+	if options.Valkey {
+		harness.Valkey = miniredis.RunT(t)
+		client, err := valkey.NewClient(valkey.ClientOption{InitAddress: []string{harness.Valkey.Addr()}, DisableCache: true})
+		if err != nil {
+			t.Fatalf("Failed to connect to miniredis: %v", err)
+		}
+		stateManager, cleanup = state.NewValkeyManager(client), client.Close
+	} else {
+		stateManager, cleanup = state.NewMemoryManager(64 * 1024 * 1024)
+	}
+
+	proxy, err := server.NewProxyServer(stateManager, cleanup, config, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	httpServer := httptest.NewServer(server.BuildMux(proxy))
+	t.Cleanup(func() {
+		httpServer.Close()
+		proxy.Shutdown()
+	})
+
+	harness.Url = httpServer.URL
+	harness.Proxy = proxy
+	harness.client = httpServer.Client()
+	return harness
+}
+
+// Sends the request with the API key, if any, and the headers given as
+// name and value pairs. Fails the test if the server cannot be reached.
+func (h *Harness) Do(t testing.TB, method string, path string, apiKey string, body string, headers ...string) *Response {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	request, err := http.NewRequest(method, h.Url+path, reader)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	for index := 0; index+1 < len(headers); index += 2 {
+		request.Header.Set(headers[index], headers[index+1])
+	}
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to send %s %s: %v", method, path, err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response of %s %s: %v", method, path, err)
+	}
+	return &Response{Status: response.StatusCode, Header: response.Header, Body: data}
+}
+
+func (h *Harness) Get(t testing.TB, path string, apiKey string, headers ...string) *Response {
+	t.Helper()
+	return h.Do(t, http.MethodGet, path, apiKey, "", headers...)
+}
+
+func (h *Harness) Post(t testing.TB, path string, apiKey string, body string, headers ...string) *Response {
+	t.Helper()
+	return h.Do(t, http.MethodPost, path, apiKey, body, headers...)
+}
+
+// Decodes the body into the value. Fails the test if it is not JSON.
+func (r *Response) Json(t testing.TB, value any) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, value); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", r.Body, err)
+	}
+}
+
+// Returns the code of the error in the body. Empty if there is none.
+func (r *Response) ErrorCode() string {
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(r.Body, &body)
+	return body.Error.Code
+}
@@ -0,0 +1,208 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Transforms the chat completion requests before they are routed, and their
+// responses before they are returned to the caller.
+type Hook interface {
+	// Called before the request is routed, and may modify it in place. An
+	// error rejects the request with 400.
+	PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error
+
+	// Called with the response before it is returned, and may modify it in
+	// place. An error is logged, and the response is returned as is.
+	PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error
+}
+
+// Creates a hook from its settings in the config. The settings are empty if
+// not configured.
+type Factory func(settings *yaml.Node) (Hook, error)
+
+type Config struct {
+	// Name of the registered hook. E.g., system_prompt
+	Name string `yaml:"name"`
+
+	// Names of the API keys whose requests the hook applies to. Empty for all
+	// the requests.
+	Keys []string `yaml:"keys"`
+
+	// Settings of the hook, which depend on the hook.
+	Settings yaml.Node `yaml:"settings"`
+}
+
+var (
+	factories = map[string]Factory{
+		"system_prompt":  newSystemPrompt,
+		"tool_allowlist": newToolAllowlist,
+	}
+	factoriesMutex sync.RWMutex
+)
+
+// Registers a hook that the config can refer to by name. Must be called
+// before the proxy is created. Replaces the hook of the same name, including
+// the built-in ones.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	factories[name] = factory
+}
+
+func lookup(name string) (Factory, bool) {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	factory, found := factories[name]
+	return factory, found
+}
+
+func registeredNames() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decodes the settings into the value, rejecting unknown keys so that a typo
+// does not silently disable a setting.
+func decodeSettings(settings *yaml.Node, value any) error {
+	if settings == nil || settings.Kind == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	return decoder.Decode(value)
+}
+
+// Returns all problems of the configs joined into one error, each prefixed
+// with its YAML path relative to the list. E.g., "[0].settings: prompt is required"
+func Validate(configs []Config) error {
+	problems := []error{}
+	for index, config := range configs {
+		if config.Name == "" {
+			problems = append(problems, fmt.Errorf("[%d].name: is required", index))
+			continue
+		}
+		factory, found := lookup(config.Name)
+		if !found {
+			problems = append(problems, fmt.Errorf("[%d].name: unknown hook %q; must be one of %v", index, config.Name, registeredNames()))
+			continue
+		}
+		if _, err := factory(&config.Settings); err != nil {
+			problems = append(problems, fmt.Errorf("[%d].settings: %v", index, err))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+type registeredHook struct {
+	name string
+	hook Hook
+
+	// Names of the API keys the hook applies to. Nil for all.
+	keys []string
+}
+
+func (h registeredHook) appliesTo(ctx context.Context) bool {
+	return h.keys == nil || slices.Contains(h.keys, KeyName(ctx))
+}
+
+// Hooks run in the order of the config, followed by the ones added in code.
+// A nil chain runs no hook.
+type Chain struct {
+	hooks  []registeredHook
+	logger *zap.SugaredLogger
+}
+
+// Creates the hooks of the configs in order.
+func NewChain(configs []Config, logger *zap.SugaredLogger) (*Chain, error) {
+	if err := Validate(configs); err != nil {
+		return nil, fmt.Errorf("invalid hooks config: %v", err)
+	}
+	chain := &Chain{logger: logger}
+	for _, config := range configs {
+		factory, _ := lookup(config.Name)
+		hook, err := factory(&config.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: %v", config.Name, err)
+		}
+		var keys []string
+		if len(config.Keys) > 0 {
+			keys = config.Keys
+		}
+		chain.hooks = append(chain.hooks, registeredHook{name: config.Name, hook: hook, keys: keys})
+	}
+	return chain, nil
+}
+
+// Appends the hook, which applies to all the requests. Not safe for
+// concurrent use with the requests, so must be called before serving them.
+func (c *Chain) Add(name string, hook Hook) {
+	c.hooks = append(c.hooks, registeredHook{name: name, hook: hook})
+}
+
+// Runs PreRequest of each hook in order, stopping at the first error.
+func (c *Chain) PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	if c == nil {
+		return nil
+	}
+	for _, hook := range c.hooks {
+		if !hook.appliesTo(ctx) {
+			continue
+		}
+		if err := hook.hook.PreRequest(ctx, request); err != nil {
+			return fmt.Errorf("%s: %v", hook.name, err)
+		}
+	}
+	return nil
+}
+
+// Runs PostResponse of each hook in order. Errors are logged, and the
+// remaining hooks still run.
+func (c *Chain) PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) {
+	if c == nil {
+		return
+	}
+	for _, hook := range c.hooks {
+		if !hook.appliesTo(ctx) {
+			continue
+		}
+		if err := hook.hook.PostResponse(ctx, request, response); err != nil {
+			c.logger.Warnw("Hook failed to process the response", "hook", hook.name, "error", err, "api_key", KeyName(ctx))
+		}
+	}
+}
+
+type keyNameContextKey struct{}
+
+// Returns a context that tells the hooks the name of the API key of the
+// request.
+func WithKeyName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, keyNameContextKey{}, name)
+}
+
+// Returns the name of the API key of the request. Empty if the proxy does
+// not require API keys.
+func KeyName(ctx context.Context) string {
+	name, _ := ctx.Value(keyNameContextKey{}).(string)
+	return name
+}
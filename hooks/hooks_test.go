@@ -0,0 +1,221 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+// Records its name in the user field, so that the order of the hooks shows.
+type recordingHook struct {
+	name       string
+	preError   error
+	postError  error
+	postCalled bool
+}
+
+func (h *recordingHook) PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	if h.preError != nil {
+		return h.preError
+	}
+	user := ""
+	if request.User != nil {
+		user = *request.User
+	}
+	request.User = utils.ToPtr(user + h.name)
+	return nil
+}
+
+func (h *recordingHook) PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error {
+	h.postCalled = true
+	response.Id += h.name
+	return h.postError
+}
+
+func parseConfigs(t *testing.T, data string) []Config {
+	var configs []Config
+	assert.NoError(t, yaml.Unmarshal([]byte(data), &configs))
+	return configs
+}
+
+func newRequest(messages ...openai.Message) *openai.ChatCompletionRequest {
+	return &openai.ChatCompletionRequest{Model: "gpt-4o", Messages: messages}
+}
+
+func userMessage(text string) openai.Message {
+	return openai.Message{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr(text)}}
+}
+
+func tool(name string) openai.Tool {
+	return openai.Tool{Type: "function", Function: openai.FunctionTool{Name: name}}
+}
+
+func TestChain(t *testing.T) {
+	t.Run("Runs the hooks in order", func(t *testing.T) {
+		chain, err := NewChain(nil, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+		chain.Add("a", &recordingHook{name: "a"})
+		chain.Add("b", &recordingHook{name: "b"})
+
+		request := newRequest(userMessage("Hi"))
+		assert.NoError(t, chain.PreRequest(context.Background(), request))
+		assert.Equal(t, "ab", *request.User)
+
+		response := &openai.ChatCompletionResponse{Id: "chatcmpl-"}
+		chain.PostResponse(context.Background(), request, response)
+		assert.Equal(t, "chatcmpl-ab", response.Id)
+	})
+
+	t.Run("Stops at the first error of PreRequest", func(t *testing.T) {
+		chain, _ := NewChain(nil, zap.NewNop().Sugar())
+		chain.Add("a", &recordingHook{name: "a"})
+		chain.Add("reject", &recordingHook{name: "reject", preError: errors.New("not today")})
+		chain.Add("c", &recordingHook{name: "c"})
+
+		request := newRequest(userMessage("Hi"))
+		err := chain.PreRequest(context.Background(), request)
+		assert.EqualError(t, err, "reject: not today")
+		assert.Equal(t, "a", *request.User)
+	})
+
+	t.Run("Continues after an error of PostResponse", func(t *testing.T) {
+		chain, _ := NewChain(nil, zap.NewNop().Sugar())
+		failing := &recordingHook{name: "a", postError: errors.New("broken")}
+		next := &recordingHook{name: "b"}
+		chain.Add("a", failing)
+		chain.Add("b", next)
+
+		response := &openai.ChatCompletionResponse{}
+		chain.PostResponse(context.Background(), newRequest(), response)
+		assert.True(t, next.postCalled)
+		assert.Equal(t, "ab", response.Id)
+	})
+
+	t.Run("A nil chain runs nothing", func(t *testing.T) {
+		var chain *Chain
+		assert.NoError(t, chain.PreRequest(context.Background(), newRequest()))
+		chain.PostResponse(context.Background(), newRequest(), &openai.ChatCompletionResponse{})
+	})
+
+	t.Run("Creates the hooks of the config in order", func(t *testing.T) {
+		chain, err := NewChain(parseConfigs(t, `
+- name: system_prompt
+  settings:
+    prompt: Be brief.
+- name: system_prompt
+  keys: [search-team]
+  settings:
+    prompt: You work for the search team.
+`), zap.NewNop().Sugar())
+		assert.NoError(t, err)
+
+		request := newRequest(userMessage("Hi"))
+		assert.NoError(t, chain.PreRequest(WithKeyName(context.Background(), "search-team"), request))
+		assert.Len(t, request.Messages, 3)
+		assert.Equal(t, "You work for the search team.", *request.Messages[0].Content.String)
+		assert.Equal(t, "Be brief.", *request.Messages[1].Content.String)
+
+		request = newRequest(userMessage("Hi"))
+		assert.NoError(t, chain.PreRequest(WithKeyName(context.Background(), "batch"), request))
+		assert.Len(t, request.Messages, 2)
+		assert.Equal(t, "Be brief.", *request.Messages[0].Content.String)
+	})
+
+	t.Run("Uses the registered hooks", func(t *testing.T) {
+		Register("test_recording", func(settings *yaml.Node) (Hook, error) {
+			var config struct {
+				Name string `yaml:"name"`
+			}
+			if err := decodeSettings(settings, &config); err != nil {
+				return nil, err
+			}
+			return &recordingHook{name: config.Name}, nil
+		})
+		chain, err := NewChain(parseConfigs(t, `
+- name: test_recording
+  settings:
+    name: x
+`), zap.NewNop().Sugar())
+		assert.NoError(t, err)
+
+		request := newRequest(userMessage("Hi"))
+		assert.NoError(t, chain.PreRequest(context.Background(), request))
+		assert.Equal(t, "x", *request.User)
+	})
+
+	t.Run("Reports the problems of the config", func(t *testing.T) {
+		err := Validate(parseConfigs(t, `
+- settings:
+    prompt: Be brief.
+- name: unknown
+- name: system_prompt
+- name: tool_allowlist
+  settings:
+    tools: [search]
+    tool: [book]
+`))
+		assert.ErrorContains(t, err, "[0].name: is required")
+		assert.ErrorContains(t, err, `[1].name: unknown hook "unknown"`)
+		assert.ErrorContains(t, err, "[2].settings: prompt is required")
+		assert.ErrorContains(t, err, "[3].settings: yaml: unmarshal errors")
+
+		_, err = NewChain(parseConfigs(t, "- name: unknown"), zap.NewNop().Sugar())
+		assert.ErrorContains(t, err, "invalid hooks config")
+	})
+}
+
+func TestToolAllowlist(t *testing.T) {
+	allowlist := &toolAllowlist{Tools: []string{"search_hotels", "get_reservation"}}
+
+	t.Run("Removes the tools that are not allowed", func(t *testing.T) {
+		request := newRequest(userMessage("Hi"))
+		request.Tools = []openai.Tool{tool("search_hotels"), tool("cancel_reservation"), tool("get_reservation")}
+		request.Functions = []openai.LegacyFunction{{Name: "cancel_reservation"}}
+		request.FunctionCall = &openai.LegacyFunctionChoice{Value: utils.ToPtr("auto")}
+
+		assert.NoError(t, allowlist.PreRequest(context.Background(), request))
+		assert.Equal(t, []openai.Tool{tool("search_hotels"), tool("get_reservation")}, request.Tools)
+		assert.Nil(t, request.Functions)
+		assert.Nil(t, request.FunctionCall)
+	})
+
+	t.Run("Drops the tool choice without tools", func(t *testing.T) {
+		request := newRequest(userMessage("Hi"))
+		request.Tools = []openai.Tool{tool("cancel_reservation")}
+		request.ToolChoice = &openai.ToolChoice{Value: utils.ToPtr(openai.ToolChoiceAuto)}
+
+		assert.NoError(t, allowlist.PreRequest(context.Background(), request))
+		assert.Nil(t, request.Tools)
+		assert.Nil(t, request.ToolChoice)
+	})
+
+	t.Run("Rejects forced calls of the tools that are not allowed", func(t *testing.T) {
+		request := newRequest(userMessage("Hi"))
+		request.Tools = []openai.Tool{tool("search_hotels"), tool("cancel_reservation")}
+		request.ToolChoice = &openai.ToolChoice{Struct: &openai.ToolChoiceStruct{Type: "function", Function: &openai.Function{Name: "cancel_reservation"}}}
+		assert.EqualError(t, allowlist.PreRequest(context.Background(), request), "tool cancel_reservation is not allowed")
+
+		request = newRequest(userMessage("Hi"))
+		request.Tools = []openai.Tool{tool("cancel_reservation")}
+		request.ToolChoice = &openai.ToolChoice{Value: utils.ToPtr(openai.ToolChoiceRequired)}
+		assert.ErrorContains(t, allowlist.PreRequest(context.Background(), request), "a tool call is required")
+
+		request = newRequest(userMessage("Hi"))
+		request.Functions = []openai.LegacyFunction{{Name: "cancel_reservation"}}
+		request.FunctionCall = &openai.LegacyFunctionChoice{Function: &openai.Function{Name: "cancel_reservation"}}
+		assert.EqualError(t, allowlist.PreRequest(context.Background(), request), "function cancel_reservation is not allowed")
+	})
+
+	t.Run("Leaves requests without tools", func(t *testing.T) {
+		request := newRequest(userMessage("Hi"))
+		assert.NoError(t, allowlist.PreRequest(context.Background(), request))
+		assert.Nil(t, request.Tools)
+	})
+}
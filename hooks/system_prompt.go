@@ -0,0 +1,40 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Puts a system prompt before the messages of the request, such as the
+// policies of an organization. Settings:
+//
+//	prompt: Never share the personal data of the guests.
+type systemPrompt struct {
+	Prompt string `yaml:"prompt"`
+}
+
+func newSystemPrompt(settings *yaml.Node) (Hook, error) {
+	hook := &systemPrompt{}
+	if err := decodeSettings(settings, hook); err != nil {
+		return nil, err
+	}
+	if hook.Prompt == "" {
+		return nil, fmt.Errorf("prompt is required")
+	}
+	return hook, nil
+}
+
+func (h *systemPrompt) PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	prompt := h.Prompt
+	message := openai.Message{Role: "system", Content: &openai.MessageContent{String: &prompt}}
+	request.Messages = append([]openai.Message{message}, request.Messages...)
+	return nil
+}
+
+func (h *systemPrompt) PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Removes the tools and the legacy functions that are not allowed from the
+// request. Rejects the request if it forces the model to call one of them.
+// Settings:
+//
+//	tools: [search_hotels, get_reservation]
+type toolAllowlist struct {
+	Tools []string `yaml:"tools"`
+}
+
+func newToolAllowlist(settings *yaml.Node) (Hook, error) {
+	hook := &toolAllowlist{}
+	if err := decodeSettings(settings, hook); err != nil {
+		return nil, err
+	}
+	for index, tool := range hook.Tools {
+		if tool == "" {
+			return nil, fmt.Errorf("tools[%d] is empty", index)
+		}
+	}
+	return hook, nil
+}
+
+func (h *toolAllowlist) allowed(name string) bool {
+	return slices.Contains(h.Tools, name)
+}
+
+func (h *toolAllowlist) PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	if request.ToolChoice != nil && request.ToolChoice.Struct != nil && request.ToolChoice.Struct.Function != nil {
+		if name := request.ToolChoice.Struct.Function.Name; !h.allowed(name) {
+			return fmt.Errorf("tool %s is not allowed", name)
+		}
+	}
+	if request.FunctionCall != nil && request.FunctionCall.Function != nil {
+		if name := request.FunctionCall.Function.Name; !h.allowed(name) {
+			return fmt.Errorf("function %s is not allowed", name)
+		}
+	}
+
+	if request.Tools != nil {
+		request.Tools = slices.DeleteFunc(request.Tools, func(tool openai.Tool) bool {
+			return !h.allowed(tool.Function.Name)
+		})
+		if len(request.Tools) == 0 {
+			if request.ToolChoice != nil && request.ToolChoice.Value != nil && *request.ToolChoice.Value == openai.ToolChoiceRequired {
+				return fmt.Errorf("none of the tools is allowed, but a tool call is required")
+			}
+			request.Tools = nil
+			request.ToolChoice = nil
+		}
+	}
+	if request.Functions != nil {
+		request.Functions = slices.DeleteFunc(request.Functions, func(function openai.LegacyFunction) bool {
+			return !h.allowed(function.Name)
+		})
+		if len(request.Functions) == 0 {
+			request.Functions = nil
+			request.FunctionCall = nil
+		}
+	}
+	return nil
+}
+
+func (h *toolAllowlist) PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error {
+	return nil
+}
@@ -0,0 +1,325 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validates the document against the schema. Supports the keywords that the
+// providers accept for the function parameters: type, properties, required,
+// additionalProperties, items, enum, const, the numeric, length and item
+// count bounds, pattern, allOf, anyOf, oneOf, nullable, and $ref within the
+// schema. Other keywords, such as format, are ignored.
+//
+// Returns the problems of the document, each prefixed with the path of the
+// value, e.g., "$.location.city: must be a string". Empty if it is valid. An
+// error is only returned for a schema that is not JSON.
+func Validate(schema []byte, document []byte) ([]string, error) {
+	var root any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	var value any
+	if err := json.Unmarshal(document, &value); err != nil {
+		return []string{fmt.Sprintf("$: invalid JSON: %v", err)}, nil
+	}
+	validator := &validator{root: root}
+	validator.validate("$", root, value)
+	return validator.problems, nil
+}
+
+type validator struct {
+	root     any
+	problems []string
+}
+
+func (v *validator) addProblem(path string, format string, args ...any) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Returns the problems of the value without adding them, for the subschemas
+// of anyOf and oneOf.
+func (v *validator) check(path string, schema any, value any) []string {
+	nested := &validator{root: v.root}
+	nested.validate(path, schema, value)
+	return nested.problems
+}
+
+func (v *validator) validate(path string, schema any, value any) {
+	// true accepts everything, and false nothing.
+	if accepted, ok := schema.(bool); ok {
+		if !accepted {
+			v.addProblem(path, "is not allowed")
+		}
+		return
+	}
+	object, ok := schema.(map[string]any)
+	if !ok {
+		return
+	}
+	if ref, ok := object["$ref"].(string); ok {
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			v.addProblem(path, "%v", err)
+			return
+		}
+		v.validate(path, resolved, value)
+		return
+	}
+	if value == nil && object["nullable"] == true {
+		return
+	}
+
+	if types := schemaTypes(object["type"]); len(types) > 0 && !matchesAnyType(types, value) {
+		v.addProblem(path, "must be %s", describeTypes(types))
+		return
+	}
+	if enum, ok := object["enum"].([]any); ok && !containsValue(enum, value) {
+		v.addProblem(path, "must be one of %s", describeValues(enum))
+	}
+	if constant, ok := object["const"]; ok && !reflect.DeepEqual(constant, value) {
+		v.addProblem(path, "must be %s", describeValue(constant))
+	}
+
+	switch typed := value.(type) {
+	case map[string]any:
+		v.validateObject(path, object, typed)
+	case []any:
+		v.validateArray(path, object, typed)
+	case string:
+		v.validateString(path, object, typed)
+	case float64:
+		v.validateNumber(path, object, typed)
+	}
+
+	if allOf, ok := object["allOf"].([]any); ok {
+		for _, subschema := range allOf {
+			v.validate(path, subschema, value)
+		}
+	}
+	if anyOf, ok := object["anyOf"].([]any); ok {
+		v.validateAlternatives(path, anyOf, value, false)
+	}
+	if oneOf, ok := object["oneOf"].([]any); ok {
+		v.validateAlternatives(path, oneOf, value, true)
+	}
+}
+
+func (v *validator) validateObject(path string, schema map[string]any, value map[string]any) {
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, found := value[name]; !found {
+					v.addProblem(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	// Sorted so that the problems are reported in the same order every time.
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertyPath := path + "." + name
+		if property, found := properties[name]; found {
+			v.validate(propertyPath, property, value[name])
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.addProblem(path, "unexpected property %q", name)
+			}
+		case map[string]any:
+			v.validate(propertyPath, additional, value[name])
+		}
+	}
+}
+
+func (v *validator) validateArray(path string, schema map[string]any, value []any) {
+	if minItems, ok := schema["minItems"].(float64); ok && float64(len(value)) < minItems {
+		v.addProblem(path, "must have at least %v items", minItems)
+	}
+	if maxItems, ok := schema["maxItems"].(float64); ok && float64(len(value)) > maxItems {
+		v.addProblem(path, "must have at most %v items", maxItems)
+	}
+	if items, ok := schema["items"]; ok {
+		for index, item := range value {
+			v.validate(fmt.Sprintf("%s[%d]", path, index), items, item)
+		}
+	}
+}
+
+func (v *validator) validateString(path string, schema map[string]any, value string) {
+	length := float64(utf8.RuneCountInString(value))
+	if minLength, ok := schema["minLength"].(float64); ok && length < minLength {
+		v.addProblem(path, "must be at least %v characters long", minLength)
+	}
+	if maxLength, ok := schema["maxLength"].(float64); ok && length > maxLength {
+		v.addProblem(path, "must be at most %v characters long", maxLength)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		// Patterns that Go cannot compile, such as those with lookarounds,
+		// are ignored rather than failing every value.
+		if compiled, err := regexp.Compile(pattern); err == nil && !compiled.MatchString(value) {
+			v.addProblem(path, "must match the pattern %q", pattern)
+		}
+	}
+}
+
+func (v *validator) validateNumber(path string, schema map[string]any, value float64) {
+	if minimum, ok := schema["minimum"].(float64); ok && value < minimum {
+		v.addProblem(path, "must be at least %v", minimum)
+	}
+	if maximum, ok := schema["maximum"].(float64); ok && value > maximum {
+		v.addProblem(path, "must be at most %v", maximum)
+	}
+	if minimum, ok := schema["exclusiveMinimum"].(float64); ok && value <= minimum {
+		v.addProblem(path, "must be greater than %v", minimum)
+	}
+	if maximum, ok := schema["exclusiveMaximum"].(float64); ok && value >= maximum {
+		v.addProblem(path, "must be less than %v", maximum)
+	}
+}
+
+// Reports the problems of the closest alternative if none matches, since
+// those are the ones the model most likely has to fix. The alternatives of
+// the same type as the value are closer than any of another type.
+func (v *validator) validateAlternatives(path string, alternatives []any, value any, exactlyOne bool) {
+	matched := 0
+	var closest []string
+	closestTyped := false
+	for _, alternative := range alternatives {
+		problems := v.check(path, alternative, value)
+		if len(problems) == 0 {
+			matched++
+			continue
+		}
+		object, _ := alternative.(map[string]any)
+		types := schemaTypes(object["type"])
+		typed := len(types) == 0 || matchesAnyType(types, value)
+		if closest == nil || (typed && !closestTyped) || (typed == closestTyped && len(problems) < len(closest)) {
+			closest = problems
+			closestTyped = typed
+		}
+	}
+	switch {
+	case matched == 0 && len(alternatives) > 0:
+		v.addProblem(path, "must match one of the %d alternatives", len(alternatives))
+		v.problems = append(v.problems, closest...)
+	case exactlyOne && matched > 1:
+		v.addProblem(path, "must match exactly one of the alternatives, but matches %d", matched)
+	}
+}
+
+// Resolves a reference within the schema, e.g., "#/$defs/location".
+func (v *validator) resolve(ref string) (any, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+	current := v.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolved reference %q", ref)
+		}
+		if current, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolved reference %q", ref)
+		}
+	}
+	return current, nil
+}
+
+func schemaTypes(value any) []string {
+	switch typed := value.(type) {
+	case string:
+		return []string{typed}
+	case []any:
+		types := []string{}
+		for _, item := range typed {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func matchesAnyType(types []string, value any) bool {
+	for _, name := range types {
+		if matchesType(name, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(name string, value any) bool {
+	switch typed := value.(type) {
+	case nil:
+		return name == "null"
+	case bool:
+		return name == "boolean"
+	case float64:
+		return name == "number" || (name == "integer" && typed == math.Trunc(typed))
+	case string:
+		return name == "string"
+	case []any:
+		return name == "array"
+	case map[string]any:
+		return name == "object"
+	}
+	return false
+}
+
+func describeTypes(types []string) string {
+	described := make([]string, len(types))
+	for index, name := range types {
+		switch name {
+		case "array", "integer", "object":
+			described[index] = "an " + name
+		case "null":
+			described[index] = "null"
+		default:
+			described[index] = "a " + name
+		}
+	}
+	return strings.Join(described, " or ")
+}
+
+func containsValue(values []any, value any) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func describeValues(values []any) string {
+	described := make([]string, len(values))
+	for index, value := range values {
+		described[index] = describeValue(value)
+	}
+	return strings.Join(described, ", ")
+}
+
+func describeValue(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,110 @@
+package jsonschema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const weatherSchema = `{
+	"type": "object",
+	"properties": {
+		"location": {"$ref": "#/$defs/location"},
+		"unit": {"type": "string", "enum": ["celsius", "fahrenheit"]},
+		"days": {"type": "integer", "minimum": 1, "maximum": 7},
+		"hours": {"type": "array", "items": {"type": "integer"}, "maxItems": 2},
+		"note": {"type": ["string", "null"], "maxLength": 5}
+	},
+	"required": ["location"],
+	"additionalProperties": false,
+	"$defs": {
+		"location": {
+			"type": "object",
+			"properties": {"city": {"type": "string", "pattern": "^[A-Z]"}},
+			"required": ["city"]
+		}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		schema   string
+		document string
+		expected []string
+	}{
+		{
+			"Accepts valid arguments",
+			weatherSchema,
+			`{"location": {"city": "Seoul"}, "unit": "celsius", "days": 3, "hours": [9, 18], "note": null}`,
+			nil,
+		},
+		{
+			"Reports every problem with its path",
+			weatherSchema,
+			`{"location": {"city": "seoul"}, "unit": "kelvin", "days": 1.5, "hours": [9, "noon", 18], "note": "too long", "extra": true}`,
+			[]string{
+				`$.days: must be an integer`,
+				`$: unexpected property "extra"`,
+				`$.hours: must have at most 2 items`,
+				`$.hours[1]: must be an integer`,
+				`$.location.city: must match the pattern "^[A-Z]"`,
+				`$.note: must be at most 5 characters long`,
+				`$.unit: must be one of "celsius", "fahrenheit"`,
+			},
+		},
+		{
+			"Reports the missing properties",
+			weatherSchema,
+			`{"location": {}}`,
+			[]string{`$.location: missing required property "city"`},
+		},
+		{
+			"Reports the wrong type",
+			weatherSchema,
+			`["Seoul"]`,
+			[]string{`$: must be an object`},
+		},
+		{
+			"Reports invalid JSON",
+			weatherSchema,
+			`{"location": `,
+			[]string{`$: invalid JSON: unexpected end of JSON input`},
+		},
+		{
+			"Reports the closest alternative",
+			`{"anyOf": [{"type": "string"}, {"type": "object", "required": ["a", "b"]}]}`,
+			`{"a": 1}`,
+			[]string{`$: must match one of the 2 alternatives`, `$: missing required property "b"`},
+		},
+		{
+			"Rejects a value matching more than one alternative",
+			`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`,
+			`1`,
+			[]string{`$: must match exactly one of the alternatives, but matches 2`},
+		},
+		{
+			"Accepts null if nullable",
+			`{"type": "string", "nullable": true}`,
+			`null`,
+			nil,
+		},
+		{
+			"Ignores unknown keywords",
+			`{"type": "string", "format": "date-time"}`,
+			`"tomorrow"`,
+			nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			problems, err := Validate([]byte(test.schema), []byte(test.document))
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, problems)
+		})
+	}
+
+	t.Run("Fails on a schema that is not JSON", func(t *testing.T) {
+		_, err := Validate([]byte(`{`), []byte(`{}`))
+		assert.Error(t, err)
+	})
+}
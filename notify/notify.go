@@ -0,0 +1,275 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+)
+
+type EventType string
+
+const (
+	// An endpoint was disabled because the provider reported a rate limit or
+	// quota error.
+	EventEndpointDisabled EventType = "endpoint_disabled"
+
+	// None of the endpoints serving a model could take the request.
+	EventEndpointsUnavailable EventType = "endpoints_unavailable"
+)
+
+type Event struct {
+	// Type of the event. E.g., endpoint_disabled
+	Type EventType `json:"type"`
+
+	// Provider of the affected endpoint. Empty if the event is not specific to
+	// a provider.
+	Provider string `json:"provider,omitempty"`
+
+	// Region of the affected endpoint. Empty if the event is not specific to a
+	// region.
+	Region string `json:"region,omitempty"`
+
+	// Model that was requested. E.g., gpt-4o
+	Model string `json:"model,omitempty"`
+
+	// Human readable description of the event.
+	Message string `json:"message"`
+
+	// Time when the event occurred.
+	Time time.Time `json:"time"`
+}
+
+type WebhookConfig struct {
+	// URL to POST the events to.
+	Url string `yaml:"url"`
+
+	// Payload format. Either "json" (default) for the event itself, or "slack"
+	// for a Slack incoming webhook message.
+	Format string `yaml:"format"`
+}
+
+type Config struct {
+	// Webhooks to notify on every event.
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	// Minimum interval between two notifications of the same event. E.g., 10m
+	Cooldown string `yaml:"cooldown"`
+
+	// Maximum number of retries for a failed delivery.
+	MaxRetries int `yaml:"max_retries"`
+}
+
+// Returns all problems of the config joined into one error, each prefixed
+// with its YAML path relative to the config. E.g., "webhooks[0].url"
+func (config Config) Validate() error {
+	problems := []error{}
+	if config.Cooldown != "" {
+		if cooldown, err := time.ParseDuration(config.Cooldown); err != nil {
+			problems = append(problems, fmt.Errorf("cooldown: %v", err))
+		} else if cooldown < 0 {
+			problems = append(problems, fmt.Errorf("cooldown: must be >= 0"))
+		}
+	}
+	if config.MaxRetries < 0 {
+		problems = append(problems, fmt.Errorf("max_retries: must be >= 0"))
+	}
+	for index, webhook := range config.Webhooks {
+		if webhook.Url == "" {
+			problems = append(problems, fmt.Errorf("webhooks[%d].url: is required", index))
+		} else if parsed, err := url.Parse(webhook.Url); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("webhooks[%d].url: must be an absolute URL", index))
+		}
+		if webhook.Format != "" && webhook.Format != "json" && webhook.Format != "slack" {
+			problems = append(problems, fmt.Errorf("webhooks[%d].format: must be json or slack", index))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+const (
+	defaultCooldown   = 10 * time.Minute
+	defaultMaxRetries = 3
+	initialBackoff    = time.Second
+	queueSize         = 256
+)
+
+// Delivers events to the configured webhooks in the background. The zero
+// value is not usable; use NewDispatcher. A nil dispatcher drops all events.
+type Dispatcher struct {
+	webhooks   []WebhookConfig
+	cooldown   time.Duration
+	maxRetries int
+	backoff    time.Duration
+
+	// Key (type:provider:region:model) -> last time the event was sent.
+	lastSent map[string]time.Time
+	mutex    sync.Mutex
+
+	queue  chan Event
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	httpClient *http.Client
+	clock      clock.Clock
+	logger     *zap.SugaredLogger
+}
+
+func NewDispatcher(config Config, logger *zap.SugaredLogger) (*Dispatcher, error) {
+	return newDispatcherWithClock(config, logger, clock.New(), initialBackoff)
+}
+
+func newDispatcherWithClock(config Config, logger *zap.SugaredLogger, clk clock.Clock, backoff time.Duration) (*Dispatcher, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid notifications config: %v", err)
+	}
+
+	cooldown := defaultCooldown
+	if config.Cooldown != "" {
+		cooldown, _ = time.ParseDuration(config.Cooldown)
+	}
+
+	maxRetries := defaultMaxRetries
+	if config.MaxRetries > 0 {
+		maxRetries = config.MaxRetries
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		webhooks:   config.Webhooks,
+		cooldown:   cooldown,
+		maxRetries: maxRetries,
+		backoff:    backoff,
+		lastSent:   make(map[string]time.Time),
+		queue:      make(chan Event, queueSize),
+		done:       make(chan struct{}),
+		cancel:     cancel,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		clock:      clk,
+		logger:     logger,
+	}
+	go d.run(ctx)
+	return d, nil
+}
+
+// Queues the event for delivery. Events that were already sent within the
+// cooldown are dropped. Never blocks the caller.
+func (d *Dispatcher) Publish(event Event) {
+	if d == nil || len(d.webhooks) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = d.clock.Now()
+	}
+
+	key := strings.Join([]string{string(event.Type), event.Provider, event.Region, event.Model}, ":")
+	d.mutex.Lock()
+	lastSent, found := d.lastSent[key]
+	if found && d.clock.Since(lastSent) < d.cooldown {
+		d.mutex.Unlock()
+		return
+	}
+	now := d.clock.Now()
+	// The keys are of the requested models, so the ones out of their cooldown
+	// are dropped to keep the map bounded.
+	for sentKey, sentAt := range d.lastSent {
+		if now.Sub(sentAt) >= d.cooldown {
+			delete(d.lastSent, sentKey)
+		}
+	}
+	d.lastSent[key] = now
+	d.mutex.Unlock()
+
+	select {
+	case d.queue <- event:
+	default:
+		d.logger.Warnw("Notification queue is full, dropping event", "event", event)
+	}
+}
+
+// Stops the delivery. Events still in the queue are dropped.
+func (d *Dispatcher) Shutdown() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	defer close(d.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.queue:
+			for _, webhook := range d.webhooks {
+				if err := d.deliver(ctx, webhook, event); err != nil {
+					d.logger.Warnw("Failed to deliver notification", "error", err, "url", webhook.Url, "event", event)
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, webhook WebhookConfig, event Event) error {
+	var payload any = event
+	if webhook.Format == "slack" {
+		payload = slackMessage(event)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %v", err)
+	}
+
+	backoff := d.backoff
+	for attempt := 0; ; attempt++ {
+		err = d.post(ctx, webhook.Url, body)
+		if err == nil || attempt >= d.maxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, url string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := d.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", response.StatusCode)
+	}
+	return nil
+}
+
+func slackMessage(event Event) map[string]string {
+	text := fmt.Sprintf("*[ogem] %s*: %s", event.Type, event.Message)
+	target := strings.Trim(strings.Join([]string{event.Provider, event.Region, event.Model}, "/"), "/")
+	if target != "" {
+		text += fmt.Sprintf("\n`%s`", target)
+	}
+	return map[string]string{"text": text}
+}
@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type webhookReceiver struct {
+	server *httptest.Server
+
+	// Number of requests to fail before succeeding.
+	failures int
+
+	mutex    sync.Mutex
+	attempts int
+	bodies   chan []byte
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	receiver := &webhookReceiver{failures: failures, bodies: make(chan []byte, 16)}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mutex.Lock()
+		receiver.attempts++
+		failing := receiver.attempts <= receiver.failures
+		receiver.mutex.Unlock()
+
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		receiver.bodies <- body
+	}))
+	t.Cleanup(receiver.server.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) next(t *testing.T) []byte {
+	select {
+	case body := <-r.bodies:
+		return body
+	case <-time.After(time.Second):
+		t.Fatal("no notification received")
+		return nil
+	}
+}
+
+func (r *webhookReceiver) assertNoMore(t *testing.T) {
+	select {
+	case body := <-r.bodies:
+		t.Fatalf("unexpected notification: %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	event := Event{
+		Type:     EventEndpointDisabled,
+		Provider: "openai",
+		Region:   "openai",
+		Model:    "gpt-4o",
+		Message:  "Endpoint disabled for 1m",
+		Time:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	t.Run("Posts the event as JSON", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 0)
+		dispatcher, err := newDispatcherWithClock(Config{
+			Webhooks: []WebhookConfig{{Url: receiver.server.URL}},
+		}, zap.NewNop().Sugar(), clock.NewMock(), time.Millisecond)
+		assert.NoError(t, err)
+		defer dispatcher.Shutdown()
+
+		dispatcher.Publish(event)
+
+		var received Event
+		assert.NoError(t, json.Unmarshal(receiver.next(t), &received))
+		assert.Equal(t, event, received)
+	})
+
+	t.Run("Posts Slack messages", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 0)
+		dispatcher, err := newDispatcherWithClock(Config{
+			Webhooks: []WebhookConfig{{Url: receiver.server.URL, Format: "slack"}},
+		}, zap.NewNop().Sugar(), clock.NewMock(), time.Millisecond)
+		assert.NoError(t, err)
+		defer dispatcher.Shutdown()
+
+		dispatcher.Publish(event)
+
+		assert.JSONEq(t,
+			`{"text": "*[ogem] endpoint_disabled*: Endpoint disabled for 1m\n`+"`openai/openai/gpt-4o`"+`"}`,
+			string(receiver.next(t)))
+	})
+
+	t.Run("Deduplicates within the cooldown", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 0)
+		mockClock := clock.NewMock()
+		dispatcher, err := newDispatcherWithClock(Config{
+			Webhooks: []WebhookConfig{{Url: receiver.server.URL}},
+			Cooldown: "10m",
+		}, zap.NewNop().Sugar(), mockClock, time.Millisecond)
+		assert.NoError(t, err)
+		defer dispatcher.Shutdown()
+
+		dispatcher.Publish(event)
+		receiver.next(t)
+
+		mockClock.Add(5 * time.Minute)
+		dispatcher.Publish(event)
+		receiver.assertNoMore(t)
+
+		otherEvent := event
+		otherEvent.Region = "other"
+		dispatcher.Publish(otherEvent)
+		receiver.next(t)
+
+		mockClock.Add(5 * time.Minute)
+		dispatcher.Publish(event)
+		receiver.next(t)
+	})
+
+	t.Run("Forgets the events out of the cooldown", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 0)
+		mockClock := clock.NewMock()
+		dispatcher, err := newDispatcherWithClock(Config{
+			Webhooks: []WebhookConfig{{Url: receiver.server.URL}},
+			Cooldown: "10m",
+		}, zap.NewNop().Sugar(), mockClock, time.Millisecond)
+		assert.NoError(t, err)
+		defer dispatcher.Shutdown()
+
+		for _, model := range []string{"gpt-4o", "gpt-4o-mini", "o3"} {
+			modelEvent := event
+			modelEvent.Model = model
+			dispatcher.Publish(modelEvent)
+			receiver.next(t)
+		}
+		mockClock.Add(10 * time.Minute)
+		dispatcher.Publish(event)
+		receiver.next(t)
+
+		dispatcher.mutex.Lock()
+		defer dispatcher.mutex.Unlock()
+		assert.Len(t, dispatcher.lastSent, 1)
+	})
+
+	t.Run("Retries failed deliveries", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, 2)
+		dispatcher, err := newDispatcherWithClock(Config{
+			Webhooks:   []WebhookConfig{{Url: receiver.server.URL}},
+			MaxRetries: 2,
+		}, zap.NewNop().Sugar(), clock.New(), time.Millisecond)
+		assert.NoError(t, err)
+		defer dispatcher.Shutdown()
+
+		dispatcher.Publish(event)
+		receiver.next(t)
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		assert.Equal(t, 3, receiver.attempts)
+	})
+
+	t.Run("Rejects invalid configs", func(t *testing.T) {
+		_, err := NewDispatcher(Config{Cooldown: "soon"}, zap.NewNop().Sugar())
+		assert.Error(t, err)
+		_, err = NewDispatcher(Config{Webhooks: []WebhookConfig{{Url: "http://localhost", Format: "xml"}}}, zap.NewNop().Sugar())
+		assert.Error(t, err)
+	})
+
+	t.Run("Nil dispatcher drops events", func(t *testing.T) {
+		var dispatcher *Dispatcher
+		dispatcher.Publish(event)
+		dispatcher.Shutdown()
+	})
+}
@@ -1,8 +1,14 @@
 package ogem
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"time"
+
+	"github.com/yanolja/ogem/postprocess"
+	"github.com/yanolja/ogem/provider/fake"
+	"github.com/yanolja/ogem/provider/ollama"
 )
 
 // ProvidersStatus is a map of provider names to their status.
@@ -18,6 +24,27 @@ type ProviderStatus struct {
 	// Environment variable name for the API key. E.g., "SELF_HOST_API_KEY"
 	ApiKeyEnv string `yaml:"api_key_env" json:"api_key_env"`
 
+	// Headers added to every request of a custom endpoint. Values may refer to
+	// environment variables. E.g., {"x-portkey-api-key": "${PORTKEY_API_KEY}"}
+	ExtraHeaders map[string]string `yaml:"extra_headers" json:"extra_headers,omitempty"`
+
+	// Query parameters added to every request of a custom endpoint. Values may
+	// refer to environment variables. E.g., {"api-version": "2024-06-01"}
+	ExtraQuery map[string]string `yaml:"extra_query" json:"extra_query,omitempty"`
+
+	// Google Cloud project of the vertex or vclaude endpoints, in place of the
+	// global google_cloud_project. E.g., "my-project"
+	GoogleCloudProject string `yaml:"google_cloud_project" json:"google_cloud_project,omitempty"`
+
+	// Key file of the Google Cloud credentials for the vertex or vclaude
+	// endpoints, in place of the Application Default Credentials. E.g.,
+	// "/secrets/vertex-key.json"
+	CredentialsFile string `yaml:"credentials_file" json:"credentials_file,omitempty"`
+
+	// Service account that the vertex or vclaude endpoints act as, on behalf
+	// of their credentials. E.g., "ogem@my-project.iam.gserviceaccount.com"
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account" json:"impersonate_service_account,omitempty"`
+
 	// Regions maps region names to their status.
 	// The "default" region configures provider-wide settings.
 	// E.g., Regions["us-central1"]
@@ -29,12 +56,67 @@ type RegionStatus struct {
 	// a combination of this list and the default models of the provider.
 	Models []*SupportedModel `yaml:"models" json:"models"`
 
-	// Latency to this region.
-	// Measured with minimal token completion and the fastest model.
+	// Share of the traffic that the region receives among the regions of the
+	// same priority that serve the model. E.g., 80 and 20 send 80% of the
+	// requests to the first. Regions without weight count as 1, and the
+	// fastest region is tried first if no region of the priority has weight.
+	Weight float64 `yaml:"weight" json:"weight,omitempty"`
+
+	// Regions of lower priority are tried only after all the regions of
+	// higher priority are rate limited, disabled or unhealthy. Defaults to 0.
+	Priority int `yaml:"priority" json:"priority,omitempty"`
+
+	// Maximum number of requests in flight to the region at once, for the
+	// self-hosted servers that fail under load. A busy region is skipped like
+	// a rate limited one. Zero if unlimited.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests" json:"max_concurrent_requests,omitempty"`
+
+	// Behavior of the region if the provider is fake, which generates
+	// synthetic responses for local development and load testing.
+	Fake *fake.Config `yaml:"fake" json:"fake,omitempty"`
+
+	// Daemon of the region if the provider is ollama.
+	Ollama *ollama.Config `yaml:"ollama" json:"ollama,omitempty"`
+
+	// Latency to this region, by which the regions are ordered. A moving
+	// average of the pings, which are measured with minimal token completion
+	// and the fastest model.
 	Latency time.Duration `json:"latency"`
 
+	// Latency of the last ping, even if it was left out of the average as an
+	// outlier.
+	LastLatency time.Duration `json:"last_latency"`
+
+	// Standard deviation of the pings around the average, weighted the same
+	// way.
+	LatencyDeviation time.Duration `json:"latency_deviation"`
+
+	// Number of the last pings in a row left out of the average as outliers.
+	LatencyOutliers int `json:"latency_outliers,omitempty"`
+
 	// Last time the region status was updated.
 	LastChecked time.Time `json:"last_checked"`
+
+	// Error of the last health check. Empty if the region is healthy.
+	LastError string `json:"last_error,omitempty"`
+
+	// Whether the last health check failed because the provider rejected
+	// the credentials.
+	Unauthorized bool `json:"unauthorized,omitempty"`
+}
+
+// Whether the last health check of the region succeeded. Regions that have
+// not been checked yet are not healthy.
+func (status *RegionStatus) Healthy() bool {
+	return !status.LastChecked.IsZero() && status.LastError == ""
+}
+
+// Returns the configured weight of the region, or 1 if unset.
+func (status *RegionStatus) EffectiveWeight() float64 {
+	if status.Weight == 0 {
+		return 1
+	}
+	return status.Weight
 }
 
 type SupportedModel struct {
@@ -56,6 +138,89 @@ type SupportedModel struct {
 	// Maximum requests per minute.
 	// Cannot send more than this number of requests per minute for this model.
 	MaxRequestsPerMinute int `yaml:"rpm" json:"rpm,omitempty"`
+
+	// Number of requests that can be sent at once within the rpm, which
+	// refill at the rpm. Zero sends one at a time, spaced evenly over the
+	// minute. E.g., 10
+	Burst int `yaml:"burst" json:"burst,omitempty"`
+
+	// Whether the model is a reasoning model (e.g., o3, o4-mini). Sampling
+	// parameters are removed from the requests to reasoning models since
+	// they reject them.
+	Reasoning bool `yaml:"reasoning" json:"reasoning,omitempty"`
+
+	// Whether to generate a one-token completion with the model when the
+	// endpoints are warmed up on startup.
+	Warmup bool `yaml:"warmup" json:"warmup,omitempty"`
+
+	// Default generation parameters. Applied only to the fields that the
+	// request leaves unset.
+	Defaults *ModelDefaults `yaml:"defaults" json:"defaults,omitempty"`
+
+	// Transforms applied to the content of the responses, in order. The
+	// X-Ogem-Postprocess header of a request replaces them.
+	// E.g., {"json-extract", "trim"}
+	Postprocess []string `yaml:"postprocess" json:"postprocess,omitempty"`
+
+	// Price in USD per million input tokens. Used to estimate the cost of
+	// requests. E.g., 2.5
+	InputPrice float64 `yaml:"input_price" json:"input_price,omitempty"`
+
+	// Price in USD per million output tokens. E.g., 10
+	OutputPrice float64 `yaml:"output_price" json:"output_price,omitempty"`
+
+	// Price in USD per million prompt tokens read from a context cache of
+	// Gemini. The input price applies if unset. E.g., 0.625
+	CachedInputPrice float64 `yaml:"cached_input_price" json:"cached_input_price,omitempty"`
+
+	// Features and limits of the model. Requests that need a missing feature
+	// are not routed to the model. Overrides the built-in capabilities of
+	// the known models.
+	Capabilities *Capabilities `yaml:"capabilities" json:"capabilities,omitempty"`
+
+	// Objective of the latency of the model in each region. A region that
+	// misses it is tried later until it meets it again.
+	Slo *LatencySlo `yaml:"slo" json:"slo,omitempty"`
+}
+
+// E.g., 95% of the requests within 8s over the last 10 minutes.
+type LatencySlo struct {
+	// Percentile of the latencies that must be within the threshold. E.g., 95
+	Percentile float64 `yaml:"percentile" json:"percentile"`
+
+	// E.g., 8s
+	Threshold string `yaml:"threshold" json:"threshold"`
+
+	// Time over which the latencies count. Defaults to 10m.
+	Window string `yaml:"window" json:"window,omitempty"`
+
+	// Factor by which a region that misses the objective is ranked lower:
+	// its latency is multiplied, and its weight divided, by it. Defaults to 4.
+	Penalty float64 `yaml:"penalty" json:"penalty,omitempty"`
+}
+
+type ModelDefaults struct {
+	// Sampling temperature. E.g., 0.2
+	Temperature *float32 `yaml:"temperature" json:"temperature,omitempty"`
+
+	// Nucleus sampling probability mass. E.g., 0.95
+	TopP *float32 `yaml:"top_p" json:"top_p,omitempty"`
+
+	// Maximum number of tokens to generate. E.g., 2048
+	MaxTokens *int32 `yaml:"max_tokens" json:"max_tokens,omitempty"`
+
+	// Penalty for tokens based on their frequency so far. E.g., 0.5
+	FrequencyPenalty *float32 `yaml:"frequency_penalty" json:"frequency_penalty,omitempty"`
+
+	// Penalty for tokens that have already appeared. E.g., 0.5
+	PresencePenalty *float32 `yaml:"presence_penalty" json:"presence_penalty,omitempty"`
+
+	// Stop sequences. E.g., {"\n\n"}
+	Stop []string `yaml:"stop" json:"stop,omitempty"`
+
+	// Text prepended to the first system message. If the request has no
+	// system message, a new one is added at the beginning.
+	SystemPromptPrefix string `yaml:"system_prompt_prefix" json:"system_prompt_prefix,omitempty"`
 }
 
 /**
@@ -84,8 +249,13 @@ func (providers ProvidersStatus) Update(provider, region string, callback func(*
 	// 1. Limits the fields that the callback can modify.
 	// 2. Discards any changes made if the callback fails.
 	statusCopy := &RegionStatus{
-		Latency:     regionStatus.Latency,
-		LastChecked: regionStatus.LastChecked,
+		Latency:          regionStatus.Latency,
+		LastLatency:      regionStatus.LastLatency,
+		LatencyDeviation: regionStatus.LatencyDeviation,
+		LatencyOutliers:  regionStatus.LatencyOutliers,
+		LastChecked:      regionStatus.LastChecked,
+		LastError:        regionStatus.LastError,
+		Unauthorized:     regionStatus.Unauthorized,
 	}
 	copy(statusCopy.Models, regionStatus.Models)
 	if err := callback(statusCopy); err != nil {
@@ -93,6 +263,11 @@ func (providers ProvidersStatus) Update(provider, region string, callback func(*
 	}
 
 	statusCopy.Models = regionStatus.Models
+	statusCopy.Weight = regionStatus.Weight
+	statusCopy.Priority = regionStatus.Priority
+	statusCopy.MaxConcurrentRequests = regionStatus.MaxConcurrentRequests
+	statusCopy.Fake = regionStatus.Fake
+	statusCopy.Ollama = regionStatus.Ollama
 	providerStatus.Regions[region] = statusCopy
 	return nil
 }
@@ -150,3 +325,168 @@ func (providers ProvidersStatus) ForEach(callback func(
 	}
 	return false
 }
+
+/**
+ * Validates the regions and models of every provider.
+ *
+ * @returns All problems joined into one error, each prefixed with its YAML
+ *   path (e.g., "providers.vertex.regions.us-central1.models[0].rpm"), or nil.
+ */
+func (providers ProvidersStatus) Validate() error {
+	problems := []error{}
+	addProblem := func(path string, format string, args ...any) {
+		problems = append(problems, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	for _, provider := range sortedKeys(providers) {
+		providerPath := fmt.Sprintf("providers.%s", provider)
+		providerStatus := providers[provider]
+		if providerStatus == nil || len(providerStatus.Regions) == 0 {
+			addProblem(providerPath+".regions", "must have at least one region")
+			continue
+		}
+
+		defaultModels := 0
+		if defaultRegion := providerStatus.Regions["default"]; defaultRegion != nil {
+			defaultModels = len(defaultRegion.Models)
+		}
+		for _, region := range sortedKeys(providerStatus.Regions) {
+			regionPath := fmt.Sprintf("%s.regions.%s", providerPath, region)
+			regionStatus := providerStatus.Regions[region]
+			if regionStatus != nil && regionStatus.Weight < 0 {
+				addProblem(regionPath+".weight", "must be >= 0")
+			}
+			if regionStatus != nil && regionStatus.MaxConcurrentRequests < 0 {
+				addProblem(regionPath+".max_concurrent_requests", "must be >= 0")
+			}
+			if regionStatus == nil || len(regionStatus.Models) == 0 {
+				if region != "default" && defaultModels == 0 {
+					addProblem(regionPath+".models", "must have at least one model")
+				}
+				continue
+			}
+
+			names := map[string]string{}
+			for index, model := range regionStatus.Models {
+				modelPath := fmt.Sprintf("%s.models[%d]", regionPath, index)
+				if model == nil {
+					addProblem(modelPath, "must not be empty")
+					continue
+				}
+				if model.Name == "" {
+					addProblem(modelPath+".name", "is required")
+				}
+				for _, name := range append([]string{model.Name}, model.OtherNames...) {
+					if name == "" {
+						continue
+					}
+					if otherPath, found := names[name]; found {
+						addProblem(modelPath, "name %q is already used by %s", name, otherPath)
+					}
+					names[name] = modelPath
+				}
+				if model.MaxRequestsPerMinute < 0 {
+					addProblem(modelPath+".rpm", "must be >= 0")
+				}
+				if model.Burst < 0 {
+					addProblem(modelPath+".burst", "must be >= 0")
+				} else if model.Burst > 0 && model.MaxRequestsPerMinute > 0 && model.Burst > model.MaxRequestsPerMinute {
+					addProblem(modelPath+".burst", "must be <= rpm")
+				}
+				if model.MaxTokensPerMinute < 0 {
+					addProblem(modelPath+".tpm", "must be >= 0")
+				}
+				if model.InputPrice < 0 {
+					addProblem(modelPath+".input_price", "must be >= 0")
+				}
+				if model.OutputPrice < 0 {
+					addProblem(modelPath+".output_price", "must be >= 0")
+				}
+				if model.CachedInputPrice < 0 {
+					addProblem(modelPath+".cached_input_price", "must be >= 0")
+				}
+				if model.Capabilities != nil && model.Capabilities.MaxContextTokens < 0 {
+					addProblem(modelPath+".capabilities.max_context_tokens", "must be >= 0")
+				}
+				if model.Capabilities != nil && model.Capabilities.MaxOutputTokens < 0 {
+					addProblem(modelPath+".capabilities.max_output_tokens", "must be >= 0")
+				}
+				for transformIndex, name := range model.Postprocess {
+					if err := postprocess.Validate([]string{name}); err != nil {
+						addProblem(fmt.Sprintf("%s.postprocess[%d]", modelPath, transformIndex), "%v", err)
+					}
+				}
+				for _, problem := range model.Defaults.validate() {
+					addProblem(modelPath+".defaults."+problem.field, "%s", problem.message)
+				}
+				for _, problem := range model.Slo.validate() {
+					addProblem(modelPath+".slo."+problem.field, "%s", problem.message)
+				}
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+type fieldProblem struct {
+	field   string
+	message string
+}
+
+func (slo *LatencySlo) validate() []fieldProblem {
+	if slo == nil {
+		return nil
+	}
+	problems := []fieldProblem{}
+	if slo.Percentile <= 0 || slo.Percentile > 100 {
+		problems = append(problems, fieldProblem{"percentile", "must be greater than 0 and at most 100"})
+	}
+	checkDuration := func(field string, value string, required bool) {
+		if value == "" {
+			if required {
+				problems = append(problems, fieldProblem{field, "is required"})
+			}
+			return
+		}
+		if duration, err := time.ParseDuration(value); err != nil {
+			problems = append(problems, fieldProblem{field, fmt.Sprintf("invalid duration %q", value)})
+		} else if duration <= 0 {
+			problems = append(problems, fieldProblem{field, "must be > 0"})
+		}
+	}
+	checkDuration("threshold", slo.Threshold, true)
+	checkDuration("window", slo.Window, false)
+	if slo.Penalty != 0 && slo.Penalty < 1 {
+		problems = append(problems, fieldProblem{"penalty", "must be >= 1"})
+	}
+	return problems
+}
+
+func (defaults *ModelDefaults) validate() []fieldProblem {
+	if defaults == nil {
+		return nil
+	}
+	problems := []fieldProblem{}
+	checkRange := func(field string, value *float32, min float32, max float32) {
+		if value != nil && (*value < min || *value > max) {
+			problems = append(problems, fieldProblem{field, fmt.Sprintf("must be between %v and %v", min, max)})
+		}
+	}
+	checkRange("temperature", defaults.Temperature, 0, 2)
+	checkRange("top_p", defaults.TopP, 0, 1)
+	checkRange("frequency_penalty", defaults.FrequencyPenalty, -2, 2)
+	checkRange("presence_penalty", defaults.PresencePenalty, -2, 2)
+	if defaults.MaxTokens != nil && *defaults.MaxTokens <= 0 {
+		problems = append(problems, fieldProblem{"max_tokens", "must be > 0"})
+	}
+	return problems
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,12 +2,17 @@ package openai
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/yanolja/ogem/utils"
+	"github.com/yanolja/ogem/utils/array"
 	"github.com/yanolja/ogem/utils/orderedmap"
 )
 
@@ -24,8 +29,9 @@ type ChatCompletionRequest struct {
 	MaxCompletionTokens *int32                `json:"max_completion_tokens,omitempty"`
 	CandidateCount      *int32                `json:"n,omitempty"`
 	PresencePenalty     *float32              `json:"presence_penalty,omitempty"`
+	ReasoningEffort     *string               `json:"reasoning_effort,omitempty"`
 	ResponseFormat      *ResponseFormat       `json:"response_format,omitempty"`
-	Seed                *int32                `json:"seed,omitempty"`
+	Seed                *int64                `json:"seed,omitempty"`
 	ServiceTier         *string               `json:"service_tier,omitempty"`
 	StopSequences       *StopSequences        `json:"stop,omitempty"`
 	Stream              *bool                 `json:"stream,omitempty"`
@@ -38,6 +44,132 @@ type ChatCompletionRequest struct {
 	User                *string               `json:"user,omitempty"`
 	FunctionCall        *LegacyFunctionChoice `json:"function_call,omitempty"`
 	Functions           []LegacyFunction      `json:"functions,omitempty"`
+	Modalities          []string              `json:"modalities,omitempty"`
+	Audio               *AudioOptions         `json:"audio,omitempty"`
+
+	// Extension of Ogem with the fields of the OpenRouter API, which are sent
+	// at the top level of the requests to the openrouter provider only.
+	// E.g., {"provider": {"order": ["Together"], "allow_fallbacks": false}}
+	OpenRouter *orderedmap.Map `json:"openrouter,omitempty"`
+}
+
+// Whether the request has audio inputs or asks for an audio output, which only
+// the audio models of OpenAI accept.
+func (r *ChatCompletionRequest) HasAudio() bool {
+	if r.Audio != nil {
+		return true
+	}
+	for _, message := range r.Messages {
+		if message.Audio != nil {
+			return true
+		}
+		if message.Content == nil {
+			continue
+		}
+		for _, part := range message.Content.Parts {
+			if part.Content.InputAudioContent != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the request asks for the log probabilities of the output tokens.
+func (r *ChatCompletionRequest) WantsLogprobs() bool {
+	return (r.Logprobs != nil && *r.Logprobs) || (r.TopLogprobs != nil && *r.TopLogprobs > 0)
+}
+
+// Takes the integer fields as raw JSON, because clients in languages without
+// an integer type send them as floats, e.g., 1024.0, which the decoder
+// rejects with an error that does not name the field.
+func (r *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	type plainRequest ChatCompletionRequest
+	fields := struct {
+		*plainRequest
+		TopLogprobs         json.RawMessage `json:"top_logprobs,omitempty"`
+		MaxTokens           json.RawMessage `json:"max_tokens,omitempty"`
+		MaxCompletionTokens json.RawMessage `json:"max_completion_tokens,omitempty"`
+		CandidateCount      json.RawMessage `json:"n,omitempty"`
+		Seed                json.RawMessage `json:"seed,omitempty"`
+	}{plainRequest: (*plainRequest)(r)}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var err error
+	if r.TopLogprobs, err = parseInt32("top_logprobs", fields.TopLogprobs, 0); err != nil {
+		return err
+	}
+	if r.MaxTokens, err = parseInt32("max_tokens", fields.MaxTokens, 1); err != nil {
+		return err
+	}
+	if r.MaxCompletionTokens, err = parseInt32("max_completion_tokens", fields.MaxCompletionTokens, 1); err != nil {
+		return err
+	}
+	if r.CandidateCount, err = parseInt32("n", fields.CandidateCount, 1); err != nil {
+		return err
+	}
+	if r.Seed, err = parseInt64("seed", fields.Seed, math.MinInt64); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returned when an integer field of the request has a value that is not an
+// integer or is out of range.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+func parseInt32(field string, data json.RawMessage, minimum int64) (*int32, error) {
+	value, err := parseInteger(field, data, minimum, math.MaxInt32)
+	if value == nil || err != nil {
+		return nil, err
+	}
+	return utils.ToPtr(int32(*value)), nil
+}
+
+func parseInt64(field string, data json.RawMessage, minimum int64) (*int64, error) {
+	return parseInteger(field, data, minimum, math.MaxInt64)
+}
+
+// Parses the JSON number as an integer in [minimum, maximum]. Numbers with a
+// fraction or an exponent are accepted if their value is integral. Returns
+// nil for null or a missing field.
+func parseInteger(field string, data json.RawMessage, minimum int64, maximum int64) (*int64, error) {
+	text := strings.TrimSpace(string(data))
+	if text == "" || text == "null" {
+		return nil, nil
+	}
+	outOfRange := &FieldError{Field: field, Message: fmt.Sprintf("must be between %d and %d, got %s", minimum, maximum, text)}
+
+	value, err := strconv.ParseInt(text, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, outOfRange
+	}
+	if err != nil {
+		floatValue, err := strconv.ParseFloat(text, 64)
+		switch {
+		case errors.Is(err, strconv.ErrRange):
+			return nil, outOfRange
+		case err != nil || floatValue != math.Trunc(floatValue):
+			return nil, &FieldError{Field: field, Message: fmt.Sprintf("must be an integer, got %s", text)}
+		case floatValue < float64(minimum) || floatValue >= 0x1p63:
+			// 2^63 is the smallest float above the range of int64.
+			return nil, outOfRange
+		}
+		value = int64(floatValue)
+	}
+	if value < minimum || value > maximum {
+		return nil, outOfRange
+	}
+	return &value, nil
 }
 
 type StopSequences struct {
@@ -169,6 +301,50 @@ type Message struct {
 	ToolCalls    []ToolCall      `json:"tool_calls,omitempty"`
 	ToolCallId   *string         `json:"tool_call_id,omitempty"`
 	FunctionCall *FunctionCall   `json:"function_call,omitempty"`
+
+	// Audio output of the model. An assistant message of a later request
+	// refers to it by its ID only.
+	Audio *MessageAudio `json:"audio,omitempty"`
+}
+
+// Voice and format of the audio output, requested along with the audio
+// modality.
+type AudioOptions struct {
+	// E.g., alloy
+	Voice string `json:"voice"`
+
+	// E.g., wav, mp3, pcm16
+	Format string `json:"format"`
+}
+
+type MessageAudio struct {
+	Id string `json:"id"`
+
+	// Base64 encoded audio in the requested format.
+	Data string `json:"data,omitempty"`
+
+	Transcript string `json:"transcript,omitempty"`
+
+	// Unix time after which the audio cannot be referred to.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// Whether the message instructs the model instead of being a turn of the
+// conversation. Newer OpenAI models take the developer role in place of
+// system, which the other providers do not know.
+func (m Message) IsSystem() bool {
+	return m.Role == "system" || m.Role == "developer"
+}
+
+// Returns a copy of the messages with the developer role changed to system,
+// for the APIs that only know the system role.
+func WithSystemRole(messages []Message) []Message {
+	return array.Map(messages, func(message Message) Message {
+		if message.Role == "developer" {
+			message.Role = "system"
+		}
+		return message
+	})
 }
 
 type MessageContent struct {
@@ -203,29 +379,54 @@ type Part struct {
 }
 
 type Content struct {
-	TextContent  *TextContent
-	ImageContent *ImageContent
+	TextContent       *TextContent
+	ImageContent      *ImageContent
+	InputAudioContent *InputAudioContent
 }
 
 func (p *Content) MarshalJSON() ([]byte, error) {
 	if p.TextContent != nil {
 		return json.Marshal(p.TextContent)
 	}
+	if p.InputAudioContent != nil {
+		return json.Marshal(p.InputAudioContent)
+	}
 	return json.Marshal(p.ImageContent)
 }
 
+// Tells the image content from the text by its url, and the audio content by
+// its data, since any object decodes into either of them.
 func (p *Content) UnmarshalJSON(data []byte) error {
-	var text TextContent
-	if err := json.Unmarshal(data, &text); err == nil {
-		p.TextContent = &text
+	var fields struct {
+		Text *string `json:"text"`
+		Url  *string `json:"url"`
+		Data *string `json:"data"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("expected text, image or audio content, got %s", data)
+	}
+	if fields.Data != nil && fields.Text == nil && fields.Url == nil {
+		var audio InputAudioContent
+		if err := json.Unmarshal(data, &audio); err != nil {
+			return fmt.Errorf("expected audio content, got %s", data)
+		}
+		p.InputAudioContent = &audio
 		return nil
 	}
-	var image ImageContent
-	if err := json.Unmarshal(data, &image); err == nil {
+	if fields.Url != nil && fields.Text == nil {
+		var image ImageContent
+		if err := json.Unmarshal(data, &image); err != nil {
+			return fmt.Errorf("expected image content, got %s", data)
+		}
 		p.ImageContent = &image
 		return nil
 	}
-	return fmt.Errorf("expected text or image content, got %s", data)
+	var text TextContent
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("expected text content, got %s", data)
+	}
+	p.TextContent = &text
+	return nil
 }
 
 type TextContent struct {
@@ -237,6 +438,14 @@ type ImageContent struct {
 	Detail string `json:"detail"`
 }
 
+type InputAudioContent struct {
+	// Base64 encoded audio.
+	Data string `json:"data"`
+
+	// E.g., wav, mp3
+	Format string `json:"format"`
+}
+
 type ToolCall struct {
 	Id       string        `json:"id"`
 	Type     string        `json:"type"`
@@ -269,6 +478,61 @@ type ChatCompletionResponse struct {
 	SystemFingerprint string   `json:"system_fingerprint"`
 	Object            string   `json:"object"`
 	Usage             Usage    `json:"usage"`
+
+	// Extension of Ogem, only set if it has anything to report.
+	Ogem *ResponseMetadata `json:"ogem,omitempty"`
+}
+
+type ResponseMetadata struct {
+	ToolValidation *ToolValidation      `json:"tool_validation,omitempty"`
+	OpenRouter     *OpenRouterMetadata  `json:"openrouter,omitempty"`
+	GeminiCache    *GeminiCacheMetadata `json:"gemini_cache,omitempty"`
+}
+
+// Whether Gemini served the request from the context cache that it asked for.
+type GeminiCacheMetadata struct {
+	// Name of the cache in Ogem. E.g., policy-v3
+	Name string `json:"name"`
+
+	// Whether the cached content was sent in place of the system prompt.
+	Hit bool `json:"hit"`
+
+	// Why the full prompt was sent instead: system_prompt_differs, tools
+	// (which cannot be sent with a cache), not_found (the cache has expired
+	// upstream) or unavailable (the endpoint has no such cache).
+	Miss string `json:"miss,omitempty"`
+}
+
+// Upstream that OpenRouter routed the request to.
+type OpenRouterMetadata struct {
+	// E.g., Together
+	Provider string `json:"provider,omitempty"`
+
+	// Model that served the request. E.g., meta-llama/llama-3.1-70b-instruct
+	Model string `json:"model"`
+
+	// ID to look up the generation in OpenRouter. E.g., gen-1234567890
+	GenerationId string `json:"generation_id,omitempty"`
+}
+
+// Result of validating the arguments of the tool calls against the parameters
+// of the tools.
+type ToolValidation struct {
+	// Whether the response is the answer to a repair prompt, whose usage
+	// includes that of the invalid response.
+	Repaired bool `json:"repaired"`
+
+	// Tool calls whose arguments are still invalid. Empty if all are valid.
+	Errors []ToolCallError `json:"errors"`
+}
+
+type ToolCallError struct {
+	ChoiceIndex int32  `json:"choice_index"`
+	ToolCallId  string `json:"tool_call_id,omitempty"`
+	Function    string `json:"function"`
+
+	// E.g., $.location: missing required property "city"
+	Problems []string `json:"problems"`
 }
 
 type Choice struct {
@@ -301,22 +565,353 @@ type Usage struct {
 	CompletionTokens        int32                   `json:"completion_tokens"`
 	TotalTokens             int32                   `json:"total_tokens"`
 	CompletionTokensDetails CompletionTokensDetails `json:"completion_tokens_details"`
+
+	// Breakdown of the prompt tokens. Nil if the provider reports none.
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+
+	// Whether Ogem estimated the counts because the provider did not report
+	// them.
+	Estimated bool `json:"estimated,omitempty"`
+
+	// Cost of the request as charged by the provider, in USD. Only reported
+	// by some providers, such as OpenRouter.
+	Cost *float64 `json:"cost,omitempty"`
 }
 
 type CompletionTokensDetails struct {
 	ReasoningTokens int32 `json:"reasoning_tokens"`
 }
 
+type PromptTokensDetails struct {
+	// Prompt tokens read from the cache of the provider, which are billed at
+	// a discount.
+	CachedTokens int32 `json:"cached_tokens"`
+}
+
+type TokenCountResponse struct {
+	PromptTokens int32   `json:"prompt_tokens"`
+	PerMessage   []int32 `json:"per_message,omitempty"`
+	Tokenizer    string  `json:"tokenizer"`
+	Estimated    bool    `json:"estimated,omitempty"`
+}
+
+type CostEstimateResponse struct {
+	// Endpoints that may serve the request, in the order of the fallback
+	// chain and then of the routing preference.
+	Candidates []CostCandidate `json:"candidates"`
+
+	// Priced candidate with the lowest cost. Nil if no candidate is priced.
+	Cheapest *CostCandidate `json:"cheapest"`
+
+	// Candidate that the routing would try first.
+	Predicted *CostCandidate `json:"predicted"`
+}
+
+type CostCandidate struct {
+	// Model of the fallback chain that the candidate serves.
+	RequestedModel string `json:"requested_model"`
+
+	Provider         string  `json:"provider"`
+	Region           string  `json:"region"`
+	Model            string  `json:"model"`
+	InputPrice       float64 `json:"input_price"`
+	OutputPrice      float64 `json:"output_price"`
+	PromptTokens     int32   `json:"prompt_tokens"`
+	CompletionTokens int32   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+
+	// Whether the prompt tokens are estimated instead of counted with the
+	// tokenizer of the model.
+	Estimated bool `json:"estimated,omitempty"`
+
+	// Whether the model has no price in the config.
+	Unpriced bool `json:"unpriced,omitempty"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+type Model struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+
+	// Extension with what Ogem knows about the model. Ignored by the OpenAI
+	// SDKs.
+	Ogem *ModelMetadata `json:"ogem,omitempty"`
+}
+
+type ModelMetadata struct {
+	// Other names that the requests may use for the model.
+	Aliases []string `json:"aliases,omitempty"`
+
+	// Limits and features that every endpoint of the model supports. Zero
+	// limits are unknown.
+	MaxContextTokens int      `json:"max_context_tokens"`
+	MaxOutputTokens  int      `json:"max_output_tokens"`
+	InputModalities  []string `json:"input_modalities"`
+	OutputModalities []string `json:"output_modalities"`
+
+	// Features supported by every endpoint. E.g., ["json_mode", "tools"]
+	Features []string `json:"features"`
+
+	Reasoning bool `json:"reasoning,omitempty"`
+
+	// Retirement of the model. Nil if it is not deprecated.
+	Deprecation *ModelDeprecation `json:"deprecation,omitempty"`
+
+	// Provider and region pairs that serve the model, with their health as of
+	// the last health check.
+	Endpoints []ModelEndpoint `json:"endpoints"`
+}
+
+type ModelDeprecation struct {
+	// Date or time in RFC 3339 from which the model is retired.
+	After string `json:"after"`
+
+	// Model that serves the requests after the cutoff, if redirected.
+	RedirectTo string `json:"redirect_to,omitempty"`
+
+	// Either redirect or reject.
+	Mode string `json:"mode"`
+
+	// Whether the cutoff has passed.
+	Retired bool `json:"retired"`
+}
+
+type ModelEndpoint struct {
+	Provider string `json:"provider"`
+	Region   string `json:"region"`
+
+	// Either healthy, unhealthy or unchecked before the first health check.
+	Health    string `json:"health"`
+	LatencyMs int64  `json:"latency_ms"`
+
+	// Prices in USD per million tokens. Zero if unpriced.
+	InputPrice  float64 `json:"input_price"`
+	OutputPrice float64 `json:"output_price"`
+
+	MaxContextTokens int `json:"max_context_tokens"`
+	MaxOutputTokens  int `json:"max_output_tokens"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Param   string `json:"param,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
 type StreamOptions struct {
 	IncludeUsage *bool `json:"include_usage,omitempty"`
 }
 
+// Request of the legacy text completions API, which Ogem serves as a chat
+// completion with the prompt as the user message.
+type CompletionRequest struct {
+	Model            string             `json:"model"`
+	Prompt           *CompletionPrompt  `json:"prompt"`
+	Echo             *bool              `json:"echo,omitempty"`
+	FrequencyPenalty *float32           `json:"frequency_penalty,omitempty"`
+	LogitBias        map[string]float32 `json:"logit_bias,omitempty"`
+	Logprobs         *int32             `json:"logprobs,omitempty"`
+	MaxTokens        *int32             `json:"max_tokens,omitempty"`
+	CandidateCount   *int32             `json:"n,omitempty"`
+	PresencePenalty  *float32           `json:"presence_penalty,omitempty"`
+	Seed             *int64             `json:"seed,omitempty"`
+	StopSequences    *StopSequences     `json:"stop,omitempty"`
+	Stream           *bool              `json:"stream,omitempty"`
+	StreamOptions    *StreamOptions     `json:"stream_options,omitempty"`
+	Temperature      *float32           `json:"temperature,omitempty"`
+	TopP             *float32           `json:"top_p,omitempty"`
+	User             *string            `json:"user,omitempty"`
+}
+
+// Takes the integer fields as raw JSON. See ChatCompletionRequest.
+func (r *CompletionRequest) UnmarshalJSON(data []byte) error {
+	type plainRequest CompletionRequest
+	fields := struct {
+		*plainRequest
+		Logprobs       json.RawMessage `json:"logprobs,omitempty"`
+		MaxTokens      json.RawMessage `json:"max_tokens,omitempty"`
+		CandidateCount json.RawMessage `json:"n,omitempty"`
+		Seed           json.RawMessage `json:"seed,omitempty"`
+	}{plainRequest: (*plainRequest)(r)}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var err error
+	if r.Logprobs, err = parseInt32("logprobs", fields.Logprobs, 0); err != nil {
+		return err
+	}
+	if r.MaxTokens, err = parseInt32("max_tokens", fields.MaxTokens, 1); err != nil {
+		return err
+	}
+	if r.CandidateCount, err = parseInt32("n", fields.CandidateCount, 1); err != nil {
+		return err
+	}
+	if r.Seed, err = parseInt64("seed", fields.Seed, math.MinInt64); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Prompt of a text completion, either a string or an array of strings.
+// Arrays of token IDs are not supported.
+type CompletionPrompt struct {
+	Prompts []string
+}
+
+func (p *CompletionPrompt) MarshalJSON() ([]byte, error) {
+	if len(p.Prompts) == 1 {
+		return json.Marshal(p.Prompts[0])
+	}
+	return json.Marshal(p.Prompts)
+}
+
+func (p *CompletionPrompt) UnmarshalJSON(data []byte) error {
+	var prompt string
+	if err := json.Unmarshal(data, &prompt); err == nil {
+		p.Prompts = []string{prompt}
+		return nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(data, &prompts); err != nil {
+		return &FieldError{Field: "prompt", Message: "must be a string or an array of strings"}
+	}
+	p.Prompts = prompts
+	return nil
+}
+
+type CompletionResponse struct {
+	Id                string             `json:"id"`
+	Choices           []CompletionChoice `json:"choices"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint string             `json:"system_fingerprint"`
+	Object            string             `json:"object"`
+
+	// Nil in the chunks of a streamed response, except the last one if the
+	// usage is asked for.
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Index        int32               `json:"index"`
+	Text         string              `json:"text"`
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason string              `json:"finish_reason"`
+}
+
+// Log probabilities of the tokens of a text completion, with an entry per
+// token in each field.
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float32            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float32 `json:"top_logprobs"`
+	TextOffset    []int32              `json:"text_offset"`
+}
+
+// Fills in the fields that the providers do not have in common. The ID and
+// the system fingerprint of the provider, such as the message ID and the model
+// version of Claude, are kept as they are; otherwise the ID is generated and
+// the fingerprint names the endpoint, e.g. ogem/studio/studio.
 func FinalizeResponse(provider string, region string, model string, response *ChatCompletionResponse) *ChatCompletionResponse {
-	response.Id = "chatcmpl-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if response.Id == "" {
+		response.Id = "chatcmpl-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
 	response.Created = time.Now().Unix()
 	response.Model = model
 	response.ServiceTier = nil
-	response.SystemFingerprint = fmt.Sprintf("open-gemini/%s/%s/%s", provider, region, model)
+	if response.SystemFingerprint == "" {
+		response.SystemFingerprint = fmt.Sprintf("ogem/%s/%s", provider, region)
+	}
 	response.Object = "chat.completion"
 	return response
 }
+
+// Request of the embeddings API.
+type EmbeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          *EmbeddingInput `json:"input"`
+	Dimensions     *int32          `json:"dimensions,omitempty"`
+	EncodingFormat *string         `json:"encoding_format,omitempty"`
+	User           *string         `json:"user,omitempty"`
+
+	// Whether the input is a search query or a document to be searched,
+	// which the retrieval models embed differently. Either query or
+	// document, or classification or clustering for Cohere. An Ogem
+	// extension that the OpenAI SDKs send as an extra body field.
+	InputType *string `json:"ogem_input_type,omitempty"`
+}
+
+// Takes the integer fields as raw JSON. See ChatCompletionRequest.
+func (r *EmbeddingRequest) UnmarshalJSON(data []byte) error {
+	type plainRequest EmbeddingRequest
+	fields := struct {
+		*plainRequest
+		Dimensions json.RawMessage `json:"dimensions,omitempty"`
+	}{plainRequest: (*plainRequest)(r)}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var err error
+	if r.Dimensions, err = parseInt32("dimensions", fields.Dimensions, 1); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Input of an embedding request, either a string or an array of strings.
+// Arrays of token IDs are not supported.
+type EmbeddingInput struct {
+	Texts []string
+}
+
+func (i *EmbeddingInput) MarshalJSON() ([]byte, error) {
+	if len(i.Texts) == 1 {
+		return json.Marshal(i.Texts[0])
+	}
+	return json.Marshal(i.Texts)
+}
+
+func (i *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		i.Texts = []string{text}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return &FieldError{Field: "input", Message: "must be a string or an array of strings"}
+	}
+	i.Texts = texts
+	return nil
+}
+
+type EmbeddingResponse struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+type Embedding struct {
+	Object    string    `json:"object"`
+	Index     int32     `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int32 `json:"prompt_tokens"`
+	TotalTokens  int32 `json:"total_tokens"`
+}
@@ -0,0 +1,175 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatCompletionRequestIntegerFields(t *testing.T) {
+	maxTokens := func(request *ChatCompletionRequest) any { return request.MaxTokens }
+	candidateCount := func(request *ChatCompletionRequest) any { return request.CandidateCount }
+	topLogprobs := func(request *ChatCompletionRequest) any { return request.TopLogprobs }
+	seed := func(request *ChatCompletionRequest) any { return request.Seed }
+	int32Ptr := func(value int32) *int32 { return &value }
+	int64Ptr := func(value int64) *int64 { return &value }
+
+	tests := []struct {
+		field string
+		value string
+		get   func(*ChatCompletionRequest) any
+
+		// Either the parsed value or the error.
+		want    any
+		wantErr string
+	}{
+		{field: "max_tokens", value: "1024", get: maxTokens, want: int32Ptr(1024)},
+		{field: "max_tokens", value: "1024.0", get: maxTokens, want: int32Ptr(1024)},
+		{field: "max_tokens", value: "1.024e3", get: maxTokens, want: int32Ptr(1024)},
+		{field: "max_tokens", value: "null", get: maxTokens, want: (*int32)(nil)},
+		{field: "max_tokens", value: "2147483647", get: maxTokens, want: int32Ptr(2147483647)},
+		{field: "max_tokens", value: "2147483648", wantErr: "max_tokens must be between 1 and 2147483647, got 2147483648"},
+		{field: "max_tokens", value: "2147483648.0", wantErr: "max_tokens must be between 1 and 2147483647, got 2147483648.0"},
+		{field: "max_tokens", value: "1024.5", wantErr: "max_tokens must be an integer, got 1024.5"},
+		{field: "max_tokens", value: "0", wantErr: "max_tokens must be between 1 and 2147483647, got 0"},
+		{field: "max_tokens", value: "-1", wantErr: "max_tokens must be between 1 and 2147483647, got -1"},
+		{field: "max_tokens", value: `"1024"`, wantErr: `max_tokens must be an integer, got "1024"`},
+		{field: "max_tokens", value: "true", wantErr: "max_tokens must be an integer, got true"},
+		{field: "max_completion_tokens", value: "1e400", wantErr: "max_completion_tokens must be between 1 and 2147483647, got 1e400"},
+		{field: "n", value: "2.0", get: candidateCount, want: int32Ptr(2)},
+		{field: "n", value: "0.5", wantErr: "n must be an integer, got 0.5"},
+		{field: "top_logprobs", value: "0", get: topLogprobs, want: int32Ptr(0)},
+		{field: "top_logprobs", value: "-1.0", wantErr: "top_logprobs must be between 0 and 2147483647, got -1.0"},
+		{field: "seed", value: "-42", get: seed, want: int64Ptr(-42)},
+		{field: "seed", value: "2147483648", get: seed, want: int64Ptr(2147483648)},
+		{field: "seed", value: "9223372036854775807", get: seed, want: int64Ptr(9223372036854775807)},
+		{field: "seed", value: "-9223372036854775808", get: seed, want: int64Ptr(-9223372036854775808)},
+		{field: "seed", value: "-9.223372036854775808e18", get: seed, want: int64Ptr(-9223372036854775808)},
+		{field: "seed", value: "9223372036854775808", wantErr: "seed must be between -9223372036854775808 and 9223372036854775807, got 9223372036854775808"},
+		{field: "seed", value: "9.223372036854775807e18", wantErr: "seed must be between -9223372036854775808 and 9223372036854775807, got 9.223372036854775807e18"},
+		{field: "seed", value: "1.5", wantErr: "seed must be an integer, got 1.5"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s=%s", test.field, test.value), func(t *testing.T) {
+			body := fmt.Sprintf(`{"model": "gpt-4o", "messages": [], %q: %s}`, test.field, test.value)
+			var request ChatCompletionRequest
+			err := json.Unmarshal([]byte(body), &request)
+			if test.wantErr != "" {
+				var fieldError *FieldError
+				assert.ErrorAs(t, err, &fieldError)
+				assert.Equal(t, test.field, fieldError.Field)
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "gpt-4o", request.Model)
+			assert.Equal(t, test.want, test.get(&request))
+		})
+	}
+
+	t.Run("Round-trips the request", func(t *testing.T) {
+		body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 16, "n": 2, "seed": 9007199254740993, "temperature": 0.5}`
+		var request ChatCompletionRequest
+		assert.NoError(t, json.Unmarshal([]byte(body), &request))
+		marshaled, err := json.Marshal(&request)
+		assert.NoError(t, err)
+		assert.JSONEq(t, body, string(marshaled))
+	})
+}
+
+func TestFinalizeResponse(t *testing.T) {
+	t.Run("Generates the ID and names the endpoint", func(t *testing.T) {
+		response := FinalizeResponse("studio", "studio", "gemini-1.5-flash", &ChatCompletionResponse{})
+		assert.Regexp(t, `^chatcmpl-[0-9a-f]{32}$`, response.Id)
+		assert.Equal(t, "ogem/studio/studio", response.SystemFingerprint)
+		assert.Equal(t, "gemini-1.5-flash", response.Model)
+		assert.Equal(t, "chat.completion", response.Object)
+
+		other := FinalizeResponse("studio", "studio", "gemini-1.5-flash", &ChatCompletionResponse{})
+		assert.NotEqual(t, response.Id, other.Id)
+	})
+
+	t.Run("Keeps those of the provider", func(t *testing.T) {
+		response := FinalizeResponse("claude", "claude", "claude-3-haiku", &ChatCompletionResponse{
+			Id:                "msg_01XFDUDYJgAACzvnptvVoYEL",
+			SystemFingerprint: "claude-3-haiku-20240307",
+		})
+		assert.Equal(t, "msg_01XFDUDYJgAACzvnptvVoYEL", response.Id)
+		assert.Equal(t, "claude-3-haiku-20240307", response.SystemFingerprint)
+		assert.Equal(t, "claude-3-haiku", response.Model)
+	})
+}
+
+func TestAudio(t *testing.T) {
+	t.Run("Round-trips the audio request", func(t *testing.T) {
+		body := `{
+			"model": "gpt-4o-audio-preview",
+			"messages": [
+				{"role": "user", "content": [
+					{"type": "text", "content": {"text": "What is in this recording?"}},
+					{"type": "input_audio", "content": {"data": "UklGRiQAAABXQVZF", "format": "wav"}}
+				]},
+				{"role": "assistant", "content": null, "audio": {"id": "audio_abc123"}},
+				{"role": "user", "content": "Say it again."}
+			],
+			"modalities": ["text", "audio"],
+			"audio": {"voice": "alloy", "format": "mp3"}
+		}`
+		var request ChatCompletionRequest
+		assert.NoError(t, json.Unmarshal([]byte(body), &request))
+		audio := request.Messages[0].Content.Parts[1].Content.InputAudioContent
+		assert.Equal(t, &InputAudioContent{Data: "UklGRiQAAABXQVZF", Format: "wav"}, audio)
+		assert.Nil(t, request.Messages[0].Content.Parts[1].Content.TextContent)
+		assert.Nil(t, request.Messages[0].Content.Parts[1].Content.ImageContent)
+		assert.NotNil(t, request.Messages[0].Content.Parts[0].Content.TextContent)
+		assert.Equal(t, &AudioOptions{Voice: "alloy", Format: "mp3"}, request.Audio)
+		assert.True(t, request.HasAudio())
+
+		marshaled, err := json.Marshal(&request)
+		assert.NoError(t, err)
+		assert.JSONEq(t, body, string(marshaled))
+	})
+
+	t.Run("Round-trips the audio output", func(t *testing.T) {
+		body := `{
+			"id": "chatcmpl-123",
+			"choices": [{
+				"index": 0,
+				"message": {
+					"role": "assistant",
+					"content": null,
+					"audio": {"id": "audio_abc123", "data": "SUQzBAAAAAAA", "transcript": "Hello there!", "expires_at": 1729018505}
+				},
+				"logprobs": null,
+				"finish_reason": "stop"
+			}],
+			"created": 1729014905,
+			"model": "gpt-4o-audio-preview-2024-10-01",
+			"system_fingerprint": "fp_1234",
+			"object": "chat.completion",
+			"usage": {"prompt_tokens": 17, "completion_tokens": 24, "total_tokens": 41, "completion_tokens_details": {"reasoning_tokens": 0}}
+		}`
+		var response ChatCompletionResponse
+		assert.NoError(t, json.Unmarshal([]byte(body), &response))
+		assert.Equal(t, &MessageAudio{Id: "audio_abc123", Data: "SUQzBAAAAAAA", Transcript: "Hello there!", ExpiresAt: 1729018505}, response.Choices[0].Message.Audio)
+
+		marshaled, err := json.Marshal(&response)
+		assert.NoError(t, err)
+		assert.JSONEq(t, body, string(marshaled))
+	})
+
+	t.Run("Tolerates the audio of streamed deltas", func(t *testing.T) {
+		var message Message
+		assert.NoError(t, json.Unmarshal([]byte(`{"role": "assistant", "audio": {"id": "audio_abc123", "transcript": "Hel"}}`), &message))
+		assert.Equal(t, "Hel", message.Audio.Transcript)
+	})
+
+	t.Run("No audio", func(t *testing.T) {
+		request := ChatCompletionRequest{Messages: []Message{{Role: "user", Content: &MessageContent{Parts: []Part{
+			{Type: "image_url", Content: Content{ImageContent: &ImageContent{Url: "https://example.com/cat.png"}}},
+		}}}}}
+		assert.False(t, request.HasAudio())
+	})
+}
@@ -0,0 +1,177 @@
+package openai
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maximum number of messages of a chat completion request. Far more than a
+// conversation needs, so that only the clients that keep appending to the
+// messages without bound hit it.
+const MaxMessages = 2048
+
+// Roles of the messages that the providers accept.
+var messageRoles = map[string]bool{
+	"system":    true,
+	"developer": true,
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+	"function":  true,
+}
+
+// A problem of a message, at the field path of the request.
+type Violation struct {
+	// Index of the message, or -1 if it is about the messages as a whole.
+	Index   int
+	Field   string
+	Message string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("%s %s", v.Field, v.Message)
+}
+
+// Returned when the messages of a request have violations that every provider
+// would reject them for.
+type MessagesError struct {
+	Violations []Violation
+}
+
+func (e *MessagesError) Error() string {
+	problems := make([]string, len(e.Violations))
+	for index, violation := range e.Violations {
+		problems[index] = violation.Error()
+	}
+	return strings.Join(problems, "; ")
+}
+
+// Checks the messages before they are sent to any provider, so that a request
+// that cannot succeed does not fail over across every endpoint. Returns a
+// MessagesError listing every violation, or nil if there is none.
+//
+// The content of an assistant message may be empty if it calls tools, and the
+// content of a tool message may be empty since a tool may return nothing.
+func ValidateMessages(messages []Message) error {
+	var violations []Violation
+	add := func(index int, field string, format string, args ...any) {
+		path := "messages"
+		if index >= 0 {
+			path = fmt.Sprintf("messages[%d]", index)
+		}
+		if field != "" {
+			path += "." + field
+		}
+		violations = append(violations, Violation{Index: index, Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(messages) == 0 {
+		add(-1, "", "must not be empty")
+	}
+	if len(messages) > MaxMessages {
+		add(-1, "", "must have at most %d messages, got %d", MaxMessages, len(messages))
+	}
+
+	toolCallIds := map[string]bool{}
+	for index, message := range messages {
+		switch {
+		case message.Role == "":
+			add(index, "role", "is required")
+			continue
+		case !messageRoles[message.Role]:
+			add(index, "role", "must be one of system, developer, user, assistant, tool and function, got %q", message.Role)
+			continue
+		}
+
+		validateContent(message.Content, func(field string, format string, args ...any) {
+			add(index, field, format, args...)
+		})
+
+		switch message.Role {
+		case "assistant":
+			for callIndex, toolCall := range message.ToolCalls {
+				if toolCall.Id == "" {
+					add(index, fmt.Sprintf("tool_calls[%d].id", callIndex), "is required")
+				} else {
+					toolCallIds[toolCall.Id] = true
+				}
+				if toolCall.Function == nil || toolCall.Function.Name == "" {
+					add(index, fmt.Sprintf("tool_calls[%d].function.name", callIndex), "is required")
+				}
+			}
+			if isBlank(message.Content) && len(message.ToolCalls) == 0 && message.FunctionCall == nil && message.Refusal == nil && message.Audio == nil {
+				add(index, "content", "must not be empty unless the message has tool_calls")
+			}
+		case "tool":
+			switch {
+			case message.ToolCallId == nil || *message.ToolCallId == "":
+				add(index, "tool_call_id", "is required")
+			case !toolCallIds[*message.ToolCallId]:
+				add(index, "tool_call_id", "must be the id of a tool call of an earlier assistant message, got %q", *message.ToolCallId)
+			}
+			if message.Content == nil {
+				add(index, "content", "is required")
+			}
+		case "function":
+			if message.Name == nil || *message.Name == "" {
+				add(index, "name", "is required")
+			}
+			if message.Content == nil {
+				add(index, "content", "is required")
+			}
+		default:
+			if isBlank(message.Content) {
+				add(index, "content", "must not be empty")
+			}
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return &MessagesError{Violations: violations}
+}
+
+// Checks the parts of the content. Whether the content itself may be empty
+// depends on the role, which is left to the caller.
+func validateContent(content *MessageContent, add func(field string, format string, args ...any)) {
+	if content == nil || content.String != nil {
+		return
+	}
+	for index, part := range content.Parts {
+		field := fmt.Sprintf("content[%d]", index)
+		switch {
+		case part.Content.ImageContent != nil:
+			url := part.Content.ImageContent.Url
+			if url == "" {
+				add(field+".content.url", "is required")
+			} else if header, data, _ := strings.Cut(url, ","); strings.HasPrefix(header, "data:") && data == "" {
+				add(field+".content.url", "must have the data of the image")
+			}
+		case part.Content.TextContent != nil:
+			if strings.TrimSpace(part.Content.TextContent.Text) == "" {
+				add(field+".content.text", "must not be empty")
+			}
+		case part.Content.InputAudioContent != nil:
+			if part.Content.InputAudioContent.Data == "" {
+				add(field+".content.data", "must have the data of the audio")
+			}
+			if part.Content.InputAudioContent.Format == "" {
+				add(field+".content.format", "is required")
+			}
+		default:
+			add(field+".content", "is required")
+		}
+	}
+}
+
+// Whether the content has no text other than whitespace and no parts.
+func isBlank(content *MessageContent) bool {
+	if content == nil {
+		return true
+	}
+	if content.String != nil {
+		return strings.TrimSpace(*content.String) == ""
+	}
+	return len(content.Parts) == 0
+}
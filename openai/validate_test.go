@@ -0,0 +1,234 @@
+package openai
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+
+		// Violations in order, empty if the messages are valid.
+		want []string
+	}{
+		{
+			name:     "User message",
+			messages: `[{"role": "user", "content": "Hi"}]`,
+		},
+		{
+			name:     "System and developer messages",
+			messages: `[{"role": "system", "content": "Be brief."}, {"role": "developer", "content": "Be kind."}, {"role": "user", "content": "Hi"}]`,
+		},
+		{
+			name:     "Content as parts",
+			messages: `[{"role": "user", "content": [{"type": "text", "content": {"text": "What is in the image?"}}, {"type": "image_url", "content": {"url": "https://example.com/cat.png"}}]}]`,
+		},
+		{
+			name:     "Image as data",
+			messages: `[{"role": "user", "content": [{"type": "image_url", "content": {"url": "data:image/png;base64,iVBORw0KGgo="}}]}]`,
+		},
+		{
+			name:     "Audio as data",
+			messages: `[{"role": "user", "content": [{"type": "text", "content": {"text": "Transcribe this."}}, {"type": "input_audio", "content": {"data": "UklGRiQAAABXQVZF", "format": "wav"}}]}]`,
+		},
+		{
+			name: "Assistant message with an audio output",
+			messages: `[
+				{"role": "user", "content": "Say hello."},
+				{"role": "assistant", "content": null, "audio": {"id": "audio_1"}},
+				{"role": "user", "content": "Again."}
+			]`,
+		},
+		{
+			name: "Assistant message with tool calls and no content",
+			messages: `[
+				{"role": "user", "content": "Weather in Seoul?"},
+				{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{}"}}]},
+				{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"}
+			]`,
+		},
+		{
+			name: "Assistant message with tool calls and empty content",
+			messages: `[
+				{"role": "user", "content": "Weather in Seoul?"},
+				{"role": "assistant", "content": "", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{}"}}]},
+				{"role": "tool", "tool_call_id": "call_1", "content": ""}
+			]`,
+		},
+		{
+			name: "Legacy function call",
+			messages: `[
+				{"role": "user", "content": "Weather in Seoul?"},
+				{"role": "assistant", "content": null, "function_call": {"name": "weather", "arguments": "{}"}},
+				{"role": "function", "name": "weather", "content": "Sunny"}
+			]`,
+		},
+		{
+			name:     "Refusal",
+			messages: `[{"role": "user", "content": "Hi"}, {"role": "assistant", "content": null, "refusal": "No."}]`,
+		},
+		{
+			name:     "No messages",
+			messages: `[]`,
+			want:     []string{"messages must not be empty"},
+		},
+		{
+			name:     "Missing role",
+			messages: `[{"content": "Hi"}]`,
+			want:     []string{"messages[0].role is required"},
+		},
+		{
+			name:     "Unknown role",
+			messages: `[{"role": "model", "content": "Hi"}]`,
+			want:     []string{`messages[0].role must be one of system, developer, user, assistant, tool and function, got "model"`},
+		},
+		{
+			name:     "Empty content",
+			messages: `[{"role": "user", "content": ""}]`,
+			want:     []string{"messages[0].content must not be empty"},
+		},
+		{
+			name:     "Whitespace content",
+			messages: `[{"role": "system", "content": " \n\t"}, {"role": "user", "content": "Hi"}]`,
+			want:     []string{"messages[0].content must not be empty"},
+		},
+		{
+			name:     "Missing content",
+			messages: `[{"role": "user"}]`,
+			want:     []string{"messages[0].content must not be empty"},
+		},
+		{
+			name:     "No parts",
+			messages: `[{"role": "user", "content": []}]`,
+			want:     []string{"messages[0].content must not be empty"},
+		},
+		{
+			name:     "Empty text part",
+			messages: `[{"role": "user", "content": [{"type": "text", "content": {"text": " "}}, {"type": "text", "content": {"text": "Hi"}}]}]`,
+			want:     []string{"messages[0].content[0].content.text must not be empty"},
+		},
+		{
+			name:     "Image without url",
+			messages: `[{"role": "user", "content": [{"type": "image_url", "content": {"url": ""}}]}]`,
+			want:     []string{"messages[0].content[0].content.url is required"},
+		},
+		{
+			name:     "Image without data",
+			messages: `[{"role": "user", "content": [{"type": "image_url", "content": {"url": "data:image/png;base64,"}}]}]`,
+			want:     []string{"messages[0].content[0].content.url must have the data of the image"},
+		},
+		{
+			name:     "Audio without data or format",
+			messages: `[{"role": "user", "content": [{"type": "input_audio", "content": {"data": ""}}]}]`,
+			want:     []string{"messages[0].content[0].content.data must have the data of the audio", "messages[0].content[0].content.format is required"},
+		},
+		{
+			name:     "Assistant message without content or tool calls",
+			messages: `[{"role": "user", "content": "Hi"}, {"role": "assistant", "content": ""}]`,
+			want:     []string{"messages[1].content must not be empty unless the message has tool_calls"},
+		},
+		{
+			name: "Tool call without id or name",
+			messages: `[
+				{"role": "user", "content": "Weather?"},
+				{"role": "assistant", "tool_calls": [{"type": "function", "function": {"name": "", "arguments": "{}"}}]}
+			]`,
+			want: []string{"messages[1].tool_calls[0].id is required", "messages[1].tool_calls[0].function.name is required"},
+		},
+		{
+			name:     "Tool message without tool call id",
+			messages: `[{"role": "user", "content": "Weather?"}, {"role": "tool", "content": "Sunny"}]`,
+			want:     []string{"messages[1].tool_call_id is required"},
+		},
+		{
+			name: "Tool message of an unknown tool call",
+			messages: `[
+				{"role": "user", "content": "Weather?"},
+				{"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{}"}}]},
+				{"role": "tool", "tool_call_id": "call_2", "content": "Sunny"}
+			]`,
+			want: []string{`messages[2].tool_call_id must be the id of a tool call of an earlier assistant message, got "call_2"`},
+		},
+		{
+			name: "Tool message before its tool call",
+			messages: `[
+				{"role": "user", "content": "Weather?"},
+				{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+				{"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{}"}}]}
+			]`,
+			want: []string{`messages[1].tool_call_id must be the id of a tool call of an earlier assistant message, got "call_1"`},
+		},
+		{
+			name: "Tool message without content",
+			messages: `[
+				{"role": "user", "content": "Weather?"},
+				{"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{}"}}]},
+				{"role": "tool", "tool_call_id": "call_1"}
+			]`,
+			want: []string{"messages[2].content is required"},
+		},
+		{
+			name:     "Function message without name",
+			messages: `[{"role": "user", "content": "Weather?"}, {"role": "function", "content": "Sunny"}]`,
+			want:     []string{"messages[1].name is required"},
+		},
+		{
+			name: "Every violation",
+			messages: `[
+				{"role": "user", "content": ""},
+				{"role": "", "content": "Hi"},
+				{"role": "tool", "content": "Sunny"}
+			]`,
+			want: []string{"messages[0].content must not be empty", "messages[1].role is required", "messages[2].tool_call_id is required"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var messages []Message
+			assert.NoError(t, json.Unmarshal([]byte(test.messages), &messages))
+
+			err := ValidateMessages(messages)
+			if len(test.want) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			var messagesError *MessagesError
+			if !assert.ErrorAs(t, err, &messagesError) {
+				return
+			}
+			got := make([]string, len(messagesError.Violations))
+			for index, violation := range messagesError.Violations {
+				got[index] = violation.Error()
+			}
+			assert.Equal(t, test.want, got)
+			assert.Equal(t, strings.Join(test.want, "; "), err.Error())
+		})
+	}
+
+	t.Run("Too many messages", func(t *testing.T) {
+		messages := make([]Message, MaxMessages+1)
+		for index := range messages {
+			content := "Hi"
+			messages[index] = Message{Role: "user", Content: &MessageContent{String: &content}}
+		}
+		err := ValidateMessages(messages)
+		assert.EqualError(t, err, "messages must have at most 2048 messages, got 2049")
+		assert.NoError(t, ValidateMessages(messages[:MaxMessages]))
+	})
+
+	t.Run("Indexes of the violations", func(t *testing.T) {
+		var messages []Message
+		assert.NoError(t, json.Unmarshal([]byte(`[{"role": "user", "content": "Hi"}, {"role": "user", "content": ""}]`), &messages))
+		var messagesError *MessagesError
+		assert.ErrorAs(t, ValidateMessages(messages), &messagesError)
+		assert.Equal(t, 1, messagesError.Violations[0].Index)
+		assert.ErrorAs(t, ValidateMessages(nil), &messagesError)
+		assert.Equal(t, -1, messagesError.Violations[0].Index)
+	})
+}
@@ -0,0 +1,135 @@
+package postprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Replaces the content with the first JSON object in it, such as the one
+	// in a ```json fence or after a preamble. Only applies when the request
+	// asks for JSON, and keeps the content if no valid object is found.
+	JsonExtract = "json-extract"
+
+	// Removes the trailing whitespace of every line and of the content.
+	Trim = "trim"
+
+	// Replaces each run of blank lines with a single empty line.
+	CollapseBlankLines = "collapse-blank-lines"
+
+	// Disables the transforms of the model for the request.
+	None = "none"
+)
+
+var transforms = map[string]func(string) string{
+	JsonExtract:        extractJson,
+	Trim:               trimTrailingWhitespace,
+	CollapseBlankLines: collapseBlankLines,
+}
+
+// Names of the transforms in the error messages.
+var transformNames = []string{JsonExtract, Trim, CollapseBlankLines}
+
+// Parses a comma-separated list of transforms. E.g., "json-extract,trim"
+// Returns an empty list for "none".
+func Parse(value string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 1 && names[0] == None {
+		return []string{}, nil
+	}
+	if err := Validate(names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Returns the unknown transforms of the list joined into one error.
+func Validate(names []string) error {
+	problems := []error{}
+	for _, name := range names {
+		if _, found := transforms[name]; !found {
+			problems = append(problems, fmt.Errorf("unknown transform %q; must be one of %s", name, strings.Join(transformNames, ", ")))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// Applies the transforms to the content in order. JsonExtract is skipped
+// unless the request asks for JSON.
+func Apply(content string, names []string, wantsJson bool) string {
+	for _, name := range names {
+		if name == JsonExtract && !wantsJson {
+			continue
+		}
+		if transform, found := transforms[name]; found {
+			content = transform(content)
+		}
+	}
+	return content
+}
+
+// Matches a fenced code block with an optional info string. E.g., ```json
+var fencePattern = regexp.MustCompile("(?s)```[\\w-]*[ \\t]*\\r?\\n(.*?)```")
+
+func extractJson(content string) string {
+	if json.Valid([]byte(content)) {
+		return content
+	}
+	for _, match := range fencePattern.FindAllStringSubmatch(content, -1) {
+		fenced := strings.TrimSpace(match[1])
+		if strings.HasPrefix(fenced, "{") && json.Valid([]byte(fenced)) {
+			return fenced
+		}
+	}
+	// A fence may be cut short by backticks within a JSON string, so the
+	// objects are also looked for outside of the fences.
+	for start := strings.IndexByte(content, '{'); start >= 0; {
+		var object json.RawMessage
+		if err := json.NewDecoder(strings.NewReader(content[start:])).Decode(&object); err == nil {
+			return string(object)
+		}
+		next := strings.IndexByte(content[start+1:], '{')
+		if next < 0 {
+			break
+		}
+		start += next + 1
+	}
+	return content
+}
+
+// Line breaks are normalized to \n since \r counts as trailing whitespace.
+func trimTrailingWhitespace(content string) string {
+	lines := strings.Split(content, "\n")
+	for index, line := range lines {
+		lines[index] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	return strings.TrimRightFunc(strings.Join(lines, "\n"), unicode.IsSpace)
+}
+
+// Lines of only whitespace count as blank, and the kept one is emptied.
+func collapseBlankLines(content string) string {
+	lines := strings.Split(content, "\n")
+	collapsed := make([]string, 0, len(lines))
+	previousBlank := false
+	for _, line := range lines {
+		blank := strings.TrimFunc(line, unicode.IsSpace) == ""
+		if blank && previousBlank {
+			continue
+		}
+		if blank {
+			line = ""
+		}
+		collapsed = append(collapsed, line)
+		previousBlank = blank
+	}
+	return strings.Join(collapsed, "\n")
+}
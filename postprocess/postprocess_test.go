@@ -0,0 +1,144 @@
+package postprocess
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractJson(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"Keeps valid JSON", `{"a": 1}`, `{"a": 1}`},
+		{"Keeps a valid array", `[{"a": 1}]`, `[{"a": 1}]`},
+		{
+			"Unwraps a json fence",
+			"```json\n{\"a\": 1}\n```",
+			`{"a": 1}`,
+		},
+		{
+			"Unwraps a fence without a language",
+			"```\n{\"a\": 1}\n```",
+			`{"a": 1}`,
+		},
+		{
+			"Unwraps a fence with CRLF and a preamble",
+			"Sure! Here you go:\r\n```JSON \r\n{\"a\": 1}\r\n```\r\nLet me know if you need more.",
+			`{"a": 1}`,
+		},
+		{
+			"Skips a fence that is not JSON",
+			"```python\nprint({'a': 1})\n```\n```json\n{\"b\": 2}\n```",
+			`{"b": 2}`,
+		},
+		{
+			"Finds an object after a preamble",
+			`Here is the JSON you requested: {"a": {"b": [1, 2]}} Hope it helps!`,
+			`{"a": {"b": [1, 2]}}`,
+		},
+		{
+			"Skips braces that are not JSON",
+			`Use {placeholders} like {this}: {"a": "}{"}`,
+			`{"a": "}{"}`,
+		},
+		{
+			"Finds an object whose string has a fence",
+			"```json\n{\"code\": \"```go\\nfmt.Println()\\n```\"}\n```",
+			"{\"code\": \"```go\\nfmt.Println()\\n```\"}",
+		},
+		{
+			"Keeps escaped quotes and unicode",
+			`Result: {"quote": "She said \"안녕\"", "emoji": "🙂"}`,
+			`{"quote": "She said \"안녕\"", "emoji": "🙂"}`,
+		},
+		{
+			"Keeps content without an object",
+			"I cannot answer that.",
+			"I cannot answer that.",
+		},
+		{
+			"Keeps a truncated object",
+			"```json\n{\"a\": [1, 2,",
+			"```json\n{\"a\": [1, 2,",
+		},
+		{"Keeps empty content", "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, extractJson(test.content))
+		})
+	}
+}
+
+func TestTrimTrailingWhitespace(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"Trims the end", "Hello \n\n\t ", "Hello"},
+		{"Trims each line", "a  \nb\t\n  c  ", "a\nb\n  c"},
+		{"Normalizes CRLF", "a \r\nb\r\n", "a\nb"},
+		{"Trims unicode spaces", "a 　\nb", "a\nb"},
+		{"Keeps the leading indentation", "    code", "    code"},
+		{"Keeps only whitespace empty", " \n\t", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, trimTrailingWhitespace(test.content))
+		})
+	}
+}
+
+func TestCollapseBlankLines(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"Collapses a run", "a\n\n\n\nb", "a\n\nb"},
+		{"Keeps a single blank line", "a\n\nb", "a\n\nb"},
+		{"Treats whitespace lines as blank", "a\n  \n\t\n \nb", "a\n\nb"},
+		{"Collapses at the ends", "\n\n\na\n\n\n", "\na\n"},
+		{"Keeps lines without blanks", "a\nb\nc", "a\nb\nc"},
+		{"Collapses CRLF blank lines", "a\r\n\r\n\r\nb", "a\r\n\nb"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, collapseBlankLines(test.content))
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Run("Parses the list", func(t *testing.T) {
+		names, err := Parse(" json-extract, trim ,,")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{JsonExtract, Trim}, names)
+	})
+
+	t.Run("Disables with none", func(t *testing.T) {
+		names, err := Parse("none")
+		assert.NoError(t, err)
+		assert.NotNil(t, names)
+		assert.Empty(t, names)
+	})
+
+	t.Run("Rejects unknown transforms", func(t *testing.T) {
+		_, err := Parse("trim,strip-markdown")
+		assert.ErrorContains(t, err, `unknown transform "strip-markdown"; must be one of json-extract, trim, collapse-blank-lines`)
+	})
+}
+
+func TestApply(t *testing.T) {
+	content := "Here is the JSON you requested:\n\n\n```json\n{\"a\": 1}\n```  \n"
+
+	t.Run("Applies the transforms in order", func(t *testing.T) {
+		assert.Equal(t, `{"a": 1}`, Apply(content, []string{JsonExtract, Trim}, true))
+		assert.Equal(t, "Here is the JSON you requested:\n\n```json\n{\"a\": 1}\n```", Apply(content, []string{CollapseBlankLines, Trim}, true))
+	})
+
+	t.Run("Skips json-extract unless JSON is requested", func(t *testing.T) {
+		assert.Equal(t, content, Apply(content, []string{JsonExtract}, false))
+	})
+}
@@ -0,0 +1,355 @@
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+type Endpoint struct {
+	client bedrockClient
+	region string
+
+	// Model name -> Bedrock model ID. The names not in it are sent as the
+	// model ID as is.
+	modelIds map[string]string
+
+	logger *zap.SugaredLogger
+}
+
+// Creates an endpoint for the AWS region. The credentials are looked up in
+// the environment and the shared credentials file. If roleArn is set, the
+// role is assumed with them.
+func NewEndpoint(region string, modelIds map[string]string, roleArn string, logger *zap.SugaredLogger) (*Endpoint, error) {
+	var credentials credentialsProvider = defaultCredentials{}
+	if roleArn != "" {
+		credentials = newAssumeRoleCredentials(credentials, roleArn, region)
+	}
+	return &Endpoint{
+		client:   newHttpClient(region, credentials),
+		region:   region,
+		modelIds: modelIds,
+		logger:   logger,
+	}, nil
+}
+
+func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	input, err := toConverseInput(openaiRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.LogRequest(ep.logger, openaiRequest)
+
+	output, err := ep.client.Converse(ctx, ep.modelId(openaiRequest.Model), input)
+	if err != nil {
+		var bedrockError *apiError
+		if errors.As(err, &bedrockError) && bedrockError.isQuota() {
+			return nil, provider.NewQuotaError(err, bedrockError.RetryAfter)
+		}
+		return nil, err
+	}
+
+	openaiResponse, err := toOpenAiResponse(output)
+	if err != nil {
+		return nil, err
+	}
+
+	return openai.FinalizeResponse(ep.Provider(), ep.Region(), openaiRequest.Model, openaiResponse), nil
+}
+
+func (ep *Endpoint) Provider() string {
+	return "bedrock"
+}
+
+func (ep *Endpoint) Region() string {
+	return ep.region
+}
+
+// Lists the foundation models, which checks the credentials without the cost
+// of a completion.
+func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := ep.client.ListFoundationModels(ctx); err != nil {
+		var bedrockError *apiError
+		if errors.As(err, &bedrockError) && bedrockError.isAuth() {
+			return 0, provider.NewAuthError(err)
+		}
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (ep *Endpoint) Shutdown() error {
+	return nil
+}
+
+func (ep *Endpoint) modelId(model string) string {
+	if modelId, exists := ep.modelIds[model]; exists {
+		return modelId
+	}
+	return model
+}
+
+func toConverseInput(openaiRequest *openai.ChatCompletionRequest) (*converseInput, error) {
+	if openaiRequest.ResponseFormat != nil {
+		return nil, fmt.Errorf("response_format is not supported with Bedrock")
+	}
+	if openaiRequest.WantsLogprobs() {
+		return nil, fmt.Errorf("logprobs is not supported with Bedrock")
+	}
+	if openaiRequest.HasAudio() {
+		return nil, provider.NewNotSupportedError("audio with Bedrock")
+	}
+
+	system, messages, err := toConverseMessages(openaiRequest.Messages)
+	if err != nil {
+		return nil, err
+	}
+	input := &converseInput{Messages: messages, System: system}
+
+	config := inferenceConfig{
+		MaxTokens:   openaiRequest.MaxTokens,
+		Temperature: openaiRequest.Temperature,
+		TopP:        openaiRequest.TopP,
+	}
+	if openaiRequest.MaxCompletionTokens != nil {
+		config.MaxTokens = openaiRequest.MaxCompletionTokens
+	}
+	if openaiRequest.StopSequences != nil {
+		config.StopSequences = openaiRequest.StopSequences.Sequences
+	}
+	if config.MaxTokens != nil || config.Temperature != nil || config.TopP != nil || len(config.StopSequences) > 0 {
+		input.InferenceConfig = &config
+	}
+
+	if len(openaiRequest.Tools) > 0 {
+		tools, err := toConverseTools(openaiRequest.Tools)
+		if err != nil {
+			return nil, err
+		}
+		input.ToolConfig = &toolConfig{Tools: tools}
+		if openaiRequest.ToolChoice != nil {
+			choice, err := toConverseToolChoice(openaiRequest.ToolChoice)
+			if err != nil {
+				return nil, err
+			}
+			input.ToolConfig.ToolChoice = choice
+		}
+	}
+
+	return input, nil
+}
+
+// Separates the system messages, wherever they are, into the system prompt,
+// since Converse only takes them apart from the conversation. The other
+// messages of the same role in a row are joined into one message, because
+// Converse requires the roles to alternate.
+func toConverseMessages(openaiMessages []openai.Message) ([]contentBlock, []converseMessage, error) {
+	if len(openaiMessages) == 0 {
+		return nil, nil, fmt.Errorf("at least one message is required")
+	}
+
+	system := []contentBlock{}
+	messages := []converseMessage{}
+	for index, message := range openaiMessages {
+		if message.IsSystem() {
+			text, err := messageText(message)
+			if err != nil {
+				return nil, nil, fmt.Errorf("system message %d: %v", index, err)
+			}
+			system = append(system, contentBlock{Text: &text})
+			continue
+		}
+
+		role, blocks, err := toConverseBlocks(message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("message %d: %v", index, err)
+		}
+		if len(messages) > 0 && messages[len(messages)-1].Role == role {
+			messages[len(messages)-1].Content = append(messages[len(messages)-1].Content, blocks...)
+			continue
+		}
+		messages = append(messages, converseMessage{Role: role, Content: blocks})
+	}
+	if len(system) == 0 {
+		system = nil
+	}
+	return system, messages, nil
+}
+
+// Returns the Converse role and the content blocks of the message. Tool
+// results are sent as the content of a user message.
+func toConverseBlocks(message openai.Message) (string, []contentBlock, error) {
+	switch message.Role {
+	case "tool":
+		if message.ToolCallId == nil {
+			return "", nil, fmt.Errorf("tool message must contain the corresponding tool call ID")
+		}
+		text, err := messageText(message)
+		if err != nil {
+			return "", nil, err
+		}
+		return "user", []contentBlock{{ToolResult: &toolResult{
+			ToolUseId: *message.ToolCallId,
+			Content:   []contentBlock{{Text: &text}},
+		}}}, nil
+	case "user":
+		text, err := messageText(message)
+		if err != nil {
+			return "", nil, err
+		}
+		return "user", []contentBlock{{Text: &text}}, nil
+	case "assistant":
+		blocks := []contentBlock{}
+		if message.Content != nil {
+			text, err := messageText(message)
+			if err != nil {
+				return "", nil, err
+			}
+			if text != "" {
+				blocks = append(blocks, contentBlock{Text: &text})
+			}
+		} else if message.Refusal != nil {
+			blocks = append(blocks, contentBlock{Text: message.Refusal})
+		}
+		for _, toolCall := range message.ToolCalls {
+			if toolCall.Type != "function" || toolCall.Function == nil {
+				return "", nil, fmt.Errorf("unsupported tool call type: %s", toolCall.Type)
+			}
+			arguments := json.RawMessage(toolCall.Function.Arguments)
+			if !json.Valid(arguments) {
+				return "", nil, fmt.Errorf("failed to parse tool arguments of %s", toolCall.Function.Name)
+			}
+			blocks = append(blocks, contentBlock{ToolUse: &toolUse{
+				ToolUseId: toolCall.Id,
+				Name:      toolCall.Function.Name,
+				Input:     arguments,
+			}})
+		}
+		if len(blocks) == 0 {
+			return "", nil, fmt.Errorf("assistant message must have content, refusal, or tool_calls")
+		}
+		return "assistant", blocks, nil
+	}
+	return "", nil, fmt.Errorf("unsupported message role: %s", message.Role)
+}
+
+// Returns the text of the message. Text parts are joined by a line break.
+// Other parts are rejected rather than dropped.
+func messageText(message openai.Message) (string, error) {
+	if message.Content == nil {
+		return "", fmt.Errorf("%s message must have content", message.Role)
+	}
+	if message.Content.String != nil {
+		return *message.Content.String, nil
+	}
+	texts := make([]string, 0, len(message.Content.Parts))
+	for _, part := range message.Content.Parts {
+		if part.Content.TextContent == nil {
+			return "", fmt.Errorf("only text content is supported with Bedrock")
+		}
+		texts = append(texts, part.Content.TextContent.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func toConverseTools(openaiTools []openai.Tool) ([]tool, error) {
+	tools := make([]tool, len(openaiTools))
+	for index, openaiTool := range openaiTools {
+		if openaiTool.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool type: %s", openaiTool.Type)
+		}
+		description := fmt.Sprintf("Tool %s", openaiTool.Function.Name)
+		if openaiTool.Function.Description != nil {
+			description = *openaiTool.Function.Description
+		}
+		var schema any = map[string]any{"type": "object", "properties": map[string]any{}}
+		if openaiTool.Function.Parameters != nil {
+			schema = openaiTool.Function.Parameters
+		}
+		tools[index] = tool{ToolSpec: toolSpec{
+			Name:        openaiTool.Function.Name,
+			Description: description,
+			InputSchema: inputSchema{Json: schema},
+		}}
+	}
+	return tools, nil
+}
+
+func toConverseToolChoice(openaiChoice *openai.ToolChoice) (*toolChoice, error) {
+	if openaiChoice.Value != nil {
+		switch *openaiChoice.Value {
+		case openai.ToolChoiceAuto:
+			return &toolChoice{Auto: &struct{}{}}, nil
+		case openai.ToolChoiceRequired:
+			return &toolChoice{Any: &struct{}{}}, nil
+		case openai.ToolChoiceNone:
+			return nil, fmt.Errorf("Bedrock does not support 'none' tool choice")
+		}
+	}
+	if openaiChoice.Struct == nil || openaiChoice.Struct.Function == nil {
+		return nil, fmt.Errorf("tool field must be set to either 'auto', 'required', 'none', or an object with a function name")
+	}
+	if openaiChoice.Struct.Type != "function" {
+		return nil, fmt.Errorf("unsupported tool type: %s", openaiChoice.Struct.Type)
+	}
+	return &toolChoice{Tool: &specificTool{Name: openaiChoice.Struct.Function.Name}}, nil
+}
+
+func toOpenAiResponse(output *converseOutput) (*openai.ChatCompletionResponse, error) {
+	message := openai.Message{Role: "assistant"}
+	content := strings.Builder{}
+	for _, block := range output.Output.Message.Content {
+		if block.Text != nil {
+			content.WriteString(*block.Text)
+		}
+		if block.ToolUse != nil {
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				Id:   block.ToolUse.ToolUseId,
+				Type: "function",
+				Function: &openai.FunctionCall{
+					Name:      block.ToolUse.Name,
+					Arguments: string(block.ToolUse.Input),
+				},
+			})
+		}
+	}
+	if content.Len() > 0 {
+		message.Content = &openai.MessageContent{String: utils.ToPtr(content.String())}
+	}
+
+	return &openai.ChatCompletionResponse{
+		Choices: []openai.Choice{{
+			Index:        0,
+			Message:      message,
+			FinishReason: toOpenAiFinishReason(output.StopReason),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     output.Usage.InputTokens,
+			CompletionTokens: output.Usage.OutputTokens,
+			TotalTokens:      output.Usage.InputTokens + output.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// Tool use ends with "stop" as with the Claude providers, so that clients see
+// the same finish reasons whichever of them serves the model.
+func toOpenAiFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "guardrail_intervened", "content_filtered":
+		return "content_filter"
+	}
+	return "stop"
+}
@@ -0,0 +1,191 @@
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+type fakeClient struct {
+	converse func(modelId string, input *converseInput) (*converseOutput, error)
+	list     func() error
+}
+
+func (c *fakeClient) Converse(ctx context.Context, modelId string, input *converseInput) (*converseOutput, error) {
+	return c.converse(modelId, input)
+}
+
+func (c *fakeClient) ListFoundationModels(ctx context.Context) error {
+	return c.list()
+}
+
+func newTestEndpoint(client *fakeClient) *Endpoint {
+	return &Endpoint{
+		client:   client,
+		region:   "us-east-1",
+		modelIds: map[string]string{"claude-3-5-sonnet": "anthropic.claude-3-5-sonnet-20240620-v1:0"},
+		logger:   zap.NewNop().Sugar(),
+	}
+}
+
+func parseOutput(t *testing.T, data string) *converseOutput {
+	var output converseOutput
+	assert.NoError(t, json.Unmarshal([]byte(data), &output))
+	return &output
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	t.Run("Generates text", func(t *testing.T) {
+		var receivedModelId string
+		var receivedInput *converseInput
+		endpoint := newTestEndpoint(&fakeClient{converse: func(modelId string, input *converseInput) (*converseOutput, error) {
+			receivedModelId, receivedInput = modelId, input
+			return parseOutput(t, `{
+				"output": {"message": {"role": "assistant", "content": [{"text": "Hello!"}]}},
+				"stopReason": "max_tokens",
+				"usage": {"inputTokens": 12, "outputTokens": 3, "totalTokens": 15}
+			}`), nil
+		}})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "claude-3-5-sonnet",
+			Messages: []openai.Message{
+				{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("Be brief.")}},
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}},
+			},
+			MaxTokens:   utils.ToPtr(int32(3)),
+			Temperature: utils.ToPtr(float32(0.5)),
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, "anthropic.claude-3-5-sonnet-20240620-v1:0", receivedModelId)
+		body, err := json.Marshal(receivedInput)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"messages": [{"role": "user", "content": [{"text": "Hi"}]}],
+			"system": [{"text": "Be brief."}],
+			"inferenceConfig": {"maxTokens": 3, "temperature": 0.5}
+		}`, string(body))
+
+		assert.Equal(t, "claude-3-5-sonnet", response.Model)
+		assert.Equal(t, "Hello!", *response.Choices[0].Message.Content.String)
+		assert.Equal(t, "length", response.Choices[0].FinishReason)
+		assert.Equal(t, openai.Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}, response.Usage)
+		assert.Regexp(t, `^chatcmpl-[0-9a-f]{32}$`, response.Id)
+		assert.Equal(t, "ogem/bedrock/"+endpoint.Region(), response.SystemFingerprint)
+	})
+
+	t.Run("Calls tools", func(t *testing.T) {
+		var receivedInput *converseInput
+		endpoint := newTestEndpoint(&fakeClient{converse: func(modelId string, input *converseInput) (*converseOutput, error) {
+			receivedInput = input
+			return parseOutput(t, `{
+				"output": {"message": {"role": "assistant", "content": [
+					{"text": "Checking."},
+					{"toolUse": {"toolUseId": "tooluse_2", "name": "get_weather", "input": {"city": "Busan"}}}
+				]}},
+				"stopReason": "tool_use",
+				"usage": {"inputTokens": 40, "outputTokens": 20, "totalTokens": 60}
+			}`), nil
+		}})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "anthropic.claude-3-haiku-20240307-v1:0",
+			Messages: []openai.Message{
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Weather in Seoul and Busan?")}},
+				{Role: "assistant", ToolCalls: []openai.ToolCall{{
+					Id:       "tooluse_1",
+					Type:     "function",
+					Function: &openai.FunctionCall{Name: "get_weather", Arguments: `{"city": "Seoul"}`},
+				}}},
+				{Role: "tool", ToolCallId: utils.ToPtr("tooluse_1"), Content: &openai.MessageContent{String: utils.ToPtr("Sunny")}},
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("And Busan?")}},
+			},
+			Tools: []openai.Tool{{Type: "function", Function: openai.FunctionTool{
+				Name:        "get_weather",
+				Description: utils.ToPtr("Returns the weather of the city."),
+			}}},
+			ToolChoice: &openai.ToolChoice{Value: utils.ToPtr(openai.ToolChoiceRequired)},
+		})
+		assert.NoError(t, err)
+
+		body, err := json.Marshal(receivedInput)
+		assert.NoError(t, err)
+		// The tool result and the next user message share a user message.
+		assert.JSONEq(t, `{
+			"messages": [
+				{"role": "user", "content": [{"text": "Weather in Seoul and Busan?"}]},
+				{"role": "assistant", "content": [{"toolUse": {"toolUseId": "tooluse_1", "name": "get_weather", "input": {"city": "Seoul"}}}]},
+				{"role": "user", "content": [
+					{"toolResult": {"toolUseId": "tooluse_1", "content": [{"text": "Sunny"}]}},
+					{"text": "And Busan?"}
+				]}
+			],
+			"toolConfig": {
+				"tools": [{"toolSpec": {
+					"name": "get_weather",
+					"description": "Returns the weather of the city.",
+					"inputSchema": {"json": {"type": "object", "properties": {}}}
+				}}],
+				"toolChoice": {"any": {}}
+			}
+		}`, string(body))
+
+		message := response.Choices[0].Message
+		assert.Equal(t, "Checking.", *message.Content.String)
+		assert.Equal(t, []openai.ToolCall{{
+			Id:       "tooluse_2",
+			Type:     "function",
+			Function: &openai.FunctionCall{Name: "get_weather", Arguments: `{"city": "Busan"}`},
+		}}, message.ToolCalls)
+		assert.Equal(t, "stop", response.Choices[0].FinishReason)
+	})
+
+	t.Run("Reports throttling as quota errors", func(t *testing.T) {
+		endpoint := newTestEndpoint(&fakeClient{converse: func(modelId string, input *converseInput) (*converseOutput, error) {
+			return nil, &apiError{StatusCode: 429, Type: "ThrottlingException", Message: "Too many requests", RetryAfter: 7 * time.Second}
+		}})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "claude-3-5-sonnet",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+		})
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+		assert.Equal(t, 7*time.Second, quotaError.RetryAfter)
+		assert.ErrorContains(t, err, "quota")
+	})
+
+	t.Run("Does not report other errors as quota errors", func(t *testing.T) {
+		endpoint := newTestEndpoint(&fakeClient{converse: func(modelId string, input *converseInput) (*converseOutput, error) {
+			return nil, &apiError{StatusCode: 400, Type: "ValidationException", Message: "Malformed input"}
+		}})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "claude-3-5-sonnet",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+		})
+		var quotaError *provider.QuotaError
+		assert.False(t, errors.As(err, &quotaError))
+		assert.ErrorContains(t, err, "ValidationException")
+	})
+}
+
+func TestPing(t *testing.T) {
+	endpoint := newTestEndpoint(&fakeClient{list: func() error {
+		return &apiError{StatusCode: 403, Type: "AccessDeniedException", Message: "Not authorized"}
+	}})
+
+	_, err := endpoint.Ping(context.Background())
+	var authError *provider.AuthError
+	assert.ErrorAs(t, err, &authError)
+}
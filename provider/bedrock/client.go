@@ -0,0 +1,239 @@
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yanolja/ogem/provider"
+)
+
+// Subset of the Bedrock Runtime and Bedrock APIs used by the endpoint, so
+// that tests can replace them.
+type bedrockClient interface {
+	Converse(ctx context.Context, modelId string, input *converseInput) (*converseOutput, error)
+	ListFoundationModels(ctx context.Context) error
+}
+
+// Request body of the Converse API.
+type converseInput struct {
+	Messages        []converseMessage `json:"messages"`
+	System          []contentBlock    `json:"system,omitempty"`
+	InferenceConfig *inferenceConfig  `json:"inferenceConfig,omitempty"`
+	ToolConfig      *toolConfig       `json:"toolConfig,omitempty"`
+}
+
+type converseMessage struct {
+	Role    string         `json:"role"`
+	Content []contentBlock `json:"content"`
+}
+
+// One of the fields is set.
+type contentBlock struct {
+	Text       *string     `json:"text,omitempty"`
+	ToolUse    *toolUse    `json:"toolUse,omitempty"`
+	ToolResult *toolResult `json:"toolResult,omitempty"`
+}
+
+type toolUse struct {
+	ToolUseId string          `json:"toolUseId"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+}
+
+type toolResult struct {
+	ToolUseId string         `json:"toolUseId"`
+	Content   []contentBlock `json:"content"`
+}
+
+type inferenceConfig struct {
+	MaxTokens     *int32   `json:"maxTokens,omitempty"`
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+}
+
+type toolConfig struct {
+	Tools      []tool      `json:"tools"`
+	ToolChoice *toolChoice `json:"toolChoice,omitempty"`
+}
+
+type tool struct {
+	ToolSpec toolSpec `json:"toolSpec"`
+}
+
+type toolSpec struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	InputSchema inputSchema `json:"inputSchema"`
+}
+
+type inputSchema struct {
+	Json any `json:"json"`
+}
+
+// One of the fields is set.
+type toolChoice struct {
+	Auto *struct{}     `json:"auto,omitempty"`
+	Any  *struct{}     `json:"any,omitempty"`
+	Tool *specificTool `json:"tool,omitempty"`
+}
+
+type specificTool struct {
+	Name string `json:"name"`
+}
+
+// Response body of the Converse API.
+type converseOutput struct {
+	Output struct {
+		Message converseMessage `json:"message"`
+	} `json:"output"`
+	StopReason string `json:"stopReason"`
+	Usage      struct {
+		InputTokens  int32 `json:"inputTokens"`
+		OutputTokens int32 `json:"outputTokens"`
+		TotalTokens  int32 `json:"totalTokens"`
+	} `json:"usage"`
+}
+
+// Returned when Bedrock responds with an error status.
+type apiError struct {
+	StatusCode int
+
+	// Exception name without the namespace. E.g., ThrottlingException
+	Type    string
+	Message string
+
+	// Zero if Bedrock did not suggest a duration.
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("bedrock: %s (status %d): %s", e.Type, e.StatusCode, e.Message)
+}
+
+// Whether Bedrock rejected the request because of the rate limits or the
+// quotas of the account.
+func (e *apiError) isQuota() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.Type == "ThrottlingException" || e.Type == "ServiceQuotaExceededException"
+}
+
+// Whether Bedrock rejected the credentials or their permissions.
+func (e *apiError) isAuth() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden ||
+		e.Type == "UnrecognizedClientException" || e.Type == "ExpiredTokenException"
+}
+
+// Calls the Bedrock REST APIs with the requests signed by the credentials.
+type httpClient struct {
+	region      string
+	credentials credentialsProvider
+	httpClient  *http.Client
+
+	// E.g., https://bedrock-runtime.us-east-1.amazonaws.com
+	runtimeUrl string
+
+	// E.g., https://bedrock.us-east-1.amazonaws.com
+	controlUrl string
+}
+
+func newHttpClient(region string, credentials credentialsProvider) *httpClient {
+	return &httpClient{
+		region:      region,
+		credentials: credentials,
+		httpClient:  provider.NewHttpClient("bedrock", 0),
+		runtimeUrl:  fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", region),
+		controlUrl:  fmt.Sprintf("https://bedrock.%s.amazonaws.com", region),
+	}
+}
+
+func (c *httpClient) Converse(ctx context.Context, modelId string, input *converseInput) (*converseOutput, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal Converse request: %v", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", c.runtimeUrl+"/model/"+uriEncode(modelId)+"/converse", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	responseBody, err := c.do(request)
+	if err != nil {
+		return nil, err
+	}
+	var output converseOutput
+	if err := json.Unmarshal(responseBody, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse Converse response: %v", err)
+	}
+	return &output, nil
+}
+
+func (c *httpClient) ListFoundationModels(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", c.controlUrl+"/foundation-models", nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(request)
+	return err
+}
+
+// Signs and sends the request. Returns the response body, or an apiError for
+// the error statuses.
+func (c *httpClient) do(request *http.Request) ([]byte, error) {
+	creds, err := c.credentials.retrieve(request.Context())
+	if err != nil {
+		return nil, provider.NewAuthError(err)
+	}
+	if err := signRequest(request, creds, c.region, "bedrock", time.Now()); err != nil {
+		return nil, err
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer provider.DrainAndClose(response.Body)
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, newApiError(response, body)
+	}
+	return body, nil
+}
+
+// The exception name is in the X-Amzn-ErrorType header, followed by the
+// namespace after a colon, and the message is in the body.
+func newApiError(response *http.Response, body []byte) *apiError {
+	var errorBody struct {
+		Message string `json:"message"`
+		Type    string `json:"__type"`
+	}
+	json.Unmarshal(body, &errorBody)
+
+	errorType := response.Header.Get("X-Amzn-ErrorType")
+	if errorType == "" {
+		errorType = errorBody.Type
+	}
+	errorType, _, _ = strings.Cut(errorType, ":")
+	if index := strings.LastIndex(errorType, "#"); index >= 0 {
+		errorType = errorType[index+1:]
+	}
+	message := errorBody.Message
+	if message == "" {
+		message = string(body)
+	}
+	return &apiError{
+		StatusCode: response.StatusCode,
+		Type:       errorType,
+		Message:    message,
+		RetryAfter: provider.RetryAfterFromHeader(response.Header),
+	}
+}
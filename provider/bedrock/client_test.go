@@ -0,0 +1,64 @@
+package bedrock
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticCredentials credentials
+
+func (c staticCredentials) retrieve(ctx context.Context) (credentials, error) {
+	return credentials(c), nil
+}
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *httpClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := newHttpClient("us-east-1", staticCredentials{AccessKeyId: "AKID", SecretAccessKey: "secret"})
+	client.runtimeUrl = server.URL
+	client.controlUrl = server.URL
+	return client
+}
+
+func TestConverse(t *testing.T) {
+	t.Run("Sends a signed request", func(t *testing.T) {
+		var receivedPath, receivedAuthorization string
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			receivedPath = r.URL.EscapedPath()
+			receivedAuthorization = r.Header.Get("Authorization")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"output": {"message": {"role": "assistant", "content": [{"text": "Hi"}]}}, "stopReason": "end_turn"}`))
+		})
+
+		output, err := client.Converse(context.Background(), "anthropic.claude-3-haiku-20240307-v1:0", &converseInput{})
+		assert.NoError(t, err)
+		assert.Equal(t, "Hi", *output.Output.Message.Content[0].Text)
+		assert.Equal(t, "/model/anthropic.claude-3-haiku-20240307-v1%3A0/converse", receivedPath)
+		assert.True(t, strings.HasPrefix(receivedAuthorization, "AWS4-HMAC-SHA256 Credential=AKID/"), receivedAuthorization)
+		assert.Contains(t, receivedAuthorization, "/us-east-1/bedrock/aws4_request")
+	})
+
+	t.Run("Parses the errors", func(t *testing.T) {
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Amzn-ErrorType", "ThrottlingException:http://internal.amazon.com/coral/com.amazon.bedrock/")
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "Too many requests, please wait before trying again."}`))
+		})
+
+		_, err := client.Converse(context.Background(), "model", &converseInput{})
+		assert.Equal(t, &apiError{
+			StatusCode: http.StatusTooManyRequests,
+			Type:       "ThrottlingException",
+			Message:    "Too many requests, please wait before trying again.",
+			RetryAfter: 3 * time.Second,
+		}, err)
+	})
+}
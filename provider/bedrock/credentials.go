@@ -0,0 +1,186 @@
+package bedrock
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time before the expiry of the assumed role credentials to renew them.
+const credentialsRenewalMargin = 5 * time.Minute
+
+type credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+
+	// Empty for long-term credentials.
+	SessionToken string
+
+	// Zero for the credentials that do not expire.
+	Expiration time.Time
+}
+
+type credentialsProvider interface {
+	retrieve(ctx context.Context) (credentials, error)
+}
+
+// Looks up the credentials the way the AWS CLI does, in the environment
+// variables and then in the profile of the shared credentials file.
+// Instance and container roles are not supported, so they must be exported
+// or assumed with a role ARN.
+type defaultCredentials struct{}
+
+func (defaultCredentials) retrieve(ctx context.Context) (credentials, error) {
+	if accessKeyId := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyId != "" {
+		return credentials{
+			AccessKeyId:     accessKeyId,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return credentials{}, fmt.Errorf("no AWS credentials in the environment: %v", err)
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return credentials{}, fmt.Errorf("no AWS credentials in the environment or the shared credentials file: %v", err)
+	}
+	defer file.Close()
+	return readSharedCredentials(file, profile)
+}
+
+// Reads the credentials of the profile in the INI format of the shared
+// credentials file.
+func readSharedCredentials(reader io.Reader, profile string) (credentials, error) {
+	creds := credentials{}
+	inProfile := false
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			creds.AccessKeyId = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return credentials{}, fmt.Errorf("failed to read the shared credentials file: %v", err)
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return credentials{}, fmt.Errorf("no AWS credentials for profile %q", profile)
+	}
+	return creds, nil
+}
+
+// Assumes the role with the source credentials through STS and renews the
+// temporary credentials shortly before they expire.
+type assumeRoleCredentials struct {
+	source     credentialsProvider
+	roleArn    string
+	region     string
+	httpClient *http.Client
+
+	cached credentials
+	mutex  sync.Mutex
+}
+
+func newAssumeRoleCredentials(source credentialsProvider, roleArn string, region string) *assumeRoleCredentials {
+	return &assumeRoleCredentials{
+		source:     source,
+		roleArn:    roleArn,
+		region:     region,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *assumeRoleCredentials) retrieve(ctx context.Context) (credentials, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cached.AccessKeyId != "" && time.Now().Add(credentialsRenewalMargin).Before(c.cached.Expiration) {
+		return c.cached, nil
+	}
+	sourceCreds, err := c.source.retrieve(ctx)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {c.roleArn},
+		"RoleSessionName": {"ogem"},
+	}
+	request, err := http.NewRequestWithContext(
+		ctx, "POST", fmt.Sprintf("https://sts.%s.amazonaws.com/", c.region), strings.NewReader(form.Encode()))
+	if err != nil {
+		return credentials{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := signRequest(request, sourceCreds, c.region, "sts", time.Now()); err != nil {
+		return credentials{}, err
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return credentials{}, fmt.Errorf("failed to assume role %s: %v", c.roleArn, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return credentials{}, fmt.Errorf("failed to read AssumeRole response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return credentials{}, fmt.Errorf("failed to assume role %s: status %d: %s", c.roleArn, response.StatusCode, body)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyId     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return credentials{}, fmt.Errorf("failed to parse AssumeRole response: %v", err)
+	}
+	c.cached = credentials(result.Credentials)
+	return c.cached, nil
+}
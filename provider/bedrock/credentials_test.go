@@ -0,0 +1,33 @@
+package bedrock
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSharedCredentials(t *testing.T) {
+	file := `
+[default]
+aws_access_key_id = AKID1
+aws_secret_access_key = secret1
+
+# Temporary credentials
+[bedrock]
+aws_access_key_id=AKID2
+aws_secret_access_key=secret2
+aws_session_token=token2
+`
+
+	creds, err := readSharedCredentials(strings.NewReader(file), "bedrock")
+	assert.NoError(t, err)
+	assert.Equal(t, credentials{AccessKeyId: "AKID2", SecretAccessKey: "secret2", SessionToken: "token2"}, creds)
+
+	creds, err = readSharedCredentials(strings.NewReader(file), "default")
+	assert.NoError(t, err)
+	assert.Equal(t, credentials{AccessKeyId: "AKID1", SecretAccessKey: "secret1"}, creds)
+
+	_, err = readSharedCredentials(strings.NewReader(file), "unknown")
+	assert.ErrorContains(t, err, `no AWS credentials for profile "unknown"`)
+}
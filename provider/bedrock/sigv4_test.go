@@ -0,0 +1,45 @@
+package bedrock
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignRequest(t *testing.T) {
+	creds := credentials{AccessKeyId: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+	t.Run("Matches the AWS test suite", func(t *testing.T) {
+		// The get-vanilla case of the Signature Version 4 test suite.
+		request, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+		assert.NoError(t, err)
+
+		assert.NoError(t, signRequest(request, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)))
+		assert.Equal(t, "20150830T123600Z", request.Header.Get("X-Amz-Date"))
+		assert.Equal(t,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+				"SignedHeaders=host;x-amz-date, "+
+				"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+			request.Header.Get("Authorization"))
+	})
+
+	t.Run("Signs the session token", func(t *testing.T) {
+		request, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+		assert.NoError(t, err)
+		sessionCreds := creds
+		sessionCreds.SessionToken = "token"
+
+		assert.NoError(t, signRequest(request, sessionCreds, "us-east-1", "service", time.Now()))
+		assert.Equal(t, "token", request.Header.Get("X-Amz-Security-Token"))
+		assert.Contains(t, request.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+	})
+}
+
+func TestCanonicalUri(t *testing.T) {
+	// The model ID is escaped once in the request and once more in the
+	// canonical request.
+	assert.Equal(t, "/model/anthropic.claude-3-haiku-20240307-v1%253A0/converse", canonicalUri("/model/anthropic.claude-3-haiku-20240307-v1%3A0/converse"))
+	assert.Equal(t, "/", canonicalUri(""))
+}
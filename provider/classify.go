@@ -0,0 +1,202 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Returned when the provider responds with an error that is not converted to
+// a more specific one, so that it can still be classified by its status and
+// code instead of its text.
+type ProviderError struct {
+	// HTTP status of the response. Zero if the provider does not speak HTTP,
+	// such as the gRPC endpoints.
+	StatusCode int
+
+	// Code of the error parsed from the response. E.g., context_length_exceeded
+	// of OpenAI, overloaded_error of Claude, and RESOURCE_EXHAUSTED of Gemini.
+	Code string
+
+	err error
+}
+
+func NewProviderError(statusCode int, code string, err error) *ProviderError {
+	return &ProviderError{StatusCode: statusCode, Code: code, err: err}
+}
+
+func (e *ProviderError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.err
+}
+
+// How the failover loop handles an error of an endpoint.
+type ErrorClass int
+
+const (
+	// Not recognized. The request fails without trying the other endpoints.
+	Unclassified ErrorClass = iota
+
+	// The endpoint is rate limited or out of quota. It is disabled for a while
+	// and the other endpoints are tried.
+	Retryable429
+
+	// The endpoint failed temporarily, such as when it is overloaded or timed
+	// out. The other endpoints are tried without disabling it.
+	RetryableTransient
+
+	// The request itself is rejected, so no other endpoint can serve it.
+	NonRetryableBadRequest
+
+	// The credentials are rejected. No request will succeed until they are
+	// fixed.
+	NonRetryableAuth
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Retryable429:
+		return "retryable_429"
+	case RetryableTransient:
+		return "retryable_transient"
+	case NonRetryableBadRequest:
+		return "non_retryable_bad_request"
+	case NonRetryableAuth:
+		return "non_retryable_auth"
+	}
+	return "unclassified"
+}
+
+// Classes of the error codes of the providers, keyed by the code in lower case
+// without underscores so that the gRPC names (ResourceExhausted) match the
+// REST ones (RESOURCE_EXHAUSTED).
+var errorCodeClasses = map[string]ErrorClass{
+	// OpenAI
+	"ratelimitexceeded":     Retryable429,
+	"insufficientquota":     Retryable429,
+	"servererror":           RetryableTransient,
+	"contextlengthexceeded": NonRetryableBadRequest,
+	"invalidrequesterror":   NonRetryableBadRequest,
+	"invalidapikey":         NonRetryableAuth,
+
+	// Claude
+	"ratelimiterror":      Retryable429,
+	"overloadederror":     RetryableTransient,
+	"apierror":            RetryableTransient,
+	"requesttoolarge":     NonRetryableBadRequest,
+	"authenticationerror": NonRetryableAuth,
+	"permissionerror":     NonRetryableAuth,
+
+	// Gemini
+	"resourceexhausted":  Retryable429,
+	"unavailable":        RetryableTransient,
+	"deadlineexceeded":   RetryableTransient,
+	"invalidargument":    NonRetryableBadRequest,
+	"failedprecondition": NonRetryableBadRequest,
+	"unauthenticated":    NonRetryableAuth,
+	"permissiondenied":   NonRetryableAuth,
+}
+
+// Returns the class of an error with the HTTP status and the code of the
+// provider. A known code takes precedence over the status, since it is more
+// specific: OpenAI rejects an invalid API key as invalid_request_error, but
+// with the invalid_api_key code.
+func Classify(statusCode int, code string) ErrorClass {
+	normalized := strings.ReplaceAll(strings.ToLower(code), "_", "")
+	if class, found := errorCodeClasses[normalized]; found {
+		return class
+	}
+
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return Retryable429
+	case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+		// Overloaded of Claude.
+		529:
+		return RetryableTransient
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return NonRetryableBadRequest
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return NonRetryableAuth
+	}
+	return Unclassified
+}
+
+// Returns the class of an error returned by an endpoint. The typed errors are
+// classified by their type, status, and code. The others are from the
+// providers that do not return structured errors yet, and are recognized as
+// quota errors by their text as before.
+func ClassifyError(err error) ErrorClass {
+	var quotaError *QuotaError
+	if errors.As(err, &quotaError) {
+		return Retryable429
+	}
+	var authError *AuthError
+	if errors.As(err, &authError) {
+		return NonRetryableAuth
+	}
+	var providerError *ProviderError
+	if errors.As(err, &providerError) {
+		return Classify(providerError.StatusCode, providerError.Code)
+	}
+	var netError net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netError) && netError.Timeout()) {
+		return RetryableTransient
+	}
+	return classifyErrorText(err)
+}
+
+// Words of the quota errors of the providers without structured errors.
+var quotaErrorWords = []string{"429", "quota", "exceeded", "throughput", "exhausted"}
+
+func classifyErrorText(err error) ErrorClass {
+	loweredError := strings.ToLower(err.Error())
+	for _, word := range quotaErrorWords {
+		if strings.Contains(loweredError, word) {
+			return Retryable429
+		}
+	}
+	return Unclassified
+}
+
+// Returns the code of the error body of OpenAI, Claude, or Gemini. Empty if
+// the body is not one of them.
+//
+// OpenAI:  {"error": {"type": "invalid_request_error", "code": "context_length_exceeded"}}
+// Claude:  {"type": "error", "error": {"type": "overloaded_error"}}
+// Gemini:  {"error": {"code": 429, "status": "RESOURCE_EXHAUSTED"}}
+func ErrorCodeFromBody(body string) string {
+	var errorBody struct {
+		Error struct {
+			Type   string          `json:"type"`
+			Code   json.RawMessage `json:"code"`
+			Status string          `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &errorBody); err != nil {
+		return ""
+	}
+	if errorBody.Error.Status != "" {
+		return errorBody.Error.Status
+	}
+	// The code of OpenAI is a string or null, while that of Gemini is the
+	// HTTP status.
+	var code string
+	if err := json.Unmarshal(errorBody.Error.Code, &code); err == nil && code != "" {
+		return code
+	}
+	return errorBody.Error.Type
+}
+
+// Returns the error of a response with an unexpected status, with the code
+// parsed from its body.
+func NewStatusError(statusCode int, body []byte) *ProviderError {
+	return NewProviderError(statusCode, ErrorCodeFromBody(string(body)), fmt.Errorf("unexpected status code: %d, body: %s", statusCode, string(body)))
+}
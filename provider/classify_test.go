@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyErrorBodies(t *testing.T) {
+	tests := []struct {
+		file       string
+		statusCode int
+		code       string
+		expected   ErrorClass
+	}{
+		{"openai_rate_limit.json", http.StatusTooManyRequests, "rate_limit_exceeded", Retryable429},
+		{"openai_context_length.json", http.StatusBadRequest, "context_length_exceeded", NonRetryableBadRequest},
+		{"openai_invalid_api_key.json", http.StatusUnauthorized, "invalid_api_key", NonRetryableAuth},
+		{"openai_server_error.json", http.StatusInternalServerError, "server_error", RetryableTransient},
+		{"claude_rate_limit.json", http.StatusTooManyRequests, "rate_limit_error", Retryable429},
+		{"claude_prompt_too_long.json", http.StatusBadRequest, "invalid_request_error", NonRetryableBadRequest},
+		{"claude_overloaded.json", 529, "overloaded_error", RetryableTransient},
+		{"claude_authentication.json", http.StatusUnauthorized, "authentication_error", NonRetryableAuth},
+		{"gemini_resource_exhausted.json", http.StatusTooManyRequests, "RESOURCE_EXHAUSTED", Retryable429},
+		{"gemini_invalid_argument.json", http.StatusBadRequest, "INVALID_ARGUMENT", NonRetryableBadRequest},
+		{"gemini_unavailable.json", http.StatusServiceUnavailable, "UNAVAILABLE", RetryableTransient},
+		{"gemini_permission_denied.json", http.StatusForbidden, "PERMISSION_DENIED", NonRetryableAuth},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "errors", test.file))
+			assert.NoError(t, err)
+
+			providerError := NewStatusError(test.statusCode, body)
+			assert.Equal(t, test.code, providerError.Code)
+			assert.Equal(t, test.expected, ClassifyError(providerError))
+			assert.Equal(t, test.expected, ClassifyError(fmt.Errorf("failed: %w", providerError)))
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	t.Run("Code takes precedence over status", func(t *testing.T) {
+		assert.Equal(t, NonRetryableAuth, Classify(http.StatusBadRequest, "invalid_api_key"))
+	})
+
+	t.Run("gRPC code names", func(t *testing.T) {
+		assert.Equal(t, Retryable429, Classify(0, "ResourceExhausted"))
+		assert.Equal(t, RetryableTransient, Classify(0, "DeadlineExceeded"))
+		assert.Equal(t, NonRetryableBadRequest, Classify(0, "InvalidArgument"))
+		assert.Equal(t, NonRetryableAuth, Classify(0, "Unauthenticated"))
+	})
+
+	t.Run("Unknown code falls back to status", func(t *testing.T) {
+		assert.Equal(t, Retryable429, Classify(http.StatusTooManyRequests, "requests"))
+		assert.Equal(t, RetryableTransient, Classify(http.StatusBadGateway, ""))
+		assert.Equal(t, RetryableTransient, Classify(http.StatusGatewayTimeout, ""))
+		assert.Equal(t, NonRetryableBadRequest, Classify(http.StatusRequestEntityTooLarge, ""))
+		assert.Equal(t, NonRetryableAuth, Classify(http.StatusForbidden, ""))
+	})
+
+	t.Run("Unknown code and status", func(t *testing.T) {
+		assert.Equal(t, Unclassified, Classify(http.StatusNotFound, "model_not_found"))
+		assert.Equal(t, Unclassified, Classify(0, ""))
+	})
+}
+
+func TestClassifyError(t *testing.T) {
+	t.Run("Rate limit without quota words", func(t *testing.T) {
+		err := NewProviderError(http.StatusTooManyRequests, "", errors.New("rate limit reached"))
+		assert.Equal(t, Retryable429, ClassifyError(err))
+	})
+
+	t.Run("Bad request with quota words", func(t *testing.T) {
+		err := NewProviderError(http.StatusBadRequest, "invalid_request_error", errors.New("prompt exceeded maximum length"))
+		assert.Equal(t, NonRetryableBadRequest, ClassifyError(err))
+	})
+
+	t.Run("Typed errors", func(t *testing.T) {
+		assert.Equal(t, Retryable429, ClassifyError(NewQuotaError(errors.New("slow down"), time.Second)))
+		assert.Equal(t, NonRetryableAuth, ClassifyError(NewAuthError(errors.New("invalid key"))))
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		assert.Equal(t, RetryableTransient, ClassifyError(fmt.Errorf("failed to send request: %w", context.DeadlineExceeded)))
+	})
+
+	// Pins the behavior for the providers that do not return structured
+	// errors yet.
+	t.Run("Text fallback", func(t *testing.T) {
+		tests := []struct {
+			message  string
+			expected ErrorClass
+		}{
+			{"error 429", Retryable429},
+			{"Quota reached", Retryable429},
+			{"prompt exceeded maximum length", Retryable429},
+			{"provisioned throughput is busy", Retryable429},
+			{"resource exhausted", Retryable429},
+			{"rate limit reached", Unclassified},
+			{"connection reset by peer", Unclassified},
+		}
+		for _, test := range tests {
+			assert.Equal(t, test.expected, ClassifyError(errors.New(test.message)), test.message)
+		}
+	})
+}
+
+func TestErrorCodeFromBody(t *testing.T) {
+	t.Run("Null code of OpenAI falls back to type", func(t *testing.T) {
+		assert.Equal(t, "server_error", ErrorCodeFromBody(`{"error": {"type": "server_error", "code": null}}`))
+	})
+
+	t.Run("Numeric code of Gemini is ignored", func(t *testing.T) {
+		assert.Equal(t, "", ErrorCodeFromBody(`{"error": {"code": 500}}`))
+	})
+
+	t.Run("Not JSON", func(t *testing.T) {
+		assert.Equal(t, "", ErrorCodeFromBody("upstream connect error"))
+	})
+}
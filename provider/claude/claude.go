@@ -2,14 +2,18 @@ package claude
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
+	"go.uber.org/zap"
 
 	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
 	"github.com/yanolja/ogem/utils"
 	"github.com/yanolja/ogem/utils/array"
 )
@@ -17,23 +21,49 @@ import (
 // A unique identifier for the Claude provider
 const REGION = "claude"
 
+// How the system messages after the start of the conversation are sent,
+// since Claude only accepts a system prompt before the first message.
+const (
+	// Sends them as user messages wrapped in a <system> tag, in place.
+	MidSystemInline = "inline"
+
+	// Appends them to the system prompt.
+	MidSystemMerge = "merge"
+
+	// Rejects the request.
+	MidSystemError = "error"
+)
+
 type Endpoint struct {
 	client *anthropic.Client
+	logger *zap.SugaredLogger
+
+	// One of the MidSystem strategies. Empty for inline.
+	midSystemMessages string
 }
 
-func NewEndpoint(apiKey string) (*Endpoint, error) {
-	client := anthropic.NewClient(option.WithAPIKey(apiKey))
-	return &Endpoint{client: client}, nil
+func NewEndpoint(apiKey string, midSystemMessages string, logger *zap.SugaredLogger) (*Endpoint, error) {
+	client := anthropic.NewClient(option.WithAPIKey(apiKey), option.WithHTTPClient(provider.NewHttpClient("claude", 0)))
+	return &Endpoint{client: client, logger: logger, midSystemMessages: midSystemMessages}, nil
 }
 
 func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
-	claudeParams, err := toClaudeParams(openaiRequest)
+	claudeParams, err := toClaudeParams(openaiRequest, ep.midSystemMessages)
 	if err != nil {
 		return nil, err
 	}
 
-	claudeResponse, err := ep.client.Messages.New(ctx, *claudeParams)
+	provider.LogRequest(ep.logger, openaiRequest)
+
+	claudeResponse, err := ep.client.Messages.New(ctx, *claudeParams, requestOptions(ctx)...)
 	if err != nil {
+		var apiError *anthropic.Error
+		if errors.As(err, &apiError) {
+			if apiError.StatusCode == http.StatusTooManyRequests {
+				return nil, provider.NewQuotaError(err, provider.RetryAfterFromHeader(apiError.Response.Header))
+			}
+			return nil, provider.NewProviderError(apiError.StatusCode, provider.ErrorCodeFromBody(apiError.JSON.RawJSON()), err)
+		}
 		return nil, err
 	}
 
@@ -45,6 +75,42 @@ func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *o
 	return openai.FinalizeResponse(ep.Provider(), ep.Region(), openaiRequest.Model, openaiResponse), nil
 }
 
+// Returns the options that override the API key of the endpoint with that of
+// the context, if any.
+func requestOptions(ctx context.Context) []option.RequestOption {
+	if apiKey, found := provider.ApiKeyFrom(ctx); found {
+		return []option.RequestOption{option.WithAPIKey(apiKey)}
+	}
+	return nil
+}
+
+func (ep *Endpoint) CountTokens(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	claudeParams, err := toClaudeParams(openaiRequest, ep.midSystemMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	var countResponse struct {
+		InputTokens int32 `json:"input_tokens"`
+	}
+	// The count_tokens API rejects the generation parameters.
+	options := append([]option.RequestOption{
+		option.WithHeader("anthropic-beta", "token-counting-2024-11-01"),
+		option.WithJSONDel("max_tokens"),
+		option.WithJSONDel("stop_sequences"),
+		option.WithJSONDel("temperature"),
+		option.WithJSONDel("top_p"),
+	}, requestOptions(ctx)...)
+	err = ep.client.Post(ctx, "v1/messages/count_tokens", claudeParams, &countResponse, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &openai.TokenCountResponse{
+		PromptTokens: countResponse.InputTokens,
+		Tokenizer:    "anthropic/" + standardizeModelName(openaiRequest.Model),
+	}, nil
+}
+
 func (ep *Endpoint) Provider() string {
 	return "claude"
 }
@@ -63,6 +129,10 @@ func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
 		}),
 	})
 	if err != nil {
+		var apiError *anthropic.Error
+		if errors.As(err, &apiError) && (apiError.StatusCode == http.StatusUnauthorized || apiError.StatusCode == http.StatusForbidden) {
+			return 0, provider.NewAuthError(err)
+		}
 		return 0, err
 	}
 	return time.Since(start), nil
@@ -72,8 +142,8 @@ func (ep *Endpoint) Shutdown() error {
 	return nil
 }
 
-func toClaudeParams(openaiRequest *openai.ChatCompletionRequest) (*anthropic.MessageNewParams, error) {
-	messages, err := toClaudeMessages(openaiRequest.Messages)
+func toClaudeParams(openaiRequest *openai.ChatCompletionRequest, midSystemMessages string) (*anthropic.MessageNewParams, error) {
+	messages, err := toClaudeMessages(openaiRequest.Messages, midSystemMessages)
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +169,7 @@ func toClaudeParams(openaiRequest *openai.ChatCompletionRequest) (*anthropic.Mes
 	if openaiRequest.StopSequences != nil {
 		params.StopSequences = anthropic.F(openaiRequest.StopSequences.Sequences)
 	}
-	systemMessage, err := toClaudeSystemMessage(openaiRequest)
+	systemMessage, err := toClaudeSystemMessage(openaiRequest, midSystemMessages)
 	if err != nil {
 		return nil, err
 	}
@@ -129,37 +199,75 @@ func toClaudeParams(openaiRequest *openai.ChatCompletionRequest) (*anthropic.Mes
 	if openaiRequest.ResponseFormat != nil {
 		return nil, fmt.Errorf("response_format is not supported with Claude")
 	}
+	if openaiRequest.WantsLogprobs() {
+		return nil, fmt.Errorf("logprobs is not supported with Claude")
+	}
+	if openaiRequest.HasAudio() {
+		return nil, provider.NewNotSupportedError("audio with Claude")
+	}
 
 	return params, nil
 }
 
-func toClaudeMessages(openaiMessages []openai.Message) ([]anthropic.MessageParam, error) {
+func toClaudeMessages(openaiMessages []openai.Message, midSystemMessages string) ([]anthropic.MessageParam, error) {
 	messageCount := len(openaiMessages)
 	if messageCount == 0 {
 		return nil, fmt.Errorf("at least one message is required")
 	}
 
+	leading := leadingSystemMessages(openaiMessages)
 	toolMap := make(map[string]string)
+	toolCallIds := make(map[string]bool)
 	claudeMessages := make([]anthropic.MessageParam, 0, len(openaiMessages))
 	for index, message := range openaiMessages {
-		if message.Role == "system" {
+		if message.IsSystem() {
+			if index < leading {
+				continue
+			}
+			switch midSystemMessages {
+			case MidSystemMerge:
+				continue
+			case MidSystemError:
+				return nil, fmt.Errorf("system message %d is not at the start of the conversation, which Claude models do not support", index)
+			}
+			text, err := systemMessageText(message)
+			if err != nil {
+				return nil, err
+			}
+			claudeMessages = appendClaudeMessage(claudeMessages, anthropic.NewUserMessage(anthropic.NewTextBlock("<system>\n"+text+"\n</system>")))
 			continue
 		}
 
 		if message.FunctionCall != nil {
 			toolMap[message.FunctionCall.Name] = fmt.Sprintf("call-%s-%d", message.FunctionCall.Name, index)
 		}
-		claudeMessage, err := toClaudeMessage(message, toolMap)
+		claudeMessage, err := toClaudeMessage(message, toolMap, toolCallIds)
 		if err != nil {
 			return nil, err
 		}
-		claudeMessages = append(claudeMessages, *claudeMessage)
+		claudeMessages = appendClaudeMessage(claudeMessages, *claudeMessage)
 	}
 	return claudeMessages, nil
 }
 
-func toClaudeMessage(openaiMessage openai.Message, toolMap map[string]string) (*anthropic.MessageParam, error) {
-	blocks, err := toClaudeMessageBlocks(openaiMessage, toolMap)
+// Appends the message to the conversation, merging it into the last message
+// if both have the same role, since Claude requires the roles to alternate.
+// E.g., the results of parallel tool calls become a single user message.
+func appendClaudeMessage(messages []anthropic.MessageParam, message anthropic.MessageParam) []anthropic.MessageParam {
+	if len(messages) == 0 {
+		return append(messages, message)
+	}
+	last := &messages[len(messages)-1]
+	if last.Role.Value != message.Role.Value {
+		return append(messages, message)
+	}
+	blocks := append(append([]anthropic.MessageParamContentUnion{}, last.Content.Value...), message.Content.Value...)
+	last.Content = anthropic.F(blocks)
+	return messages
+}
+
+func toClaudeMessage(openaiMessage openai.Message, toolMap map[string]string, toolCallIds map[string]bool) (*anthropic.MessageParam, error) {
+	blocks, err := toClaudeMessageBlocks(openaiMessage, toolMap, toolCallIds)
 	if err != nil {
 		return nil, err
 	}
@@ -178,28 +286,62 @@ func toClaudeMessage(openaiMessage openai.Message, toolMap map[string]string) (*
 	return nil, fmt.Errorf("unsupported message role: %s", openaiMessage.Role)
 }
 
-func toClaudeSystemMessage(openAiRequest *openai.ChatCompletionRequest) ([]anthropic.TextBlockParam, error) {
-	for _, message := range openAiRequest.Messages {
-		if message.Role == "system" {
-			blocks, err := toClaudeMessageBlocks(message, nil)
-			if err != nil {
-				return nil, err
-			}
-			textBlocks := make([]anthropic.TextBlockParam, 0, len(blocks))
-			for _, block := range blocks {
-				if textBlock, ok := block.(anthropic.TextBlockParam); ok {
-					textBlocks = append(textBlocks, textBlock)
-				} else {
-					return nil, fmt.Errorf("system message must contain only text blocks with Claude models")
-				}
-			}
-			return textBlocks, nil
+// Joins the leading system messages, and the later ones if they are merged,
+// into the system prompt. Each message is separated by a blank line.
+// Developer messages count as system messages. Nil if
+// there is no system message to send.
+func toClaudeSystemMessage(openAiRequest *openai.ChatCompletionRequest, midSystemMessages string) ([]anthropic.TextBlockParam, error) {
+	leading := leadingSystemMessages(openAiRequest.Messages)
+	texts := []string{}
+	for index, message := range openAiRequest.Messages {
+		if !message.IsSystem() || (index >= leading && midSystemMessages != MidSystemMerge) {
+			continue
+		}
+		text, err := systemMessageText(message)
+		if err != nil {
+			return nil, err
 		}
+		texts = append(texts, text)
+	}
+	if len(texts) == 0 {
+		return nil, nil
 	}
-	return nil, nil
+	return []anthropic.TextBlockParam{anthropic.NewTextBlock(strings.Join(texts, "\n\n"))}, nil
 }
 
-func toClaudeMessageBlocks(message openai.Message, toolMap map[string]string) ([]anthropic.MessageParamContentUnion, error) {
+// Returns the number of system messages at the start of the conversation.
+func leadingSystemMessages(messages []openai.Message) int {
+	for index, message := range messages {
+		if !message.IsSystem() {
+			return index
+		}
+	}
+	return len(messages)
+}
+
+// Returns the text of the system message. Text parts are joined by a line
+// break. Other parts are rejected rather than dropped.
+func systemMessageText(message openai.Message) (string, error) {
+	if message.Content == nil {
+		return "", fmt.Errorf("system message must have content")
+	}
+	if message.Content.String != nil {
+		return *message.Content.String, nil
+	}
+	texts := make([]string, 0, len(message.Content.Parts))
+	for _, part := range message.Content.Parts {
+		if part.Content.TextContent == nil {
+			return "", fmt.Errorf("system message must contain only text blocks with Claude models")
+		}
+		texts = append(texts, part.Content.TextContent.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// Converts the content of the message to Claude blocks. The tool calls of
+// an assistant message follow its text as tool_use blocks, and their IDs are
+// added to toolCallIds so that the later tool messages can refer to them.
+func toClaudeMessageBlocks(message openai.Message, toolMap map[string]string, toolCallIds map[string]bool) ([]anthropic.MessageParamContentUnion, error) {
 	if message.Role == "tool" {
 		if message.Content == nil || message.Content.String == nil {
 			return nil, fmt.Errorf("tool message must contain a string content")
@@ -207,6 +349,9 @@ func toClaudeMessageBlocks(message openai.Message, toolMap map[string]string) ([
 		if message.ToolCallId == nil {
 			return nil, fmt.Errorf("tool message must contain the corresponding tool call ID")
 		}
+		if !toolCallIds[*message.ToolCallId] {
+			return nil, provider.NewInvalidRequestError(fmt.Errorf("tool message refers to %s, which is not a tool call of an earlier assistant message", *message.ToolCallId))
+		}
 		return []anthropic.MessageParamContentUnion{
 			anthropic.NewToolResultBlock(*message.ToolCallId, *message.Content.String, false),
 		}, nil
@@ -226,57 +371,58 @@ func toClaudeMessageBlocks(message openai.Message, toolMap map[string]string) ([
 			anthropic.NewToolResultBlock(toolId, *message.Content.String, false),
 		}, nil
 	}
+
+	blocks := []anthropic.MessageParamContentUnion{}
+	hasCalls := message.FunctionCall != nil || len(message.ToolCalls) > 0
 	if message.Content != nil {
 		if message.Content.String != nil {
-			return []anthropic.MessageParamContentUnion{
-				anthropic.NewTextBlock(*message.Content.String),
-			}, nil
-		}
-		return array.Map(message.Content.Parts, func(part openai.Part) anthropic.MessageParamContentUnion {
-			if part.Content.TextContent != nil {
-				return anthropic.NewTextBlock(part.Content.TextContent.Text)
+			// Claude rejects empty text blocks, which OpenAI clients often
+			// send along with tool calls.
+			if *message.Content.String != "" || !hasCalls {
+				blocks = append(blocks, anthropic.NewTextBlock(*message.Content.String))
 			}
-			if part.Content.ImageContent != nil {
-				// TODO(seungduk): Implement image downloader and pass it from the main to this provider.
-				// It should support cache mechanism using Valkey.
-				return anthropic.NewTextBlock("image content is not supported yet")
-			}
-			return anthropic.NewTextBlock("unsupported content type")
-		}), nil
-	}
-	if message.Refusal != nil {
-		return []anthropic.MessageParamContentUnion{
-			anthropic.NewTextBlock(*message.Refusal),
-		}, nil
+		} else {
+			blocks = append(blocks, array.Map(message.Content.Parts, func(part openai.Part) anthropic.MessageParamContentUnion {
+				if part.Content.TextContent != nil {
+					return anthropic.NewTextBlock(part.Content.TextContent.Text)
+				}
+				if part.Content.ImageContent != nil {
+					// TODO(seungduk): Implement image downloader and pass it from the main to this provider.
+					// It should support cache mechanism using Valkey.
+					return anthropic.NewTextBlock("image content is not supported yet")
+				}
+				return anthropic.NewTextBlock("unsupported content type")
+			})...)
+		}
+	} else if message.Refusal != nil {
+		blocks = append(blocks, anthropic.NewTextBlock(*message.Refusal))
 	}
 	if message.FunctionCall != nil {
 		arguments, err := utils.JsonToMap(message.FunctionCall.Arguments)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse function arguments: %v", err)
+			return nil, provider.NewInvalidRequestError(fmt.Errorf("arguments of function call %s must be a JSON object: %v", message.FunctionCall.Name, err))
 		}
 		toolId, exists := toolMap[message.FunctionCall.Name]
 		if !exists {
 			return nil, fmt.Errorf("function message must contain the corresponding function name")
 		}
-		return []anthropic.MessageParamContentUnion{
-			anthropic.NewToolUseBlockParam(toolId, message.FunctionCall.Name, any(arguments)),
-		}, nil
+		blocks = append(blocks, anthropic.NewToolUseBlockParam(toolId, message.FunctionCall.Name, any(arguments)))
 	}
-	if len(message.ToolCalls) > 0 {
-		toolCalls := make([]anthropic.MessageParamContentUnion, len(message.ToolCalls))
-		for index, toolCall := range message.ToolCalls {
-			if toolCall.Type != "function" {
-				return nil, fmt.Errorf("unsupported tool call type: %s", toolCall.Type)
-			}
-			arguments, err := utils.JsonToMap(toolCall.Function.Arguments)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse tool arguments: %v", err)
-			}
-			toolCalls[index] = anthropic.NewToolUseBlockParam(toolCall.Id, toolCall.Function.Name, any(arguments))
+	for _, toolCall := range message.ToolCalls {
+		if toolCall.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool call type: %s", toolCall.Type)
+		}
+		arguments, err := utils.JsonToMap(toolCall.Function.Arguments)
+		if err != nil {
+			return nil, provider.NewInvalidRequestError(fmt.Errorf("arguments of tool call %s must be a JSON object: %v", toolCall.Id, err))
 		}
-		return toolCalls, nil
+		blocks = append(blocks, anthropic.NewToolUseBlockParam(toolCall.Id, toolCall.Function.Name, any(arguments)))
+		toolCallIds[toolCall.Id] = true
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("message must have content, refusal, function_call, or tool_calls")
 	}
-	return nil, fmt.Errorf("message must have content, refusal, function_call, or tool_calls")
+	return blocks, nil
 }
 
 func toClaudeToolParams(openaiTools []openai.Tool) ([]anthropic.ToolParam, error) {
@@ -361,7 +507,9 @@ func toOpenAiResponse(claudeResponse *anthropic.Message) (*openai.ChatCompletion
 	}
 
 	return &openai.ChatCompletionResponse{
-		Choices: choices,
+		Id:                claudeResponse.ID,
+		Choices:           choices,
+		SystemFingerprint: claudeResponse.Model,
 		Usage: openai.Usage{
 			PromptTokens:     int32(claudeResponse.Usage.InputTokens),
 			CompletionTokens: int32(claudeResponse.Usage.OutputTokens),
@@ -0,0 +1,348 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func newTestEndpoint(t *testing.T, handler http.HandlerFunc) *Endpoint {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := anthropic.NewClient(
+		option.WithBaseURL(server.URL),
+		option.WithAPIKey("test-key"),
+		option.WithMaxRetries(0),
+	)
+	return &Endpoint{client: client, logger: zap.NewNop().Sugar()}
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	t.Run("Reports rate limits as quota errors", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "17")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"type": "error", "error": {"type": "rate_limit_error", "message": "slow down"}}`))
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "claude-3-haiku",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+		})
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+		assert.Equal(t, 17*time.Second, quotaError.RetryAfter)
+	})
+
+	t.Run("Rejects logprobs", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request is sent to Claude")
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "claude-3-haiku",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+			Logprobs: utils.ToPtr(true),
+		})
+		assert.ErrorContains(t, err, "logprobs is not supported")
+	})
+
+	t.Run("Rejects audio", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request is sent to Claude")
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "claude-3-haiku",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{Parts: []openai.Part{
+				{Type: "input_audio", Content: openai.Content{InputAudioContent: &openai.InputAudioContent{Data: "UklGRiQAAABXQVZF", Format: "wav"}}},
+			}}}},
+		})
+		var notSupported *provider.NotSupportedError
+		assert.ErrorAs(t, err, &notSupported)
+	})
+
+	t.Run("Keeps the message ID and model version", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "msg_01XFDUDYJgAACzvnptvVoYEL", "type": "message", "role": "assistant", "model": "claude-3-haiku-20240307", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 1}}`))
+		})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "claude-3-haiku",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "msg_01XFDUDYJgAACzvnptvVoYEL", response.Id)
+		assert.Equal(t, "claude-3-haiku-20240307", response.SystemFingerprint)
+		assert.Equal(t, "claude-3-haiku", response.Model)
+	})
+
+	t.Run("Sends the API key of the context instead of its own", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "owner-key", r.Header.Get("X-Api-Key"))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-3-haiku-20240307", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 1}}`))
+		})
+
+		ctx := provider.WithApiKey(context.Background(), "owner-key")
+		_, err := endpoint.GenerateChatCompletion(ctx, &openai.ChatCompletionRequest{
+			Model:    "claude-3-haiku",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+		})
+		assert.NoError(t, err)
+	})
+}
+
+func TestCountTokens(t *testing.T) {
+	t.Run("Uses the count_tokens API", func(t *testing.T) {
+		var receivedPath string
+		var receivedBody map[string]any
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			receivedPath = r.URL.Path
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &receivedBody)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"input_tokens": 14}`))
+		})
+
+		response, err := endpoint.CountTokens(context.Background(), &openai.ChatCompletionRequest{
+			Model: "claude-3-5-sonnet",
+			Messages: []openai.Message{
+				{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("You are a helpful assistant.")}},
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello, world!")}},
+			},
+			Temperature: utils.ToPtr(float32(0.5)),
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(14), response.PromptTokens)
+		assert.Equal(t, "anthropic/claude-3-5-sonnet-20240620", response.Tokenizer)
+		assert.False(t, response.Estimated)
+
+		assert.Equal(t, "/v1/messages/count_tokens", receivedPath)
+		assert.Equal(t, "claude-3-5-sonnet-20240620", receivedBody["model"])
+		assert.NotContains(t, receivedBody, "max_tokens")
+		assert.NotContains(t, receivedBody, "temperature")
+		assert.Contains(t, receivedBody, "system")
+		assert.Len(t, receivedBody["messages"], 1)
+	})
+
+	t.Run("Returns upstream errors", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type": "error", "error": {"type": "invalid_request_error", "message": "bad"}}`))
+		})
+
+		_, err := endpoint.CountTokens(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "claude-3-haiku",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestSystemMessages(t *testing.T) {
+	type sentMessage struct {
+		Role    string
+		Content []struct{ Text string }
+	}
+	type sentParams struct {
+		System   []struct{ Text string }
+		Messages []sentMessage
+	}
+	system := func(text string) openai.Message {
+		return openai.Message{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr(text)}}
+	}
+	user := func(text string) openai.Message {
+		return openai.Message{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr(text)}}
+	}
+	convert := func(t *testing.T, strategy string, messages ...openai.Message) (*sentParams, error) {
+		params, err := toClaudeParams(&openai.ChatCompletionRequest{Model: "claude-3-haiku", Messages: messages}, strategy)
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(params)
+		assert.NoError(t, err)
+		var sent sentParams
+		assert.NoError(t, json.Unmarshal(body, &sent))
+		return &sent, nil
+	}
+	texts := func(messages []sentMessage) []string {
+		result := []string{}
+		for _, message := range messages {
+			for _, block := range message.Content {
+				result = append(result, message.Role+": "+block.Text)
+			}
+		}
+		return result
+	}
+
+	t.Run("Leading system messages become the system prompt", func(t *testing.T) {
+		sent, err := convert(t, "", system("Be brief."), system("Answer in Korean."), user("Hi"))
+		assert.NoError(t, err)
+		assert.Len(t, sent.System, 1)
+		assert.Equal(t, "Be brief.\n\nAnswer in Korean.", sent.System[0].Text)
+		assert.Equal(t, []string{"user: Hi"}, texts(sent.Messages))
+	})
+
+	t.Run("No system prompt without system messages", func(t *testing.T) {
+		sent, err := convert(t, "", user("Hi"))
+		assert.NoError(t, err)
+		assert.Empty(t, sent.System)
+	})
+
+	t.Run("Developer messages are system messages", func(t *testing.T) {
+		developer := openai.Message{Role: "developer", Content: &openai.MessageContent{String: utils.ToPtr("Answer in Korean.")}}
+		sent, err := convert(t, "", system("Be brief."), developer, user("Hi"), developer)
+		assert.NoError(t, err)
+		assert.Equal(t, "Be brief.\n\nAnswer in Korean.", sent.System[0].Text)
+		assert.Equal(t, []string{"user: Hi", "user: <system>\nAnswer in Korean.\n</system>"}, texts(sent.Messages))
+	})
+
+	t.Run("Text parts are joined", func(t *testing.T) {
+		parts := openai.Message{Role: "system", Content: &openai.MessageContent{Parts: []openai.Part{
+			{Type: "text", Content: openai.Content{TextContent: &openai.TextContent{Text: "Be brief."}}},
+			{Type: "text", Content: openai.Content{TextContent: &openai.TextContent{Text: "Be kind."}}},
+		}}}
+		sent, err := convert(t, "", parts, user("Hi"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Be brief.\nBe kind.", sent.System[0].Text)
+	})
+
+	t.Run("Non-text parts are rejected", func(t *testing.T) {
+		image := openai.Message{Role: "system", Content: &openai.MessageContent{Parts: []openai.Part{
+			{Type: "image_url", Content: openai.Content{ImageContent: &openai.ImageContent{Url: "https://example.com/cat.png"}}},
+		}}}
+		_, err := convert(t, "", image, user("Hi"))
+		assert.ErrorContains(t, err, "only text")
+	})
+
+	t.Run("Mid-conversation system messages are inlined by default", func(t *testing.T) {
+		sent, err := convert(t, "", system("Be brief."), user("Hi"), system("The user is an admin."), user("Delete it"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Be brief.", sent.System[0].Text)
+		assert.Len(t, sent.Messages, 1, "consecutive user messages are merged")
+		assert.Equal(t, []string{
+			"user: Hi",
+			"user: <system>\nThe user is an admin.\n</system>",
+			"user: Delete it",
+		}, texts(sent.Messages))
+
+		inlined, err := convert(t, MidSystemInline, system("Be brief."), user("Hi"), system("The user is an admin."), user("Delete it"))
+		assert.NoError(t, err)
+		assert.Equal(t, sent, inlined)
+	})
+
+	t.Run("Mid-conversation system messages are merged", func(t *testing.T) {
+		sent, err := convert(t, MidSystemMerge, system("Be brief."), user("Hi"), system("The user is an admin."), user("Delete it"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Be brief.\n\nThe user is an admin.", sent.System[0].Text)
+		assert.Equal(t, []string{"user: Hi", "user: Delete it"}, texts(sent.Messages))
+	})
+
+	t.Run("Mid-conversation system messages are rejected", func(t *testing.T) {
+		_, err := convert(t, MidSystemError, system("Be brief."), user("Hi"), system("The user is an admin."))
+		assert.ErrorContains(t, err, "system message 2 is not at the start of the conversation")
+
+		_, err = convert(t, MidSystemError, system("Be brief."), user("Hi"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestToolHistory(t *testing.T) {
+	loadTranscript := func(t *testing.T) *openai.ChatCompletionRequest {
+		body, err := os.ReadFile("testdata/agent_transcript.json")
+		assert.NoError(t, err)
+		var request openai.ChatCompletionRequest
+		assert.NoError(t, json.Unmarshal(body, &request))
+		return &request
+	}
+	sentMessages := func(t *testing.T, request *openai.ChatCompletionRequest) (string, error) {
+		params, err := toClaudeParams(request, "")
+		if err != nil {
+			return "", err
+		}
+		body, err := json.Marshal(params.Messages.Value)
+		assert.NoError(t, err)
+		return string(body), nil
+	}
+
+	t.Run("Translates tool calls and results into alternating blocks", func(t *testing.T) {
+		expected, err := os.ReadFile("testdata/agent_transcript_claude.json")
+		assert.NoError(t, err)
+
+		sent, err := sentMessages(t, loadTranscript(t))
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(expected), sent)
+	})
+
+	t.Run("Tool calls of a response are sent back with their IDs", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{
+				"id": "msg_01", "type": "message", "role": "assistant", "model": "claude-3-5-sonnet-20240620",
+				"content": [
+					{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"city": "Seoul"}},
+					{"type": "tool_use", "id": "toolu_02", "name": "get_time", "input": {"city": "Seoul"}}
+				],
+				"stop_reason": "tool_use", "usage": {"input_tokens": 10, "output_tokens": 20}
+			}`))
+		})
+		transcript := loadTranscript(t)
+		request := *transcript
+		request.Messages = transcript.Messages[:2]
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &request)
+		assert.NoError(t, err)
+		assert.Len(t, response.Choices[0].Message.ToolCalls, 2)
+
+		// The response replaces the recorded assistant message.
+		request.Messages = append(append([]openai.Message{}, transcript.Messages[:2]...), response.Choices[0].Message)
+		request.Messages = append(request.Messages, transcript.Messages[3:5]...)
+		sent, err := sentMessages(t, &request)
+		assert.NoError(t, err)
+
+		recorded := *transcript
+		recorded.Messages = transcript.Messages[:5]
+		expected, err := sentMessages(t, &recorded)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, sent)
+	})
+
+	t.Run("Rejects tool calls with invalid arguments", func(t *testing.T) {
+		request := loadTranscript(t)
+		request.Messages[2].ToolCalls[1].Function.Arguments = `{"city": "Seoul"`
+
+		_, err := sentMessages(t, request)
+		var invalidRequest *provider.InvalidRequestError
+		assert.ErrorAs(t, err, &invalidRequest)
+		assert.ErrorContains(t, err, "arguments of tool call toolu_02 must be a JSON object")
+	})
+
+	t.Run("Rejects tool results without a tool call", func(t *testing.T) {
+		request := loadTranscript(t)
+		request.Messages[4].ToolCallId = utils.ToPtr("toolu_99")
+
+		_, err := sentMessages(t, request)
+		var invalidRequest *provider.InvalidRequestError
+		assert.ErrorAs(t, err, &invalidRequest)
+		assert.ErrorContains(t, err, "tool message refers to toolu_99")
+	})
+}
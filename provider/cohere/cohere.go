@@ -0,0 +1,193 @@
+package cohere
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+// Input type of the requests that do not set one. Cohere requires it, and
+// most of the texts embedded for retrieval are documents.
+const defaultInputType = "search_document"
+
+// Endpoint that serves the embedding models of Cohere through its v2 API. It
+// cannot generate chat completions.
+type Endpoint struct {
+	baseUrl    string
+	apiKey     string
+	httpClient *http.Client
+	logger     *zap.SugaredLogger
+}
+
+// The base URL is https://api.cohere.com except in tests.
+func NewEndpoint(baseUrl string, apiKey string, logger *zap.SugaredLogger) (*Endpoint, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("cohere api key is required")
+	}
+	return &Endpoint{
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		apiKey:     apiKey,
+		httpClient: provider.NewHttpClient("cohere", 0),
+		logger:     logger,
+	}, nil
+}
+
+type embedRequest struct {
+	Model           string   `json:"model"`
+	Texts           []string `json:"texts"`
+	InputType       string   `json:"input_type"`
+	EmbeddingTypes  []string `json:"embedding_types"`
+	OutputDimension *int32   `json:"output_dimension,omitempty"`
+}
+
+type embedResponse struct {
+	Embeddings struct {
+		Float [][]float32 `json:"float"`
+	} `json:"embeddings"`
+	Meta struct {
+		BilledUnits struct {
+			InputTokens int32 `json:"input_tokens"`
+		} `json:"billed_units"`
+	} `json:"meta"`
+}
+
+func (ep *Endpoint) GenerateEmbedding(ctx context.Context, openaiRequest *openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	request, err := toEmbedRequest(openaiRequest)
+	if err != nil {
+		return nil, provider.NewInvalidRequestError(err)
+	}
+
+	var response embedResponse
+	if err := ep.call(ctx, "POST", "/v2/embed", request, &response); err != nil {
+		return nil, err
+	}
+
+	tokens := response.Meta.BilledUnits.InputTokens
+	openaiResponse := &openai.EmbeddingResponse{
+		Object: "list",
+		Data:   make([]openai.Embedding, len(response.Embeddings.Float)),
+		Model:  openaiRequest.Model,
+		Usage:  openai.EmbeddingUsage{PromptTokens: tokens, TotalTokens: tokens},
+	}
+	for index, embedding := range response.Embeddings.Float {
+		openaiResponse.Data[index] = openai.Embedding{Object: "embedding", Index: int32(index), Embedding: embedding}
+	}
+	return openaiResponse, nil
+}
+
+func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	return nil, provider.NewNotSupportedError("chat completions")
+}
+
+func (ep *Endpoint) Provider() string {
+	return "cohere"
+}
+
+func (ep *Endpoint) Region() string {
+	return "cohere"
+}
+
+// Checks the key, which embeds nothing.
+func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := ep.call(ctx, "POST", "/v1/check-api-key", nil, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (ep *Endpoint) Shutdown() error {
+	return nil
+}
+
+// Maps the input types of Ogem to the ones of Cohere. Query and document are
+// the search types, and the others are passed as they are.
+func toEmbedRequest(openaiRequest *openai.EmbeddingRequest) (*embedRequest, error) {
+	if openaiRequest.Input == nil || len(openaiRequest.Input.Texts) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+	if openaiRequest.EncodingFormat != nil && *openaiRequest.EncodingFormat != "float" {
+		return nil, fmt.Errorf("unsupported encoding format: %s", *openaiRequest.EncodingFormat)
+	}
+	request := &embedRequest{
+		Model:           openaiRequest.Model,
+		Texts:           openaiRequest.Input.Texts,
+		InputType:       defaultInputType,
+		EmbeddingTypes:  []string{"float"},
+		OutputDimension: openaiRequest.Dimensions,
+	}
+	if openaiRequest.InputType != nil {
+		switch inputType := *openaiRequest.InputType; inputType {
+		case "query":
+			request.InputType = "search_query"
+		case "document":
+			request.InputType = "search_document"
+		case "classification", "clustering":
+			request.InputType = inputType
+		default:
+			return nil, fmt.Errorf("unsupported input type for Cohere: %s", inputType)
+		}
+	}
+	return request, nil
+}
+
+// Sends the body as JSON and decodes the response into result, if not nil.
+// Rate limits are reported as quota errors and rejected keys as
+// authentication errors.
+func (ep *Endpoint) call(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, method, ep.baseUrl+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if body != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+	httpRequest.Header.Set("Authorization", "Bearer "+ep.apiKey)
+
+	httpResponse, err := ep.httpClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer provider.DrainAndClose(httpResponse.Body)
+	data, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	switch httpResponse.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		return provider.NewQuotaError(fmt.Errorf("%s", string(data)), provider.RetryAfterFromHeader(httpResponse.Header))
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return provider.NewAuthError(fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(data)))
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return provider.NewInvalidRequestError(fmt.Errorf("cohere: %s", string(data)))
+	default:
+		return fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(data))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package cohere
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func newTestEndpoint(t *testing.T, handler http.HandlerFunc) *Endpoint {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	endpoint, err := NewEndpoint(server.URL, "cohere-key", zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	return endpoint
+}
+
+func TestGenerateEmbedding(t *testing.T) {
+	t.Run("Embeds the texts", func(t *testing.T) {
+		var receivedPath, receivedAuthorization string
+		var receivedBody map[string]any
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			receivedPath = r.URL.Path
+			receivedAuthorization = r.Header.Get("Authorization")
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &receivedBody)
+			w.Write([]byte(`{
+				"id": "da6e531f",
+				"embeddings": {"float": [[0.1, 0.2], [0.3, 0.4]]},
+				"texts": ["what is ogem?", "a proxy"],
+				"meta": {"billed_units": {"input_tokens": 9}}
+			}`))
+		})
+
+		response, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{
+			Model:      "embed-v4.0",
+			Input:      &openai.EmbeddingInput{Texts: []string{"What is ogem?", "A proxy"}},
+			Dimensions: utils.ToPtr(int32(256)),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "/v2/embed", receivedPath)
+		assert.Equal(t, "Bearer cohere-key", receivedAuthorization)
+		assert.Equal(t, map[string]any{
+			"model":            "embed-v4.0",
+			"texts":            []any{"What is ogem?", "A proxy"},
+			"input_type":       "search_document",
+			"embedding_types":  []any{"float"},
+			"output_dimension": float64(256),
+		}, receivedBody)
+
+		assert.Equal(t, "list", response.Object)
+		assert.Equal(t, "embed-v4.0", response.Model)
+		assert.Equal(t, []openai.Embedding{
+			{Object: "embedding", Index: 0, Embedding: []float32{0.1, 0.2}},
+			{Object: "embedding", Index: 1, Embedding: []float32{0.3, 0.4}},
+		}, response.Data)
+		assert.Equal(t, openai.EmbeddingUsage{PromptTokens: 9, TotalTokens: 9}, response.Usage)
+	})
+
+	t.Run("Maps the input types", func(t *testing.T) {
+		var receivedInputType any
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			receivedInputType = body["input_type"]
+			w.Write([]byte(`{"embeddings": {"float": [[0.1]]}}`))
+		})
+
+		for inputType, expected := range map[string]string{
+			"query":          "search_query",
+			"document":       "search_document",
+			"classification": "classification",
+			"clustering":     "clustering",
+		} {
+			_, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{
+				Model:     "embed-v4.0",
+				Input:     &openai.EmbeddingInput{Texts: []string{"Hi"}},
+				InputType: utils.ToPtr(inputType),
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, receivedInputType, inputType)
+		}
+
+		_, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{
+			Model:     "embed-v4.0",
+			Input:     &openai.EmbeddingInput{Texts: []string{"Hi"}},
+			InputType: utils.ToPtr("search_query"),
+		})
+		var invalidRequest *provider.InvalidRequestError
+		assert.ErrorAs(t, err, &invalidRequest)
+	})
+
+	t.Run("Reports the rejected key as an authentication error", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message": "invalid api token"}`))
+		})
+
+		_, err := endpoint.Ping(context.Background())
+		var authError *provider.AuthError
+		assert.ErrorAs(t, err, &authError)
+	})
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request must not be sent")
+	})
+
+	_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{Model: "embed-v4.0"})
+	var notSupported *provider.NotSupportedError
+	assert.ErrorAs(t, err, &notSupported)
+}
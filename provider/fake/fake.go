@@ -0,0 +1,327 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+// Behavior of a region of the fake provider.
+type Config struct {
+	// Average time to respond. E.g., 300ms
+	Latency string `yaml:"latency" json:"latency,omitempty"`
+
+	// Maximum difference from latency, drawn uniformly for each request.
+	// E.g., 100ms
+	LatencyJitter string `yaml:"latency_jitter" json:"latency_jitter,omitempty"`
+
+	// Template of the response text. It can use .LastUserMessage, .Model and
+	// the lorem function that returns that many words of placeholder text.
+	// Defaults to echoing the last user message. E.g., "{{lorem 50}}"
+	Response string `yaml:"response" json:"response,omitempty"`
+
+	// Shares of the requests, from 0 to 1, that fail with a rate limit error,
+	// fail with an internal error, or hang until they are canceled.
+	RateLimitRate float64 `yaml:"rate_limit_rate" json:"rate_limit_rate,omitempty"`
+	ErrorRate     float64 `yaml:"error_rate" json:"error_rate,omitempty"`
+	TimeoutRate   float64 `yaml:"timeout_rate" json:"timeout_rate,omitempty"`
+
+	// Seed of the latency and failures, to reproduce a run. Zero for a random
+	// seed.
+	Seed int64 `yaml:"seed" json:"seed,omitempty"`
+}
+
+const defaultResponse = "{{.LastUserMessage}}"
+
+// Characters per token of the synthetic token counts, close to the average
+// of English text with the OpenAI tokenizers.
+const charactersPerToken = 4
+
+var loremWords = strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut labore et dolore magna aliqua")
+
+// Returns all problems of the config joined into one error, each prefixed
+// with its field.
+func (config Config) Validate() error {
+	problems := []error{}
+	for _, duration := range []struct {
+		field string
+		value string
+	}{{"latency", config.Latency}, {"latency_jitter", config.LatencyJitter}} {
+		if duration.value == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(duration.value); err != nil {
+			problems = append(problems, fmt.Errorf("%s: invalid duration %q", duration.field, duration.value))
+		} else if parsed < 0 {
+			problems = append(problems, fmt.Errorf("%s: must be >= 0", duration.field))
+		}
+	}
+	if _, err := parseResponse(config.Response); err != nil {
+		problems = append(problems, fmt.Errorf("response: %v", err))
+	}
+	for _, rate := range []struct {
+		field string
+		value float64
+	}{{"rate_limit_rate", config.RateLimitRate}, {"error_rate", config.ErrorRate}, {"timeout_rate", config.TimeoutRate}} {
+		if rate.value < 0 || rate.value > 1 {
+			problems = append(problems, fmt.Errorf("%s: must be between 0 and 1", rate.field))
+		}
+	}
+	if config.RateLimitRate+config.ErrorRate+config.TimeoutRate > 1 {
+		problems = append(problems, errors.New("rate_limit_rate, error_rate and timeout_rate must add up to at most 1"))
+	}
+	return errors.Join(problems...)
+}
+
+// Zero if empty or invalid.
+func parseDuration(value string) time.Duration {
+	duration, _ := time.ParseDuration(value)
+	return duration
+}
+
+func parseResponse(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultResponse
+	}
+	return template.New("response").Funcs(template.FuncMap{"lorem": lorem}).Parse(text)
+}
+
+// Returns the words of placeholder text, repeating them as needed.
+func lorem(count int) string {
+	words := make([]string, max(count, 0))
+	for index := range words {
+		words[index] = loremWords[index%len(loremWords)]
+	}
+	return strings.Join(words, " ")
+}
+
+// Endpoint that generates synthetic responses without calling any API, for
+// local development and load testing of the proxy itself. Token counts are
+// derived from the length of the text, so they are deterministic.
+type Endpoint struct {
+	region   string
+	latency  time.Duration
+	jitter   time.Duration
+	response *template.Template
+	config   Config
+
+	// Not safe for concurrent use, so guarded by randomMutex.
+	random      *rand.Rand
+	randomMutex sync.Mutex
+
+	logger *zap.SugaredLogger
+}
+
+// Nil config responds immediately by echoing the last user message.
+func NewEndpoint(region string, config *Config, logger *zap.SugaredLogger) (*Endpoint, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Validated above.
+	response, _ := parseResponse(config.Response)
+	latency := parseDuration(config.Latency)
+	jitter := parseDuration(config.LatencyJitter)
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Endpoint{
+		region:   region,
+		latency:  latency,
+		jitter:   jitter,
+		response: response,
+		config:   *config,
+		random:   rand.New(rand.NewSource(seed)),
+		logger:   logger,
+	}, nil
+}
+
+type failure int
+
+const (
+	noFailure failure = iota
+	rateLimitFailure
+	internalFailure
+	timeoutFailure
+)
+
+// Draws the latency and the failure of a request.
+func (ep *Endpoint) draw() (time.Duration, failure) {
+	ep.randomMutex.Lock()
+	defer ep.randomMutex.Unlock()
+
+	latency := ep.latency
+	if ep.jitter > 0 {
+		latency += time.Duration((ep.random.Float64()*2 - 1) * float64(ep.jitter))
+	}
+	latency = max(latency, 0)
+
+	value := ep.random.Float64()
+	switch {
+	case value < ep.config.RateLimitRate:
+		return latency, rateLimitFailure
+	case value < ep.config.RateLimitRate+ep.config.ErrorRate:
+		return latency, internalFailure
+	case value < ep.config.RateLimitRate+ep.config.ErrorRate+ep.config.TimeoutRate:
+		return latency, timeoutFailure
+	default:
+		return latency, noFailure
+	}
+}
+
+func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	provider.LogRequest(ep.logger, openaiRequest)
+
+	latency, failure := ep.draw()
+	if failure == timeoutFailure {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(latency):
+	}
+
+	switch failure {
+	case rateLimitFailure:
+		return nil, provider.NewQuotaError(errors.New("synthetic rate limit of the fake provider"), 0)
+	case internalFailure:
+		return nil, errors.New("synthetic internal error of the fake provider")
+	}
+
+	var text strings.Builder
+	err := ep.response.Execute(&text, struct {
+		LastUserMessage string
+		Model           string
+	}{
+		LastUserMessage: lastUserMessage(openaiRequest.Messages),
+		Model:           openaiRequest.Model,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render the response: %v", err)
+	}
+
+	content, finishReason := truncate(text.String(), maxTokens(openaiRequest))
+	choices := 1
+	if openaiRequest.CandidateCount != nil && *openaiRequest.CandidateCount > 1 {
+		choices = int(*openaiRequest.CandidateCount)
+	}
+	response := &openai.ChatCompletionResponse{}
+	for index := range choices {
+		response.Choices = append(response.Choices, openai.Choice{
+			Index: int32(index),
+			Message: openai.Message{
+				Role:    "assistant",
+				Content: &openai.MessageContent{String: utils.ToPtr(content)},
+			},
+			FinishReason: finishReason,
+		})
+	}
+	prompt := promptTokens(openaiRequest.Messages)
+	completion := tokens(content) * int32(choices)
+	response.Usage = openai.Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+	return openai.FinalizeResponse(ep.Provider(), ep.Region(), openaiRequest.Model, response), nil
+}
+
+func (ep *Endpoint) CountTokens(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	return &openai.TokenCountResponse{
+		PromptTokens: promptTokens(openaiRequest.Messages),
+		Tokenizer:    "fake",
+	}, nil
+}
+
+func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
+	return ep.latency, nil
+}
+
+func (ep *Endpoint) Provider() string {
+	return "fake"
+}
+
+func (ep *Endpoint) Region() string {
+	return ep.region
+}
+
+func (ep *Endpoint) Shutdown() error {
+	return nil
+}
+
+// Returns max_completion_tokens or max_tokens of the request. Zero if unset.
+func maxTokens(request *openai.ChatCompletionRequest) int32 {
+	if request.MaxCompletionTokens != nil {
+		return *request.MaxCompletionTokens
+	}
+	if request.MaxTokens != nil {
+		return *request.MaxTokens
+	}
+	return 0
+}
+
+// Cuts the text to the maximum number of tokens, if any, and returns the
+// finish reason.
+func truncate(text string, maxTokens int32) (string, string) {
+	runes := []rune(text)
+	if maxTokens <= 0 || len(runes) <= int(maxTokens)*charactersPerToken {
+		return text, "stop"
+	}
+	return string(runes[:maxTokens*charactersPerToken]), "length"
+}
+
+func tokens(text string) int32 {
+	length := len([]rune(text))
+	return int32((length + charactersPerToken - 1) / charactersPerToken)
+}
+
+func promptTokens(messages []openai.Message) int32 {
+	total := int32(0)
+	for _, message := range messages {
+		total += tokens(messageText(message))
+	}
+	return total
+}
+
+func lastUserMessage(messages []openai.Message) string {
+	for index := len(messages) - 1; index >= 0; index-- {
+		if messages[index].Role == "user" {
+			return messageText(messages[index])
+		}
+	}
+	return ""
+}
+
+func messageText(message openai.Message) string {
+	if message.Content == nil {
+		return ""
+	}
+	if message.Content.String != nil {
+		return *message.Content.String
+	}
+	texts := []string{}
+	for _, part := range message.Content.Parts {
+		if part.Content.TextContent != nil {
+			texts = append(texts, part.Content.TextContent.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,123 @@
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func newTestEndpoint(t *testing.T, config *Config) *Endpoint {
+	endpoint, err := NewEndpoint("local", config, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	return endpoint
+}
+
+func request(texts ...string) *openai.ChatCompletionRequest {
+	messages := []openai.Message{}
+	for _, text := range texts {
+		messages = append(messages, openai.Message{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr(text)}})
+	}
+	return &openai.ChatCompletionRequest{Model: "fake-model", Messages: messages}
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	t.Run("Echoes the last user message by default", func(t *testing.T) {
+		response, err := newTestEndpoint(t, nil).GenerateChatCompletion(context.Background(), request("Hi", "How are you?"))
+		assert.NoError(t, err)
+		assert.Equal(t, "fake-model", response.Model)
+		assert.Len(t, response.Choices, 1)
+		assert.Equal(t, "How are you?", *response.Choices[0].Message.Content.String)
+		assert.Equal(t, "stop", response.Choices[0].FinishReason)
+		// One token per four characters, rounded up.
+		assert.Equal(t, openai.Usage{PromptTokens: 1 + 3, CompletionTokens: 3, TotalTokens: 7}, response.Usage)
+	})
+
+	t.Run("Renders the response template", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, &Config{Response: "{{.Model}}: {{lorem 3}}"})
+		response, err := endpoint.GenerateChatCompletion(context.Background(), request("Hi"))
+		assert.NoError(t, err)
+		assert.Equal(t, "fake-model: lorem ipsum dolor", *response.Choices[0].Message.Content.String)
+	})
+
+	t.Run("Stops at max tokens", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, &Config{Response: "{{lorem 100}}"})
+		generateRequest := request("Hi")
+		generateRequest.MaxTokens = utils.ToPtr(int32(2))
+		generateRequest.CandidateCount = utils.ToPtr(int32(2))
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), generateRequest)
+		assert.NoError(t, err)
+		assert.Len(t, response.Choices, 2)
+		assert.Equal(t, "lorem ip", *response.Choices[1].Message.Content.String)
+		assert.Equal(t, "length", response.Choices[1].FinishReason)
+		assert.Equal(t, int32(4), response.Usage.CompletionTokens)
+	})
+
+	t.Run("Waits for the latency", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, &Config{Latency: "50ms", LatencyJitter: "10ms"})
+		start := time.Now()
+		_, err := endpoint.GenerateChatCompletion(context.Background(), request("Hi"))
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = endpoint.GenerateChatCompletion(ctx, request("Hi"))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Injects failures", func(t *testing.T) {
+		_, err := newTestEndpoint(t, &Config{RateLimitRate: 1}).GenerateChatCompletion(context.Background(), request("Hi"))
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+
+		_, err = newTestEndpoint(t, &Config{ErrorRate: 1}).GenerateChatCompletion(context.Background(), request("Hi"))
+		assert.ErrorContains(t, err, "synthetic internal error")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = newTestEndpoint(t, &Config{TimeoutRate: 1}).GenerateChatCompletion(ctx, request("Hi"))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Failures are reproducible with a seed", func(t *testing.T) {
+		outcomes := func() []bool {
+			endpoint := newTestEndpoint(t, &Config{ErrorRate: 0.5, Seed: 42})
+			succeeded := []bool{}
+			for range 20 {
+				_, err := endpoint.GenerateChatCompletion(context.Background(), request("Hi"))
+				succeeded = append(succeeded, err == nil)
+			}
+			return succeeded
+		}
+		first := outcomes()
+		assert.Equal(t, first, outcomes())
+		assert.Contains(t, first, true)
+		assert.Contains(t, first, false)
+	})
+}
+
+func TestCountTokens(t *testing.T) {
+	response, err := newTestEndpoint(t, nil).CountTokens(context.Background(), request("Hello", "world"))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2+2), response.PromptTokens)
+	assert.Equal(t, "fake", response.Tokenizer)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{Latency: "1s", Response: "{{lorem 5}}", ErrorRate: 0.5}.Validate())
+
+	err := Config{Latency: "soon", LatencyJitter: "-1s", Response: "{{.Broken", RateLimitRate: 0.6, ErrorRate: 0.6, TimeoutRate: 2}.Validate()
+	assert.ErrorContains(t, err, `latency: invalid duration "soon"`)
+	assert.ErrorContains(t, err, "latency_jitter: must be >= 0")
+	assert.ErrorContains(t, err, "response: ")
+	assert.ErrorContains(t, err, "timeout_rate: must be between 0 and 1")
+	assert.ErrorContains(t, err, "must add up to at most 1")
+}
@@ -0,0 +1,50 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// Scope of the tokens for Vertex AI.
+const googleCloudScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Returns the credentials for the Google Cloud endpoints of a provider: those
+// of the key file if set, or the Application Default Credentials otherwise.
+// With a service account, the tokens are issued for it instead, on behalf of
+// those credentials.
+func GoogleCredentials(ctx context.Context, credentialsFile string, serviceAccount string) (*google.Credentials, error) {
+	var credentials *google.Credentials
+	if credentialsFile != "" {
+		data, err := os.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials file: %v", err)
+		}
+		credentials, err = google.CredentialsFromJSON(ctx, data, googleCloudScope)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials file %s: %v", credentialsFile, err)
+		}
+	} else {
+		var err error
+		credentials, err = google.FindDefaultCredentials(ctx, googleCloudScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the application default credentials: %v", err)
+		}
+	}
+	if serviceAccount == "" {
+		return credentials, nil
+	}
+
+	tokenSource, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          []string{googleCloudScope},
+	}, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %v", serviceAccount, err)
+	}
+	return &google.Credentials{ProjectID: credentials.ProjectID, TokenSource: tokenSource}, nil
+}
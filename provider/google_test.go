@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves the OAuth token endpoint of the service account keys and the IAM
+// Credentials API.
+type fakeGoogle struct {
+	server *httptest.Server
+
+	// Authorization header of the last impersonation request.
+	impersonatedWith string
+	impersonatedPath string
+}
+
+func newFakeGoogle(t *testing.T) *fakeGoogle {
+	fake := &fakeGoogle{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "key-file-token", "token_type": "Bearer", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("POST /v1/", func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		fake.impersonatedWith = r.Header.Get("Authorization")
+		fake.impersonatedPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessToken": "impersonated-token",
+			"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	})
+	fake.server = httptest.NewTLSServer(mux)
+	t.Cleanup(fake.server.Close)
+
+	// The IAM Credentials API is always called at its public address, so its
+	// connections are sent to the fake server instead.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, fake.server.Listener.Addr().String())
+	}
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	original := http.DefaultTransport
+	http.DefaultTransport = transport
+	t.Cleanup(func() { http.DefaultTransport = original })
+	return fake
+}
+
+// Writes a service account key of the project whose tokens are issued by the
+// fake server.
+func (f *fakeGoogle) writeKeyFile(t *testing.T, project string) string {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     project,
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "caller@" + project + ".iam.gserviceaccount.com",
+		"client_id":      "1",
+		"token_uri":      f.server.URL + "/token",
+	})
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.json")
+	assert.NoError(t, os.WriteFile(path, key, 0o600))
+	return path
+}
+
+func TestGoogleCredentials(t *testing.T) {
+	t.Run("Uses the key file", func(t *testing.T) {
+		fake := newFakeGoogle(t)
+		credentials, err := GoogleCredentials(context.Background(), fake.writeKeyFile(t, "search-project"), "")
+		assert.NoError(t, err)
+		assert.Equal(t, "search-project", credentials.ProjectID)
+
+		token, err := credentials.TokenSource.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "key-file-token", token.AccessToken)
+	})
+
+	t.Run("Acts as the service account", func(t *testing.T) {
+		fake := newFakeGoogle(t)
+		credentials, err := GoogleCredentials(
+			context.Background(),
+			fake.writeKeyFile(t, "search-project"),
+			"vertex@ads-project.iam.gserviceaccount.com",
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, "search-project", credentials.ProjectID)
+
+		token, err := credentials.TokenSource.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "impersonated-token", token.AccessToken)
+		assert.Equal(t, "Bearer key-file-token", fake.impersonatedWith)
+		assert.Equal(t, "/v1/projects/-/serviceAccounts/vertex@ads-project.iam.gserviceaccount.com:generateAccessToken", fake.impersonatedPath)
+	})
+
+	t.Run("Fails on a missing key file", func(t *testing.T) {
+		_, err := GoogleCredentials(context.Background(), filepath.Join(t.TempDir(), "missing.json"), "")
+		assert.ErrorContains(t, err, "failed to read credentials file")
+	})
+
+	t.Run("Fails on an invalid key file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "key.json")
+		assert.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+		_, err := GoogleCredentials(context.Background(), path, "")
+		assert.ErrorContains(t, err, "invalid credentials file "+path)
+	})
+}
@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Message contents longer than this are truncated in the logs.
+const MaxLoggedContentLength = 256
+
+const redacted = "[REDACTED]"
+
+// Returns a copy of the headers with the credentials replaced, safe to log.
+func RedactHeaders(header http.Header) http.Header {
+	result := header.Clone()
+	for name := range result {
+		lowerName := strings.ToLower(name)
+		if lowerName == "authorization" ||
+			strings.Contains(lowerName, "key") ||
+			strings.Contains(lowerName, "token") ||
+			strings.Contains(lowerName, "secret") {
+			result[name] = []string{redacted}
+		}
+	}
+	return result
+}
+
+// Returns a copy of the request with long message contents truncated, safe to
+// log. The arguments of the tool calls and the tool results are redacted
+// entirely, since they often carry the data of the systems behind the tools.
+func RedactRequest(request *openai.ChatCompletionRequest) *openai.ChatCompletionRequest {
+	if request == nil {
+		return nil
+	}
+	result := *request
+	result.Messages = make([]openai.Message, len(request.Messages))
+	for index, message := range request.Messages {
+		redactText := truncateContent
+		if message.Role == "tool" || message.Role == "function" {
+			redactText = redactContent
+		}
+		if message.Content != nil {
+			content := &openai.MessageContent{}
+			if message.Content.String != nil {
+				text := redactText(*message.Content.String)
+				content.String = &text
+			}
+			for _, part := range message.Content.Parts {
+				if part.Content.TextContent != nil {
+					part.Content.TextContent = &openai.TextContent{Text: redactText(part.Content.TextContent.Text)}
+				}
+				if part.Content.ImageContent != nil {
+					part.Content.ImageContent = &openai.ImageContent{
+						Url:    truncateContent(part.Content.ImageContent.Url),
+						Detail: part.Content.ImageContent.Detail,
+					}
+				}
+				if part.Content.InputAudioContent != nil {
+					part.Content.InputAudioContent = &openai.InputAudioContent{
+						Data:   truncateContent(part.Content.InputAudioContent.Data),
+						Format: part.Content.InputAudioContent.Format,
+					}
+				}
+				content.Parts = append(content.Parts, part)
+			}
+			message.Content = content
+		}
+		if message.ToolCalls != nil {
+			message.ToolCalls = make([]openai.ToolCall, len(message.ToolCalls))
+			for callIndex, toolCall := range request.Messages[index].ToolCalls {
+				toolCall.Function = redactFunctionCall(toolCall.Function)
+				message.ToolCalls[callIndex] = toolCall
+			}
+		}
+		message.FunctionCall = redactFunctionCall(message.FunctionCall)
+		result.Messages[index] = message
+	}
+	return &result
+}
+
+// Logs the request sent to the provider at debug level with the long message
+// contents truncated. Logged only when the debug flag of the config is set.
+func LogRequest(logger *zap.SugaredLogger, request *openai.ChatCompletionRequest, keysAndValues ...any) {
+	if logger.Level() > zap.DebugLevel {
+		return
+	}
+	logger.Debugw("Sending request", append([]any{"request", RedactRequest(request)}, keysAndValues...)...)
+}
+
+func redactFunctionCall(functionCall *openai.FunctionCall) *openai.FunctionCall {
+	if functionCall == nil {
+		return nil
+	}
+	return &openai.FunctionCall{Name: functionCall.Name, Arguments: redactContent(functionCall.Arguments)}
+}
+
+func redactContent(content string) string {
+	return fmt.Sprintf("[%d characters redacted]", len(content))
+}
+
+func truncateContent(content string) string {
+	if len(content) <= MaxLoggedContentLength {
+		return content
+	}
+	return fmt.Sprintf("%s... [%d characters redacted]", content[:MaxLoggedContentLength], len(content)-MaxLoggedContentLength)
+}
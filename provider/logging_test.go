@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("x-api-key", "secret")
+	header.Set("Content-Type", "application/json")
+
+	redactedHeader := RedactHeaders(header)
+	assert.Equal(t, "[REDACTED]", redactedHeader.Get("Authorization"))
+	assert.Equal(t, "[REDACTED]", redactedHeader.Get("x-api-key"))
+	assert.Equal(t, "application/json", redactedHeader.Get("Content-Type"))
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+}
+
+func TestRedactRequest(t *testing.T) {
+	t.Run("Truncates long contents", func(t *testing.T) {
+		long := strings.Repeat("a", MaxLoggedContentLength+10)
+		request := &openai.ChatCompletionRequest{
+			Model: "gpt-4o",
+			Messages: []openai.Message{
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr(long)}},
+				{Role: "user", Content: &openai.MessageContent{Parts: []openai.Part{
+					{Type: "text", Content: openai.Content{TextContent: &openai.TextContent{Text: long}}},
+					{Type: "input_audio", Content: openai.Content{InputAudioContent: &openai.InputAudioContent{Data: long, Format: "wav"}}},
+				}}},
+			},
+		}
+
+		redactedRequest := RedactRequest(request)
+		expected := strings.Repeat("a", MaxLoggedContentLength) + "... [10 characters redacted]"
+		assert.Equal(t, expected, *redactedRequest.Messages[0].Content.String)
+		assert.Equal(t, expected, redactedRequest.Messages[1].Content.Parts[0].Content.TextContent.Text)
+		assert.Equal(t, &openai.InputAudioContent{Data: expected, Format: "wav"}, redactedRequest.Messages[1].Content.Parts[1].Content.InputAudioContent)
+		assert.Equal(t, long, *request.Messages[0].Content.String)
+		assert.Equal(t, long, request.Messages[1].Content.Parts[0].Content.TextContent.Text)
+		assert.Equal(t, long, request.Messages[1].Content.Parts[1].Content.InputAudioContent.Data)
+	})
+
+	t.Run("Redacts tool arguments and results", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Messages: []openai.Message{
+				{Role: "assistant", ToolCalls: []openai.ToolCall{
+					{Id: "call_1", Type: "function", Function: &openai.FunctionCall{Name: "get_user", Arguments: `{"ssn":"123-45-6789"}`}},
+				}},
+				{Role: "tool", ToolCallId: utils.ToPtr("call_1"), Content: &openai.MessageContent{String: utils.ToPtr(`{"name":"Jane"}`)}},
+				{Role: "assistant", FunctionCall: &openai.FunctionCall{Name: "get_user", Arguments: `{"id":1}`}},
+				{Role: "function", Name: utils.ToPtr("get_user"), Content: &openai.MessageContent{Parts: []openai.Part{
+					{Type: "text", Content: openai.Content{TextContent: &openai.TextContent{Text: `{"name":"Jane"}`}}},
+				}}},
+			},
+		}
+
+		redactedRequest := RedactRequest(request)
+		assert.Equal(t, &openai.FunctionCall{Name: "get_user", Arguments: "[21 characters redacted]"}, redactedRequest.Messages[0].ToolCalls[0].Function)
+		assert.Equal(t, "call_1", redactedRequest.Messages[0].ToolCalls[0].Id)
+		assert.Equal(t, "[15 characters redacted]", *redactedRequest.Messages[1].Content.String)
+		assert.Equal(t, "[8 characters redacted]", redactedRequest.Messages[2].FunctionCall.Arguments)
+		assert.Equal(t, "[15 characters redacted]", redactedRequest.Messages[3].Content.Parts[0].Content.TextContent.Text)
+		assert.Equal(t, `{"ssn":"123-45-6789"}`, request.Messages[0].ToolCalls[0].Function.Arguments)
+		assert.Equal(t, `{"id":1}`, request.Messages[2].FunctionCall.Arguments)
+	})
+
+	t.Run("Keeps short contents", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Messages: []openai.Message{
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}},
+			},
+		}
+		assert.Equal(t, "Hi", *RedactRequest(request).Messages[0].Content.String)
+	})
+}
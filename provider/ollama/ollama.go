@@ -0,0 +1,415 @@
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+const defaultBaseUrl = "http://localhost:11434"
+
+// Connection to an Ollama daemon in a region of the ollama provider.
+type Config struct {
+	// Base URL of the daemon. Defaults to http://localhost:11434
+	BaseUrl string `yaml:"base_url" json:"base_url,omitempty"`
+
+	// Model name -> Ollama model. The names not in it are sent as they are.
+	// E.g., {"llama-3.1-8b": "llama3.1:8b"}
+	ModelNames map[string]string `yaml:"model_names" json:"model_names,omitempty"`
+
+	// Whether to pull a model that the daemon does not have and retry the
+	// request once, instead of failing it. The request waits for the whole
+	// download.
+	PullMissingModels bool `yaml:"pull_missing_models" json:"pull_missing_models,omitempty"`
+}
+
+// Returns all problems of the config joined into one error, each prefixed
+// with its field.
+func (config Config) Validate() error {
+	problems := []error{}
+	if config.BaseUrl != "" {
+		if parsed, err := url.Parse(config.BaseUrl); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("base_url: must be an absolute URL"))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(config.ModelNames)) {
+		if config.ModelNames[name] == "" {
+			problems = append(problems, fmt.Errorf("model_names.%s: is required", name))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// Endpoint that serves the models of a local or on-premises Ollama daemon
+// through its chat API.
+type Endpoint struct {
+	region     string
+	baseUrl    string
+	config     Config
+	httpClient *http.Client
+	logger     *zap.SugaredLogger
+}
+
+// Nil config uses the daemon on localhost.
+func NewEndpoint(region string, config *Config, logger *zap.SugaredLogger) (*Endpoint, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	baseUrl := config.BaseUrl
+	if baseUrl == "" {
+		baseUrl = defaultBaseUrl
+	}
+	return &Endpoint{
+		region:     region,
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		config:     *config,
+		httpClient: provider.NewHttpClient("ollama", 0),
+		logger:     logger,
+	}, nil
+}
+
+type chatRequest struct {
+	Model    string         `json:"model"`
+	Messages []chatMessage  `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Tools    []openai.Tool  `json:"tools,omitempty"`
+	Format   any            `json:"format,omitempty"`
+	Options  map[string]any `json:"options,omitempty"`
+}
+
+type chatMessage struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Images    []string   `json:"images,omitempty"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+}
+
+type toolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type chatResponse struct {
+	Message         chatMessage `json:"message"`
+	DoneReason      string      `json:"done_reason"`
+	PromptEvalCount int32       `json:"prompt_eval_count"`
+	EvalCount       int32       `json:"eval_count"`
+}
+
+// Returned when the daemon responds with an error status.
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("ollama: status %d: %s", e.StatusCode, e.Message)
+}
+
+func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	request, err := toChatRequest(openaiRequest, ep.model(openaiRequest.Model))
+	if err != nil {
+		return nil, err
+	}
+
+	provider.LogRequest(ep.logger, openaiRequest)
+
+	response, err := ep.chat(ctx, request)
+	var modelNotFound *provider.ModelNotFoundError
+	if errors.As(err, &modelNotFound) && ep.config.PullMissingModels {
+		ep.logger.Infow("Pulling missing model", "model", request.Model)
+		if err := ep.pull(ctx, request.Model); err != nil {
+			return nil, fmt.Errorf("failed to pull model %s: %v", request.Model, err)
+		}
+		response, err = ep.chat(ctx, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	openaiResponse, err := toOpenAiResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return openai.FinalizeResponse(ep.Provider(), ep.Region(), openaiRequest.Model, openaiResponse), nil
+}
+
+func (ep *Endpoint) Provider() string {
+	return "ollama"
+}
+
+func (ep *Endpoint) Region() string {
+	return ep.region
+}
+
+func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := ep.call(ctx, "GET", "/api/version", nil, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (ep *Endpoint) Shutdown() error {
+	return nil
+}
+
+func (ep *Endpoint) model(model string) string {
+	if mapped, exists := ep.config.ModelNames[model]; exists {
+		return mapped
+	}
+	return model
+}
+
+// Sends the chat request. The missing model is reported as a
+// ModelNotFoundError, and a busy daemon as a quota error so that the request
+// goes to another endpoint meanwhile.
+func (ep *Endpoint) chat(ctx context.Context, request *chatRequest) (*chatResponse, error) {
+	var response chatResponse
+	err := ep.call(ctx, "POST", "/api/chat", request, &response)
+	var ollamaError *apiError
+	if errors.As(err, &ollamaError) {
+		switch {
+		case ollamaError.StatusCode == http.StatusNotFound && strings.Contains(ollamaError.Message, "not found"):
+			return nil, provider.NewModelNotFoundError(request.Model, err)
+		case ollamaError.StatusCode == http.StatusServiceUnavailable || ollamaError.StatusCode == http.StatusTooManyRequests:
+			return nil, provider.NewQuotaError(err, 0)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (ep *Endpoint) pull(ctx context.Context, model string) error {
+	var response struct {
+		Status string `json:"status"`
+	}
+	if err := ep.call(ctx, "POST", "/api/pull", map[string]any{"model": model, "stream": false}, &response); err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return fmt.Errorf("unexpected pull status %q", response.Status)
+	}
+	return nil
+}
+
+// Sends the body as JSON and decodes the response into result, if not nil.
+func (ep *Endpoint) call(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, ep.baseUrl+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := ep.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer provider.DrainAndClose(response.Body)
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		var errorBody struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &errorBody) != nil || errorBody.Error == "" {
+			errorBody.Error = string(data)
+		}
+		return &apiError{StatusCode: response.StatusCode, Message: errorBody.Error}
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to parse response: %v", err)
+	}
+	return nil
+}
+
+func toChatRequest(openaiRequest *openai.ChatCompletionRequest, model string) (*chatRequest, error) {
+	if openaiRequest.WantsLogprobs() {
+		return nil, fmt.Errorf("logprobs is not supported with Ollama")
+	}
+	if openaiRequest.HasAudio() {
+		return nil, provider.NewNotSupportedError("audio with Ollama")
+	}
+	if len(openaiRequest.Messages) == 0 {
+		return nil, fmt.Errorf("at least one message is required")
+	}
+
+	messages := make([]chatMessage, len(openaiRequest.Messages))
+	for index, message := range openai.WithSystemRole(openaiRequest.Messages) {
+		converted, err := toChatMessage(message)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %v", index, err)
+		}
+		messages[index] = *converted
+	}
+
+	request := &chatRequest{
+		Model:    model,
+		Messages: messages,
+		Tools:    openaiRequest.Tools,
+		Options:  map[string]any{},
+	}
+	if openaiRequest.Temperature != nil {
+		request.Options["temperature"] = *openaiRequest.Temperature
+	}
+	if openaiRequest.TopP != nil {
+		request.Options["top_p"] = *openaiRequest.TopP
+	}
+	if openaiRequest.MaxTokens != nil {
+		request.Options["num_predict"] = *openaiRequest.MaxTokens
+	}
+	if openaiRequest.MaxCompletionTokens != nil {
+		request.Options["num_predict"] = *openaiRequest.MaxCompletionTokens
+	}
+	if openaiRequest.StopSequences != nil {
+		request.Options["stop"] = openaiRequest.StopSequences.Sequences
+	}
+	if openaiRequest.Seed != nil {
+		request.Options["seed"] = *openaiRequest.Seed
+	}
+	if openaiRequest.FrequencyPenalty != nil {
+		request.Options["frequency_penalty"] = *openaiRequest.FrequencyPenalty
+	}
+	if openaiRequest.PresencePenalty != nil {
+		request.Options["presence_penalty"] = *openaiRequest.PresencePenalty
+	}
+	if len(request.Options) == 0 {
+		request.Options = nil
+	}
+
+	if openaiRequest.ResponseFormat != nil {
+		switch openaiRequest.ResponseFormat.Type {
+		case "text":
+		case "json_object":
+			request.Format = "json"
+		case "json_schema":
+			if openaiRequest.ResponseFormat.JsonSchema == nil || openaiRequest.ResponseFormat.JsonSchema.Schema == nil {
+				return nil, fmt.Errorf("json_schema response format requires a schema")
+			}
+			request.Format = openaiRequest.ResponseFormat.JsonSchema.Schema
+		default:
+			return nil, fmt.Errorf("unsupported response format: %s", openaiRequest.ResponseFormat.Type)
+		}
+	}
+	return request, nil
+}
+
+// Images are only accepted as data URLs, since the daemon takes the base64
+// data rather than URLs.
+func toChatMessage(message openai.Message) (*chatMessage, error) {
+	converted := &chatMessage{Role: message.Role}
+	switch {
+	case message.Content == nil:
+	case message.Content.String != nil:
+		converted.Content = *message.Content.String
+	default:
+		texts := []string{}
+		for _, part := range message.Content.Parts {
+			switch {
+			case part.Content.TextContent != nil:
+				texts = append(texts, part.Content.TextContent.Text)
+			case part.Content.ImageContent != nil:
+				_, data, found := strings.Cut(part.Content.ImageContent.Url, ";base64,")
+				if !strings.HasPrefix(part.Content.ImageContent.Url, "data:") || !found {
+					return nil, fmt.Errorf("only data URLs of images are supported with Ollama")
+				}
+				converted.Images = append(converted.Images, data)
+			default:
+				return nil, fmt.Errorf("unsupported content type")
+			}
+		}
+		converted.Content = strings.Join(texts, "\n")
+	}
+	if message.Content == nil && message.Refusal != nil {
+		converted.Content = *message.Refusal
+	}
+
+	for _, openaiToolCall := range message.ToolCalls {
+		if openaiToolCall.Type != "function" || openaiToolCall.Function == nil {
+			return nil, fmt.Errorf("unsupported tool call type: %s", openaiToolCall.Type)
+		}
+		arguments := json.RawMessage(openaiToolCall.Function.Arguments)
+		if !json.Valid(arguments) {
+			return nil, fmt.Errorf("failed to parse tool arguments of %s", openaiToolCall.Function.Name)
+		}
+		call := toolCall{}
+		call.Function.Name = openaiToolCall.Function.Name
+		call.Function.Arguments = arguments
+		converted.ToolCalls = append(converted.ToolCalls, call)
+	}
+	return converted, nil
+}
+
+// Ollama does not identify the tool calls, so they are numbered in the
+// response.
+func toOpenAiResponse(response *chatResponse) (*openai.ChatCompletionResponse, error) {
+	message := openai.Message{Role: "assistant"}
+	if response.Message.Content != "" {
+		message.Content = &openai.MessageContent{String: utils.ToPtr(response.Message.Content)}
+	}
+	for index, call := range response.Message.ToolCalls {
+		message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+			Id:   fmt.Sprintf("call-%s-%d", call.Function.Name, index),
+			Type: "function",
+			Function: &openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			},
+		})
+	}
+
+	finishReason := "stop"
+	if response.DoneReason == "length" {
+		finishReason = "length"
+	}
+	return &openai.ChatCompletionResponse{
+		Choices: []openai.Choice{{
+			Index:        0,
+			Message:      message,
+			FinishReason: finishReason,
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     response.PromptEvalCount,
+			CompletionTokens: response.EvalCount,
+			TotalTokens:      response.PromptEvalCount + response.EvalCount,
+		},
+	}, nil
+}
@@ -0,0 +1,155 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func newTestEndpoint(t *testing.T, config Config, handler http.HandlerFunc) *Endpoint {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	config.BaseUrl = server.URL
+	endpoint, err := NewEndpoint("local", &config, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	return endpoint
+}
+
+func chatRequestOf(model string) *openai.ChatCompletionRequest {
+	return &openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}},
+	}
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	t.Run("Generates text", func(t *testing.T) {
+		var receivedPath string
+		var receivedBody map[string]any
+		endpoint := newTestEndpoint(t, Config{ModelNames: map[string]string{"llama-3.1-8b": "llama3.1:8b"}}, func(w http.ResponseWriter, r *http.Request) {
+			receivedPath = r.URL.Path
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &receivedBody)
+			w.Write([]byte(`{
+				"model": "llama3.1:8b",
+				"message": {"role": "assistant", "content": "Hello!"},
+				"done": true,
+				"done_reason": "length",
+				"prompt_eval_count": 26,
+				"eval_count": 2
+			}`))
+		})
+
+		request := chatRequestOf("llama-3.1-8b")
+		request.Messages = append([]openai.Message{{Role: "developer", Content: &openai.MessageContent{String: utils.ToPtr("Be brief.")}}}, request.Messages...)
+		request.MaxTokens = utils.ToPtr(int32(2))
+		request.Temperature = utils.ToPtr(float32(0))
+		request.ResponseFormat = &openai.ResponseFormat{Type: "json_object"}
+		response, err := endpoint.GenerateChatCompletion(context.Background(), request)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "/api/chat", receivedPath)
+		assert.Equal(t, map[string]any{
+			"model": "llama3.1:8b",
+			"messages": []any{
+				map[string]any{"role": "system", "content": "Be brief."},
+				map[string]any{"role": "user", "content": "Hi"},
+			},
+			"stream":  false,
+			"format":  "json",
+			"options": map[string]any{"num_predict": 2.0, "temperature": 0.0},
+		}, receivedBody)
+
+		assert.Equal(t, "llama-3.1-8b", response.Model)
+		assert.Equal(t, "Hello!", *response.Choices[0].Message.Content.String)
+		assert.Equal(t, "length", response.Choices[0].FinishReason)
+		assert.Equal(t, openai.Usage{PromptTokens: 26, CompletionTokens: 2, TotalTokens: 28}, response.Usage)
+		assert.Regexp(t, `^chatcmpl-[0-9a-f]{32}$`, response.Id)
+		assert.Equal(t, "ogem/ollama/"+endpoint.Region(), response.SystemFingerprint)
+	})
+
+	t.Run("Calls tools", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{
+				"message": {"role": "assistant", "content": "", "tool_calls": [
+					{"function": {"name": "get_weather", "arguments": {"city": "Seoul"}}}
+				]},
+				"done": true,
+				"done_reason": "stop"
+			}`))
+		})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), chatRequestOf("llama3.1"))
+		assert.NoError(t, err)
+		message := response.Choices[0].Message
+		assert.Nil(t, message.Content)
+		assert.Equal(t, []openai.ToolCall{{
+			Id:       "call-get_weather-0",
+			Type:     "function",
+			Function: &openai.FunctionCall{Name: "get_weather", Arguments: `{"city": "Seoul"}`},
+		}}, message.ToolCalls)
+	})
+
+	t.Run("Reports missing models", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "model \"llama3.1\" not found, try pulling it first"}`))
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), chatRequestOf("llama3.1"))
+		var modelNotFound *provider.ModelNotFoundError
+		assert.ErrorAs(t, err, &modelNotFound)
+		assert.Equal(t, "llama3.1", modelNotFound.Model)
+	})
+
+	t.Run("Pulls missing models and retries once", func(t *testing.T) {
+		pulled := false
+		paths := []string{}
+		endpoint := newTestEndpoint(t, Config{PullMissingModels: true}, func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			switch {
+			case r.URL.Path == "/api/pull":
+				pulled = true
+				w.Write([]byte(`{"status": "success"}`))
+			case pulled:
+				w.Write([]byte(`{"message": {"role": "assistant", "content": "Hello!"}, "done": true, "done_reason": "stop"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": "model \"llama3.1\" not found, try pulling it first"}`))
+			}
+		})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), chatRequestOf("llama3.1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello!", *response.Choices[0].Message.Content.String)
+		assert.Equal(t, []string{"/api/chat", "/api/pull", "/api/chat"}, paths)
+	})
+
+	t.Run("Reports a busy daemon as a quota error", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error": "server busy, please try again.  maximum pending requests exceeded"}`))
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), chatRequestOf("llama3.1"))
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	err := Config{BaseUrl: "localhost:11434", ModelNames: map[string]string{"llama": ""}}.Validate()
+	assert.ErrorContains(t, err, "base_url: must be an absolute URL")
+	assert.ErrorContains(t, err, "model_names.llama: is required")
+}
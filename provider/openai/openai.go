@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -16,7 +15,11 @@ import (
 	"sync"
 	"time"
 
+	"go.uber.org/zap"
+
 	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/tokenizer"
 )
 
 const REGION = "openai"
@@ -56,14 +59,64 @@ type Endpoint struct {
 	client       *http.Client
 	providerName string
 	region       string
+	logger       *zap.SugaredLogger
 
 	batchJobs       map[string]*BatchJob
 	batchJobMutex   sync.RWMutex
 	batchChan       chan *BatchJob
 	stopBatchSignal chan struct{}
+
+	// Headers and query parameters added to every request.
+	extraHeaders map[string]string
+	extraQuery   map[string]string
+
+	// Whether the developer messages are sent as system messages.
+	systemRoleOnly bool
+
+	// Whether the endpoint is OpenRouter, which takes the openrouter fields
+	// of the requests and reports the upstream that served them.
+	openRouter bool
+
+	// Model name -> OpenRouter model ID. The names not in it are sent as is.
+	openRouterModelIds map[string]string
+}
+
+type Option func(*Endpoint)
+
+// Adds the headers to every request. E.g., {"x-portkey-provider": "openai"}
+func WithExtraHeaders(headers map[string]string) Option {
+	return func(endpoint *Endpoint) {
+		endpoint.extraHeaders = headers
+	}
+}
+
+// Adds the query parameters to every request. E.g., {"api-version": "2024-06-01"}
+func WithExtraQuery(query map[string]string) Option {
+	return func(endpoint *Endpoint) {
+		endpoint.extraQuery = query
+	}
+}
+
+// Sends the developer messages as system messages, for the OpenAI-compatible
+// APIs that do not know the developer role.
+func WithSystemRoleOnly() Option {
+	return func(endpoint *Endpoint) {
+		endpoint.systemRoleOnly = true
+	}
 }
 
-func NewEndpoint(providerName string, region string, baseUrl string, apiKey string) (*Endpoint, error) {
+// Sends the openrouter fields of the requests at their top level, asks for
+// the cost of each request, and reports the upstream that served it. The
+// model IDs map the model names to those of OpenRouter, which contain a
+// slash. E.g., {"llama-3.1-70b": "meta-llama/llama-3.1-70b-instruct"}
+func WithOpenRouter(modelIds map[string]string) Option {
+	return func(endpoint *Endpoint) {
+		endpoint.openRouter = true
+		endpoint.openRouterModelIds = modelIds
+	}
+}
+
+func NewEndpoint(providerName string, region string, baseUrl string, apiKey string, logger *zap.SugaredLogger, options ...Option) (*Endpoint, error) {
 	parsedBaseUrl, err := url.Parse(baseUrl)
 	if err != nil {
 		return nil, fmt.Errorf("invalid endpoint: %v", err)
@@ -71,13 +124,17 @@ func NewEndpoint(providerName string, region string, baseUrl string, apiKey stri
 	endpoint := &Endpoint{
 		providerName:    providerName,
 		region:          region,
+		logger:          logger,
 		apiKey:          apiKey,
 		baseUrl:         parsedBaseUrl,
-		client:          &http.Client{Timeout: 30 * time.Minute},
+		client:          provider.NewHttpClient(providerName, 30*time.Minute),
 		batchJobs:       make(map[string]*BatchJob),
 		batchChan:       make(chan *BatchJob),
 		stopBatchSignal: make(chan struct{}),
 	}
+	for _, option := range options {
+		option(endpoint)
+	}
 
 	go endpoint.batchManager()
 	return endpoint, nil
@@ -88,8 +145,18 @@ func (p *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *op
 		openaiRequest.Model = batchModel
 		return p.GenerateBatchChatCompletion(ctx, openaiRequest)
 	}
+	if p.systemRoleOnly {
+		converted := *openaiRequest
+		converted.Messages = openai.WithSystemRole(openaiRequest.Messages)
+		openaiRequest = &converted
+	}
+	if !p.openRouter && openaiRequest.OpenRouter != nil {
+		converted := *openaiRequest
+		converted.OpenRouter = nil
+		openaiRequest = &converted
+	}
 
-	jsonData, err := json.Marshal(openaiRequest)
+	jsonData, err := p.marshalRequest(openaiRequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
@@ -105,13 +172,14 @@ func (p *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *op
 	}
 
 	httpRequest.Header.Set("Content-Type", "application/json")
-	httpRequest.Header.Set("Authorization", "Bearer "+p.apiKey)
+	p.prepareRequest(httpRequest)
+	provider.LogRequest(p.logger, openaiRequest, "url", endpointPath, "headers", provider.RedactHeaders(httpRequest.Header))
 
 	httpResponse, err := p.client.Do(httpRequest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer httpResponse.Body.Close()
+	defer provider.DrainAndClose(httpResponse.Body)
 
 	body, err := io.ReadAll(httpResponse.Body)
 	if err != nil {
@@ -120,20 +188,68 @@ func (p *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *op
 
 	if httpResponse.StatusCode != http.StatusOK {
 		if httpResponse.StatusCode == http.StatusTooManyRequests {
-			// Must include `quota` keyword in the error message to disable the provider for a while.
-			return nil, fmt.Errorf("quota exceeded: %s", string(body))
+			retryAfter := provider.RetryAfterFromHeader(httpResponse.Header)
+			if retryAfter == 0 {
+				retryAfter = provider.RetryAfterFromBody(string(body))
+			}
+			return nil, provider.NewQuotaError(fmt.Errorf("%s", string(body)), retryAfter)
 		}
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(body))
+		return nil, provider.NewStatusError(httpResponse.StatusCode, body)
 	}
 
 	var openAiResponse openai.ChatCompletionResponse
 	if err := json.Unmarshal(body, &openAiResponse); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %v", err)
 	}
+	if p.openRouter {
+		var upstream struct {
+			Provider string `json:"provider"`
+		}
+		if err := json.Unmarshal(body, &upstream); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %v", err)
+		}
+		openAiResponse.Ogem = &openai.ResponseMetadata{OpenRouter: &openai.OpenRouterMetadata{
+			Provider:     upstream.Provider,
+			Model:        openAiResponse.Model,
+			GenerationId: openAiResponse.Id,
+		}}
+	}
 
 	return &openAiResponse, nil
 }
 
+// Encodes the request for OpenRouter with its fields at the top level, where
+// they override the standard ones of the same name, and with usage accounting
+// so that the response reports the cost.
+func (p *Endpoint) marshalRequest(openaiRequest *openai.ChatCompletionRequest) ([]byte, error) {
+	if !p.openRouter {
+		return json.Marshal(openaiRequest)
+	}
+	converted := *openaiRequest
+	converted.OpenRouter = nil
+	if modelId, found := p.openRouterModelIds[converted.Model]; found {
+		converted.Model = modelId
+	}
+	jsonData, err := json.Marshal(&converted)
+	if err != nil {
+		return nil, err
+	}
+	// Numbers are kept as they are, since a seed may not fit in a float64.
+	fields := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	fields["usage"] = map[string]any{"include": true}
+	if openaiRequest.OpenRouter != nil {
+		for _, entry := range openaiRequest.OpenRouter.Entries() {
+			fields[entry.Key] = entry.Value
+		}
+	}
+	return json.Marshal(fields)
+}
+
 func (p *Endpoint) GenerateBatchChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
 	jobId, err := p.createOrGetBatchJob(ctx, openaiRequest)
 	if err != nil {
@@ -153,7 +269,7 @@ func (p *Endpoint) createOrGetBatchJob(ctx context.Context, openaiRequest *opena
 
 	p.batchJobMutex.Lock()
 	if _, exists := p.batchJobs[jobId]; exists {
-		log.Printf("Found existing batch job %v", jobId)
+		p.logger.Debugw("Found existing batch job", "job_id", jobId)
 		p.batchJobMutex.Unlock()
 		return jobId, nil
 	}
@@ -167,7 +283,7 @@ func (p *Endpoint) createOrGetBatchJob(ctx context.Context, openaiRequest *opena
 		Waiters: []chan struct{}{},
 	}
 
-	log.Printf("Creating batch job %v", job)
+	p.logger.Debugw("Creating batch job", "job_id", jobId)
 
 	p.batchJobs[jobId] = job
 	p.batchJobMutex.Unlock()
@@ -198,10 +314,10 @@ func (p *Endpoint) waitForBatchJob(ctx context.Context, jobId string) (*BatchJob
 
 	select {
 	case <-ctx.Done():
-		log.Printf("Context cancelled while waiting for batch job %v", jobId)
+		p.logger.Infow("Context cancelled while waiting for batch job", "job_id", jobId)
 		return nil, ctx.Err()
 	case <-waiter:
-		log.Printf("Batch job %v completed", jobId)
+		p.logger.Debugw("Batch job completed", "job_id", jobId)
 		// Job completed; return the result
 		p.batchJobMutex.Lock()
 		defer p.batchJobMutex.Unlock()
@@ -219,7 +335,7 @@ func (p *Endpoint) batchManager() {
 	for {
 		select {
 		case job := <-p.batchChan:
-			log.Printf("Received batch job %v", job)
+			p.logger.Debugw("Received batch job", "job_id", job.Id)
 			batch = append(batch, job)
 			if len(batch) == 50000 {
 				p.sendBatch(batch)
@@ -235,12 +351,11 @@ func (p *Endpoint) batchManager() {
 			}
 			timer.Reset(10 * time.Second)
 		case <-timer.C:
-			log.Printf("Sending batch of %d jobs", len(batch))
 			// Send the batch using OpenAI Batch API
 			p.sendBatch(batch)
 			batch = nil
 		case <-p.stopBatchSignal:
-			log.Printf("Stopping batch manager")
+			p.logger.Info("Stopping batch manager")
 			if len(batch) > 0 {
 				p.sendBatch(batch)
 			}
@@ -257,7 +372,7 @@ func (p *Endpoint) sendBatch(batch []*BatchJob) {
 		return
 	}
 
-	log.Printf("Sending batch of %d jobs", len(batch))
+	p.logger.Infow("Sending batch", "jobs", len(batch))
 
 	// Step 1: Create JSONL content in memory
 	buffer, fileName, err := p.createBatchFileInMemory(batch)
@@ -266,7 +381,7 @@ func (p *Endpoint) sendBatch(batch []*BatchJob) {
 		return
 	}
 
-	log.Printf("Uploading batch file %s", fileName)
+	p.logger.Infow("Uploading batch file", "file_name", fileName)
 
 	// Step 2: Upload the file to OpenAI
 	inputFileId, err := p.uploadFileFromBuffer(buffer, fileName, "batch")
@@ -275,7 +390,7 @@ func (p *Endpoint) sendBatch(batch []*BatchJob) {
 		return
 	}
 
-	log.Printf("Uploaded batch file %s with ID %s", fileName, inputFileId)
+	p.logger.Infow("Uploaded batch file", "file_name", fileName, "file_id", inputFileId)
 
 	// Step 3: Create a batch job
 	batchId, err := p.createBatchJob(inputFileId)
@@ -284,7 +399,7 @@ func (p *Endpoint) sendBatch(batch []*BatchJob) {
 		return
 	}
 
-	log.Printf("Created batch job %s", batchId)
+	p.logger.Infow("Created batch", "batch_id", batchId)
 
 	// Assign BatchId and InputFileId to each job
 	for _, job := range batch {
@@ -292,7 +407,7 @@ func (p *Endpoint) sendBatch(batch []*BatchJob) {
 		job.InputFileId = inputFileId
 	}
 
-	log.Printf("Assigned batch ID %s to %d jobs", batchId, len(batch))
+	p.logger.Debugw("Assigned batch ID to jobs", "batch_id", batchId, "jobs", len(batch))
 
 	// Step 4: Monitor the batch job until completion
 	go p.monitorBatchJob(batchId, batch)
@@ -333,14 +448,14 @@ func (p *Endpoint) uploadFileFromBuffer(buffer *bytes.Buffer, fileName string, p
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	p.prepareRequest(req)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
 	resp, err := p.client.Do(req)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	defer provider.DrainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
@@ -369,14 +484,14 @@ func (p *Endpoint) createBatchJob(inputFileId string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	p.prepareRequest(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := p.client.Do(req)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	defer provider.DrainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
@@ -390,7 +505,6 @@ func (p *Endpoint) createBatchJob(inputFileId string) (string, error) {
 		return "", err
 	}
 
-	log.Printf("Created batch job %s", batchResponse.Id)
 	return batchResponse.Id, nil
 }
 
@@ -403,14 +517,14 @@ func (p *Endpoint) monitorBatchJob(batchId string, batch []*BatchJob) {
 		select {
 		case <-time.After(delay):
 			status, outputFileId, err := p.checkBatchStatus(batchId)
-			log.Printf("Batch %s status: %s", batchId, status)
+			p.logger.Infow("Checked batch status", "batch_id", batchId, "status", status)
 			if err != nil {
 				p.handleBatchError(batch, err)
 				return
 			}
 
 			if status == BatchJobStatusCompleted {
-				log.Printf("Batch %s completed", batchId)
+				p.logger.Infow("Batch completed", "batch_id", batchId)
 				// Retrieve results
 				err = p.retrieveBatchResults(batch, outputFileId)
 				if err != nil {
@@ -436,13 +550,13 @@ func (p *Endpoint) checkBatchStatus(batchID string) (status BatchJobStatus, outp
 	if err != nil {
 		return "", "", err
 	}
-	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	p.prepareRequest(req)
 
 	resp, err := p.client.Do(req)
 	if err != nil {
 		return "", "", err
 	}
-	defer resp.Body.Close()
+	defer provider.DrainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
@@ -498,13 +612,13 @@ func (p *Endpoint) downloadFileContent(fileID string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	p.prepareRequest(req)
 
 	resp, err := p.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer provider.DrainAndClose(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
@@ -524,7 +638,7 @@ func (p *Endpoint) handleBatchError(batch []*BatchJob, err error) {
 	defer p.batchJobMutex.Unlock()
 
 	for _, job := range batch {
-		log.Printf("Batch job %s failed: %v", job.Id, err)
+		p.logger.Warnw("Batch job failed", "job_id", job.Id, "error", err)
 		job.Status = "failed"
 		job.Error = err
 		for _, waiter := range job.Waiters {
@@ -534,6 +648,38 @@ func (p *Endpoint) handleBatchError(batch []*BatchJob, err error) {
 	}
 }
 
+// Sets the API key and the extra headers and query parameters on the request.
+// The API key of the context of the request, if any, replaces that of the
+// endpoint.
+func (p *Endpoint) prepareRequest(request *http.Request) {
+	apiKey := p.apiKey
+	if override, found := provider.ApiKeyFrom(request.Context()); found {
+		apiKey = override
+	}
+	request.Header.Set("Authorization", "Bearer "+apiKey)
+	for name, value := range p.extraHeaders {
+		request.Header.Set(name, value)
+	}
+	if len(p.extraQuery) > 0 {
+		query := request.URL.Query()
+		for name, value := range p.extraQuery {
+			query.Set(name, value)
+		}
+		request.URL.RawQuery = query.Encode()
+	}
+}
+
+func (p *Endpoint) CountTokens(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	if p.providerName != "openai" {
+		// Custom endpoints may serve any model, so the tiktoken encodings are
+		// not reliable for them.
+		return nil, fmt.Errorf("token counting is not supported for %s provider", p.providerName)
+	}
+	countRequest := *openaiRequest
+	countRequest.Model = strings.TrimSuffix(countRequest.Model, "@batch")
+	return tokenizer.CountOpenAi(&countRequest)
+}
+
 func (p *Endpoint) Provider() string {
 	return p.providerName
 }
@@ -542,8 +688,41 @@ func (p *Endpoint) Region() string {
 	return p.region
 }
 
+// Lists the models, which requires the API key but generates nothing, to
+// check that the endpoint is reachable and accepts the key.
 func (p *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
-	return 0, nil
+	endpointPath, err := url.JoinPath(p.baseUrl.String(), "models")
+	if err != nil {
+		return 0, fmt.Errorf("failed to build endpoint path: %v", err)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, "GET", endpointPath, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	p.prepareRequest(httpRequest)
+
+	start := time.Now()
+	httpResponse, err := p.client.Do(httpRequest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer provider.DrainAndClose(httpResponse.Body)
+
+	body, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response body: %v", err)
+	}
+	latency := time.Since(start)
+
+	switch httpResponse.StatusCode {
+	case http.StatusOK:
+		return latency, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return 0, provider.NewAuthError(fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(body)))
+	default:
+		return 0, fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(body))
+	}
 }
 
 func (p *Endpoint) Shutdown() error {
@@ -0,0 +1,402 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+	"github.com/yanolja/ogem/utils/orderedmap"
+)
+
+// Builds an endpoint that sends its requests to the given handler.
+func newTestEndpoint(t *testing.T, handler http.HandlerFunc) *Endpoint {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	endpoint, err := NewEndpoint("openai", "openai", server.URL, "test-key", zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	t.Cleanup(func() { endpoint.Shutdown() })
+	return endpoint
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	t.Run("Passes reasoning parameters and usage through", func(t *testing.T) {
+		var requestBody []byte
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/chat/completions", r.URL.Path)
+			assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+			requestBody, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{
+				"model": "o3-2025-04-16",
+				"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}],
+				"usage": {
+					"prompt_tokens": 10,
+					"completion_tokens": 120,
+					"total_tokens": 130,
+					"completion_tokens_details": {"reasoning_tokens": 100}
+				}
+			}`))
+		})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "o3",
+			Messages: []openai.Message{{
+				Role:    "user",
+				Content: &openai.MessageContent{String: utils.ToPtr("Hello")},
+			}},
+			MaxCompletionTokens: utils.ToPtr(int32(1000)),
+			ReasoningEffort:     utils.ToPtr("low"),
+		})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"model": "o3",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"max_completion_tokens": 1000,
+			"reasoning_effort": "low"
+		}`, string(requestBody))
+		assert.Equal(t, int32(120), response.Usage.CompletionTokens)
+		assert.Equal(t, int32(100), response.Usage.CompletionTokensDetails.ReasoningTokens)
+	})
+
+	t.Run("Passes logprobs through", func(t *testing.T) {
+		var requestBody []byte
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			requestBody, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{
+				"model": "gpt-4o-2024-08-06",
+				"choices": [{
+					"message": {"role": "assistant", "content": "Hi"},
+					"logprobs": {"content": [{
+						"token": "Hi",
+						"logprob": -0.25,
+						"bytes": [72, 105],
+						"top_logprobs": [
+							{"token": "Hi", "logprob": -0.25, "bytes": [72, 105]},
+							{"token": "Hello", "logprob": -1.5, "bytes": null}
+						]
+					}]},
+					"finish_reason": "stop"
+				}]
+			}`))
+		})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:       "gpt-4o",
+			Messages:    []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}}},
+			Logprobs:    utils.ToPtr(true),
+			TopLogprobs: utils.ToPtr(int32(2)),
+		})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"model": "gpt-4o",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"logprobs": true,
+			"top_logprobs": 2
+		}`, string(requestBody))
+
+		logprobs := response.Choices[0].Logprobs
+		assert.NotNil(t, logprobs)
+		assert.Len(t, logprobs.Content, 1)
+		assert.Equal(t, "Hi", logprobs.Content[0].Token)
+		assert.Equal(t, float32(-0.25), logprobs.Content[0].Logprob)
+		assert.Len(t, logprobs.Content[0].TopLogprobs, 2)
+		assert.Equal(t, "Hello", logprobs.Content[0].TopLogprobs[1].Token)
+		assert.Equal(t, float32(-1.5), logprobs.Content[0].TopLogprobs[1].Logprob)
+	})
+
+	t.Run("Translates the developer role only for compatible APIs", func(t *testing.T) {
+		var requestBody []byte
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			requestBody, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`))
+		}
+		request := &openai.ChatCompletionRequest{
+			Model: "o3",
+			Messages: []openai.Message{
+				{Role: "developer", Content: &openai.MessageContent{String: utils.ToPtr("Be brief.")}},
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}},
+			},
+		}
+
+		_, err := newTestEndpoint(t, handler).GenerateChatCompletion(context.Background(), request)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"model": "o3",
+			"messages": [{"role": "developer", "content": "Be brief."}, {"role": "user", "content": "Hello"}]
+		}`, string(requestBody))
+
+		server := httptest.NewServer(http.HandlerFunc(handler))
+		t.Cleanup(server.Close)
+		compatible, err := NewEndpoint("groq", "groq", server.URL, "test-key", zap.NewNop().Sugar(), WithSystemRoleOnly())
+		assert.NoError(t, err)
+		t.Cleanup(func() { compatible.Shutdown() })
+
+		_, err = compatible.GenerateChatCompletion(context.Background(), request)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"model": "o3",
+			"messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hello"}]
+		}`, string(requestBody))
+		assert.Equal(t, "developer", request.Messages[0].Role)
+	})
+
+	t.Run("Passes the seed and keeps the system fingerprint", func(t *testing.T) {
+		var requestBody []byte
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			requestBody, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{"system_fingerprint": "fp_44709d6fcb", "choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`))
+		})
+
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "gpt-4o",
+			Seed:  utils.ToPtr(int64(9007199254740993)),
+		})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"model": "gpt-4o", "messages": null, "seed": 9007199254740993}`, string(requestBody))
+		assert.Equal(t, "fp_44709d6fcb", response.SystemFingerprint)
+	})
+
+	t.Run("Reports rate limits as quota errors", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{Model: "o3"})
+		assert.ErrorContains(t, err, "quota")
+	})
+
+	t.Run("Takes the retry hint from the headers", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "42")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"message": "Please try again in 20s."}}`))
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{Model: "o3"})
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+		assert.Equal(t, 42*time.Second, quotaError.RetryAfter)
+	})
+
+	t.Run("Takes the retry hint from the body", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"message": "Please try again in 20s."}}`))
+		})
+
+		_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{Model: "o3"})
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+		assert.Equal(t, 20*time.Second, quotaError.RetryAfter)
+	})
+
+	t.Run("Sends the extra headers and query parameters", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+			assert.Equal(t, "openai", r.Header.Get("x-portkey-provider"))
+			assert.Equal(t, "2024-06-01", r.URL.Query().Get("api-version"))
+			w.Write([]byte(`{"model": "gpt-4o", "choices": []}`))
+		}))
+		t.Cleanup(server.Close)
+
+		endpoint, err := NewEndpoint(
+			"portkey",
+			"portkey",
+			server.URL,
+			"test-key",
+			zap.NewNop().Sugar(),
+			WithExtraHeaders(map[string]string{"x-portkey-provider": "openai"}),
+			WithExtraQuery(map[string]string{"api-version": "2024-06-01"}),
+		)
+		assert.NoError(t, err)
+		t.Cleanup(func() { endpoint.Shutdown() })
+
+		_, err = endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{Model: "gpt-4o"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Does not log message contents at info level", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"model": "gpt-4o", "choices": []}`))
+		}))
+		t.Cleanup(server.Close)
+
+		core, logs := observer.New(zapcore.InfoLevel)
+		endpoint, err := NewEndpoint("openai", "openai", server.URL, "test-key", zap.New(core).Sugar())
+		assert.NoError(t, err)
+		t.Cleanup(func() { endpoint.Shutdown() })
+
+		_, err = endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "gpt-4o",
+			Messages: []openai.Message{
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("my secret prompt")}},
+			},
+		})
+		assert.NoError(t, err)
+		for _, entry := range logs.All() {
+			assert.NotContains(t, entry.Message, "my secret prompt")
+			for _, value := range entry.ContextMap() {
+				assert.NotContains(t, fmt.Sprint(value), "my secret prompt")
+			}
+		}
+	})
+
+	t.Run("Logs redacted requests at debug level", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"model": "gpt-4o", "choices": []}`))
+		}))
+		t.Cleanup(server.Close)
+
+		core, logs := observer.New(zapcore.DebugLevel)
+		endpoint, err := NewEndpoint("openai", "openai", server.URL, "test-key", zap.New(core).Sugar())
+		assert.NoError(t, err)
+		t.Cleanup(func() { endpoint.Shutdown() })
+
+		_, err = endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model: "gpt-4o",
+			Messages: []openai.Message{
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr(strings.Repeat("a", 1000))}},
+			},
+		})
+		assert.NoError(t, err)
+
+		entries := logs.FilterMessage("Sending request").All()
+		assert.Len(t, entries, 1)
+		fields := entries[0].ContextMap()
+		assert.Equal(t, []string{"[REDACTED]"}, fields["headers"].(http.Header)["Authorization"])
+		request := fields["request"].(*openai.ChatCompletionRequest)
+		assert.Less(t, len(*request.Messages[0].Content.String), 1000)
+	})
+
+	t.Run("Sends the OpenRouter fields at the top level", func(t *testing.T) {
+		var requestBody []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestBody, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{
+				"id": "gen-123",
+				"model": "meta-llama/llama-3.1-70b-instruct",
+				"provider": "Together",
+				"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}],
+				"usage": {"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12, "cost": 0.00042}
+			}`))
+		}))
+		t.Cleanup(server.Close)
+
+		endpoint, err := NewEndpoint("openrouter", "openrouter", server.URL, "test-key", zap.NewNop().Sugar(),
+			WithOpenRouter(map[string]string{"llama-3.1-70b": "meta-llama/llama-3.1-70b-instruct"}))
+		assert.NoError(t, err)
+		t.Cleanup(func() { endpoint.Shutdown() })
+
+		preferences := orderedmap.New()
+		preferences.Set("provider", map[string]any{"order": []string{"Together", "Fireworks"}, "allow_fallbacks": false})
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:      "llama-3.1-70b",
+			Messages:   []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}}},
+			OpenRouter: preferences,
+		})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"model": "meta-llama/llama-3.1-70b-instruct",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"provider": {"order": ["Together", "Fireworks"], "allow_fallbacks": false},
+			"usage": {"include": true}
+		}`, string(requestBody))
+		assert.Equal(t, &openai.OpenRouterMetadata{
+			Provider:     "Together",
+			Model:        "meta-llama/llama-3.1-70b-instruct",
+			GenerationId: "gen-123",
+		}, response.Ogem.OpenRouter)
+		assert.Equal(t, 0.00042, *response.Usage.Cost)
+	})
+
+	t.Run("Drops the OpenRouter fields for other endpoints", func(t *testing.T) {
+		var requestBody []byte
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			requestBody, _ = io.ReadAll(r.Body)
+			w.Write([]byte(`{"model": "gpt-4o", "provider": "OpenAI", "choices": []}`))
+		})
+
+		preferences := orderedmap.New()
+		preferences.Set("provider", map[string]any{"sort": "price"})
+		response, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:      "gpt-4o",
+			Messages:   []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}}},
+			OpenRouter: preferences,
+		})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`, string(requestBody))
+		assert.Nil(t, response.Ogem)
+	})
+
+	t.Run("Sends the API key of the context instead of its own", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer owner-key", r.Header.Get("Authorization"))
+			w.Write([]byte(`{"model": "gpt-4o", "choices": []}`))
+		})
+
+		ctx := provider.WithApiKey(context.Background(), "owner-key")
+		_, err := endpoint.GenerateChatCompletion(ctx, &openai.ChatCompletionRequest{Model: "gpt-4o"})
+		assert.NoError(t, err)
+	})
+}
+
+func TestPing(t *testing.T) {
+	t.Run("Healthy", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "GET", r.Method)
+			assert.Equal(t, "/models", r.URL.Path)
+			assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+			w.Write([]byte(`{"object": "list", "data": []}`))
+		})
+
+		latency, err := endpoint.Ping(context.Background())
+		assert.NoError(t, err)
+		assert.Greater(t, latency, time.Duration(0))
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error": {"message": "Incorrect API key provided"}}`, http.StatusUnauthorized)
+		})
+
+		_, err := endpoint.Ping(context.Background())
+		var authError *provider.AuthError
+		assert.ErrorAs(t, err, &authError)
+	})
+
+	t.Run("Down", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+		endpoint, err := NewEndpoint("openai", "openai", server.URL, "test-key", zap.NewNop().Sugar())
+		assert.NoError(t, err)
+		t.Cleanup(func() { endpoint.Shutdown() })
+
+		_, err = endpoint.Ping(context.Background())
+		assert.Error(t, err)
+		var authError *provider.AuthError
+		assert.False(t, errors.As(err, &authError))
+	})
+
+	t.Run("Server error", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		})
+
+		_, err := endpoint.Ping(context.Background())
+		assert.ErrorContains(t, err, "503")
+	})
+}
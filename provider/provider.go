@@ -3,6 +3,9 @@ package provider
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +21,200 @@ type AiEndpoint interface {
 	Shutdown() error
 }
 
+type apiKeyContextKey struct{}
+
+// Returns a context whose requests are sent with the API key instead of the
+// one of the endpoint, so that they are billed to the account of the key.
+// Only the endpoints of the OpenAI protocol and Claude support it; the others
+// ignore it.
+func WithApiKey(ctx context.Context, apiKey string) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, apiKey)
+}
+
+// Returns the API key that overrides the one of the endpoint for the request.
+// False if the endpoint uses its own.
+func ApiKeyFrom(ctx context.Context) (string, bool) {
+	apiKey, found := ctx.Value(apiKeyContextKey{}).(string)
+	return apiKey, found && apiKey != ""
+}
+
+type cachedContentContextKey struct{}
+
+// System prompt that the provider has cached ahead of the requests.
+type CachedContent struct {
+	// Name of the cache in Ogem. E.g., policy-v3
+	Name string
+
+	// Resource of the cache on the endpoint. E.g., cachedContents/a1b2c3
+	Resource string
+
+	SystemPrompt string
+}
+
+// Returns a context whose requests reference the cached content instead of
+// sending their system prompt, if it is the cached one. Only the Gemini
+// endpoints support it; the others ignore it.
+func WithCachedContent(ctx context.Context, content CachedContent) context.Context {
+	return context.WithValue(ctx, cachedContentContextKey{}, content)
+}
+
+// Returns the cached content that the request may reference. False if there
+// is none.
+func CachedContentFrom(ctx context.Context) (CachedContent, bool) {
+	content, found := ctx.Value(cachedContentContextKey{}).(CachedContent)
+	return content, found
+}
+
+// Optionally implemented by endpoints that can cache a system prompt upstream
+// for the requests to reference.
+type ContentCacher interface {
+	// Returns the resource of the cache and the time at which the provider
+	// deletes it.
+	CreateCachedContent(ctx context.Context, model string, systemPrompt string, ttl time.Duration) (string, time.Time, error)
+	DeleteCachedContent(ctx context.Context, resource string) error
+}
+
+// Optionally implemented by endpoints that can count prompt tokens with the
+// tokenizer of the model.
+type TokenCounter interface {
+	CountTokens(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error)
+}
+
+// Optionally implemented by endpoints that can embed texts.
+type Embedder interface {
+	GenerateEmbedding(ctx context.Context, request *openai.EmbeddingRequest) (*openai.EmbeddingResponse, error)
+}
+
+// Returned when the provider rejects a request because of rate limits or
+// quotas. The message contains "quota" so that it is also recognized by the
+// callers that only check the error text.
+type QuotaError struct {
+	// Duration suggested by the provider to wait before retrying. Zero if the
+	// provider did not suggest one.
+	RetryAfter time.Duration
+
+	err error
+}
+
+func NewQuotaError(err error, retryAfter time.Duration) *QuotaError {
+	return &QuotaError{RetryAfter: retryAfter, err: err}
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %v", e.err)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return e.err
+}
+
+// Returned when the provider rejects the credentials of the endpoint. The
+// endpoint is reachable, but no request will succeed until the credentials
+// are fixed.
+type AuthError struct {
+	err error
+}
+
+func NewAuthError(err error) *AuthError {
+	return &AuthError{err: err}
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", e.err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.err
+}
+
+// Returned when the endpoint does not have the model, such as a local model
+// that has not been pulled. Other endpoints may still serve it.
+type ModelNotFoundError struct {
+	Model string
+
+	err error
+}
+
+func NewModelNotFoundError(model string, err error) *ModelNotFoundError {
+	return &ModelNotFoundError{Model: model, err: err}
+}
+
+func (e *ModelNotFoundError) Error() string {
+	return fmt.Sprintf("model %s not found: %v", e.Model, e.err)
+}
+
+func (e *ModelNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// Returned when the request is invalid for the provider, such as a tool call
+// with malformed arguments, so that it is rejected before being sent.
+type InvalidRequestError struct {
+	err error
+}
+
+func NewInvalidRequestError(err error) *InvalidRequestError {
+	return &InvalidRequestError{err: err}
+}
+
+func (e *InvalidRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *InvalidRequestError) Unwrap() error {
+	return e.err
+}
+
+// Returned when the endpoint cannot serve the kind of request at all, such
+// as a chat completion for an embedding-only provider. No other attempt of
+// the same request can succeed there.
+type NotSupportedError struct {
+	// What is not supported. E.g., chat completions
+	Operation string
+}
+
+func NewNotSupportedError(operation string) *NotSupportedError {
+	return &NotSupportedError{Operation: operation}
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s not supported", e.Operation)
+}
+
+// Returns the duration suggested by the retry-after-ms or Retry-After
+// header. Zero if there is no valid suggestion.
+func RetryAfterFromHeader(header http.Header) time.Duration {
+	if milliseconds, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && milliseconds > 0 {
+		return time.Duration(milliseconds * float64(time.Millisecond))
+	}
+
+	retryAfter := header.Get("Retry-After")
+	if seconds, err := strconv.ParseFloat(retryAfter, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// Matches the hints in the error bodies. E.g., "Please try again in 6m0s." of
+// OpenAI, and "retryDelay": "30s" of Gemini.
+var retryAfterPattern = regexp.MustCompile(`(?i)(?:try again in |"retryDelay":\s*")((?:\d+(?:\.\d+)?(?:ms|h|m|s))+)`)
+
+// Returns the duration suggested in the error body. Zero if there is none.
+func RetryAfterFromBody(body string) time.Duration {
+	match := retryAfterPattern.FindStringSubmatch(body)
+	if match == nil {
+		return 0
+	}
+	duration, err := time.ParseDuration(match[1])
+	if err != nil {
+		return 0
+	}
+	return duration
+}
+
 func ToGeminiRole(role string) string {
 	lowered := strings.ToLower(role)
 	switch lowered {
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryAfterFromHeader(t *testing.T) {
+	t.Run("Milliseconds header", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("retry-after-ms", "1500")
+		header.Set("Retry-After", "2")
+		assert.Equal(t, 1500*time.Millisecond, RetryAfterFromHeader(header))
+	})
+
+	t.Run("Seconds header", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Retry-After", "30")
+		assert.Equal(t, 30*time.Second, RetryAfterFromHeader(header))
+	})
+
+	t.Run("Date header", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		assert.InDelta(t, time.Hour, RetryAfterFromHeader(header), float64(2*time.Second))
+	})
+
+	t.Run("No header", func(t *testing.T) {
+		assert.Equal(t, time.Duration(0), RetryAfterFromHeader(http.Header{}))
+	})
+
+	t.Run("Invalid header", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Retry-After", "soon")
+		assert.Equal(t, time.Duration(0), RetryAfterFromHeader(header))
+	})
+}
+
+func TestRetryAfterFromBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected time.Duration
+	}{
+		{"OpenAI seconds", `{"error": {"message": "Rate limit reached. Please try again in 20s."}}`, 20 * time.Second},
+		{"OpenAI fractions", `{"error": {"message": "Please try again in 1.5s."}}`, 1500 * time.Millisecond},
+		{"OpenAI minutes", `{"error": {"message": "Please try again in 6m0s."}}`, 6 * time.Minute},
+		{"OpenAI milliseconds", `{"error": {"message": "Please try again in 120ms."}}`, 120 * time.Millisecond},
+		{"Gemini retry delay", `{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "30s"}`, 30 * time.Second},
+		{"No hint", `{"error": {"message": "You exceeded your current quota."}}`, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, RetryAfterFromBody(test.body))
+		})
+	}
+}
@@ -1,12 +1,21 @@
 package studio
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
 
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
 	"github.com/yanolja/ogem/utils/orderedmap"
 )
 
@@ -269,3 +278,327 @@ func TestToGeminiSchema_WithRef(t *testing.T) {
 		})
 	}
 }
+
+type fakeTokenCounter struct {
+	parts []genai.Part
+}
+
+func (c *fakeTokenCounter) CountTokens(ctx context.Context, parts ...genai.Part) (*genai.CountTokensResponse, error) {
+	c.parts = parts
+	return &genai.CountTokensResponse{TotalTokens: 9}, nil
+}
+
+func TestCountTokens(t *testing.T) {
+	history, last, err := toGeminiMessages([]openai.Message{
+		{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("You are a helpful assistant.")}},
+		{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}},
+		{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}},
+		{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("How are you?")}},
+	})
+	assert.NoError(t, err)
+
+	parts := []genai.Part{}
+	for _, content := range append(history, last) {
+		parts = append(parts, content.Parts...)
+	}
+
+	counter := &fakeTokenCounter{}
+	response, err := countTokens(context.Background(), counter, "gemini-1.5-flash", parts)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(9), response.PromptTokens)
+	assert.Equal(t, "gemini/gemini-1.5-flash", response.Tokenizer)
+	assert.Equal(t, []genai.Part{genai.Text("Hello"), genai.Text("Hi"), genai.Text("How are you?")}, counter.parts)
+}
+
+func TestMultipleChoices(t *testing.T) {
+	client, err := genai.NewClient(context.Background(), option.WithAPIKey("test"))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	model, err := modelFromOpenAiRequest(client, &openai.ChatCompletionRequest{
+		Model:          "gemini-1.5-flash",
+		Messages:       []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}}},
+		CandidateCount: utils.ToPtr(int32(3)),
+	}, zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), *model.CandidateCount)
+
+	candidate := func(index int32, text string) *genai.Candidate {
+		return &genai.Candidate{
+			Index:        index,
+			Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(text)}},
+			FinishReason: genai.FinishReasonStop,
+		}
+	}
+	response, err := toOpenAiResponse(&genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{candidate(0, "Hi"), candidate(1, "Hey"), candidate(2, "Hello")},
+		UsageMetadata: &genai.UsageMetadata{
+			PromptTokenCount:     5,
+			CandidatesTokenCount: 6,
+			TotalTokenCount:      11,
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, response.Choices, 3)
+	for index, text := range []string{"Hi", "Hey", "Hello"} {
+		assert.Equal(t, int32(index), response.Choices[index].Index)
+		assert.Equal(t, text, *response.Choices[index].Message.Content.String)
+		assert.Equal(t, "stop", response.Choices[index].FinishReason)
+	}
+	// Gemini counts the tokens of all candidates together.
+	assert.Equal(t, openai.Usage{PromptTokens: 5, CompletionTokens: 6, TotalTokens: 11}, response.Usage)
+}
+
+func TestResponseIdentity(t *testing.T) {
+	response, err := toOpenAiResponse(&genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text("Hi")}},
+			FinishReason: genai.FinishReasonStop,
+		}},
+		UsageMetadata: &genai.UsageMetadata{PromptTokenCount: 1, CandidatesTokenCount: 1, TotalTokenCount: 2},
+	})
+	assert.NoError(t, err)
+
+	// The SDK exposes neither a response ID nor the model version.
+	endpoint := &Endpoint{}
+	response = openai.FinalizeResponse(endpoint.Provider(), endpoint.Region(), "gemini-1.5-flash", response)
+	assert.Regexp(t, `^chatcmpl-[0-9a-f]{32}$`, response.Id)
+	assert.Equal(t, "ogem/studio/studio", response.SystemFingerprint)
+}
+
+func TestLogprobs(t *testing.T) {
+	client, err := genai.NewClient(context.Background(), option.WithAPIKey("test"))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = modelFromOpenAiRequest(client, &openai.ChatCompletionRequest{
+		Model:       "gemini-1.5-flash",
+		Messages:    []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}}},
+		Logprobs:    utils.ToPtr(true),
+		TopLogprobs: utils.ToPtr(int32(5)),
+	}, zap.NewNop().Sugar())
+	assert.ErrorContains(t, err, "logprobs is not supported")
+}
+
+func TestSystemInstruction(t *testing.T) {
+	request := &openai.ChatCompletionRequest{
+		Model: "gemini-1.5-flash",
+		Messages: []openai.Message{
+			{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("Be brief.")}},
+			{Role: "developer", Content: &openai.MessageContent{Parts: []openai.Part{
+				{Type: "text", Content: openai.Content{TextContent: &openai.TextContent{Text: "Answer in Korean."}}},
+			}}},
+			{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}},
+		},
+	}
+
+	instruction := toGeminiSystemInstruction(request)
+	assert.Equal(t, []genai.Part{genai.Text("Be brief."), genai.Text("Answer in Korean.")}, instruction.Parts)
+
+	history, last, err := toGeminiMessages(request.Messages)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	assert.Equal(t, "user", last.Role)
+
+	assert.Nil(t, toGeminiSystemInstruction(&openai.ChatCompletionRequest{Messages: request.Messages[2:]}))
+}
+
+func TestGenerationConfig(t *testing.T) {
+	client, err := genai.NewClient(context.Background(), option.WithAPIKey("test"))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	request := func() *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:    "gemini-1.5-flash",
+			Messages: []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}}},
+		}
+	}
+
+	t.Run("Stop sequences", func(t *testing.T) {
+		stopRequest := request()
+		stopRequest.StopSequences = &openai.StopSequences{Sequences: []string{"\n\n", "END"}}
+		model, err := modelFromOpenAiRequest(client, stopRequest, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"\n\n", "END"}, model.StopSequences)
+	})
+
+	t.Run("Too many stop sequences", func(t *testing.T) {
+		stopRequest := request()
+		stopRequest.StopSequences = &openai.StopSequences{Sequences: []string{"a", "b", "c", "d", "e", "f"}}
+		_, err := modelFromOpenAiRequest(client, stopRequest, zap.NewNop().Sugar())
+		assert.ErrorContains(t, err, "at most 5 stop sequences are supported with Gemini, got 6")
+	})
+
+	t.Run("JSON mode", func(t *testing.T) {
+		jsonRequest := request()
+		jsonRequest.ResponseFormat = &openai.ResponseFormat{Type: "json_object"}
+		model, err := modelFromOpenAiRequest(client, jsonRequest, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", model.ResponseMIMEType)
+		assert.Nil(t, model.ResponseSchema)
+	})
+
+	t.Run("Penalties are dropped", func(t *testing.T) {
+		penaltyRequest := request()
+		penaltyRequest.FrequencyPenalty = utils.ToPtr(float32(0.5))
+		penaltyRequest.PresencePenalty = utils.ToPtr(float32(0.5))
+		_, err := modelFromOpenAiRequest(client, penaltyRequest, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+	})
+}
+
+// Sends a request through the client to a fake Gemini API and checks the
+// payload it receives. The fake rejects the request, which is enough to see
+// the payload without parsing a response stream.
+func TestGenerateChatCompletionPayload(t *testing.T) {
+	var payload map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Chats are sent as streams of one response.
+		assert.Equal(t, "/v1beta/models/gemini-1.5-flash:streamGenerateContent", r.URL.Path)
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(body, &payload))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"code": 400, "message": "rejected by the fake", "status": "INVALID_ARGUMENT"}}`))
+	}))
+	defer server.Close()
+
+	client, err := genai.NewClient(context.Background(), option.WithAPIKey("test"), option.WithEndpoint(server.URL))
+	assert.NoError(t, err)
+	endpoint := &Endpoint{client: client, logger: zap.NewNop().Sugar()}
+	defer endpoint.Shutdown()
+
+	_, err = endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+		Model:            "gemini-1.5-flash",
+		Messages:         []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Answer in JSON.")}}},
+		StopSequences:    &openai.StopSequences{Sequences: []string{"\n\n"}},
+		ResponseFormat:   &openai.ResponseFormat{Type: "json_object"},
+		FrequencyPenalty: utils.ToPtr(float32(0.5)),
+	})
+	assert.ErrorContains(t, err, "rejected by the fake")
+
+	generationConfig, ok := payload["generationConfig"].(map[string]any)
+	assert.True(t, ok)
+	assert.Equal(t, []any{"\n\n"}, generationConfig["stopSequences"])
+	assert.Equal(t, "application/json", generationConfig["responseMimeType"])
+	assert.NotContains(t, generationConfig, "frequencyPenalty")
+}
+
+func TestCachedContent(t *testing.T) {
+	const systemPrompt = "Follow the policy."
+	// Every generation is rejected by the fake, since only the payloads that
+	// reach it are checked here.
+	const rejection = `{"error": {"code": 400, "message": "rejected by the fake", "status": "INVALID_ARGUMENT"}}`
+	newEndpoint := func(t *testing.T, handler func(w http.ResponseWriter, payload map[string]any)) (*Endpoint, *[]map[string]any) {
+		payloads := []map[string]any{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			payload := map[string]any{}
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			if len(body) > 0 {
+				assert.NoError(t, json.Unmarshal(body, &payload))
+			}
+			payload["method"] = r.Method
+			payload["path"] = r.URL.Path
+			payloads = append(payloads, payload)
+			w.Header().Set("Content-Type", "application/json")
+			handler(w, payload)
+		}))
+		t.Cleanup(server.Close)
+
+		client, err := genai.NewClient(context.Background(), option.WithAPIKey("test"), option.WithEndpoint(server.URL))
+		assert.NoError(t, err)
+		endpoint := &Endpoint{client: client, logger: zap.NewNop().Sugar()}
+		t.Cleanup(func() { endpoint.Shutdown() })
+		return endpoint, &payloads
+	}
+	reject := func(w http.ResponseWriter, payload map[string]any) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(rejection))
+	}
+	request := func(system string) *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model: "gemini-1.5-flash",
+			Messages: []openai.Message{
+				{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr(system)}},
+				{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}},
+			},
+		}
+	}
+	ctx := provider.WithCachedContent(context.Background(), provider.CachedContent{Name: "policy", Resource: "cachedContents/abc", SystemPrompt: systemPrompt})
+
+	t.Run("References the cache in place of the system prompt", func(t *testing.T) {
+		endpoint, payloads := newEndpoint(t, reject)
+
+		_, err := endpoint.GenerateChatCompletion(ctx, request(systemPrompt))
+		assert.Error(t, err)
+		assert.Len(t, *payloads, 1)
+		assert.Equal(t, "cachedContents/abc", (*payloads)[0]["cachedContent"])
+		assert.NotContains(t, (*payloads)[0], "systemInstruction")
+	})
+
+	t.Run("Sends the full prompt once the cache has expired", func(t *testing.T) {
+		endpoint, payloads := newEndpoint(t, func(w http.ResponseWriter, payload map[string]any) {
+			if _, found := payload["cachedContent"]; found {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"error": {"code": 403, "message": "CachedContent not found (or permission denied)", "status": "PERMISSION_DENIED"}}`))
+				return
+			}
+			reject(w, payload)
+		})
+
+		_, err := endpoint.GenerateChatCompletion(ctx, request(systemPrompt))
+		assert.ErrorContains(t, err, "rejected by the fake")
+		assert.Len(t, *payloads, 2)
+		assert.NotContains(t, (*payloads)[1], "cachedContent")
+		assert.Contains(t, (*payloads)[1], "systemInstruction")
+		// The retry does not repeat the message in the history.
+		assert.Len(t, (*payloads)[1]["contents"], 1)
+	})
+
+	t.Run("Sends the full prompt if it is not the cached one", func(t *testing.T) {
+		endpoint, payloads := newEndpoint(t, reject)
+
+		endpoint.GenerateChatCompletion(ctx, request("Another policy."))
+		withTools := request(systemPrompt)
+		withTools.Tools = []openai.Tool{{Type: "function", Function: openai.FunctionTool{Name: "lookup"}}}
+		endpoint.GenerateChatCompletion(ctx, withTools)
+
+		assert.Len(t, *payloads, 2)
+		for _, payload := range *payloads {
+			assert.NotContains(t, payload, "cachedContent")
+			assert.Contains(t, payload, "systemInstruction")
+		}
+	})
+
+	t.Run("Reports whether the request used the cache", func(t *testing.T) {
+		model := func(system string) *genai.GenerativeModel {
+			return &genai.GenerativeModel{SystemInstruction: &genai.Content{Parts: []genai.Part{genai.Text(system)}}}
+		}
+
+		hit := model(systemPrompt)
+		assert.Equal(t, &openai.GeminiCacheMetadata{Name: "policy", Hit: true}, useCachedContent(ctx, hit, request(systemPrompt)))
+		assert.Equal(t, "cachedContents/abc", hit.CachedContentName)
+		assert.Nil(t, hit.SystemInstruction)
+
+		assert.Equal(t, &openai.GeminiCacheMetadata{Name: "policy", Miss: "system_prompt_differs"}, useCachedContent(ctx, model("Another policy."), request("Another policy.")))
+		withTools := request(systemPrompt)
+		withTools.Tools = []openai.Tool{{Type: "function", Function: openai.FunctionTool{Name: "lookup"}}}
+		assert.Equal(t, &openai.GeminiCacheMetadata{Name: "policy", Miss: "tools"}, useCachedContent(ctx, model(systemPrompt), withTools))
+		assert.Nil(t, useCachedContent(context.Background(), model(systemPrompt), request(systemPrompt)))
+	})
+
+	t.Run("Reports the cached tokens", func(t *testing.T) {
+		response, err := toOpenAiResponse(&genai.GenerateContentResponse{
+			Candidates:    []*genai.Candidate{{Content: &genai.Content{Role: "model", Parts: []genai.Part{genai.Text("Hi")}}, FinishReason: genai.FinishReasonStop}},
+			UsageMetadata: &genai.UsageMetadata{PromptTokenCount: 30010, CandidatesTokenCount: 2, TotalTokenCount: 30012, CachedContentTokenCount: 30000},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, &openai.PromptTokensDetails{CachedTokens: 30000}, response.Usage.PromptTokensDetails)
+	})
+
+}
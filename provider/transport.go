@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Idle connections kept to each host of a provider. The default of 2
+	// makes the bursts to the same API open new connections, each with its
+	// own TLS handshake.
+	maxIdleConnsPerHost = 100
+
+	idleConnTimeout = 90 * time.Second
+
+	// Bytes of a body read before closing it. Longer ones close the
+	// connection rather than wait for the rest.
+	maxDrainBytes = 1 << 20
+)
+
+// Connections that the requests to a provider got from its pool.
+type ConnectionStats struct {
+	// Number of the requests sent over an idle connection of the pool.
+	Reused int64 `json:"reused"`
+
+	// Number of the requests that opened a new connection.
+	New int64 `json:"new"`
+}
+
+// Transport shared by the endpoints of a provider, which counts whether the
+// requests reuse the pooled connections.
+type pooledTransport struct {
+	base *http.Transport
+
+	reused atomic.Int64
+	new    atomic.Int64
+}
+
+func newPooledTransport() *pooledTransport {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.MaxIdleConns = 0
+	base.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	base.IdleConnTimeout = idleConnTimeout
+	base.ForceAttemptHTTP2 = true
+	return &pooledTransport{base: base}
+}
+
+func (t *pooledTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.reused.Add(1)
+			} else {
+				t.new.Add(1)
+			}
+		},
+	}
+	return t.base.RoundTrip(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+}
+
+var (
+	transportsMutex sync.Mutex
+	transports      = map[string]*pooledTransport{}
+)
+
+func transportFor(providerName string) *pooledTransport {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	transport, found := transports[providerName]
+	if !found {
+		transport = newPooledTransport()
+		transports[providerName] = transport
+	}
+	return transport
+}
+
+// Returns a client that shares the connection pool of the provider with the
+// other endpoints of the provider. Zero timeout for none.
+func NewHttpClient(providerName string, timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: transportFor(providerName)}
+}
+
+// Returns the connection stats of each provider whose clients have been
+// created with NewHttpClient.
+func AllConnectionStats() map[string]ConnectionStats {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	stats := make(map[string]ConnectionStats, len(transports))
+	for providerName, transport := range transports {
+		stats[providerName] = ConnectionStats{Reused: transport.reused.Load(), New: transport.new.Load()}
+	}
+	return stats
+}
+
+// Reads the rest of the body before closing it, since the connection goes
+// back to the pool only if the body has been read to the end.
+func DrainAndClose(body io.ReadCloser) {
+	io.CopyN(io.Discard, body, maxDrainBytes)
+	body.Close()
+}
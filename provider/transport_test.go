@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPooledTransport(t *testing.T) {
+	newClient := func(t *testing.T, handler http.HandlerFunc) (*pooledTransport, *http.Client, string) {
+		server := httptest.NewTLSServer(handler)
+		t.Cleanup(server.Close)
+		transport := newPooledTransport()
+		transport.base.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		t.Cleanup(transport.base.CloseIdleConnections)
+		return transport, &http.Client{Transport: transport}, server.URL
+	}
+
+	t.Run("Reuses the connection across sequential requests", func(t *testing.T) {
+		transport, client, url := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"ok": true}`))
+		})
+
+		for range 5 {
+			response, err := client.Get(url)
+			assert.NoError(t, err)
+			var body map[string]bool
+			assert.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+			DrainAndClose(response.Body)
+		}
+		assert.Equal(t, int64(1), transport.new.Load())
+		assert.Equal(t, int64(4), transport.reused.Load())
+	})
+
+	t.Run("Keeps the connection after the error responses", func(t *testing.T) {
+		transport, client, url := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"message": "slow down"}}` + strings.Repeat(" ", 512<<10)))
+		})
+
+		for range 5 {
+			response, err := client.Get(url)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+			// Returns on the status without reading the body, as the error
+			// paths do.
+			DrainAndClose(response.Body)
+		}
+		// A connection left unread would be closed and a new one opened for
+		// each request.
+		assert.Equal(t, int64(1), transport.new.Load())
+		assert.Equal(t, int64(4), transport.reused.Load())
+	})
+
+	t.Run("Shares the pool among the clients of a provider", func(t *testing.T) {
+		first := NewHttpClient("test-provider", 0)
+		second := NewHttpClient("test-provider", 0)
+		other := NewHttpClient("other-provider", 0)
+		assert.Same(t, first.Transport, second.Transport)
+		assert.NotSame(t, first.Transport, other.Transport)
+		assert.Contains(t, AllConnectionStats(), "test-provider")
+	})
+}
+
+func BenchmarkPooledTransport(b *testing.B) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+	transport := newPooledTransport()
+	transport.base.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	defer transport.base.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	for range b.N {
+		response, err := client.Get(server.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		DrainAndClose(response.Body)
+	}
+	b.ReportMetric(float64(transport.new.Load()), "connections")
+}
@@ -17,20 +17,61 @@ const REGION = "claude"''', '''''')
   content = content.replace(
       '''type Endpoint struct {
 	client *anthropic.Client
-}''', '''type Endpoint struct {
+	logger *zap.SugaredLogger
+''', '''type Endpoint struct {
 	client *anthropic.Client
+	logger *zap.SugaredLogger
 	region string
-}''')
+''')
+  content = content.replace('''"go.uber.org/zap"''', '''"go.uber.org/zap"
+	"golang.org/x/oauth2/google"''')
   content = content.replace(
-      '''func NewEndpoint(apiKey string) (*Endpoint, error) {''',
-      '''func NewEndpoint(projectId string, region string) (*Endpoint, error) {''')
+      '''func NewEndpoint(apiKey string, midSystemMessages string, logger *zap.SugaredLogger) (*Endpoint, error) {''',
+      '''func NewEndpoint(projectId string, region string, credentials *google.Credentials, midSystemMessages string, logger *zap.SugaredLogger) (*Endpoint, error) {''')
   content = content.replace(
-      '''anthropic.NewClient(option.WithAPIKey(apiKey))''',
-      '''anthropic.NewClient(vertex.WithGoogleAuth(context.Background(), region, projectId))''')
-  content = content.replace('''return &Endpoint{client: client}, nil''',
-                            '''return &Endpoint{client: client, region: region}, nil''')
+      # The client of the Google credentials authorizes the requests, so it
+      # replaces the pooled one of the provider.
+      '''anthropic.NewClient(option.WithAPIKey(apiKey), option.WithHTTPClient(provider.NewHttpClient("claude", 0)))''',
+      '''anthropic.NewClient(vertex.WithCredentials(context.Background(), region, projectId, credentials))''')
+  content = content.replace('''return &Endpoint{client: client, logger: logger, midSystemMessages: midSystemMessages}, nil''',
+                            '''return &Endpoint{client: client, logger: logger, region: region, midSystemMessages: midSystemMessages}, nil''')
   content = content.replace('''Model:     anthropic.F(anthropic.ModelClaude_3_Haiku_20240307),''',
                             '''Model:     anthropic.F("claude-3-haiku@20240307"),''')
+  content = content.replace(
+      '''	var countResponse struct {
+		InputTokens int32 `json:"input_tokens"`
+	}
+	// The count_tokens API rejects the generation parameters.
+	options := append([]option.RequestOption{
+		option.WithHeader("anthropic-beta", "token-counting-2024-11-01"),
+		option.WithJSONDel("max_tokens"),
+		option.WithJSONDel("stop_sequences"),
+		option.WithJSONDel("temperature"),
+		option.WithJSONDel("top_p"),
+	}, requestOptions(ctx)...)
+	err = ep.client.Post(ctx, "v1/messages/count_tokens", claudeParams, &countResponse, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &openai.TokenCountResponse{
+		PromptTokens: countResponse.InputTokens,
+		Tokenizer:    "anthropic/" + standardizeModelName(openaiRequest.Model),
+	}, nil''', '''	// Vertex AI does not serve the count_tokens API for Claude models.
+	return nil, fmt.Errorf("token counting is not supported for %s on Vertex AI", claudeParams.Model.Value)''')
+  # The Vertex AI credentials are those of the endpoint, not of the API key.
+  content = content.replace('''ep.client.Messages.New(ctx, *claudeParams, requestOptions(ctx)...)''',
+                            '''ep.client.Messages.New(ctx, *claudeParams)''')
+  content = content.replace(
+      '''// Returns the options that override the API key of the endpoint with that of
+// the context, if any.
+func requestOptions(ctx context.Context) []option.RequestOption {
+	if apiKey, found := provider.ApiKeyFrom(ctx); found {
+		return []option.RequestOption{option.WithAPIKey(apiKey)}
+	}
+	return nil
+}
+
+''', '''''')
   content = content.replace('''return "claude"''', '''return "vclaude"''')
   content = content.replace('''func (ep *Endpoint) Region() string {
 	return REGION
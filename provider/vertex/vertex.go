@@ -4,11 +4,19 @@ package vertex
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/vertexai/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
 
 	"github.com/yanolja/ogem/openai"
 	"github.com/yanolja/ogem/provider"
@@ -17,45 +25,151 @@ import (
 	"github.com/yanolja/ogem/utils/orderedmap"
 )
 
+// Maximum number of stop sequences that Gemini accepts.
+const maxStopSequences = 5
+
 type Endpoint struct {
 	client *genai.Client
+	logger *zap.SugaredLogger
 	region string
 }
 
-func NewEndpoint(projectId string, region string) (*Endpoint, error) {
+func NewEndpoint(projectId string, region string, credentials *google.Credentials, logger *zap.SugaredLogger) (*Endpoint, error) {
 	ctx := context.Background()
-	client, err := genai.NewClient(ctx, projectId, region)
+	client, err := genai.NewClient(ctx, projectId, region, option.WithCredentials(credentials))
 	if err != nil {
 		return nil, err
 	}
-	return &Endpoint{client: client, region: region}, nil
+	return &Endpoint{client: client, logger: logger, region: region}, nil
 }
 
 func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
-	model, err := modelFromOpenAiRequest(ep.client, openaiRequest)
+	model, err := modelFromOpenAiRequest(ep.client, openaiRequest, ep.logger)
 	if err != nil {
 		return nil, err
 	}
 
-	chat := model.StartChat()
-	var messageToSend *genai.Content
-	chat.History, messageToSend, err = toGeminiMessages(openaiRequest.Messages)
+	cacheStatus := useCachedContent(ctx, model, openaiRequest)
+
+	provider.LogRequest(ep.logger, openaiRequest)
+
+	history, messageToSend, err := toGeminiMessages(openaiRequest.Messages)
 	if err != nil {
 		return nil, err
 	}
 
-	geminiResponse, err := chat.SendMessage(ctx, messageToSend.Parts...)
+	geminiResponse, err := sendMessage(ctx, model, history, messageToSend)
+	if err != nil && cacheStatus != nil && cacheStatus.Hit && isCacheNotFound(err) {
+		ep.logger.Warnw("Cached content not found, sending the full prompt", "cache", cacheStatus.Name, "error", err)
+		model.CachedContentName = ""
+		model.SystemInstruction = toGeminiSystemInstruction(openaiRequest)
+		cacheStatus = &openai.GeminiCacheMetadata{Name: cacheStatus.Name, Miss: "not_found"}
+		geminiResponse, err = sendMessage(ctx, model, history, messageToSend)
+	}
 	if err != nil {
-		return nil, err
+		return nil, toQuotaError(err)
 	}
 
 	openaiResponse, err := toOpenAiResponse(geminiResponse)
 	if err != nil {
 		return nil, err
 	}
+	if cacheStatus != nil {
+		openaiResponse.Ogem = &openai.ResponseMetadata{GeminiCache: cacheStatus}
+	}
 	return openai.FinalizeResponse(ep.Provider(), ep.Region(), openaiRequest.Model, openaiResponse), nil
 }
 
+// Sends the messages in a new chat, since a chat keeps the failed message in
+// its history.
+func sendMessage(ctx context.Context, model *genai.GenerativeModel, history []*genai.Content, message *genai.Content) (*genai.GenerateContentResponse, error) {
+	chat := model.StartChat()
+	chat.History = append([]*genai.Content{}, history...)
+	return chat.SendMessage(ctx, message.Parts...)
+}
+
+// Makes the model reference the cached content that the request may use in
+// place of its system prompt. Returns whether it does, for the response. Nil
+// if the request has no cached content.
+func useCachedContent(ctx context.Context, model *genai.GenerativeModel, openAiRequest *openai.ChatCompletionRequest) *openai.GeminiCacheMetadata {
+	cache, found := provider.CachedContentFrom(ctx)
+	if !found {
+		return nil
+	}
+	// Gemini rejects the requests that set the system instruction or the
+	// tools along with a cache.
+	if len(openAiRequest.Tools) > 0 || len(openAiRequest.Functions) > 0 {
+		return &openai.GeminiCacheMetadata{Name: cache.Name, Miss: "tools"}
+	}
+	instruction := model.SystemInstruction
+	if instruction == nil || len(instruction.Parts) != 1 || instruction.Parts[0] != genai.Text(cache.SystemPrompt) {
+		return &openai.GeminiCacheMetadata{Name: cache.Name, Miss: "system_prompt_differs"}
+	}
+	model.CachedContentName = cache.Resource
+	model.SystemInstruction = nil
+	return &openai.GeminiCacheMetadata{Name: cache.Name, Hit: true}
+}
+
+// Whether the cached content that the request referenced no longer exists,
+// usually because it has expired.
+func isCacheNotFound(err error) bool {
+	var apiError *apierror.APIError
+	if !errors.As(err, &apiError) {
+		return false
+	}
+	notFound := apiError.HTTPCode() == http.StatusNotFound ||
+		(apiError.GRPCStatus() != nil && apiError.GRPCStatus().Code() == codes.NotFound)
+	// Gemini reports a missing cache as denied, since it cannot tell whether
+	// it belongs to another project.
+	denied := apiError.HTTPCode() == http.StatusForbidden ||
+		(apiError.GRPCStatus() != nil && apiError.GRPCStatus().Code() == codes.PermissionDenied)
+	return notFound || (denied && strings.Contains(strings.ToLower(err.Error()), "cachedcontent"))
+}
+
+func (ep *Endpoint) CreateCachedContent(ctx context.Context, model string, systemPrompt string, ttl time.Duration) (string, time.Time, error) {
+	cached, err := ep.client.CreateCachedContent(ctx, &genai.CachedContent{
+		Model:             model,
+		SystemInstruction: &genai.Content{Parts: []genai.Part{genai.Text(systemPrompt)}},
+		Expiration:        genai.ExpireTimeOrTTL{TTL: ttl},
+	})
+	if err != nil {
+		var apiError *apierror.APIError
+		if errors.As(err, &apiError) && (apiError.HTTPCode() == http.StatusBadRequest ||
+			(apiError.GRPCStatus() != nil && apiError.GRPCStatus().Code() == codes.InvalidArgument)) {
+			return "", time.Time{}, provider.NewInvalidRequestError(err)
+		}
+		return "", time.Time{}, toQuotaError(err)
+	}
+	expireTime := cached.Expiration.ExpireTime
+	if expireTime.IsZero() {
+		expireTime = time.Now().Add(ttl)
+	}
+	return cached.Name, expireTime, nil
+}
+
+func (ep *Endpoint) DeleteCachedContent(ctx context.Context, resource string) error {
+	return ep.client.DeleteCachedContent(ctx, resource)
+}
+
+func (ep *Endpoint) CountTokens(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	model, err := modelFromOpenAiRequest(ep.client, openaiRequest, ep.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	history, last, err := toGeminiMessages(openaiRequest.Messages)
+	if err != nil {
+		return nil, err
+	}
+	parts := []genai.Part{}
+	for _, content := range append(history, last) {
+		if content != nil {
+			parts = append(parts, content.Parts...)
+		}
+	}
+	return countTokens(ctx, model, openaiRequest.Model, parts)
+}
+
 func (ep *Endpoint) Provider() string {
 	return "vertex"
 }
@@ -64,14 +178,15 @@ func (ep *Endpoint) Region() string {
 	return ep.region
 }
 
+// Counts the tokens of a short text, which requires the credentials but
+// generates nothing, to check that the endpoint is reachable and accepts them.
 func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
 	genModel := ep.client.GenerativeModel("gemini-1.5-flash")
-	genModel.MaxOutputTokens = utils.ToPtr(int32(1))
 
 	start := time.Now()
-	_, err := genModel.GenerateContent(ctx, genai.Text("Ping"))
+	_, err := genModel.CountTokens(ctx, genai.Text("Ping"))
 	if err != nil {
-		return 0, err
+		return 0, toAuthError(err)
 	}
 	return time.Since(start), nil
 }
@@ -80,7 +195,29 @@ func (ep *Endpoint) Shutdown() error {
 	return ep.client.Close()
 }
 
-func modelFromOpenAiRequest(client *genai.Client, openAiRequest *openai.ChatCompletionRequest) (*genai.GenerativeModel, error) {
+type tokenCounter interface {
+	CountTokens(ctx context.Context, parts ...genai.Part) (*genai.CountTokensResponse, error)
+}
+
+func countTokens(ctx context.Context, counter tokenCounter, model string, parts []genai.Part) (*openai.TokenCountResponse, error) {
+	geminiResponse, err := counter.CountTokens(ctx, parts...)
+	if err != nil {
+		return nil, err
+	}
+	return &openai.TokenCountResponse{
+		PromptTokens: geminiResponse.TotalTokens,
+		Tokenizer:    "gemini/" + model,
+	}, nil
+}
+
+func modelFromOpenAiRequest(client *genai.Client, openAiRequest *openai.ChatCompletionRequest, logger *zap.SugaredLogger) (*genai.GenerativeModel, error) {
+	if openAiRequest.WantsLogprobs() {
+		return nil, fmt.Errorf("logprobs is not supported with Gemini")
+	}
+	if openAiRequest.HasAudio() {
+		return nil, provider.NewNotSupportedError("audio with Gemini")
+	}
+
 	model := client.GenerativeModel(openAiRequest.Model)
 
 	model.SystemInstruction = toGeminiSystemInstruction(openAiRequest)
@@ -93,15 +230,17 @@ func modelFromOpenAiRequest(client *genai.Client, openAiRequest *openai.ChatComp
 		model.MaxOutputTokens = openAiRequest.MaxCompletionTokens
 	}
 
-	if openAiRequest.CandidateCount != nil && *openAiRequest.CandidateCount != 1 {
-		return nil, fmt.Errorf("unsupported candidate count: %d, only 1 is supported", *openAiRequest.CandidateCount)
-	}
 	model.CandidateCount = openAiRequest.CandidateCount
 
 	if openAiRequest.StopSequences != nil {
+		if len(openAiRequest.StopSequences.Sequences) > maxStopSequences {
+			return nil, fmt.Errorf("at most %d stop sequences are supported with Gemini, got %d", maxStopSequences, len(openAiRequest.StopSequences.Sequences))
+		}
 		model.StopSequences = openAiRequest.StopSequences.Sequences
 	}
 
+	setPenalties(model, openAiRequest, logger)
+
 	model.SafetySettings = []*genai.SafetySetting{
 		{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockNone},
 		{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockNone},
@@ -120,6 +259,11 @@ func modelFromOpenAiRequest(client *genai.Client, openAiRequest *openai.ChatComp
 	return model, nil
 }
 
+func setPenalties(model *genai.GenerativeModel, openAiRequest *openai.ChatCompletionRequest, logger *zap.SugaredLogger) {
+	model.FrequencyPenalty = openAiRequest.FrequencyPenalty
+	model.PresencePenalty = openAiRequest.PresencePenalty
+}
+
 func setToolsAndFunctions(model *genai.GenerativeModel, openAiRequest *openai.ChatCompletionRequest) error {
 	hasFunctions := len(openAiRequest.Functions) > 0
 	hasTools := len(openAiRequest.Tools) > 0
@@ -176,7 +320,7 @@ func toGeminiMessages(openAiMessages []openai.Message) ([]*genai.Content, *genai
 	toolMap := make(map[string]string)
 	geminiMessages := make([]*genai.Content, 0, messageCount)
 	for _, message := range openAiMessages {
-		if message.Role == "system" {
+		if message.IsSystem() {
 			continue
 		}
 
@@ -197,15 +341,28 @@ func toGeminiMessages(openAiMessages []openai.Message) ([]*genai.Content, *genai
 	return geminiMessages, last, nil
 }
 
+// Merges the system and developer messages into the system instruction in
+// order, since Gemini takes a single one. Nil if there is none.
 func toGeminiSystemInstruction(openAiRequest *openai.ChatCompletionRequest) *genai.Content {
+	parts := []genai.Part{}
 	for _, message := range openAiRequest.Messages {
-		if provider.ToGeminiRole(message.Role) == "system" {
-			return &genai.Content{
-				Parts: []genai.Part{genai.Text(*message.Content.String)},
+		if !message.IsSystem() || message.Content == nil {
+			continue
+		}
+		if message.Content.String != nil {
+			parts = append(parts, genai.Text(*message.Content.String))
+			continue
+		}
+		for _, part := range message.Content.Parts {
+			if part.Content.TextContent != nil {
+				parts = append(parts, genai.Text(part.Content.TextContent.Text))
 			}
 		}
 	}
-	return nil
+	if len(parts) == 0 {
+		return nil
+	}
+	return &genai.Content{Parts: parts}
 }
 
 func toGeminiParts(message openai.Message, toolMap map[string]string) ([]genai.Part, error) {
@@ -539,16 +696,26 @@ func toOpenAiResponse(geminiResponse *genai.GenerateContentResponse) (*openai.Ch
 			FinishReason: toOpenAiFinishReason(candidate.FinishReason),
 		}
 	}
+	usage := openai.Usage{
+		PromptTokens:     geminiResponse.UsageMetadata.PromptTokenCount,
+		CompletionTokens: geminiResponse.UsageMetadata.CandidatesTokenCount,
+		TotalTokens:      geminiResponse.UsageMetadata.TotalTokenCount,
+	}
+	if cached := cachedTokens(geminiResponse.UsageMetadata); cached > 0 {
+		usage.PromptTokensDetails = &openai.PromptTokensDetails{CachedTokens: cached}
+	}
 	return &openai.ChatCompletionResponse{
 		Choices: choices,
-		Usage: openai.Usage{
-			PromptTokens:     geminiResponse.UsageMetadata.PromptTokenCount,
-			CompletionTokens: geminiResponse.UsageMetadata.CandidatesTokenCount,
-			TotalTokens:      geminiResponse.UsageMetadata.TotalTokenCount,
-		},
+		Usage:   usage,
 	}, nil
 }
 
+// The Vertex AI client does not report the cached tokens, so they are billed
+// at the full price.
+func cachedTokens(usage *genai.UsageMetadata) int32 {
+	return 0
+}
+
 func toOpenAiMessage(content *genai.Content, index int32) (*openai.Message, error) {
 	message := &openai.Message{
 		Role: "assistant",
@@ -635,3 +802,54 @@ func toOpenAiFinishReason(finishReason genai.FinishReason) string {
 		return "content_filter"
 	}
 }
+
+// Converts the resource exhausted errors to provider.QuotaError with the retry
+// delay suggested by the API. Returns other errors as is.
+func toAuthError(err error) error {
+	var apiError *apierror.APIError
+	if !errors.As(err, &apiError) {
+		return err
+	}
+	unauthorized := apiError.HTTPCode() == http.StatusUnauthorized ||
+		apiError.HTTPCode() == http.StatusForbidden ||
+		(apiError.GRPCStatus() != nil && (apiError.GRPCStatus().Code() == codes.Unauthenticated ||
+			apiError.GRPCStatus().Code() == codes.PermissionDenied))
+	if !unauthorized {
+		return err
+	}
+	return provider.NewAuthError(err)
+}
+
+func toQuotaError(err error) error {
+	var apiError *apierror.APIError
+	if !errors.As(err, &apiError) {
+		return err
+	}
+	exhausted := apiError.HTTPCode() == http.StatusTooManyRequests ||
+		(apiError.GRPCStatus() != nil && apiError.GRPCStatus().Code() == codes.ResourceExhausted)
+	if !exhausted {
+		return toProviderError(apiError, err)
+	}
+
+	var retryAfter time.Duration
+	if retryInfo := apiError.Details().RetryInfo; retryInfo != nil {
+		retryAfter = retryInfo.GetRetryDelay().AsDuration()
+	}
+	return provider.NewQuotaError(err, retryAfter)
+}
+
+// Converts the other errors of the API to provider.ProviderError with the
+// status and code, so that they can be classified without their text.
+func toProviderError(apiError *apierror.APIError, err error) error {
+	if apiError.HTTPCode() > 0 {
+		var httpError *googleapi.Error
+		if errors.As(err, &httpError) {
+			return provider.NewProviderError(apiError.HTTPCode(), provider.ErrorCodeFromBody(httpError.Body), err)
+		}
+		return provider.NewProviderError(apiError.HTTPCode(), "", err)
+	}
+	if apiError.GRPCStatus() != nil {
+		return provider.NewProviderError(0, apiError.GRPCStatus().Code().String(), err)
+	}
+	return err
+}
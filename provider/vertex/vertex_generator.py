@@ -9,8 +9,8 @@ def replace_content(content):
   content = content.replace('''package studio''', '''package vertex''')
   content = content.replace('''"github.com/google/generative-ai-go/genai"''',
                             '''"cloud.google.com/go/vertexai/genai"''')
-  content = content.replace('''
-	"google.golang.org/api/option"''', '''''')
+  content = content.replace('''"go.uber.org/zap"''', '''"go.uber.org/zap"
+	"golang.org/x/oauth2/google"''')
   content = content.replace(
       '''
 
@@ -18,23 +18,46 @@ def replace_content(content):
 const REGION = "studio"''', '''''')
   content = content.replace('''type Endpoint struct {
 	client *genai.Client
+	logger *zap.SugaredLogger
 }''', '''type Endpoint struct {
 	client *genai.Client
+	logger *zap.SugaredLogger
 	region string
 }''')
   content = content.replace(
-      '''func NewEndpoint(apiKey string) (*Endpoint, error) {''',
-      '''func NewEndpoint(projectId string, region string) (*Endpoint, error) {''')
+      '''func NewEndpoint(apiKey string, logger *zap.SugaredLogger) (*Endpoint, error) {''',
+      '''func NewEndpoint(projectId string, region string, credentials *google.Credentials, logger *zap.SugaredLogger) (*Endpoint, error) {''')
   content = content.replace('''client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))''',
-                            '''client, err := genai.NewClient(ctx, projectId, region)''')
-  content = content.replace('''return &Endpoint{client: client}, nil''',
-                            '''return &Endpoint{client: client, region: region}, nil''')
+                            '''client, err := genai.NewClient(ctx, projectId, region, option.WithCredentials(credentials))''')
+  content = content.replace('''return &Endpoint{client: client, logger: logger}, nil''',
+                            '''return &Endpoint{client: client, logger: logger, region: region}, nil''')
   content = content.replace('''return "studio"''', '''return "vertex"''')
   content = content.replace('''func (ep *Endpoint) Region() string {
 	return REGION
 }''', '''func (ep *Endpoint) Region() string {
 	return ep.region
 }''')
+  content = content.replace(
+      '''// The Gemini API client has no penalty fields, so the penalties are dropped.
+func setPenalties(model *genai.GenerativeModel, openAiRequest *openai.ChatCompletionRequest, logger *zap.SugaredLogger) {
+	if openAiRequest.FrequencyPenalty != nil || openAiRequest.PresencePenalty != nil {
+		logger.Debugw("Dropping penalties unsupported by the Gemini API", "model", openAiRequest.Model)
+	}
+}''', '''func setPenalties(model *genai.GenerativeModel, openAiRequest *openai.ChatCompletionRequest, logger *zap.SugaredLogger) {
+	model.FrequencyPenalty = openAiRequest.FrequencyPenalty
+	model.PresencePenalty = openAiRequest.PresencePenalty
+}''')
+
+  content = content.replace(
+      '''// Returns the prompt tokens read from the cached content, which are included
+// in the prompt tokens.
+func cachedTokens(usage *genai.UsageMetadata) int32 {
+	return usage.CachedContentTokenCount
+}''', '''// The Vertex AI client does not report the cached tokens, so they are billed
+// at the full price.
+func cachedTokens(usage *genai.UsageMetadata) int32 {
+	return 0
+}''')
 
   return content
 
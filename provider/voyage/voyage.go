@@ -0,0 +1,175 @@
+package voyage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+// Endpoint that serves the embedding models of Voyage AI. It cannot generate
+// chat completions.
+type Endpoint struct {
+	baseUrl    string
+	apiKey     string
+	httpClient *http.Client
+	logger     *zap.SugaredLogger
+}
+
+// The base URL is https://api.voyageai.com/v1 except in tests.
+func NewEndpoint(baseUrl string, apiKey string, logger *zap.SugaredLogger) (*Endpoint, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("voyage api key is required")
+	}
+	return &Endpoint{
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		apiKey:     apiKey,
+		httpClient: provider.NewHttpClient("voyage", 0),
+		logger:     logger,
+	}, nil
+}
+
+type embeddingRequest struct {
+	Model           string   `json:"model"`
+	Input           []string `json:"input"`
+	InputType       *string  `json:"input_type,omitempty"`
+	OutputDimension *int32   `json:"output_dimension,omitempty"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int32     `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Model string `json:"model"`
+	Usage struct {
+		TotalTokens int32 `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (ep *Endpoint) GenerateEmbedding(ctx context.Context, openaiRequest *openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	request, err := toEmbeddingRequest(openaiRequest)
+	if err != nil {
+		return nil, provider.NewInvalidRequestError(err)
+	}
+
+	var response embeddingResponse
+	if err := ep.call(ctx, request, &response); err != nil {
+		return nil, err
+	}
+
+	openaiResponse := &openai.EmbeddingResponse{
+		Object: "list",
+		Data:   make([]openai.Embedding, len(response.Data)),
+		Model:  openaiRequest.Model,
+		Usage:  openai.EmbeddingUsage{PromptTokens: response.Usage.TotalTokens, TotalTokens: response.Usage.TotalTokens},
+	}
+	for index, data := range response.Data {
+		openaiResponse.Data[index] = openai.Embedding{Object: "embedding", Index: data.Index, Embedding: data.Embedding}
+	}
+	return openaiResponse, nil
+}
+
+func (ep *Endpoint) GenerateChatCompletion(ctx context.Context, openaiRequest *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	return nil, provider.NewNotSupportedError("chat completions")
+}
+
+func (ep *Endpoint) Provider() string {
+	return "voyage"
+}
+
+func (ep *Endpoint) Region() string {
+	return "voyage"
+}
+
+// Embeds a single word, since Voyage has no endpoint that checks the key
+// without embedding anything.
+func (ep *Endpoint) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := ep.call(ctx, &embeddingRequest{Model: "voyage-3-lite", Input: []string{"ping"}}, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (ep *Endpoint) Shutdown() error {
+	return nil
+}
+
+// Voyage only distinguishes queries from documents.
+func toEmbeddingRequest(openaiRequest *openai.EmbeddingRequest) (*embeddingRequest, error) {
+	if openaiRequest.Input == nil || len(openaiRequest.Input.Texts) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+	if openaiRequest.EncodingFormat != nil && *openaiRequest.EncodingFormat != "float" {
+		return nil, fmt.Errorf("unsupported encoding format: %s", *openaiRequest.EncodingFormat)
+	}
+	request := &embeddingRequest{
+		Model:           openaiRequest.Model,
+		Input:           openaiRequest.Input.Texts,
+		OutputDimension: openaiRequest.Dimensions,
+	}
+	if openaiRequest.InputType != nil {
+		switch inputType := *openaiRequest.InputType; inputType {
+		case "query", "document":
+			request.InputType = &inputType
+		default:
+			return nil, fmt.Errorf("unsupported input type for Voyage: %s", inputType)
+		}
+	}
+	return request, nil
+}
+
+// Sends the embedding request and decodes the response into result, if not
+// nil. Rate limits are reported as quota errors and rejected keys as
+// authentication errors.
+func (ep *Endpoint) call(ctx context.Context, request *embeddingRequest, result any) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", ep.baseUrl+"/embeddings", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Authorization", "Bearer "+ep.apiKey)
+
+	httpResponse, err := ep.httpClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer provider.DrainAndClose(httpResponse.Body)
+	body, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	switch httpResponse.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		return provider.NewQuotaError(fmt.Errorf("%s", string(body)), provider.RetryAfterFromHeader(httpResponse.Header))
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return provider.NewAuthError(fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(body)))
+	case http.StatusBadRequest:
+		return provider.NewInvalidRequestError(fmt.Errorf("voyage: %s", string(body)))
+	default:
+		return fmt.Errorf("unexpected status code: %d, body: %s", httpResponse.StatusCode, string(body))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package voyage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func newTestEndpoint(t *testing.T, handler http.HandlerFunc) *Endpoint {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	endpoint, err := NewEndpoint(server.URL, "voyage-key", zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	return endpoint
+}
+
+func TestGenerateEmbedding(t *testing.T) {
+	t.Run("Embeds the texts", func(t *testing.T) {
+		var receivedPath, receivedAuthorization string
+		var receivedBody map[string]any
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			receivedPath = r.URL.Path
+			receivedAuthorization = r.Header.Get("Authorization")
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &receivedBody)
+			w.Write([]byte(`{
+				"object": "list",
+				"data": [
+					{"object": "embedding", "embedding": [0.1, 0.2], "index": 0},
+					{"object": "embedding", "embedding": [0.3, 0.4], "index": 1}
+				],
+				"model": "voyage-3",
+				"usage": {"total_tokens": 12}
+			}`))
+		})
+
+		response, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{
+			Model:      "voyage-3",
+			Input:      &openai.EmbeddingInput{Texts: []string{"What is ogem?", "A proxy"}},
+			Dimensions: utils.ToPtr(int32(512)),
+			InputType:  utils.ToPtr("query"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "/embeddings", receivedPath)
+		assert.Equal(t, "Bearer voyage-key", receivedAuthorization)
+		assert.Equal(t, map[string]any{
+			"model":            "voyage-3",
+			"input":            []any{"What is ogem?", "A proxy"},
+			"input_type":       "query",
+			"output_dimension": float64(512),
+		}, receivedBody)
+
+		assert.Equal(t, "list", response.Object)
+		assert.Equal(t, "voyage-3", response.Model)
+		assert.Equal(t, []openai.Embedding{
+			{Object: "embedding", Index: 0, Embedding: []float32{0.1, 0.2}},
+			{Object: "embedding", Index: 1, Embedding: []float32{0.3, 0.4}},
+		}, response.Data)
+		assert.Equal(t, openai.EmbeddingUsage{PromptTokens: 12, TotalTokens: 12}, response.Usage)
+	})
+
+	t.Run("Leaves the input type unset", func(t *testing.T) {
+		var receivedBody map[string]any
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &receivedBody)
+			w.Write([]byte(`{"data": [{"embedding": [0.1], "index": 0}], "usage": {"total_tokens": 1}}`))
+		})
+
+		_, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{Model: "voyage-3", Input: &openai.EmbeddingInput{Texts: []string{"Hi"}}})
+		assert.NoError(t, err)
+		assert.NotContains(t, receivedBody, "input_type")
+	})
+
+	t.Run("Rejects the input types of Cohere", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			t.Error("the request must not be sent")
+		})
+
+		_, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{
+			Model:     "voyage-3",
+			Input:     &openai.EmbeddingInput{Texts: []string{"Hi"}},
+			InputType: utils.ToPtr("clustering"),
+		})
+		var invalidRequest *provider.InvalidRequestError
+		assert.ErrorAs(t, err, &invalidRequest)
+	})
+
+	t.Run("Reports the rate limits as quota errors", func(t *testing.T) {
+		endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"detail": "rate limited"}`))
+		})
+
+		_, err := endpoint.GenerateEmbedding(context.Background(), &openai.EmbeddingRequest{Model: "voyage-3", Input: &openai.EmbeddingInput{Texts: []string{"Hi"}}})
+		var quotaError *provider.QuotaError
+		assert.ErrorAs(t, err, &quotaError)
+		assert.Equal(t, "3s", quotaError.RetryAfter.String())
+	})
+}
+
+func TestGenerateChatCompletion(t *testing.T) {
+	endpoint := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request must not be sent")
+	})
+
+	_, err := endpoint.GenerateChatCompletion(context.Background(), &openai.ChatCompletionRequest{Model: "voyage-3"})
+	var notSupported *provider.NotSupportedError
+	assert.ErrorAs(t, err, &notSupported)
+}
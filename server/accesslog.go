@@ -0,0 +1,224 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// One JSON line for each request to the API, written apart from the logs of
+// the proxy for the log pipelines.
+type AccessLogConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Where to write the lines: stdout, stderr or the path of a file.
+	// Defaults to stdout.
+	Output string `yaml:"output"`
+}
+
+type accessRecordContextKey struct{}
+
+// Fields of the access log line that only the handlers know. Written by the
+// goroutine of the request and read by the middleware once the handler
+// returns, so it needs no lock.
+type accessRecord struct {
+	apiKey string
+
+	// Either hit, miss, or disabled if the request is not cacheable. Empty
+	// if no model was requested.
+	cache string
+
+	// Chat completion that the request made, if any.
+	activity *RequestActivity
+}
+
+// Returns nil if the access log is disabled.
+func newAccessLogger(config AccessLogConfig) (*zap.Logger, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "timestamp"
+	encoderConfig.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	loggerConfig := zap.Config{
+		Level:             zap.NewAtomicLevelAt(zap.InfoLevel),
+		Encoding:          "json",
+		EncoderConfig:     encoderConfig,
+		OutputPaths:       []string{cmp.Or(config.Output, "stdout")},
+		ErrorOutputPaths:  []string{"stderr"},
+		DisableCaller:     true,
+		DisableStacktrace: true,
+		// Every request is logged, however many there are.
+		Sampling: nil,
+	}
+	return loggerConfig.Build()
+}
+
+func withAccessRecord(ctx context.Context, record *accessRecord) context.Context {
+	return context.WithValue(ctx, accessRecordContextKey{}, record)
+}
+
+// Nil if the request is not logged. Every method of accessRecord does
+// nothing on nil.
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(accessRecordContextKey{}).(*accessRecord)
+	return record
+}
+
+func (r *accessRecord) setApiKey(name string) {
+	if r != nil {
+		r.apiKey = name
+	}
+}
+
+func (r *accessRecord) setCache(cache string) {
+	if r != nil {
+		r.cache = cache
+	}
+}
+
+func (r *accessRecord) setActivity(activity RequestActivity) {
+	if r != nil {
+		r.activity = &activity
+	}
+}
+
+// Records the status, the size and the time of the first byte of the
+// response.
+type accessLogWriter struct {
+	http.ResponseWriter
+
+	status       int
+	bytes        int64
+	firstWriteAt time.Time
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.firstWriteAt.IsZero() {
+		w.firstWriteAt = time.Now()
+	}
+	written, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(written)
+	return written, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Writes a line to the access log for each request under /v1/ once its
+// response has been written, which is the end of the stream for the streamed
+// ones. Passes through if the access log is disabled.
+func (s *ModelProxy) AccessLogMiddleware(next http.Handler) http.Handler {
+	if s.accessLogger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+		if !strings.HasPrefix(httpRequest.URL.Path, "/v1/") {
+			next.ServeHTTP(httpResponse, httpRequest)
+			return
+		}
+		start := time.Now()
+		record := &accessRecord{}
+		writer := &accessLogWriter{ResponseWriter: httpResponse}
+		next.ServeHTTP(writer, httpRequest.WithContext(withAccessRecord(httpRequest.Context(), record)))
+		s.writeAccessLog(httpRequest, writer, record, start)
+	})
+}
+
+func (s *ModelProxy) writeAccessLog(httpRequest *http.Request, writer *accessLogWriter, record *accessRecord, start time.Time) {
+	status := writer.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	clientIp := ""
+	if client := s.ipFilter.clientIp(httpRequest); client.IsValid() {
+		clientIp = client.String()
+	}
+	fields := []zap.Field{
+		zap.String("request_id", writer.Header().Get("X-Ogem-Request-Id")),
+		zap.String("method", httpRequest.Method),
+		zap.String("path", httpRequest.URL.Path),
+		zap.Int("status", status),
+		zap.Int64("bytes", writer.bytes),
+		zap.Int64("duration_ms", time.Since(start).Milliseconds()),
+		zap.String("client_ip", clientIp),
+		zap.String("api_key", record.apiKey),
+	}
+	if activity := record.activity; activity != nil {
+		provider, region, model, _ := parseModelIdentifier(activity.Endpoint)
+		fields = append(fields,
+			zap.String("requested_model", activity.RequestedModel),
+			zap.String("served_model", model),
+			zap.String("provider", provider),
+			zap.String("region", region),
+			zap.Int32("prompt_tokens", activity.PromptTokens),
+			zap.Int32("completion_tokens", activity.CompletionTokens),
+			zap.Float64("cost", activity.Cost),
+			zap.Int64("queue_ms", activity.QueueMs),
+		)
+		if activity.CacheHit {
+			fields = append(fields, zap.Float64("cost_saved", activity.CostSaved))
+		}
+		if activity.TrafficArm != "" {
+			fields = append(fields, zap.String("traffic_arm", activity.TrafficArm))
+		}
+	}
+	if record.cache != "" {
+		fields = append(fields, zap.String("cache", record.cache))
+	}
+	if errorClass := accessErrorClass(status, record.activity); errorClass != "" {
+		fields = append(fields, zap.String("error_class", errorClass))
+	}
+	if strings.HasPrefix(writer.Header().Get("Content-Type"), "text/event-stream") && !writer.firstWriteAt.IsZero() {
+		fields = append(fields, zap.Int64("ttft_ms", writer.firstWriteAt.Sub(start).Milliseconds()))
+	}
+	s.accessLogger.Info("access", fields...)
+}
+
+// Returns the kind of the error of the response, as in the request activity.
+// Empty if it succeeded.
+func accessErrorClass(status int, activity *RequestActivity) string {
+	if activity != nil && activity.ErrorClass != "" {
+		return activity.ErrorClass
+	}
+	switch {
+	case status < http.StatusBadRequest:
+		return ""
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return "timeout"
+	case status == http.StatusServiceUnavailable:
+		return "unavailable"
+	case status < http.StatusInternalServerError:
+		return "bad_request"
+	default:
+		return "internal"
+	}
+}
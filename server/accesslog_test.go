@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestAccessLog(t *testing.T) {
+	newServer := func(t *testing.T) (http.Handler, *observer.ObservedLogs) {
+		generate := func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return &openai.ChatCompletionResponse{
+				Model: request.Model,
+				Choices: []openai.Choice{{
+					Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hello!")}},
+					FinishReason: "stop",
+				}},
+				Usage: openai.Usage{PromptTokens: 1000000, CompletionTokens: 500000, TotalTokens: 1500000},
+			}, nil
+		}
+		proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model", InputPrice: 1, OutputPrice: 4}, generate)
+		proxy.config.ApiKeys = []ApiKey{{Name: "search", Key: "key-1"}}
+		proxy.indexApiKeys()
+		core, logs := observer.New(zapcore.InfoLevel)
+		proxy.accessLogger = zap.New(core)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v1/chat/completions", proxy.HandleAuthentication(proxy.HandleChatCompletions))
+		mux.HandleFunc("POST /v1/completions", proxy.HandleAuthentication(proxy.HandleCompletions))
+		mux.HandleFunc("GET /ready", proxy.HandleReadiness)
+		return proxy.AccessLogMiddleware(mux), logs
+	}
+	send := func(handler http.Handler, path string, apiKey string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+apiKey)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("Logs the served request", func(t *testing.T) {
+		handler, logs := newServer(t)
+
+		recorder := send(handler, "/v1/chat/completions", "key-1", `{"model": "fake-model", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		entries := logs.All()
+		assert.Len(t, entries, 1)
+		assert.Equal(t, "access", entries[0].Message)
+		fields := entries[0].ContextMap()
+		assert.Equal(t, recorder.Header().Get("X-Ogem-Request-Id"), fields["request_id"])
+		assert.NotEmpty(t, fields["request_id"])
+		assert.Equal(t, "POST", fields["method"])
+		assert.Equal(t, "/v1/chat/completions", fields["path"])
+		assert.Equal(t, int64(http.StatusOK), fields["status"])
+		assert.Equal(t, int64(recorder.Body.Len()), fields["bytes"])
+		assert.Contains(t, fields, "duration_ms")
+		assert.Equal(t, "192.0.2.1", fields["client_ip"])
+		assert.Equal(t, "search", fields["api_key"])
+		assert.Equal(t, "fake-model", fields["requested_model"])
+		assert.Equal(t, "fake-model", fields["served_model"])
+		assert.Equal(t, "fake", fields["provider"])
+		assert.Equal(t, "fake", fields["region"])
+		assert.Equal(t, int32(1000000), fields["prompt_tokens"])
+		assert.Equal(t, int32(500000), fields["completion_tokens"])
+		assert.Equal(t, float64(3), fields["cost"])
+		assert.Equal(t, int64(0), fields["queue_ms"])
+		assert.Equal(t, "miss", fields["cache"])
+		assert.NotContains(t, fields, "error_class")
+		assert.NotContains(t, fields, "ttft_ms")
+	})
+
+	t.Run("Logs the rejected request", func(t *testing.T) {
+		handler, logs := newServer(t)
+
+		recorder := send(handler, "/v1/chat/completions", "wrong-key", `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		entries := logs.All()
+		assert.Len(t, entries, 1)
+		fields := entries[0].ContextMap()
+		assert.Equal(t, int64(http.StatusUnauthorized), fields["status"])
+		assert.Equal(t, "unauthorized", fields["error_class"])
+		assert.Equal(t, "", fields["api_key"])
+		assert.Equal(t, "", fields["request_id"])
+		assert.Equal(t, "192.0.2.1", fields["client_ip"])
+		assert.NotContains(t, fields, "requested_model")
+		assert.NotContains(t, fields, "cache")
+	})
+
+	t.Run("Logs the streamed request at its end", func(t *testing.T) {
+		handler, logs := newServer(t)
+
+		recorder := send(handler, "/v1/completions", "key-1", `{"model": "fake-model", "prompt": "Hi", "stream": true}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.True(t, strings.HasSuffix(recorder.Body.String(), "data: [DONE]\n\n"))
+
+		entries := logs.All()
+		assert.Len(t, entries, 1)
+		fields := entries[0].ContextMap()
+		assert.Equal(t, "/v1/completions", fields["path"])
+		assert.Equal(t, int64(http.StatusOK), fields["status"])
+		assert.Equal(t, int64(recorder.Body.Len()), fields["bytes"])
+		assert.Equal(t, "search", fields["api_key"])
+		assert.Equal(t, "fake-model", fields["served_model"])
+		assert.Equal(t, "disabled", fields["cache"])
+		assert.Contains(t, fields, "ttft_ms")
+		assert.LessOrEqual(t, fields["ttft_ms"], fields["duration_ms"])
+	})
+
+	t.Run("Ignores the requests outside the API", func(t *testing.T) {
+		handler, logs := newServer(t)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+		assert.Empty(t, logs.All())
+	})
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+// Default number of completed requests kept for the activity endpoints.
+const defaultActivityBufferSize = 1000
+
+const (
+	requestInFlight = "in-flight"
+	requestSuccess  = "success"
+	requestError    = "error"
+)
+
+type RequestActivity struct {
+	// Also returned to the caller in the X-Ogem-Request-Id header.
+	Id string `json:"id"`
+
+	// Name of the API key that sent the request. Empty if authentication is
+	// disabled.
+	ApiKey string `json:"api_key,omitempty"`
+
+	// Address of the client, resolved through the trusted proxies.
+	ClientIp string `json:"client_ip,omitempty"`
+
+	// Model or fallback chain requested by the caller.
+	RequestedModel string `json:"requested_model"`
+
+	// Concrete "provider/region/model" that served the request. Empty until
+	// it is served, and for cached responses.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	StartTime  time.Time `json:"start_time"`
+	DurationMs int64     `json:"duration_ms"`
+
+	// Either in-flight, success or error.
+	Status string `json:"status"`
+
+	// Kind of the error, such as bad_request or unavailable, and its message.
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	PromptTokens     int32 `json:"prompt_tokens,omitempty"`
+	CompletionTokens int32 `json:"completion_tokens,omitempty"`
+
+	// Cost in the currency of the model prices. Zero if the model is unpriced.
+	Cost float64 `json:"cost,omitempty"`
+
+	// Whether the response was served from the cache, which costs nothing,
+	// and what the tokens would have cost at the prices of the model.
+	CacheHit  bool    `json:"cache_hit,omitempty"`
+	CostSaved float64 `json:"cost_saved,omitempty"`
+
+	// Time that the request slept in the failover loop, waiting for the rate
+	// limits, the busy endpoints and the retries.
+	QueueMs int64 `json:"queue_ms,omitempty"`
+
+	// Model of the traffic split arm that the request fell on, if it asked
+	// for a split alias. E.g., openai/gpt-4.1
+	TrafficArm string `json:"traffic_arm,omitempty"`
+
+	// Whether the request mirrors a request of the caller to the shadow model,
+	// whose response is discarded.
+	Shadow bool `json:"shadow,omitempty"`
+
+	// Labels of the request, read from the configured headers and metadata
+	// keys.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type ActivityResponse struct {
+	Requests []RequestActivity `json:"requests"`
+}
+
+// Keeps the in-flight requests and a bounded number of the recently
+// completed ones in memory, so that the admins can see what the proxy is
+// doing during an incident. Not shared between instances.
+type activityTracker struct {
+	inFlight map[string]*RequestActivity
+
+	// Ring buffer of the completed requests. next is where the next one is
+	// written, overwriting the oldest once the buffer is full.
+	completed []RequestActivity
+	next      int
+	size      int
+
+	mutex sync.Mutex
+}
+
+// Zero size uses the default.
+func newActivityTracker(size int) *activityTracker {
+	if size <= 0 {
+		size = defaultActivityBufferSize
+	}
+	return &activityTracker{
+		inFlight:  map[string]*RequestActivity{},
+		completed: make([]RequestActivity, 0, size),
+		size:      size,
+	}
+}
+
+// Records the start of a request and returns its ID.
+func (t *activityTracker) start(apiKey string, clientIp string, requestedModel string, labels map[string]string) string {
+	return t.track(&RequestActivity{
+		Id:             uuid.New().String(),
+		ApiKey:         apiKey,
+		ClientIp:       clientIp,
+		RequestedModel: requestedModel,
+		StartTime:      time.Now(),
+		Status:         requestInFlight,
+		Labels:         labels,
+	})
+}
+
+// Records the start of a shadow request and returns its ID. It has the
+// labels of the request that it mirrors.
+func (t *activityTracker) startShadow(apiKey string, clientIp string, shadowModel string, labels map[string]string) string {
+	return t.track(&RequestActivity{
+		Id:             uuid.New().String(),
+		ApiKey:         apiKey,
+		ClientIp:       clientIp,
+		RequestedModel: shadowModel,
+		StartTime:      time.Now(),
+		Status:         requestInFlight,
+		Shadow:         true,
+		Labels:         labels,
+	})
+}
+
+func (t *activityTracker) track(activity *RequestActivity) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inFlight[activity.Id] = activity
+	return activity.Id
+}
+
+// Updates the request while it is in flight. Does nothing if it is not.
+func (t *activityTracker) annotate(id string, update func(activity *RequestActivity)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if activity, found := t.inFlight[id]; found {
+		update(activity)
+	}
+}
+
+// Moves the request to the completed ones and returns it. The update fills
+// in the result. Returns false if the request is not in flight.
+func (t *activityTracker) finish(id string, update func(activity *RequestActivity)) (RequestActivity, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	activity, found := t.inFlight[id]
+	if !found {
+		return RequestActivity{}, false
+	}
+	delete(t.inFlight, id)
+
+	activity.DurationMs = time.Since(activity.StartTime).Milliseconds()
+	update(activity)
+	if len(t.completed) < t.size {
+		t.completed = append(t.completed, *activity)
+	} else {
+		t.completed[t.next] = *activity
+	}
+	t.next = (t.next + 1) % t.size
+	return *activity, true
+}
+
+// Returns up to limit requests of the status, or of any status if empty,
+// from the most recent. The in-flight requests come first, with their
+// duration so far. Zero limit returns all of them. A label, formatted as
+// name=value, only returns the requests that have it.
+func (t *activityTracker) list(status string, label string, limit int) []RequestActivity {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	activities := []RequestActivity{}
+	add := func(activity RequestActivity) bool {
+		if (status == "" || activity.Status == status) && (label == "" || matchesLabel(activity.Labels, label)) {
+			activities = append(activities, activity)
+		}
+		return limit > 0 && len(activities) >= limit
+	}
+
+	if status == "" || status == requestInFlight {
+		inFlight := make([]RequestActivity, 0, len(t.inFlight))
+		for _, activity := range t.inFlight {
+			current := *activity
+			current.DurationMs = time.Since(activity.StartTime).Milliseconds()
+			inFlight = append(inFlight, current)
+		}
+		sort.Slice(inFlight, func(i, j int) bool {
+			return inFlight[i].StartTime.After(inFlight[j].StartTime)
+		})
+		for _, activity := range inFlight {
+			if add(activity) {
+				return activities
+			}
+		}
+	}
+
+	for offset := 1; offset <= len(t.completed); offset++ {
+		index := (t.next - offset + len(t.completed)) % len(t.completed)
+		if add(t.completed[index]) {
+			return activities
+		}
+	}
+	return activities
+}
+
+// Returns the kind of the error for the activity endpoints.
+func errorClass(err error) string {
+	switch err.(type) {
+	case BadRequestError:
+		return "bad_request"
+	case UnavailableError:
+		return "unavailable"
+	case RateLimitError:
+		return "rate_limited"
+	case RequestTimeoutError:
+		return "timeout"
+	default:
+		return "internal"
+	}
+}
+
+// Records the result of the chat completion request with the ID, and returns
+// the completed request.
+func (s *ModelProxy) finishActivity(id string, resolvedModel string, response *openai.ChatCompletionResponse, err error) RequestActivity {
+	var served *ogem.SupportedModel
+	if response != nil && resolvedModel != "" {
+		served = s.servedModel(resolvedModel)
+	}
+
+	activity, _ := s.activity.finish(id, func(activity *RequestActivity) {
+		if response == nil {
+			if err == nil {
+				err = errors.New("no response")
+			}
+			activity.Status = requestError
+			activity.ErrorClass = errorClass(err)
+			activity.Error = err.Error()
+			return
+		}
+		activity.Status = requestSuccess
+		activity.Endpoint = resolvedModel
+		activity.PromptTokens = response.Usage.PromptTokens
+		activity.CompletionTokens = response.Usage.CompletionTokens
+		// Cached responses cost nothing.
+		if resolvedModel != "" {
+			activity.Cost = responseCost(served, response.Usage)
+		}
+	})
+	return activity
+}
+
+// Returns the model of the "provider/region/model" that served a request.
+// Nil if it is no longer configured.
+func (s *ModelProxy) servedModel(resolvedModel string) *ogem.SupportedModel {
+	endpointProvider, endpointRegion, modelName, err := parseModelIdentifier(resolvedModel)
+	if err != nil {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var served *ogem.SupportedModel
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, _ ogem.RegionStatus, models []*ogem.SupportedModel) bool {
+		if provider != endpointProvider || region != endpointRegion {
+			return false
+		}
+		for _, model := range models {
+			if model.Name == modelName {
+				served = model
+				return true
+			}
+		}
+		return false
+	})
+	return served
+}
+
+// Lists the in-flight and recently completed chat completion requests. The
+// status query parameter filters them by in-flight, success or error, label
+// by a label formatted as name=value, and limit caps their number.
+func (s *ModelProxy) HandleRequestActivity(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	status := httpRequest.URL.Query().Get("status")
+	if status != "" && status != requestInFlight && status != requestSuccess && status != requestError {
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request: status must be in-flight, success or error")
+		return
+	}
+	s.writeActivity(httpResponse, httpRequest, status)
+}
+
+// Lists the recent failed chat completion requests, from the most recent.
+func (s *ModelProxy) HandleRecentErrors(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	s.writeActivity(httpResponse, httpRequest, requestError)
+}
+
+func (s *ModelProxy) writeActivity(httpResponse http.ResponseWriter, httpRequest *http.Request, status string) {
+	limit := 0
+	if value := httpRequest.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request: limit must be a non-negative integer")
+			return
+		}
+	}
+
+	label := httpRequest.URL.Query().Get("label")
+	if label != "" && !strings.Contains(label, "=") {
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request: label must be formatted as name=value")
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(ActivityResponse{Requests: s.activity.list(status, label, limit)}); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestRequestActivity(t *testing.T) {
+	release := make(chan struct{})
+	proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model", InputPrice: 2, OutputPrice: 10}, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		<-release
+		return &openai.ChatCompletionResponse{
+			Model:   request.Model,
+			Choices: []openai.Choice{{FinishReason: "stop"}},
+			Usage:   openai.Usage{PromptTokens: 1000, CompletionTokens: 100, TotalTokens: 1100},
+		}, nil
+	})
+
+	listActivity := func(path string) (int, []RequestActivity) {
+		recorder := httptest.NewRecorder()
+		handler := proxy.HandleRequestActivity
+		if strings.HasPrefix(path, "/v1/admin/errors/recent") {
+			handler = proxy.HandleRecentErrors
+		}
+		handler(recorder, httptest.NewRequest("GET", path, nil))
+		var response ActivityResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response.Requests
+	}
+	chatCompletions := func(model string) *httptest.ResponseRecorder {
+		body := `{"model": "` + model + `", "messages": [{"role": "user", "content": "Hi"}]}`
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder
+	}
+
+	t.Run("Tracks a slow request from in-flight to success", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- chatCompletions("fake-model")
+		}()
+
+		var inFlight []RequestActivity
+		assert.Eventually(t, func() bool {
+			_, inFlight = listActivity("/v1/admin/requests?status=in-flight")
+			return len(inFlight) == 1
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, "fake-model", inFlight[0].RequestedModel)
+		assert.Equal(t, requestInFlight, inFlight[0].Status)
+		id := inFlight[0].Id
+
+		close(release)
+		recorder := <-done
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, id, recorder.Header().Get("X-Ogem-Request-Id"))
+
+		_, inFlight = listActivity("/v1/admin/requests?status=in-flight")
+		assert.Empty(t, inFlight)
+		status, succeeded := listActivity("/v1/admin/requests?status=success")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, succeeded, 1)
+		assert.Equal(t, id, succeeded[0].Id)
+		assert.Equal(t, "fake/fake/fake-model", succeeded[0].Endpoint)
+		assert.Equal(t, int32(1000), succeeded[0].PromptTokens)
+		assert.Equal(t, int32(100), succeeded[0].CompletionTokens)
+		assert.InDelta(t, 0.003, succeeded[0].Cost, 1e-9)
+	})
+
+	t.Run("Lists the recent errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, chatCompletions("unknown/model/name/x").Code)
+
+		_, failed := listActivity("/v1/admin/errors/recent")
+		assert.Len(t, failed, 1)
+		assert.Equal(t, requestError, failed[0].Status)
+		assert.Equal(t, "bad_request", failed[0].ErrorClass)
+		assert.Contains(t, failed[0].Error, "invalid model name")
+
+		_, all := listActivity("/v1/admin/requests?limit=1")
+		assert.Equal(t, failed, all)
+	})
+
+	t.Run("Rejects invalid queries", func(t *testing.T) {
+		status, _ := listActivity("/v1/admin/requests?status=done")
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = listActivity("/v1/admin/requests?limit=-1")
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = listActivity("/v1/admin/requests?label=app")
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+}
+
+func TestActivityTracker(t *testing.T) {
+	tracker := newActivityTracker(2)
+	ids := []string{}
+	for range 3 {
+		id := tracker.start("key", "192.0.2.1", "model", nil)
+		tracker.finish(id, func(activity *RequestActivity) {
+			activity.Status = requestSuccess
+		})
+		ids = append(ids, id)
+	}
+	inFlight := tracker.start("key", "192.0.2.1", "model", nil)
+
+	activities := tracker.list("", "", 0)
+	assert.Len(t, activities, 3)
+	assert.Equal(t, inFlight, activities[0].Id)
+	// The oldest completed request is dropped.
+	assert.Equal(t, ids[2], activities[1].Id)
+	assert.Equal(t, ids[1], activities[2].Id)
+
+	assert.Len(t, tracker.list(requestSuccess, "", 1), 1)
+	assert.Empty(t, tracker.list(requestError, "", 0))
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/state"
+	"github.com/yanolja/ogem/utils"
+)
+
+type ModelLimits struct {
+	Provider string `json:"provider"`
+	Region   string `json:"region"`
+	Model    string `json:"model"`
+	RateKey  string `json:"rate_key"`
+
+	// Configured limits. Zero if unlimited.
+	MaxRequestsPerMinute int `json:"rpm"`
+	MaxTokensPerMinute   int `json:"tpm"`
+
+	// Time to wait before the next request is accepted by the rate limiter.
+	WaitMs int64 `json:"wait_ms"`
+
+	// Whether the model is disabled after a quota error, and until when.
+	Disabled      bool       `json:"disabled"`
+	DisabledUntil *time.Time `json:"disabled_until,omitempty"`
+
+	// Result of the last ping of the region.
+	LatencyMs   int64     `json:"latency_ms"`
+	LastChecked time.Time `json:"last_checked"`
+
+	// Effective routing weight and priority of the region.
+	Weight   float64 `json:"weight"`
+	Priority int     `json:"priority"`
+
+	// Requests in flight to the region from this instance, for all of its
+	// models, and their limit. The limit is zero if unlimited.
+	InFlight              int `json:"in_flight"`
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// Latency objective of the model in the region. Nil if it has none.
+	Slo *SloStatus `json:"slo,omitempty"`
+}
+
+type LimitsResponse struct {
+	Models []ModelLimits `json:"models"`
+
+	// Namespace of the keys in Valkey that the limits are read from. Empty
+	// without Valkey.
+	StateNamespace string `json:"state_namespace,omitempty"`
+
+	// Connections that the requests of this instance got from the pool of
+	// each provider, by provider name.
+	Connections map[string]provider.ConnectionStats `json:"connections"`
+
+	// Time that the requests of this instance slept in the failover loop,
+	// by provider, model and kind of wait.
+	QueueWaits []QueueWaitStats `json:"queue_waits"`
+}
+
+func (s *ModelProxy) HandleLimits(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	limits, err := s.limits(httpRequest.Context())
+	if err != nil {
+		s.logger.Warnw("Failed to get limits", "error", err)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(LimitsResponse{
+		Models:         limits,
+		StateNamespace: s.stateNamespace(),
+		Connections:    provider.AllConnectionStats(),
+		QueueWaits:     s.queueWaits.snapshot(),
+	}); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+func (s *ModelProxy) stateNamespace() string {
+	if s.config.ValkeyEndpoint == "" {
+		return ""
+	}
+	if s.config.StateNamespace == "" {
+		return state.DefaultNamespace
+	}
+	return s.config.StateNamespace
+}
+
+// Returns the rate limiting state of every model, sorted by provider, region
+// and model.
+func (s *ModelProxy) limits(ctx context.Context) ([]ModelLimits, error) {
+	type regionModel struct {
+		provider    string
+		region      string
+		latency     time.Duration
+		lastChecked time.Time
+		weight      float64
+		priority    int
+		maxInFlight int
+		model       *ogem.SupportedModel
+	}
+
+	s.mutex.RLock()
+	models := []regionModel{}
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, regionStatus ogem.RegionStatus, supportedModels []*ogem.SupportedModel) bool {
+		for _, model := range supportedModels {
+			models = append(models, regionModel{
+				provider:    provider,
+				region:      region,
+				latency:     regionStatus.Latency,
+				lastChecked: regionStatus.LastChecked,
+				weight:      regionStatus.EffectiveWeight(),
+				priority:    regionStatus.Priority,
+				maxInFlight: regionStatus.MaxConcurrentRequests,
+				model:       model,
+			})
+		}
+		return false
+	})
+	s.mutex.RUnlock()
+
+	now := time.Now()
+	limits := make([]ModelLimits, 0, len(models))
+	for _, entry := range models {
+		// The rate limiter is keyed by the name that the caller used, so the
+		// longest wait among the names is the effective one.
+		var wait time.Duration
+		for _, name := range append([]string{entry.model.Name}, entry.model.OtherNames...) {
+			nameWait, err := s.stateManager.Peek(ctx, entry.provider, entry.region, name)
+			if err != nil {
+				return nil, err
+			}
+			wait = max(wait, nameWait)
+		}
+
+		modelLimits := ModelLimits{
+			Provider:              entry.provider,
+			Region:                entry.region,
+			Model:                 entry.model.Name,
+			RateKey:               entry.model.RateKey,
+			MaxRequestsPerMinute:  entry.model.MaxRequestsPerMinute,
+			MaxTokensPerMinute:    entry.model.MaxTokensPerMinute,
+			WaitMs:                wait.Milliseconds(),
+			LatencyMs:             entry.latency.Milliseconds(),
+			LastChecked:           entry.lastChecked,
+			Weight:                entry.weight,
+			Priority:              entry.priority,
+			InFlight:              s.inFlight.count(entry.provider, entry.region),
+			MaxConcurrentRequests: entry.maxInFlight,
+			Slo:                   s.slo.status(entry.provider, entry.region, entry.model),
+		}
+		// Accepting a request blocks the model for at most one request
+		// interval, so any longer wait comes from disabling it.
+		if wait > requestInterval(entry.model) {
+			modelLimits.Disabled = true
+			modelLimits.DisabledUntil = utils.ToPtr(now.Add(wait).UTC())
+		}
+		limits = append(limits, modelLimits)
+	}
+
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].Provider != limits[j].Provider {
+			return limits[i].Provider < limits[j].Provider
+		}
+		if limits[i].Region != limits[j].Region {
+			return limits[i].Region < limits[j].Region
+		}
+		return limits[i].Model < limits[j].Model
+	})
+	return limits, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestHandleLimits(t *testing.T) {
+	lastChecked := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"us": {
+				Latency:     150 * time.Millisecond,
+				LastChecked: lastChecked,
+				Priority:    2,
+				Models: []*ogem.SupportedModel{
+					{Name: "model-b", RateKey: "model-b", MaxRequestsPerMinute: 6},
+					{Name: "model-a", OtherNames: []string{"alias-a"}, RateKey: "model-a", MaxRequestsPerMinute: 60, MaxTokensPerMinute: 1000},
+				},
+			},
+		}},
+	}, &fakeEndpoint{provider: "fake", region: "us"})
+
+	ctx := context.Background()
+	// Disabled through the alias after a quota error.
+	assert.NoError(t, proxy.stateManager.Disable(ctx, "fake", "us", "alias-a", time.Minute))
+	// Rate limited by the request that was just accepted.
+	accepted, _, err := proxy.stateManager.Allow(ctx, "fake", "us", "model-b", 10*time.Second, 1)
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+
+	recorder := httptest.NewRecorder()
+	proxy.HandleLimits(recorder, httptest.NewRequest("GET", "/v1/admin/limits", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response LimitsResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Len(t, response.Models, 2)
+
+	t.Run("Disabled model", func(t *testing.T) {
+		limits := response.Models[0]
+		assert.Equal(t, "model-a", limits.Model)
+		assert.Equal(t, 60, limits.MaxRequestsPerMinute)
+		assert.Equal(t, 1000, limits.MaxTokensPerMinute)
+		assert.True(t, limits.Disabled)
+		assert.NotNil(t, limits.DisabledUntil)
+		assert.InDelta(t, time.Minute.Milliseconds(), limits.WaitMs, 1000)
+		assert.Equal(t, int64(150), limits.LatencyMs)
+		assert.Equal(t, lastChecked, limits.LastChecked)
+		assert.Equal(t, 1.0, limits.Weight)
+		assert.Equal(t, 2, limits.Priority)
+	})
+
+	t.Run("Rate limited model", func(t *testing.T) {
+		limits := response.Models[1]
+		assert.Equal(t, "model-b", limits.Model)
+		assert.False(t, limits.Disabled)
+		assert.Nil(t, limits.DisabledUntil)
+		assert.InDelta(t, (10 * time.Second).Milliseconds(), limits.WaitMs, 1000)
+	})
+
+	t.Run("State namespace", func(t *testing.T) {
+		assert.Empty(t, response.StateNamespace)
+
+		proxy.config.ValkeyEndpoint = "localhost:6379"
+		assert.Equal(t, "ogem", proxy.stateNamespace())
+		proxy.config.StateNamespace = "prod-eu"
+		assert.Equal(t, "prod-eu", proxy.stateNamespace())
+	})
+}
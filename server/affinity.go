@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+type sessionContextKey struct{}
+
+// Endpoint that served the last request of a session.
+type sessionAffinity struct {
+	Provider string `json:"provider"`
+	Region   string `json:"region"`
+
+	// The memory state manager may return expired cache entries, so the
+	// expiry is stored with the value.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Returns the session key of the request. The X-Ogem-Session header takes
+// precedence over the user field of the request.
+func sessionKey(httpRequest *http.Request, user *string) string {
+	if session := httpRequest.Header.Get("X-Ogem-Session"); session != "" {
+		return session
+	}
+	if user != nil {
+		return *user
+	}
+	return ""
+}
+
+func withSession(ctx context.Context, session string) context.Context {
+	if session == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+func sessionFrom(ctx context.Context) string {
+	session, _ := ctx.Value(sessionContextKey{}).(string)
+	return session
+}
+
+func affinityCacheKey(session string, model string) string {
+	hash := sha256.Sum256([]byte(session))
+	return fmt.Sprintf("affinity:%s:%s", hex.EncodeToString(hash[:]), model)
+}
+
+// Moves the endpoint that served the previous request of the session to the
+// front, keeping the order of the others. Does nothing if session affinity is
+// disabled, the request has no session or the affinity has expired.
+func (s *ModelProxy) preferSessionEndpoint(ctx context.Context, model string, endpoints []*endpointStatus) []*endpointStatus {
+	session := sessionFrom(ctx)
+	if !s.config.SessionAffinity || session == "" {
+		return endpoints
+	}
+
+	data, err := s.stateManager.LoadCache(ctx, affinityCacheKey(session, model))
+	if err != nil {
+		s.logger.Warnw("Failed to load session affinity", "error", err)
+		return endpoints
+	}
+	if data == nil {
+		return endpoints
+	}
+	var affinity sessionAffinity
+	if err := json.Unmarshal(data, &affinity); err != nil {
+		s.logger.Warnw("Failed to unmarshal session affinity", "error", err)
+		return endpoints
+	}
+	if time.Now().After(affinity.ExpiresAt) {
+		return endpoints
+	}
+
+	for index, endpoint := range endpoints {
+		if endpoint.endpoint.Provider() != affinity.Provider || endpoint.endpoint.Region() != affinity.Region {
+			continue
+		}
+		preferred := make([]*endpointStatus, 0, len(endpoints))
+		preferred = append(preferred, endpoint)
+		preferred = append(preferred, endpoints[:index]...)
+		return append(preferred, endpoints[index+1:]...)
+	}
+	return endpoints
+}
+
+// Records the endpoint that served the request of the session. Every request
+// extends the affinity by the TTL.
+func (s *ModelProxy) storeSessionEndpoint(ctx context.Context, model string, endpoint *endpointStatus) {
+	session := sessionFrom(ctx)
+	if !s.config.SessionAffinity || session == "" {
+		return
+	}
+
+	data, err := json.Marshal(sessionAffinity{
+		Provider:  endpoint.endpoint.Provider(),
+		Region:    endpoint.endpoint.Region(),
+		ExpiresAt: time.Now().Add(s.affinityTtl),
+	})
+	if err != nil {
+		s.logger.Warnw("Failed to marshal session affinity", "error", err)
+		return
+	}
+	if err := s.stateManager.SaveCache(ctx, affinityCacheKey(session, model), data, s.affinityTtl); err != nil {
+		s.logger.Warnw("Failed to store session affinity", "error", err)
+	}
+}
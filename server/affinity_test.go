@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestSessionAffinity(t *testing.T) {
+	newProxy := func(t *testing.T) *ModelProxy {
+		// Allows back-to-back requests so that the rate limiter does not move
+		// the session.
+		models := []*ogem.SupportedModel{{Name: "fake-model", MaxRequestsPerMinute: 600_000_000}}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"fake": {Regions: map[string]*ogem.RegionStatus{
+				"fast": {Latency: 10 * time.Millisecond, LastChecked: time.Now(), Models: models},
+				"slow": {Latency: 20 * time.Millisecond, LastChecked: time.Now(), Models: models},
+			}},
+		}, &fakeEndpoint{provider: "fake", region: "fast"}, &fakeEndpoint{provider: "fake", region: "slow"})
+		proxy.config.SessionAffinity = true
+		proxy.affinityTtl = time.Minute
+		return proxy
+	}
+
+	// Returns the endpoint that served the request.
+	chatCompletions := func(proxy *ModelProxy, session string, user string) string {
+		body := `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]`
+		if user != "" {
+			body += `, "user": "` + user + `"`
+		}
+		headers := map[string]string{}
+		if session != "" {
+			headers["X-Ogem-Session"] = session
+		}
+		recorder := sendChatCompletions(proxy, body+"}", headers, nil)
+		return recorder.Header().Get("X-Ogem-Resolved-Model")
+	}
+
+	ctx := context.Background()
+
+	t.Run("Sticks to the endpoint of the session", func(t *testing.T) {
+		proxy := newProxy(t)
+
+		// The fast endpoint is busy for the first request of the session.
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", time.Minute)
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "session-1", ""))
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", 0)
+
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "session-1", ""))
+		assert.Equal(t, "fake/fast/fake-model", chatCompletions(proxy, "session-2", ""))
+		assert.Equal(t, "fake/fast/fake-model", chatCompletions(proxy, "", ""))
+	})
+
+	t.Run("Uses the user field as the session", func(t *testing.T) {
+		proxy := newProxy(t)
+
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", time.Minute)
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "", "user-1"))
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", 0)
+
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "", "user-1"))
+	})
+
+	t.Run("Fails over when the endpoint is unavailable", func(t *testing.T) {
+		proxy := newProxy(t)
+
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", time.Minute)
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "session", ""))
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", 0)
+
+		proxy.stateManager.Disable(ctx, "fake", "slow", "fake-model", time.Minute)
+		assert.Equal(t, "fake/fast/fake-model", chatCompletions(proxy, "session", ""))
+		proxy.stateManager.Disable(ctx, "fake", "slow", "fake-model", 0)
+
+		// The session moved to the endpoint that served it last.
+		assert.Equal(t, "fake/fast/fake-model", chatCompletions(proxy, "session", ""))
+	})
+
+	t.Run("Forgets the endpoint after the TTL", func(t *testing.T) {
+		proxy := newProxy(t)
+		proxy.affinityTtl = 20 * time.Millisecond
+
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", time.Minute)
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "session", ""))
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", 0)
+
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, "fake/fast/fake-model", chatCompletions(proxy, "session", ""))
+	})
+
+	t.Run("Ignores sessions when disabled", func(t *testing.T) {
+		proxy := newProxy(t)
+		proxy.config.SessionAffinity = false
+
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", time.Minute)
+		assert.Equal(t, "fake/slow/fake-model", chatCompletions(proxy, "session", ""))
+		proxy.stateManager.Disable(ctx, "fake", "fast", "fake-model", 0)
+
+		assert.Equal(t, "fake/fast/fake-model", chatCompletions(proxy, "session", ""))
+	})
+}
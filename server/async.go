@@ -0,0 +1,628 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+type AsyncConfig struct {
+	// Whether to accept the async requests.
+	Enabled bool `yaml:"enabled"`
+
+	// Number of the jobs run at a time. Defaults to 4.
+	Workers int `yaml:"workers"`
+
+	// Number of the jobs that wait for a worker, beyond which new jobs are
+	// rejected with 429. Defaults to 100.
+	QueueSize int `yaml:"queue_size"`
+
+	// Time to keep a job after it is created. E.g., 24h
+	JobTtl string `yaml:"job_ttl"`
+
+	// Secret to sign the callbacks when authentication is disabled. With API
+	// keys, the callback_secret of the key is used instead.
+	CallbackSecret string `yaml:"callback_secret"`
+
+	// Hosts of the callback URLs that may be on the proxy itself or in a
+	// private network, such as a receiver next to the proxy. The others
+	// cannot reach the loopback, private, and link-local addresses, which
+	// include the metadata services of the clouds.
+	CallbackAllowedHosts []string `yaml:"callback_allowed_hosts"`
+}
+
+const (
+	defaultAsyncWorkers   = 4
+	defaultAsyncQueueSize = 100
+	defaultAsyncJobTtl    = 24 * time.Hour
+
+	// Maximum time of a job, including its waits for the rate limits.
+	asyncJobTimeout = 10 * time.Minute
+
+	// Number of the deliveries of a callback before giving up, and the wait
+	// before the second one, which doubles for each retry.
+	asyncCallbackAttempts       = 3
+	asyncCallbackInitialBackoff = time.Second
+
+	// Maximum times to record the result of a job and to deliver its
+	// callback, which do not count against the timeout of the job.
+	asyncSaveTimeout     = 10 * time.Second
+	asyncCallbackTimeout = 2 * time.Minute
+)
+
+const (
+	asyncJobQueued    = "queued"
+	asyncJobRunning   = "running"
+	asyncJobSucceeded = "succeeded"
+	asyncJobFailed    = "failed"
+)
+
+const (
+	asyncCallbackPending   = "pending"
+	asyncCallbackDelivered = "delivered"
+	asyncCallbackFailed    = "failed"
+)
+
+// Chat completion request run in the background, as returned by the job
+// endpoint and posted to the callback URL.
+type AsyncJob struct {
+	Id string `json:"id"`
+
+	// Either queued, running, succeeded or failed.
+	Status string `json:"status"`
+
+	// Model or fallback chain requested by the caller.
+	Model string `json:"model"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	// Time from the start to the completion of the request.
+	DurationMs int64 `json:"duration_ms,omitempty"`
+
+	// Concrete "provider/region/model" that served the request, as in the
+	// X-Ogem-Resolved-Model header.
+	ResolvedModel string `json:"resolved_model,omitempty"`
+
+	// Status of the request had it been sent synchronously, and the response
+	// or the error it would have returned.
+	StatusCode int                            `json:"status_code,omitempty"`
+	Response   *openai.ChatCompletionResponse `json:"response,omitempty"`
+	Usage      *openai.Usage                  `json:"usage,omitempty"`
+	Error      *openai.Error                  `json:"error,omitempty"`
+
+	Callback *AsyncCallback `json:"callback,omitempty"`
+}
+
+type AsyncCallback struct {
+	Url string `json:"url"`
+
+	// Either pending, delivered or failed.
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Job as stored in the state manager, with the key that created it, so that
+// the other keys cannot see it.
+type asyncJobRecord struct {
+	// Hash of the secret of the API key. Empty if authentication is disabled.
+	Owner string   `json:"owner"`
+	Job   AsyncJob `json:"job"`
+}
+
+type asyncTask struct {
+	record asyncJobRecord
+
+	// Context of the request without its cancellation, which keeps the API
+	// key and the client address for the pipeline.
+	ctx    context.Context
+	body   []byte
+	header http.Header
+
+	// Secret to sign the callback. Empty if there is no callback.
+	callbackSecret string
+}
+
+// Runs the async jobs on a bounded number of workers. Nil if async requests
+// are disabled.
+type asyncQueue struct {
+	workers int
+	jobTtl  time.Duration
+
+	// Holds a value for each job that is queued or running, so that the
+	// tasks channel never blocks.
+	slots chan struct{}
+	tasks chan *asyncTask
+
+	allowedCallbackHosts map[string]bool
+	callbackBackoff      time.Duration
+	httpClient           *http.Client
+
+	running sync.WaitGroup
+	cancel  context.CancelFunc
+}
+
+func newAsyncQueue(config AsyncConfig) *asyncQueue {
+	if !config.Enabled {
+		return nil
+	}
+	workers := defaultAsyncWorkers
+	if config.Workers > 0 {
+		workers = config.Workers
+	}
+	queueSize := defaultAsyncQueueSize
+	if config.QueueSize > 0 {
+		queueSize = config.QueueSize
+	}
+	jobTtl := defaultAsyncJobTtl
+	if config.JobTtl != "" {
+		// Validated with the config.
+		jobTtl, _ = time.ParseDuration(config.JobTtl)
+	}
+	allowedCallbackHosts := make(map[string]bool, len(config.CallbackAllowedHosts))
+	for _, host := range config.CallbackAllowedHosts {
+		allowedCallbackHosts[strings.ToLower(host)] = true
+	}
+	return &asyncQueue{
+		workers:              workers,
+		jobTtl:               jobTtl,
+		slots:                make(chan struct{}, workers+queueSize),
+		tasks:                make(chan *asyncTask, workers+queueSize),
+		allowedCallbackHosts: allowedCallbackHosts,
+		callbackBackoff:      asyncCallbackInitialBackoff,
+		httpClient:           newCallbackClient(allowedCallbackHosts),
+	}
+}
+
+// Returns the client of the callbacks, which connects to the hosts that are
+// not allowed only if they resolve to public addresses. The addresses are
+// checked when connecting rather than when the job is submitted, so that a
+// host cannot resolve to another address by then, and so are the redirects.
+func newCallbackClient(allowedHosts map[string]bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The callbacks are not sent through the proxy of the environment, whose
+	// address would be checked instead.
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if allowedHosts[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, address)
+		}
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, resolved := range addresses {
+			if isInternalAddress(resolved.IP) {
+				return nil, fmt.Errorf("callback host %s resolves to the internal address %s", host, resolved.IP)
+			}
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addresses[0].IP.String(), port))
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
+// Whether the address is of the proxy itself or of a private network,
+// including the link-local metadata services of the clouds.
+func isInternalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// Starts the workers, each running the jobs with run one at a time.
+func (q *asyncQueue) start(run func(task *asyncTask)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	for range q.workers {
+		q.running.Add(1)
+		go func() {
+			defer q.running.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case task := <-q.tasks:
+					run(task)
+					<-q.slots
+				}
+			}
+		}()
+	}
+}
+
+// Queues the task. False if every worker is busy and the queue is full.
+func (q *asyncQueue) submit(task *asyncTask) bool {
+	select {
+	case q.slots <- struct{}{}:
+		q.tasks <- task
+		return true
+	default:
+		return false
+	}
+}
+
+// Stops the workers after their current jobs. Queued jobs are not run, and
+// stay queued until they expire.
+func (q *asyncQueue) shutdown() {
+	if q == nil || q.cancel == nil {
+		return
+	}
+	q.cancel()
+	q.running.Wait()
+}
+
+// Whether the request asks to run in the background with the X-Ogem-Async
+// header.
+func wantsAsync(httpRequest *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(httpRequest.Header.Get("X-Ogem-Async")), "true")
+}
+
+// Identifies the key that authenticated the request by the hash of its
+// secret, which unlike the name is unique.
+func keyOwner(ctx context.Context) string {
+	apiKey, found := apiKeyFrom(ctx)
+	if !found {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(apiKey.Key))
+	return hex.EncodeToString(hash[:])
+}
+
+func asyncJobKey(id string) string {
+	return "async_job:" + id
+}
+
+// Signs the callback body with the timestamp, so that a receiver can check
+// that it comes from the proxy and reject replays of old callbacks.
+func signCallback(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the callback URL from the X-Ogem-Callback-Url header, which takes
+// precedence, or the ogem_callback_url field of the body. Empty if there is
+// none. The URLs of the internal addresses are rejected unless their host is
+// allowed. Those of the other hosts are checked again when connecting.
+func parseCallbackUrl(httpRequest *http.Request, fields ogemExtensionFields, allowedHosts map[string]bool) (string, error) {
+	callbackUrl := strings.TrimSpace(fields.CallbackUrl)
+	if header := httpRequest.Header.Get("X-Ogem-Callback-Url"); header != "" {
+		callbackUrl = strings.TrimSpace(header)
+	}
+	if callbackUrl == "" {
+		return "", nil
+	}
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("callback URL must be an absolute http or https URL: %s", callbackUrl)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if allowedHosts[host] {
+		return callbackUrl, nil
+	}
+	if ip := net.ParseIP(host); host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && isInternalAddress(ip)) {
+		return "", fmt.Errorf("callback URL must not point to an internal address: %s", callbackUrl)
+	}
+	return callbackUrl, nil
+}
+
+func (s *ModelProxy) saveAsyncJob(ctx context.Context, record asyncJobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal async job: %v", err)
+	}
+	return s.stateManager.SaveCache(ctx, asyncJobKey(record.Job.Id), data, s.async.jobTtl)
+}
+
+// Returns nil if the job does not exist or has expired.
+func (s *ModelProxy) loadAsyncJob(ctx context.Context, id string) (*asyncJobRecord, error) {
+	data, err := s.stateManager.LoadCache(ctx, asyncJobKey(id))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var record asyncJobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse async job: %v", err)
+	}
+	return &record, nil
+}
+
+// Queues the chat completion request and responds with 202 and the job at
+// once. The request runs through the same pipeline as the synchronous ones.
+func (s *ModelProxy) HandleAsyncChatCompletions(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+
+	if s.async == nil {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "async_disabled", "Async requests are not enabled")
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+	var openAiRequest openai.ChatCompletionRequest
+	if err := json.Unmarshal(bodyBytes, &openAiRequest); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err, "body", string(bodyBytes))
+		writeBodyError(httpResponse, err)
+		return
+	}
+	if openAiRequest.Stream != nil && *openAiRequest.Stream {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("async requests cannot be streamed")})
+		return
+	}
+
+	fields, err := parseExtensionFields(bodyBytes)
+	if err != nil {
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+	callbackUrl, err := parseCallbackUrl(httpRequest, fields, s.async.allowedCallbackHosts)
+	if err != nil {
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+	callbackSecret := s.config.Async.CallbackSecret
+	if apiKey, found := apiKeyFrom(httpRequest.Context()); found {
+		callbackSecret = apiKey.CallbackSecret
+	}
+	if callbackUrl != "" && callbackSecret == "" {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("callbacks need a callback secret for the API key")})
+		return
+	}
+
+	job := AsyncJob{
+		Id:        "job-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Status:    asyncJobQueued,
+		Model:     openAiRequest.Model,
+		CreatedAt: time.Now().UTC(),
+	}
+	if callbackUrl != "" {
+		job.Callback = &AsyncCallback{Url: callbackUrl, Status: asyncCallbackPending}
+	}
+	header := httpRequest.Header.Clone()
+	header.Del("X-Ogem-Async")
+	// The job outlives the request, whose access log line is written once it
+	// is accepted.
+	ctx := withAccessRecord(context.WithoutCancel(httpRequest.Context()), nil)
+	task := &asyncTask{
+		record:         asyncJobRecord{Owner: keyOwner(httpRequest.Context()), Job: job},
+		ctx:            ctx,
+		body:           bodyBytes,
+		header:         header,
+		callbackSecret: callbackSecret,
+	}
+
+	// Saved before it is queued, so that a worker never overwrites a later
+	// state with this one.
+	if err := s.saveAsyncJob(httpRequest.Context(), task.record); err != nil {
+		s.logger.Warnw("Failed to save async job", "error", err, "job_id", job.Id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if !s.async.submit(task) {
+		s.logger.Warnw("Rejected async job at the queue limit", "job_id", job.Id, "model", job.Model)
+		// Otherwise the job would stay queued until it expires.
+		completedAt := time.Now().UTC()
+		task.record.Job.Status = asyncJobFailed
+		task.record.Job.CompletedAt = &completedAt
+		task.record.Job.StatusCode = http.StatusTooManyRequests
+		task.record.Job.Error = &openai.Error{Message: "Too many async jobs are queued", Type: errorTypeRateLimit, Code: "async_queue_full"}
+		s.recordAsyncJob(httpRequest.Context(), task.record)
+		writeError(httpResponse, http.StatusTooManyRequests, errorTypeRateLimit, "async_queue_full", "Too many async jobs are queued")
+		return
+	}
+	s.logger.Infow("Queued async job", "job_id", job.Id, "model", job.Model, "api_key", apiKeyName(httpRequest.Context()))
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	httpResponse.Header().Set("Location", "/v1/async/jobs/"+job.Id)
+	httpResponse.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(httpResponse).Encode(job); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+	}
+}
+
+// Returns the job with the ID in the path. Jobs of the other keys are not
+// found, as are the expired ones.
+func (s *ModelProxy) HandleAsyncJob(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	if s.async == nil {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "async_disabled", "Async requests are not enabled")
+		return
+	}
+
+	id := httpRequest.PathValue("id")
+	record, err := s.loadAsyncJob(httpRequest.Context(), id)
+	if err != nil {
+		s.logger.Warnw("Failed to load async job", "error", err, "job_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if record == nil || record.Owner != keyOwner(httpRequest.Context()) {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "job_not_found", fmt.Sprintf("No async job has the ID %q", id))
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(record.Job); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Runs the job on a worker, records its result, and delivers the callback.
+func (s *ModelProxy) runAsyncJob(task *asyncTask) {
+	ctx, cancel := context.WithTimeout(task.ctx, asyncJobTimeout)
+	defer cancel()
+
+	record := task.record
+	job := &record.Job
+	startedAt := time.Now().UTC()
+	job.Status = asyncJobRunning
+	job.StartedAt = &startedAt
+	s.recordAsyncJob(ctx, record)
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", bytes.NewReader(task.body))
+	if err != nil {
+		s.logger.Errorw("Failed to create async request", "error", err, "job_id", job.Id)
+		return
+	}
+	httpRequest.Header = task.header
+	response := newResponseBuffer()
+	s.HandleChatCompletions(response, httpRequest)
+
+	completedAt := time.Now().UTC()
+	job.CompletedAt = &completedAt
+	job.DurationMs = completedAt.Sub(startedAt).Milliseconds()
+	job.StatusCode = response.status
+	job.ResolvedModel = response.Header().Get("X-Ogem-Resolved-Model")
+	if response.status == http.StatusOK {
+		var completion openai.ChatCompletionResponse
+		if err := json.Unmarshal(response.body.Bytes(), &completion); err == nil {
+			job.Status = asyncJobSucceeded
+			job.Response = &completion
+			job.Usage = &completion.Usage
+		} else {
+			job.Status = asyncJobFailed
+			job.Error = &openai.Error{Message: fmt.Sprintf("failed to parse response: %v", err), Type: errorTypeServer}
+		}
+	} else {
+		job.Status = asyncJobFailed
+		var errorResponse openai.ErrorResponse
+		json.Unmarshal(response.body.Bytes(), &errorResponse)
+		job.Error = &errorResponse.Error
+	}
+	s.logger.Infow("Completed async job", "job_id", job.Id, "status", job.Status, "resolved_model", job.ResolvedModel, "duration_ms", job.DurationMs)
+
+	// The job may have used up its timeout, which must not keep its result
+	// from being recorded and delivered.
+	s.recordAsyncJob(ctx, record)
+	if job.Callback == nil {
+		return
+	}
+	callbackCtx, cancelCallback := context.WithTimeout(context.WithoutCancel(ctx), asyncCallbackTimeout)
+	defer cancelCallback()
+	s.deliverCallback(callbackCtx, job, task.callbackSecret)
+	s.recordAsyncJob(ctx, record)
+}
+
+// Saves the job regardless of the cancellation of the context, logging the
+// failure.
+func (s *ModelProxy) recordAsyncJob(ctx context.Context, record asyncJobRecord) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), asyncSaveTimeout)
+	defer cancel()
+	if err := s.saveAsyncJob(ctx, record); err != nil {
+		s.logger.Warnw("Failed to save async job", "error", err, "job_id", record.Job.Id)
+	}
+}
+
+// Posts the completed job to its callback URL, retrying with backoff on
+// errors and non-2xx statuses, and records the outcome in the job.
+func (s *ModelProxy) deliverCallback(ctx context.Context, job *AsyncJob, secret string) {
+	callback := job.Callback
+	backoff := s.async.callbackBackoff
+	for callback.Attempts < asyncCallbackAttempts {
+		if callback.Attempts > 0 {
+			select {
+			case <-ctx.Done():
+				callback.Status = asyncCallbackFailed
+				callback.Error = ctx.Err().Error()
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		callback.Attempts++
+
+		// The body is the job as delivered, so it says which attempt it is.
+		callback.Status = asyncCallbackDelivered
+		callback.Error = ""
+		body, err := json.Marshal(job)
+		if err != nil {
+			callback.Status = asyncCallbackFailed
+			callback.Error = fmt.Sprintf("failed to marshal callback: %v", err)
+			return
+		}
+		err = s.postCallback(ctx, callback.Url, secret, body)
+		if err == nil {
+			s.logger.Infow("Delivered async callback", "job_id", job.Id, "attempts", callback.Attempts)
+			return
+		}
+		callback.Status = asyncCallbackFailed
+		callback.Error = err.Error()
+		s.logger.Warnw("Failed to deliver async callback", "error", err, "job_id", job.Id, "attempt", callback.Attempts)
+	}
+}
+
+func (s *ModelProxy) postCallback(ctx context.Context, callbackUrl string, secret string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Ogem-Timestamp", timestamp)
+	request.Header.Set("X-Ogem-Signature", signCallback(secret, timestamp, body))
+
+	response, err := s.async.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("callback returned HTTP %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Collects the response of a handler that is not called by a client, such as
+// for an async job.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(data)
+}
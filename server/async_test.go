@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestAsyncJobs(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+		}},
+	}
+	body := `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	newProxy := func(t *testing.T, config AsyncConfig, endpoint *fakeEndpoint) *ModelProxy {
+		proxy := newTestProxy(t, providers, endpoint)
+		config.Enabled = true
+		proxy.config.Async = config
+		proxy.async = newAsyncQueue(config)
+		proxy.async.callbackBackoff = time.Millisecond
+		proxy.async.start(proxy.runAsyncJob)
+		t.Cleanup(proxy.async.shutdown)
+		return proxy
+	}
+
+	withKey := func(request *http.Request, apiKey ApiKey) *http.Request {
+		return request.WithContext(context.WithValue(request.Context(), apiKeyContextKey{}, apiKey))
+	}
+
+	submit := func(proxy *ModelProxy, request *http.Request) (int, AsyncJob) {
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, request)
+		var job AsyncJob
+		json.Unmarshal(recorder.Body.Bytes(), &job)
+		return recorder.Code, job
+	}
+
+	asyncRequest := func(body string) *http.Request {
+		request := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		request.Header.Set("X-Ogem-Async", "true")
+		return request
+	}
+
+	getJob := func(proxy *ModelProxy, request *http.Request, id string) (int, AsyncJob) {
+		request.SetPathValue("id", id)
+		recorder := httptest.NewRecorder()
+		proxy.HandleAsyncJob(recorder, request)
+		var job AsyncJob
+		json.Unmarshal(recorder.Body.Bytes(), &job)
+		return recorder.Code, job
+	}
+
+	// Polls the job until it is completed. The first job takes a while with
+	// the race detector.
+	waitForJob := func(t *testing.T, proxy *ModelProxy, id string) AsyncJob {
+		var job AsyncJob
+		assert.Eventually(t, func() bool {
+			_, job = getJob(proxy, httptest.NewRequest("GET", "/v1/async/jobs/"+id, nil), id)
+			return job.Status == asyncJobSucceeded || job.Status == asyncJobFailed
+		}, 10*time.Second, time.Millisecond)
+		return job
+	}
+
+	t.Run("Returns the result to polling", func(t *testing.T) {
+		proxy := newProxy(t, AsyncConfig{}, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		status, job := submit(proxy, asyncRequest(body))
+		assert.Equal(t, http.StatusAccepted, status)
+		assert.True(t, strings.HasPrefix(job.Id, "job-"))
+		assert.Equal(t, asyncJobQueued, job.Status)
+		assert.Equal(t, "fake-model", job.Model)
+
+		job = waitForJob(t, proxy, job.Id)
+		assert.Equal(t, asyncJobSucceeded, job.Status)
+		assert.Equal(t, http.StatusOK, job.StatusCode)
+		assert.Equal(t, "fake/fake/fake-model", job.ResolvedModel)
+		assert.Equal(t, "fake-model", *job.Response.Choices[0].Message.Content.String)
+		assert.NotNil(t, job.Usage)
+		assert.NotNil(t, job.StartedAt)
+		assert.NotNil(t, job.CompletedAt)
+		assert.Nil(t, job.Error)
+	})
+
+	t.Run("Records the error of a failed request", func(t *testing.T) {
+		proxy := newProxy(t, AsyncConfig{}, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		status, job := submit(proxy, asyncRequest(`{"model": "fake-model", "messages": []}`))
+		assert.Equal(t, http.StatusAccepted, status)
+
+		job = waitForJob(t, proxy, job.Id)
+		assert.Equal(t, asyncJobFailed, job.Status)
+		assert.Equal(t, http.StatusBadRequest, job.StatusCode)
+		assert.Equal(t, errorTypeInvalidRequest, job.Error.Type)
+		assert.Contains(t, job.Error.Message, "messages must not be empty")
+	})
+
+	t.Run("Scopes the jobs to the creating key", func(t *testing.T) {
+		proxy := newProxy(t, AsyncConfig{}, &fakeEndpoint{provider: "fake", region: "fake"})
+		owner := ApiKey{Name: "search-team", Key: "owner-secret"}
+
+		status, job := submit(proxy, withKey(asyncRequest(body), owner))
+		assert.Equal(t, http.StatusAccepted, status)
+
+		status, _ = getJob(proxy, withKey(httptest.NewRequest("GET", "/", nil), ApiKey{Name: "search-team", Key: "other-secret"}), job.Id)
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = getJob(proxy, withKey(httptest.NewRequest("GET", "/", nil), owner), job.Id)
+		assert.Equal(t, http.StatusOK, status)
+		status, _ = getJob(proxy, withKey(httptest.NewRequest("GET", "/", nil), owner), "job-unknown")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Delivers the signed callback", func(t *testing.T) {
+		type delivery struct {
+			body      []byte
+			timestamp string
+			signature string
+		}
+		deliveries := make(chan delivery, 3)
+		attempts := 0
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			deliveries <- delivery{body, r.Header.Get("X-Ogem-Timestamp"), r.Header.Get("X-Ogem-Signature")}
+		}))
+		t.Cleanup(receiver.Close)
+
+		// The receiver listens on the loopback address.
+		proxy := newProxy(t, AsyncConfig{CallbackAllowedHosts: []string{"127.0.0.1"}}, &fakeEndpoint{provider: "fake", region: "fake"})
+		apiKey := ApiKey{Name: "batch", Key: "batch-secret", CallbackSecret: "whsec"}
+		request := withKey(asyncRequest(`{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}], "ogem_callback_url": "`+receiver.URL+`"}`), apiKey)
+		status, job := submit(proxy, request)
+		assert.Equal(t, http.StatusAccepted, status)
+		assert.Equal(t, asyncCallbackPending, job.Callback.Status)
+
+		select {
+		case received := <-deliveries:
+			mac := hmac.New(sha256.New, []byte("whsec"))
+			mac.Write([]byte(received.timestamp + "."))
+			mac.Write(received.body)
+			assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), received.signature)
+
+			var delivered AsyncJob
+			assert.NoError(t, json.Unmarshal(received.body, &delivered))
+			assert.Equal(t, job.Id, delivered.Id)
+			assert.Equal(t, asyncJobSucceeded, delivered.Status)
+			assert.Equal(t, 2, delivered.Callback.Attempts)
+		case <-time.After(time.Second):
+			t.Fatal("callback was not delivered")
+		}
+
+		assert.Eventually(t, func() bool {
+			_, stored := getJob(proxy, withKey(httptest.NewRequest("GET", "/", nil), apiKey), job.Id)
+			return stored.Callback != nil && stored.Callback.Status == asyncCallbackDelivered
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("Rejects callbacks without a secret", func(t *testing.T) {
+		proxy := newProxy(t, AsyncConfig{}, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		request := asyncRequest(body)
+		request.Header.Set("X-Ogem-Callback-Url", "https://hooks.example.com/ogem")
+		status, _ := submit(proxy, request)
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		request = asyncRequest(body)
+		request.Header.Set("X-Ogem-Callback-Url", "file:///etc/passwd")
+		proxy.config.Async.CallbackSecret = "whsec"
+		status, _ = submit(proxy, request)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Rejects callbacks to internal addresses", func(t *testing.T) {
+		proxy := newProxy(t, AsyncConfig{CallbackSecret: "whsec"}, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		for _, callbackUrl := range []string{
+			"http://169.254.169.254/latest/meta-data",
+			"http://127.0.0.1:8080/hook",
+			"http://localhost/hook",
+			"http://10.0.0.8/hook",
+			"http://[::1]/hook",
+			"http://[fd00:ec2::254]/hook",
+		} {
+			request := asyncRequest(body)
+			request.Header.Set("X-Ogem-Callback-Url", callbackUrl)
+			status, _ := submit(proxy, request)
+			assert.Equal(t, http.StatusBadRequest, status, callbackUrl)
+		}
+	})
+
+	t.Run("Connects only to the public addresses of the hosts that are not allowed", func(t *testing.T) {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(receiver.Close)
+		// Resolves to the loopback address, as a host of the caller could.
+		callbackUrl := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+
+		_, err := newCallbackClient(nil).Post(callbackUrl, "application/json", nil)
+		assert.ErrorContains(t, err, "internal address")
+
+		response, err := newCallbackClient(map[string]bool{"localhost": true}).Post(callbackUrl, "application/json", nil)
+		assert.NoError(t, err)
+		response.Body.Close()
+	})
+
+	t.Run("Rejects jobs when the workers and the queue are full", func(t *testing.T) {
+		release := make(chan struct{})
+		endpoint := &fakeEndpoint{provider: "fake", region: "fake", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, errors.New("canceled")
+			}
+			return &openai.ChatCompletionResponse{Choices: []openai.Choice{{FinishReason: "stop"}}}, nil
+		}}
+		proxy := newProxy(t, AsyncConfig{Workers: 1, QueueSize: 1}, endpoint)
+		defer close(release)
+
+		status, _ := submit(proxy, asyncRequest(body))
+		assert.Equal(t, http.StatusAccepted, status)
+		status, _ = submit(proxy, asyncRequest(body))
+		assert.Equal(t, http.StatusAccepted, status)
+
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, asyncRequest(body))
+		assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "async_queue_full")
+	})
+
+	t.Run("Rejects async requests when disabled", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, asyncRequest(body))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "async_disabled")
+	})
+}
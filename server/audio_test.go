@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	openaiProvider "github.com/yanolja/ogem/provider/openai"
+)
+
+func TestAudio(t *testing.T) {
+	var requestBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{
+			"id": "chatcmpl-123",
+			"model": "gpt-4o-audio-preview-2024-10-01",
+			"choices": [{
+				"message": {
+					"role": "assistant",
+					"content": null,
+					"audio": {"id": "audio_abc123", "data": "SUQzBAAAAAAA", "transcript": "A dog is barking.", "expires_at": 1729018505}
+				},
+				"finish_reason": "stop"
+			}],
+			"usage": {"prompt_tokens": 40, "completion_tokens": 30, "total_tokens": 70}
+		}`))
+	}))
+	t.Cleanup(server.Close)
+
+	endpoint, err := openaiProvider.NewEndpoint("openai", "openai", server.URL, "test-key", zap.NewNop().Sugar())
+	assert.NoError(t, err)
+	t.Cleanup(func() { endpoint.Shutdown() })
+
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+			Models: []*ogem.SupportedModel{{Name: "gpt-4o-audio-preview"}},
+		}}},
+		"claude": {Regions: map[string]*ogem.RegionStatus{"claude": {
+			Models: []*ogem.SupportedModel{{Name: "claude-3-5-sonnet"}},
+		}}},
+	}, endpoint, &fakeEndpoint{provider: "claude", region: "claude"})
+
+	chatCompletions := func(body string) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder, decodeChatCompletion(recorder)
+	}
+	audioRequest := func(model string) string {
+		return `{
+			"model": "` + model + `",
+			"messages": [{"role": "user", "content": [
+				{"type": "text", "content": {"text": "What is in this recording?"}},
+				{"type": "input_audio", "content": {"data": "UklGRiQAAABXQVZF", "format": "wav"}}
+			]}],
+			"modalities": ["text", "audio"],
+			"audio": {"voice": "alloy", "format": "mp3"}
+		}`
+	}
+
+	t.Run("Passes the audio through and returns the audio output", func(t *testing.T) {
+		recorder, response := chatCompletions(audioRequest("gpt-4o-audio-preview"))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		var sent struct {
+			Messages   json.RawMessage `json:"messages"`
+			Modalities []string        `json:"modalities"`
+			Audio      json.RawMessage `json:"audio"`
+		}
+		assert.NoError(t, json.Unmarshal(requestBody, &sent))
+		assert.JSONEq(t, `[{"role": "user", "content": [
+			{"type": "text", "content": {"text": "What is in this recording?"}},
+			{"type": "input_audio", "content": {"data": "UklGRiQAAABXQVZF", "format": "wav"}}
+		]}]`, string(sent.Messages))
+		assert.Equal(t, []string{"text", "audio"}, sent.Modalities)
+		assert.JSONEq(t, `{"voice": "alloy", "format": "mp3"}`, string(sent.Audio))
+
+		assert.Equal(t, &openai.MessageAudio{
+			Id:         "audio_abc123",
+			Data:       "SUQzBAAAAAAA",
+			Transcript: "A dog is barking.",
+			ExpiresAt:  1729018505,
+		}, response.Choices[0].Message.Audio)
+	})
+
+	t.Run("Refers to an earlier audio output", func(t *testing.T) {
+		recorder, _ := chatCompletions(`{
+			"model": "gpt-4o-audio-preview",
+			"messages": [
+				{"role": "user", "content": "Describe a dog."},
+				{"role": "assistant", "content": null, "audio": {"id": "audio_abc123"}},
+				{"role": "user", "content": "Louder."}
+			]
+		}`)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Contains(t, string(requestBody), `"audio":{"id":"audio_abc123"}`)
+	})
+
+	t.Run("Rejects the audio for models without audio", func(t *testing.T) {
+		recorder, _ := chatCompletions(audioRequest("claude-3-5-sonnet"))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "missing capabilities: audio")
+	})
+}
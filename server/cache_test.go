@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestCacheStampede(t *testing.T) {
+	newProxy := func(t *testing.T, generate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)) (*ModelProxy, *fakeEndpoint) {
+		endpoint := &fakeEndpoint{provider: "openai", region: "openai", generate: generate}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+				Models: []*ogem.SupportedModel{{Name: "gpt-4o"}},
+			}}},
+		}, endpoint)
+		return proxy, endpoint
+	}
+	slowResponse := func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+		return &openai.ChatCompletionResponse{
+			Model: request.Model,
+			Choices: []openai.Choice{{
+				Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}},
+				FinishReason: "stop",
+			}},
+		}, nil
+	}
+	request := func() *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:       "gpt-4o",
+			Messages:    []openai.Message{userMessage("Hi")},
+			Temperature: utils.ToPtr(float32(0)),
+		}
+	}
+	// Sends the identical requests at once and returns their errors.
+	burst := func(proxy *ModelProxy, count int) []error {
+		errs := make([]error, count)
+		var wait sync.WaitGroup
+		for index := range count {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				response, _, err := proxy.generateChatCompletion(context.Background(), request(), false)
+				if err == nil && *response.Choices[0].Message.Content.String != "Hello" {
+					err = errors.New("unexpected response")
+				}
+				errs[index] = err
+			}()
+		}
+		wait.Wait()
+		return errs
+	}
+
+	t.Run("Calls the provider once for identical cold requests", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, slowResponse)
+
+		for _, err := range burst(proxy, 50) {
+			assert.NoError(t, err)
+		}
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Waiting requests call the provider if the first one failed", func(t *testing.T) {
+		calls := atomic.Int32{}
+		proxy, endpoint := newProxy(t, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			if calls.Add(1) == 1 {
+				time.Sleep(100 * time.Millisecond)
+				return nil, errors.New("upstream error")
+			}
+			return slowResponse(ctx, request)
+		})
+
+		failed := 0
+		for _, err := range burst(proxy, 50) {
+			if err != nil {
+				failed++
+			}
+		}
+		assert.Equal(t, 1, failed)
+		assert.Len(t, endpoint.receivedRequests(), 2)
+	})
+
+	t.Run("Stops waiting when the request is canceled", func(t *testing.T) {
+		proxy, _ := newProxy(t, slowResponse)
+		go proxy.generateChatCompletion(context.Background(), request(), false)
+		time.Sleep(20 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, _, err := proxy.generateChatCompletion(ctx, request(), false)
+		assert.IsType(t, RequestTimeoutError{}, err)
+	})
+}
+
+func TestCacheWithProviderFilter(t *testing.T) {
+	openaiEndpoint := &fakeEndpoint{provider: "openai", region: "openai"}
+	vertexEndpoint := &fakeEndpoint{provider: "vertex", region: "us-central1"}
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+			Priority: 1,
+			Models:   []*ogem.SupportedModel{{Name: "chat-openai", OtherNames: []string{"chat"}}},
+		}}},
+		"vertex": {Regions: map[string]*ogem.RegionStatus{"us-central1": {
+			Models: []*ogem.SupportedModel{{Name: "chat-vertex", OtherNames: []string{"chat"}}},
+		}}},
+	}, openaiEndpoint, vertexEndpoint)
+	request := func() *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:       "chat",
+			Messages:    []openai.Message{userMessage("Hi")},
+			Temperature: utils.ToPtr(float32(0)),
+		}
+	}
+
+	_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "openai/openai/chat-openai", resolvedModel)
+
+	// The response of OpenAI is cached, but must not be served to a request
+	// that excludes it.
+	ctx := withProviderFilter(context.Background(), providerFilter{exclude: []string{"openai"}})
+	_, resolvedModel, err = proxy.generateChatCompletion(ctx, request(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "vertex/us-central1/chat-vertex", resolvedModel)
+	assert.Len(t, openaiEndpoint.receivedRequests(), 1)
+	assert.Len(t, vertexEndpoint.receivedRequests(), 1)
+
+	// Without the filter, the cached response is served.
+	_, resolvedModel, err = proxy.generateChatCompletion(context.Background(), request(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", resolvedModel)
+	assert.Len(t, openaiEndpoint.receivedRequests(), 1)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils/array"
+)
+
+// Returns the key of the cached response of the request. Requests that differ
+// only in ways that cannot change the completion share the key: the fields
+// that only affect the delivery (stream, stream_options and user) are
+// ignored, parameters set to their default are the same as omitted ones, a
+// content of a single text part is the same as a plain string, and the order
+// of JSON object keys, such as in the tool parameters, does not matter. Like
+// every key of the state manager, it is relative to its namespace.
+//
+// Changing the output of this function invalidates every cached response, so
+// it is pinned by golden tests.
+func CanonicalCacheKey(request *openai.ChatCompletionRequest) (string, error) {
+	canonical := canonicalRequest(request)
+	requestBytes, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+
+	// Decoding into generic values and encoding again sorts the object keys,
+	// which json.Marshal does for maps, and formats every number the same
+	// way, such as 1.0 as 1.
+	var generic any
+	if err := json.Unmarshal(requestBytes, &generic); err != nil {
+		return "", err
+	}
+	canonicalBytes, err := json.Marshal(generic)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(canonicalBytes)
+	return "cache:" + hex.EncodeToString(hash[:]), nil
+}
+
+// Returns a copy of the request without the fields that do not change the
+// completion.
+func canonicalRequest(request *openai.ChatCompletionRequest) *openai.ChatCompletionRequest {
+	canonical := *request
+	canonical.Stream = nil
+	canonical.StreamOptions = nil
+	canonical.User = nil
+
+	// Defaults of the OpenAI API.
+	if canonical.CandidateCount != nil && *canonical.CandidateCount == 1 {
+		canonical.CandidateCount = nil
+	}
+	if canonical.TopP != nil && *canonical.TopP == 1 {
+		canonical.TopP = nil
+	}
+	if canonical.FrequencyPenalty != nil && *canonical.FrequencyPenalty == 0 {
+		canonical.FrequencyPenalty = nil
+	}
+	if canonical.PresencePenalty != nil && *canonical.PresencePenalty == 0 {
+		canonical.PresencePenalty = nil
+	}
+	if canonical.Logprobs != nil && !*canonical.Logprobs {
+		canonical.Logprobs = nil
+	}
+	if canonical.TopLogprobs != nil && *canonical.TopLogprobs == 0 {
+		canonical.TopLogprobs = nil
+	}
+	if canonical.StopSequences != nil && len(canonical.StopSequences.Sequences) == 0 {
+		canonical.StopSequences = nil
+	}
+
+	canonical.Messages = array.Map(request.Messages, func(message openai.Message) openai.Message {
+		if message.Content == nil || message.Content.String != nil || len(message.Content.Parts) != 1 {
+			return message
+		}
+		if text := message.Content.Parts[0].Content.TextContent; text != nil {
+			message.Content = &openai.MessageContent{String: &text.Text}
+		}
+		return message
+	})
+	return &canonical
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestCanonicalCacheKey(t *testing.T) {
+	cacheKey := func(t *testing.T, body string) string {
+		var request openai.ChatCompletionRequest
+		assert.NoError(t, json.Unmarshal([]byte(body), &request))
+		key, err := CanonicalCacheKey(&request)
+		assert.NoError(t, err)
+		return key
+	}
+
+	t.Run("Equivalent requests share the key", func(t *testing.T) {
+		for _, test := range []struct {
+			name string
+			a    string
+			b    string
+		}{
+			{
+				name: "Single text part",
+				a:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`,
+				b:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": [{"type": "text", "content": {"text": "Hi"}}]}]}`,
+			},
+			{
+				name: "Delivery fields",
+				a:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`,
+				b:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "stream": true, "stream_options": {"include_usage": true}, "user": "alice"}`,
+			},
+			{
+				name: "Explicit defaults",
+				a:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`,
+				b:    `{"model": "gpt-4o", "temperature": 0.0, "messages": [{"role": "user", "content": "Hi"}], "n": 1, "top_p": 1.0, "frequency_penalty": 0, "presence_penalty": 0, "logprobs": false, "stop": []}`,
+			},
+			{
+				name: "Order of the tool parameters",
+				a: `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "tools": [{"type": "function", "function": {"name": "search", "parameters": {
+					"type": "object", "properties": {"query": {"type": "string"}, "limit": {"type": "integer", "maximum": 10}}
+				}}}]}`,
+				b: `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "tools": [{"type": "function", "function": {"name": "search", "parameters": {
+					"properties": {"limit": {"maximum": 10.0, "type": "integer"}, "query": {"type": "string"}}, "type": "object"
+				}}}]}`,
+			},
+			{
+				name: "Order of the logit bias",
+				a:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "logit_bias": {"50256": -100, "198": 5}}`,
+				b:    `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "logit_bias": {"198": 5, "50256": -100}}`,
+			},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				assert.Equal(t, cacheKey(t, test.a), cacheKey(t, test.b))
+			})
+		}
+	})
+
+	t.Run("Different requests have different keys", func(t *testing.T) {
+		base := `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+		for _, other := range []string{
+			`{"model": "gpt-4o-mini", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi!"}]}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "system", "content": "Hi"}]}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": [{"type": "text", "content": {"text": "H"}}, {"type": "text", "content": {"text": "i"}}]}]}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "n": 2}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "top_p": 0.5}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 10}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "seed": 1}`,
+			`{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}], "response_format": {"type": "json_object"}}`,
+		} {
+			assert.NotEqual(t, cacheKey(t, base), cacheKey(t, other), other)
+		}
+
+		cat := `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": [{"type": "image_url", "content": {"url": "https://example.com/cat.png"}}]}]}`
+		assert.NotEqual(t, cacheKey(t, cat), cacheKey(t, strings.Replace(cat, "cat.png", "dog.png", 1)))
+	})
+
+	// Existing cache entries are lost whenever these change, such as by a new
+	// field of the request that is marshaled even if unset. Update them only
+	// on purpose.
+	t.Run("Golden keys", func(t *testing.T) {
+		for _, test := range []struct {
+			body string
+			key  string
+		}{
+			{
+				body: `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`,
+				key:  "cache:2dd8af9cc967d71dc2439554c6dccde61d02513302e7842368eda8538f531936",
+			},
+			{
+				body: `{"model": "gemini-1.5-flash", "temperature": 0, "max_tokens": 100, "messages": [
+					{"role": "system", "content": "Be brief."},
+					{"role": "user", "content": [{"type": "text", "content": {"text": "What is in the image?"}}, {"type": "image_url", "content": {"url": "https://example.com/cat.png"}}]}
+				]}`,
+				key: "cache:b642b78f1fe921c368d03a0ca5c2182a8ab0835a2f3b426dc1a4c2b8ca596ea8",
+			},
+			{
+				body: `{"model": "claude-3-5-sonnet", "temperature": 0, "messages": [{"role": "user", "content": "Weather?"}],
+					"tools": [{"type": "function", "function": {"name": "weather", "description": "Current weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}}}],
+					"tool_choice": "auto", "stop": ["\n\n"], "seed": 42}`,
+				key: "cache:d90dc9675986bee3aecffc79ef0bdecfb20adc2f9c921978c2ff449c5bf84230",
+			},
+		} {
+			assert.Equal(t, test.key, cacheKey(t, test.body))
+		}
+	})
+}
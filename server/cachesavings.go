@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Where a response was served from without calling a provider.
+type cacheSavingSource string
+
+const (
+	// Response cache of the requests with temperature 0.
+	cacheSavingCache cacheSavingSource = "cache"
+
+	// Stored response of an earlier request with the same Idempotency-Key.
+	cacheSavingIdempotency cacheSavingSource = "idempotency"
+)
+
+// Responses served to an API key without calling a provider, since the
+// start of this instance. They cost nothing, and CostSaved estimates what the
+// tokens would have cost at the prices of the models.
+type CacheSavingsStats struct {
+	// Empty if authentication is disabled.
+	ApiKey string            `json:"api_key"`
+	Source cacheSavingSource `json:"source"`
+
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	CostSaved        float64 `json:"cost_saved"`
+}
+
+type CacheSavingsResponse struct {
+	Savings []CacheSavingsStats `json:"savings"`
+	Tiers   CacheTierStats      `json:"tiers"`
+}
+
+type cacheSavingsKey struct {
+	apiKey string
+	source cacheSavingSource
+}
+
+// Savings of every API key on this instance. The zero value is ready to use.
+type cacheSavingsTable struct {
+	mutex sync.Mutex
+	stats map[cacheSavingsKey]*CacheSavingsStats
+}
+
+func (t *cacheSavingsTable) record(apiKey string, source cacheSavingSource, usage openai.Usage, saved float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stats == nil {
+		t.stats = map[cacheSavingsKey]*CacheSavingsStats{}
+	}
+	key := cacheSavingsKey{apiKey: apiKey, source: source}
+	stats, found := t.stats[key]
+	if !found {
+		stats = &CacheSavingsStats{ApiKey: apiKey, Source: source}
+		t.stats[key] = stats
+	}
+	stats.Requests++
+	stats.PromptTokens += int64(usage.PromptTokens)
+	stats.CompletionTokens += int64(usage.CompletionTokens)
+	stats.CostSaved += saved
+}
+
+// Returns the savings sorted by API key and source.
+func (t *cacheSavingsTable) snapshot() []CacheSavingsStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := make([]CacheSavingsStats, 0, len(t.stats))
+	for _, keyStats := range t.stats {
+		stats = append(stats, *keyStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ApiKey != stats[j].ApiKey {
+			return stats[i].ApiKey < stats[j].ApiKey
+		}
+		return stats[i].Source < stats[j].Source
+	})
+	return stats
+}
+
+type cacheSavingContextKey struct{}
+
+// Cost that a request saved by being served from the response cache, to be
+// reported in its activity.
+type cacheSaving struct {
+	mutex sync.Mutex
+	hit   bool
+	saved float64
+
+	// "provider/region/model" of the endpoint that generated the cached
+	// response.
+	model string
+}
+
+func withCacheSaving(ctx context.Context, saving *cacheSaving) context.Context {
+	return context.WithValue(ctx, cacheSavingContextKey{}, saving)
+}
+
+// Nil if the request does not report its savings. Every method of
+// cacheSaving does nothing on nil.
+func cacheSavingFrom(ctx context.Context) *cacheSaving {
+	saving, _ := ctx.Value(cacheSavingContextKey{}).(*cacheSaving)
+	return saving
+}
+
+func (c *cacheSaving) add(model string, saved float64) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.hit = true
+	c.saved += saved
+	c.model = model
+}
+
+// Whether the request was served from the cache, and the cost it saved.
+func (c *cacheSaving) result() (bool, float64) {
+	if c == nil {
+		return false, 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hit, c.saved
+}
+
+// Returns the model that generated the cached response, or an empty string
+// if the request was not served from the cache.
+func (c *cacheSaving) servedModel() string {
+	if c == nil {
+		return ""
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.model
+}
+
+// Records a response served from the cache as a request of zero cost, with
+// what it would have cost the model otherwise.
+func (s *ModelProxy) recordCacheHit(ctx context.Context, response *openai.ChatCompletionResponse, endpoint *endpointStatus) {
+	saved := responseCost(endpoint.modelStatus, response.Usage)
+	model := fmt.Sprintf("%s/%s/%s", endpoint.endpoint.Provider(), endpoint.endpoint.Region(), endpoint.modelStatus.Name)
+	cacheSavingFrom(ctx).add(model, saved)
+	s.cacheSavings.record(apiKeyName(ctx), cacheSavingCache, response.Usage, saved)
+}
+
+// Records the replay of a stored response for an Idempotency-Key. Only the
+// successful chat completions are counted, costed with the model reported in
+// their X-Ogem-Resolved-Model header.
+func (s *ModelProxy) recordIdempotentReplay(ctx context.Context, stored *idempotentResponse) {
+	if stored.Status != http.StatusOK {
+		return
+	}
+	var response openai.ChatCompletionResponse
+	if err := json.Unmarshal(stored.Body, &response); err != nil {
+		s.logger.Warnw("Failed to read usage of stored response", "error", err)
+		return
+	}
+	saved := responseCost(s.servedModel(stored.Header.Get("X-Ogem-Resolved-Model")), response.Usage)
+	s.cacheSavings.record(apiKeyName(ctx), cacheSavingIdempotency, response.Usage, saved)
+}
+
+func (s *ModelProxy) HandleCacheSavings(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	response := CacheSavingsResponse{Savings: s.cacheSavings.snapshot()}
+	response.Tiers.StateHits = s.stateCacheHits.Load()
+	response.Tiers.StateMisses = s.stateCacheMisses.Load()
+	s.localCache.addStats(&response.Tiers)
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestCacheSavings(t *testing.T) {
+	newProxy := func(t *testing.T) (*ModelProxy, *fakeEndpoint) {
+		// $0.01 per request.
+		model := &ogem.SupportedModel{Name: "gpt-4o", InputPrice: 10, OutputPrice: 10}
+		return newSingleEndpointProxy(t, "openai", model, replyWith("Hello", openai.Usage{PromptTokens: 600, CompletionTokens: 400, TotalTokens: 1000}))
+	}
+	chatCompletions := func(proxy *ModelProxy, body string, idempotencyKey string) {
+		headers := map[string]string{}
+		if idempotencyKey != "" {
+			headers["Idempotency-Key"] = idempotencyKey
+		}
+		recorder := sendChatCompletions(proxy, body, headers, &ApiKey{Name: "mobile", Key: "key-1"})
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	savings := func(proxy *ModelProxy) []CacheSavingsStats {
+		recorder := httptest.NewRecorder()
+		proxy.HandleCacheSavings(recorder, httptest.NewRequest("GET", "/v1/admin/cache-savings", nil))
+		var response CacheSavingsResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		return response.Savings
+	}
+
+	t.Run("Counts a cache hit as a request that saved its cost", func(t *testing.T) {
+		proxy, endpoint := newProxy(t)
+		proxy.endUsers = newEndUserLimiter(EndUserLimitsConfig{CostPerDay: 1})
+		body := `{"model": "gpt-4o", "temperature": 0, "user": "user-1", "messages": [{"role": "user", "content": "Hi"}]}`
+
+		chatCompletions(proxy, body, "")
+		chatCompletions(proxy, body, "")
+		assert.Len(t, endpoint.receivedRequests(), 1)
+
+		usage, err := proxy.addEndUserUsage(context.Background(), "user-1", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), usage.Requests)
+		assert.Equal(t, int64(1), usage.CacheHits)
+		assert.Equal(t, int64(1000), usage.Tokens)
+		assert.InDelta(t, 0.01, usage.Cost, 1e-9)
+		assert.InDelta(t, 0.01, usage.CostSaved, 1e-9)
+
+		recent := proxy.activity.list("", "", 2)
+		assert.True(t, recent[0].CacheHit)
+		assert.Zero(t, recent[0].Cost)
+		assert.InDelta(t, 0.01, recent[0].CostSaved, 1e-9)
+		assert.False(t, recent[1].CacheHit)
+		assert.InDelta(t, 0.01, recent[1].Cost, 1e-9)
+
+		assert.Equal(t, []CacheSavingsStats{{
+			ApiKey:           "mobile",
+			Source:           cacheSavingCache,
+			Requests:         1,
+			PromptTokens:     600,
+			CompletionTokens: 400,
+			CostSaved:        0.01,
+		}}, savings(proxy))
+	})
+
+	t.Run("Counts the idempotent replays", func(t *testing.T) {
+		proxy, endpoint := newProxy(t)
+		body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+
+		chatCompletions(proxy, body, "order-1")
+		chatCompletions(proxy, body, "order-1")
+		chatCompletions(proxy, body, "order-1")
+		assert.Len(t, endpoint.receivedRequests(), 1)
+
+		stats := savings(proxy)
+		assert.Len(t, stats, 1)
+		assert.Equal(t, cacheSavingIdempotency, stats[0].Source)
+		assert.Equal(t, int64(2), stats[0].Requests)
+		assert.Equal(t, int64(1200), stats[0].PromptTokens)
+		assert.InDelta(t, 0.02, stats[0].CostSaved, 1e-9)
+	})
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+// Returns the capabilities that the request needs but the model lacks.
+// E.g., ["tools", "vision"]
+// Multiple choices are not missing if they can be emulated, and the maximum
+// output tokens only if the request is strict about its max_tokens, which is
+// clamped otherwise.
+func missingCapabilities(request *openai.ChatCompletionRequest, model *ogem.SupportedModel, emulateMultipleChoices bool, strictMaxTokens bool) []string {
+	capabilities := model.ResolvedCapabilities()
+	missing := []string{}
+	if (len(request.Tools) > 0 || len(request.Functions) > 0) && !capabilities.ToolsSupported() {
+		missing = append(missing, "tools")
+	}
+	if hasImage(request.Messages) && !capabilities.VisionSupported() {
+		missing = append(missing, "vision")
+	}
+	if request.HasAudio() && !capabilities.AudioSupported() {
+		missing = append(missing, "audio")
+	}
+	if request.ResponseFormat != nil &&
+		(request.ResponseFormat.Type == "json_object" || request.ResponseFormat.Type == "json_schema") &&
+		!capabilities.JsonModeSupported() {
+		missing = append(missing, "json_mode")
+	}
+	if request.Stream != nil && *request.Stream && !capabilities.StreamingSupported() {
+		missing = append(missing, "streaming")
+	}
+	if requestedChoices(request) > 1 && !capabilities.MultipleChoicesSupported() && !emulateMultipleChoices {
+		missing = append(missing, "n")
+	}
+	// Reasoning models are sent the request without logprobs.
+	if request.WantsLogprobs() && (!capabilities.LogprobsSupported() || model.Reasoning) {
+		missing = append(missing, "logprobs")
+	}
+	if maxTokens := requestedMaxTokens(request); strictMaxTokens && capabilities.MaxOutputTokens > 0 && maxTokens > capabilities.MaxOutputTokens {
+		missing = append(missing, fmt.Sprintf("max_output_tokens >= %d", maxTokens))
+	}
+	return missing
+}
+
+func hasImage(messages []openai.Message) bool {
+	for _, message := range messages {
+		if message.Content == nil {
+			continue
+		}
+		for _, part := range message.Content.Parts {
+			if part.Content.ImageContent != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns max_completion_tokens or max_tokens of the request. Zero if unset.
+func requestedMaxTokens(request *openai.ChatCompletionRequest) int {
+	if request.MaxCompletionTokens != nil {
+		return int(*request.MaxCompletionTokens)
+	}
+	if request.MaxTokens != nil {
+		return int(*request.MaxTokens)
+	}
+	return 0
+}
+
+// Removes the endpoints whose model cannot serve the request, keeping the
+// order of the others. Also returns the capabilities that the removed
+// endpoints lack, without duplicates.
+func capableEndpoints(request *openai.ChatCompletionRequest, endpoints []*endpointStatus, emulateMultipleChoices bool, strictMaxTokens bool) ([]*endpointStatus, []string) {
+	capable := []*endpointStatus{}
+	allMissing := []string{}
+	seen := map[string]bool{}
+	for _, endpoint := range endpoints {
+		missing := missingCapabilities(request, endpoint.modelStatus, emulateMultipleChoices, strictMaxTokens)
+		// Only OpenRouter knows its fields, which the others would ignore.
+		if request.OpenRouter != nil && endpoint.endpoint.Provider() != "openrouter" {
+			missing = append(missing, "openrouter")
+		}
+		if len(missing) == 0 {
+			capable = append(capable, endpoint)
+			continue
+		}
+		for _, capability := range missing {
+			if !seen[capability] {
+				seen[capability] = true
+				allMissing = append(allMissing, capability)
+			}
+		}
+	}
+	return capable, allMissing
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestCapabilities(t *testing.T) {
+	// Both providers serve "chat"; only the capable one may receive the
+	// request.
+	newProxy := func(t *testing.T, limited *ogem.Capabilities) (*ModelProxy, *fakeEndpoint, *fakeEndpoint) {
+		capable := &fakeEndpoint{provider: "capable", region: "capable"}
+		limitedEndpoint := &fakeEndpoint{provider: "limited", region: "limited"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"capable": {Regions: map[string]*ogem.RegionStatus{"capable": {
+				Latency:     20 * time.Millisecond,
+				LastChecked: time.Now(),
+				Models:      []*ogem.SupportedModel{{Name: "capable-model", OtherNames: []string{"chat"}}},
+			}}},
+			"limited": {Regions: map[string]*ogem.RegionStatus{"limited": {
+				Latency:     10 * time.Millisecond,
+				LastChecked: time.Now(),
+				Models:      []*ogem.SupportedModel{{Name: "limited-model", OtherNames: []string{"chat"}, Capabilities: limited}},
+			}}},
+		}, capable, limitedEndpoint)
+		return proxy, capable, limitedEndpoint
+	}
+
+	imageMessage := openai.Message{
+		Role: "user",
+		Content: &openai.MessageContent{Parts: []openai.Part{
+			{Type: "image_url", Content: openai.Content{ImageContent: &openai.ImageContent{Url: "https://example.com/cat.png"}}},
+		}},
+	}
+
+	for _, test := range []struct {
+		name       string
+		limited    *ogem.Capabilities
+		request    *openai.ChatCompletionRequest
+		capability string
+	}{
+		{
+			name:    "Tools",
+			limited: &ogem.Capabilities{SupportsTools: utils.ToPtr(false)},
+			request: &openai.ChatCompletionRequest{
+				Messages: []openai.Message{userMessage("Hi")},
+				Tools:    []openai.Tool{{Type: "function", Function: openai.FunctionTool{Name: "search"}}},
+			},
+			capability: "tools",
+		},
+		{
+			name:       "Vision",
+			limited:    &ogem.Capabilities{SupportsVision: utils.ToPtr(false)},
+			request:    &openai.ChatCompletionRequest{Messages: []openai.Message{imageMessage}},
+			capability: "vision",
+		},
+		{
+			name:    "JSON mode",
+			limited: &ogem.Capabilities{SupportsJsonMode: utils.ToPtr(false)},
+			request: &openai.ChatCompletionRequest{
+				Messages:       []openai.Message{userMessage("Hi")},
+				ResponseFormat: &openai.ResponseFormat{Type: "json_object"},
+			},
+			capability: "json_mode",
+		},
+		{
+			name:    "Streaming",
+			limited: &ogem.Capabilities{SupportsStreaming: utils.ToPtr(false)},
+			request: &openai.ChatCompletionRequest{
+				Messages: []openai.Message{userMessage("Hi")},
+				Stream:   utils.ToPtr(true),
+			},
+			capability: "streaming",
+		},
+		{
+			name:    "Multiple choices",
+			limited: &ogem.Capabilities{SupportsMultipleChoices: utils.ToPtr(false)},
+			request: &openai.ChatCompletionRequest{
+				Messages:       []openai.Message{userMessage("Hi")},
+				CandidateCount: utils.ToPtr(int32(3)),
+			},
+			capability: "n",
+		},
+		{
+			name:    "Logprobs",
+			limited: &ogem.Capabilities{SupportsLogprobs: utils.ToPtr(false)},
+			request: &openai.ChatCompletionRequest{
+				Messages:    []openai.Message{userMessage("Hi")},
+				Logprobs:    utils.ToPtr(true),
+				TopLogprobs: utils.ToPtr(int32(5)),
+			},
+			capability: "logprobs",
+		},
+		{
+			name:    "Max output tokens",
+			limited: &ogem.Capabilities{MaxOutputTokens: 100},
+			request: &openai.ChatCompletionRequest{
+				Messages:  []openai.Message{userMessage("Hi")},
+				MaxTokens: utils.ToPtr(int32(200)),
+			},
+			capability: "max_output_tokens >= 200",
+		},
+	} {
+		t.Run(test.name+" skips the incapable endpoint", func(t *testing.T) {
+			proxy, capable, limited := newProxy(t, test.limited)
+			request := *test.request
+			request.Model = "chat"
+
+			// Clamped otherwise.
+			ctx := withMaxTokens(context.Background(), &maxTokens{strict: true})
+			_, resolvedModel, err := proxy.generateChatCompletion(ctx, &request, false)
+			assert.NoError(t, err)
+			assert.Equal(t, "capable/capable/capable-model", resolvedModel)
+			assert.Len(t, capable.receivedRequests(), 1)
+			assert.Empty(t, limited.receivedRequests())
+		})
+
+		t.Run(test.name+" is rejected if no endpoint is capable", func(t *testing.T) {
+			proxy, _, limited := newProxy(t, test.limited)
+			request := *test.request
+			request.Model = "limited/chat"
+
+			ctx := withMaxTokens(context.Background(), &maxTokens{strict: true})
+			_, _, err := proxy.generateChatCompletion(ctx, &request, false)
+			assert.IsType(t, BadRequestError{}, err)
+			assert.ErrorContains(t, err, "missing capabilities: "+test.capability)
+			assert.Empty(t, limited.receivedRequests())
+		})
+	}
+
+	t.Run("Plain requests use the fastest endpoint", func(t *testing.T) {
+		proxy, _, limited := newProxy(t, &ogem.Capabilities{SupportsTools: utils.ToPtr(false)})
+
+		_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:    "chat",
+			Messages: []openai.Message{userMessage("Hi")},
+		}, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "limited/limited/limited-model", resolvedModel)
+		assert.Len(t, limited.receivedRequests(), 1)
+	})
+}
+
+func TestResolvedCapabilities(t *testing.T) {
+	t.Run("Uses the built-in capabilities of known models", func(t *testing.T) {
+		capabilities := (&ogem.SupportedModel{Name: "gpt-3.5-turbo-1106@batch"}).ResolvedCapabilities()
+		assert.True(t, capabilities.ToolsSupported())
+		assert.False(t, capabilities.VisionSupported())
+		assert.Equal(t, 4_096, capabilities.MaxOutputTokens)
+
+		// The longest name wins over "gpt-4o".
+		assert.True(t, (&ogem.SupportedModel{Name: "gpt-4o-mini-2024-07-18"}).ResolvedCapabilities().LogprobsSupported())
+		assert.False(t, (&ogem.SupportedModel{Name: "gpt-4o-mini-audio-preview-2024-12-17"}).ResolvedCapabilities().VisionSupported())
+	})
+
+	t.Run("Covers the dated versions of a model", func(t *testing.T) {
+		tests := map[string]int{
+			"gpt-4-0613":                    8_192,
+			"gpt-4o-2024-08-06":             16_384,
+			"claude-3-5-sonnet-20241022":    8_192,
+			"claude-3-5-sonnet-latest":      8_192,
+			"claude-3-5-sonnet-v2@20241022": 8_192,
+			"claude-3-5-haiku@20241022":     8_192,
+			"claude-3-7-sonnet-20250219":    64_000,
+			"claude-3-opus-20240229":        4_096,
+			"gemini-1.5-pro-002":            8_192,
+			"gemini-2.0-flash-001":          8_192,
+			"gemini-2.5-pro-preview-05-06":  65_536,
+		}
+		for model, maxOutputTokens := range tests {
+			assert.Equal(t, maxOutputTokens, (&ogem.SupportedModel{Name: model}).ResolvedCapabilities().MaxOutputTokens, model)
+		}
+	})
+
+	t.Run("Does not cover the other models that share the name", func(t *testing.T) {
+		for _, model := range []string{"gpt-4.1", "gpt-4.5-preview", "gpt-4.1-mini-2025-04-14", "claude-3-8-sonnet", "gemini-2.7-pro"} {
+			capabilities := (&ogem.SupportedModel{Name: model}).ResolvedCapabilities()
+			assert.True(t, capabilities.JsonModeSupported(), model)
+			assert.Zero(t, capabilities.MaxContextTokens, model)
+			assert.Zero(t, capabilities.MaxOutputTokens, model)
+		}
+	})
+
+	t.Run("Configured capabilities take precedence", func(t *testing.T) {
+		capabilities := (&ogem.SupportedModel{
+			Name:         "gpt-3.5-turbo",
+			Capabilities: &ogem.Capabilities{SupportsVision: utils.ToPtr(true), MaxOutputTokens: 1_000},
+		}).ResolvedCapabilities()
+		assert.True(t, capabilities.VisionSupported())
+		assert.Equal(t, 1_000, capabilities.MaxOutputTokens)
+		assert.Equal(t, 16_385, capabilities.MaxContextTokens)
+	})
+
+	t.Run("Unknown models have no restriction", func(t *testing.T) {
+		capabilities := (&ogem.SupportedModel{Name: "llama"}).ResolvedCapabilities()
+		assert.True(t, capabilities.ToolsSupported())
+		assert.True(t, capabilities.VisionSupported())
+		assert.True(t, capabilities.JsonModeSupported())
+		assert.True(t, capabilities.StreamingSupported())
+		assert.Zero(t, capabilities.MaxOutputTokens)
+	})
+}
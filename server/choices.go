@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Returns n of the request. One if unset.
+func requestedChoices(request *openai.ChatCompletionRequest) int {
+	if request.CandidateCount == nil {
+		return 1
+	}
+	return int(*request.CandidateCount)
+}
+
+// Generates the completion on the endpoint. If the request asks for multiple
+// choices but the model cannot generate them, sends a request for each choice
+// in parallel and merges the responses. Only reached for such models if the
+// emulation is enabled, since they are filtered out otherwise.
+func generateChoices(ctx context.Context, endpoint *endpointStatus, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	ctx = withProviderKey(ctx, endpoint)
+	ctx = withEndpointCachedContent(ctx, endpoint)
+	choices := requestedChoices(request)
+	if choices <= 1 || endpoint.modelStatus.ResolvedCapabilities().MultipleChoicesSupported() {
+		return endpoint.endpoint.GenerateChatCompletion(ctx, request)
+	}
+
+	// The other requests are pointless once one fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := make([]*openai.ChatCompletionResponse, choices)
+	var firstErr error
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	for index := range responses {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			single := *request
+			single.CandidateCount = nil
+			response, err := endpoint.endpoint.GenerateChatCompletion(ctx, &single)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				// Keeps the error that canceled the others rather than theirs.
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			responses[index] = response
+		}()
+	}
+	wait.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return mergeChoices(responses), nil
+}
+
+// Merges the responses of the emulated choices into one response. The choices
+// are renumbered in order and the usage is the sum of all requests, since each
+// of them is billed.
+func mergeChoices(responses []*openai.ChatCompletionResponse) *openai.ChatCompletionResponse {
+	merged := *responses[0]
+	merged.Choices = []openai.Choice{}
+	merged.Usage = openai.Usage{}
+	for _, response := range responses {
+		for _, choice := range response.Choices {
+			choice.Index = int32(len(merged.Choices))
+			merged.Choices = append(merged.Choices, choice)
+		}
+		addUsage(&merged.Usage, response.Usage)
+	}
+	return &merged
+}
+
+// Whether every choice of the response finished naturally. Otherwise the next
+// model of the fallback chain is tried.
+func allChoicesStopped(response *openai.ChatCompletionResponse) bool {
+	if len(response.Choices) == 0 {
+		return false
+	}
+	for _, choice := range response.Choices {
+		if choice.FinishReason != "stop" {
+			return false
+		}
+	}
+	return true
+}
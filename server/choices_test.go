@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestMultipleChoices(t *testing.T) {
+	newProxy := func(t *testing.T, endpoint *fakeEndpoint, model string) *ModelProxy {
+		return newTestProxy(t, ogem.ProvidersStatus{endpoint.provider: {Regions: map[string]*ogem.RegionStatus{endpoint.region: {
+			Models: []*ogem.SupportedModel{{Name: model, MaxRequestsPerMinute: 600_000_000}},
+		}}}}, endpoint)
+	}
+	request := func(model string) *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:          model,
+			Messages:       []openai.Message{userMessage("Hi")},
+			CandidateCount: utils.ToPtr(int32(3)),
+		}
+	}
+
+	t.Run("Passes n to the models that support it", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "studio", region: "studio"}
+		proxy := newProxy(t, endpoint, "gemini-1.5-flash")
+
+		_, _, err := proxy.generateChatCompletion(context.Background(), request("gemini-1.5-flash"), false)
+		assert.NoError(t, err)
+		assert.Len(t, endpoint.receivedRequests(), 1)
+		assert.Equal(t, int32(3), *endpoint.receivedRequests()[0].CandidateCount)
+	})
+
+	t.Run("Emulates n with parallel requests", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "claude", region: "claude", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return &openai.ChatCompletionResponse{
+				Id:    "response",
+				Model: request.Model,
+				Choices: []openai.Choice{{
+					Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hello")}},
+					FinishReason: "stop",
+				}},
+				Usage: openai.Usage{
+					PromptTokens:            10,
+					CompletionTokens:        5,
+					TotalTokens:             15,
+					CompletionTokensDetails: openai.CompletionTokensDetails{ReasoningTokens: 2},
+				},
+			}, nil
+		}}
+		proxy := newProxy(t, endpoint, "claude-3-5-sonnet")
+		proxy.config.EmulateMultipleChoices = true
+
+		response, _, err := proxy.generateChatCompletion(context.Background(), request("claude-3-5-sonnet"), false)
+		assert.NoError(t, err)
+		assert.Len(t, endpoint.receivedRequests(), 3)
+		for _, received := range endpoint.receivedRequests() {
+			assert.Nil(t, received.CandidateCount)
+		}
+
+		assert.Equal(t, "response", response.Id)
+		assert.Len(t, response.Choices, 3)
+		for index, choice := range response.Choices {
+			assert.Equal(t, int32(index), choice.Index)
+			assert.Equal(t, "Hello", *choice.Message.Content.String)
+		}
+		assert.Equal(t, openai.Usage{
+			PromptTokens:            30,
+			CompletionTokens:        15,
+			TotalTokens:             45,
+			CompletionTokensDetails: openai.CompletionTokensDetails{ReasoningTokens: 6},
+		}, response.Usage)
+	})
+
+	t.Run("Fails if any emulated request fails", func(t *testing.T) {
+		var calls atomic.Int32
+		endpoint := &fakeEndpoint{provider: "claude", region: "claude", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			if calls.Add(1) == 1 {
+				return nil, errors.New("overloaded")
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+				t.Error("The other requests are not canceled")
+				return nil, nil
+			}
+		}}
+		proxy := newProxy(t, endpoint, "claude-3-5-sonnet")
+		proxy.config.EmulateMultipleChoices = true
+
+		_, _, err := proxy.generateChatCompletion(context.Background(), request("claude-3-5-sonnet"), false)
+		assert.IsType(t, InternalServerError{}, err)
+	})
+
+	t.Run("Rejects n for the models without it unless emulated", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "claude", region: "claude"}
+		proxy := newProxy(t, endpoint, "claude-3-5-sonnet")
+
+		_, _, err := proxy.generateChatCompletion(context.Background(), request("claude-3-5-sonnet"), false)
+		assert.IsType(t, BadRequestError{}, err)
+		assert.ErrorContains(t, err, "missing capabilities: n")
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+
+	t.Run("Falls back unless every choice stopped", func(t *testing.T) {
+		truncated := &fakeEndpoint{provider: "truncated", region: "truncated", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return &openai.ChatCompletionResponse{Model: request.Model, Choices: []openai.Choice{
+				{Index: 0, FinishReason: "stop"},
+				{Index: 1, FinishReason: "length"},
+			}}, nil
+		}}
+		complete := &fakeEndpoint{provider: "complete", region: "complete"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"truncated": {Regions: map[string]*ogem.RegionStatus{"truncated": {Models: []*ogem.SupportedModel{{Name: "truncated-model"}}}}},
+			"complete":  {Regions: map[string]*ogem.RegionStatus{"complete": {Models: []*ogem.SupportedModel{{Name: "complete-model"}}}}},
+		}, truncated, complete)
+
+		body := `{"model": "truncated-model,complete-model", "n": 2, "messages": [{"role": "user", "content": "Hi"}]}`
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var response openai.ChatCompletionResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, "complete-model", response.Model)
+		assert.Len(t, truncated.receivedRequests(), 1)
+	})
+}
+
+func TestAllChoicesStopped(t *testing.T) {
+	assert.False(t, allChoicesStopped(&openai.ChatCompletionResponse{}))
+	assert.True(t, allChoicesStopped(&openai.ChatCompletionResponse{Choices: []openai.Choice{{FinishReason: "stop"}, {FinishReason: "stop"}}}))
+	assert.False(t, allChoicesStopped(&openai.ChatCompletionResponse{Choices: []openai.Choice{{FinishReason: "stop"}, {FinishReason: "length"}}}))
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+// Holds the response of the chat completion that serves a text completion, so
+// that it is converted before anything is sent. The headers are set on the
+// underlying writer as they are.
+type bufferedWriter struct {
+	http.ResponseWriter
+
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// Converts the text completion request to a chat completion with the prompt
+// as the only user message.
+func toChatCompletionRequest(request *openai.CompletionRequest) (*openai.ChatCompletionRequest, error) {
+	if request.Prompt == nil || len(request.Prompt.Prompts) == 0 {
+		return nil, fmt.Errorf("prompt is required")
+	}
+	if len(request.Prompt.Prompts) > 1 {
+		return nil, fmt.Errorf("prompt must be a single string; send a request for each prompt")
+	}
+	if request.Echo != nil && *request.Echo {
+		return nil, fmt.Errorf("echo is not supported")
+	}
+
+	chatRequest := &openai.ChatCompletionRequest{
+		Messages:         []openai.Message{{Role: "user", Content: &openai.MessageContent{String: &request.Prompt.Prompts[0]}}},
+		Model:            request.Model,
+		FrequencyPenalty: request.FrequencyPenalty,
+		LogitBias:        request.LogitBias,
+		MaxTokens:        request.MaxTokens,
+		CandidateCount:   request.CandidateCount,
+		PresencePenalty:  request.PresencePenalty,
+		Seed:             request.Seed,
+		StopSequences:    request.StopSequences,
+		Temperature:      request.Temperature,
+		TopP:             request.TopP,
+		User:             request.User,
+	}
+	// The legacy logprobs is the number of the most likely tokens to return
+	// for each position, and 0 still returns the logprobs of the chosen ones.
+	if request.Logprobs != nil {
+		chatRequest.Logprobs = utils.ToPtr(true)
+		if *request.Logprobs > 0 {
+			chatRequest.TopLogprobs = request.Logprobs
+		}
+	}
+	return chatRequest, nil
+}
+
+// Returns the text of the message content, joining the text parts if any.
+func contentText(content *openai.MessageContent) string {
+	if content == nil {
+		return ""
+	}
+	if content.String != nil {
+		return *content.String
+	}
+	texts := []string{}
+	for _, part := range content.Parts {
+		if part.Content.TextContent != nil {
+			texts = append(texts, part.Content.TextContent.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func toCompletionLogprobs(logprobs *openai.Logprobs) *openai.CompletionLogprobs {
+	if logprobs == nil {
+		return nil
+	}
+	completionLogprobs := &openai.CompletionLogprobs{
+		Tokens:        []string{},
+		TokenLogprobs: []float32{},
+		TopLogprobs:   []map[string]float32{},
+		TextOffset:    []int32{},
+	}
+	offset := int32(0)
+	for _, logprob := range logprobs.Content {
+		completionLogprobs.Tokens = append(completionLogprobs.Tokens, logprob.Token)
+		completionLogprobs.TokenLogprobs = append(completionLogprobs.TokenLogprobs, logprob.Logprob)
+		topLogprobs := map[string]float32{}
+		for _, topLogprob := range logprob.TopLogprobs {
+			topLogprobs[topLogprob.Token] = topLogprob.Logprob
+		}
+		completionLogprobs.TopLogprobs = append(completionLogprobs.TopLogprobs, topLogprobs)
+		completionLogprobs.TextOffset = append(completionLogprobs.TextOffset, offset)
+		offset += int32(utf8.RuneCountInString(logprob.Token))
+	}
+	return completionLogprobs
+}
+
+// Converts the chat completion back to the shape of the text completions.
+func toCompletionResponse(response *openai.ChatCompletionResponse) *openai.CompletionResponse {
+	choices := make([]openai.CompletionChoice, len(response.Choices))
+	for index, choice := range response.Choices {
+		choices[index] = openai.CompletionChoice{
+			Index:        choice.Index,
+			Text:         contentText(choice.Message.Content),
+			Logprobs:     toCompletionLogprobs(choice.Logprobs),
+			FinishReason: choice.FinishReason,
+		}
+	}
+	usage := response.Usage
+	return &openai.CompletionResponse{
+		Id:                "cmpl-" + strings.TrimPrefix(response.Id, "chatcmpl-"),
+		Choices:           choices,
+		Created:           response.Created,
+		Model:             response.Model,
+		SystemFingerprint: response.SystemFingerprint,
+		Object:            "text_completion",
+		Usage:             &usage,
+	}
+}
+
+// Writes the completion as server-sent events in the legacy format: a chunk
+// for each choice with its whole text, the usage if asked for, and [DONE].
+// The providers are not streamed from, so the events are sent at once.
+func writeCompletionEvents(httpResponse http.ResponseWriter, response *openai.CompletionResponse, includeUsage bool) error {
+	httpResponse.Header().Set("Content-Type", "text/event-stream")
+	httpResponse.Header().Set("Cache-Control", "no-cache")
+	chunks := []openai.CompletionResponse{}
+	for _, choice := range response.Choices {
+		chunk := *response
+		chunk.Choices = []openai.CompletionChoice{choice}
+		chunk.Usage = nil
+		chunks = append(chunks, chunk)
+	}
+	if includeUsage {
+		chunk := *response
+		chunk.Choices = []openai.CompletionChoice{}
+		chunks = append(chunks, chunk)
+	}
+
+	for _, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(httpResponse, "data: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(httpResponse, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	if flusher, ok := httpResponse.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Serves the legacy text completions API by converting the request to a chat
+// completion and its response back, so that the routing, the fallbacks and
+// the limits of the chat completions apply as they are.
+func (s *ModelProxy) HandleCompletions(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+	if wantsAsync(httpRequest) {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("async requests are only supported for the chat completions")})
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+	var request openai.CompletionRequest
+	if err := json.Unmarshal(bodyBytes, &request); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err)
+		writeBodyError(httpResponse, err)
+		return
+	}
+	chatRequest, err := toChatCompletionRequest(&request)
+	if err != nil {
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+	chatBody, err := json.Marshal(chatRequest)
+	if err != nil {
+		s.logger.Errorw("Failed to encode chat completion request", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+		return
+	}
+
+	chatHttpRequest := httpRequest.Clone(httpRequest.Context())
+	chatHttpRequest.Body = io.NopCloser(bytes.NewReader(chatBody))
+	chatHttpRequest.ContentLength = int64(len(chatBody))
+	buffered := &bufferedWriter{ResponseWriter: httpResponse}
+	s.HandleChatCompletions(buffered, chatHttpRequest)
+
+	// Errors have the same shape in both APIs.
+	if buffered.status != http.StatusOK {
+		httpResponse.WriteHeader(buffered.status)
+		httpResponse.Write(buffered.body.Bytes())
+		return
+	}
+	var chatResponse openai.ChatCompletionResponse
+	if err := json.Unmarshal(buffered.body.Bytes(), &chatResponse); err != nil {
+		s.logger.Errorw("Failed to decode chat completion response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+		return
+	}
+	response := toCompletionResponse(&chatResponse)
+
+	if request.Stream != nil && *request.Stream {
+		includeUsage := request.StreamOptions != nil && request.StreamOptions.IncludeUsage != nil && *request.StreamOptions.IncludeUsage
+		if err := writeCompletionEvents(httpResponse, response, includeUsage); err != nil {
+			s.logger.Warnw("Failed to write completion events", "error", err)
+		}
+		return
+	}
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
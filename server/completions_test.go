@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestCompletions(t *testing.T) {
+	newProxy := func(t *testing.T) (*ModelProxy, *fakeEndpoint) {
+		generate := func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			response := &openai.ChatCompletionResponse{
+				Id:    "chatcmpl-123",
+				Model: request.Model,
+				Usage: openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+			}
+			for index := range requestedChoices(request) {
+				choice := openai.Choice{
+					Index:        int32(index),
+					Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hello!")}},
+					FinishReason: "stop",
+				}
+				if request.WantsLogprobs() {
+					choice.Logprobs = &openai.Logprobs{Content: []openai.Logprob{
+						{Token: "Hello", Logprob: -0.5, TopLogprobs: []openai.TopLogprob{{Token: "Hello", Logprob: -0.5}, {Token: "Hi", Logprob: -1}}},
+						{Token: "!", Logprob: -0.25, TopLogprobs: []openai.TopLogprob{{Token: "!", Logprob: -0.25}}},
+					}}
+				}
+				response.Choices = append(response.Choices, choice)
+			}
+			return response, nil
+		}
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, generate)
+		proxy.config.EmulateMultipleChoices = true
+		return proxy, endpoint
+	}
+	completions := func(proxy *ModelProxy, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		proxy.HandleCompletions(recorder, httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body)))
+		return recorder
+	}
+
+	t.Run("Sends the prompt as a chat completion", func(t *testing.T) {
+		proxy, endpoint := newProxy(t)
+
+		recorder := completions(proxy, `{"model": "fake-model", "prompt": ["Say hello"], "max_tokens": 16, "temperature": 0.5, "stop": "\n", "logprobs": 2}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		requests := endpoint.receivedRequests()
+		assert.Len(t, requests, 1)
+		assert.Equal(t, []openai.Message{{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Say hello")}}}, requests[0].Messages)
+		assert.Equal(t, int32(16), *requests[0].MaxTokens)
+		assert.Equal(t, float32(0.5), *requests[0].Temperature)
+		assert.Equal(t, []string{"\n"}, requests[0].StopSequences.Sequences)
+		assert.True(t, *requests[0].Logprobs)
+		assert.Equal(t, int32(2), *requests[0].TopLogprobs)
+	})
+
+	t.Run("Returns the response in the legacy shape", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+
+		recorder := completions(proxy, `{"model": "fake-model", "prompt": "Say hello", "n": 2, "logprobs": 2}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, "fake/fake/fake-model", recorder.Header().Get("X-Ogem-Resolved-Model"))
+
+		var response openai.CompletionResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.True(t, strings.HasPrefix(response.Id, "cmpl-"))
+		assert.Equal(t, "text_completion", response.Object)
+		assert.Len(t, response.Choices, 2)
+		assert.Equal(t, int32(1), response.Choices[1].Index)
+		assert.Equal(t, "Hello!", response.Choices[0].Text)
+		assert.Equal(t, "stop", response.Choices[0].FinishReason)
+		assert.Equal(t, &openai.CompletionLogprobs{
+			Tokens:        []string{"Hello", "!"},
+			TokenLogprobs: []float32{-0.5, -0.25},
+			TopLogprobs:   []map[string]float32{{"Hello": -0.5, "Hi": -1}, {"!": -0.25}},
+			TextOffset:    []int32{0, 5},
+		}, response.Choices[0].Logprobs)
+		assert.Equal(t, int32(5), response.Usage.TotalTokens)
+	})
+
+	t.Run("Streams the legacy chunks", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+
+		recorder := completions(proxy, `{"model": "fake-model", "prompt": "Say hello", "n": 2, "stream": true, "stream_options": {"include_usage": true}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+
+		events := strings.Split(strings.TrimSuffix(recorder.Body.String(), "\n\n"), "\n\n")
+		assert.Len(t, events, 4)
+		assert.Equal(t, "data: [DONE]", events[3])
+		chunks := make([]openai.CompletionResponse, 3)
+		for index, event := range events[:3] {
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunks[index]))
+			assert.Equal(t, "text_completion", chunks[index].Object)
+		}
+		assert.Equal(t, []openai.CompletionChoice{{Index: 0, Text: "Hello!", FinishReason: "stop"}}, chunks[0].Choices)
+		assert.Equal(t, int32(1), chunks[1].Choices[0].Index)
+		assert.Nil(t, chunks[0].Usage)
+		assert.Empty(t, chunks[2].Choices)
+		assert.Equal(t, int32(5), chunks[2].Usage.TotalTokens)
+
+		// Every chunk carries the same ID and fingerprint.
+		assert.True(t, strings.HasPrefix(chunks[0].Id, "cmpl-"))
+		for _, chunk := range chunks[1:] {
+			assert.Equal(t, chunks[0].Id, chunk.Id)
+			assert.Equal(t, chunks[0].SystemFingerprint, chunk.SystemFingerprint)
+		}
+	})
+
+	t.Run("Rejects what cannot be converted", func(t *testing.T) {
+		proxy, endpoint := newProxy(t)
+
+		for body, message := range map[string]string{
+			`{"model": "fake-model", "prompt": "Hi", "echo": true}`:    "echo is not supported",
+			`{"model": "fake-model", "prompt": ["Hi", "Bye"]}`:         "prompt must be a single string",
+			`{"model": "fake-model"}`:                                  "prompt is required",
+			`{"model": "fake-model", "prompt": [[1, 2]]}`:              "prompt must be a string or an array of strings",
+			`{"model": "fake-model", "prompt": "Hi", "logprobs": 1.5}`: "logprobs must be an integer",
+		} {
+			recorder := completions(proxy, body)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, body)
+			assert.Contains(t, recorder.Body.String(), message, body)
+		}
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+
+	t.Run("Passes the errors through", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+
+		recorder := completions(proxy, `{"model": "unknown-model", "prompt": "Hi", "stream": true}`)
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.Contains(t, recorder.Body.String(), "no_available_endpoints")
+	})
+}
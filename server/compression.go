@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+type CompressionConfig struct {
+	// Whether to compress the responses for the clients that accept it.
+	Enabled bool `yaml:"enabled"`
+
+	// Responses smaller than this are sent uncompressed. Streamed responses are
+	// always compressed. E.g., 1024
+	MinSize int `yaml:"min_size"`
+
+	// Compression level of gzip, from 1 (fastest) to 9 (smallest). E.g., 6
+	GzipLevel int `yaml:"gzip_level"`
+
+	// Compression level of brotli, from 0 (fastest) to 11 (smallest). E.g., 4
+	BrotliLevel int `yaml:"brotli_level"`
+}
+
+const (
+	defaultCompressionMinSize = 1024
+	defaultBrotliLevel        = 4
+)
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Compresses the responses with gzip or brotli according to the
+// Accept-Encoding header of the request. Event streams are flushed after
+// every event that the handler flushes. Binary media is never compressed.
+func CompressionMiddleware(config CompressionConfig, next http.Handler) http.Handler {
+	if !config.Enabled {
+		return next
+	}
+	if config.MinSize <= 0 {
+		config.MinSize = defaultCompressionMinSize
+	}
+	if config.GzipLevel == 0 {
+		config.GzipLevel = gzip.DefaultCompression
+	}
+	if config.BrotliLevel == 0 {
+		config.BrotliLevel = defaultBrotliLevel
+	}
+
+	return http.HandlerFunc(func(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+		httpResponse.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(httpRequest.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(httpResponse, httpRequest)
+			return
+		}
+
+		writer := &compressingWriter{
+			ResponseWriter: httpResponse,
+			config:         config,
+			encoding:       encoding,
+			status:         http.StatusOK,
+		}
+		defer writer.Close()
+		next.ServeHTTP(writer, httpRequest)
+	})
+}
+
+// Returns the preferred encoding among the supported ones, or an empty string
+// if the client accepts neither.
+func acceptedEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		accepted[strings.ToLower(name)] = quality > 0
+	}
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+type compressingWriter struct {
+	http.ResponseWriter
+
+	config   CompressionConfig
+	encoding string
+	status   int
+
+	// Whether the header has been written and the writer is either
+	// compressing or passing through.
+	decided    bool
+	compressor compressor
+
+	// Body written before deciding whether to compress.
+	buffer bytes.Buffer
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *compressingWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if w.streaming() {
+			w.decide(true)
+		} else if !w.compressible() {
+			w.decide(false)
+		} else {
+			w.buffer.Write(data)
+			if w.buffer.Len() >= w.config.MinSize {
+				w.decide(true)
+				if _, err := w.compressor.Write(w.buffer.Bytes()); err != nil {
+					return 0, err
+				}
+				w.buffer.Reset()
+			}
+			return len(data), nil
+		}
+	}
+
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressingWriter) Flush() {
+	if !w.decided {
+		// The handler wants the data now, so it cannot wait for the minimum
+		// size.
+		w.decide(w.streaming() || (w.compressible() && w.buffer.Len() >= w.config.MinSize))
+		w.writeBuffer()
+	}
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressingWriter) Close() error {
+	if !w.decided {
+		w.decide(w.compressible() && w.buffer.Len() >= w.config.MinSize)
+		w.writeBuffer()
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
+
+func (w *compressingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressingWriter) streaming() bool {
+	return w.compressible() && strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+func (w *compressingWriter) compressible() bool {
+	if w.Header().Get("Content-Encoding") != "" ||
+		w.status == http.StatusNoContent ||
+		w.status == http.StatusNotModified {
+		return false
+	}
+	contentType := w.Header().Get("Content-Type")
+	for _, binaryType := range []string{"audio/", "video/", "image/", "application/octet-stream"} {
+		if strings.HasPrefix(contentType, binaryType) {
+			return false
+		}
+	}
+	return true
+}
+
+// Writes the header with or without the compression.
+func (w *compressingWriter) decide(compress bool) {
+	w.decided = true
+	if compress {
+		w.Header().Set("Content-Encoding", w.encoding)
+		w.Header().Del("Content-Length")
+		if w.encoding == "br" {
+			w.compressor = brotli.NewWriterLevel(w.ResponseWriter, w.config.BrotliLevel)
+		} else {
+			gzipWriter, err := gzip.NewWriterLevel(w.ResponseWriter, w.config.GzipLevel)
+			if err != nil {
+				gzipWriter = gzip.NewWriter(w.ResponseWriter)
+			}
+			w.compressor = gzipWriter
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressingWriter) writeBuffer() {
+	if w.buffer.Len() == 0 {
+		return
+	}
+	if w.compressor != nil {
+		w.compressor.Write(w.buffer.Bytes())
+	} else {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+	w.buffer.Reset()
+}
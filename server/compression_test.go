@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionMiddleware(t *testing.T) {
+	config := CompressionConfig{Enabled: true, MinSize: 100}
+	largeJson := `{"data": "` + strings.Repeat("a", 1000) + `"}`
+
+	// Serves the handler through the middleware and returns the response to a
+	// request with the given Accept-Encoding.
+	serve := func(t *testing.T, config CompressionConfig, acceptEncoding string, handler http.HandlerFunc) *http.Response {
+		server := httptest.NewServer(CompressionMiddleware(config, handler))
+		t.Cleanup(server.Close)
+
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		// Disables the transparent decompression of the client.
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		response, err := client.Do(request)
+		assert.NoError(t, err)
+		t.Cleanup(func() { response.Body.Close() })
+		return response
+	}
+
+	jsonHandler := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}
+	}
+
+	t.Run("Gzips large JSON", func(t *testing.T) {
+		response := serve(t, config, "gzip, deflate", jsonHandler(largeJson))
+		assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+		assert.Contains(t, response.Header.Values("Vary"), "Accept-Encoding")
+
+		reader, err := gzip.NewReader(response.Body)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(reader)
+		assert.Equal(t, largeJson, string(body))
+	})
+
+	t.Run("Prefers brotli", func(t *testing.T) {
+		response := serve(t, config, "gzip, br", jsonHandler(largeJson))
+		assert.Equal(t, "br", response.Header.Get("Content-Encoding"))
+
+		body, _ := io.ReadAll(brotli.NewReader(response.Body))
+		assert.Equal(t, largeJson, string(body))
+	})
+
+	t.Run("Respects zero quality", func(t *testing.T) {
+		response := serve(t, config, "br;q=0, gzip;q=0.5", jsonHandler(largeJson))
+		assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("Skips small responses", func(t *testing.T) {
+		response := serve(t, config, "gzip", jsonHandler(`{"data": "a"}`))
+		assert.Empty(t, response.Header.Get("Content-Encoding"))
+
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(t, `{"data": "a"}`, string(body))
+	})
+
+	t.Run("Skips clients without compression", func(t *testing.T) {
+		response := serve(t, config, "", jsonHandler(largeJson))
+		assert.Empty(t, response.Header.Get("Content-Encoding"))
+
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(t, largeJson, string(body))
+	})
+
+	t.Run("Skips when disabled", func(t *testing.T) {
+		response := serve(t, CompressionConfig{}, "gzip", jsonHandler(largeJson))
+		assert.Empty(t, response.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("Keeps audio untouched", func(t *testing.T) {
+		audio := strings.Repeat("\x00\x01\x02", 1000)
+		response := serve(t, config, "gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.Write([]byte(audio))
+		})
+		assert.Empty(t, response.Header.Get("Content-Encoding"))
+
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(t, audio, string(body))
+	})
+
+	t.Run("Keeps the status code", func(t *testing.T) {
+		response := serve(t, config, "gzip", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		})
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	})
+
+	t.Run("Streams events incrementally", func(t *testing.T) {
+		proceed := make(chan struct{})
+		response := serve(t, config, "gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for index := range 2 {
+				fmt.Fprintf(w, "data: {\"index\": %d}\n\n", index)
+				w.(http.Flusher).Flush()
+				<-proceed
+			}
+		})
+		assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+
+		reader, err := gzip.NewReader(response.Body)
+		assert.NoError(t, err)
+		lines := bufio.NewReader(reader)
+
+		// Each event arrives while the handler is still blocked.
+		for index := range 2 {
+			received := make(chan string)
+			go func() {
+				line, _ := lines.ReadString('\n')
+				received <- line
+			}()
+			select {
+			case line := <-received:
+				assert.Equal(t, fmt.Sprintf("data: {\"index\": %d}\n", index), line)
+			case <-time.After(time.Second):
+				t.Fatalf("event %d was not flushed", index)
+			}
+			lines.ReadString('\n')
+			proceed <- struct{}{}
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Time to wait for a busy endpoint before trying it again. There is no
+// telling when its requests finish, so it is kept short.
+const busyEndpointWait = 50 * time.Millisecond
+
+// Number of the requests in flight to each endpoint, to keep the regions
+// under their max_concurrent_requests. Only counts the requests of this
+// instance. The zero value is ready to use.
+type inFlightRequests struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// Takes a slot of the endpoint for a request. Returns false without taking it
+// if the endpoint is busy. Each taken slot must be given back with release.
+func (r *inFlightRequests) acquire(endpoint *endpointStatus) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := endpointKey(endpoint)
+	if endpoint.maxConcurrentRequests > 0 && r.counts[key] >= endpoint.maxConcurrentRequests {
+		return false
+	}
+	if r.counts == nil {
+		r.counts = map[string]int{}
+	}
+	r.counts[key]++
+	return true
+}
+
+func (r *inFlightRequests) release(endpoint *endpointStatus) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := endpointKey(endpoint)
+	if r.counts[key] <= 1 {
+		delete(r.counts, key)
+		return
+	}
+	r.counts[key]--
+}
+
+// Returns the number of the requests in flight to the region.
+func (r *inFlightRequests) count(provider string, region string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.counts[provider+"/"+region]
+}
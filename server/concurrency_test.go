@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+func TestConcurrencyLimits(t *testing.T) {
+	// Holds every request until released, and reports each one as it starts.
+	slowEndpoint := func(region string, started chan<- string, release <-chan struct{}) *fakeEndpoint {
+		return &fakeEndpoint{provider: "fake", region: region, generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			started <- region
+			<-release
+			return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: &region}}}}}, nil
+		}}
+	}
+	newProxy := func(t *testing.T, regions map[string]*ogem.RegionStatus, endpoints ...provider.AiEndpoint) *ModelProxy {
+		for _, regionStatus := range regions {
+			regionStatus.Models = []*ogem.SupportedModel{{Name: "llama"}}
+		}
+		return newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: regions}}, endpoints...)
+	}
+	chatCompletions := func(proxy *ModelProxy) *httptest.ResponseRecorder {
+		recorder := sendChatCompletions(proxy, `{"model": "llama", "messages": [{"role": "user", "content": "Hi"}]}`, nil, nil)
+		return recorder
+	}
+	inFlight := func(t *testing.T, proxy *ModelProxy, region string) int {
+		limits, err := proxy.limits(context.Background())
+		assert.NoError(t, err)
+		for _, modelLimits := range limits {
+			if modelLimits.Region == region {
+				return modelLimits.InFlight
+			}
+		}
+		return -1
+	}
+
+	t.Run("Fails over from the busy region", func(t *testing.T) {
+		started := make(chan string, 3)
+		release := make(chan struct{})
+		// The limited region is tried first for its priority.
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"vllm":   {Priority: 1, MaxConcurrentRequests: 2},
+			"backup": {},
+		}, slowEndpoint("vllm", started, release), slowEndpoint("backup", started, release))
+
+		var wait sync.WaitGroup
+		for range 3 {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				assert.Equal(t, http.StatusOK, chatCompletions(proxy).Code)
+			}()
+		}
+		regions := []string{<-started, <-started, <-started}
+		assert.ElementsMatch(t, []string{"vllm", "vllm", "backup"}, regions)
+		assert.Equal(t, 2, inFlight(t, proxy, "vllm"))
+		assert.Equal(t, 1, inFlight(t, proxy, "backup"))
+
+		close(release)
+		wait.Wait()
+		assert.Zero(t, inFlight(t, proxy, "vllm"))
+	})
+
+	t.Run("Keeps the limit after a ping", func(t *testing.T) {
+		started := make(chan string, 2)
+		release := make(chan struct{})
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"vllm": {MaxConcurrentRequests: 1},
+		}, slowEndpoint("vllm", started, release))
+		proxy.TriggerPing(context.Background())
+
+		done := make(chan int, 2)
+		for range 2 {
+			go func() {
+				done <- chatCompletions(proxy).Code
+			}()
+		}
+		<-started
+		select {
+		case <-started:
+			t.Fatal("The second request was sent over the limit")
+		case <-time.After(3 * busyEndpointWait):
+		}
+		assert.Equal(t, 1, inFlight(t, proxy, "vllm"))
+
+		close(release)
+		assert.Equal(t, http.StatusOK, <-done)
+		assert.Equal(t, http.StatusOK, <-done)
+	})
+
+	t.Run("Waits for a slot of the only region", func(t *testing.T) {
+		started := make(chan string, 3)
+		release := make(chan struct{})
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"vllm": {MaxConcurrentRequests: 2},
+		}, slowEndpoint("vllm", started, release))
+
+		done := make(chan int, 3)
+		for range 3 {
+			go func() {
+				done <- chatCompletions(proxy).Code
+			}()
+		}
+		<-started
+		<-started
+		select {
+		case <-started:
+			t.Fatal("The third request was sent over the limit")
+		case <-time.After(3 * busyEndpointWait):
+		}
+		assert.Equal(t, 2, inFlight(t, proxy, "vllm"))
+
+		// The third request is sent once the others finish.
+		release <- struct{}{}
+		assert.Equal(t, http.StatusOK, <-done)
+		assert.Equal(t, "vllm", <-started)
+		close(release)
+		assert.Equal(t, http.StatusOK, <-done)
+		assert.Equal(t, http.StatusOK, <-done)
+	})
+
+	t.Run("Does not limit the regions without a limit", func(t *testing.T) {
+		started := make(chan string, 5)
+		release := make(chan struct{})
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{"vllm": {}}, slowEndpoint("vllm", started, release))
+
+		var wait sync.WaitGroup
+		for range 5 {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				chatCompletions(proxy)
+			}()
+		}
+		for range 5 {
+			<-started
+		}
+		assert.Equal(t, 5, inFlight(t, proxy, "vllm"))
+		close(release)
+		wait.Wait()
+	})
+}
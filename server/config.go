@@ -0,0 +1,465 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/yanolja/ogem/hooks"
+	"github.com/yanolja/ogem/provider/claude"
+	"github.com/yanolja/ogem/utils/env"
+)
+
+// Providers that can be used without a base URL, and whether their only
+// region must be named after the provider.
+var builtinProviders = map[string]bool{
+	"bedrock":    false,
+	"claude":     true,
+	"cohere":     true,
+	"fake":       false,
+	"ollama":     false,
+	"openai":     true,
+	"openrouter": true,
+	"studio":     true,
+	"vclaude":    false,
+	"vertex":     false,
+	"voyage":     true,
+}
+
+// Decodes the YAML config over the given config. If the YAML sets
+// strict_config, unknown keys are rejected.
+func ParseConfig(data []byte, config *Config) error {
+	var strictness struct {
+		StrictConfig bool `yaml:"strict_config"`
+	}
+	if err := yaml.Unmarshal(data, &strictness); err != nil {
+		return err
+	}
+	if !strictness.StrictConfig {
+		return yaml.Unmarshal(data, config)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns all problems of the config joined into one error, each prefixed
+// with its YAML path. E.g., "providers.vertex.regions.us-central1.models[0].rpm: must be >= 0"
+func (config *Config) Validate() error {
+	problems := []error{}
+	addProblem := func(path string, format string, args ...any) {
+		problems = append(problems, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	checkDuration := func(path string, value string, required bool) {
+		if value == "" {
+			if required {
+				addProblem(path, "is required")
+			}
+			return
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			addProblem(path, "invalid duration %q", value)
+		} else if duration < 0 {
+			addProblem(path, "must be >= 0")
+		}
+	}
+	checkAddresses := func(path string, values []string) {
+		for index, value := range values {
+			if _, err := parsePrefix(value); err != nil {
+				addProblem(fmt.Sprintf("%s[%d]", path, index), "invalid address or CIDR %q", value)
+			}
+		}
+	}
+
+	if config.Port < 1 || config.Port > 65535 {
+		addProblem("port", "must be between 1 and 65535")
+	}
+	checkDuration("retry_interval", config.RetryInterval, true)
+	checkDuration("ping_interval", config.PingInterval, true)
+	if config.PingConcurrency < 0 {
+		addProblem("ping_concurrency", "must be >= 0")
+	}
+	checkDuration("max_disable_duration", config.MaxDisableDuration, false)
+	checkDuration("affinity_ttl", config.AffinityTtl, false)
+	checkDuration("idempotency_ttl", config.IdempotencyTtl, false)
+	checkDuration("valkey_cooldown", config.ValkeyCooldown, false)
+	checkDuration("hedge_after", config.HedgeAfter, false)
+	checkDuration("warmup.timeout", config.Warmup.Timeout, false)
+	checkDuration("status_persist_interval", config.StatusPersistInterval, false)
+	checkDuration("status_max_age", config.StatusMaxAge, false)
+	if config.MaxHedges < 0 {
+		addProblem("max_hedges", "must be >= 0")
+	}
+	switch config.ClaudeMidSystemMessages {
+	case "", claude.MidSystemInline, claude.MidSystemMerge, claude.MidSystemError:
+	default:
+		addProblem("claude_mid_system_messages", "must be inline, merge or error")
+	}
+	if config.BedrockRoleArn != "" && !strings.HasPrefix(config.BedrockRoleArn, "arn:") {
+		addProblem("bedrock_role_arn", "invalid ARN %q", config.BedrockRoleArn)
+	}
+	for _, model := range sortedKeys(config.BedrockModelIds) {
+		if config.BedrockModelIds[model] == "" {
+			addProblem("bedrock_model_ids."+model, "is required")
+		}
+	}
+	for _, model := range sortedKeys(config.OpenRouterModelIds) {
+		if config.OpenRouterModelIds[model] == "" {
+			addProblem("openrouter_model_ids."+model, "is required")
+		}
+	}
+	if config.ActivityBufferSize < 0 {
+		addProblem("activity_buffer_size", "must be >= 0")
+	}
+	if config.ValkeyFailureThreshold < 0 {
+		addProblem("valkey_failure_threshold", "must be >= 0")
+	}
+	if strings.IndexFunc(config.StateNamespace, unicode.IsSpace) >= 0 {
+		addProblem("state_namespace", "must not contain whitespace")
+	}
+	if config.EndUserLimits.TokensPerDay < 0 {
+		addProblem("end_user_limits.tokens_per_day", "must be >= 0")
+	}
+	if config.EndUserLimits.CostPerDay < 0 {
+		addProblem("end_user_limits.cost_per_day", "must be >= 0")
+	}
+	if config.EndUserLimits.RequestsPerDay < 0 {
+		addProblem("end_user_limits.requests_per_day", "must be >= 0")
+	}
+	if config.LoadShedding.MaxInFlight < 0 {
+		addProblem("load_shedding.max_in_flight", "must be >= 0")
+	}
+	if config.LoadShedding.MaxInFlightHigh != 0 && config.LoadShedding.MaxInFlightHigh < config.LoadShedding.MaxInFlight {
+		addProblem("load_shedding.max_in_flight_high", "must be >= max_in_flight")
+	}
+	checkDuration("load_shedding.state_latency_threshold", config.LoadShedding.StateLatencyThreshold, false)
+	if alpha := config.LatencySmoothing.Alpha; alpha < 0 || alpha > 1 {
+		addProblem("latency_smoothing.alpha", "must be between 0 and 1")
+	}
+	if factor := config.LatencySmoothing.OutlierFactor; factor != 0 && factor <= 1 {
+		addProblem("latency_smoothing.outlier_factor", "must be > 1")
+	}
+	if config.LatencySmoothing.MaxOutliers < 0 {
+		addProblem("latency_smoothing.max_outliers", "must be >= 0")
+	}
+	checkDuration("transcripts.ttl", config.Transcripts.Ttl, false)
+	if ttl, err := time.ParseDuration(config.Transcripts.Ttl); err == nil && ttl == 0 {
+		addProblem("transcripts.ttl", "must be > 0")
+	}
+	if name := config.Transcripts.EncryptionKeyEnv; name != "" {
+		if value := os.Getenv(name); value == "" {
+			addProblem("transcripts.encryption_key_env", "environment variable %s is not set", name)
+		} else if _, err := transcriptCipher(value); err != nil {
+			addProblem("transcripts.encryption_key_env", "%s %v", name, err)
+		}
+	}
+	for index, header := range config.Labels.Headers {
+		if headerLabelName(header) == "" {
+			addProblem(fmt.Sprintf("labels.headers[%d]", index), "must name a header other than X-Ogem-")
+		}
+	}
+	for index, key := range config.Labels.MetadataKeys {
+		if strings.TrimSpace(key) == "" {
+			addProblem(fmt.Sprintf("labels.metadata_keys[%d]", index), "is required")
+		}
+	}
+	if config.Labels.MaxLabels < 0 {
+		addProblem("labels.max_labels", "must be >= 0")
+	}
+	if config.Labels.MaxValueLength < 0 {
+		addProblem("labels.max_value_length", "must be >= 0")
+	}
+
+	keys := map[string]int{}
+	for index, apiKey := range config.ApiKeys {
+		if apiKey.Key == "" {
+			addProblem(fmt.Sprintf("api_keys[%d].key", index), "is required")
+			continue
+		}
+		if otherIndex, found := keys[apiKey.Key]; found {
+			addProblem(fmt.Sprintf("api_keys[%d].key", index), "is the same as api_keys[%d].key", otherIndex)
+		}
+		keys[apiKey.Key] = index
+		checkAddresses(fmt.Sprintf("api_keys[%d].allowed_cidrs", index), apiKey.AllowedCidrs)
+		if apiKey.ExpiresAt != "" {
+			if _, err := time.Parse(time.RFC3339, apiKey.ExpiresAt); err != nil {
+				addProblem(fmt.Sprintf("api_keys[%d].expires_at", index), "invalid time %q; must be in RFC 3339", apiKey.ExpiresAt)
+			}
+		}
+		if apiKey.CaptureTranscriptsUntil != "" {
+			if _, err := time.Parse(time.RFC3339, apiKey.CaptureTranscriptsUntil); err != nil {
+				addProblem(fmt.Sprintf("api_keys[%d].capture_transcripts_until", index), "invalid time %q; must be in RFC 3339", apiKey.CaptureTranscriptsUntil)
+			}
+		}
+		if _, err := toolValidationMode(apiKey.ValidateTools); err != nil {
+			addProblem(fmt.Sprintf("api_keys[%d].validate_tools", index), "%v", err)
+		}
+		if apiKey.Priority != "" && apiKey.Priority != priorityHigh && apiKey.Priority != "normal" {
+			addProblem(fmt.Sprintf("api_keys[%d].priority", index), "must be high or normal")
+		}
+		for _, provider := range sortedKeys(apiKey.ProviderKeys) {
+			keyPath := fmt.Sprintf("api_keys[%d].provider_keys.%s", index, provider)
+			custom := config.Providers[provider] != nil && config.Providers[provider].BaseUrl != ""
+			if provider != "openai" && provider != "claude" && provider != "openrouter" && !custom {
+				addProblem(keyPath, "is only supported for the openai, claude and openrouter providers and custom endpoints")
+				continue
+			}
+			if value, err := env.Interpolate(apiKey.ProviderKeys[provider]); err != nil {
+				addProblem(keyPath, "%v", err)
+			} else if value == "" {
+				addProblem(keyPath, "is required")
+			}
+		}
+	}
+	checkAddresses("ip_filter.allow", config.IpFilter.Allow)
+	checkAddresses("ip_filter.deny", config.IpFilter.Deny)
+	checkAddresses("ip_filter.trusted_proxies", config.IpFilter.TrustedProxies)
+
+	if config.Shadow.Enabled {
+		if config.Shadow.SourceModel == "" {
+			addProblem("shadow.source_model", "is required")
+		} else if _, err := path.Match(config.Shadow.SourceModel, ""); err != nil {
+			addProblem("shadow.source_model", "invalid pattern %q", config.Shadow.SourceModel)
+		}
+		if config.Shadow.Model == "" {
+			addProblem("shadow.model", "is required")
+		}
+		if config.Shadow.Percent < 0 || config.Shadow.Percent > 100 {
+			addProblem("shadow.percent", "must be between 0 and 100")
+		}
+		if config.Shadow.MaxConcurrent < 0 {
+			addProblem("shadow.max_concurrent", "must be >= 0")
+		}
+	}
+
+	deprecated := map[string]int{}
+	for index, deprecation := range config.Deprecations {
+		path := fmt.Sprintf("deprecations[%d]", index)
+		if deprecation.Model == "" {
+			addProblem(path+".model", "is required")
+		} else if otherIndex, found := deprecated[deprecation.Model]; found {
+			addProblem(path+".model", "is the same as deprecations[%d].model", otherIndex)
+		} else {
+			deprecated[deprecation.Model] = index
+		}
+		if deprecation.After == "" {
+			addProblem(path+".after", "is required")
+		} else if _, err := parseCutoff(deprecation.After); err != nil {
+			addProblem(path+".after", "%v", err)
+		}
+		switch deprecation.Mode {
+		case "", deprecationRedirect:
+			if deprecation.RedirectTo == "" {
+				addProblem(path+".redirect_to", "is required in the redirect mode")
+			} else if deprecation.RedirectTo == deprecation.Model {
+				addProblem(path+".redirect_to", "must be another model")
+			}
+		case deprecationReject:
+		default:
+			addProblem(path+".mode", "must be redirect or reject")
+		}
+	}
+
+	splitAliases := map[string]int{}
+	for index, split := range config.TrafficSplits {
+		path := fmt.Sprintf("traffic_splits[%d]", index)
+		if split.Alias == "" {
+			addProblem(path+".alias", "is required")
+		} else if otherIndex, found := splitAliases[split.Alias]; found {
+			addProblem(path+".alias", "is the same as traffic_splits[%d].alias", otherIndex)
+		} else {
+			splitAliases[split.Alias] = index
+		}
+		if len(split.Arms) == 0 {
+			addProblem(path+".arms", "is required")
+			continue
+		}
+		total := 0.0
+		for armIndex, arm := range split.Arms {
+			armPath := fmt.Sprintf("%s.arms[%d]", path, armIndex)
+			if arm.Model == "" {
+				addProblem(armPath+".model", "is required")
+			} else if strings.Contains(arm.Model, ",") {
+				addProblem(armPath+".model", "must not be a fallback chain")
+			}
+			if arm.Weight <= 0 {
+				addProblem(armPath+".weight", "must be > 0")
+			}
+			total += arm.Weight
+		}
+		if math.Abs(total-100) > 1e-9 {
+			addProblem(path+".arms", "weights must sum to 100, not %g", total)
+		}
+	}
+
+	if config.Async.Workers < 0 {
+		addProblem("async.workers", "must be >= 0")
+	}
+	if config.Async.QueueSize < 0 {
+		addProblem("async.queue_size", "must be >= 0")
+	}
+	checkDuration("async.job_ttl", config.Async.JobTtl, false)
+
+	checkDuration("conversations.ttl", config.Conversations.Ttl, false)
+	if ttl, err := time.ParseDuration(config.Conversations.Ttl); err == nil && ttl == 0 {
+		addProblem("conversations.ttl", "must be > 0")
+	}
+	if config.Conversations.MaxMessages < 0 {
+		addProblem("conversations.max_messages", "must be >= 0")
+	}
+	if config.Conversations.MaxBytes < 0 {
+		addProblem("conversations.max_bytes", "must be >= 0")
+	}
+
+	if config.LocalCache.MaxEntries < 0 {
+		addProblem("local_cache.max_entries", "must be >= 0")
+	}
+	if config.LocalCache.MaxBytes < 0 {
+		addProblem("local_cache.max_bytes", "must be >= 0")
+	}
+	checkDuration("local_cache.ttl", config.LocalCache.Ttl, false)
+	if ttl, err := time.ParseDuration(config.LocalCache.Ttl); err == nil && ttl == 0 {
+		addProblem("local_cache.ttl", "must be > 0")
+	}
+
+	if config.Compression.MinSize < 0 {
+		addProblem("compression.min_size", "must be >= 0")
+	}
+	if config.Compression.GzipLevel < 0 || config.Compression.GzipLevel > 9 {
+		addProblem("compression.gzip_level", "must be between 1 and 9")
+	}
+	if config.Compression.BrotliLevel < 0 || config.Compression.BrotliLevel > 11 {
+		addProblem("compression.brotli_level", "must be between 0 and 11")
+	}
+
+	problems = append(problems, prefixProblems("notifications.", config.Notifications.Validate())...)
+	problems = append(problems, prefixProblems("hooks", hooks.Validate(config.Hooks))...)
+
+	for _, provider := range sortedKeys(config.Providers) {
+		providerStatus := config.Providers[provider]
+		if providerStatus == nil {
+			continue
+		}
+		path := fmt.Sprintf("providers.%s", provider)
+		googleFields := map[string]string{
+			"google_cloud_project":        providerStatus.GoogleCloudProject,
+			"credentials_file":            providerStatus.CredentialsFile,
+			"impersonate_service_account": providerStatus.ImpersonateServiceAccount,
+		}
+		for _, field := range sortedKeys(googleFields) {
+			if googleFields[field] != "" && provider != "vertex" && provider != "vclaude" {
+				addProblem(path+"."+field, "is only supported for the vertex and vclaude providers")
+			}
+		}
+		if account := providerStatus.ImpersonateServiceAccount; account != "" && !strings.Contains(account, "@") {
+			addProblem(path+".impersonate_service_account", "must be the email of a service account")
+		}
+		if providerStatus.BaseUrl != "" {
+			if providerStatus.Protocol != "openai" {
+				addProblem(path+".protocol", "must be openai for custom endpoints")
+			}
+			if providerStatus.ApiKeyEnv == "" {
+				addProblem(path+".api_key_env", "is required for custom endpoints")
+			}
+			for _, name := range sortedKeys(providerStatus.ExtraHeaders) {
+				if _, err := env.Interpolate(providerStatus.ExtraHeaders[name]); err != nil {
+					addProblem(fmt.Sprintf("%s.extra_headers.%s", path, name), "%v", err)
+				}
+			}
+			for _, name := range sortedKeys(providerStatus.ExtraQuery) {
+				if _, err := env.Interpolate(providerStatus.ExtraQuery[name]); err != nil {
+					addProblem(fmt.Sprintf("%s.extra_query.%s", path, name), "%v", err)
+				}
+			}
+			for _, region := range sortedKeys(providerStatus.Regions) {
+				if region != provider && region != "default" {
+					addProblem(fmt.Sprintf("%s.regions.%s", path, region), "must be named %s for custom endpoints", provider)
+				}
+			}
+			continue
+		}
+
+		if len(providerStatus.ExtraHeaders) > 0 || len(providerStatus.ExtraQuery) > 0 {
+			addProblem(path, "extra_headers and extra_query are only supported for custom endpoints")
+		}
+		for _, region := range sortedKeys(providerStatus.Regions) {
+			regionStatus := providerStatus.Regions[region]
+			if regionStatus == nil {
+				continue
+			}
+			if regionStatus.Fake != nil {
+				regionPath := fmt.Sprintf("%s.regions.%s.fake", path, region)
+				if provider != "fake" {
+					addProblem(regionPath, "is only supported for the fake provider")
+				} else {
+					problems = append(problems, prefixProblems(regionPath+".", regionStatus.Fake.Validate())...)
+				}
+			}
+			if regionStatus.Ollama != nil {
+				regionPath := fmt.Sprintf("%s.regions.%s.ollama", path, region)
+				if provider != "ollama" {
+					addProblem(regionPath, "is only supported for the ollama provider")
+				} else {
+					problems = append(problems, prefixProblems(regionPath+".", regionStatus.Ollama.Validate())...)
+				}
+			}
+		}
+		singleRegion, builtin := builtinProviders[provider]
+		if !builtin {
+			addProblem(path, "unsupported provider; set base_url and protocol for custom endpoints")
+			continue
+		}
+		if singleRegion {
+			for _, region := range sortedKeys(providerStatus.Regions) {
+				if region != provider && region != "default" {
+					addProblem(fmt.Sprintf("%s.regions.%s", path, region), "must be named %s", provider)
+				}
+			}
+		}
+	}
+	problems = append(problems, unwrapProblems(config.Providers.Validate())...)
+
+	return errors.Join(problems...)
+}
+
+// Splits the joined error into the individual problems.
+func unwrapProblems(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+func prefixProblems(prefix string, err error) []error {
+	problems := unwrapProblems(err)
+	for index, problem := range problems {
+		problems[index] = fmt.Errorf("%s%v", prefix, problem)
+	}
+	return problems
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	load := func(t *testing.T, path string) *Config {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		config := &Config{}
+		assert.NoError(t, ParseConfig(data, config))
+		return config
+	}
+
+	t.Run("Accepts the bundled config", func(t *testing.T) {
+		config := load(t, "../config.yaml")
+		config.Port = 8080
+		assert.NoError(t, config.Validate())
+	})
+
+	t.Run("Reports every problem with its path", func(t *testing.T) {
+		err := load(t, "testdata/broken_config.yaml").Validate()
+		assert.Error(t, err)
+
+		for _, expected := range []string{
+			"port: must be between 1 and 65535",
+			`retry_interval: invalid duration "soon"`,
+			"ping_concurrency: must be >= 0",
+			"max_disable_duration: must be >= 0",
+			`idempotency_ttl: invalid duration "1 day"`,
+			`valkey_cooldown: invalid duration "later"`,
+			"max_hedges: must be >= 0",
+			"activity_buffer_size: must be >= 0",
+			"claude_mid_system_messages: must be inline, merge or error",
+			`bedrock_role_arn: invalid ARN "ogem-bedrock"`,
+			"bedrock_model_ids.claude-3-5-sonnet: is required",
+			"openrouter_model_ids.llama-3.1-70b: is required",
+			"api_keys[1].key: is the same as api_keys[0].key",
+			"state_namespace: must not contain whitespace",
+			"end_user_limits.cost_per_day: must be >= 0",
+			"load_shedding.max_in_flight_high: must be >= max_in_flight",
+			`load_shedding.state_latency_threshold: invalid duration "fast"`,
+			"latency_smoothing.alpha: must be between 0 and 1",
+			"latency_smoothing.outlier_factor: must be > 1",
+			"transcripts.ttl: must be > 0",
+			"transcripts.encryption_key_env: environment variable OGEM_TEST_UNSET_TRANSCRIPT_KEY is not set",
+			`warmup.timeout: invalid duration "1 minute"`,
+			`status_max_age: invalid duration "forever"`,
+			"labels.headers[1]: must name a header other than X-Ogem-",
+			"labels.max_labels: must be >= 0",
+			"api_keys[2].key: is required",
+			`api_keys[1].allowed_cidrs[1]: invalid address or CIDR "10.0.0.0/33"`,
+			`api_keys[1].expires_at: invalid time "2025-12-31"; must be in RFC 3339`,
+			`api_keys[1].validate_tools: unsupported tool validation mode "always"; must be one of true, false, annotate, repair, off`,
+			`api_keys[1].capture_transcripts_until: invalid time "tomorrow"; must be in RFC 3339`,
+			"api_keys[1].priority: must be high or normal",
+			"api_keys[1].provider_keys.openai: environment variables are not set: [OGEM_TEST_UNSET_OPENAI_KEY]",
+			"api_keys[1].provider_keys.vertex: is only supported for the openai, claude and openrouter providers and custom endpoints",
+			`ip_filter.trusted_proxies[1]: invalid address or CIDR "proxy.internal"`,
+			"compression.gzip_level: must be between 1 and 9",
+			`shadow.source_model: invalid pattern "gpt-4o["`,
+			"shadow.model: is required",
+			"shadow.percent: must be between 0 and 100",
+			"deprecations[0].redirect_to: is required in the redirect mode",
+			"deprecations[1].model: is the same as deprecations[0].model",
+			`deprecations[1].after: invalid time "July 1st"; must be a date (YYYY-MM-DD) or in RFC 3339`,
+			"deprecations[2].mode: must be redirect or reject",
+			"traffic_splits[0].arms[1].model: must not be a fallback chain",
+			"traffic_splits[0].arms[1].weight: must be > 0",
+			"traffic_splits[0].arms: weights must sum to 100, not 90",
+			"traffic_splits[1].alias: is the same as traffic_splits[0].alias",
+			"traffic_splits[1].arms: is required",
+			"async.workers: must be >= 0",
+			`async.job_ttl: invalid duration "1d"`,
+			`conversations.ttl: invalid duration "1 week"`,
+			"conversations.max_messages: must be >= 0",
+			"local_cache.max_bytes: must be >= 0",
+			"local_cache.ttl: must be > 0",
+			"notifications.webhooks[0].url: must be an absolute URL",
+			"notifications.webhooks[0].format: must be json or slack",
+			"hooks[0].settings: prompt is required",
+			`hooks[1].name: unknown hook "pii_redaction"`,
+			"providers.azure: unsupported provider",
+			"providers.claude.regions.us-east1: must be named claude",
+			"providers.custom.protocol: must be openai for custom endpoints",
+			`providers.fake.regions.local.fake.latency: invalid duration "slow"`,
+			"providers.fake.regions.local.ollama: is only supported for the ollama provider",
+			"providers.ollama.regions.local.ollama.base_url: must be an absolute URL",
+			"providers.custom.api_key_env: is required for custom endpoints",
+			"providers.custom.extra_headers.x-portkey-api-key: environment variables are not set: [OGEM_TEST_UNSET_VARIABLE]",
+			"providers.claude: extra_headers and extra_query are only supported for custom endpoints",
+			"providers.claude.credentials_file: is only supported for the vertex and vclaude providers",
+			"providers.vertex.impersonate_service_account: must be the email of a service account",
+			"providers.vertex.regions.us-central1.weight: must be >= 0",
+			"providers.vertex.regions.us-central1.max_concurrent_requests: must be >= 0",
+			"providers.vertex.regions.us-central1.models[0].rpm: must be >= 0",
+			"providers.vertex.regions.us-central1.models[0].burst: must be >= 0",
+			"providers.vertex.regions.us-central1.models[0].input_price: must be >= 0",
+			"providers.vertex.regions.us-central1.models[0].cached_input_price: must be >= 0",
+			`providers.vertex.regions.us-central1.models[0].postprocess[1]: unknown transform "strip-markdown"`,
+			"providers.vertex.regions.us-central1.models[0].slo.threshold: is required",
+			`providers.vertex.regions.us-central1.models[0].slo.window: invalid duration "10 minutes"`,
+			`providers.vertex.regions.us-central1.models[1]: name "gemini-1.5-pro" is already used by providers.vertex.regions.us-central1.models[0]`,
+			"providers.vertex.regions.us-central1.models[2].name: is required",
+			"providers.vertex.regions.us-central1.models[2].defaults.temperature: must be between 0 and 2",
+		} {
+			assert.ErrorContains(t, err, expected)
+		}
+	})
+
+	t.Run("Ignores unknown keys by default", func(t *testing.T) {
+		config := &Config{}
+		assert.NoError(t, ParseConfig([]byte("port: 8080\nretry_intervall: 1m\n"), config))
+		assert.Equal(t, 8080, config.Port)
+	})
+
+	t.Run("Rejects unknown keys in strict mode", func(t *testing.T) {
+		config := &Config{}
+		err := ParseConfig([]byte("strict_config: true\nport: 8080\nretry_intervall: 1m\n"), config)
+		assert.ErrorContains(t, err, "field retry_intervall not found")
+	})
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils/array"
+)
+
+type ConversationsConfig struct {
+	// Whether to keep the conversations on the server.
+	Enabled bool `yaml:"enabled"`
+
+	// Time to keep a conversation after its last turn. Defaults to 24h.
+	Ttl string `yaml:"ttl"`
+
+	// Number of the messages kept in a conversation, beyond which the oldest
+	// turns are dropped. System messages are always kept. Defaults to 200.
+	MaxMessages int `yaml:"max_messages"`
+
+	// Size of the messages kept in a conversation, in bytes of JSON, beyond
+	// which the oldest turns are dropped. Defaults to 1 MiB.
+	MaxBytes int `yaml:"max_bytes"`
+}
+
+const (
+	defaultConversationTtl         = 24 * time.Hour
+	defaultConversationMaxMessages = 200
+	defaultConversationMaxBytes    = 1 << 20
+
+	defaultConversationPageSize = 20
+	maxConversationPageSize     = 100
+
+	// Maximum time of a turn, after which its lock expires.
+	conversationLockDuration = 10 * time.Minute
+)
+
+// Conversation whose history is kept by the proxy, so that each turn only
+// sends the new message.
+type Conversation struct {
+	Id string `json:"id"`
+
+	// Model or fallback chain of the turns, unless a turn asks for another.
+	Model string `json:"model"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Number of the messages kept, and of those dropped to stay within the
+	// limits of the conversation.
+	MessageCount    int `json:"message_count"`
+	DroppedMessages int `json:"dropped_messages,omitempty"`
+}
+
+type CreateConversationRequest struct {
+	Model string `json:"model"`
+
+	// Messages that start the conversation, such as a system prompt.
+	Messages []openai.Message `json:"messages"`
+}
+
+// Page of the messages of a conversation, from the oldest.
+type ConversationResponse struct {
+	Conversation
+	Messages []openai.Message `json:"messages"`
+
+	// Cursor of the next page. Empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Message of a turn. The other fields of the body are the parameters of the
+// chat completion request, except for the messages.
+type conversationTurnFields struct {
+	Role    string                 `json:"role"`
+	Content *openai.MessageContent `json:"content"`
+}
+
+// Conversation as stored in the state manager, with the key that created it,
+// so that the other keys cannot see it.
+type conversationRecord struct {
+	// Hash of the secret of the API key. Empty if authentication is disabled.
+	Owner        string           `json:"owner"`
+	Conversation Conversation     `json:"conversation"`
+	Messages     []openai.Message `json:"messages"`
+}
+
+// Limits of the conversations. Nil if they are disabled.
+type conversationStore struct {
+	ttl         time.Duration
+	maxMessages int
+	maxBytes    int
+}
+
+func newConversationStore(config ConversationsConfig) *conversationStore {
+	if !config.Enabled {
+		return nil
+	}
+	ttl := defaultConversationTtl
+	if config.Ttl != "" {
+		// Validated with the config.
+		ttl, _ = time.ParseDuration(config.Ttl)
+	}
+	maxMessages := defaultConversationMaxMessages
+	if config.MaxMessages > 0 {
+		maxMessages = config.MaxMessages
+	}
+	maxBytes := defaultConversationMaxBytes
+	if config.MaxBytes > 0 {
+		maxBytes = config.MaxBytes
+	}
+	return &conversationStore{ttl: ttl, maxMessages: maxMessages, maxBytes: maxBytes}
+}
+
+func conversationKey(id string) string {
+	return "conversation:" + id
+}
+
+func conversationLockKey(id string) string {
+	return "conversation:" + id + ":lock"
+}
+
+// Groups the indices of the messages by turn, from the oldest: a user message
+// and the messages that answer it, including the tool calls and their
+// results. System messages are not in any turn.
+func conversationTurns(messages []openai.Message) [][]int {
+	turns := [][]int{}
+	for index, message := range messages {
+		switch {
+		case message.IsSystem():
+			continue
+		case message.Role == "user" || len(turns) == 0:
+			turns = append(turns, []int{index})
+		default:
+			turns[len(turns)-1] = append(turns[len(turns)-1], index)
+		}
+	}
+	return turns
+}
+
+// Drops the oldest turns until the conversation is within its limits, so
+// that the history never starts in the middle of a turn. System messages and
+// the last turn are always kept. Returns the number of the dropped messages.
+func (c *conversationStore) trim(record *conversationRecord) int {
+	size := func(messages []openai.Message) int {
+		data, _ := json.Marshal(messages)
+		return len(data)
+	}
+	messages := record.Messages
+	dropped := []int{}
+	turns := conversationTurns(messages)
+	for _, turn := range turns[:max(len(turns)-1, 0)] {
+		if len(messages)-len(dropped) <= c.maxMessages && size(record.Messages) <= c.maxBytes {
+			break
+		}
+		dropped = append(dropped, turn...)
+		record.Messages = []openai.Message{}
+		for index, message := range messages {
+			if !array.Contains(dropped, index) {
+				record.Messages = append(record.Messages, message)
+			}
+		}
+	}
+	return len(dropped)
+}
+
+func (s *ModelProxy) saveConversation(ctx context.Context, record *conversationRecord) error {
+	now := time.Now().UTC()
+	record.Conversation.DroppedMessages += s.conversations.trim(record)
+	record.Conversation.MessageCount = len(record.Messages)
+	record.Conversation.UpdatedAt = now
+	record.Conversation.ExpiresAt = now.Add(s.conversations.ttl)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation: %v", err)
+	}
+	return s.stateManager.SaveCache(ctx, conversationKey(record.Conversation.Id), data, s.conversations.ttl)
+}
+
+// Returns nil if the conversation does not exist, has expired or has been
+// deleted, or belongs to another key.
+func (s *ModelProxy) loadConversation(ctx context.Context, id string) (*conversationRecord, error) {
+	data, err := s.stateManager.LoadCache(ctx, conversationKey(id))
+	// A deleted conversation is left empty until it expires, since the state
+	// manager cannot delete.
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var record conversationRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse conversation: %v", err)
+	}
+	// The memory manager returns an expired entry once more.
+	if record.Owner != keyOwner(ctx) || time.Now().After(record.Conversation.ExpiresAt) {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func writeConversationNotFound(httpResponse http.ResponseWriter, id string) {
+	writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "conversation_not_found", fmt.Sprintf("No conversation has the ID %q", id))
+}
+
+// Whether the conversations are enabled. Responds with 404 if not.
+func (s *ModelProxy) checkConversationsEnabled(httpResponse http.ResponseWriter) bool {
+	if s.conversations == nil {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "conversations_disabled", "Conversations are not enabled")
+		return false
+	}
+	return true
+}
+
+func (s *ModelProxy) HandleCreateConversation(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+	if !s.checkConversationsEnabled(httpResponse) {
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+	var request CreateConversationRequest
+	if err := json.Unmarshal(bodyBytes, &request); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err)
+		writeBodyError(httpResponse, err)
+		return
+	}
+	if strings.TrimSpace(request.Model) == "" {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("model is required")})
+		return
+	}
+
+	now := time.Now().UTC()
+	record := &conversationRecord{
+		Owner: keyOwner(httpRequest.Context()),
+		Conversation: Conversation{
+			Id:        "conv-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Model:     strings.TrimSpace(request.Model),
+			CreatedAt: now,
+		},
+		Messages: request.Messages,
+	}
+	if record.Messages == nil {
+		record.Messages = []openai.Message{}
+	}
+	if err := s.saveConversation(httpRequest.Context(), record); err != nil {
+		s.logger.Warnw("Failed to save conversation", "error", err)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	s.logger.Infow("Created conversation", "conversation_id", record.Conversation.Id, "model", record.Conversation.Model, "api_key", apiKeyName(httpRequest.Context()))
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	httpResponse.Header().Set("Location", "/v1/conversations/"+record.Conversation.Id)
+	httpResponse.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(httpResponse).Encode(record.Conversation); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+	}
+}
+
+// Lists the messages of the conversation from the oldest, a page at a time.
+func (s *ModelProxy) HandleConversation(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	if !s.checkConversationsEnabled(httpResponse) {
+		return
+	}
+
+	query := httpRequest.URL.Query()
+	limit := defaultConversationPageSize
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxConversationPageSize {
+			handleError(httpResponse, BadRequestError{fmt.Errorf("limit must be between 1 and %d", maxConversationPageSize)})
+			return
+		}
+		limit = parsed
+	}
+	offset := 0
+	if value := query.Get("cursor"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			handleError(httpResponse, BadRequestError{fmt.Errorf("invalid cursor %q", value)})
+			return
+		}
+		offset = parsed
+	}
+
+	id := httpRequest.PathValue("id")
+	record, err := s.loadConversation(httpRequest.Context(), id)
+	if err != nil {
+		s.logger.Warnw("Failed to load conversation", "error", err, "conversation_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if record == nil {
+		writeConversationNotFound(httpResponse, id)
+		return
+	}
+
+	response := ConversationResponse{Conversation: record.Conversation, Messages: []openai.Message{}}
+	if offset < len(record.Messages) {
+		end := min(offset+limit, len(record.Messages))
+		response.Messages = record.Messages[offset:end]
+		if end < len(record.Messages) {
+			response.NextCursor = strconv.Itoa(end)
+		}
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Appends the message to the conversation and responds with the chat
+// completion of the whole history, whose reply is kept for the next turn.
+// The history is sent with the oldest messages dropped if it exceeds the
+// context window, but kept as it is.
+func (s *ModelProxy) HandleConversationMessage(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+	if !s.checkConversationsEnabled(httpResponse) {
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+	var fields conversationTurnFields
+	var chatRequest openai.ChatCompletionRequest
+	if err := json.Unmarshal(bodyBytes, &fields); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err)
+		writeBodyError(httpResponse, err)
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &chatRequest); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err)
+		writeBodyError(httpResponse, err)
+		return
+	}
+	switch {
+	case fields.Content == nil:
+		handleError(httpResponse, BadRequestError{fmt.Errorf("content is required")})
+		return
+	case fields.Role != "" && fields.Role != "user":
+		handleError(httpResponse, BadRequestError{fmt.Errorf("role must be user")})
+		return
+	case len(chatRequest.Messages) > 0:
+		handleError(httpResponse, BadRequestError{fmt.Errorf("messages cannot be sent; the conversation keeps the history")})
+		return
+	case chatRequest.Stream != nil && *chatRequest.Stream:
+		handleError(httpResponse, BadRequestError{fmt.Errorf("conversation turns cannot be streamed")})
+		return
+	}
+
+	ctx := httpRequest.Context()
+	id := httpRequest.PathValue("id")
+	acquired, err := s.stateManager.AcquireLock(ctx, conversationLockKey(id), conversationLockDuration)
+	if err != nil {
+		s.logger.Warnw("Failed to lock conversation", "error", err, "conversation_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if !acquired {
+		writeError(httpResponse, http.StatusConflict, errorTypeInvalidRequest, "conversation_busy", "Another turn of the conversation is in progress; retry later")
+		return
+	}
+	defer func() {
+		if err := s.stateManager.ReleaseLock(context.Background(), conversationLockKey(id)); err != nil {
+			s.logger.Warnw("Failed to release conversation lock", "error", err, "conversation_id", id)
+		}
+	}()
+
+	record, err := s.loadConversation(ctx, id)
+	if err != nil {
+		s.logger.Warnw("Failed to load conversation", "error", err, "conversation_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if record == nil {
+		writeConversationNotFound(httpResponse, id)
+		return
+	}
+
+	message := openai.Message{Role: "user", Content: fields.Content}
+	if chatRequest.Model == "" {
+		chatRequest.Model = record.Conversation.Model
+	}
+	chatRequest.Messages = append(append([]openai.Message{}, record.Messages...), message)
+	chatBody, err := json.Marshal(chatRequest)
+	if err != nil {
+		s.logger.Errorw("Failed to encode chat completion request", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+		return
+	}
+
+	chatHttpRequest := httpRequest.Clone(ctx)
+	chatHttpRequest.Body = io.NopCloser(bytes.NewReader(chatBody))
+	chatHttpRequest.ContentLength = int64(len(chatBody))
+	chatHttpRequest.Header.Set("X-Ogem-Truncate", truncateOldest)
+	chatHttpRequest.Header.Del("X-Ogem-Async")
+	buffered := &bufferedWriter{ResponseWriter: httpResponse}
+	s.HandleChatCompletions(buffered, chatHttpRequest)
+
+	// The history is only extended by the turns that succeed, so that a
+	// failed one can be sent again.
+	if buffered.status != http.StatusOK {
+		httpResponse.WriteHeader(buffered.status)
+		httpResponse.Write(buffered.body.Bytes())
+		return
+	}
+	var chatResponse openai.ChatCompletionResponse
+	if err := json.Unmarshal(buffered.body.Bytes(), &chatResponse); err != nil || len(chatResponse.Choices) == 0 {
+		s.logger.Errorw("Failed to decode chat completion response", "error", err, "conversation_id", id)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+		return
+	}
+	record.Messages = append(record.Messages, message, chatResponse.Choices[0].Message)
+	if err := s.saveConversation(ctx, record); err != nil {
+		s.logger.Warnw("Failed to save conversation", "error", err, "conversation_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+
+	httpResponse.Header().Set("X-Ogem-Conversation-Id", id)
+	httpResponse.Write(buffered.body.Bytes())
+}
+
+// Purges the messages of the conversation.
+func (s *ModelProxy) HandleDeleteConversation(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	if !s.checkConversationsEnabled(httpResponse) {
+		return
+	}
+
+	id := httpRequest.PathValue("id")
+	record, err := s.loadConversation(httpRequest.Context(), id)
+	if err != nil {
+		s.logger.Warnw("Failed to load conversation", "error", err, "conversation_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if record == nil {
+		writeConversationNotFound(httpResponse, id)
+		return
+	}
+	if err := s.stateManager.SaveCache(httpRequest.Context(), conversationKey(id), nil, s.conversations.ttl); err != nil {
+		s.logger.Warnw("Failed to delete conversation", "error", err, "conversation_id", id)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	s.logger.Infow("Deleted conversation", "conversation_id", id, "api_key", apiKeyName(httpRequest.Context()))
+	httpResponse.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestConversations(t *testing.T) {
+	// Replies with the number of the messages it received.
+	newProxy := func(t *testing.T, config ConversationsConfig, maxContextTokens int) (*ModelProxy, *fakeEndpoint) {
+		generate := func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			if strings.Contains(*request.Messages[len(request.Messages)-1].Content.String, "fail") {
+				return nil, provider.NewInvalidRequestError(fmt.Errorf("not today"))
+			}
+			return &openai.ChatCompletionResponse{
+				Model: request.Model,
+				Choices: []openai.Choice{{
+					Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr(fmt.Sprintf("%d messages", len(request.Messages)))}},
+					FinishReason: "stop",
+				}},
+			}, nil
+		}
+		model := &ogem.SupportedModel{Name: "fake-model"}
+		if maxContextTokens > 0 {
+			model.Capabilities = &ogem.Capabilities{MaxContextTokens: maxContextTokens}
+		}
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", model, generate)
+		config.Enabled = true
+		proxy.conversations = newConversationStore(config)
+		proxy.config.ApiKeys = []ApiKey{{Name: "search", Key: "key-a"}, {Name: "chat", Key: "key-b"}}
+		proxy.indexApiKeys()
+		return proxy, endpoint
+	}
+	send := func(proxy *ModelProxy, apiKey string, method string, target string, body string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /v1/conversations", proxy.HandleAuthentication(proxy.HandleCreateConversation))
+		mux.HandleFunc("GET /v1/conversations/{id}", proxy.HandleAuthentication(proxy.HandleConversation))
+		mux.HandleFunc("POST /v1/conversations/{id}/messages", proxy.HandleAuthentication(proxy.HandleConversationMessage))
+		mux.HandleFunc("DELETE /v1/conversations/{id}", proxy.HandleAuthentication(proxy.HandleDeleteConversation))
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+apiKey)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	create := func(proxy *ModelProxy, apiKey string) Conversation {
+		recorder := send(proxy, apiKey, "POST", "/v1/conversations", `{"model": "fake-model", "messages": [{"role": "system", "content": "Be brief."}]}`)
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+		var conversation Conversation
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &conversation))
+		assert.Equal(t, "/v1/conversations/"+conversation.Id, recorder.Header().Get("Location"))
+		return conversation
+	}
+	turn := func(proxy *ModelProxy, apiKey string, id string, content string) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		recorder := send(proxy, apiKey, "POST", "/v1/conversations/"+id+"/messages", fmt.Sprintf(`{"content": %q, "max_tokens": 10}`, content))
+		return recorder, decodeChatCompletion(recorder)
+	}
+	list := func(proxy *ModelProxy, apiKey string, id string, query string) ConversationResponse {
+		recorder := send(proxy, apiKey, "GET", "/v1/conversations/"+id+query, "")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		var response ConversationResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		return response
+	}
+	contents := func(messages []openai.Message) []string {
+		texts := []string{}
+		for _, message := range messages {
+			texts = append(texts, message.Role+": "+*message.Content.String)
+		}
+		return texts
+	}
+
+	t.Run("Accumulates the turns", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, ConversationsConfig{}, 0)
+		conversation := create(proxy, "key-a")
+		assert.Equal(t, "fake-model", conversation.Model)
+		assert.Equal(t, 1, conversation.MessageCount)
+
+		recorder, response := turn(proxy, "key-a", conversation.Id, "Hi")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, conversation.Id, recorder.Header().Get("X-Ogem-Conversation-Id"))
+		assert.Equal(t, "2 messages", *response.Choices[0].Message.Content.String)
+
+		_, response = turn(proxy, "key-a", conversation.Id, "And then?")
+		assert.Equal(t, "4 messages", *response.Choices[0].Message.Content.String)
+		sent := endpoint.receivedRequests()[1]
+		assert.Equal(t, []string{"system: Be brief.", "user: Hi", "assistant: 2 messages", "user: And then?"}, contents(sent.Messages))
+		assert.Equal(t, int32(10), *sent.MaxTokens)
+
+		// A failed turn is not kept.
+		recorder, _ = turn(proxy, "key-a", conversation.Id, "Now fail")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		page := list(proxy, "key-a", conversation.Id, "?limit=3")
+		assert.Equal(t, 5, page.MessageCount)
+		assert.Equal(t, []string{"system: Be brief.", "user: Hi", "assistant: 2 messages"}, contents(page.Messages))
+		assert.Equal(t, "3", page.NextCursor)
+		page = list(proxy, "key-a", conversation.Id, "?limit=3&cursor="+page.NextCursor)
+		assert.Equal(t, []string{"user: And then?", "assistant: 4 messages"}, contents(page.Messages))
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("Trims the history to the context window", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, ConversationsConfig{}, 200)
+		conversation := create(proxy, "key-a")
+
+		// About 100 tokens each, so that only the last one fits.
+		long := strings.Repeat("hello ", 100)
+		for range 3 {
+			recorder, _ := turn(proxy, "key-a", conversation.Id, long)
+			assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		sent := endpoint.receivedRequests()[2]
+		assert.Equal(t, "system", sent.Messages[0].Role)
+		assert.Less(t, len(sent.Messages), 6)
+
+		// The history is kept whole.
+		assert.Equal(t, 7, list(proxy, "key-a", conversation.Id, "").MessageCount)
+	})
+
+	t.Run("Drops the oldest messages beyond the limits", func(t *testing.T) {
+		proxy, _ := newProxy(t, ConversationsConfig{MaxMessages: 4}, 0)
+		conversation := create(proxy, "key-a")
+
+		for _, content := range []string{"One", "Two", "Three"} {
+			turn(proxy, "key-a", conversation.Id, content)
+		}
+		page := list(proxy, "key-a", conversation.Id, "")
+		assert.Equal(t, []string{"system: Be brief.", "user: Three", "assistant: 4 messages"}, contents(page.Messages))
+		assert.Equal(t, 4, page.DroppedMessages)
+	})
+
+	t.Run("Keeps the conversations of each key apart", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, ConversationsConfig{}, 0)
+		conversation := create(proxy, "key-a")
+
+		recorder, _ := turn(proxy, "key-b", conversation.Id, "Hi")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "conversation_not_found")
+		assert.Equal(t, http.StatusNotFound, send(proxy, "key-b", "GET", "/v1/conversations/"+conversation.Id, "").Code)
+		assert.Equal(t, http.StatusNotFound, send(proxy, "key-b", "DELETE", "/v1/conversations/"+conversation.Id, "").Code)
+		assert.Empty(t, endpoint.receivedRequests())
+
+		assert.Equal(t, 1, list(proxy, "key-a", conversation.Id, "").MessageCount)
+	})
+
+	t.Run("Deletes the conversation", func(t *testing.T) {
+		proxy, _ := newProxy(t, ConversationsConfig{}, 0)
+		conversation := create(proxy, "key-a")
+
+		assert.Equal(t, http.StatusNoContent, send(proxy, "key-a", "DELETE", "/v1/conversations/"+conversation.Id, "").Code)
+		assert.Equal(t, http.StatusNotFound, send(proxy, "key-a", "GET", "/v1/conversations/"+conversation.Id, "").Code)
+		recorder, _ := turn(proxy, "key-a", conversation.Id, "Hi")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("Expires after the TTL", func(t *testing.T) {
+		proxy, _ := newProxy(t, ConversationsConfig{Ttl: "50ms"}, 0)
+		conversation := create(proxy, "key-a")
+		assert.WithinDuration(t, time.Now().Add(50*time.Millisecond), conversation.ExpiresAt, time.Second)
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, http.StatusNotFound, send(proxy, "key-a", "GET", "/v1/conversations/"+conversation.Id, "").Code)
+	})
+
+	t.Run("Rejects what a turn cannot have", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, ConversationsConfig{}, 0)
+		conversation := create(proxy, "key-a")
+
+		for body, message := range map[string]string{
+			`{}`:                                     "content is required",
+			`{"role": "assistant", "content": "Hi"}`: "role must be user",
+			`{"content": "Hi", "messages": [{"role": "user", "content": "Hi"}]}`: "the conversation keeps the history",
+			`{"content": "Hi", "stream": true}`:                                  "cannot be streamed",
+		} {
+			recorder := send(proxy, "key-a", "POST", "/v1/conversations/"+conversation.Id+"/messages", body)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, body)
+			assert.Contains(t, recorder.Body.String(), message, body)
+		}
+		assert.Equal(t, http.StatusBadRequest, send(proxy, "key-a", "POST", "/v1/conversations", `{"messages": []}`).Code)
+		assert.Empty(t, endpoint.receivedRequests())
+
+		proxy.conversations = nil
+		assert.Equal(t, http.StatusNotFound, send(proxy, "key-a", "POST", "/v1/conversations", `{"model": "fake-model"}`).Code)
+	})
+}
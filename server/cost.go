@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/tokenizer"
+)
+
+// Token counts of the cost estimate request given instead of the messages.
+type costEstimateFields struct {
+	// Number of prompt tokens. Counted from the messages if nil.
+	PromptTokens *int32 `json:"prompt_tokens"`
+
+	// Number of completion tokens. Falls back to max_completion_tokens,
+	// max_tokens, and then the max_tokens default of the model.
+	CompletionTokens *int32 `json:"completion_tokens"`
+}
+
+func (s *ModelProxy) HandleCostEstimate(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+
+	var openAiRequest openai.ChatCompletionRequest
+	if err := json.Unmarshal(bodyBytes, &openAiRequest); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err, "body", string(bodyBytes))
+		writeBodyError(httpResponse, err)
+		return
+	}
+	var fields costEstimateFields
+	if err := json.Unmarshal(bodyBytes, &fields); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err, "body", string(bodyBytes))
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+
+	estimateResponse, err := s.estimateCost(httpRequest.Context(), &openAiRequest, fields)
+	if err != nil {
+		handleError(httpResponse, err)
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(estimateResponse); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Estimates the cost of the request on every endpoint that may serve a model
+// of its fallback chain. The prompt tokens are counted with the tokenizer of
+// each endpoint, the same as the token count endpoint.
+func (s *ModelProxy) estimateCost(ctx context.Context, openAiRequest *openai.ChatCompletionRequest, fields costEstimateFields) (*openai.CostEstimateResponse, error) {
+	estimateResponse := &openai.CostEstimateResponse{Candidates: []openai.CostCandidate{}}
+	var estimated *openai.TokenCountResponse
+	for _, model := range strings.Split(openAiRequest.Model, ",") {
+		model = strings.TrimSpace(model)
+		endpointProvider, endpointRegion, modelOrAlias, err := parseModelIdentifier(model)
+		if err != nil {
+			s.logger.Warnw("Invalid model name", "error", err, "model", model)
+			return nil, BadRequestError{fmt.Errorf("invalid model name: %s", model)}
+		}
+
+		endpoints, err := s.sortedEndpoints(endpointProvider, endpointRegion, modelOrAlias)
+		if err != nil {
+			s.logger.Warnw("Failed to select endpoint", "error", err, "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias)
+			continue
+		}
+
+		for _, endpoint := range endpoints {
+			candidate := openai.CostCandidate{
+				RequestedModel: model,
+				Provider:       endpoint.endpoint.Provider(),
+				Region:         endpoint.endpoint.Region(),
+				Model:          endpoint.modelStatus.Name,
+				InputPrice:     endpoint.modelStatus.InputPrice,
+				OutputPrice:    endpoint.modelStatus.OutputPrice,
+				Unpriced:       endpoint.modelStatus.InputPrice == 0 && endpoint.modelStatus.OutputPrice == 0,
+			}
+
+			if fields.PromptTokens != nil {
+				candidate.PromptTokens = *fields.PromptTokens
+			} else if countResponse := s.countEndpointTokens(ctx, endpoint, openAiRequest); countResponse != nil {
+				candidate.PromptTokens = countResponse.PromptTokens
+				candidate.Estimated = countResponse.Estimated
+			} else {
+				if estimated == nil {
+					estimated = tokenizer.Estimate(openAiRequest)
+				}
+				candidate.PromptTokens = estimated.PromptTokens
+				candidate.Estimated = true
+			}
+
+			switch {
+			case fields.CompletionTokens != nil:
+				candidate.CompletionTokens = *fields.CompletionTokens
+			case openAiRequest.MaxCompletionTokens != nil:
+				candidate.CompletionTokens = *openAiRequest.MaxCompletionTokens
+			case openAiRequest.MaxTokens != nil:
+				candidate.CompletionTokens = *openAiRequest.MaxTokens
+			case endpoint.modelStatus.Defaults != nil && endpoint.modelStatus.Defaults.MaxTokens != nil:
+				candidate.CompletionTokens = *endpoint.modelStatus.Defaults.MaxTokens
+			}
+
+			// Every choice is billed for its completion, and also for the
+			// prompt if the choices are emulated with separate requests.
+			choices := int32(requestedChoices(openAiRequest))
+			candidate.CompletionTokens *= choices
+			if choices > 1 && !endpoint.modelStatus.ResolvedCapabilities().MultipleChoicesSupported() {
+				candidate.PromptTokens *= choices
+			}
+
+			candidate.Cost = tokenCost(endpoint.modelStatus, candidate.PromptTokens, candidate.CompletionTokens)
+			estimateResponse.Candidates = append(estimateResponse.Candidates, candidate)
+		}
+	}
+
+	if len(estimateResponse.Candidates) == 0 {
+		return nil, BadRequestError{fmt.Errorf("no endpoints serve %s", openAiRequest.Model)}
+	}
+
+	// Routing tries the models of the chain in order and the endpoints of a
+	// model from the fastest.
+	estimateResponse.Predicted = &estimateResponse.Candidates[0]
+	for index, candidate := range estimateResponse.Candidates {
+		if candidate.Unpriced {
+			continue
+		}
+		if estimateResponse.Cheapest == nil || candidate.Cost < estimateResponse.Cheapest.Cost {
+			estimateResponse.Cheapest = &estimateResponse.Candidates[index]
+		}
+	}
+	return estimateResponse, nil
+}
+
+// Returns the cost of the response as charged by the provider if it reports
+// it, or else of its tokens with the prices of the model. Zero if neither is
+// known.
+func responseCost(model *ogem.SupportedModel, usage openai.Usage) float64 {
+	if usage.Cost != nil {
+		return *usage.Cost
+	}
+	if model == nil {
+		return 0
+	}
+	if usage.PromptTokensDetails == nil || model.CachedInputPrice == 0 {
+		return tokenCost(model, usage.PromptTokens, usage.CompletionTokens)
+	}
+	// The cached tokens are part of the prompt tokens, billed at their own
+	// price.
+	cachedTokens := usage.PromptTokensDetails.CachedTokens
+	cachedCost := float64(cachedTokens) * model.CachedInputPrice / 1_000_000
+	return tokenCost(model, usage.PromptTokens-cachedTokens, usage.CompletionTokens) + cachedCost
+}
+
+// Returns the cost of the tokens with the prices of the model, which are per
+// million tokens.
+func tokenCost(model *ogem.SupportedModel, promptTokens int32, completionTokens int32) float64 {
+	return (float64(promptTokens)*model.InputPrice + float64(completionTokens)*model.OutputPrice) / 1_000_000
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestHandleCostEstimate(t *testing.T) {
+	// The alias "smart" is served by two providers with different prices.
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+			Latency:     10 * time.Millisecond,
+			LastChecked: time.Now(),
+			Models: []*ogem.SupportedModel{
+				{Name: "gpt-4o", OtherNames: []string{"smart"}, InputPrice: 2.5, OutputPrice: 10},
+				{Name: "gpt-4o-mini", OtherNames: []string{"cheap"}, InputPrice: 0.15, OutputPrice: 0.6},
+			},
+		}}},
+		"claude": {Regions: map[string]*ogem.RegionStatus{"claude": {
+			Latency:     20 * time.Millisecond,
+			LastChecked: time.Now(),
+			Models: []*ogem.SupportedModel{
+				{Name: "claude-3-5-sonnet", OtherNames: []string{"smart"}, InputPrice: 3, OutputPrice: 15},
+			},
+		}}},
+		"self": {Regions: map[string]*ogem.RegionStatus{"self": {
+			Latency:     5 * time.Millisecond,
+			LastChecked: time.Now(),
+			Models: []*ogem.SupportedModel{
+				{Name: "llama", OtherNames: []string{"cheap"}, Defaults: &ogem.ModelDefaults{MaxTokens: utils.ToPtr(int32(300))}},
+			},
+		}}},
+	},
+		&fakeCountingEndpoint{&fakeEndpoint{provider: "openai", region: "openai"}},
+		&fakeEndpoint{provider: "claude", region: "claude"},
+		&fakeEndpoint{provider: "self", region: "self"},
+	)
+
+	estimateCost := func(body string) (int, openai.CostEstimateResponse) {
+		recorder := httptest.NewRecorder()
+		proxy.HandleCostEstimate(recorder, httptest.NewRequest("POST", "/v1/cost/estimate", strings.NewReader(body)))
+		var response openai.CostEstimateResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	t.Run("Lists every provider of an alias", func(t *testing.T) {
+		status, response := estimateCost(`{"model": "smart", "prompt_tokens": 1000000, "completion_tokens": 100000}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, response.Candidates, 2)
+
+		assert.Equal(t, "openai", response.Candidates[0].Provider)
+		assert.Equal(t, "gpt-4o", response.Candidates[0].Model)
+		assert.InDelta(t, 3.5, response.Candidates[0].Cost, 1e-9)
+		assert.Equal(t, "claude", response.Candidates[1].Provider)
+		assert.Equal(t, "claude-3-5-sonnet", response.Candidates[1].Model)
+		assert.InDelta(t, 4.5, response.Candidates[1].Cost, 1e-9)
+
+		assert.Equal(t, "openai", response.Cheapest.Provider)
+		assert.Equal(t, "openai", response.Predicted.Provider)
+	})
+
+	t.Run("Counts the messages with the tokenizer of each endpoint", func(t *testing.T) {
+		status, response := estimateCost(`{"model": "smart", "max_tokens": 10, "messages": [{"role": "user", "content": "Hello, world!"}]}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, response.Candidates, 2)
+
+		assert.Equal(t, int32(42), response.Candidates[0].PromptTokens)
+		assert.False(t, response.Candidates[0].Estimated)
+		assert.Equal(t, int32(11), response.Candidates[1].PromptTokens)
+		assert.True(t, response.Candidates[1].Estimated)
+		assert.Equal(t, int32(10), response.Candidates[1].CompletionTokens)
+	})
+
+	t.Run("Covers the fallback chain and the routing prefixes", func(t *testing.T) {
+		status, response := estimateCost(`{"model": "claude/smart, cheap", "prompt_tokens": 1000000}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, response.Candidates, 3)
+
+		assert.Equal(t, "claude/smart", response.Candidates[0].RequestedModel)
+		assert.Equal(t, "claude", response.Candidates[0].Provider)
+		assert.Equal(t, "cheap", response.Candidates[1].RequestedModel)
+		assert.Equal(t, "self", response.Candidates[1].Provider)
+		assert.True(t, response.Candidates[1].Unpriced)
+		assert.Equal(t, int32(300), response.Candidates[1].CompletionTokens)
+		assert.Equal(t, "openai", response.Candidates[2].Provider)
+
+		// The unpriced candidate is not the cheapest even though it costs nothing.
+		assert.Equal(t, "gpt-4o-mini", response.Cheapest.Model)
+		assert.Equal(t, "claude", response.Predicted.Provider)
+	})
+
+	t.Run("Multiplies the cost by the number of choices", func(t *testing.T) {
+		status, response := estimateCost(`{"model": "smart", "n": 2, "prompt_tokens": 1000000, "completion_tokens": 100000}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, response.Candidates, 2)
+
+		// GPT generates the choices at once and reads the prompt once.
+		assert.Equal(t, int32(1000000), response.Candidates[0].PromptTokens)
+		assert.Equal(t, int32(200000), response.Candidates[0].CompletionTokens)
+		assert.InDelta(t, 4.5, response.Candidates[0].Cost, 1e-9)
+
+		// Claude needs a request for each choice.
+		assert.Equal(t, int32(2000000), response.Candidates[1].PromptTokens)
+		assert.Equal(t, int32(200000), response.Candidates[1].CompletionTokens)
+		assert.InDelta(t, 9, response.Candidates[1].Cost, 1e-9)
+	})
+
+	t.Run("Rejects unknown models", func(t *testing.T) {
+		status, _ := estimateCost(`{"model": "unknown", "prompt_tokens": 10}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Rejects invalid bodies", func(t *testing.T) {
+		status, _ := estimateCost(`{"model": `)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+}
+
+func TestResponseCost(t *testing.T) {
+	model := &ogem.SupportedModel{InputPrice: 1.25, OutputPrice: 5}
+	usage := openai.Usage{
+		PromptTokens:        1_000_000,
+		CompletionTokens:    100_000,
+		PromptTokensDetails: &openai.PromptTokensDetails{CachedTokens: 800_000},
+	}
+
+	t.Run("Bills the cached tokens at the full price without a cached price", func(t *testing.T) {
+		assert.InDelta(t, 1.25+0.5, responseCost(model, usage), 1e-9)
+	})
+
+	t.Run("Bills the cached tokens at the cached price", func(t *testing.T) {
+		cached := *model
+		cached.CachedInputPrice = 0.3125
+		assert.InDelta(t, 0.2*1.25+0.8*0.3125+0.5, responseCost(&cached, usage), 1e-9)
+	})
+
+	t.Run("Prefers the cost reported by the provider", func(t *testing.T) {
+		reported := usage
+		reported.Cost = utils.ToPtr(0.01)
+		assert.Equal(t, 0.01, responseCost(model, reported))
+	})
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+const (
+	deprecationRedirect = "redirect"
+	deprecationReject   = "reject"
+)
+
+// Retirement of a model snapshot by its provider.
+type Deprecation struct {
+	// Model to retire, matched against the model of the request with or
+	// without its provider and region. E.g., gpt-4-0613
+	Model string `yaml:"model"`
+
+	// Model that serves the requests for the retired model after the cutoff,
+	// in any form accepted in requests. E.g., gpt-4o
+	RedirectTo string `yaml:"redirect_to"`
+
+	// Cutoff from which the model is retired, as a date in UTC or in RFC 3339.
+	// E.g., 2025-07-01
+	After string `yaml:"after"`
+
+	// Whether to tell the callers of the model in the X-Ogem-Deprecation
+	// header.
+	Warn bool `yaml:"warn"`
+
+	// What happens to the requests after the cutoff: redirect (default) to
+	// serve them with redirect_to, or reject to fail them with 400.
+	Mode string `yaml:"mode"`
+}
+
+// Requests for a deprecated model since the start of this instance.
+type DeprecationStats struct {
+	Model      string `json:"model"`
+	RedirectTo string `json:"redirect_to,omitempty"`
+	After      string `json:"after"`
+	Mode       string `json:"mode"`
+
+	// Number of the requests served by the model before the cutoff, and of
+	// those redirected or rejected after it.
+	Warned     int64 `json:"warned"`
+	Redirected int64 `json:"redirected"`
+	Rejected   int64 `json:"rejected"`
+}
+
+type DeprecationsResponse struct {
+	Deprecations []DeprecationStats `json:"deprecations"`
+}
+
+type deprecation struct {
+	config Deprecation
+	cutoff time.Time
+	stats  DeprecationStats
+}
+
+// Deprecations of the config by model. Nil if none is configured.
+type deprecationTable struct {
+	deprecations []*deprecation
+	mutex        sync.Mutex
+}
+
+// Parses the cutoff as a date, which starts at midnight UTC, or as a time in
+// RFC 3339.
+func parseCutoff(value string) (time.Time, error) {
+	if cutoff, err := time.Parse(time.DateOnly, value); err == nil {
+		return cutoff, nil
+	}
+	cutoff, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q; must be a date (YYYY-MM-DD) or in RFC 3339", value)
+	}
+	return cutoff, nil
+}
+
+func newDeprecationTable(configs []Deprecation) (*deprecationTable, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	table := &deprecationTable{}
+	for _, config := range configs {
+		cutoff, err := parseCutoff(config.After)
+		if err != nil {
+			return nil, fmt.Errorf("deprecation of %s: %v", config.Model, err)
+		}
+		if config.Mode == "" {
+			config.Mode = deprecationRedirect
+		}
+		table.deprecations = append(table.deprecations, &deprecation{
+			config: config,
+			cutoff: cutoff,
+			stats: DeprecationStats{
+				Model:      config.Model,
+				RedirectTo: config.RedirectTo,
+				After:      config.After,
+				Mode:       config.Mode,
+			},
+		})
+	}
+	return table, nil
+}
+
+// Returns the deprecation of the model identifier, which matches either as a
+// whole or by its model name. Nil if the model is not deprecated.
+func (t *deprecationTable) find(model string) *deprecation {
+	if t == nil {
+		return nil
+	}
+	_, _, modelName, err := parseModelIdentifier(model)
+	for _, deprecation := range t.deprecations {
+		if deprecation.config.Model == model || (err == nil && deprecation.config.Model == modelName) {
+			return deprecation
+		}
+	}
+	return nil
+}
+
+func (t *deprecationTable) record(update func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	update()
+}
+
+func (t *deprecationTable) snapshot() []DeprecationStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := make([]DeprecationStats, len(t.deprecations))
+	for index, deprecation := range t.deprecations {
+		stats[index] = deprecation.stats
+	}
+	return stats
+}
+
+// Applies the deprecation of the requested model, if any, before it is
+// routed, so that a redirect is served by the endpoints of its target. The
+// model of the request is rewritten to the target after the cutoff in the
+// redirect mode, and a BadRequestError is returned in the reject mode.
+func (s *ModelProxy) applyDeprecation(ctx context.Context, httpResponse http.ResponseWriter, request *openai.ChatCompletionRequest) error {
+	deprecation := s.deprecations.find(request.Model)
+	if deprecation == nil {
+		return nil
+	}
+	config := deprecation.config
+
+	if time.Now().Before(deprecation.cutoff) {
+		s.deprecations.record(func() { deprecation.stats.Warned++ })
+		if config.Warn {
+			warning := fmt.Sprintf("%s is deprecated and will be retired on %s", request.Model, config.After)
+			if config.RedirectTo != "" {
+				warning += fmt.Sprintf("; use %s", config.RedirectTo)
+			}
+			httpResponse.Header().Add("X-Ogem-Deprecation", warning)
+		}
+		return nil
+	}
+
+	if config.Mode == deprecationReject {
+		s.deprecations.record(func() { deprecation.stats.Rejected++ })
+		message := fmt.Sprintf("the model %s was retired on %s", request.Model, config.After)
+		if config.RedirectTo != "" {
+			message += fmt.Sprintf("; use %s", config.RedirectTo)
+		}
+		return BadRequestError{fmt.Errorf("%s", message)}
+	}
+
+	s.deprecations.record(func() { deprecation.stats.Redirected++ })
+	s.logger.Infow("Redirected deprecated model", "model", request.Model, "redirect_to", config.RedirectTo, "api_key", apiKeyName(ctx), "client_ip", clientIpFrom(ctx))
+	if config.Warn {
+		httpResponse.Header().Add("X-Ogem-Deprecation", fmt.Sprintf("%s was retired on %s and redirected to %s", request.Model, config.After, config.RedirectTo))
+	}
+	request.Model = config.RedirectTo
+	return nil
+}
+
+func (s *ModelProxy) HandleDeprecations(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	response := DeprecationsResponse{Deprecations: []DeprecationStats{}}
+	if s.deprecations != nil {
+		response.Deprecations = s.deprecations.snapshot()
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestDeprecations(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"openai": {Regions: map[string]*ogem.RegionStatus{
+			"openai": {Models: []*ogem.SupportedModel{{Name: "gpt-4-0613"}, {Name: "gpt-4o"}}},
+		}},
+		"claude": {Regions: map[string]*ogem.RegionStatus{
+			"claude": {Models: []*ogem.SupportedModel{{Name: "claude-3-5-sonnet"}}},
+		}},
+	}
+
+	newProxy := func(t *testing.T, deprecations ...Deprecation) (*ModelProxy, *fakeEndpoint, *fakeEndpoint) {
+		openaiEndpoint := &fakeEndpoint{provider: "openai", region: "openai"}
+		claudeEndpoint := &fakeEndpoint{provider: "claude", region: "claude"}
+		proxy := newTestProxy(t, providers, openaiEndpoint, claudeEndpoint)
+		table, err := newDeprecationTable(deprecations)
+		assert.NoError(t, err)
+		proxy.deprecations = table
+		return proxy, openaiEndpoint, claudeEndpoint
+	}
+
+	chatCompletions := func(proxy *ModelProxy, model string) *httptest.ResponseRecorder {
+		body := `{"model": "` + model + `", "messages": [{"role": "user", "content": "Hi"}]}`
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder
+	}
+
+	t.Run("Warns before the cutoff", func(t *testing.T) {
+		proxy, openaiEndpoint, _ := newProxy(t, Deprecation{Model: "gpt-4-0613", RedirectTo: "gpt-4o", After: "2999-07-01", Warn: true})
+
+		recorder := chatCompletions(proxy, "gpt-4-0613")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "gpt-4-0613 is deprecated and will be retired on 2999-07-01; use gpt-4o", recorder.Header().Get("X-Ogem-Deprecation"))
+		assert.Equal(t, "openai/openai/gpt-4-0613", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Equal(t, "gpt-4-0613", openaiEndpoint.receivedRequests()[0].Model)
+
+		recorder = chatCompletions(proxy, "gpt-4o")
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Deprecation"))
+	})
+
+	t.Run("Does not warn unless asked", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, Deprecation{Model: "gpt-4-0613", RedirectTo: "gpt-4o", After: "2999-07-01"})
+
+		recorder := chatCompletions(proxy, "gpt-4-0613")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Deprecation"))
+		assert.Equal(t, int64(1), proxy.deprecations.snapshot()[0].Warned)
+	})
+
+	t.Run("Redirects to the provider of the target after the cutoff", func(t *testing.T) {
+		proxy, openaiEndpoint, claudeEndpoint := newProxy(t, Deprecation{Model: "gpt-4-0613", RedirectTo: "claude-3-5-sonnet", After: "2025-07-01", Warn: true})
+
+		recorder := chatCompletions(proxy, "openai/gpt-4-0613")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "claude/claude/claude-3-5-sonnet", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Equal(t, "openai/gpt-4-0613 was retired on 2025-07-01 and redirected to claude-3-5-sonnet", recorder.Header().Get("X-Ogem-Deprecation"))
+		assert.Empty(t, openaiEndpoint.receivedRequests())
+		assert.Equal(t, "claude-3-5-sonnet", claudeEndpoint.receivedRequests()[0].Model)
+
+		var response openai.ChatCompletionResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		assert.Equal(t, "openai/gpt-4-0613", response.Model)
+	})
+
+	t.Run("Rejects after the cutoff in the reject mode", func(t *testing.T) {
+		proxy, openaiEndpoint, _ := newProxy(t, Deprecation{Model: "gpt-4-0613", RedirectTo: "gpt-4o", After: "2025-07-01T09:00:00Z", Mode: "reject"})
+
+		recorder := chatCompletions(proxy, "gpt-4-0613")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "the model gpt-4-0613 was retired on 2025-07-01T09:00:00Z; use gpt-4o")
+		assert.Empty(t, openaiEndpoint.receivedRequests())
+
+		recorder = chatCompletions(proxy, "gpt-4-0613,gpt-4o")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "openai/openai/gpt-4o", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Counts the requests", func(t *testing.T) {
+		proxy, _, _ := newProxy(t,
+			Deprecation{Model: "gpt-4-0613", RedirectTo: "gpt-4o", After: "2025-07-01"},
+			Deprecation{Model: "claude-3-5-sonnet", After: "2999-01-01", Mode: "reject"},
+		)
+		chatCompletions(proxy, "gpt-4-0613")
+		chatCompletions(proxy, "gpt-4-0613")
+		chatCompletions(proxy, "claude-3-5-sonnet")
+
+		recorder := httptest.NewRecorder()
+		proxy.HandleDeprecations(recorder, httptest.NewRequest("GET", "/v1/admin/deprecations", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.JSONEq(t, `{"deprecations": [
+			{"model": "gpt-4-0613", "redirect_to": "gpt-4o", "after": "2025-07-01", "mode": "redirect", "warned": 0, "redirected": 2, "rejected": 0},
+			{"model": "claude-3-5-sonnet", "after": "2999-01-01", "mode": "reject", "warned": 1, "redirected": 0, "rejected": 0}
+		]}`, recorder.Body.String())
+	})
+}
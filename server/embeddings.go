@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+func (s *ModelProxy) HandleEmbeddings(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+
+	var openAiRequest openai.EmbeddingRequest
+	if err := json.Unmarshal(bodyBytes, &openAiRequest); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err, "body", string(bodyBytes))
+		writeBodyError(httpResponse, err)
+		return
+	}
+	if openAiRequest.Model == "" {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("model is required")})
+		return
+	}
+	if openAiRequest.Input == nil || len(openAiRequest.Input.Texts) == 0 {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("input is required")})
+		return
+	}
+	s.logger.Infow("Received embeddings request", "model", openAiRequest.Model, "inputs", len(openAiRequest.Input.Texts), "api_key", apiKeyName(httpRequest.Context()))
+
+	openAiResponse, resolvedModel, err := s.generateEmbedding(httpRequest.Context(), &openAiRequest)
+	if err != nil {
+		s.logger.Warnw("Failed to get embeddings", "error", err, "model", openAiRequest.Model)
+		handleError(httpResponse, err)
+		return
+	}
+
+	httpResponse.Header().Set("X-Ogem-Resolved-Model", resolvedModel)
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(openAiResponse); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Tries the endpoints of the model that can embed, in the same order as the
+// chat completions. Unlike them, it does not wait for the rate limits; the
+// request fails with 429 if every endpoint is rate limited.
+func (s *ModelProxy) generateEmbedding(ctx context.Context, openAiRequest *openai.EmbeddingRequest) (*openai.EmbeddingResponse, string, error) {
+	endpointProvider, endpointRegion, modelOrAlias, err := parseModelIdentifier(strings.TrimSpace(openAiRequest.Model))
+	if err != nil {
+		return nil, "", BadRequestError{err}
+	}
+	endpoints, err := s.sortedEndpoints(endpointProvider, endpointRegion, modelOrAlias)
+	if err != nil {
+		return nil, "", UnavailableError{err}
+	}
+	if len(endpoints) == 0 {
+		return nil, "", UnavailableError{fmt.Errorf("no available endpoints")}
+	}
+
+	rateLimited := false
+	attempted := false
+	for _, endpoint := range endpoints {
+		embedder, ok := endpoint.endpoint.(provider.Embedder)
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, "", RequestTimeoutError{fmt.Errorf("request canceled")}
+		}
+		if !s.inFlight.acquire(endpoint) {
+			rateLimited = true
+			continue
+		}
+		accepted, _, err := s.stateManager.Allow(
+			ctx,
+			endpoint.endpoint.Provider(),
+			endpoint.endpoint.Region(),
+			rateLimitModel(ctx, endpoint, modelOrAlias),
+			requestInterval(endpoint.modelStatus),
+			requestBurst(endpoint.modelStatus),
+		)
+		if err != nil {
+			s.inFlight.release(endpoint)
+			s.logger.Warnw("Failed to check rate limit", "error", err, "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", modelOrAlias)
+			return nil, "", InternalServerError{fmt.Errorf("rate limit check failed")}
+		}
+		if !accepted {
+			s.inFlight.release(endpoint)
+			rateLimited = true
+			continue
+		}
+
+		attempted = true
+		endpointRequest := *openAiRequest
+		endpointRequest.Model = endpoint.modelStatus.Name
+		openAiResponse, err := embedder.GenerateEmbedding(ctx, &endpointRequest)
+		s.inFlight.release(endpoint)
+		if err != nil {
+			if s.disableOnQuotaError(ctx, endpoint, modelOrAlias, err) {
+				rateLimited = true
+				continue
+			}
+			s.logger.Warnw("Failed to generate embedding", "error", err, "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", endpointRequest.Model)
+			var invalidRequest *provider.InvalidRequestError
+			if errors.As(err, &invalidRequest) {
+				return nil, "", BadRequestError{invalidRequest}
+			}
+			var notSupported *provider.NotSupportedError
+			if errors.As(err, &notSupported) {
+				return nil, "", BadRequestError{fmt.Errorf("%s/%s cannot serve %s: %v", endpoint.endpoint.Provider(), endpoint.endpoint.Region(), modelOrAlias, notSupported)}
+			}
+			if provider.ClassifyError(err) == provider.NonRetryableBadRequest {
+				return nil, "", BadRequestError{err}
+			}
+			continue
+		}
+		s.resetDisableBackoff(endpoint.endpoint, rateLimitModel(ctx, endpoint, modelOrAlias))
+		return openAiResponse, fmt.Sprintf("%s/%s/%s", endpoint.endpoint.Provider(), endpoint.endpoint.Region(), endpointRequest.Model), nil
+	}
+
+	switch {
+	case rateLimited:
+		return nil, "", RateLimitError{fmt.Errorf("every endpoint of %s is rate limited", modelOrAlias)}
+	case !attempted:
+		return nil, "", BadRequestError{fmt.Errorf("%s is not an embedding model", modelOrAlias)}
+	default:
+		return nil, "", InternalServerError{fmt.Errorf("failed to generate embedding")}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+// Endpoint that only embeds, the same as the Voyage and Cohere endpoints.
+type fakeEmbedder struct {
+	fakeEndpoint
+
+	// Error of the embedding. Embeds each input as its length if nil.
+	err error
+
+	embedded []*openai.EmbeddingRequest
+}
+
+func (e *fakeEmbedder) GenerateEmbedding(ctx context.Context, request *openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	e.mutex.Lock()
+	e.embedded = append(e.embedded, request)
+	e.mutex.Unlock()
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	response := &openai.EmbeddingResponse{Object: "list", Model: request.Model}
+	for index, text := range request.Input.Texts {
+		response.Data = append(response.Data, openai.Embedding{Object: "embedding", Index: int32(index), Embedding: []float32{float32(len(text))}})
+	}
+	return response, nil
+}
+
+func (e *fakeEmbedder) GenerateChatCompletion(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	e.fakeEndpoint.GenerateChatCompletion(ctx, request)
+	return nil, provider.NewNotSupportedError("chat completions")
+}
+
+func TestEmbeddings(t *testing.T) {
+	newProxy := func(t *testing.T, primaryErr error) (*ModelProxy, *fakeEmbedder, *fakeEmbedder, *fakeEndpoint) {
+		primary := &fakeEmbedder{fakeEndpoint: fakeEndpoint{provider: "voyage", region: "voyage"}, err: primaryErr}
+		secondary := &fakeEmbedder{fakeEndpoint: fakeEndpoint{provider: "cohere", region: "cohere"}}
+		chat := &fakeEndpoint{provider: "chat", region: "chat"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"voyage": {Regions: map[string]*ogem.RegionStatus{"voyage": {
+				Priority: 2,
+				Models:   []*ogem.SupportedModel{{Name: "voyage-3", OtherNames: []string{"retrieval"}}},
+			}}},
+			"cohere": {Regions: map[string]*ogem.RegionStatus{"cohere": {
+				Priority: 1,
+				Models:   []*ogem.SupportedModel{{Name: "embed-v4.0", OtherNames: []string{"retrieval"}}},
+			}}},
+			"chat": {Regions: map[string]*ogem.RegionStatus{"chat": {
+				Models: []*ogem.SupportedModel{{Name: "chat-model", OtherNames: []string{"retrieval"}}},
+			}}},
+		}, primary, secondary, chat)
+		return proxy, primary, secondary, chat
+	}
+	embeddings := func(proxy *ModelProxy, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		proxy.HandleEmbeddings(recorder, request)
+		return recorder
+	}
+
+	t.Run("Embeds with the first endpoint that can embed", func(t *testing.T) {
+		proxy, primary, secondary, _ := newProxy(t, nil)
+
+		recorder := embeddings(proxy, `{"model": "retrieval", "input": ["Hi", "Hello"], "dimensions": 256, "ogem_input_type": "query"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "voyage/voyage/voyage-3", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Len(t, primary.embedded, 1)
+		assert.Equal(t, "voyage-3", primary.embedded[0].Model)
+		assert.Equal(t, int32(256), *primary.embedded[0].Dimensions)
+		assert.Equal(t, "query", *primary.embedded[0].InputType)
+		assert.Empty(t, secondary.embedded)
+		assert.Contains(t, recorder.Body.String(), `"embedding":[5]`)
+	})
+
+	t.Run("Falls back to the next endpoint", func(t *testing.T) {
+		proxy, _, secondary, _ := newProxy(t, fmt.Errorf("unexpected status code: 500"))
+
+		recorder := embeddings(proxy, `{"model": "retrieval", "input": "Hi"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "cohere/cohere/embed-v4.0", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Equal(t, []string{"Hi"}, secondary.embedded[0].Input.Texts)
+	})
+
+	t.Run("Rejects the invalid requests without trying the other endpoints", func(t *testing.T) {
+		proxy, _, secondary, _ := newProxy(t, provider.NewInvalidRequestError(fmt.Errorf("unsupported input type")))
+
+		recorder := embeddings(proxy, `{"model": "retrieval", "input": "Hi", "ogem_input_type": "clustering"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+		assert.Empty(t, secondary.embedded)
+	})
+
+	t.Run("Rejects the models that cannot embed", func(t *testing.T) {
+		proxy, _, _, _ := newProxy(t, nil)
+
+		recorder := embeddings(proxy, `{"model": "chat-model", "input": "Hi"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+		assert.Contains(t, recorder.Body.String(), "not an embedding model")
+	})
+
+	t.Run("Requires the input", func(t *testing.T) {
+		proxy, _, _, _ := newProxy(t, nil)
+
+		recorder := embeddings(proxy, `{"model": "retrieval"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+	})
+
+	t.Run("Rejects the chat completions of an embedding model", func(t *testing.T) {
+		proxy, primary, secondary, chat := newProxy(t, nil)
+
+		request := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "retrieval", "messages": [{"role": "user", "content": "Hi"}]}`))
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+		assert.Contains(t, recorder.Body.String(), "chat completions not supported")
+		assert.Len(t, primary.receivedRequests(), 1)
+		assert.Empty(t, secondary.receivedRequests())
+		assert.Empty(t, chat.receivedRequests())
+	})
+}
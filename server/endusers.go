@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+// Limits of the usage of each end user, identified by the user field of the
+// requests, per day in UTC. Zero limits are unlimited, and nothing is counted
+// unless a limit is set or the user field is required.
+type EndUserLimitsConfig struct {
+	// Maximum total tokens per day. E.g., 1000000
+	TokensPerDay int64 `yaml:"tokens_per_day" json:"tokens_per_day,omitempty"`
+
+	// Maximum cost in USD per day, estimated with the prices of the models.
+	// E.g., 5
+	CostPerDay float64 `yaml:"cost_per_day" json:"cost_per_day,omitempty"`
+
+	// Maximum number of requests per day. E.g., 500
+	RequestsPerDay int64 `yaml:"requests_per_day" json:"requests_per_day,omitempty"`
+
+	// Whether to reject the requests without the user field. They bypass the
+	// limits otherwise.
+	RequireUser bool `yaml:"require_user" json:"require_user,omitempty"`
+}
+
+func (c EndUserLimitsConfig) enabled() bool {
+	return c.TokensPerDay > 0 || c.CostPerDay > 0 || c.RequestsPerDay > 0 || c.RequireUser
+}
+
+// Counters of the usage of an end user in the state manager.
+const (
+	endUserTokens   = "tokens"
+	endUserCost     = "cost"
+	endUserRequests = "requests"
+
+	endUserCacheHits = "cache_hits"
+	endUserCostSaved = "cost_saved"
+)
+
+// Usage of an end user on a day, which starts over at midnight UTC.
+type EndUserUsage struct {
+	User string `json:"user"`
+
+	// Day of the usage in UTC. E.g., 2025-01-31
+	Date string `json:"date"`
+
+	Tokens   int64   `json:"tokens"`
+	Cost     float64 `json:"cost"`
+	Requests int64   `json:"requests"`
+
+	// Requests served from the cache, which count as requests but not as
+	// tokens or cost, and what they would have cost otherwise.
+	CacheHits int64   `json:"cache_hits"`
+	CostSaved float64 `json:"cost_saved"`
+
+	Limits EndUserLimitsConfig `json:"limits"`
+
+	// Time at which the usage starts over.
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+type endUserLimiter struct {
+	limits EndUserLimitsConfig
+
+	// Returns the current time. Replaced in tests to cross midnight.
+	now func() time.Time
+}
+
+// Returns nil if no limit is configured.
+func newEndUserLimiter(limits EndUserLimitsConfig) *endUserLimiter {
+	if !limits.enabled() {
+		return nil
+	}
+	return &endUserLimiter{limits: limits, now: time.Now}
+}
+
+// Users are recorded by the hash of their ID, which the callers may have
+// derived from personal data, and by the day so that the usage of each day
+// starts from zero.
+func endUserUsageKey(user string, day string) string {
+	hash := sha256.Sum256([]byte(user))
+	return fmt.Sprintf("end_user_usage:%s:%s", day, hex.EncodeToString(hash[:]))
+}
+
+// Returns the day in UTC and the time at which it ends.
+func (l *endUserLimiter) today() (string, time.Time) {
+	now := l.now().UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format(time.DateOnly), start.AddDate(0, 0, 1)
+}
+
+// Adds the increments to the usage of the user today and returns the usage.
+// Without increments, only reads it.
+func (s *ModelProxy) addEndUserUsage(ctx context.Context, user string, increments map[string]float64) (*EndUserUsage, error) {
+	day, resetsAt := s.endUsers.today()
+	// Kept for a day from the first request, which outlives the day.
+	counters, err := s.stateManager.AddCounters(ctx, endUserUsageKey(user, day), increments, 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return &EndUserUsage{
+		User:      user,
+		Date:      day,
+		Tokens:    int64(counters[endUserTokens]),
+		Cost:      counters[endUserCost],
+		Requests:  int64(counters[endUserRequests]),
+		CacheHits: int64(counters[endUserCacheHits]),
+		CostSaved: counters[endUserCostSaved],
+		Limits:    s.endUsers.limits,
+		ResetsAt:  resetsAt,
+	}, nil
+}
+
+// Returns the limit that the usage has reached, or empty if none.
+func (u *EndUserUsage) exceededLimit() string {
+	switch {
+	case u.Limits.TokensPerDay > 0 && u.Tokens >= u.Limits.TokensPerDay:
+		return fmt.Sprintf("%d of %d tokens", u.Tokens, u.Limits.TokensPerDay)
+	case u.Limits.CostPerDay > 0 && u.Cost >= u.Limits.CostPerDay:
+		return fmt.Sprintf("$%.4f of $%.4f", u.Cost, u.Limits.CostPerDay)
+	case u.Limits.RequestsPerDay > 0 && u.Requests >= u.Limits.RequestsPerDay:
+		return fmt.Sprintf("%d of %d requests", u.Requests, u.Limits.RequestsPerDay)
+	}
+	return ""
+}
+
+// Rejects the request if its end user has reached a limit today. A request
+// admitted under the limits is served in full, so the usage may exceed them
+// by the last requests.
+func (s *ModelProxy) checkEndUserQuota(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	// The shadow requests are not made by the user.
+	if s.endUsers == nil || shadowFrom(ctx) {
+		return nil
+	}
+	if request.User == nil || *request.User == "" {
+		if s.endUsers.limits.RequireUser {
+			return BadRequestError{fmt.Errorf("user is required to track the usage of the end users")}
+		}
+		return nil
+	}
+
+	usage, err := s.addEndUserUsage(ctx, *request.User, nil)
+	if err != nil {
+		s.logger.Warnw("Failed to check end user usage", "error", err)
+		return InternalServerError{fmt.Errorf("end user quota check failed")}
+	}
+	if exceeded := usage.exceededLimit(); exceeded != "" {
+		return EndUserQuotaError{fmt.Errorf("the user has used %s today; the usage resets at %s", exceeded, usage.ResetsAt.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+// Adds the usage of the response to its end user. Cached responses only
+// count as requests since no provider was called for them, and their cost is
+// counted as saved.
+func (s *ModelProxy) recordEndUserUsage(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse, model *ogem.SupportedModel, cached bool) {
+	if s.endUsers == nil || shadowFrom(ctx) || request.User == nil || *request.User == "" {
+		return
+	}
+	increments := map[string]float64{endUserRequests: 1}
+	if cached {
+		increments[endUserCacheHits] = 1
+		if saved := responseCost(model, response.Usage); saved > 0 {
+			increments[endUserCostSaved] = saved
+		}
+	} else {
+		addBilledUsage(increments, response, model)
+	}
+	// Counted even if the request has been canceled, since the provider was
+	// paid for it.
+	if _, err := s.addEndUserUsage(context.Background(), *request.User, increments); err != nil {
+		s.logger.Warnw("Failed to record end user usage", "error", err)
+	}
+}
+
+// Adds the tokens and the cost of a hedged attempt that completed after the
+// winner to the end user of the request, without counting another request.
+func (s *ModelProxy) recordEndUserHedgeUsage(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse, model *ogem.SupportedModel) {
+	if s.endUsers == nil || shadowFrom(ctx) || request.User == nil || *request.User == "" {
+		return
+	}
+	increments := map[string]float64{}
+	addBilledUsage(increments, response, model)
+	if _, err := s.addEndUserUsage(context.Background(), *request.User, increments); err != nil {
+		s.logger.Warnw("Failed to record end user usage", "error", err)
+	}
+}
+
+func addBilledUsage(increments map[string]float64, response *openai.ChatCompletionResponse, model *ogem.SupportedModel) {
+	increments[endUserTokens] = float64(response.Usage.TotalTokens)
+	if cost := responseCost(model, response.Usage); cost > 0 {
+		increments[endUserCost] = cost
+	}
+}
+
+func (s *ModelProxy) HandleEndUserUsage(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	if s.endUsers == nil {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "", "End user limits are not configured")
+		return
+	}
+
+	usage, err := s.addEndUserUsage(httpRequest.Context(), httpRequest.PathValue("id"), nil)
+	if err != nil {
+		s.logger.Warnw("Failed to get end user usage", "error", err)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(usage); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
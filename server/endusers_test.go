@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestEndUserLimits(t *testing.T) {
+	// One minute before midnight UTC.
+	lastMinute := time.Date(2025, 1, 31, 23, 59, 0, 0, time.UTC)
+
+	newProxy := func(t *testing.T, limits EndUserLimitsConfig) (*ModelProxy, *fakeEndpoint, *time.Time) {
+		// $0.01 per request.
+		model := &ogem.SupportedModel{Name: "gpt-4o", InputPrice: 10, OutputPrice: 10}
+		proxy, endpoint := newSingleEndpointProxy(t, "openai", model, replyWith("Hello", openai.Usage{PromptTokens: 600, CompletionTokens: 400, TotalTokens: 1000}))
+		now := lastMinute
+		proxy.endUsers = newEndUserLimiter(limits)
+		if proxy.endUsers != nil {
+			proxy.endUsers.now = func() time.Time { return now }
+		}
+		return proxy, endpoint, &now
+	}
+	chatCompletions := func(proxy *ModelProxy, user string) *httptest.ResponseRecorder {
+		request := openai.ChatCompletionRequest{Model: "gpt-4o", Messages: []openai.Message{userMessage("Hi")}}
+		if user != "" {
+			request.User = utils.ToPtr(user)
+		}
+		body, err := json.Marshal(request)
+		assert.NoError(t, err)
+		return sendChatCompletions(proxy, string(body), nil, nil)
+	}
+	usageOf := func(t *testing.T, proxy *ModelProxy, user string) EndUserUsage {
+		httpRequest := httptest.NewRequest("GET", "/v1/admin/end-users/"+user+"/usage", nil)
+		httpRequest.SetPathValue("id", user)
+		recorder := httptest.NewRecorder()
+		proxy.HandleEndUserUsage(recorder, httpRequest)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var usage EndUserUsage
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &usage))
+		return usage
+	}
+
+	t.Run("Rejects the user over the tokens of the day", func(t *testing.T) {
+		proxy, endpoint, _ := newProxy(t, EndUserLimitsConfig{TokensPerDay: 2000})
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		recorder := chatCompletions(proxy, "user-1")
+		assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		var response openai.ErrorResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, "end_user_quota_exceeded", response.Error.Code)
+		assert.Equal(t, "rate_limit_error", response.Error.Type)
+		assert.Contains(t, response.Error.Message, "2000 of 2000 tokens")
+		assert.Contains(t, response.Error.Message, "2025-02-01T00:00:00Z")
+		assert.Len(t, endpoint.receivedRequests(), 2)
+
+		// Other users have their own usage.
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-2").Code)
+	})
+
+	t.Run("Rejects the user over the cost of the day", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, EndUserLimitsConfig{CostPerDay: 0.015})
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		// Admitted under the limit, and served in full.
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, chatCompletions(proxy, "user-1").Code)
+		assert.InDelta(t, 0.02, usageOf(t, proxy, "user-1").Cost, 1e-9)
+	})
+
+	t.Run("Rejects the user over the requests of the day", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, EndUserLimitsConfig{RequestsPerDay: 1})
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, chatCompletions(proxy, "user-1").Code)
+	})
+
+	t.Run("Starts over at midnight UTC", func(t *testing.T) {
+		proxy, _, now := newProxy(t, EndUserLimitsConfig{RequestsPerDay: 1})
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		// Still January 31 in UTC.
+		*now = time.Date(2025, 2, 1, 8, 59, 59, 0, time.FixedZone("KST", 9*60*60))
+		assert.Equal(t, http.StatusTooManyRequests, chatCompletions(proxy, "user-1").Code)
+
+		*now = lastMinute.Add(time.Minute)
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "user-1").Code)
+		usage := usageOf(t, proxy, "user-1")
+		assert.Equal(t, "2025-02-01", usage.Date)
+		assert.Equal(t, int64(1), usage.Requests)
+		assert.Equal(t, time.Date(2025, 2, 2, 0, 0, 0, 0, time.UTC), usage.ResetsAt)
+	})
+
+	t.Run("Lets the requests without a user bypass the limits", func(t *testing.T) {
+		proxy, endpoint, _ := newProxy(t, EndUserLimitsConfig{RequestsPerDay: 1})
+
+		for range 3 {
+			assert.Equal(t, http.StatusOK, chatCompletions(proxy, "").Code)
+		}
+		assert.Len(t, endpoint.receivedRequests(), 3)
+		assert.Equal(t, int64(0), usageOf(t, proxy, "").Requests)
+	})
+
+	t.Run("Rejects the requests without a user if required", func(t *testing.T) {
+		proxy, endpoint, _ := newProxy(t, EndUserLimitsConfig{RequestsPerDay: 1, RequireUser: true})
+
+		recorder := chatCompletions(proxy, "")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "user is required")
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+
+	t.Run("Reports the usage", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, EndUserLimitsConfig{TokensPerDay: 1_000_000})
+
+		chatCompletions(proxy, "user-1")
+		chatCompletions(proxy, "user-1")
+		usage := usageOf(t, proxy, "user-1")
+		assert.Equal(t, "user-1", usage.User)
+		assert.Equal(t, "2025-01-31", usage.Date)
+		assert.Equal(t, int64(2000), usage.Tokens)
+		assert.Equal(t, int64(2), usage.Requests)
+		assert.Equal(t, int64(1_000_000), usage.Limits.TokensPerDay)
+		assert.Equal(t, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), usage.ResetsAt)
+	})
+
+	t.Run("Reports nothing without limits", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, EndUserLimitsConfig{})
+		assert.Nil(t, proxy.endUsers)
+
+		httpRequest := httptest.NewRequest("GET", "/v1/admin/end-users/user-1/usage", nil)
+		httpRequest.SetPathValue("id", "user-1")
+		recorder := httptest.NewRecorder()
+		proxy.HandleEndUserUsage(recorder, httpRequest)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
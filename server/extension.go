@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/goccy/go-json"
+)
+
+// Extension fields of the chat completion request body for the SDKs that
+// cannot set the X-Ogem-* headers, each of which takes precedence over its
+// field. They are decoded apart from the request, so that they are never sent
+// to the providers.
+type ogemExtensionFields struct {
+	// X-Ogem-Only-Providers and X-Ogem-Exclude-Providers
+	OnlyProviders    []string `json:"ogem_only_providers"`
+	ExcludeProviders []string `json:"ogem_exclude_providers"`
+
+	// X-Ogem-Truncate
+	Truncate string `json:"ogem_truncate"`
+
+	// X-Ogem-Postprocess
+	Postprocess string `json:"ogem_postprocess"`
+
+	// X-Ogem-Validate-Tools
+	ValidateTools string `json:"ogem_validate_tools"`
+
+	// X-Ogem-Gemini-Cache
+	GeminiCache string `json:"ogem_gemini_cache"`
+
+	// X-Ogem-Callback-Url
+	CallbackUrl string `json:"ogem_callback_url"`
+}
+
+func parseExtensionFields(body []byte) (ogemExtensionFields, error) {
+	var fields ogemExtensionFields
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ogemExtensionFields{}, fmt.Errorf("invalid ogem_* fields: %v", err)
+	}
+	return fields, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExtensionFields(t *testing.T) {
+	t.Run("Decodes every field", func(t *testing.T) {
+		fields, err := parseExtensionFields([]byte(`{
+			"model": "gpt-4o",
+			"messages": [{"role": "user", "content": "Hi"}],
+			"ogem_only_providers": ["openai"],
+			"ogem_exclude_providers": ["claude"],
+			"ogem_truncate": "oldest",
+			"ogem_postprocess": "trim",
+			"ogem_validate_tools": "repair",
+			"ogem_gemini_cache": "policy-v3",
+			"ogem_callback_url": "https://hooks.example.com/ogem"
+		}`))
+		assert.NoError(t, err)
+		assert.Equal(t, ogemExtensionFields{
+			OnlyProviders:    []string{"openai"},
+			ExcludeProviders: []string{"claude"},
+			Truncate:         "oldest",
+			Postprocess:      "trim",
+			ValidateTools:    "repair",
+			GeminiCache:      "policy-v3",
+			CallbackUrl:      "https://hooks.example.com/ogem",
+		}, fields)
+	})
+
+	t.Run("Rejects a field of the wrong type", func(t *testing.T) {
+		_, err := parseExtensionFields([]byte(`{"model": "gpt-4o", "ogem_truncate": 5}`))
+		assert.ErrorContains(t, err, "invalid ogem_* fields")
+	})
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider/fake"
+	"github.com/yanolja/ogem/state"
+)
+
+// Runs the whole proxy over HTTP against the fake provider.
+func TestFakeProvider(t *testing.T) {
+	newServer := func(t *testing.T, regions map[string]*ogem.RegionStatus) *httptest.Server {
+		stateManager, cleanup := state.NewMemoryManager(1024 * 1024)
+		t.Cleanup(cleanup)
+		config := Config{
+			Port:          8080,
+			RetryInterval: "1ms",
+			PingInterval:  "1h",
+			Providers:     ogem.ProvidersStatus{"fake": {Regions: regions}},
+		}
+		assert.NoError(t, config.Validate())
+		proxy, err := NewProxyServer(stateManager, cleanup, config, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v1/chat/completions", proxy.HandleAuthentication(proxy.HandleChatCompletions))
+		mux.HandleFunc("/", HandleNotFound)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return server
+	}
+	chatCompletions := func(t *testing.T, server *httptest.Server, model string) (*http.Response, *openai.ChatCompletionResponse) {
+		body := `{"model": "` + model + `", "messages": [{"role": "user", "content": "Ping"}]}`
+		httpResponse, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		defer httpResponse.Body.Close()
+		var response openai.ChatCompletionResponse
+		json.NewDecoder(httpResponse.Body).Decode(&response)
+		return httpResponse, &response
+	}
+	models := func(names ...string) []*ogem.SupportedModel {
+		supported := []*ogem.SupportedModel{}
+		for _, name := range names {
+			supported = append(supported, &ogem.SupportedModel{Name: name})
+		}
+		return supported
+	}
+
+	t.Run("Serves the synthetic response", func(t *testing.T) {
+		server := newServer(t, map[string]*ogem.RegionStatus{
+			"local": {Models: models("fake-model"), Fake: &fake.Config{Response: "Pong: {{.LastUserMessage}}"}},
+		})
+
+		httpResponse, response := chatCompletions(t, server, "fake-model")
+		assert.Equal(t, http.StatusOK, httpResponse.StatusCode)
+		assert.Equal(t, "fake/local/fake-model", httpResponse.Header.Get("X-Ogem-Resolved-Model"))
+		assert.Equal(t, "Pong: Ping", *response.Choices[0].Message.Content.String)
+		assert.Equal(t, int32(1), response.Usage.PromptTokens)
+	})
+
+	t.Run("Fails over from a rate limited region", func(t *testing.T) {
+		// The limited region is tried first for its priority.
+		server := newServer(t, map[string]*ogem.RegionStatus{
+			"limited": {Models: models("fake-model"), Priority: 1, Fake: &fake.Config{RateLimitRate: 1}},
+			"backup":  {Models: models("fake-model"), Fake: &fake.Config{}},
+		})
+
+		for range 3 {
+			httpResponse, _ := chatCompletions(t, server, "fake-model")
+			assert.Equal(t, http.StatusOK, httpResponse.StatusCode)
+			assert.Equal(t, "fake/backup/fake-model", httpResponse.Header.Get("X-Ogem-Resolved-Model"))
+		}
+	})
+
+	t.Run("Falls back to the next model after an error", func(t *testing.T) {
+		server := newServer(t, map[string]*ogem.RegionStatus{
+			"broken": {Models: models("broken-model"), Fake: &fake.Config{ErrorRate: 1}},
+			"local":  {Models: models("fake-model")},
+		})
+
+		httpResponse, _ := chatCompletions(t, server, "broken-model")
+		assert.Equal(t, http.StatusInternalServerError, httpResponse.StatusCode)
+
+		httpResponse, _ = chatCompletions(t, server, "broken-model,fake-model")
+		assert.Equal(t, http.StatusOK, httpResponse.StatusCode)
+		assert.Equal(t, "fake/local/fake-model", httpResponse.Header.Get("X-Ogem-Resolved-Model"))
+	})
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/yanolja/ogem/utils/array"
+)
+
+type providerFilterContextKey struct{}
+
+// Providers that a request allows to serve it.
+type providerFilter struct {
+	// Only these providers may serve the request. All providers if empty.
+	only []string
+
+	// These providers must not serve the request.
+	exclude []string
+}
+
+// Returns the provider filter of the request. The X-Ogem-Only-Providers and
+// X-Ogem-Exclude-Providers headers take precedence over the
+// ogem_only_providers and ogem_exclude_providers fields of the body.
+func parseProviderFilter(httpRequest *http.Request, fields ogemExtensionFields) providerFilter {
+	filter := providerFilter{
+		only:    trimProviders(fields.OnlyProviders),
+		exclude: trimProviders(fields.ExcludeProviders),
+	}
+	if header := httpRequest.Header.Get("X-Ogem-Only-Providers"); header != "" {
+		filter.only = trimProviders(strings.Split(header, ","))
+	}
+	if header := httpRequest.Header.Get("X-Ogem-Exclude-Providers"); header != "" {
+		filter.exclude = trimProviders(strings.Split(header, ","))
+	}
+	return filter
+}
+
+func trimProviders(providers []string) []string {
+	return array.Filter(array.Map(providers, strings.TrimSpace), func(provider string) bool {
+		return provider != ""
+	})
+}
+
+func (f providerFilter) empty() bool {
+	return len(f.only) == 0 && len(f.exclude) == 0
+}
+
+func (f providerFilter) allows(provider string) bool {
+	if len(f.only) > 0 && !array.Contains(f.only, provider) {
+		return false
+	}
+	return !array.Contains(f.exclude, provider)
+}
+
+// Describes the filter for the error messages. E.g., "only: openai; excluded: vertex, studio"
+func (f providerFilter) String() string {
+	descriptions := []string{}
+	if len(f.only) > 0 {
+		descriptions = append(descriptions, "only: "+strings.Join(f.only, ", "))
+	}
+	if len(f.exclude) > 0 {
+		descriptions = append(descriptions, "excluded: "+strings.Join(f.exclude, ", "))
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+func withProviderFilter(ctx context.Context, filter providerFilter) context.Context {
+	if filter.empty() {
+		return ctx
+	}
+	return context.WithValue(ctx, providerFilterContextKey{}, filter)
+}
+
+func providerFilterFrom(ctx context.Context) providerFilter {
+	filter, _ := ctx.Value(providerFilterContextKey{}).(providerFilter)
+	return filter
+}
+
+// Removes the endpoints of the providers that the filter of the request does
+// not allow, keeping the order of the others.
+func filterEndpoints(ctx context.Context, endpoints []*endpointStatus) []*endpointStatus {
+	filter := providerFilterFrom(ctx)
+	if filter.empty() {
+		return endpoints
+	}
+	return array.Filter(endpoints, func(endpoint *endpointStatus) bool {
+		return filter.allows(endpoint.endpoint.Provider())
+	})
+}
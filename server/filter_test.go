@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestProviderFilter(t *testing.T) {
+	newProxy := func(t *testing.T) *ModelProxy {
+		models := []*ogem.SupportedModel{{Name: "fake-model"}}
+		return newTestProxy(t, ogem.ProvidersStatus{
+			"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {Latency: 30 * time.Millisecond, LastChecked: time.Now(), Models: models}}},
+			"studio": {Regions: map[string]*ogem.RegionStatus{"studio": {Latency: 10 * time.Millisecond, LastChecked: time.Now(), Models: models}}},
+			"vertex": {Regions: map[string]*ogem.RegionStatus{"us-central1": {Latency: 20 * time.Millisecond, LastChecked: time.Now(), Models: models}}},
+		},
+			&fakeEndpoint{provider: "openai", region: "openai"},
+			&fakeEndpoint{provider: "studio", region: "studio"},
+			&fakeEndpoint{provider: "vertex", region: "us-central1"},
+		)
+	}
+
+	chatCompletions := func(proxy *ModelProxy, headers map[string]string, fields string) *httptest.ResponseRecorder {
+		body := `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]` + fields + `}`
+		request := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer key-1")
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.HandleAuthentication(proxy.HandleChatCompletions)(recorder, request)
+		return recorder
+	}
+
+	t.Run("Routes to the fastest endpoint without a filter", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), nil, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "studio/studio/fake-model", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Skips the excluded providers", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), map[string]string{"X-Ogem-Exclude-Providers": "vertex, studio"}, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "openai/openai/fake-model", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Uses only the listed providers", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), map[string]string{"X-Ogem-Only-Providers": "vertex"}, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "vertex/us-central1/fake-model", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Accepts the body fields", func(t *testing.T) {
+		proxy := newProxy(t)
+		recorder := chatCompletions(proxy, nil, `, "ogem_only_providers": ["openai", "vertex"], "ogem_exclude_providers": ["vertex"]`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "openai/openai/fake-model", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Headers take precedence over the body fields", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), map[string]string{"X-Ogem-Only-Providers": "vertex"}, `, "ogem_only_providers": ["openai"]`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "vertex/us-central1/fake-model", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Rejects the request if no endpoint is left", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), map[string]string{
+			"X-Ogem-Only-Providers":    "openai",
+			"X-Ogem-Exclude-Providers": "openai",
+		}, "")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "only: openai; excluded: openai")
+	})
+
+	t.Run("Rejects the filter of a key that forbids it", func(t *testing.T) {
+		proxy := newProxy(t)
+		proxy.config.ApiKeys = []ApiKey{{Name: "tenant", Key: "key-1", ForbidProviderFilter: true}}
+		proxy.indexApiKeys()
+
+		recorder := chatCompletions(proxy, map[string]string{"X-Ogem-Exclude-Providers": "studio"}, "")
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "provider_filter_forbidden")
+
+		recorder = chatCompletions(proxy, nil, `, "ogem_exclude_providers": ["studio"]`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = chatCompletions(proxy, nil, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
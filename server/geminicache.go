@@ -0,0 +1,411 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+// Key of the record of all Gemini caches. They are kept in one record since
+// the state manager cannot list its keys, and there are only a few of them.
+const geminiCachesKey = "gemini_caches"
+
+// Held while the record is read and written back, so that the admin requests
+// of other instances do not overwrite each other.
+const geminiCachesLockKey = "gemini_caches:lock"
+
+const geminiCachesLockDuration = 30 * time.Second
+
+const defaultGeminiCacheTtl = time.Hour
+
+var errGeminiCachesLocked = errors.New("the Gemini caches are being updated by another request")
+
+type geminiCacheContextKey struct{}
+
+// System prompt cached on the Gemini endpoints of a model, which the requests
+// reference by name instead of sending it.
+type GeminiCache struct {
+	// E.g., policy-v3
+	Name string `json:"name"`
+
+	// Model as requested. E.g., gemini-1.5-pro
+	Model string `json:"model"`
+
+	SystemPrompt string `json:"system_prompt,omitempty"`
+
+	// The earliest time at which an endpoint deletes its cache.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Resource of the cache on each endpoint by provider/region/model.
+	// E.g., {"vertex/us-central1/gemini-1.5-pro": "projects/p/locations/us-central1/cachedContents/123"}
+	Resources map[string]string `json:"resources"`
+}
+
+type CreateGeminiCacheRequest struct {
+	Name         string `json:"name"`
+	Model        string `json:"model"`
+	SystemPrompt string `json:"system_prompt"`
+
+	// How long the endpoints keep the cache. Defaults to 1h. E.g., 30m
+	Ttl string `json:"ttl"`
+}
+
+type GeminiCachesResponse struct {
+	// Without their system prompts, which may be large.
+	GeminiCaches []GeminiCache `json:"gemini_caches"`
+}
+
+// Returns the name of the Gemini cache that the request references. The
+// X-Ogem-Gemini-Cache header takes precedence over the ogem_gemini_cache
+// field of the body. Empty if it references none.
+func parseGeminiCache(httpRequest *http.Request, fields ogemExtensionFields) string {
+	if header := httpRequest.Header.Get("X-Ogem-Gemini-Cache"); header != "" {
+		return header
+	}
+	return fields.GeminiCache
+}
+
+// Returns the context of the request referencing the cache. A cache that does
+// not exist has no resources, so that the full prompt is sent and the miss is
+// reported.
+func withGeminiCache(ctx context.Context, cache *GeminiCache) context.Context {
+	return context.WithValue(ctx, geminiCacheContextKey{}, cache)
+}
+
+// Nil if the request references no cache.
+func geminiCacheFrom(ctx context.Context) *GeminiCache {
+	cache, _ := ctx.Value(geminiCacheContextKey{}).(*GeminiCache)
+	return cache
+}
+
+func geminiCacheEndpointKey(endpoint *endpointStatus) string {
+	return endpointKey(endpoint) + "/" + endpoint.modelStatus.Name
+}
+
+// Returns the context to send the request to the endpoint with, which carries
+// the cached content of the endpoint if the request references a cache on it.
+func withEndpointCachedContent(ctx context.Context, endpoint *endpointStatus) context.Context {
+	cache := geminiCacheFrom(ctx)
+	if cache == nil {
+		return ctx
+	}
+	resource, found := cache.Resources[geminiCacheEndpointKey(endpoint)]
+	if !found {
+		return ctx
+	}
+	return provider.WithCachedContent(ctx, provider.CachedContent{Name: cache.Name, Resource: resource, SystemPrompt: cache.SystemPrompt})
+}
+
+// Reports whether the response was served from the cache that the request
+// references in the X-Ogem-Gemini-Cache header, and warns of a miss, since
+// the full prompt is billed then.
+func writeGeminiCacheStatus(httpResponse http.ResponseWriter, cache *GeminiCache, response *openai.ChatCompletionResponse) {
+	if cache == nil {
+		return
+	}
+	var status *openai.GeminiCacheMetadata
+	if response.Ogem != nil {
+		status = response.Ogem.GeminiCache
+	}
+	if status == nil {
+		reason := "unavailable"
+		if len(cache.Resources) == 0 {
+			reason = "not_found"
+		}
+		status = &openai.GeminiCacheMetadata{Name: cache.Name, Miss: reason}
+		if response.Ogem == nil {
+			response.Ogem = &openai.ResponseMetadata{}
+		}
+		response.Ogem.GeminiCache = status
+	}
+	if status.Hit {
+		httpResponse.Header().Set("X-Ogem-Gemini-Cache", "hit")
+		return
+	}
+	httpResponse.Header().Set("X-Ogem-Gemini-Cache", "miss")
+	httpResponse.Header().Add("Warning", fmt.Sprintf(`199 - "Gemini cache %s was not used (%s); the full prompt was sent"`, cache.Name, status.Miss))
+}
+
+// Returns the caches that have not expired by their names.
+func (s *ModelProxy) loadGeminiCaches(ctx context.Context) (map[string]*GeminiCache, error) {
+	data, err := s.stateManager.LoadCache(ctx, geminiCachesKey)
+	if err != nil {
+		return nil, err
+	}
+	caches := map[string]*GeminiCache{}
+	if data == nil {
+		return caches, nil
+	}
+	if err := json.Unmarshal(data, &caches); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for name, cache := range caches {
+		if !cache.ExpiresAt.After(now) {
+			delete(caches, name)
+		}
+	}
+	return caches, nil
+}
+
+// Returns the cache that the request references. The one without resources
+// if it does not exist.
+func (s *ModelProxy) lookUpGeminiCache(ctx context.Context, name string) *GeminiCache {
+	caches, err := s.loadGeminiCaches(ctx)
+	if err != nil {
+		s.logger.Warnw("Failed to load Gemini caches", "error", err, "name", name)
+	}
+	if cache, found := caches[name]; found {
+		return cache
+	}
+	return &GeminiCache{Name: name}
+}
+
+// Loads the caches, lets update change them, and saves them back under the
+// lock.
+func (s *ModelProxy) updateGeminiCaches(ctx context.Context, update func(caches map[string]*GeminiCache) error) error {
+	acquired, err := s.stateManager.AcquireLock(ctx, geminiCachesLockKey, geminiCachesLockDuration)
+	if err != nil {
+		return InternalServerError{err}
+	}
+	if !acquired {
+		return errGeminiCachesLocked
+	}
+	defer func() {
+		// Releasing should be done even if the request has been canceled.
+		if err := s.stateManager.ReleaseLock(context.Background(), geminiCachesLockKey); err != nil {
+			s.logger.Warnw("Failed to release Gemini caches lock", "error", err)
+		}
+	}()
+
+	caches, err := s.loadGeminiCaches(ctx)
+	if err != nil {
+		return InternalServerError{err}
+	}
+	if err := update(caches); err != nil {
+		return err
+	}
+	data, err := json.Marshal(caches)
+	if err != nil {
+		return InternalServerError{err}
+	}
+	if err := s.stateManager.SaveCache(ctx, geminiCachesKey, data, revocationTtl); err != nil {
+		return InternalServerError{err}
+	}
+	return nil
+}
+
+func writeGeminiCachesError(httpResponse http.ResponseWriter, err error) {
+	if errors.Is(err, errGeminiCachesLocked) {
+		writeError(httpResponse, http.StatusConflict, errorTypeInvalidRequest, "gemini_caches_locked", "The Gemini caches are being updated by another request; retry later")
+		return
+	}
+	handleError(httpResponse, err)
+}
+
+// Creates the cache on every endpoint of the model that can cache content.
+// Fails if none can, and deletes the ones created if any fails.
+func (s *ModelProxy) createGeminiCache(ctx context.Context, request CreateGeminiCacheRequest, ttl time.Duration) (*GeminiCache, error) {
+	endpointProvider, endpointRegion, modelOrAlias, err := parseModelIdentifier(request.Model)
+	if err != nil {
+		return nil, BadRequestError{fmt.Errorf("invalid model name: %s", request.Model)}
+	}
+	endpoints, err := s.sortedEndpoints(endpointProvider, endpointRegion, modelOrAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &GeminiCache{Name: request.Name, Model: request.Model, SystemPrompt: request.SystemPrompt, Resources: map[string]string{}}
+	cachers := map[string]provider.ContentCacher{}
+	for _, endpoint := range endpoints {
+		cacher, ok := endpoint.endpoint.(provider.ContentCacher)
+		if !ok {
+			continue
+		}
+		key := geminiCacheEndpointKey(endpoint)
+		resource, expiresAt, err := cacher.CreateCachedContent(ctx, endpoint.modelStatus.Name, request.SystemPrompt, ttl)
+		if err != nil {
+			s.logger.Warnw("Failed to create Gemini cache", "error", err, "name", request.Name, "endpoint", key)
+			s.deleteCachedContents(cache, cachers)
+			var invalidRequest *provider.InvalidRequestError
+			if errors.As(err, &invalidRequest) {
+				return nil, BadRequestError{invalidRequest}
+			}
+			return nil, InternalServerError{fmt.Errorf("failed to create the cache on %s", key)}
+		}
+		cache.Resources[key] = resource
+		cachers[key] = cacher
+		if cache.ExpiresAt.IsZero() || expiresAt.Before(cache.ExpiresAt) {
+			cache.ExpiresAt = expiresAt
+		}
+	}
+	if len(cache.Resources) == 0 {
+		return nil, BadRequestError{fmt.Errorf("no endpoint of %s supports context caching", request.Model)}
+	}
+	return cache, nil
+}
+
+// Deletes the resources of the cache on the endpoints. Failures are only
+// logged, since the endpoints delete them at their expiry anyway.
+func (s *ModelProxy) deleteCachedContents(cache *GeminiCache, cachers map[string]provider.ContentCacher) {
+	for key, resource := range cache.Resources {
+		cacher, found := cachers[key]
+		if !found {
+			continue
+		}
+		// Deleting should be done even if the request has been canceled.
+		if err := cacher.DeleteCachedContent(context.Background(), resource); err != nil {
+			s.logger.Warnw("Failed to delete Gemini cache", "error", err, "name", cache.Name, "endpoint", key)
+		}
+	}
+}
+
+// Returns the cachers of the endpoints that the cache has resources on.
+func (s *ModelProxy) geminiCachers(cache *GeminiCache) map[string]provider.ContentCacher {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	cachers := map[string]provider.ContentCacher{}
+	for _, endpoint := range s.endpoints {
+		cacher, ok := endpoint.(provider.ContentCacher)
+		if !ok {
+			continue
+		}
+		prefix := endpoint.Provider() + "/" + endpoint.Region() + "/"
+		for key := range cache.Resources {
+			if strings.HasPrefix(key, prefix) {
+				cachers[key] = cacher
+			}
+		}
+	}
+	return cachers
+}
+
+func (s *ModelProxy) HandleCreateGeminiCache(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+	var request CreateGeminiCacheRequest
+	if err := json.NewDecoder(httpRequest.Body).Decode(&request); err != nil {
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	ttl := defaultGeminiCacheTtl
+	if request.Ttl != "" {
+		parsed, err := time.ParseDuration(request.Ttl)
+		if err != nil || parsed <= 0 {
+			handleError(httpResponse, BadRequestError{fmt.Errorf("ttl must be a positive duration: %q", request.Ttl)})
+			return
+		}
+		ttl = parsed
+	}
+	switch {
+	case request.Name == "":
+		handleError(httpResponse, BadRequestError{errors.New("name is required")})
+		return
+	case request.Model == "":
+		handleError(httpResponse, BadRequestError{errors.New("model is required")})
+		return
+	case request.SystemPrompt == "":
+		handleError(httpResponse, BadRequestError{errors.New("system_prompt is required")})
+		return
+	}
+
+	ctx := httpRequest.Context()
+	caches, err := s.loadGeminiCaches(ctx)
+	if err != nil {
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if _, found := caches[request.Name]; found {
+		writeError(httpResponse, http.StatusConflict, errorTypeInvalidRequest, "gemini_cache_exists", fmt.Sprintf("Gemini cache %q already exists", request.Name))
+		return
+	}
+
+	cache, err := s.createGeminiCache(ctx, request, ttl)
+	if err != nil {
+		handleError(httpResponse, err)
+		return
+	}
+	exists := false
+	err = s.updateGeminiCaches(ctx, func(caches map[string]*GeminiCache) error {
+		// Created by another request in the meantime.
+		if _, exists = caches[cache.Name]; exists {
+			return nil
+		}
+		caches[cache.Name] = cache
+		return nil
+	})
+	if err != nil || exists {
+		s.deleteCachedContents(cache, s.geminiCachers(cache))
+		if exists {
+			writeError(httpResponse, http.StatusConflict, errorTypeInvalidRequest, "gemini_cache_exists", fmt.Sprintf("Gemini cache %q already exists", request.Name))
+			return
+		}
+		s.logger.Warnw("Failed to save Gemini cache", "error", err, "name", cache.Name)
+		writeGeminiCachesError(httpResponse, err)
+		return
+	}
+	s.logger.Infow("Created Gemini cache", "name", cache.Name, "model", cache.Model, "expires_at", cache.ExpiresAt)
+
+	response := *cache
+	response.SystemPrompt = ""
+	httpResponse.Header().Set("Content-Type", "application/json")
+	httpResponse.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+	}
+}
+
+func (s *ModelProxy) HandleGeminiCaches(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	caches, err := s.loadGeminiCaches(httpRequest.Context())
+	if err != nil {
+		s.logger.Warnw("Failed to load Gemini caches", "error", err)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	response := GeminiCachesResponse{GeminiCaches: []GeminiCache{}}
+	for _, cache := range caches {
+		listed := *cache
+		listed.SystemPrompt = ""
+		response.GeminiCaches = append(response.GeminiCaches, listed)
+	}
+	slices.SortFunc(response.GeminiCaches, func(a GeminiCache, b GeminiCache) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+func (s *ModelProxy) HandleDeleteGeminiCache(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	name := httpRequest.PathValue("name")
+	var deleted *GeminiCache
+	err := s.updateGeminiCaches(httpRequest.Context(), func(caches map[string]*GeminiCache) error {
+		deleted = caches[name]
+		delete(caches, name)
+		return nil
+	})
+	if err != nil {
+		s.logger.Warnw("Failed to delete Gemini cache", "error", err, "name", name)
+		writeGeminiCachesError(httpResponse, err)
+		return
+	}
+	if deleted == nil {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "gemini_cache_not_found", fmt.Sprintf("No Gemini cache is named %q", name))
+		return
+	}
+	s.deleteCachedContents(deleted, s.geminiCachers(deleted))
+	s.logger.Infow("Deleted Gemini cache", "name", name)
+	httpResponse.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+// Endpoint that caches the system prompts in memory, like a Gemini endpoint.
+type fakeCacherEndpoint struct {
+	*fakeEndpoint
+
+	// Fails the creation of the caches if set.
+	createErr error
+
+	mutex    sync.Mutex
+	created  []string
+	deleted  []string
+	contents []provider.CachedContent
+}
+
+func (e *fakeCacherEndpoint) CreateCachedContent(ctx context.Context, model string, systemPrompt string, ttl time.Duration) (string, time.Time, error) {
+	if e.createErr != nil {
+		return "", time.Time{}, e.createErr
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	resource := fmt.Sprintf("cachedContents/%s-%s-%d", e.provider, model, len(e.created))
+	e.created = append(e.created, resource)
+	return resource, time.Now().Add(ttl), nil
+}
+
+func (e *fakeCacherEndpoint) DeleteCachedContent(ctx context.Context, resource string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.deleted = append(e.deleted, resource)
+	return nil
+}
+
+func newFakeCacherEndpoint(providerName string, region string) *fakeCacherEndpoint {
+	endpoint := &fakeCacherEndpoint{}
+	endpoint.fakeEndpoint = &fakeEndpoint{provider: providerName, region: region, generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		response := &openai.ChatCompletionResponse{
+			Model:   request.Model,
+			Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: &request.Model}}, FinishReason: "stop"}},
+			Usage:   openai.Usage{PromptTokens: 1000, CompletionTokens: 10, TotalTokens: 1010},
+		}
+		content, found := provider.CachedContentFrom(ctx)
+		if !found {
+			return response, nil
+		}
+		endpoint.mutex.Lock()
+		endpoint.contents = append(endpoint.contents, content)
+		endpoint.mutex.Unlock()
+		response.Usage.PromptTokensDetails = &openai.PromptTokensDetails{CachedTokens: 900}
+		response.Ogem = &openai.ResponseMetadata{GeminiCache: &openai.GeminiCacheMetadata{Name: content.Name, Hit: true}}
+		return response, nil
+	}}
+	return endpoint
+}
+
+func TestGeminiCache(t *testing.T) {
+	newProxy := func(t *testing.T, endpoints ...provider.AiEndpoint) *ModelProxy {
+		providers := ogem.ProvidersStatus{}
+		for _, endpoint := range endpoints {
+			providers[endpoint.Provider()] = &ogem.ProviderStatus{Regions: map[string]*ogem.RegionStatus{
+				endpoint.Region(): {Models: []*ogem.SupportedModel{{Name: "gemini-1.5-pro"}}},
+			}}
+		}
+		proxy := newTestProxy(t, providers, endpoints...)
+		proxy.config.ApiKeys = []ApiKey{{Name: "admin", Key: "admin-key", Admin: true}}
+		proxy.indexApiKeys()
+		return proxy
+	}
+	admin := func(proxy *ModelProxy, method string, target string, body string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /v1/admin/gemini-caches", proxy.HandleAdminAuthentication(proxy.HandleCreateGeminiCache))
+		mux.HandleFunc("GET /v1/admin/gemini-caches", proxy.HandleAdminAuthentication(proxy.HandleGeminiCaches))
+		mux.HandleFunc("DELETE /v1/admin/gemini-caches/{name}", proxy.HandleAdminAuthentication(proxy.HandleDeleteGeminiCache))
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer admin-key")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	chatCompletions := func(proxy *ModelProxy, cache string) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		body := `{"model": "gemini-1.5-pro", "messages": [{"role": "system", "content": "Follow the policy."}, {"role": "user", "content": "Hi"}]}`
+		recorder := sendChatCompletions(proxy, body, map[string]string{"X-Ogem-Gemini-Cache": cache}, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		return recorder, decodeChatCompletion(recorder)
+	}
+	const createBody = `{"name": "policy", "model": "gemini-1.5-pro", "system_prompt": "Follow the policy.", "ttl": "30m"}`
+
+	t.Run("Creates the cache on every endpoint and references it", func(t *testing.T) {
+		vertex := newFakeCacherEndpoint("vertex", "us-central1")
+		studio := newFakeCacherEndpoint("studio", "studio")
+		proxy := newProxy(t, vertex, studio)
+
+		recorder := admin(proxy, "POST", "/v1/admin/gemini-caches", createBody)
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+		var created GeminiCache
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+		assert.Equal(t, map[string]string{
+			"vertex/us-central1/gemini-1.5-pro": "cachedContents/vertex-gemini-1.5-pro-0",
+			"studio/studio/gemini-1.5-pro":      "cachedContents/studio-gemini-1.5-pro-0",
+		}, created.Resources)
+		assert.WithinDuration(t, time.Now().Add(30*time.Minute), created.ExpiresAt, time.Minute)
+		assert.Empty(t, created.SystemPrompt)
+
+		recorder = admin(proxy, "GET", "/v1/admin/gemini-caches", "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var listed GeminiCachesResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &listed))
+		assert.Len(t, listed.GeminiCaches, 1)
+		assert.Equal(t, "policy", listed.GeminiCaches[0].Name)
+		assert.NotContains(t, recorder.Body.String(), "Follow the policy.")
+
+		recorder, response := chatCompletions(proxy, "policy")
+		assert.Equal(t, "hit", recorder.Header().Get("X-Ogem-Gemini-Cache"))
+		assert.Empty(t, recorder.Header().Get("Warning"))
+		assert.Equal(t, &openai.GeminiCacheMetadata{Name: "policy", Hit: true}, response.Ogem.GeminiCache)
+		assert.Equal(t, int32(900), response.Usage.PromptTokensDetails.CachedTokens)
+		contents := append(vertex.contents, studio.contents...)
+		assert.Len(t, contents, 1)
+		assert.Equal(t, "Follow the policy.", contents[0].SystemPrompt)
+		assert.Contains(t, []string{created.Resources["vertex/us-central1/gemini-1.5-pro"], created.Resources["studio/studio/gemini-1.5-pro"]}, contents[0].Resource)
+
+		assert.Equal(t, http.StatusConflict, admin(proxy, "POST", "/v1/admin/gemini-caches", createBody).Code)
+	})
+
+	t.Run("Sends the full prompt and warns if the cache is missing", func(t *testing.T) {
+		vertex := newFakeCacherEndpoint("vertex", "us-central1")
+		proxy := newProxy(t, vertex)
+
+		recorder, response := chatCompletions(proxy, "unknown")
+		assert.Equal(t, "miss", recorder.Header().Get("X-Ogem-Gemini-Cache"))
+		assert.Contains(t, recorder.Header().Get("Warning"), `199 - "Gemini cache unknown was not used (not_found)`)
+		assert.Equal(t, &openai.GeminiCacheMetadata{Name: "unknown", Miss: "not_found"}, response.Ogem.GeminiCache)
+		assert.Empty(t, vertex.contents)
+		assert.Equal(t, "Follow the policy.", *vertex.requests[0].Messages[0].Content.String)
+	})
+
+	t.Run("Reports the miss of the endpoint", func(t *testing.T) {
+		vertex := newFakeCacherEndpoint("vertex", "us-central1")
+		vertex.generate = func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return &openai.ChatCompletionResponse{
+				Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: &request.Model}}, FinishReason: "stop"}},
+				Ogem:    &openai.ResponseMetadata{GeminiCache: &openai.GeminiCacheMetadata{Name: "policy", Miss: "not_found"}},
+			}, nil
+		}
+		proxy := newProxy(t, vertex)
+		assert.Equal(t, http.StatusCreated, admin(proxy, "POST", "/v1/admin/gemini-caches", createBody).Code)
+
+		recorder, _ := chatCompletions(proxy, "policy")
+		assert.Equal(t, "miss", recorder.Header().Get("X-Ogem-Gemini-Cache"))
+		assert.Contains(t, recorder.Header().Get("Warning"), "(not_found)")
+	})
+
+	t.Run("Rolls back the cache if an endpoint fails", func(t *testing.T) {
+		vertex := newFakeCacherEndpoint("vertex", "us-central1")
+		studio := newFakeCacherEndpoint("studio", "studio")
+		studio.createErr = provider.NewInvalidRequestError(errors.New("the prompt is too short to cache"))
+		proxy := newProxy(t, vertex, studio)
+
+		recorder := admin(proxy, "POST", "/v1/admin/gemini-caches", createBody)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "too short")
+		assert.Equal(t, vertex.created, vertex.deleted)
+
+		recorder = admin(proxy, "GET", "/v1/admin/gemini-caches", "")
+		assert.Contains(t, recorder.Body.String(), `"gemini_caches":[]`)
+	})
+
+	t.Run("Rejects the model without a caching endpoint", func(t *testing.T) {
+		proxy := newProxy(t, &fakeEndpoint{provider: "openai", region: "openai"})
+
+		recorder := admin(proxy, "POST", "/v1/admin/gemini-caches", createBody)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "supports context caching")
+
+		for _, body := range []string{
+			`{"model": "gemini-1.5-pro", "system_prompt": "Follow the policy."}`,
+			`{"name": "policy", "system_prompt": "Follow the policy."}`,
+			`{"name": "policy", "model": "gemini-1.5-pro"}`,
+			`{"name": "policy", "model": "gemini-1.5-pro", "system_prompt": "Follow the policy.", "ttl": "-1m"}`,
+		} {
+			assert.Equal(t, http.StatusBadRequest, admin(proxy, "POST", "/v1/admin/gemini-caches", body).Code, body)
+		}
+	})
+
+	t.Run("Deletes the cache upstream", func(t *testing.T) {
+		vertex := newFakeCacherEndpoint("vertex", "us-central1")
+		proxy := newProxy(t, vertex)
+		assert.Equal(t, http.StatusCreated, admin(proxy, "POST", "/v1/admin/gemini-caches", createBody).Code)
+
+		assert.Equal(t, http.StatusNoContent, admin(proxy, "DELETE", "/v1/admin/gemini-caches/policy", "").Code)
+		assert.Equal(t, vertex.created, vertex.deleted)
+		assert.Equal(t, http.StatusNotFound, admin(proxy, "DELETE", "/v1/admin/gemini-caches/policy", "").Code)
+
+		recorder, _ := chatCompletions(proxy, "policy")
+		assert.Equal(t, "miss", recorder.Header().Get("X-Ogem-Gemini-Cache"))
+	})
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/state"
+)
+
+type RegionHealth struct {
+	Provider string `json:"provider"`
+	Region   string `json:"region"`
+
+	// Whether the last health check succeeded. False until the first check.
+	Healthy bool `json:"healthy"`
+
+	// Whether the provider rejected the credentials on the last check.
+	Unauthorized bool `json:"unauthorized,omitempty"`
+
+	// Error of the last health check, if any.
+	Error string `json:"error,omitempty"`
+
+	// Moving average of the pings of the region, by which it is routed.
+	LatencyMs int64 `json:"latency_ms"`
+
+	// Result of the last ping, even if it was left out of the average.
+	LastLatencyMs int64 `json:"last_latency_ms"`
+
+	LatencyDeviationMs int64     `json:"latency_deviation_ms"`
+	LastChecked        time.Time `json:"last_checked"`
+}
+
+type ReadinessResponse struct {
+	Ready   bool           `json:"ready"`
+	Regions []RegionHealth `json:"regions"`
+
+	// Whether the state is kept in memory because Valkey is unreachable. The
+	// proxy is still ready, but without caching and shared rate limits.
+	StateDegraded bool `json:"state_degraded"`
+
+	// Whether requests are being shed under load. The proxy is still ready,
+	// but rejects the requests beyond its limits.
+	Degraded bool `json:"degraded,omitempty"`
+
+	// Number of the requests shed under load since the start.
+	ShedRequests int64 `json:"shed_requests,omitempty"`
+
+	// Whether the endpoints are still being warmed up. The proxy is not ready
+	// until they are.
+	Warming bool `json:"warming,omitempty"`
+}
+
+// Reports whether the proxy can serve requests. Once warmed up, it is ready
+// if any region passed its last health check, or always if the ping loop is
+// disabled.
+// Responds with 503 otherwise so that load balancers stop routing to it.
+func (s *ModelProxy) HandleReadiness(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	readiness := s.readiness()
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		httpResponse.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(httpResponse).Encode(readiness); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+	}
+}
+
+// Returns the health of every region, sorted by provider and region.
+func (s *ModelProxy) readiness() ReadinessResponse {
+	s.mutex.RLock()
+	regions := []RegionHealth{}
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, regionStatus ogem.RegionStatus, _ []*ogem.SupportedModel) bool {
+		regions = append(regions, RegionHealth{
+			Provider:     provider,
+			Region:       region,
+			Healthy:      regionStatus.Healthy(),
+			Unauthorized: regionStatus.Unauthorized,
+			Error:        regionStatus.LastError,
+			LatencyMs:    regionStatus.Latency.Milliseconds(),
+			LastChecked:  regionStatus.LastChecked,
+
+			LastLatencyMs:      regionStatus.LastLatency.Milliseconds(),
+			LatencyDeviationMs: regionStatus.LatencyDeviation.Milliseconds(),
+		})
+		return false
+	})
+	s.mutex.RUnlock()
+
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].Provider != regions[j].Provider {
+			return regions[i].Provider < regions[j].Provider
+		}
+		return regions[i].Region < regions[j].Region
+	})
+
+	ready := s.PingInterval() <= 0
+	for _, region := range regions {
+		ready = ready || region.Healthy
+	}
+	warming := s.warming.Load()
+	stateDegraded := false
+	if reporter, ok := s.stateManager.(state.DegradationReporter); ok {
+		stateDegraded = reporter.Degraded()
+	}
+	readiness := ReadinessResponse{Ready: ready && !warming, Regions: regions, StateDegraded: stateDegraded, Warming: warming}
+	if s.loadShedder != nil {
+		readiness.Degraded, readiness.ShedRequests = s.loadShedder.status()
+	}
+	return readiness
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/state"
+)
+
+func TestHealthCheck(t *testing.T) {
+	models := []*ogem.SupportedModel{{Name: "fake-model@batch"}, {Name: "fake-model"}}
+	newProxy := func(t *testing.T, endpoints ...*fakeEndpoint) *ModelProxy {
+		regions := map[string]*ogem.RegionStatus{}
+		aiEndpoints := []provider.AiEndpoint{}
+		for _, endpoint := range endpoints {
+			regions[endpoint.region] = &ogem.RegionStatus{Models: models}
+			aiEndpoints = append(aiEndpoints, endpoint)
+		}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: regions}}, aiEndpoints...)
+		proxy.SetPingInterval(time.Hour)
+		return proxy
+	}
+	regionStatus := func(proxy *ModelProxy, region string) *ogem.RegionStatus {
+		return proxy.endpointStatus["fake"].Regions[region]
+	}
+
+	t.Run("Marks the failing regions unhealthy", func(t *testing.T) {
+		proxy := newProxy(t,
+			&fakeEndpoint{provider: "fake", region: "healthy", ping: func(ctx context.Context) (time.Duration, error) {
+				return 10 * time.Millisecond, nil
+			}},
+			&fakeEndpoint{provider: "fake", region: "unauthorized", ping: func(ctx context.Context) (time.Duration, error) {
+				return 0, provider.NewAuthError(errors.New("invalid api key"))
+			}},
+			&fakeEndpoint{provider: "fake", region: "down", ping: func(ctx context.Context) (time.Duration, error) {
+				return 0, errors.New("connection refused")
+			}},
+		)
+		proxy.pingAllEndpoints(context.Background(), false)
+
+		assert.True(t, regionStatus(proxy, "healthy").Healthy())
+		assert.Equal(t, 10*time.Millisecond, regionStatus(proxy, "healthy").Latency)
+
+		assert.False(t, regionStatus(proxy, "unauthorized").Healthy())
+		assert.True(t, regionStatus(proxy, "unauthorized").Unauthorized)
+		assert.Contains(t, regionStatus(proxy, "unauthorized").LastError, "invalid api key")
+
+		assert.False(t, regionStatus(proxy, "down").Healthy())
+		assert.False(t, regionStatus(proxy, "down").Unauthorized)
+		assert.Contains(t, regionStatus(proxy, "down").LastError, "connection refused")
+
+		status, response := readiness(proxy)
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, response.Ready)
+		assert.Equal(t, []RegionHealth{
+			{Provider: "fake", Region: "down", Error: "connection refused"},
+			{Provider: "fake", Region: "healthy", Healthy: true, LatencyMs: 10, LastLatencyMs: 10},
+			{Provider: "fake", Region: "unauthorized", Unauthorized: true, Error: "authentication failed: invalid api key"},
+		}, clearLastChecked(response.Regions))
+	})
+
+	t.Run("Recovers on the next successful check", func(t *testing.T) {
+		var pingErr error = errors.New("connection refused")
+		proxy := newProxy(t, &fakeEndpoint{provider: "fake", region: "flaky", ping: func(ctx context.Context) (time.Duration, error) {
+			return time.Millisecond, pingErr
+		}})
+
+		proxy.pingAllEndpoints(context.Background(), false)
+		assert.False(t, regionStatus(proxy, "flaky").Healthy())
+
+		pingErr = nil
+		proxy.pingAllEndpoints(context.Background(), false)
+		assert.True(t, regionStatus(proxy, "flaky").Healthy())
+		assert.Empty(t, regionStatus(proxy, "flaky").LastError)
+	})
+
+	t.Run("Deep check generates a completion with a non-batch model", func(t *testing.T) {
+		failing := &fakeEndpoint{provider: "fake", region: "failing", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return nil, errors.New("model not found")
+		}}
+		healthy := &fakeEndpoint{provider: "fake", region: "healthy"}
+		proxy := newProxy(t, failing, healthy)
+
+		proxy.pingAllEndpoints(context.Background(), false)
+		assert.Empty(t, healthy.receivedRequests())
+		assert.True(t, regionStatus(proxy, "failing").Healthy())
+
+		proxy.pingAllEndpoints(context.Background(), true)
+		assert.Len(t, healthy.receivedRequests(), 1)
+		assert.Equal(t, "fake-model", healthy.receivedRequests()[0].Model)
+		assert.Equal(t, int32(1), *healthy.receivedRequests()[0].MaxTokens)
+		assert.True(t, regionStatus(proxy, "healthy").Healthy())
+		assert.False(t, regionStatus(proxy, "failing").Healthy())
+		assert.Contains(t, regionStatus(proxy, "failing").LastError, "model not found")
+	})
+
+	t.Run("Is not ready until a region is healthy", func(t *testing.T) {
+		proxy := newProxy(t, &fakeEndpoint{provider: "fake", region: "down", ping: func(ctx context.Context) (time.Duration, error) {
+			return 0, errors.New("connection refused")
+		}})
+
+		status, response := readiness(proxy)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.False(t, response.Ready)
+
+		proxy.pingAllEndpoints(context.Background(), false)
+		status, _ = readiness(proxy)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	})
+
+	t.Run("Is always ready without the ping loop", func(t *testing.T) {
+		proxy := newProxy(t, &fakeEndpoint{provider: "fake", region: "unchecked"})
+		proxy.SetPingInterval(0)
+
+		status, response := readiness(proxy)
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, response.Ready)
+		assert.False(t, response.Regions[0].Healthy)
+	})
+}
+
+func TestStateOutage(t *testing.T) {
+	server := miniredis.RunT(t)
+	client, err := valkey.NewClient(valkey.ClientOption{InitAddress: []string{server.Addr()}, DisableCache: true, DisableRetry: true})
+	assert.NoError(t, err)
+	t.Cleanup(client.Close)
+	stateManager, cleanup := state.NewResilientManager(state.NewValkeyManager(client), 1, 100*time.Millisecond, zap.NewNop().Sugar())
+	t.Cleanup(cleanup)
+
+	endpoint := &fakeEndpoint{provider: "fake", region: "fake"}
+	proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: map[string]*ogem.RegionStatus{"fake": {
+		Models: []*ogem.SupportedModel{{Name: "fake-model", MaxRequestsPerMinute: 600_000_000}},
+	}}}}, endpoint)
+	proxy.stateManager = stateManager
+
+	chatCompletions := func(content string) int {
+		body := `{"model": "fake-model", "temperature": 0, "messages": [{"role": "user", "content": "` + content + `"}]}`
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, chatCompletions("cached"))
+	assert.Equal(t, http.StatusOK, chatCompletions("cached"))
+	assert.Len(t, endpoint.receivedRequests(), 1)
+
+	// Requests are served without the cache while Valkey is down.
+	server.Close()
+	assert.Equal(t, http.StatusOK, chatCompletions("cached"))
+	assert.Equal(t, http.StatusOK, chatCompletions("cached"))
+	assert.Len(t, endpoint.receivedRequests(), 3)
+	status, response := readiness(proxy)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, response.StateDegraded)
+
+	// Caching resumes after the cooldown once Valkey is back.
+	assert.NoError(t, server.Restart())
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, chatCompletions("fresh"))
+	assert.Equal(t, http.StatusOK, chatCompletions("fresh"))
+	assert.Len(t, endpoint.receivedRequests(), 4)
+	_, response = readiness(proxy)
+	assert.False(t, response.StateDegraded)
+}
+
+func readiness(proxy *ModelProxy) (int, ReadinessResponse) {
+	recorder := httptest.NewRecorder()
+	proxy.HandleReadiness(recorder, httptest.NewRequest("GET", "/ready", nil))
+	var response ReadinessResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+func clearLastChecked(regions []RegionHealth) []RegionHealth {
+	for index := range regions {
+		regions[index].LastChecked = time.Time{}
+	}
+	return regions
+}
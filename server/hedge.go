@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+type idempotentContextKey struct{}
+
+// Default number of backup requests if hedging is enabled.
+const defaultMaxHedges = 1
+
+// Result of sending the request to an endpoint.
+type attempt struct {
+	endpoint *endpointStatus
+
+	// Request as sent to the endpoint, with its model name.
+	request *openai.ChatCompletionRequest
+
+	response *openai.ChatCompletionResponse
+	err      error
+}
+
+// Whether the caller marked the request as safe to send more than once with
+// the Idempotency-Key header.
+func isIdempotent(httpRequest *http.Request) bool {
+	return httpRequest.Header.Get("Idempotency-Key") != ""
+}
+
+func withIdempotent(ctx context.Context, idempotent bool) context.Context {
+	return context.WithValue(ctx, idempotentContextKey{}, idempotent)
+}
+
+func idempotentFrom(ctx context.Context) bool {
+	idempotent, _ := ctx.Value(idempotentContextKey{}).(bool)
+	return idempotent
+}
+
+// Whether the request may be sent to a second endpoint while the first is
+// still working on it. Only the requests whose duplicates are harmless are,
+// that is the deterministic ones and the ones marked idempotent.
+func (s *ModelProxy) hedgeable(ctx context.Context, request *openai.ChatCompletionRequest, deterministic bool) bool {
+	if s.hedgeAfter <= 0 || (request.Stream != nil && *request.Stream) {
+		return false
+	}
+	return deterministic || idempotentFrom(ctx)
+}
+
+// Returns a copy of the request for the endpoint, with the defaults of its
+// model and max_tokens clamped to the maximum output tokens of the model. The
+// defaults are applied per endpoint, since the models of an alias may have
+// different ones.
+func requestForEndpoint(request *openai.ChatCompletionRequest, endpoint *endpointStatus) *openai.ChatCompletionRequest {
+	endpointRequest := *applyModelDefaults(request, endpoint.modelStatus.Defaults)
+	endpointRequest.Model = endpoint.modelStatus.Name
+	clampMaxTokens(&endpointRequest, endpoint.modelStatus.ResolvedCapabilities().MaxOutputTokens)
+	if endpoint.modelStatus.Reasoning {
+		toReasoningRequest(&endpointRequest)
+	}
+	return &endpointRequest
+}
+
+// Sends the request to the endpoint, whose slot must have been taken by the
+// caller. The slot is released once the endpoint responds.
+func (s *ModelProxy) attempt(ctx context.Context, endpoint *endpointStatus, request *openai.ChatCompletionRequest) attempt {
+	defer s.inFlight.release(endpoint)
+	endpointRequest := requestForEndpoint(request, endpoint)
+	start := time.Now()
+	response, err := generateChoices(ctx, endpoint, endpointRequest)
+	if err == nil {
+		s.slo.record(endpoint, time.Since(start))
+	}
+	return attempt{endpoint: endpoint, request: endpointRequest, response: response, err: err}
+}
+
+// Sends the request to the primary endpoint, and to the next backup that is
+// not rate limited each time hedgeAfter passes without a response, up to
+// maxHedges backups. Returns the first successful attempt and cancels the
+// others. If every attempt fails, returns the attempt of the primary so that
+// the caller handles its error; the quota errors of the backups disable them
+// here. Without backups, it is a plain attempt on the primary.
+func (s *ModelProxy) generateHedged(
+	ctx context.Context,
+	primary *endpointStatus,
+	backups []*endpointStatus,
+	request *openai.ChatCompletionRequest,
+	modelOrAlias string,
+) attempt {
+	if len(backups) == 0 {
+		return s.attempt(ctx, primary, request)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered so that the losers do not block after the winner returns.
+	results := make(chan attempt, 1+s.maxHedges)
+	start := func(endpoint *endpointStatus) {
+		go func() {
+			results <- s.attempt(ctx, endpoint, request)
+		}()
+	}
+
+	start(primary)
+	running := 1
+	hedges := 0
+	timer := time.NewTimer(s.hedgeAfter)
+	defer timer.Stop()
+
+	var primaryResult attempt
+	for running > 0 {
+		select {
+		case result := <-results:
+			running--
+			if result.err == nil {
+				if hedges > 0 {
+					s.logger.Infow(
+						"Hedged request finished",
+						"provider", result.endpoint.endpoint.Provider(),
+						"region", result.endpoint.endpoint.Region(),
+						"model", modelOrAlias,
+						"hedges", hedges,
+						"winner_is_primary", result.endpoint == primary,
+					)
+					go s.recordLosers(ctx, request, results, running, modelOrAlias)
+				}
+				return result
+			}
+			if result.endpoint == primary {
+				primaryResult = result
+			} else if !s.disableOnQuotaError(ctx, result.endpoint, modelOrAlias, result.err) {
+				s.logger.Warnw("Hedged request failed", "error", result.err, "provider", result.endpoint.endpoint.Provider(), "region", result.endpoint.endpoint.Region(), "model", modelOrAlias)
+			}
+
+		case <-timer.C:
+			if hedges >= s.maxHedges {
+				continue
+			}
+			var backup *endpointStatus
+			backup, backups = s.nextHedge(ctx, backups, modelOrAlias)
+			if backup == nil {
+				continue
+			}
+			s.logger.Infow(
+				"Hedging slow request",
+				"provider", backup.endpoint.Provider(),
+				"region", backup.endpoint.Region(),
+				"model", modelOrAlias,
+				"after", s.hedgeAfter*time.Duration(hedges+1),
+			)
+			start(backup)
+			running++
+			hedges++
+			timer.Reset(s.hedgeAfter)
+		}
+	}
+	return primaryResult
+}
+
+// Returns the first backup that is neither busy nor rate limited, and the
+// backups after it. A slot and the rate limit of the returned backup are
+// consumed.
+func (s *ModelProxy) nextHedge(ctx context.Context, backups []*endpointStatus, modelOrAlias string) (*endpointStatus, []*endpointStatus) {
+	for index, backup := range backups {
+		if !s.inFlight.acquire(backup) {
+			continue
+		}
+		accepted, _, err := s.stateManager.Allow(
+			ctx,
+			backup.endpoint.Provider(),
+			backup.endpoint.Region(),
+			rateLimitModel(ctx, backup, modelOrAlias),
+			requestInterval(backup.modelStatus),
+			requestBurst(backup.modelStatus),
+		)
+		if err != nil {
+			s.inFlight.release(backup)
+			s.logger.Warnw("Failed to check rate limit", "error", err, "provider", backup.endpoint.Provider(), "region", backup.endpoint.Region(), "model", modelOrAlias)
+			continue
+		}
+		if accepted {
+			return backup, backups[index+1:]
+		}
+		s.inFlight.release(backup)
+	}
+	return nil, nil
+}
+
+// Logs the usage of the attempts that finished after the winner. They are
+// canceled, but the ones that completed anyway are still billed by their
+// providers, so their usage is also charged to the end user if configured.
+func (s *ModelProxy) recordLosers(ctx context.Context, request *openai.ChatCompletionRequest, results <-chan attempt, running int, modelOrAlias string) {
+	for range running {
+		result := <-results
+		if result.err != nil {
+			continue
+		}
+		backfillUsage(result.request, result.response)
+		if s.config.ChargeHedgeLosers {
+			s.recordEndUserHedgeUsage(ctx, request, result.response, result.endpoint.modelStatus)
+		}
+		s.logger.Infow(
+			"Hedged request completed after the winner",
+			"provider", result.endpoint.endpoint.Provider(),
+			"region", result.endpoint.endpoint.Region(),
+			"model", modelOrAlias,
+			"prompt_tokens", result.response.Usage.PromptTokens,
+			"completion_tokens", result.response.Usage.CompletionTokens,
+		)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestHedging(t *testing.T) {
+	// The primary is preferred for its latency but stalls until canceled.
+	newProxy := func(t *testing.T, backupRpm int) (*ModelProxy, *fakeEndpoint, *fakeEndpoint, chan struct{}) {
+		canceled := make(chan struct{}, 1)
+		primary := &fakeEndpoint{provider: "primary", region: "primary", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			select {
+			case <-ctx.Done():
+				canceled <- struct{}{}
+				return nil, ctx.Err()
+			case <-time.After(200 * time.Millisecond):
+				return &openai.ChatCompletionResponse{Model: request.Model, Choices: []openai.Choice{{FinishReason: "stop"}}}, nil
+			}
+		}}
+		backup := &fakeEndpoint{provider: "backup", region: "backup"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"primary": {Regions: map[string]*ogem.RegionStatus{"primary": {
+				Latency:     10 * time.Millisecond,
+				LastChecked: time.Now(),
+				Models:      []*ogem.SupportedModel{{Name: "primary-model", OtherNames: []string{"chat"}}},
+			}}},
+			"backup": {Regions: map[string]*ogem.RegionStatus{"backup": {
+				Latency:     20 * time.Millisecond,
+				LastChecked: time.Now(),
+				Models:      []*ogem.SupportedModel{{Name: "backup-model", OtherNames: []string{"chat"}, MaxRequestsPerMinute: backupRpm}},
+			}}},
+		}, primary, backup)
+		proxy.hedgeAfter = 20 * time.Millisecond
+		proxy.maxHedges = 1
+		return proxy, primary, backup, canceled
+	}
+	request := func(temperature float32) *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:       "chat",
+			Messages:    []openai.Message{userMessage("Hi")},
+			Temperature: utils.ToPtr(temperature),
+		}
+	}
+
+	t.Run("Backup wins over the stalled primary", func(t *testing.T) {
+		proxy, primary, backup, canceled := newProxy(t, 0)
+
+		start := time.Now()
+		response, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request(0), false)
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), 200*time.Millisecond)
+		assert.Equal(t, "backup-model", response.Model)
+		assert.Equal(t, "backup/backup/backup-model", resolvedModel)
+		assert.Len(t, primary.receivedRequests(), 1)
+		assert.Len(t, backup.receivedRequests(), 1)
+
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Error("The primary request is not canceled")
+		}
+	})
+
+	t.Run("Idempotent requests are hedged", func(t *testing.T) {
+		proxy, _, backup, _ := newProxy(t, 0)
+
+		ctx := withIdempotent(context.Background(), true)
+		response, _, err := proxy.generateChatCompletion(ctx, request(1), false)
+		assert.NoError(t, err)
+		assert.Equal(t, "backup-model", response.Model)
+		assert.Len(t, backup.receivedRequests(), 1)
+	})
+
+	t.Run("Other requests wait for the primary", func(t *testing.T) {
+		proxy, _, backup, _ := newProxy(t, 0)
+
+		response, _, err := proxy.generateChatCompletion(context.Background(), request(1), false)
+		assert.NoError(t, err)
+		assert.Equal(t, "primary-model", response.Model)
+		assert.Empty(t, backup.receivedRequests())
+	})
+
+	t.Run("Rate limited backups are not hedged", func(t *testing.T) {
+		proxy, _, backup, _ := newProxy(t, 1)
+		accepted, _, err := proxy.stateManager.Allow(context.Background(), "backup", "backup", "chat", time.Minute, 1)
+		assert.NoError(t, err)
+		assert.True(t, accepted)
+
+		response, _, err := proxy.generateChatCompletion(context.Background(), request(0), false)
+		assert.NoError(t, err)
+		assert.Equal(t, "primary-model", response.Model)
+		assert.Empty(t, backup.receivedRequests())
+	})
+
+	t.Run("Primary wins if the backup fails", func(t *testing.T) {
+		proxy, _, backup, _ := newProxy(t, 0)
+		backup.generate = func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return nil, errors.New("internal error")
+		}
+
+		response, _, err := proxy.generateChatCompletion(context.Background(), request(0), false)
+		assert.NoError(t, err)
+		assert.Equal(t, "primary-model", response.Model)
+		assert.Len(t, backup.receivedRequests(), 1)
+	})
+}
+
+func TestHedgeLoserUsage(t *testing.T) {
+	// The primary ignores the cancellation and completes after the backup.
+	newProxy := func(t *testing.T, chargeLosers bool) *ModelProxy {
+		respond := func(request *openai.ChatCompletionRequest) *openai.ChatCompletionResponse {
+			return &openai.ChatCompletionResponse{
+				Model:   request.Model,
+				Choices: []openai.Choice{{FinishReason: "stop"}},
+				Usage:   openai.Usage{PromptTokens: 600, CompletionTokens: 400, TotalTokens: 1000},
+			}
+		}
+		primary := &fakeEndpoint{provider: "primary", region: "primary", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			time.Sleep(100 * time.Millisecond)
+			return respond(request), nil
+		}}
+		backup := &fakeEndpoint{provider: "backup", region: "backup", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return respond(request), nil
+		}}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"primary": {Regions: map[string]*ogem.RegionStatus{"primary": {
+				Latency:     10 * time.Millisecond,
+				LastChecked: time.Now(),
+				// $0.01 per request.
+				Models: []*ogem.SupportedModel{{Name: "primary-model", OtherNames: []string{"chat"}, InputPrice: 10, OutputPrice: 10}},
+			}}},
+			"backup": {Regions: map[string]*ogem.RegionStatus{"backup": {
+				Latency:     20 * time.Millisecond,
+				LastChecked: time.Now(),
+				// $0.02 per request.
+				Models: []*ogem.SupportedModel{{Name: "backup-model", OtherNames: []string{"chat"}, InputPrice: 20, OutputPrice: 20}},
+			}}},
+		}, primary, backup)
+		proxy.hedgeAfter = 20 * time.Millisecond
+		proxy.maxHedges = 1
+		proxy.config.ChargeHedgeLosers = chargeLosers
+		proxy.endUsers = newEndUserLimiter(EndUserLimitsConfig{TokensPerDay: 1_000_000})
+		return proxy
+	}
+	send := func(t *testing.T, proxy *ModelProxy) {
+		response, _, err := proxy.generateChatCompletion(context.Background(), &openai.ChatCompletionRequest{
+			Model:       "chat",
+			Messages:    []openai.Message{userMessage("Hi")},
+			Temperature: utils.ToPtr(float32(0)),
+			User:        utils.ToPtr("user-1"),
+		}, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "backup-model", response.Model)
+		// Lets the primary complete after the winner.
+		time.Sleep(200 * time.Millisecond)
+	}
+	usageOf := func(t *testing.T, proxy *ModelProxy) *EndUserUsage {
+		usage, err := proxy.addEndUserUsage(context.Background(), "user-1", nil)
+		assert.NoError(t, err)
+		return usage
+	}
+
+	t.Run("Charges the losers to the end user", func(t *testing.T) {
+		proxy := newProxy(t, true)
+		send(t, proxy)
+
+		usage := usageOf(t, proxy)
+		assert.Equal(t, int64(2000), usage.Tokens)
+		assert.InDelta(t, 0.03, usage.Cost, 1e-9)
+		assert.Equal(t, int64(1), usage.Requests)
+	})
+
+	t.Run("Charges only the winner by default", func(t *testing.T) {
+		proxy := newProxy(t, false)
+		send(t, proxy)
+
+		usage := usageOf(t, proxy)
+		assert.Equal(t, int64(1000), usage.Tokens)
+		assert.InDelta(t, 0.02, usage.Cost, 1e-9)
+		assert.Equal(t, int64(1), usage.Requests)
+	})
+}
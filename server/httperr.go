@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Types of the errors in the error format of the OpenAI API. Its SDKs raise
+// the exception of the type along with the status code.
+const (
+	errorTypeInvalidRequest = "invalid_request_error"
+	errorTypeAuthentication = "authentication_error"
+	errorTypeRateLimit      = "rate_limit_error"
+	errorTypeServer         = "server_error"
+)
+
+// Writes the error in the error format of the OpenAI API. The code is a
+// machine-readable detail of the type, omitted if empty.
+func writeError(httpResponse http.ResponseWriter, status int, errorType string, code string, message string) {
+	httpResponse.Header().Set("Content-Type", "application/json")
+	httpResponse.Header().Set("X-Content-Type-Options", "nosniff")
+	httpResponse.WriteHeader(status)
+	json.NewEncoder(httpResponse).Encode(openai.ErrorResponse{
+		Error: openai.Error{
+			Message: message,
+			Type:    errorType,
+			Code:    code,
+		},
+	})
+}
+
+func writeAuthError(httpResponse http.ResponseWriter, status int, code string, message string) {
+	writeError(httpResponse, status, errorTypeAuthentication, code, message)
+}
+
+// Writes the error of decoding the request body. Only the errors of the
+// integer fields are detailed, since the decoder's own messages are not
+// meaningful to the clients.
+func writeBodyError(httpResponse http.ResponseWriter, err error) {
+	var fieldError *openai.FieldError
+	if errors.As(err, &fieldError) {
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", fmt.Sprintf("Invalid request body: %v", fieldError))
+		return
+	}
+	writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+}
+
+func handleError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case BadRequestError:
+		writeError(w, http.StatusBadRequest, errorTypeInvalidRequest, "", fmt.Sprintf("Invalid request: %v", err))
+	case ModelNotFoundError:
+		writeError(w, http.StatusNotFound, errorTypeInvalidRequest, "model_not_found", fmt.Sprintf("The model is not available: %v", err))
+	case UnavailableError:
+		writeError(w, http.StatusServiceUnavailable, errorTypeServer, "no_available_endpoints", "No available endpoints")
+	case RateLimitError:
+		writeError(w, http.StatusTooManyRequests, errorTypeRateLimit, "rate_limit_exceeded", "Rate limit exceeded")
+	case EndUserQuotaError:
+		writeError(w, http.StatusTooManyRequests, errorTypeRateLimit, "end_user_quota_exceeded", fmt.Sprintf("End user quota exceeded: %v", err))
+	case RequestTimeoutError:
+		writeError(w, http.StatusRequestTimeout, errorTypeServer, "timeout", "Request timed out")
+	default:
+		writeError(w, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Responds to the requests of unknown routes the same way as the OpenAI API.
+func HandleNotFound(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "unknown_url", fmt.Sprintf("Invalid URL (%s %s)", httpRequest.Method, httpRequest.URL.Path))
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestErrorResponses(t *testing.T) {
+	proxy := newTestProxy(t, ogem.ProvidersStatus{})
+	authenticated := newTestProxy(t, ogem.ProvidersStatus{})
+	authenticated.config.ApiKeys = []ApiKey{{Name: "search", Key: "user-key"}}
+	authenticated.indexApiKeys()
+
+	for _, test := range []struct {
+		name        string
+		respond     func(w http.ResponseWriter)
+		status      int
+		errorType   string
+		code        string
+		messagePart string
+	}{
+		{
+			name:        "Bad request",
+			respond:     func(w http.ResponseWriter) { handleError(w, BadRequestError{errors.New("no messages provided")}) },
+			status:      http.StatusBadRequest,
+			errorType:   "invalid_request_error",
+			messagePart: "no messages provided",
+		},
+		{
+			name:      "Unavailable",
+			respond:   func(w http.ResponseWriter) { handleError(w, UnavailableError{errors.New("down")}) },
+			status:    http.StatusServiceUnavailable,
+			errorType: "server_error",
+			code:      "no_available_endpoints",
+		},
+		{
+			name:      "Rate limited",
+			respond:   func(w http.ResponseWriter) { handleError(w, RateLimitError{errors.New("slow down")}) },
+			status:    http.StatusTooManyRequests,
+			errorType: "rate_limit_error",
+			code:      "rate_limit_exceeded",
+		},
+		{
+			name:      "Timeout",
+			respond:   func(w http.ResponseWriter) { handleError(w, RequestTimeoutError{errors.New("canceled")}) },
+			status:    http.StatusRequestTimeout,
+			errorType: "server_error",
+			code:      "timeout",
+		},
+		{
+			name: "Model not found",
+			respond: func(w http.ResponseWriter) {
+				handleError(w, ModelNotFoundError{errors.New("model llama3.1 is not available on ollama/local")})
+			},
+			status:      http.StatusNotFound,
+			errorType:   "invalid_request_error",
+			code:        "model_not_found",
+			messagePart: "llama3.1 is not available on ollama/local",
+		},
+		{
+			name:      "Internal",
+			respond:   func(w http.ResponseWriter) { handleError(w, InternalServerError{errors.New("secret detail")}) },
+			status:    http.StatusInternalServerError,
+			errorType: "server_error",
+		},
+		{
+			name:      "Unknown error",
+			respond:   func(w http.ResponseWriter) { handleError(w, errors.New("secret detail")) },
+			status:    http.StatusInternalServerError,
+			errorType: "server_error",
+		},
+		{
+			name: "Unknown route",
+			respond: func(w http.ResponseWriter) {
+				HandleNotFound(w, httptest.NewRequest("POST", "/v1/embeddings", nil))
+			},
+			status:      http.StatusNotFound,
+			errorType:   "invalid_request_error",
+			code:        "unknown_url",
+			messagePart: "POST /v1/embeddings",
+		},
+		{
+			name: "Missing API key",
+			respond: func(w http.ResponseWriter) {
+				authenticated.HandleAuthentication(proxy.HandleChatCompletions)(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+			},
+			status:    http.StatusUnauthorized,
+			errorType: "authentication_error",
+			code:      "missing_api_key",
+		},
+		{
+			name: "Non-admin API key",
+			respond: func(w http.ResponseWriter) {
+				request := httptest.NewRequest("GET", "/v1/admin/limits", nil)
+				request.Header.Set("Authorization", "Bearer user-key")
+				authenticated.HandleAdminAuthentication(proxy.HandleLimits)(w, request)
+			},
+			status:    http.StatusForbidden,
+			errorType: "authentication_error",
+			code:      "admin_required",
+		},
+		{
+			name: "Invalid chat completions body",
+			respond: func(w http.ResponseWriter) {
+				proxy.HandleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader("{")))
+			},
+			status:    http.StatusBadRequest,
+			errorType: "invalid_request_error",
+		},
+		{
+			name: "Failed chat completions",
+			respond: func(w http.ResponseWriter) {
+				body := `{"model": "a/b/c/d", "messages": [{"role": "user", "content": "Hi"}]}`
+				proxy.HandleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+			},
+			status:      http.StatusBadRequest,
+			errorType:   "invalid_request_error",
+			messagePart: "invalid model name",
+		},
+		{
+			name: "Invalid token count body",
+			respond: func(w http.ResponseWriter) {
+				proxy.HandleTokenCount(w, httptest.NewRequest("POST", "/v1/tokens/count", strings.NewReader("[")))
+			},
+			status:    http.StatusBadRequest,
+			errorType: "invalid_request_error",
+		},
+		{
+			name: "Invalid cost estimate body",
+			respond: func(w http.ResponseWriter) {
+				proxy.HandleCostEstimate(w, httptest.NewRequest("POST", "/v1/cost/estimate", strings.NewReader("nope")))
+			},
+			status:    http.StatusBadRequest,
+			errorType: "invalid_request_error",
+		},
+		{
+			name: "Invalid activity query",
+			respond: func(w http.ResponseWriter) {
+				proxy.HandleRequestActivity(w, httptest.NewRequest("GET", "/v1/admin/requests?limit=x", nil))
+			},
+			status:      http.StatusBadRequest,
+			errorType:   "invalid_request_error",
+			messagePart: "limit",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.respond(recorder)
+
+			assert.Equal(t, test.status, recorder.Code)
+			assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+			var response openai.ErrorResponse
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+			assert.Equal(t, test.errorType, response.Error.Type)
+			assert.Equal(t, test.code, response.Error.Code)
+			assert.NotEmpty(t, response.Error.Message)
+			assert.Contains(t, response.Error.Message, test.messagePart)
+			assert.NotContains(t, response.Error.Message, "secret detail")
+		})
+	}
+}
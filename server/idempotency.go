@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	defaultIdempotencyTtl = 24 * time.Hour
+
+	// Maximum time that a request holds the lock of its idempotency key, and
+	// that its duplicates wait for it. Longer than cacheLockDuration since
+	// the retries and the fallback models of a request may take a while.
+	idempotencyLockDuration = 5 * time.Minute
+)
+
+// Response stored for the Idempotency-Key of a request, to be replayed to its
+// retries.
+type idempotentResponse struct {
+	// SHA-256 hash of the body of the request, to tell a retry from another
+	// request that reuses the key.
+	BodyHash string      `json:"body_hash"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+
+	// Checked on load since the state manager may return an expired entry.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Records the response written by the handler while passing it through.
+type recordingWriter struct {
+	http.ResponseWriter
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Whether a response with the status is replayed to the retries. Errors that
+// a retry may not hit again, such as rate limits and outages, are not.
+func replayable(status int) bool {
+	return status < http.StatusInternalServerError &&
+		status != http.StatusTooManyRequests &&
+		status != http.StatusRequestTimeout
+}
+
+// Key of the stored response, scoped to the API key so that the callers
+// cannot replay the responses of each other.
+func idempotencyStoreKey(ctx context.Context, idempotencyKey string) string {
+	apiKey, _ := apiKeyFrom(ctx)
+	hash := sha256.Sum256([]byte(apiKey.Key + "\x00" + idempotencyKey))
+	return "idempotency:" + hex.EncodeToString(hash[:])
+}
+
+// Handles the Idempotency-Key header of the request. Replays the stored
+// response of an earlier request with the same key and body, and rejects a
+// different body with 422. Duplicates in flight, across all instances sharing
+// the state manager, wait for the first one to finish. Returns false if the
+// response has been written. Otherwise, the request is executed with the
+// returned writer, and the returned function stores its response and must be
+// called once it is written.
+func (s *ModelProxy) handleIdempotencyKey(httpResponse http.ResponseWriter, httpRequest *http.Request, body []byte) (http.ResponseWriter, func(), bool) {
+	noop := func() {}
+	idempotencyKey := httpRequest.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		return httpResponse, noop, true
+	}
+	ctx := httpRequest.Context()
+	storeKey := idempotencyStoreKey(ctx, idempotencyKey)
+	hash := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(hash[:])
+
+	lockKey := storeKey + ":lock"
+	for {
+		stored, err := s.storedResponse(ctx, storeKey)
+		if err != nil {
+			// Executes the request rather than failing it, as for the cache.
+			s.logger.Warnw("Failed to get stored response", "error", err)
+			return httpResponse, noop, true
+		}
+		if stored != nil {
+			if stored.BodyHash != bodyHash {
+				writeError(httpResponse, http.StatusUnprocessableEntity, errorTypeInvalidRequest, "idempotency_key_reused", "Idempotency-Key has been used with a different request body")
+				return nil, noop, false
+			}
+			s.logger.Infow("Replaying stored response", "api_key", apiKeyName(ctx), "status", stored.Status)
+			s.recordIdempotentReplay(ctx, stored)
+			for name, values := range stored.Header {
+				httpResponse.Header()[name] = values
+			}
+			httpResponse.Header().Set("X-Ogem-Idempotent-Replay", "true")
+			httpResponse.WriteHeader(stored.Status)
+			httpResponse.Write(stored.Body)
+			return nil, noop, false
+		}
+
+		acquired, err := s.stateManager.AcquireLock(ctx, lockKey, idempotencyLockDuration)
+		if err != nil {
+			s.logger.Warnw("Failed to acquire idempotency lock", "error", err, "key", lockKey)
+			return httpResponse, noop, true
+		}
+		if acquired {
+			recorder := &recordingWriter{ResponseWriter: httpResponse}
+			return recorder, func() {
+				// Storing and releasing should be done even if the request
+				// has been canceled.
+				if replayable(recorder.status) {
+					s.storeResponse(context.Background(), storeKey, bodyHash, recorder)
+				}
+				if err := s.stateManager.ReleaseLock(context.Background(), lockKey); err != nil {
+					s.logger.Warnw("Failed to release idempotency lock", "error", err, "key", lockKey)
+				}
+			}, true
+		}
+
+		select {
+		case <-ctx.Done():
+			s.logger.Warn("Request canceled while waiting for its duplicate")
+			handleError(httpResponse, RequestTimeoutError{fmt.Errorf("request canceled")})
+			return nil, noop, false
+		case <-time.After(cacheLockPollInterval):
+		}
+	}
+}
+
+func (s *ModelProxy) storedResponse(ctx context.Context, storeKey string) (*idempotentResponse, error) {
+	data, err := s.stateManager.LoadCache(ctx, storeKey)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var stored idempotentResponse
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal stored response: %v", err)
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, nil
+	}
+	return &stored, nil
+}
+
+func (s *ModelProxy) storeResponse(ctx context.Context, storeKey string, bodyHash string, recorder *recordingWriter) {
+	header := recorder.header.Clone()
+	// Set again by the compression of the replay.
+	for _, name := range []string{"Content-Encoding", "Content-Length", "Vary"} {
+		header.Del(name)
+	}
+	data, err := json.Marshal(idempotentResponse{
+		BodyHash:  bodyHash,
+		Status:    recorder.status,
+		Header:    header,
+		Body:      recorder.body.Bytes(),
+		ExpiresAt: time.Now().Add(s.idempotencyTtl),
+	})
+	if err != nil {
+		s.logger.Warnw("Failed to marshal response for idempotency", "error", err)
+		return
+	}
+	if err := s.stateManager.SaveCache(ctx, storeKey, data, s.idempotencyTtl); err != nil {
+		s.logger.Warnw("Failed to store response for idempotency", "error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	const body = `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`
+	newProxy := func(t *testing.T, generate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)) (*ModelProxy, *fakeEndpoint) {
+		return newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, generate)
+	}
+	chatCompletions := func(proxy *ModelProxy, apiKey ApiKey, idempotencyKey string, body string) *httptest.ResponseRecorder {
+		return sendChatCompletions(proxy, body, map[string]string{"Idempotency-Key": idempotencyKey}, &apiKey)
+	}
+	mobile := ApiKey{Name: "mobile", Key: "key-1"}
+
+	t.Run("Replays the response to a retry", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, nil)
+
+		first := chatCompletions(proxy, mobile, "order-1", body)
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.Empty(t, first.Header().Get("X-Ogem-Idempotent-Replay"))
+
+		retry := chatCompletions(proxy, mobile, "order-1", body)
+		assert.Equal(t, http.StatusOK, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get("X-Ogem-Idempotent-Replay"))
+		assert.Equal(t, first.Header().Get("X-Ogem-Request-Id"), retry.Header().Get("X-Ogem-Request-Id"))
+		assert.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Rejects the key reused with a different body", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, nil)
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, mobile, "order-1", body).Code)
+		recorder := chatCompletions(proxy, mobile, "order-1", strings.Replace(body, "Hi", "Bye", 1))
+		assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "idempotency_key_reused")
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Scopes the keys to the API key", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, nil)
+
+		chatCompletions(proxy, mobile, "order-1", body)
+		recorder := chatCompletions(proxy, ApiKey{Name: "web", Key: "key-2"}, "order-1", body)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Idempotent-Replay"))
+		assert.Len(t, endpoint.receivedRequests(), 2)
+	})
+
+	t.Run("Executes the concurrent duplicates once", func(t *testing.T) {
+		release := make(chan struct{})
+		proxy, endpoint := newProxy(t, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			<-release
+			return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}}}}, nil
+		})
+
+		recorders := make([]*httptest.ResponseRecorder, 3)
+		var wait sync.WaitGroup
+		for index := range recorders {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				recorders[index] = chatCompletions(proxy, mobile, "order-1", body)
+			}()
+		}
+		time.Sleep(3 * cacheLockPollInterval)
+		close(release)
+		wait.Wait()
+
+		replays := 0
+		for _, recorder := range recorders {
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, recorders[0].Body.String(), recorder.Body.String())
+			if recorder.Header().Get("X-Ogem-Idempotent-Replay") == "true" {
+				replays++
+			}
+		}
+		assert.Equal(t, 2, replays)
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Executes the request again after the TTL", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, nil)
+		proxy.idempotencyTtl = 20 * time.Millisecond
+
+		chatCompletions(proxy, mobile, "order-1", body)
+		time.Sleep(2 * proxy.idempotencyTtl)
+		recorder := chatCompletions(proxy, mobile, "order-1", body)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Idempotent-Replay"))
+		assert.Len(t, endpoint.receivedRequests(), 2)
+	})
+
+	t.Run("Does not replay the errors that a retry may not hit", func(t *testing.T) {
+		calls := 0
+		proxy, endpoint := newProxy(t, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("connection reset by peer")
+			}
+			return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}}}}, nil
+		})
+
+		assert.GreaterOrEqual(t, chatCompletions(proxy, mobile, "order-1", body).Code, http.StatusInternalServerError)
+		recorder := chatCompletions(proxy, mobile, "order-1", body)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Idempotent-Replay"))
+		assert.Len(t, endpoint.receivedRequests(), 2)
+	})
+}
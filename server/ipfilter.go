@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type IpFilterConfig struct {
+	// Addresses or CIDRs of the clients allowed to call the proxy. Empty to
+	// allow every client. E.g., ["10.0.0.0/8", "2001:db8::/32"]
+	Allow []string `yaml:"allow"`
+
+	// Addresses or CIDRs of the clients to reject, even if they are allowed.
+	Deny []string `yaml:"deny"`
+
+	// Addresses or CIDRs of the reverse proxies in front of the proxy. The
+	// client address is taken from the X-Forwarded-For or X-Real-IP header
+	// only for the requests coming from them, since anyone else can forge it.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type clientIpContextKey struct{}
+
+// Parsed IpFilterConfig. The zero value allows every client and trusts no
+// proxy.
+type ipFilter struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	trustedProxies []netip.Prefix
+}
+
+func newIpFilter(config IpFilterConfig) (ipFilter, error) {
+	allow, err := parsePrefixes(config.Allow)
+	if err != nil {
+		return ipFilter{}, fmt.Errorf("invalid allowed address: %v", err)
+	}
+	deny, err := parsePrefixes(config.Deny)
+	if err != nil {
+		return ipFilter{}, fmt.Errorf("invalid denied address: %v", err)
+	}
+	trustedProxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return ipFilter{}, fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+	return ipFilter{allow: allow, deny: deny, trustedProxies: trustedProxies}, nil
+}
+
+// Parses a CIDR, or a single address as the CIDR of only that address.
+// IPv4-mapped IPv6 addresses are treated as IPv4 so that both forms match.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr := prefix.Addr(); addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return netip.Prefix{}, fmt.Errorf("prefix %q is wider than the IPv4-mapped range", value)
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), bits)
+	}
+	return prefix.Masked(), nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address of the client that sent the request. If the request
+// comes from a trusted proxy, X-Forwarded-For is walked from the right,
+// skipping the trusted proxies, and the first other hop is the client. Falls
+// back to X-Real-IP if there is no X-Forwarded-For. Invalid if the address
+// cannot be parsed, such as for Unix sockets.
+func (f ipFilter) clientIp(httpRequest *http.Request) netip.Addr {
+	client := remoteAddr(httpRequest.RemoteAddr)
+	if !containsAddr(f.trustedProxies, client) {
+		return client
+	}
+
+	hops := []string{}
+	for _, header := range httpRequest.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIp, err := netip.ParseAddr(strings.TrimSpace(httpRequest.Header.Get("X-Real-IP"))); err == nil {
+			return realIp.Unmap()
+		}
+		return client
+	}
+
+	for index := len(hops) - 1; index >= 0; index-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[index]))
+		if err != nil {
+			// The hop that added the garbage is the last one known.
+			return client
+		}
+		client = hop.Unmap()
+		if !containsAddr(f.trustedProxies, client) {
+			return client
+		}
+	}
+	return client
+}
+
+// Parses the address of http.Request.RemoteAddr, which usually has a port.
+func remoteAddr(value string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return addr.Unmap()
+	}
+	return netip.Addr{}
+}
+
+// Whether the client is not denied and, if there is an allow list, allowed.
+// Unknown addresses are only allowed without an allow list.
+func (f ipFilter) allows(client netip.Addr) bool {
+	if containsAddr(f.deny, client) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, client)
+}
+
+// Whether the key may be used from the client. The addresses are validated
+// with the config, so the invalid ones are ignored here.
+func (k ApiKey) allowsClient(client netip.Addr) bool {
+	if len(k.AllowedCidrs) == 0 {
+		return true
+	}
+	for _, value := range k.AllowedCidrs {
+		prefix, err := parsePrefix(value)
+		if err == nil && prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+func withClientIp(ctx context.Context, client netip.Addr) context.Context {
+	return context.WithValue(ctx, clientIpContextKey{}, client)
+}
+
+// Returns the address of the client for the logs. Empty if unknown.
+func clientIpFrom(ctx context.Context) string {
+	client, _ := ctx.Value(clientIpContextKey{}).(netip.Addr)
+	if !client.IsValid() {
+		return ""
+	}
+	return client.String()
+}
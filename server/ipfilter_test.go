@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestClientIp(t *testing.T) {
+	filter, err := newIpFilter(IpFilterConfig{TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}})
+	assert.NoError(t, err)
+
+	clientIp := func(remoteAddr string, headers map[string]string) string {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		return filter.clientIp(request).String()
+	}
+
+	t.Run("Direct connections use the remote address", func(t *testing.T) {
+		assert.Equal(t, "203.0.113.7", clientIp("203.0.113.7:5000", nil))
+		assert.Equal(t, "2001:db8::7", clientIp("[2001:db8::7]:5000", nil))
+		assert.Equal(t, "203.0.113.7", clientIp("[::ffff:203.0.113.7]:5000", nil))
+	})
+
+	t.Run("Untrusted proxies cannot forge the address", func(t *testing.T) {
+		assert.Equal(t, "203.0.113.7", clientIp("203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}))
+		assert.Equal(t, "203.0.113.7", clientIp("203.0.113.7:5000", map[string]string{"X-Real-IP": "198.51.100.1"}))
+	})
+
+	t.Run("Trusted proxies forward the address", func(t *testing.T) {
+		assert.Equal(t, "198.51.100.1", clientIp("10.0.0.1:5000", map[string]string{"X-Real-IP": "198.51.100.1"}))
+		// The spoofed left-most hop is ignored, as are the trusted hops.
+		assert.Equal(t, "198.51.100.1", clientIp("10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.2"}))
+		assert.Equal(t, "2001:db8::1", clientIp("[fd00::1]:5000", map[string]string{"X-Forwarded-For": "2001:db8::1, 10.0.0.2"}))
+		// Without an untrusted hop, the left-most one is the client.
+		assert.Equal(t, "10.0.0.3", clientIp("10.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}))
+		// Garbage stops at the last hop that is known.
+		assert.Equal(t, "10.0.0.2", clientIp("10.0.0.1:5000", map[string]string{"X-Forwarded-For": "unknown, 10.0.0.2"}))
+	})
+}
+
+func TestIpFilter(t *testing.T) {
+	filter, err := newIpFilter(IpFilterConfig{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.66", "2001:db8:bad::/48"},
+	})
+	assert.NoError(t, err)
+
+	allows := func(client string) bool {
+		return filter.allows(remoteAddr(client))
+	}
+	assert.True(t, allows("192.0.2.1"))
+	assert.True(t, allows("::ffff:192.0.2.1"))
+	assert.True(t, allows("2001:db8::1"))
+	assert.False(t, allows("192.0.2.66"))
+	assert.False(t, allows("2001:db8:bad::1"))
+	assert.False(t, allows("198.51.100.1"))
+	assert.False(t, allows("unix"))
+
+	assert.True(t, ipFilter{}.allows(remoteAddr("198.51.100.1")))
+
+	_, err = newIpFilter(IpFilterConfig{Deny: []string{"192.0.2.0/33"}})
+	assert.Error(t, err)
+}
+
+func TestAuthenticateClientIp(t *testing.T) {
+	authenticate := func(proxy *ModelProxy, remoteAddr string, authorization string) (int, string) {
+		var clientIp string
+		handler := proxy.HandleAuthentication(func(w http.ResponseWriter, r *http.Request) {
+			clientIp = clientIpFrom(r.Context())
+		})
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("X-Forwarded-For", "198.51.100.1")
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder.Code, clientIp
+	}
+	newProxy := func(t *testing.T, config IpFilterConfig) *ModelProxy {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+		filter, err := newIpFilter(config)
+		assert.NoError(t, err)
+		proxy.ipFilter = filter
+		return proxy
+	}
+
+	t.Run("Global filter applies without authentication", func(t *testing.T) {
+		proxy := newProxy(t, IpFilterConfig{Deny: []string{"198.51.100.0/24"}, TrustedProxies: []string{"10.0.0.0/8"}})
+
+		status, clientIp := authenticate(proxy, "203.0.113.7:5000", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "203.0.113.7", clientIp)
+
+		status, _ = authenticate(proxy, "10.0.0.1:5000", "")
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Keys are restricted to their addresses", func(t *testing.T) {
+		proxy := newProxy(t, IpFilterConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "office", Key: "office-key", AllowedCidrs: []string{"198.51.100.0/24", "2001:db8::/32"}},
+			{Name: "anywhere", Key: "anywhere-key"},
+		}
+		proxy.indexApiKeys()
+
+		status, clientIp := authenticate(proxy, "10.0.0.1:5000", "Bearer office-key")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "198.51.100.1", clientIp)
+		status, _ = authenticate(proxy, "[2001:db8::1]:5000", "Bearer office-key")
+		assert.Equal(t, http.StatusOK, status)
+
+		status, _ = authenticate(proxy, "203.0.113.7:5000", "Bearer office-key")
+		assert.Equal(t, http.StatusForbidden, status)
+		status, _ = authenticate(proxy, "203.0.113.7:5000", "Bearer anywhere-key")
+		assert.Equal(t, http.StatusOK, status)
+	})
+}
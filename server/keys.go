@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// Time to keep the revocations in the state manager, which is long enough to
+// outlive any key.
+const revocationTtl = 10 * 365 * 24 * time.Hour
+
+type RevokeKeyResponse struct {
+	Name string `json:"name"`
+
+	// Number of the keys with the name, all of which are revoked.
+	Revoked int `json:"revoked"`
+}
+
+// Returns the expiry of the key. False if it never expires. Invalid values
+// are rejected by the config validation, so they never expire here.
+func (k ApiKey) expiresAt() (time.Time, bool) {
+	if k.ExpiresAt == "" {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, k.ExpiresAt)
+	return expiresAt, err == nil
+}
+
+// Whether the key has expired at the time. The key is no longer accepted from
+// the moment of its expiry.
+func (k ApiKey) expired(now time.Time) bool {
+	expiresAt, expires := k.expiresAt()
+	return expires && !now.Before(expiresAt)
+}
+
+// Revocations are recorded by the hash of the secret rather than the name, so
+// that a revoked key is replaced by setting a new secret under the same name.
+func revocationKey(apiKey ApiKey) string {
+	hash := sha256.Sum256([]byte(apiKey.Key))
+	return "revoked_key:" + hex.EncodeToString(hash[:])
+}
+
+// Revokes all configured keys with the name, on this instance at once and on
+// the others sharing the state manager from their next request. Returns the
+// number of the revoked keys.
+func (s *ModelProxy) revokeApiKeys(ctx context.Context, name string) (int, error) {
+	revoked := 0
+	for _, apiKey := range s.apiKeys() {
+		// Unnamed keys, including the legacy one, cannot be revoked.
+		if apiKey.Name == "" || apiKey.Name != name {
+			continue
+		}
+		key := revocationKey(apiKey)
+
+		// Kept locally as well, because the state manager may lose it, such
+		// as while Valkey is unreachable.
+		s.revokedKeysMutex.Lock()
+		s.revokedKeys[key] = true
+		s.revokedKeysMutex.Unlock()
+
+		revokedAt, err := time.Now().UTC().MarshalText()
+		if err != nil {
+			return revoked, err
+		}
+		if err := s.stateManager.SaveCache(ctx, key, revokedAt, revocationTtl); err != nil {
+			return revoked, fmt.Errorf("failed to save revocation: %v", err)
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// Whether the key has been revoked on this or any other instance. Keys are
+// accepted if the state manager fails, the same way as the cache misses.
+func (s *ModelProxy) isRevoked(ctx context.Context, apiKey ApiKey) bool {
+	key := revocationKey(apiKey)
+
+	s.revokedKeysMutex.Lock()
+	revoked := s.revokedKeys[key]
+	s.revokedKeysMutex.Unlock()
+	if revoked {
+		return true
+	}
+
+	revokedAt, err := s.stateManager.LoadCache(ctx, key)
+	if err != nil {
+		s.logger.Warnw("Failed to check revocation", "error", err, "api_key", apiKey.Name)
+		return false
+	}
+	return revokedAt != nil
+}
+
+// Revokes the keys with the name in the path. Unlike removing them from the
+// config, the revocation takes effect without a restart, and the names stay
+// in the logs and the request activity.
+func (s *ModelProxy) HandleRevokeKey(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	name := httpRequest.PathValue("name")
+	revoked, err := s.revokeApiKeys(httpRequest.Context(), name)
+	if err != nil {
+		s.logger.Warnw("Failed to revoke API key", "error", err, "api_key", name)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	if revoked == 0 {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "key_not_found", fmt.Sprintf("No API key is named %q", name))
+		return
+	}
+	s.logger.Infow("Revoked API key", "api_key", name, "count", revoked)
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(RevokeKeyResponse{Name: name, Revoked: revoked}); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/valkey-io/valkey-go"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/state"
+)
+
+func TestKeyExpiry(t *testing.T) {
+	apiKey := ApiKey{Name: "search", Key: "key-1", ExpiresAt: "2025-06-01T00:00:00Z"}
+	expiresAt := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.False(t, apiKey.expired(expiresAt.Add(-time.Nanosecond)))
+	assert.True(t, apiKey.expired(expiresAt))
+	assert.True(t, apiKey.expired(expiresAt.Add(time.Hour)))
+	assert.False(t, ApiKey{Key: "key-2"}.expired(expiresAt))
+}
+
+func TestKeyRevocation(t *testing.T) {
+	newProxy := func(t *testing.T, stateManager state.Manager) *ModelProxy {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+		if stateManager != nil {
+			proxy.stateManager = stateManager
+		}
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "admin", Key: "admin-key", Admin: true},
+			{Name: "search", Key: "key-1"},
+			{Name: "search", Key: "key-2"},
+			{Name: "expired", Key: "key-3", ExpiresAt: "2000-01-01T00:00:00Z"},
+		}
+		proxy.indexApiKeys()
+		return proxy
+	}
+	// Returns the status code and the error code of the response.
+	request := func(proxy *ModelProxy, apiKey string) (int, string) {
+		httpRequest := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		httpRequest.Header.Set("Authorization", "Bearer "+apiKey)
+		recorder := httptest.NewRecorder()
+		proxy.HandleAuthentication(func(w http.ResponseWriter, r *http.Request) {})(recorder, httpRequest)
+
+		var response openai.ErrorResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response.Error.Code
+	}
+	revoke := func(proxy *ModelProxy, name string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /v1/admin/keys/{name}/revoke", proxy.HandleAdminAuthentication(proxy.HandleRevokeKey))
+		httpRequest := httptest.NewRequest("POST", "/v1/admin/keys/"+name+"/revoke", nil)
+		httpRequest.Header.Set("Authorization", "Bearer admin-key")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httpRequest)
+		return recorder
+	}
+
+	t.Run("Rejects expired keys", func(t *testing.T) {
+		status, code := request(newProxy(t, nil), "key-3")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "key_expired", code)
+	})
+
+	t.Run("Rejects the next request after revoking", func(t *testing.T) {
+		proxy := newProxy(t, nil)
+		status, _ := request(proxy, "key-1")
+		assert.Equal(t, http.StatusOK, status)
+
+		recorder := revoke(proxy, "search")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response RevokeKeyResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, RevokeKeyResponse{Name: "search", Revoked: 2}, response)
+
+		for _, apiKey := range []string{"key-1", "key-2"} {
+			status, code := request(proxy, apiKey)
+			assert.Equal(t, http.StatusUnauthorized, status)
+			assert.Equal(t, "key_revoked", code)
+		}
+		status, _ = request(proxy, "admin-key")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("A new secret replaces the revoked key", func(t *testing.T) {
+		proxy := newProxy(t, nil)
+		assert.Equal(t, http.StatusOK, revoke(proxy, "search").Code)
+
+		// As on the restart with the new secret in the config.
+		proxy.config.ApiKeys[1].Key = "key-4"
+		proxy.indexApiKeys()
+		status, _ := request(proxy, "key-4")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Unknown names are not found", func(t *testing.T) {
+		recorder := revoke(newProxy(t, nil), "unknown")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("Revocation reaches the instances sharing Valkey", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		newValkeyProxy := func() *ModelProxy {
+			client, err := valkey.NewClient(valkey.ClientOption{InitAddress: []string{server.Addr()}, DisableCache: true})
+			assert.NoError(t, err)
+			t.Cleanup(client.Close)
+			return newProxy(t, state.NewValkeyManager(client))
+		}
+		first, second := newValkeyProxy(), newValkeyProxy()
+
+		status, _ := request(second, "key-1")
+		assert.Equal(t, http.StatusOK, status)
+
+		assert.Equal(t, http.StatusOK, revoke(first, "search").Code)
+		status, code := request(second, "key-1")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "key_revoked", code)
+	})
+}
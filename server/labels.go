@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	defaultMaxLabels      = 8
+	defaultMaxLabelLength = 64
+)
+
+// Labels that the callers attach to their requests to slice the request
+// activity, e.g., by application and environment. Only the allowlisted
+// headers and metadata keys are read, so that the callers cannot create
+// labels without bound.
+type LabelsConfig struct {
+	// Headers read as labels, named after the header in lower case without
+	// the X-Ogem- prefix. E.g., [X-Ogem-App, X-Ogem-Env]
+	Headers []string `yaml:"headers"`
+
+	// Keys of the metadata field of the requests read as labels, unless a
+	// header sets the same label. E.g., [app, feature]
+	MetadataKeys []string `yaml:"metadata_keys"`
+
+	// Maximum number of labels per request. Defaults to 8.
+	MaxLabels int `yaml:"max_labels"`
+
+	// Maximum length of a label value. Longer values are cut. Defaults to 64.
+	MaxValueLength int `yaml:"max_value_length"`
+}
+
+type labelsContextKey struct{}
+
+// Metadata field of OpenAI, decoded separately so that it is never sent to
+// the providers.
+type labelFields struct {
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// Returns the name of the label that the header sets. E.g., "app" for
+// X-Ogem-App.
+func headerLabelName(header string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(header)), "x-ogem-")
+}
+
+// Returns the labels of the request, or nil if it has none. The headers come
+// first, then the metadata keys, each in the configured order, until the
+// maximum number of labels. Labels never fail a request: values that are not
+// strings and metadata that is not an object are ignored.
+func parseLabels(config LabelsConfig, httpRequest *http.Request, body []byte) map[string]string {
+	if len(config.Headers) == 0 && len(config.MetadataKeys) == 0 {
+		return nil
+	}
+	maxLabels := config.MaxLabels
+	if maxLabels <= 0 {
+		maxLabels = defaultMaxLabels
+	}
+	maxLength := config.MaxValueLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxLabelLength
+	}
+
+	labels := map[string]string{}
+	add := func(name string, value string) {
+		if _, found := labels[name]; found || len(labels) >= maxLabels {
+			return
+		}
+		if value = sanitizeLabelValue(value, maxLength); value != "" {
+			labels[name] = value
+		}
+	}
+
+	for _, header := range config.Headers {
+		add(headerLabelName(header), httpRequest.Header.Get(header))
+	}
+
+	var fields labelFields
+	var metadata map[string]any
+	if json.Unmarshal(body, &fields) == nil && len(fields.Metadata) > 0 && json.Unmarshal(fields.Metadata, &metadata) == nil {
+		for _, key := range config.MetadataKeys {
+			if value, ok := metadata[key].(string); ok {
+				add(key, value)
+			}
+		}
+	}
+
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// Replaces the characters other than ASCII letters, digits and ._:/@- with
+// underscores, and cuts the value to the maximum length.
+func sanitizeLabelValue(value string, maxLength int) string {
+	value = strings.TrimSpace(value)
+	var builder strings.Builder
+	for _, char := range value {
+		if builder.Len() >= maxLength {
+			break
+		}
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || strings.ContainsRune("._:/@-", char) {
+			builder.WriteRune(char)
+		} else {
+			builder.WriteByte('_')
+		}
+	}
+	return builder.String()
+}
+
+func withLabels(ctx context.Context, labels map[string]string) context.Context {
+	if len(labels) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, labelsContextKey{}, labels)
+}
+
+// Returns the labels of the request. Nil if it has none.
+func labelsFrom(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsContextKey{}).(map[string]string)
+	return labels
+}
+
+// Whether the labels have the label of the filter, formatted as name=value.
+func matchesLabel(labels map[string]string, filter string) bool {
+	name, value, _ := strings.Cut(filter, "=")
+	actual, found := labels[name]
+	return found && actual == value
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestParseLabels(t *testing.T) {
+	config := LabelsConfig{
+		Headers:      []string{"X-Ogem-App", "x-ogem-env"},
+		MetadataKeys: []string{"app", "feature"},
+	}
+	parse := func(config LabelsConfig, headers map[string]string, body string) map[string]string {
+		httpRequest := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		for name, value := range headers {
+			httpRequest.Header.Set(name, value)
+		}
+		return parseLabels(config, httpRequest, []byte(body))
+	}
+
+	t.Run("Reads the allowed headers and metadata keys", func(t *testing.T) {
+		labels := parse(config, map[string]string{
+			"X-Ogem-App":  "search",
+			"X-Ogem-Env":  "prod",
+			"X-Ogem-Team": "ads",
+		}, `{"metadata": {"feature": "autocomplete", "customer": "acme"}}`)
+		assert.Equal(t, map[string]string{"app": "search", "env": "prod", "feature": "autocomplete"}, labels)
+	})
+
+	t.Run("Prefers the headers to the metadata", func(t *testing.T) {
+		labels := parse(config, map[string]string{"X-Ogem-App": "search"}, `{"metadata": {"app": "chat"}}`)
+		assert.Equal(t, map[string]string{"app": "search"}, labels)
+	})
+
+	t.Run("Sanitizes the values", func(t *testing.T) {
+		labels := parse(LabelsConfig{Headers: []string{"X-Ogem-App"}, MetadataKeys: []string{"feature"}, MaxValueLength: 10},
+			map[string]string{"X-Ogem-App": "  my app\t"},
+			`{"metadata": {"feature": "검색/v2.1:beta-release"}}`)
+		assert.Equal(t, map[string]string{"app": "my_app", "feature": "__/v2.1:be"}, labels)
+	})
+
+	t.Run("Caps the number of labels", func(t *testing.T) {
+		labels := parse(LabelsConfig{Headers: []string{"X-Ogem-App", "X-Ogem-Env"}, MetadataKeys: []string{"feature"}, MaxLabels: 2},
+			map[string]string{"X-Ogem-App": "search", "X-Ogem-Env": "prod"},
+			`{"metadata": {"feature": "autocomplete"}}`)
+		assert.Equal(t, map[string]string{"app": "search", "env": "prod"}, labels)
+	})
+
+	t.Run("Ignores the values that are not strings", func(t *testing.T) {
+		assert.Nil(t, parse(config, nil, `{"metadata": {"app": 1, "feature": ["a"]}}`))
+		assert.Nil(t, parse(config, nil, `{"metadata": "search"}`))
+		assert.Nil(t, parse(config, map[string]string{"X-Ogem-App": " \t"}, `{}`))
+	})
+
+	t.Run("Reads nothing without configuration", func(t *testing.T) {
+		assert.Nil(t, parse(LabelsConfig{}, map[string]string{"X-Ogem-App": "search"}, `{"metadata": {"app": "search"}}`))
+	})
+}
+
+func TestLabels(t *testing.T) {
+	proxy, endpoint := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, nil)
+	proxy.config.Labels = LabelsConfig{Headers: []string{"X-Ogem-App", "X-Ogem-Env"}, MetadataKeys: []string{"feature"}}
+
+	chatCompletions := func(headers map[string]string, metadata string) {
+		body := `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}], "metadata": ` + metadata + `}`
+		recorder := sendChatCompletions(proxy, body, headers, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	listActivity := func(path string) []RequestActivity {
+		recorder := httptest.NewRecorder()
+		proxy.HandleRequestActivity(recorder, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response ActivityResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		return response.Requests
+	}
+
+	chatCompletions(map[string]string{"X-Ogem-App": "search", "X-Ogem-Env": "prod", "X-Ogem-Team": "ads"}, `{"feature": "autocomplete"}`)
+	chatCompletions(map[string]string{"X-Ogem-App": "chat"}, `{}`)
+
+	t.Run("Records the labels of the requests", func(t *testing.T) {
+		activities := listActivity("/v1/admin/requests")
+		assert.Len(t, activities, 2)
+		assert.Equal(t, map[string]string{"app": "chat"}, activities[0].Labels)
+		assert.Equal(t, map[string]string{"app": "search", "env": "prod", "feature": "autocomplete"}, activities[1].Labels)
+	})
+
+	t.Run("Filters the requests by a label", func(t *testing.T) {
+		activities := listActivity("/v1/admin/requests?label=app=search")
+		assert.Len(t, activities, 1)
+		assert.Equal(t, "prod", activities[0].Labels["env"])
+		assert.Empty(t, listActivity("/v1/admin/requests?label=team=ads"))
+	})
+
+	t.Run("Never sends the metadata to the providers", func(t *testing.T) {
+		for _, request := range endpoint.receivedRequests() {
+			body, err := json.Marshal(request)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(body), "autocomplete")
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"cmp"
+	"math"
+	"time"
+
+	"github.com/yanolja/ogem"
+)
+
+// Smoothing of the ping latencies of the regions, so that a single slow ping,
+// such as one during a GC pause, does not reorder the routing until the next
+// ping.
+type LatencySmoothingConfig struct {
+	// Weight of the latest ping in the moving average, between 0 and 1.
+	// Higher follows the changes faster. Defaults to 0.3.
+	Alpha float64 `yaml:"alpha"`
+
+	// Multiple of the average above which a ping is left out as an outlier.
+	// Defaults to 3.
+	OutlierFactor float64 `yaml:"outlier_factor"`
+
+	// Number of consecutive outliers after which they are taken as the new
+	// latency of the region, since it has degraded rather than blipped.
+	// Defaults to 3.
+	MaxOutliers int `yaml:"max_outliers"`
+}
+
+const (
+	defaultLatencyAlpha         = 0.3
+	defaultLatencyOutlierFactor = 3
+	defaultLatencyMaxOutliers   = 3
+)
+
+// How a ping changed the latency of a region.
+type pingOutcome int
+
+const (
+	latencyAccepted pingOutcome = iota
+
+	// Left out of the average as an outlier.
+	latencyRejected
+
+	// Too many outliers in a row, so the average restarted from the ping.
+	latencyDegraded
+)
+
+// Adds the ping to the latency of the region. The first ping starts the
+// average.
+func (c LatencySmoothingConfig) observe(status *ogem.RegionStatus, latency time.Duration) pingOutcome {
+	alpha := cmp.Or(c.Alpha, defaultLatencyAlpha)
+	outlierFactor := cmp.Or(c.OutlierFactor, defaultLatencyOutlierFactor)
+	maxOutliers := cmp.Or(c.MaxOutliers, defaultLatencyMaxOutliers)
+
+	status.LastLatency = latency
+	if status.Latency <= 0 {
+		status.Latency = latency
+		status.LatencyDeviation = 0
+		status.LatencyOutliers = 0
+		return latencyAccepted
+	}
+
+	if float64(latency) > outlierFactor*float64(status.Latency) {
+		status.LatencyOutliers++
+		if status.LatencyOutliers < maxOutliers {
+			return latencyRejected
+		}
+		status.Latency = latency
+		status.LatencyDeviation = 0
+		status.LatencyOutliers = 0
+		return latencyDegraded
+	}
+
+	// Exponentially weighted mean and variance, updated incrementally.
+	status.LatencyOutliers = 0
+	mean := float64(status.Latency)
+	variance := math.Pow(float64(status.LatencyDeviation), 2)
+	diff := float64(latency) - mean
+	mean += alpha * diff
+	variance = (1 - alpha) * (variance + alpha*diff*diff)
+	status.Latency = time.Duration(mean)
+	status.LatencyDeviation = time.Duration(math.Sqrt(variance))
+	return latencyAccepted
+}
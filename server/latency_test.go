@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestLatencySmoothing(t *testing.T) {
+	feed := func(config LatencySmoothingConfig, status *ogem.RegionStatus, latencies ...time.Duration) []pingOutcome {
+		outcomes := []pingOutcome{}
+		for _, latency := range latencies {
+			outcomes = append(outcomes, config.observe(status, latency))
+		}
+		return outcomes
+	}
+	ms := time.Millisecond
+
+	t.Run("Starts from the first ping", func(t *testing.T) {
+		status := &ogem.RegionStatus{}
+		feed(LatencySmoothingConfig{}, status, 100*ms)
+		assert.Equal(t, 100*ms, status.Latency)
+		assert.Equal(t, 100*ms, status.LastLatency)
+		assert.Zero(t, status.LatencyDeviation)
+	})
+
+	t.Run("Averages the pings", func(t *testing.T) {
+		status := &ogem.RegionStatus{}
+		feed(LatencySmoothingConfig{}, status, 100*ms, 200*ms)
+		// 100 + 0.3 * (200 - 100), and a variance of 0.7 * 0.3 * 100^2.
+		assert.Equal(t, 130*ms, status.Latency)
+		assert.Equal(t, 200*ms, status.LastLatency)
+		assert.InDelta(t, 45.83, float64(status.LatencyDeviation)/float64(ms), 0.01)
+
+		// Converges to a steady latency, with the deviation fading.
+		for range 50 {
+			feed(LatencySmoothingConfig{}, status, 150*ms)
+		}
+		assert.InDelta(t, float64(150*ms), float64(status.Latency), float64(ms))
+		assert.Less(t, status.LatencyDeviation, ms)
+	})
+
+	t.Run("Leaves a single slow ping out", func(t *testing.T) {
+		status := &ogem.RegionStatus{}
+		outcomes := feed(LatencySmoothingConfig{}, status, 100*ms, 100*ms, 2*time.Second)
+		assert.Equal(t, []pingOutcome{latencyAccepted, latencyAccepted, latencyRejected}, outcomes)
+		assert.Equal(t, 100*ms, status.Latency)
+		assert.Equal(t, 2*time.Second, status.LastLatency)
+		assert.Equal(t, 1, status.LatencyOutliers)
+
+		feed(LatencySmoothingConfig{}, status, 100*ms)
+		assert.Equal(t, 100*ms, status.Latency)
+		assert.Zero(t, status.LatencyOutliers)
+	})
+
+	t.Run("Takes the outliers in a row as a degradation", func(t *testing.T) {
+		status := &ogem.RegionStatus{}
+		outcomes := feed(LatencySmoothingConfig{}, status, 100*ms, time.Second, 1100*ms, 900*ms)
+		assert.Equal(t, []pingOutcome{latencyAccepted, latencyRejected, latencyRejected, latencyDegraded}, outcomes)
+		assert.Equal(t, 900*ms, status.Latency)
+		assert.Zero(t, status.LatencyOutliers)
+
+		// The slow pings are the norm from then on.
+		assert.Equal(t, []pingOutcome{latencyAccepted}, feed(LatencySmoothingConfig{}, status, time.Second))
+	})
+
+	t.Run("Follows the config", func(t *testing.T) {
+		config := LatencySmoothingConfig{Alpha: 1, OutlierFactor: 10, MaxOutliers: 1}
+		status := &ogem.RegionStatus{}
+		feed(config, status, 100*ms, 500*ms)
+		assert.Equal(t, 500*ms, status.Latency)
+
+		assert.Equal(t, []pingOutcome{latencyDegraded}, feed(config, status, 6*time.Second))
+		assert.Equal(t, 6*time.Second, status.Latency)
+	})
+
+	t.Run("Keeps the smoothing state across the health checks", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"fake": {Regions: map[string]*ogem.RegionStatus{
+				"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+			}},
+		}, &fakeEndpoint{provider: "fake", region: "fake"})
+		status := func() *ogem.RegionStatus {
+			return proxy.endpointStatus["fake"].Regions["fake"]
+		}
+
+		proxy.updateEndpointStatus("fake", "fake", 100*ms, nil)
+		proxy.updateEndpointStatus("fake", "fake", 200*ms, nil)
+		assert.Equal(t, 130*ms, status().Latency)
+		assert.InDelta(t, 45.83, float64(status().LatencyDeviation)/float64(ms), 0.01)
+
+		proxy.updateEndpointStatus("fake", "fake", time.Second, nil)
+		proxy.updateEndpointStatus("fake", "fake", time.Second, nil)
+		assert.Equal(t, 130*ms, status().Latency)
+		assert.Equal(t, 2, status().LatencyOutliers)
+		assert.Equal(t, time.Second, status().LastLatency)
+
+		// The region has slowed down rather than blipped.
+		proxy.updateEndpointStatus("fake", "fake", time.Second, nil)
+		assert.Equal(t, time.Second, status().Latency)
+		assert.Zero(t, status().LatencyOutliers)
+	})
+
+	t.Run("Keeps the routing order through a blip", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"fake": {Regions: map[string]*ogem.RegionStatus{
+				"fast": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+				"slow": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+			}},
+		}, &fakeEndpoint{provider: "fake", region: "fast"}, &fakeEndpoint{provider: "fake", region: "slow"})
+		proxy.updateEndpointStatus("fake", "fast", 50*ms, nil)
+		proxy.updateEndpointStatus("fake", "slow", 200*ms, nil)
+		proxy.updateEndpointStatus("fake", "fast", time.Second, nil)
+
+		endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+		assert.NoError(t, err)
+		assert.Equal(t, "fast", endpoints[0].endpoint.Region())
+
+		readiness := proxy.readiness()
+		for _, region := range readiness.Regions {
+			if region.Region == "fast" {
+				assert.Equal(t, int64(50), region.LatencyMs)
+				assert.Equal(t, int64(1000), region.LastLatencyMs)
+			}
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Rejection of the requests beyond what the instance can serve, so that the
+// accepted ones keep their latency instead of all of them queueing. Disabled
+// unless a limit is set.
+type LoadSheddingConfig struct {
+	// Maximum number of chat completion requests in flight on this instance.
+	// Zero for no limit. E.g., 200
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// Maximum number of requests in flight up to which the requests of the
+	// API keys with priority: high are still accepted. Defaults to
+	// max_in_flight. E.g., 250
+	MaxInFlightHigh int `yaml:"max_in_flight_high"`
+
+	// Average latency of the state manager calls above which the requests
+	// other than those of the high priority keys are rejected, since every
+	// request waits for the state manager. Empty for no limit. E.g., 200ms
+	StateLatencyThreshold string `yaml:"state_latency_threshold"`
+}
+
+const (
+	// Priority of the API keys whose requests are shed last.
+	priorityHigh = "high"
+
+	// Time for which the proxy reports itself degraded after shedding a
+	// request, and for which a latency of the state manager counts. Without
+	// a newer call, the state manager is assumed to have recovered.
+	loadSheddingWindow = 10 * time.Second
+
+	// Weight of the latest call in the average latency of the state manager.
+	stateLatencyWeight = 0.2
+)
+
+type loadShedder struct {
+	maxInFlight           int
+	maxInFlightHigh       int
+	stateLatencyThreshold time.Duration
+
+	mutex    sync.Mutex
+	inFlight int
+
+	// Moving average of the latency of the state manager calls, and the time
+	// of the last one.
+	stateLatency  time.Duration
+	stateCalledAt time.Time
+
+	// Number of the requests rejected so far, and the time of the last one.
+	shedRequests int64
+	lastShedAt   time.Time
+}
+
+// Returns nil if no limit is configured. The config must have been
+// validated.
+func newLoadShedder(config LoadSheddingConfig) *loadShedder {
+	stateLatencyThreshold, _ := time.ParseDuration(config.StateLatencyThreshold)
+	if config.MaxInFlight <= 0 && stateLatencyThreshold <= 0 {
+		return nil
+	}
+	maxInFlightHigh := config.MaxInFlightHigh
+	if maxInFlightHigh <= 0 {
+		maxInFlightHigh = config.MaxInFlight
+	}
+	return &loadShedder{
+		maxInFlight:           config.MaxInFlight,
+		maxInFlightHigh:       maxInFlightHigh,
+		stateLatencyThreshold: stateLatencyThreshold,
+	}
+}
+
+// Counts the request in flight if it is admitted. Each admitted request must
+// be finished with done.
+func (l *loadShedder) admit(priority string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit := l.maxInFlight
+	if priority == priorityHigh {
+		limit = l.maxInFlightHigh
+	}
+	shed := limit > 0 && l.inFlight >= limit
+	if priority != priorityHigh && l.statePressured() {
+		shed = true
+	}
+	if shed {
+		l.shedRequests++
+		l.lastShedAt = time.Now()
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+func (l *loadShedder) done() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight--
+}
+
+// Records the latency of a state manager call on the request path.
+func (l *loadShedder) observeState(latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.stateCalledAt.IsZero() {
+		l.stateLatency = latency
+	} else {
+		l.stateLatency = time.Duration(stateLatencyWeight*float64(latency) + (1-stateLatencyWeight)*float64(l.stateLatency))
+	}
+	l.stateCalledAt = time.Now()
+}
+
+// Must be called with the mutex held.
+func (l *loadShedder) statePressured() bool {
+	return l.stateLatencyThreshold > 0 &&
+		l.stateLatency > l.stateLatencyThreshold &&
+		time.Since(l.stateCalledAt) < loadSheddingWindow
+}
+
+// Returns whether requests are being shed, and how many have been so far.
+func (l *loadShedder) status() (bool, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	degraded := l.statePressured() || (!l.lastShedAt.IsZero() && time.Since(l.lastShedAt) < loadSheddingWindow)
+	return degraded, l.shedRequests
+}
+
+// Rejects the request with 503 and Retry-After if the proxy is overloaded.
+// Must be wrapped by the authentication to know the priority of the key.
+func (s *ModelProxy) HandleLoadShedding(handler http.HandlerFunc) http.HandlerFunc {
+	return func(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+		if s.loadShedder == nil {
+			handler(httpResponse, httpRequest)
+			return
+		}
+		apiKey, _ := apiKeyFrom(httpRequest.Context())
+		if !s.loadShedder.admit(apiKey.Priority) {
+			s.logger.Warnw("Shed request under load", "api_key", apiKey.Name, "priority", apiKey.Priority)
+			httpResponse.Header().Set("Retry-After", "1")
+			writeError(httpResponse, http.StatusServiceUnavailable, errorTypeServer, "overloaded", "The server is overloaded; retry later")
+			return
+		}
+		defer s.loadShedder.done()
+		handler(httpResponse, httpRequest)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestLoadShedding(t *testing.T) {
+	newProxy := func(t *testing.T, config LoadSheddingConfig, started chan<- struct{}, release <-chan struct{}) *ModelProxy {
+		proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			started <- struct{}{}
+			<-release
+			return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: &request.Model}}}}}, nil
+		})
+		proxy.loadShedder = newLoadShedder(config)
+		return proxy
+	}
+	chatCompletions := func(proxy *ModelProxy, apiKey ApiKey) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`))
+		request = request.WithContext(withApiKey(request.Context(), apiKey))
+		recorder := httptest.NewRecorder()
+		proxy.HandleLoadShedding(proxy.HandleChatCompletions)(recorder, request)
+		return recorder
+	}
+	batch := ApiKey{Name: "batch"}
+	checkout := ApiKey{Name: "checkout", Priority: priorityHigh}
+
+	t.Run("Sheds the requests beyond the caps", func(t *testing.T) {
+		started := make(chan struct{}, 3)
+		release := make(chan struct{})
+		proxy := newProxy(t, LoadSheddingConfig{MaxInFlight: 2, MaxInFlightHigh: 3}, started, release)
+
+		done := make(chan int, 3)
+		for _, apiKey := range []ApiKey{batch, batch, checkout} {
+			go func() {
+				done <- chatCompletions(proxy, apiKey).Code
+			}()
+			<-started
+		}
+
+		// Normal requests are shed at the cap, and the high priority ones at
+		// their higher cap.
+		shed := chatCompletions(proxy, batch)
+		assert.Equal(t, http.StatusServiceUnavailable, shed.Code)
+		assert.Equal(t, "1", shed.Header().Get("Retry-After"))
+		assert.Contains(t, shed.Body.String(), "overloaded")
+		assert.Equal(t, http.StatusServiceUnavailable, chatCompletions(proxy, checkout).Code)
+
+		readiness := proxy.readiness()
+		assert.True(t, readiness.Degraded)
+		assert.Equal(t, int64(2), readiness.ShedRequests)
+
+		close(release)
+		for range 3 {
+			assert.Equal(t, http.StatusOK, <-done)
+		}
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, batch).Code)
+	})
+
+	t.Run("Sheds the normal requests while the state manager is slow", func(t *testing.T) {
+		started := make(chan struct{}, 2)
+		release := make(chan struct{})
+		close(release)
+		proxy := newProxy(t, LoadSheddingConfig{StateLatencyThreshold: "100ms"}, started, release)
+		proxy.loadShedder.observeState(300 * time.Millisecond)
+
+		assert.Equal(t, http.StatusServiceUnavailable, chatCompletions(proxy, batch).Code)
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, checkout).Code)
+
+		// Without a recent call, the state manager is assumed to have
+		// recovered.
+		proxy.loadShedder.stateCalledAt = time.Now().Add(-loadSheddingWindow)
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, batch).Code)
+	})
+
+	t.Run("Accepts everything if disabled", func(t *testing.T) {
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		close(release)
+		proxy := newProxy(t, LoadSheddingConfig{}, started, release)
+
+		assert.Nil(t, proxy.loadShedder)
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, batch).Code)
+		assert.False(t, proxy.readiness().Degraded)
+	})
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LocalCacheConfig struct {
+	// Whether to keep the cached responses in memory as well, in front of the
+	// state manager, so that the popular ones are served without a round trip
+	// to Valkey.
+	Enabled bool `yaml:"enabled"`
+
+	// Number of the responses kept, beyond which the least recently used are
+	// dropped. Defaults to 1000.
+	MaxEntries int `yaml:"max_entries"`
+
+	// Size of the responses kept, in bytes of JSON, beyond which the least
+	// recently used are dropped. Defaults to 64 MiB.
+	MaxBytes int `yaml:"max_bytes"`
+
+	// Time to keep a response in memory, at most the time it is cached. Bounds
+	// how long an instance serves a response that another instance has
+	// replaced. Defaults to 60s.
+	Ttl string `yaml:"ttl"`
+}
+
+const (
+	// Time to keep a cached response.
+	responseCacheTtl = 24 * time.Hour
+
+	defaultLocalCacheMaxEntries = 1000
+	defaultLocalCacheMaxBytes   = 64 << 20
+	defaultLocalCacheTtl        = time.Minute
+)
+
+// Lookups of the response cache in each tier, since the start of this
+// instance. A lookup that misses the local tier goes on to the state manager.
+type CacheTierStats struct {
+	LocalHits    int64 `json:"local_hits"`
+	LocalMisses  int64 `json:"local_misses"`
+	LocalEntries int   `json:"local_entries"`
+	LocalBytes   int   `json:"local_bytes"`
+
+	StateHits   int64 `json:"state_hits"`
+	StateMisses int64 `json:"state_misses"`
+}
+
+type localCacheEntry struct {
+	key    string
+	value  []byte
+	expiry time.Time
+}
+
+// Least recently used responses of the response cache. Nil if disabled, on
+// which get misses and put does nothing. The keys are the ones of the state
+// manager, so that an entry is only served to the requests the state manager
+// would serve it to.
+type localCache struct {
+	maxEntries int
+	maxBytes   int
+	ttl        time.Duration
+
+	mutex sync.Mutex
+	// Most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newLocalCache(config LocalCacheConfig) *localCache {
+	if !config.Enabled {
+		return nil
+	}
+	maxEntries := defaultLocalCacheMaxEntries
+	if config.MaxEntries > 0 {
+		maxEntries = config.MaxEntries
+	}
+	maxBytes := defaultLocalCacheMaxBytes
+	if config.MaxBytes > 0 {
+		maxBytes = config.MaxBytes
+	}
+	ttl := defaultLocalCacheTtl
+	if config.Ttl != "" {
+		// Validated with the config.
+		ttl, _ = time.ParseDuration(config.Ttl)
+	}
+	return &localCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        min(ttl, responseCacheTtl),
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Returns the value of the key, or nil if it is missing or expired.
+func (c *localCache) get(key string) []byte {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, found := c.entries[key]
+	if !found {
+		c.misses.Add(1)
+		return nil
+	}
+	entry := element.Value.(*localCacheEntry)
+	if time.Now().After(entry.expiry) {
+		c.remove(element)
+		c.misses.Add(1)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return entry.value
+}
+
+// Keeps the value for the local TTL, dropping the least recently used entries
+// to stay within the limits. A value larger than the byte limit is not kept.
+// The value must not be modified afterwards.
+func (c *localCache) put(key string, value []byte) {
+	if c == nil || len(value) > c.maxBytes {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, found := c.entries[key]; found {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&localCacheEntry{key: key, value: value, expiry: time.Now().Add(c.ttl)})
+	c.bytes += len(value)
+	for len(c.entries) > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *localCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*localCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.value)
+}
+
+// Adds the counters of the local tier to the stats. Leaves them zero if
+// disabled.
+func (c *localCache) addStats(stats *CacheTierStats) {
+	if c == nil {
+		return
+	}
+	stats.LocalHits = c.hits.Load()
+	stats.LocalMisses = c.misses.Load()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats.LocalEntries = len(c.entries)
+	stats.LocalBytes = c.bytes
+}
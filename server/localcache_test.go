@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/state"
+	"github.com/yanolja/ogem/utils"
+)
+
+// State manager that counts the cache lookups, standing in for Valkey.
+type countingStateManager struct {
+	state.Manager
+	loads atomic.Int32
+}
+
+func (m *countingStateManager) LoadCache(ctx context.Context, key string) ([]byte, error) {
+	m.loads.Add(1)
+	return m.Manager.LoadCache(ctx, key)
+}
+
+func TestLocalCache(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+			Models: []*ogem.SupportedModel{{Name: "gpt-4o"}},
+		}}},
+	}
+	// Proxies that share the state manager, like the instances of a
+	// deployment share Valkey.
+	newProxies := func(t *testing.T, count int) ([]*ModelProxy, *countingStateManager, *fakeEndpoint) {
+		endpoint := &fakeEndpoint{provider: "openai", region: "openai"}
+		proxies := make([]*ModelProxy, count)
+		for index := range proxies {
+			proxies[index] = newTestProxy(t, providers, endpoint)
+			proxies[index].localCache = newLocalCache(LocalCacheConfig{Enabled: true})
+		}
+		shared := &countingStateManager{Manager: proxies[0].stateManager}
+		for _, proxy := range proxies {
+			proxy.stateManager = shared
+		}
+		return proxies, shared, endpoint
+	}
+	request := func(content string) *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:       "gpt-4o",
+			Messages:    []openai.Message{userMessage(content)},
+			Temperature: utils.ToPtr(float32(0)),
+		}
+	}
+
+	t.Run("Serves a warm hit without the state manager", func(t *testing.T) {
+		proxies, shared, endpoint := newProxies(t, 1)
+
+		_, _, err := proxies[0].generateChatCompletion(context.Background(), request("Hi"), false)
+		assert.NoError(t, err)
+		loads := shared.loads.Load()
+
+		for range 3 {
+			response, _, err := proxies[0].generateChatCompletion(context.Background(), request("Hi"), false)
+			assert.NoError(t, err)
+			assert.Equal(t, "gpt-4o", *response.Choices[0].Message.Content.String)
+		}
+		assert.Equal(t, loads, shared.loads.Load())
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Keeps the hits of the state manager", func(t *testing.T) {
+		proxies, shared, endpoint := newProxies(t, 2)
+
+		_, _, err := proxies[0].generateChatCompletion(context.Background(), request("Hi"), false)
+		assert.NoError(t, err)
+
+		loads := shared.loads.Load()
+		_, _, err = proxies[1].generateChatCompletion(context.Background(), request("Hi"), false)
+		assert.NoError(t, err)
+		assert.Equal(t, loads+1, shared.loads.Load())
+		_, _, err = proxies[1].generateChatCompletion(context.Background(), request("Hi"), false)
+		assert.NoError(t, err)
+		assert.Equal(t, loads+1, shared.loads.Load())
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Serves an entry only to the requests of its key", func(t *testing.T) {
+		proxies, shared, endpoint := newProxies(t, 1)
+
+		_, _, err := proxies[0].generateChatCompletion(context.Background(), request("Hi"), false)
+		assert.NoError(t, err)
+
+		loads := shared.loads.Load()
+		other := request("Hi")
+		other.Messages = append([]openai.Message{{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("Be brief.")}}}, other.Messages...)
+		_, _, err = proxies[0].generateChatCompletion(context.Background(), other, false)
+		assert.NoError(t, err)
+		assert.Greater(t, shared.loads.Load(), loads)
+		assert.Len(t, endpoint.receivedRequests(), 2)
+
+		key, err := CanonicalCacheKey(request("Hi"))
+		assert.NoError(t, err)
+		otherKey, err := CanonicalCacheKey(other)
+		assert.NoError(t, err)
+		assert.NotEqual(t, proxies[0].localCache.get(key), proxies[0].localCache.get(otherKey))
+	})
+
+	t.Run("Reports the lookups of each tier", func(t *testing.T) {
+		proxies, _, _ := newProxies(t, 2)
+
+		for _, proxy := range proxies {
+			for range 2 {
+				_, _, err := proxy.generateChatCompletion(context.Background(), request("Hi"), false)
+				assert.NoError(t, err)
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		proxies[1].HandleCacheSavings(recorder, httptest.NewRequest("GET", "/v1/admin/cache-savings", nil))
+		var response CacheSavingsResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, CacheTierStats{LocalHits: 1, LocalMisses: 1, LocalEntries: 1, LocalBytes: response.Tiers.LocalBytes, StateHits: 1}, response.Tiers)
+		assert.Positive(t, response.Tiers.LocalBytes)
+	})
+}
+
+func TestLocalCacheLimits(t *testing.T) {
+	t.Run("Drops the least recently used entries", func(t *testing.T) {
+		cache := newLocalCache(LocalCacheConfig{Enabled: true, MaxEntries: 2})
+		cache.put("a", []byte("1"))
+		cache.put("b", []byte("2"))
+		cache.get("a")
+		cache.put("c", []byte("3"))
+
+		assert.Equal(t, []byte("1"), cache.get("a"))
+		assert.Nil(t, cache.get("b"))
+		assert.Equal(t, []byte("3"), cache.get("c"))
+	})
+
+	t.Run("Stays within the bytes", func(t *testing.T) {
+		cache := newLocalCache(LocalCacheConfig{Enabled: true, MaxBytes: 10})
+		cache.put("a", []byte("12345"))
+		cache.put("b", []byte("12345"))
+		cache.put("c", []byte("123"))
+		cache.put("d", []byte("12345678901"))
+
+		assert.Nil(t, cache.get("a"))
+		assert.NotNil(t, cache.get("b"))
+		assert.NotNil(t, cache.get("c"))
+		assert.Nil(t, cache.get("d"))
+		var stats CacheTierStats
+		cache.addStats(&stats)
+		assert.Equal(t, 2, stats.LocalEntries)
+		assert.Equal(t, 8, stats.LocalBytes)
+	})
+
+	t.Run("Expires the entries", func(t *testing.T) {
+		cache := newLocalCache(LocalCacheConfig{Enabled: true, Ttl: "20ms"})
+		cache.put("a", []byte("1"))
+		assert.NotNil(t, cache.get("a"))
+		time.Sleep(40 * time.Millisecond)
+		assert.Nil(t, cache.get("a"))
+	})
+
+	t.Run("Does nothing if disabled", func(t *testing.T) {
+		cache := newLocalCache(LocalCacheConfig{})
+		assert.Nil(t, cache)
+		cache.put("a", []byte("1"))
+		assert.Nil(t, cache.get("a"))
+	})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+const (
+	// Lowers max_tokens to the maximum output tokens of each endpoint.
+	maxTokensClamp = "clamp"
+
+	// Routes the request only to the endpoints whose maximum output tokens
+	// cover max_tokens, and rejects it if none does.
+	maxTokensStrict = "strict"
+)
+
+// Returns whether the request is strict about its max_tokens. The
+// X-Ogem-Max-Tokens header takes precedence over the config.
+func parseStrictMaxTokens(httpRequest *http.Request, strictByDefault bool) (bool, error) {
+	switch value := strings.ToLower(strings.TrimSpace(httpRequest.Header.Get("X-Ogem-Max-Tokens"))); value {
+	case "":
+		return strictByDefault, nil
+	case maxTokensClamp:
+		return false, nil
+	case maxTokensStrict:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported max tokens mode %q; must be %s or %s", value, maxTokensClamp, maxTokensStrict)
+	}
+}
+
+type maxTokensContextKey struct{}
+
+// Max tokens of a request and the value that the endpoint serving it was
+// sent, if it was clamped.
+type maxTokens struct {
+	mutex     sync.Mutex
+	strict    bool
+	requested int
+	clamped   int
+}
+
+func withMaxTokens(ctx context.Context, tokens *maxTokens) context.Context {
+	return context.WithValue(ctx, maxTokensContextKey{}, tokens)
+}
+
+// Nil if the request does not track its max tokens, in which case it is
+// clamped. Every method of maxTokens works on nil.
+func maxTokensFrom(ctx context.Context) *maxTokens {
+	tokens, _ := ctx.Value(maxTokensContextKey{}).(*maxTokens)
+	return tokens
+}
+
+func (t *maxTokens) isStrict() bool {
+	return t != nil && t.strict
+}
+
+// Records the max tokens of the request sent to the endpoint that served it.
+// A later model of the fallback chain replaces the one of an earlier model.
+func (t *maxTokens) served(request *openai.ChatCompletionRequest, endpointRequest *openai.ChatCompletionRequest) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.requested, t.clamped = 0, 0
+	if requested, sent := requestedMaxTokens(request), requestedMaxTokens(endpointRequest); sent < requested {
+		t.requested, t.clamped = requested, sent
+	}
+}
+
+// Reports the clamped max tokens in the X-Ogem-Clamped-Max-Tokens header,
+// e.g., "requested=16384, clamped=8192". Nothing if it was not clamped.
+func writeClampedMaxTokens(httpResponse http.ResponseWriter, tokens *maxTokens) {
+	if tokens == nil {
+		return
+	}
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+	if tokens.clamped == 0 {
+		return
+	}
+	httpResponse.Header().Set("X-Ogem-Clamped-Max-Tokens", fmt.Sprintf("requested=%d, clamped=%d", tokens.requested, tokens.clamped))
+}
+
+// Lowers max_completion_tokens and max_tokens of the request to the maximum
+// output tokens, if they exceed it. The request must be a copy of its own.
+func clampMaxTokens(request *openai.ChatCompletionRequest, maxOutputTokens int) {
+	if maxOutputTokens <= 0 {
+		return
+	}
+	if request.MaxCompletionTokens != nil && int(*request.MaxCompletionTokens) > maxOutputTokens {
+		request.MaxCompletionTokens = utils.ToPtr(int32(maxOutputTokens))
+	}
+	if request.MaxTokens != nil && int(*request.MaxTokens) > maxOutputTokens {
+		request.MaxTokens = utils.ToPtr(int32(maxOutputTokens))
+	}
+}
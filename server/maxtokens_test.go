@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+func TestMaxTokens(t *testing.T) {
+	newProxy := func(t *testing.T, failSmall bool) (*ModelProxy, *fakeEndpoint, *fakeEndpoint) {
+		small := &fakeEndpoint{provider: "small", region: "small"}
+		if failSmall {
+			small.generate = func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, provider.NewInvalidRequestError(fmt.Errorf("not today"))
+			}
+		}
+		large := &fakeEndpoint{provider: "large", region: "large"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"small": {Regions: map[string]*ogem.RegionStatus{"small": {
+				Models: []*ogem.SupportedModel{{Name: "small-model", Capabilities: &ogem.Capabilities{MaxOutputTokens: 4096}}},
+			}}},
+			"large": {Regions: map[string]*ogem.RegionStatus{"large": {
+				Models: []*ogem.SupportedModel{{Name: "large-model", Capabilities: &ogem.Capabilities{MaxOutputTokens: 8192}}},
+			}}},
+		}, small, large)
+		return proxy, small, large
+	}
+	chatCompletions := func(proxy *ModelProxy, body string, mode string) *httptest.ResponseRecorder {
+		headers := map[string]string{}
+		if mode != "" {
+			headers["X-Ogem-Max-Tokens"] = mode
+		}
+		return sendChatCompletions(proxy, body, headers, nil)
+	}
+	maxTokensOf := func(request *openai.ChatCompletionRequest) int32 {
+		if request.MaxCompletionTokens != nil {
+			return *request.MaxCompletionTokens
+		}
+		return *request.MaxTokens
+	}
+
+	t.Run("Clamps to the maximum output tokens of the model", func(t *testing.T) {
+		proxy, small, _ := newProxy(t, false)
+
+		recorder := chatCompletions(proxy, `{"model": "small-model", "max_tokens": 16384, "messages": [{"role": "user", "content": "Hi"}]}`, "")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "requested=16384, clamped=4096", recorder.Header().Get("X-Ogem-Clamped-Max-Tokens"))
+		assert.Equal(t, int32(4096), maxTokensOf(small.receivedRequests()[0]))
+
+		recorder = chatCompletions(proxy, `{"model": "small-model", "max_tokens": 1000, "messages": [{"role": "user", "content": "Hi"}]}`, "")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Clamped-Max-Tokens"))
+		assert.Equal(t, int32(1000), maxTokensOf(small.receivedRequests()[1]))
+	})
+
+	t.Run("Clamps each model of the fallback chain to its own maximum", func(t *testing.T) {
+		proxy, small, large := newProxy(t, true)
+
+		recorder := chatCompletions(proxy, `{"model": "small-model,large-model", "max_completion_tokens": 16384, "messages": [{"role": "user", "content": "Hi"}]}`, "")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, int32(4096), maxTokensOf(small.receivedRequests()[0]))
+		assert.Equal(t, int32(8192), maxTokensOf(large.receivedRequests()[0]))
+		assert.Equal(t, "requested=16384, clamped=8192", recorder.Header().Get("X-Ogem-Clamped-Max-Tokens"))
+	})
+
+	t.Run("Rejects the request in strict mode", func(t *testing.T) {
+		proxy, small, _ := newProxy(t, false)
+
+		recorder := chatCompletions(proxy, `{"model": "small-model", "max_tokens": 16384, "messages": [{"role": "user", "content": "Hi"}]}`, "strict")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "missing capabilities: max_output_tokens")
+		assert.Empty(t, small.receivedRequests())
+
+		// Strict by default, and clamped on request.
+		proxy.config.StrictMaxTokens = true
+		recorder = chatCompletions(proxy, `{"model": "small-model", "max_tokens": 16384, "messages": [{"role": "user", "content": "Hi"}]}`, "")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		recorder = chatCompletions(proxy, `{"model": "small-model", "max_tokens": 16384, "messages": [{"role": "user", "content": "Hi"}]}`, "clamp")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		recorder = chatCompletions(proxy, `{"model": "small-model", "messages": [{"role": "user", "content": "Hi"}]}`, "loose")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "unsupported max tokens mode")
+	})
+}
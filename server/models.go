@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+// Configured model of a region that serves a model of the list.
+type servingRegion struct {
+	provider string
+	region   string
+	status   ogem.RegionStatus
+	model    *ogem.SupportedModel
+}
+
+// Lists the models of every region, by name, with the ogem extension. Every
+// API key can use every model, so the list is the same for all callers.
+func (s *ModelProxy) HandleModels(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(openai.ModelList{Object: "list", Data: s.listModels()}); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Returns the model with the ID, which may also be one of its aliases.
+func (s *ModelProxy) HandleModel(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	id := httpRequest.PathValue("id")
+	for _, model := range s.listModels() {
+		if model.Id != id && !slices.Contains(model.Ogem.Aliases, id) {
+			continue
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(httpResponse).Encode(model); err != nil {
+			s.logger.Errorw("Failed to encode response", "error", err)
+			writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+		}
+		return
+	}
+	handleError(httpResponse, ModelNotFoundError{fmt.Errorf("model %s is not configured", id)})
+}
+
+// Returns the models sorted by name. Their health is that of the last health
+// check, so listing them never calls the providers.
+func (s *ModelProxy) listModels() []openai.Model {
+	byName := map[string][]servingRegion{}
+	s.mutex.RLock()
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, regionStatus ogem.RegionStatus, models []*ogem.SupportedModel) bool {
+		// Regions whose endpoint failed to start cannot serve any request.
+		if _, err := s.endpoint(provider, region); err != nil {
+			return false
+		}
+		for _, model := range models {
+			byName[model.Name] = append(byName[model.Name], servingRegion{
+				provider: provider,
+				region:   region,
+				status:   regionStatus,
+				model:    model,
+			})
+		}
+		return false
+	})
+	s.mutex.RUnlock()
+
+	models := make([]openai.Model, 0, len(byName))
+	for name, regions := range byName {
+		models = append(models, openai.Model{
+			Id:      name,
+			Object:  "model",
+			OwnedBy: "ogem",
+			Ogem:    s.modelMetadata(name, regions),
+		})
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Id < models[j].Id
+	})
+	return models
+}
+
+// Summarizes the regions of the model. The limits and features are those
+// that every region supports, so that the callers can rely on them whichever
+// region serves the request.
+func (s *ModelProxy) modelMetadata(name string, regions []servingRegion) *openai.ModelMetadata {
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].provider != regions[j].provider {
+			return regions[i].provider < regions[j].provider
+		}
+		return regions[i].region < regions[j].region
+	})
+
+	metadata := &openai.ModelMetadata{
+		Endpoints:        []openai.ModelEndpoint{},
+		OutputModalities: []string{"text"},
+	}
+	features := map[string]int{}
+	for _, region := range regions {
+		for _, alias := range region.model.OtherNames {
+			if !slices.Contains(metadata.Aliases, alias) {
+				metadata.Aliases = append(metadata.Aliases, alias)
+			}
+		}
+		metadata.Reasoning = metadata.Reasoning || region.model.Reasoning
+
+		capabilities := region.model.ResolvedCapabilities()
+		metadata.MaxContextTokens = minKnown(metadata.MaxContextTokens, capabilities.MaxContextTokens)
+		metadata.MaxOutputTokens = minKnown(metadata.MaxOutputTokens, capabilities.MaxOutputTokens)
+		for _, feature := range supportedFeatures(region.model, capabilities) {
+			features[feature]++
+		}
+
+		metadata.Endpoints = append(metadata.Endpoints, openai.ModelEndpoint{
+			Provider:         region.provider,
+			Region:           region.region,
+			Health:           regionHealth(region.status).String(),
+			LatencyMs:        region.status.Latency.Milliseconds(),
+			InputPrice:       region.model.InputPrice,
+			OutputPrice:      region.model.OutputPrice,
+			MaxContextTokens: capabilities.MaxContextTokens,
+			MaxOutputTokens:  capabilities.MaxOutputTokens,
+		})
+	}
+	sort.Strings(metadata.Aliases)
+
+	metadata.Features = []string{}
+	for feature, count := range features {
+		if count == len(regions) {
+			metadata.Features = append(metadata.Features, feature)
+		}
+	}
+	sort.Strings(metadata.Features)
+	metadata.InputModalities = []string{"text"}
+	if slices.Contains(metadata.Features, "vision") {
+		metadata.InputModalities = append(metadata.InputModalities, "image")
+	}
+	if slices.Contains(metadata.Features, "audio") {
+		metadata.InputModalities = append(metadata.InputModalities, "audio")
+		metadata.OutputModalities = append(metadata.OutputModalities, "audio")
+	}
+
+	if deprecation := s.deprecations.find(name); deprecation != nil {
+		metadata.Deprecation = &openai.ModelDeprecation{
+			After:      deprecation.config.After,
+			RedirectTo: deprecation.config.RedirectTo,
+			Mode:       deprecation.config.Mode,
+			Retired:    !time.Now().Before(deprecation.cutoff),
+		}
+	}
+	return metadata
+}
+
+// Returns the features of the model, named as in the errors of the missing
+// capabilities.
+func supportedFeatures(model *ogem.SupportedModel, capabilities ogem.Capabilities) []string {
+	features := []string{}
+	if capabilities.ToolsSupported() {
+		features = append(features, "tools")
+	}
+	if capabilities.VisionSupported() {
+		features = append(features, "vision")
+	}
+	if capabilities.AudioSupported() {
+		features = append(features, "audio")
+	}
+	if capabilities.JsonModeSupported() {
+		features = append(features, "json_mode")
+	}
+	if capabilities.StreamingSupported() {
+		features = append(features, "streaming")
+	}
+	if capabilities.MultipleChoicesSupported() {
+		features = append(features, "n")
+	}
+	// Reasoning models are sent the request without logprobs.
+	if capabilities.LogprobsSupported() && !model.Reasoning {
+		features = append(features, "logprobs")
+	}
+	return features
+}
+
+// Returns the smaller of the limits, ignoring the unknown ones.
+func minKnown(current int, limit int) int {
+	if current == 0 || (limit > 0 && limit < current) {
+		return limit
+	}
+	return current
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestModels(t *testing.T) {
+	checked := time.Now()
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+			Latency:     120 * time.Millisecond,
+			LastChecked: checked,
+			Models: []*ogem.SupportedModel{
+				{Name: "gpt-4o", OtherNames: []string{"gpt-4o-2024-08-06"}, InputPrice: 2.5, OutputPrice: 10},
+				{Name: "gpt-4-0613", InputPrice: 30, OutputPrice: 60},
+				{Name: "o3-mini", Reasoning: true, InputPrice: 1.1, OutputPrice: 4.4},
+			},
+		}}},
+		"custom": {Regions: map[string]*ogem.RegionStatus{"eu": {
+			Models: []*ogem.SupportedModel{{Name: "gpt-4o", Capabilities: &ogem.Capabilities{
+				SupportsVision:  utils.ToPtr(false),
+				MaxOutputTokens: 4096,
+			}}},
+		}}},
+		"studio": {Regions: map[string]*ogem.RegionStatus{"studio": {
+			LastChecked: checked,
+			LastError:   "connection refused",
+			Models:      []*ogem.SupportedModel{{Name: "gemini-1.5-flash", InputPrice: 0.075, OutputPrice: 0.3}},
+		}}},
+		// Its endpoint failed to start.
+		"claude": {Regions: map[string]*ogem.RegionStatus{"claude": {
+			Models: []*ogem.SupportedModel{{Name: "claude-3-5-sonnet"}},
+		}}},
+	},
+		&fakeEndpoint{provider: "openai", region: "openai"},
+		&fakeEndpoint{provider: "custom", region: "eu"},
+		&fakeEndpoint{provider: "studio", region: "studio"},
+	)
+	deprecations, err := newDeprecationTable([]Deprecation{{Model: "gpt-4-0613", RedirectTo: "gpt-4o", After: "2020-01-01"}})
+	assert.NoError(t, err)
+	proxy.deprecations = deprecations
+
+	getModel := func(id string) *httptest.ResponseRecorder {
+		httpRequest := httptest.NewRequest("GET", "/v1/models/"+id, nil)
+		httpRequest.SetPathValue("id", id)
+		recorder := httptest.NewRecorder()
+		proxy.HandleModel(recorder, httpRequest)
+		return recorder
+	}
+
+	t.Run("Lists the models as in the golden file", func(t *testing.T) {
+		golden, err := os.ReadFile("testdata/models.golden.json")
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		proxy.HandleModels(recorder, httptest.NewRequest("GET", "/v1/models", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.JSONEq(t, string(golden), recorder.Body.String())
+	})
+
+	t.Run("Gets a model by its name or alias", func(t *testing.T) {
+		byName := getModel("gpt-4o")
+		assert.Equal(t, http.StatusOK, byName.Code)
+		var model openai.Model
+		assert.NoError(t, json.Unmarshal(byName.Body.Bytes(), &model))
+		assert.Equal(t, "gpt-4o", model.Id)
+		assert.Len(t, model.Ogem.Endpoints, 2)
+
+		byAlias := getModel("gpt-4o-2024-08-06")
+		assert.Equal(t, http.StatusOK, byAlias.Code)
+		assert.JSONEq(t, byName.Body.String(), byAlias.Body.String())
+	})
+
+	t.Run("Reports the models that are not served", func(t *testing.T) {
+		for _, id := range []string{"gpt-5", "claude-3-5-sonnet"} {
+			recorder := getModel(id)
+			assert.Equal(t, http.StatusNotFound, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), "model_not_found")
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/rs/cors"
+)
+
+// Returns the handler of every route of the proxy, wrapped in the CORS,
+// access log and compression middleware. Shared by the server binary and the
+// end-to-end tests so that they serve the same routes.
+func BuildMux(proxy *ModelProxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", proxy.HandleAuthentication(proxy.HandleLoadShedding(proxy.HandleChatCompletions)))
+	mux.HandleFunc("POST /v1/completions", proxy.HandleAuthentication(proxy.HandleLoadShedding(proxy.HandleCompletions)))
+	mux.HandleFunc("POST /v1/embeddings", proxy.HandleAuthentication(proxy.HandleLoadShedding(proxy.HandleEmbeddings)))
+	mux.HandleFunc("POST /v1/async/chat/completions", proxy.HandleAuthentication(proxy.HandleAsyncChatCompletions))
+	mux.HandleFunc("GET /v1/async/jobs/{id}", proxy.HandleAuthentication(proxy.HandleAsyncJob))
+	mux.HandleFunc("POST /v1/conversations", proxy.HandleAuthentication(proxy.HandleCreateConversation))
+	mux.HandleFunc("GET /v1/conversations/{id}", proxy.HandleAuthentication(proxy.HandleConversation))
+	mux.HandleFunc("POST /v1/conversations/{id}/messages", proxy.HandleAuthentication(proxy.HandleLoadShedding(proxy.HandleConversationMessage)))
+	mux.HandleFunc("DELETE /v1/conversations/{id}", proxy.HandleAuthentication(proxy.HandleDeleteConversation))
+	mux.HandleFunc("GET /v1/models", proxy.HandleAuthentication(proxy.HandleModels))
+	mux.HandleFunc("GET /v1/models/{id}", proxy.HandleAuthentication(proxy.HandleModel))
+	mux.HandleFunc("POST /v1/tokens/count", proxy.HandleAuthentication(proxy.HandleTokenCount))
+	mux.HandleFunc("POST /v1/cost/estimate", proxy.HandleAuthentication(proxy.HandleCostEstimate))
+	mux.HandleFunc("GET /v1/admin/limits", proxy.HandleAdminAuthentication(proxy.HandleLimits))
+	mux.HandleFunc("GET /v1/admin/requests", proxy.HandleAdminAuthentication(proxy.HandleRequestActivity))
+	mux.HandleFunc("GET /v1/admin/errors/recent", proxy.HandleAdminAuthentication(proxy.HandleRecentErrors))
+	mux.HandleFunc("POST /v1/admin/keys/{name}/revoke", proxy.HandleAdminAuthentication(proxy.HandleRevokeKey))
+	mux.HandleFunc("GET /v1/admin/keys/{name}/provider-keys", proxy.HandleAdminAuthentication(proxy.HandleProviderKeys))
+	mux.HandleFunc("PUT /v1/admin/keys/{name}/capture-transcripts", proxy.HandleAdminAuthentication(proxy.HandleCaptureTranscripts))
+	mux.HandleFunc("GET /v1/admin/keys/{name}/transcripts", proxy.HandleAdminAuthentication(proxy.HandleTranscripts))
+	mux.HandleFunc("POST /v1/admin/gemini-caches", proxy.HandleAdminAuthentication(proxy.HandleCreateGeminiCache))
+	mux.HandleFunc("GET /v1/admin/gemini-caches", proxy.HandleAdminAuthentication(proxy.HandleGeminiCaches))
+	mux.HandleFunc("DELETE /v1/admin/gemini-caches/{name}", proxy.HandleAdminAuthentication(proxy.HandleDeleteGeminiCache))
+	mux.HandleFunc("GET /v1/admin/shadow", proxy.HandleAdminAuthentication(proxy.HandleShadowStats))
+	mux.HandleFunc("GET /v1/admin/deprecations", proxy.HandleAdminAuthentication(proxy.HandleDeprecations))
+	mux.HandleFunc("GET /v1/admin/traffic-splits", proxy.HandleAdminAuthentication(proxy.HandleTrafficSplits))
+	mux.HandleFunc("GET /v1/admin/cache-savings", proxy.HandleAdminAuthentication(proxy.HandleCacheSavings))
+	mux.HandleFunc("POST /v1/admin/ping", proxy.HandleAdminAuthentication(proxy.HandlePing))
+	mux.HandleFunc("GET /v1/admin/end-users/{id}/usage", proxy.HandleAdminAuthentication(proxy.HandleEndUserUsage))
+	mux.HandleFunc("GET /ready", proxy.HandleReadiness)
+	mux.HandleFunc("/", HandleNotFound)
+
+	corsMiddleware := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"*"},
+		Debug:          false,
+	})
+
+	return corsMiddleware.Handler(proxy.AccessLogMiddleware(CompressionMiddleware(proxy.config.Compression, mux)))
+}
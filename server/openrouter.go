@@ -0,0 +1,21 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Returns the "provider/region/model" that served the response for the
+// X-Ogem-Resolved-Model header. For OpenRouter, the model is the one that it
+// actually used, which may differ from the requested one.
+func resolvedModelHeader(resolvedModel string, response *openai.ChatCompletionResponse) string {
+	if response.Ogem == nil || response.Ogem.OpenRouter == nil || response.Ogem.OpenRouter.Model == "" {
+		return resolvedModel
+	}
+	parts := strings.SplitN(resolvedModel, "/", 3)
+	if len(parts) < 3 {
+		return resolvedModel
+	}
+	return parts[0] + "/" + parts[1] + "/" + response.Ogem.OpenRouter.Model
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	openaiProvider "github.com/yanolja/ogem/provider/openai"
+)
+
+func TestOpenRouter(t *testing.T) {
+	var requestBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{
+			"id": "gen-123",
+			"model": "meta-llama/llama-3.1-70b-instruct",
+			"provider": "Fireworks",
+			"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12, "cost": 0.00042}
+		}`))
+	}))
+	t.Cleanup(server.Close)
+
+	endpoint, err := openaiProvider.NewEndpoint("openrouter", "openrouter", server.URL, "test-key", zap.NewNop().Sugar(),
+		openaiProvider.WithOpenRouter(map[string]string{"llama-3.1-70b": "meta-llama/llama-3.1-70b-instruct"}))
+	assert.NoError(t, err)
+	t.Cleanup(func() { endpoint.Shutdown() })
+
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"openrouter": {Regions: map[string]*ogem.RegionStatus{"openrouter": {
+			Models: []*ogem.SupportedModel{{Name: "llama-3.1-70b", InputPrice: 1, OutputPrice: 1}},
+		}}},
+		"fake": {Regions: map[string]*ogem.RegionStatus{"fake": {
+			Models: []*ogem.SupportedModel{{Name: "fake-model"}},
+		}}},
+	}, endpoint, &fakeEndpoint{provider: "fake", region: "fake"})
+
+	chatCompletions := func(body string) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder, decodeChatCompletion(recorder)
+	}
+
+	t.Run("Passes the routing fields and reports the upstream", func(t *testing.T) {
+		recorder, response := chatCompletions(`{
+			"model": "llama-3.1-70b",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"openrouter": {"provider": {"order": ["Together", "Fireworks"]}, "transforms": ["middle-out"]}
+		}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.JSONEq(t, `{
+			"model": "meta-llama/llama-3.1-70b-instruct",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"provider": {"order": ["Together", "Fireworks"]},
+			"transforms": ["middle-out"],
+			"usage": {"include": true}
+		}`, string(requestBody))
+		assert.Equal(t, "openrouter/openrouter/meta-llama/llama-3.1-70b-instruct", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Equal(t, "Fireworks", response.Ogem.OpenRouter.Provider)
+		assert.Equal(t, "gen-123", response.Ogem.OpenRouter.GenerationId)
+
+		// The reported cost is used over the prices of the model.
+		activity := proxy.activity.list(requestSuccess, "", 1)[0]
+		assert.Equal(t, 0.00042, activity.Cost)
+	})
+
+	t.Run("Rejects the routing fields for other providers", func(t *testing.T) {
+		recorder, _ := chatCompletions(`{
+			"model": "fake-model",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"openrouter": {"provider": {"sort": "price"}}
+		}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "openrouter")
+	})
+}
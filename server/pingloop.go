@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/provider"
+)
+
+const (
+	// Number of the endpoints pinged at once, unless configured.
+	defaultPingConcurrency = 16
+
+	// Maximum duration of a sweep triggered by POST /v1/admin/ping. The
+	// endpoints that have not answered by then are reported with the
+	// deadline error, which is not recorded in their status.
+	triggeredPingTimeout = 30 * time.Second
+)
+
+// Health checks of every endpoint on an interval. The loop can be stopped,
+// started again, and given another interval while it runs. The zero value is
+// a stopped loop with no interval.
+type pingLoop struct {
+	mutex    sync.Mutex
+	interval time.Duration
+
+	// Cancels the running loop and its sweep. Nil if not running.
+	cancel context.CancelFunc
+
+	// Wakes the running loop up to apply a new interval.
+	reset chan struct{}
+
+	// Closed when the running loop returns.
+	done chan struct{}
+}
+
+// Result of the health check of an endpoint.
+type PingResult struct {
+	Provider  string `json:"provider"`
+	Region    string `json:"region"`
+	Healthy   bool   `json:"healthy"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type PingResponse struct {
+	Results    []PingResult `json:"results"`
+	DurationMs int64        `json:"duration_ms"`
+}
+
+func (s *ModelProxy) PingInterval() time.Duration {
+	s.pings.mutex.Lock()
+	defer s.pings.mutex.Unlock()
+	return s.pings.interval
+}
+
+// Starts the ping loop in the background until the context is done or the
+// loop is stopped. Pings every endpoint first unless the warm-up has done so.
+// Does nothing if it is already running. With no interval, the loop waits
+// for one to be set.
+func (s *ModelProxy) StartPingLoop(ctx context.Context) {
+	s.pings.mutex.Lock()
+	defer s.pings.mutex.Unlock()
+	if s.pings.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.pings.cancel = cancel
+	s.pings.reset = make(chan struct{}, 1)
+	s.pings.done = make(chan struct{})
+	go s.runPingLoop(ctx, s.pings.interval, s.pings.reset, s.pings.done)
+}
+
+// Stops the ping loop, canceling its sweep if any, and waits for it to
+// return. Does nothing if it is not running.
+func (s *ModelProxy) StopPingLoop() {
+	s.pings.mutex.Lock()
+	cancel, done := s.pings.cancel, s.pings.done
+	s.pings.cancel, s.pings.reset, s.pings.done = nil, nil, nil
+	s.pings.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Changes the interval of the ping loop, from the next tick if it is
+// running. Zero or less pauses the pings, and the readiness endpoint then
+// reports ready regardless of the health checks.
+func (s *ModelProxy) SetPingInterval(interval time.Duration) {
+	s.pings.mutex.Lock()
+	defer s.pings.mutex.Unlock()
+	s.pings.interval = interval
+	if s.pings.reset == nil {
+		return
+	}
+	select {
+	case s.pings.reset <- struct{}{}:
+	default:
+		// The loop has yet to read the previous change, which it reads
+		// together with this one.
+	}
+}
+
+// Pings every endpoint now, apart from the loop, and returns the results.
+func (s *ModelProxy) TriggerPing(ctx context.Context) []PingResult {
+	return s.pingAllEndpoints(ctx, false)
+}
+
+func (s *ModelProxy) runPingLoop(ctx context.Context, interval time.Duration, reset <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	startTicker := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if interval > 0 {
+			ticker = time.NewTicker(interval)
+			tick = ticker.C
+		}
+	}
+	startTicker()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	// This ensures we have initial data without waiting for the first tick,
+	// which occurs after a full interval. The warm-up has already collected
+	// it if enabled.
+	round := 0
+	if interval > 0 && !s.config.Warmup.Enabled {
+		s.pingAllEndpoints(ctx, s.config.DeepHealthCheck)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reset:
+			previous := interval
+			interval = s.PingInterval()
+			if interval == previous {
+				continue
+			}
+			s.logger.Infow("Changed ping interval", "interval", interval)
+			startTicker()
+			// The status has not been kept up to date while paused.
+			if previous <= 0 && interval > 0 {
+				s.pingAllEndpoints(ctx, false)
+			}
+		case <-tick:
+			round++
+			s.pingAllEndpoints(ctx, s.config.DeepHealthCheck && round%deepHealthCheckRounds == 0)
+		}
+	}
+}
+
+// Checks the health of every endpoint, ping_concurrency of them at once, and
+// returns the results sorted by provider and region. If deep is set, also
+// generates a one-token completion with a model of every region that passes
+// the ping.
+func (s *ModelProxy) pingAllEndpoints(ctx context.Context, deep bool) []PingResult {
+	concurrency := s.config.PingConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPingConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+	results := make([]PingResult, len(s.endpoints))
+	var wait sync.WaitGroup
+	for index, endpoint := range s.endpoints {
+		slots <- struct{}{}
+		wait.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wait.Done()
+			}()
+			results[index] = s.pingEndpoint(ctx, endpoint, deep)
+		}()
+	}
+	wait.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Provider != results[j].Provider {
+			return results[i].Provider < results[j].Provider
+		}
+		return results[i].Region < results[j].Region
+	})
+	return results
+}
+
+func (s *ModelProxy) pingEndpoint(ctx context.Context, endpoint provider.AiEndpoint, deep bool) PingResult {
+	latency, err := endpoint.Ping(ctx)
+	if err == nil && deep {
+		err = s.checkCompletion(ctx, endpoint)
+	}
+	result := PingResult{Provider: endpoint.Provider(), Region: endpoint.Region(), Healthy: err == nil, LatencyMs: latency.Milliseconds()}
+	if err != nil {
+		s.logger.Warnw("Failed to ping endpoint", "provider", endpoint.Provider(), "region", endpoint.Region(), "error", err)
+		result.Error = err.Error()
+	}
+	// The endpoint did not fail if the sweep was canceled or timed out.
+	if ctx.Err() != nil {
+		return result
+	}
+	s.updateEndpointStatus(endpoint.Provider(), endpoint.Region(), latency, err)
+	return result
+}
+
+// Pings every endpoint at once and responds with the results, which are also
+// recorded as those of a health check. The sweep completes even if the client
+// disconnects.
+func (s *ModelProxy) HandlePing(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(httpRequest.Context()), triggeredPingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	results := s.TriggerPing(ctx)
+	response := PingResponse{Results: results, DurationMs: time.Since(start).Milliseconds()}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/provider"
+)
+
+func TestPingLoop(t *testing.T) {
+	// Proxy of an endpoint that counts its pings.
+	newProxy := func(t *testing.T, interval time.Duration) (*ModelProxy, *atomic.Int32) {
+		var pings atomic.Int32
+		endpoint := &fakeEndpoint{provider: "fake", region: "fake", ping: func(ctx context.Context) (time.Duration, error) {
+			pings.Add(1)
+			return time.Millisecond, nil
+		}}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: map[string]*ogem.RegionStatus{"fake": {}}}}, endpoint)
+		proxy.SetPingInterval(interval)
+		t.Cleanup(proxy.StopPingLoop)
+		return proxy, &pings
+	}
+
+	t.Run("Pings first and then on the interval", func(t *testing.T) {
+		proxy, pings := newProxy(t, 10*time.Millisecond)
+
+		proxy.StartPingLoop(context.Background())
+		assert.Eventually(t, func() bool { return pings.Load() >= 3 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("Applies a new interval while running", func(t *testing.T) {
+		proxy, pings := newProxy(t, time.Hour)
+
+		proxy.StartPingLoop(context.Background())
+		assert.Eventually(t, func() bool { return pings.Load() == 1 }, time.Second, time.Millisecond)
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(1), pings.Load())
+
+		proxy.SetPingInterval(10 * time.Millisecond)
+		assert.Equal(t, 10*time.Millisecond, proxy.PingInterval())
+		assert.Eventually(t, func() bool { return pings.Load() >= 3 }, time.Second, time.Millisecond)
+
+		proxy.SetPingInterval(0)
+		time.Sleep(30 * time.Millisecond)
+		paused := pings.Load()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, paused, pings.Load())
+	})
+
+	t.Run("Pings at once when resumed", func(t *testing.T) {
+		proxy, pings := newProxy(t, 0)
+
+		proxy.StartPingLoop(context.Background())
+		time.Sleep(30 * time.Millisecond)
+		assert.Zero(t, pings.Load())
+
+		proxy.SetPingInterval(time.Hour)
+		assert.Eventually(t, func() bool { return pings.Load() == 1 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("Stops and starts again", func(t *testing.T) {
+		proxy, pings := newProxy(t, 10*time.Millisecond)
+
+		proxy.StartPingLoop(context.Background())
+		proxy.StartPingLoop(context.Background())
+		assert.Eventually(t, func() bool { return pings.Load() >= 2 }, time.Second, time.Millisecond)
+
+		proxy.StopPingLoop()
+		stopped := pings.Load()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, stopped, pings.Load())
+		proxy.StopPingLoop()
+
+		proxy.StartPingLoop(context.Background())
+		assert.Eventually(t, func() bool { return pings.Load() > stopped }, time.Second, time.Millisecond)
+	})
+
+	t.Run("Cancels the sweep on stop", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "fake", region: "fake", ping: func(ctx context.Context) (time.Duration, error) {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: map[string]*ogem.RegionStatus{"fake": {}}}}, endpoint)
+		proxy.SetPingInterval(time.Hour)
+
+		proxy.StartPingLoop(context.Background())
+		time.Sleep(20 * time.Millisecond)
+		stopped := make(chan struct{})
+		go func() {
+			proxy.StopPingLoop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("the loop did not stop")
+		}
+	})
+}
+
+func TestTriggerPing(t *testing.T) {
+	newProxy := func(t *testing.T, endpoints ...*fakeEndpoint) *ModelProxy {
+		regions := map[string]*ogem.RegionStatus{}
+		aiEndpoints := []provider.AiEndpoint{}
+		for _, endpoint := range endpoints {
+			regions[endpoint.region] = &ogem.RegionStatus{}
+			aiEndpoints = append(aiEndpoints, endpoint)
+		}
+		return newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: regions}}, aiEndpoints...)
+	}
+
+	t.Run("Returns the results of every endpoint", func(t *testing.T) {
+		proxy := newProxy(t,
+			&fakeEndpoint{provider: "fake", region: "b-down", ping: func(ctx context.Context) (time.Duration, error) {
+				return 0, errors.New("connection refused")
+			}},
+			&fakeEndpoint{provider: "fake", region: "a-healthy", ping: func(ctx context.Context) (time.Duration, error) {
+				return 20 * time.Millisecond, nil
+			}},
+		)
+
+		results := proxy.TriggerPing(context.Background())
+		assert.Equal(t, []PingResult{
+			{Provider: "fake", Region: "a-healthy", Healthy: true, LatencyMs: 20},
+			{Provider: "fake", Region: "b-down", Error: "connection refused"},
+		}, results)
+		assert.True(t, proxy.endpointStatus["fake"].Regions["a-healthy"].Healthy())
+		assert.Equal(t, "connection refused", proxy.endpointStatus["fake"].Regions["b-down"].LastError)
+	})
+
+	t.Run("Pings the endpoints in parallel up to the concurrency", func(t *testing.T) {
+		var inFlight, maxInFlight atomic.Int32
+		endpoints := []*fakeEndpoint{}
+		for index := range 8 {
+			endpoints = append(endpoints, &fakeEndpoint{provider: "fake", region: fmt.Sprintf("region-%d", index), ping: func(ctx context.Context) (time.Duration, error) {
+				current := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					observed := maxInFlight.Load()
+					if current <= observed || maxInFlight.CompareAndSwap(observed, current) {
+						break
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+				return 100 * time.Millisecond, nil
+			}})
+		}
+		proxy := newProxy(t, endpoints...)
+		proxy.config.PingConcurrency = 4
+
+		start := time.Now()
+		results := proxy.TriggerPing(context.Background())
+		elapsed := time.Since(start)
+		assert.Len(t, results, 8)
+		assert.Equal(t, int32(4), maxInFlight.Load())
+		// Two rounds of four instead of eight in a row.
+		assert.Less(t, elapsed, 600*time.Millisecond)
+	})
+
+	t.Run("Keeps the status of the endpoints when canceled", func(t *testing.T) {
+		pinged := make(chan struct{})
+		proxy := newProxy(t,
+			&fakeEndpoint{provider: "fake", region: "a-answered", ping: func(ctx context.Context) (time.Duration, error) {
+				return 20 * time.Millisecond, nil
+			}},
+			&fakeEndpoint{provider: "fake", region: "b-pending", ping: func(ctx context.Context) (time.Duration, error) {
+				close(pinged)
+				<-ctx.Done()
+				return 0, ctx.Err()
+			}},
+		)
+		// Pings one endpoint after the other, in order.
+		proxy.config.PingConcurrency = 1
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-pinged
+			cancel()
+		}()
+		results := proxy.TriggerPing(ctx)
+		assert.Equal(t, "context canceled", results[1].Error)
+		assert.True(t, proxy.endpointStatus["fake"].Regions["a-answered"].Healthy())
+		pending := proxy.endpointStatus["fake"].Regions["b-pending"]
+		assert.Empty(t, pending.LastError)
+		assert.True(t, pending.LastChecked.IsZero())
+	})
+
+	t.Run("Completes the sweep of the admin endpoint after the client disconnects", func(t *testing.T) {
+		proxy := newProxy(t, &fakeEndpoint{provider: "fake", region: "fake", ping: func(ctx context.Context) (time.Duration, error) {
+			return time.Millisecond, ctx.Err()
+		}})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		recorder := httptest.NewRecorder()
+		proxy.HandlePing(recorder, httptest.NewRequest("POST", "/v1/admin/ping", nil).WithContext(ctx))
+		var response PingResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, []PingResult{{Provider: "fake", Region: "fake", Healthy: true, LatencyMs: 1}}, response.Results)
+		assert.True(t, proxy.endpointStatus["fake"].Regions["fake"].Healthy())
+	})
+
+	t.Run("Responds to the admin endpoint", func(t *testing.T) {
+		proxy := newProxy(t, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		recorder := httptest.NewRecorder()
+		proxy.HandlePing(recorder, httptest.NewRequest("POST", "/v1/admin/ping", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response PingResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, []PingResult{{Provider: "fake", Region: "fake", Healthy: true}}, response.Results)
+	})
+}
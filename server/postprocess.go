@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/postprocess"
+)
+
+type postprocessContextKey struct{}
+
+// Returns the transforms of the request, or nil to use those of the model.
+// The X-Ogem-Postprocess header takes precedence over the ogem_postprocess
+// field of the body.
+func parsePostprocess(httpRequest *http.Request, fields ogemExtensionFields) ([]string, error) {
+	value := fields.Postprocess
+	if header := httpRequest.Header.Get("X-Ogem-Postprocess"); header != "" {
+		value = header
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return postprocess.Parse(value)
+}
+
+func withPostprocess(ctx context.Context, transforms []string) context.Context {
+	return context.WithValue(ctx, postprocessContextKey{}, transforms)
+}
+
+// Returns the transforms of the request. Nil if the request does not set
+// them.
+func postprocessFrom(ctx context.Context) []string {
+	transforms, _ := ctx.Value(postprocessContextKey{}).([]string)
+	return transforms
+}
+
+func wantsJson(request *openai.ChatCompletionRequest) bool {
+	return request.ResponseFormat != nil && (request.ResponseFormat.Type == "json_object" || request.ResponseFormat.Type == "json_schema")
+}
+
+// Applies the transforms of the request, or those of the model if the
+// request does not set them, to the text content of each choice. Responses
+// are never streamed, so the transforms always see the whole content.
+func postprocessResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse, modelStatus *ogem.SupportedModel) {
+	transforms := postprocessFrom(ctx)
+	if transforms == nil && modelStatus != nil {
+		transforms = modelStatus.Postprocess
+	}
+	if len(transforms) == 0 {
+		return
+	}
+	for index := range response.Choices {
+		content := response.Choices[index].Message.Content
+		if content == nil || content.String == nil {
+			continue
+		}
+		transformed := postprocess.Apply(*content.String, transforms, wantsJson(request))
+		response.Choices[index].Message.Content = &openai.MessageContent{String: &transformed}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestPostprocess(t *testing.T) {
+	const fenced = "Here is the JSON you requested:\n\n\n```json\n{\"answer\": 42}\n```  \n"
+
+	newProxy := func(t *testing.T, transforms ...string) (*ModelProxy, *fakeEndpoint) {
+		return newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "chat", Postprocess: transforms}, replyWith(fenced, openai.Usage{}))
+	}
+	chatCompletions := func(proxy *ModelProxy, header string, request map[string]any) *httptest.ResponseRecorder {
+		request["model"] = "chat"
+		request["messages"] = []openai.Message{userMessage("Answer in JSON.")}
+		body, err := json.Marshal(request)
+		assert.NoError(t, err)
+		headers := map[string]string{}
+		if header != "" {
+			headers["X-Ogem-Postprocess"] = header
+		}
+		return sendChatCompletions(proxy, string(body), headers, nil)
+	}
+	content := func(t *testing.T, recorder *httptest.ResponseRecorder) string {
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		return *decodeChatCompletion(recorder).Choices[0].Message.Content.String
+	}
+	jsonFormat := map[string]string{"type": "json_object"}
+
+	t.Run("Keeps the content unless asked", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+		recorder := chatCompletions(proxy, "", map[string]any{"response_format": jsonFormat})
+		assert.Equal(t, fenced, content(t, recorder))
+	})
+
+	t.Run("Applies the transforms of the header", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+		recorder := chatCompletions(proxy, "json-extract,trim", map[string]any{"response_format": jsonFormat})
+		assert.Equal(t, `{"answer": 42}`, content(t, recorder))
+	})
+
+	t.Run("Extracts JSON only if the request asks for it", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+		recorder := chatCompletions(proxy, "json-extract,collapse-blank-lines,trim", map[string]any{})
+		assert.Equal(t, "Here is the JSON you requested:\n\n```json\n{\"answer\": 42}\n```", content(t, recorder))
+	})
+
+	t.Run("Applies the transforms of the body field", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+		recorder := chatCompletions(proxy, "", map[string]any{"response_format": jsonFormat, "ogem_postprocess": "json-extract"})
+		assert.Equal(t, `{"answer": 42}`, content(t, recorder))
+	})
+
+	t.Run("Applies the transforms of the model", func(t *testing.T) {
+		proxy, _ := newProxy(t, "json-extract")
+		recorder := chatCompletions(proxy, "", map[string]any{"response_format": jsonFormat})
+		assert.Equal(t, `{"answer": 42}`, content(t, recorder))
+	})
+
+	t.Run("Replaces the transforms of the model with the header", func(t *testing.T) {
+		proxy, _ := newProxy(t, "json-extract")
+		recorder := chatCompletions(proxy, "trim", map[string]any{"response_format": jsonFormat})
+		assert.Equal(t, strings.TrimRight(fenced, " \n"), content(t, recorder))
+
+		recorder = chatCompletions(proxy, "none", map[string]any{"response_format": jsonFormat})
+		assert.Equal(t, fenced, content(t, recorder))
+	})
+
+	t.Run("Caches the content as generated", func(t *testing.T) {
+		proxy, endpoint := newProxy(t)
+		request := func() map[string]any {
+			return map[string]any{"response_format": jsonFormat, "temperature": 0}
+		}
+		recorder := chatCompletions(proxy, "json-extract", request())
+		assert.Equal(t, `{"answer": 42}`, content(t, recorder))
+
+		recorder = chatCompletions(proxy, "", request())
+		assert.Equal(t, fenced, content(t, recorder))
+		recorder = chatCompletions(proxy, "json-extract", request())
+		assert.Equal(t, `{"answer": 42}`, content(t, recorder))
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Rejects unknown transforms", func(t *testing.T) {
+		proxy, _ := newProxy(t)
+		recorder := chatCompletions(proxy, "strip-markdown", map[string]any{})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), `unknown transform \"strip-markdown\"`)
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/provider"
+)
+
+// Number of the trailing characters of a provider key shown by the admin
+// endpoint, the same as the provider consoles do.
+const providerKeySuffixLength = 4
+
+type ProviderKeysResponse struct {
+	Name string `json:"name"`
+
+	// Providers whose keys the API key brings, with their keys masked.
+	ProviderKeys []ProviderKeyStatus `json:"provider_keys"`
+}
+
+type ProviderKeyStatus struct {
+	Provider string `json:"provider"`
+
+	// The last characters of the key. E.g., ...abcd
+	Key string `json:"key"`
+}
+
+// Returns the key of the provider that the API key of the request brings.
+// False if the requests to the provider use the key of the proxy.
+func providerKeyFrom(ctx context.Context, providerName string) (string, bool) {
+	apiKey, _ := apiKeyFrom(ctx)
+	key, found := apiKey.ProviderKeys[providerName]
+	return key, found && key != ""
+}
+
+// Returns the context to send the request to the endpoint with, which carries
+// the key of its provider if the API key brings one.
+func withProviderKey(ctx context.Context, endpoint *endpointStatus) context.Context {
+	if key, found := providerKeyFrom(ctx, endpoint.endpoint.Provider()); found {
+		return provider.WithApiKey(ctx, key)
+	}
+	return ctx
+}
+
+// Returns the model name under which the rate limits and the quota errors of
+// the endpoint are recorded. The requests sent with a key of their own are
+// limited separately, since the provider limits each account on its own, so
+// that one owner exhausting their quota does not disable the endpoint for the
+// others.
+func rateLimitModel(ctx context.Context, endpoint *endpointStatus, modelOrAlias string) string {
+	key, found := providerKeyFrom(ctx, endpoint.endpoint.Provider())
+	if !found {
+		return modelOrAlias
+	}
+	hash := sha256.Sum256([]byte(key))
+	return modelOrAlias + "#" + hex.EncodeToString(hash[:4])
+}
+
+func maskProviderKey(key string) string {
+	// Short keys are hidden entirely, since their suffix is most of them.
+	if len(key) < 2*providerKeySuffixLength {
+		return "..."
+	}
+	return "..." + key[len(key)-providerKeySuffixLength:]
+}
+
+// Lists the providers whose keys the API keys with the name in the path bring,
+// with the keys masked. The keys are set in the config, so they cannot be
+// changed here.
+func (s *ModelProxy) HandleProviderKeys(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	name := httpRequest.PathValue("name")
+	response := ProviderKeysResponse{Name: name, ProviderKeys: []ProviderKeyStatus{}}
+	found := false
+	for _, apiKey := range s.apiKeyIndex {
+		if apiKey.Name == "" || apiKey.Name != name {
+			continue
+		}
+		found = true
+		for providerName, key := range apiKey.ProviderKeys {
+			response.ProviderKeys = append(response.ProviderKeys, ProviderKeyStatus{Provider: providerName, Key: maskProviderKey(key)})
+		}
+	}
+	if !found {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "key_not_found", fmt.Sprintf("No API key is named %q", name))
+		return
+	}
+	slices.SortFunc(response.ProviderKeys, func(a, b ProviderKeyStatus) int {
+		return cmp.Or(cmp.Compare(a.Provider, b.Provider), cmp.Compare(a.Key, b.Key))
+	})
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
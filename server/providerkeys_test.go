@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestProviderKeys(t *testing.T) {
+	newProxy := func(t *testing.T, generate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)) *ModelProxy {
+		proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, generate)
+		return proxy
+	}
+	chatCompletions := func(proxy *ModelProxy, apiKey ApiKey) *httptest.ResponseRecorder {
+		return sendChatCompletions(proxy, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`, nil, &apiKey)
+	}
+	respond := func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}}}}, nil
+	}
+	owner := ApiKey{Name: "search", Key: "key-1", ProviderKeys: map[string]string{"fake": "owner-secret-abcd"}}
+	other := ApiKey{Name: "web", Key: "key-2"}
+
+	t.Run("Sends the requests with the key of the owner", func(t *testing.T) {
+		receivedKeys := []string{}
+		proxy := newProxy(t, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			key, _ := provider.ApiKeyFrom(ctx)
+			receivedKeys = append(receivedKeys, key)
+			return respond(ctx, request)
+		})
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, owner).Code)
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, other).Code)
+		assert.Equal(t, []string{"owner-secret-abcd", ""}, receivedKeys)
+	})
+
+	t.Run("Disables the endpoint only for the key that hit the quota", func(t *testing.T) {
+		proxy := newProxy(t, respond)
+		endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+		assert.NoError(t, err)
+		ownerCtx := withApiKey(context.Background(), owner)
+		assert.NotEqual(t, "fake-model", rateLimitModel(ownerCtx, endpoints[0], "fake-model"))
+
+		assert.True(t, proxy.disableOnQuotaError(ownerCtx, endpoints[0], "fake-model", errors.New("429: quota exceeded")))
+		assert.True(t, proxy.allDisabled(ownerCtx, endpoints, "fake-model"))
+		assert.False(t, proxy.allDisabled(context.Background(), endpoints, "fake-model"))
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, other).Code)
+	})
+
+	t.Run("Lists the provider keys masked", func(t *testing.T) {
+		proxy := newProxy(t, respond)
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "admin", Key: "admin-key", Admin: true},
+			{Name: "search", Key: "key-1", ProviderKeys: map[string]string{"openai": "sk-proj-1234wxyz", "claude": "short"}},
+		}
+		proxy.indexApiKeys()
+		list := func(name string) *httptest.ResponseRecorder {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /v1/admin/keys/{name}/provider-keys", proxy.HandleAdminAuthentication(proxy.HandleProviderKeys))
+			request := httptest.NewRequest("GET", "/v1/admin/keys/"+name+"/provider-keys", nil)
+			request.Header.Set("Authorization", "Bearer admin-key")
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		recorder := list("search")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.NotContains(t, recorder.Body.String(), "sk-proj")
+		var response ProviderKeysResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, ProviderKeysResponse{Name: "search", ProviderKeys: []ProviderKeyStatus{
+			{Provider: "claude", Key: "..."},
+			{Provider: "openai", Key: "...wxyz"},
+		}}, response)
+
+		assert.Equal(t, http.StatusNotFound, list("unknown").Code)
+	})
+
+	t.Run("Resolves the environment variables in the keys", func(t *testing.T) {
+		t.Setenv("OGEM_TEST_OWNER_KEY", "resolved-key")
+		proxy := newProxy(t, respond)
+		proxy.config.ApiKeys = []ApiKey{{Name: "search", Key: "key-1", ProviderKeys: map[string]string{"fake": "${OGEM_TEST_OWNER_KEY}"}}}
+		proxy.indexApiKeys()
+
+		apiKey, found := proxy.findApiKey("key-1")
+		assert.True(t, found)
+		assert.Equal(t, map[string]string{"fake": "resolved-key"}, apiKey.ProviderKeys)
+	})
+}
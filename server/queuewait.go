@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Why a request slept in the failover loop.
+type queueWaitKind string
+
+const (
+	// Waiting for the endpoint that frees up first, after every endpoint was
+	// rate limited or busy.
+	queueWaitEndpoint queueWaitKind = "endpoint"
+
+	// Waiting for the retry interval of the last model of the chain, after
+	// every endpoint was unavailable.
+	queueWaitRetry queueWaitKind = "retry"
+)
+
+// Upper bounds of the buckets of the wait histograms, in milliseconds. The
+// waits above the last one are only counted in the total.
+var queueWaitBucketsMs = []int64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// Histogram of the waits of a model for one kind of wait, since the start of
+// this instance.
+type QueueWaitStats struct {
+	// Provider of the endpoint waited for. Empty for the retries of a model
+	// that was not asked for at a provider.
+	Provider string        `json:"provider"`
+	Model    string        `json:"model"`
+	Kind     queueWaitKind `json:"kind"`
+
+	Count   int64 `json:"count"`
+	TotalMs int64 `json:"total_ms"`
+
+	// Number of waits up to each bound of queueWaitBucketsMs, cumulative.
+	Buckets []QueueWaitBucket `json:"buckets"`
+}
+
+type QueueWaitBucket struct {
+	LessOrEqualMs int64 `json:"le_ms"`
+	Count         int64 `json:"count"`
+}
+
+type queueWaitKey struct {
+	provider string
+	model    string
+	kind     queueWaitKind
+}
+
+type queueWaitHistogram struct {
+	count   int64
+	total   time.Duration
+	buckets []int64
+}
+
+// Waits of every model on this instance. The zero value is ready to use.
+type queueWaitTable struct {
+	mutex      sync.Mutex
+	histograms map[queueWaitKey]*queueWaitHistogram
+}
+
+func (t *queueWaitTable) observe(provider string, model string, kind queueWaitKind, wait time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.histograms == nil {
+		t.histograms = map[queueWaitKey]*queueWaitHistogram{}
+	}
+	key := queueWaitKey{provider: provider, model: model, kind: kind}
+	histogram, found := t.histograms[key]
+	if !found {
+		histogram = &queueWaitHistogram{buckets: make([]int64, len(queueWaitBucketsMs))}
+		t.histograms[key] = histogram
+	}
+	histogram.count++
+	histogram.total += wait
+	for index, bound := range queueWaitBucketsMs {
+		if wait.Milliseconds() <= bound {
+			histogram.buckets[index]++
+		}
+	}
+}
+
+// Returns the histograms sorted by provider, model and kind.
+func (t *queueWaitTable) snapshot() []QueueWaitStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := make([]QueueWaitStats, 0, len(t.histograms))
+	for key, histogram := range t.histograms {
+		buckets := make([]QueueWaitBucket, len(queueWaitBucketsMs))
+		for index, bound := range queueWaitBucketsMs {
+			buckets[index] = QueueWaitBucket{LessOrEqualMs: bound, Count: histogram.buckets[index]}
+		}
+		stats = append(stats, QueueWaitStats{
+			Provider: key.provider,
+			Model:    key.model,
+			Kind:     key.kind,
+			Count:    histogram.count,
+			TotalMs:  histogram.total.Milliseconds(),
+			Buckets:  buckets,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Provider != stats[j].Provider {
+			return stats[i].Provider < stats[j].Provider
+		}
+		if stats[i].Model != stats[j].Model {
+			return stats[i].Model < stats[j].Model
+		}
+		return stats[i].Kind < stats[j].Kind
+	})
+	return stats
+}
+
+type queueWaitContextKey struct{}
+
+// Time that a request has slept in the failover loop, over all the models of
+// its chain.
+type queueWait struct {
+	mutex sync.Mutex
+	total time.Duration
+}
+
+func withQueueWait(ctx context.Context, wait *queueWait) context.Context {
+	return context.WithValue(ctx, queueWaitContextKey{}, wait)
+}
+
+// Nil if the request does not track its waits. Every method of queueWait
+// does nothing on nil.
+func queueWaitFrom(ctx context.Context) *queueWait {
+	wait, _ := ctx.Value(queueWaitContextKey{}).(*queueWait)
+	return wait
+}
+
+func (w *queueWait) add(wait time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.total += wait
+}
+
+func (w *queueWait) milliseconds() int64 {
+	if w == nil {
+		return 0
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.total.Milliseconds()
+}
+
+// Sleeps in the failover loop, adding the time slept to the request and to
+// the histogram of the model.
+func (s *ModelProxy) sleepInQueue(ctx context.Context, provider string, model string, kind queueWaitKind, wait time.Duration) {
+	start := time.Now()
+	time.Sleep(wait)
+	slept := time.Since(start)
+	queueWaitFrom(ctx).add(slept)
+	s.queueWaits.observe(provider, model, kind, slept)
+}
+
+// Reports the time that the request has slept so far in the
+// X-Ogem-Queue-Ms header.
+func writeQueueWait(httpResponse http.ResponseWriter, wait *queueWait) {
+	httpResponse.Header().Set("X-Ogem-Queue-Ms", strconv.FormatInt(wait.milliseconds(), 10))
+}
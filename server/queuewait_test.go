@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/state"
+)
+
+// Rate limits the first requests, each for the request interval, then
+// accepts all of them.
+type rateLimitedManager struct {
+	state.Manager
+
+	mutex      sync.Mutex
+	rejections int
+}
+
+func (m *rateLimitedManager) Allow(ctx context.Context, provider string, region string, model string, interval time.Duration, burst int) (bool, time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.rejections > 0 {
+		m.rejections--
+		return false, interval, nil
+	}
+	return true, 0, nil
+}
+
+func TestQueueWait(t *testing.T) {
+	const interval = 30 * time.Millisecond
+	newProxy := func(t *testing.T, rejections int) *ModelProxy {
+		proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model", MaxRequestsPerMinute: int(time.Minute / interval)}, nil)
+		proxy.stateManager = &rateLimitedManager{Manager: proxy.stateManager, rejections: rejections}
+		return proxy
+	}
+	send := func(handler http.HandlerFunc, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		return recorder
+	}
+	queueMs := func(recorder *httptest.ResponseRecorder) int64 {
+		value, err := strconv.ParseInt(recorder.Header().Get("X-Ogem-Queue-Ms"), 10, 64)
+		assert.NoError(t, err)
+		return value
+	}
+	const chatBody = `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	t.Run("Reports the time spent on the rate limit", func(t *testing.T) {
+		proxy := newProxy(t, 2)
+		core, logs := observer.New(zapcore.InfoLevel)
+		proxy.accessLogger = zap.New(core)
+		handler := proxy.AccessLogMiddleware(http.HandlerFunc(proxy.HandleChatCompletions)).ServeHTTP
+
+		waited := queueMs(send(handler, "/v1/chat/completions", chatBody))
+		assert.GreaterOrEqual(t, waited, 2*interval.Milliseconds())
+		assert.Equal(t, int64(0), queueMs(send(handler, "/v1/chat/completions", chatBody)))
+
+		entries := logs.All()
+		assert.Len(t, entries, 2)
+		assert.Equal(t, waited, entries[0].ContextMap()["queue_ms"])
+		assert.Equal(t, int64(0), entries[1].ContextMap()["queue_ms"])
+		recent := proxy.activity.list("", "", 2)
+		assert.Zero(t, recent[0].QueueMs)
+		assert.Equal(t, waited, recent[1].QueueMs)
+
+		recorder := httptest.NewRecorder()
+		proxy.HandleLimits(recorder, httptest.NewRequest("GET", "/v1/admin/limits", nil))
+		var limits LimitsResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &limits))
+		assert.Len(t, limits.QueueWaits, 1)
+		stats := limits.QueueWaits[0]
+		assert.Equal(t, "fake", stats.Provider)
+		assert.Equal(t, "fake-model", stats.Model)
+		assert.Equal(t, queueWaitEndpoint, stats.Kind)
+		assert.Equal(t, int64(2), stats.Count)
+		assert.Equal(t, waited, stats.TotalMs)
+		assert.Equal(t, QueueWaitBucket{LessOrEqualMs: 10, Count: 0}, stats.Buckets[0])
+		assert.Equal(t, QueueWaitBucket{LessOrEqualMs: 30000, Count: 2}, stats.Buckets[len(stats.Buckets)-1])
+	})
+
+	t.Run("Reports the wait on the streamed legacy completions", func(t *testing.T) {
+		proxy := newProxy(t, 1)
+
+		recorder := send(proxy.HandleCompletions, "/v1/completions", `{"model": "fake-model", "prompt": "Hi", "stream": true}`)
+		assert.Equal(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+		assert.GreaterOrEqual(t, queueMs(recorder), interval.Milliseconds())
+	})
+
+	t.Run("Tells the retries apart", func(t *testing.T) {
+		table := &queueWaitTable{}
+		table.observe("", "fake-model", queueWaitRetry, time.Second)
+		table.observe("fake", "fake-model", queueWaitEndpoint, 20*time.Millisecond)
+		table.observe("fake", "fake-model", queueWaitEndpoint, time.Minute)
+
+		stats := table.snapshot()
+		assert.Len(t, stats, 2)
+		assert.Equal(t, queueWaitRetry, stats[0].Kind)
+		assert.Equal(t, int64(1000), stats[0].TotalMs)
+		assert.Equal(t, int64(2), stats[1].Count)
+		assert.Equal(t, int64(1), stats[1].Buckets[1].Count)
+		// The minute is above the last bucket.
+		assert.Equal(t, int64(1), stats[1].Buckets[len(queueWaitBucketsMs)-1].Count)
+	})
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem"
+)
+
+const (
+	defaultStatusPersistInterval = time.Minute
+	defaultStatusMaxAge          = 10 * time.Minute
+
+	// Shared by all instances, so that a restarted instance starts from what
+	// any of them last saw.
+	regionStatusKey = "region_status"
+)
+
+// Result of the last health check of a region, saved in the state manager.
+// Quota errors are not included since the state manager already keeps the
+// disabled endpoints.
+type savedRegionStatus struct {
+	Provider     string        `json:"provider"`
+	Region       string        `json:"region"`
+	Latency      time.Duration `json:"latency"`
+	LastLatency  time.Duration `json:"last_latency"`
+	Deviation    time.Duration `json:"latency_deviation"`
+	LastChecked  time.Time     `json:"last_checked"`
+	LastError    string        `json:"last_error,omitempty"`
+	Unauthorized bool          `json:"unauthorized,omitempty"`
+}
+
+// Returns the checked regions of the proxy.
+func (s *ModelProxy) regionStatusSnapshot() []savedRegionStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	saved := []savedRegionStatus{}
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, regionStatus ogem.RegionStatus, _ []*ogem.SupportedModel) bool {
+		if regionStatus.LastChecked.IsZero() {
+			return false
+		}
+		saved = append(saved, savedRegionStatus{
+			Provider:     provider,
+			Region:       region,
+			Latency:      regionStatus.Latency,
+			LastLatency:  regionStatus.LastLatency,
+			Deviation:    regionStatus.LatencyDeviation,
+			LastChecked:  regionStatus.LastChecked,
+			LastError:    regionStatus.LastError,
+			Unauthorized: regionStatus.Unauthorized,
+		})
+		return false
+	})
+	return saved
+}
+
+// Saves the status of the checked regions, which expires after the maximum
+// age. Does nothing if no region has been checked yet, so that a new
+// instance does not overwrite what the others saw.
+func (s *ModelProxy) saveRegionStatus(ctx context.Context) error {
+	snapshot := s.regionStatusSnapshot()
+	if len(snapshot) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode region status: %v", err)
+	}
+	return s.stateManager.SaveCache(ctx, regionStatusKey, data, s.statusMaxAge)
+}
+
+// Loads the saved status of the regions that have not been checked by this
+// instance yet. Regions checked before the maximum age, and those no longer
+// configured, are ignored. Returns the number of regions restored.
+func (s *ModelProxy) RestoreRegionStatus(ctx context.Context) (int, error) {
+	if s.statusPersistInterval <= 0 {
+		return 0, nil
+	}
+	data, err := s.stateManager.LoadCache(ctx, regionStatusKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load region status: %v", err)
+	}
+	if data == nil {
+		return 0, nil
+	}
+	var saved []savedRegionStatus
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("failed to decode region status: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	restored := 0
+	for _, status := range saved {
+		if time.Since(status.LastChecked) > s.statusMaxAge {
+			continue
+		}
+		err := s.endpointStatus.Update(status.Provider, status.Region, func(regionStatus *ogem.RegionStatus) error {
+			if !regionStatus.LastChecked.IsZero() {
+				return fmt.Errorf("already checked")
+			}
+			regionStatus.Latency = status.Latency
+			regionStatus.LastLatency = status.LastLatency
+			regionStatus.LatencyDeviation = status.Deviation
+			regionStatus.LastChecked = status.LastChecked
+			regionStatus.LastError = status.LastError
+			regionStatus.Unauthorized = status.Unauthorized
+			return nil
+		})
+		if err == nil {
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// Saves the status of the regions every interval until the context is done.
+// Failures are only logged, since the requests never depend on the saved
+// status.
+func (s *ModelProxy) StartStatusPersistLoop(ctx context.Context) {
+	if s.statusPersistInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.statusPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.saveRegionStatus(ctx); err != nil {
+				s.logger.Warnw("Failed to save region status", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/state"
+)
+
+type failingSaveManager struct {
+	state.Manager
+}
+
+func (m failingSaveManager) SaveCache(ctx context.Context, key string, value []byte, duration time.Duration) error {
+	return errors.New("connection refused")
+}
+
+func TestRegionStatusPersistence(t *testing.T) {
+	regions := []string{"fast", "slow", "down", "unauthorized"}
+	newProxy := func(t *testing.T) *ModelProxy {
+		statuses := map[string]*ogem.RegionStatus{}
+		endpoints := []provider.AiEndpoint{}
+		for _, region := range regions {
+			statuses[region] = &ogem.RegionStatus{Models: []*ogem.SupportedModel{{Name: "chat"}}}
+			endpoints = append(endpoints, &fakeEndpoint{provider: "fake", region: region})
+		}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: statuses}}, endpoints...)
+		proxy.statusPersistInterval = time.Minute
+		proxy.statusMaxAge = 10 * time.Minute
+		return proxy
+	}
+	check := func(proxy *ModelProxy) {
+		proxy.updateEndpointStatus("fake", "fast", 10*time.Millisecond, nil)
+		proxy.updateEndpointStatus("fake", "slow", 50*time.Millisecond, nil)
+		proxy.updateEndpointStatus("fake", "down", 0, errors.New("connection refused"))
+		proxy.updateEndpointStatus("fake", "unauthorized", 0, provider.NewAuthError(errors.New("invalid api key")))
+	}
+	order := func(t *testing.T, proxy *ModelProxy) []string {
+		endpoints, err := proxy.sortedEndpoints("", "", "chat")
+		assert.NoError(t, err)
+		keys := []string{}
+		for _, endpoint := range endpoints {
+			keys = append(keys, endpointKey(endpoint)+":"+endpoint.health.String())
+		}
+		return keys
+	}
+	regionStatus := func(proxy *ModelProxy, region string) *ogem.RegionStatus {
+		return proxy.endpointStatus["fake"].Regions[region]
+	}
+
+	t.Run("Starts a new proxy from the saved status", func(t *testing.T) {
+		previous := newProxy(t)
+		check(previous)
+		assert.NoError(t, previous.saveRegionStatus(context.Background()))
+
+		restarted := newProxy(t)
+		restarted.stateManager = previous.stateManager
+		restored, err := restarted.RestoreRegionStatus(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 4, restored)
+
+		for _, region := range regions {
+			expected, actual := regionStatus(previous, region), regionStatus(restarted, region)
+			assert.Equal(t, expected.Latency, actual.Latency)
+			assert.True(t, expected.LastChecked.Equal(actual.LastChecked))
+			assert.Equal(t, expected.LastError, actual.LastError)
+			assert.Equal(t, expected.Unauthorized, actual.Unauthorized)
+		}
+		// The unhealthy regions come last in random order.
+		for range 10 {
+			expected, actual := order(t, previous), order(t, restarted)
+			assert.Equal(t, []string{"fake/fast:healthy", "fake/slow:healthy"}, actual[:2])
+			assert.Equal(t, expected[:2], actual[:2])
+			assert.ElementsMatch(t, []string{"fake/down:unhealthy", "fake/unauthorized:unhealthy"}, actual[2:])
+		}
+	})
+
+	t.Run("Discards the stale status", func(t *testing.T) {
+		previous := newProxy(t)
+		check(previous)
+		regionStatus(previous, "slow").LastChecked = time.Now().Add(-time.Hour)
+		assert.NoError(t, previous.saveRegionStatus(context.Background()))
+
+		restarted := newProxy(t)
+		restarted.stateManager = previous.stateManager
+		restored, err := restarted.RestoreRegionStatus(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 3, restored)
+		assert.True(t, regionStatus(restarted, "slow").LastChecked.IsZero())
+	})
+
+	t.Run("Keeps the status checked by the proxy itself", func(t *testing.T) {
+		previous := newProxy(t)
+		check(previous)
+		assert.NoError(t, previous.saveRegionStatus(context.Background()))
+
+		restarted := newProxy(t)
+		restarted.stateManager = previous.stateManager
+		restarted.updateEndpointStatus("fake", "fast", time.Second, nil)
+		restored, err := restarted.RestoreRegionStatus(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 3, restored)
+		assert.Equal(t, time.Second, regionStatus(restarted, "fast").Latency)
+	})
+
+	t.Run("Saves nothing before the first check", func(t *testing.T) {
+		proxy := newProxy(t)
+		assert.NoError(t, proxy.saveRegionStatus(context.Background()))
+		data, err := proxy.stateManager.LoadCache(context.Background(), regionStatusKey)
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+	})
+
+	t.Run("Ignores broken status", func(t *testing.T) {
+		proxy := newProxy(t)
+		assert.NoError(t, proxy.stateManager.SaveCache(context.Background(), regionStatusKey, []byte("{"), time.Minute))
+		restored, err := proxy.RestoreRegionStatus(context.Background())
+		assert.Error(t, err)
+		assert.Zero(t, restored)
+		assert.True(t, regionStatus(proxy, "fast").LastChecked.IsZero())
+	})
+
+	t.Run("Reports the failures to save", func(t *testing.T) {
+		proxy := newProxy(t)
+		check(proxy)
+		proxy.stateManager = failingSaveManager{proxy.stateManager}
+		assert.ErrorContains(t, proxy.saveRegionStatus(context.Background()), "connection refused")
+	})
+
+	t.Run("Does nothing if disabled", func(t *testing.T) {
+		previous := newProxy(t)
+		check(previous)
+		assert.NoError(t, previous.saveRegionStatus(context.Background()))
+
+		restarted := newProxy(t)
+		restarted.stateManager = previous.stateManager
+		restarted.statusPersistInterval = 0
+		restored, err := restarted.RestoreRegionStatus(context.Background())
+		assert.NoError(t, err)
+		assert.Zero(t, restored)
+	})
+}
@@ -3,28 +3,40 @@ package server
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goccy/go-json"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2/google"
 
 	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/hooks"
+	"github.com/yanolja/ogem/notify"
 	"github.com/yanolja/ogem/openai"
 	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/provider/bedrock"
 	"github.com/yanolja/ogem/provider/claude"
+	"github.com/yanolja/ogem/provider/cohere"
+	"github.com/yanolja/ogem/provider/fake"
+	"github.com/yanolja/ogem/provider/ollama"
 	openaiProvider "github.com/yanolja/ogem/provider/openai"
 	"github.com/yanolja/ogem/provider/studio"
 	"github.com/yanolja/ogem/provider/vclaude"
 	"github.com/yanolja/ogem/provider/vertex"
+	"github.com/yanolja/ogem/provider/voyage"
 	"github.com/yanolja/ogem/state"
+	"github.com/yanolja/ogem/tokenizer"
+	"github.com/yanolja/ogem/utils"
 	"github.com/yanolja/ogem/utils/array"
 	"github.com/yanolja/ogem/utils/copy"
 	"github.com/yanolja/ogem/utils/env"
@@ -32,7 +44,9 @@ import (
 
 type (
 	BadRequestError     struct{ error }
+	EndUserQuotaError   struct{ error }
 	InternalServerError struct{ error }
+	ModelNotFoundError  struct{ error }
 	RateLimitError      struct{ error }
 	RequestTimeoutError struct{ error }
 	UnavailableError    struct{ error }
@@ -43,9 +57,33 @@ type Config struct {
 	// E.g., localhost:6379
 	ValkeyEndpoint string `yaml:"valkey_endpoint"`
 
+	// Number of consecutive connection errors to Valkey after which it is not
+	// called for valkey_cooldown. Meanwhile, the responses are not cached and
+	// the rate limits are kept in memory. Defaults to 3.
+	ValkeyFailureThreshold int `yaml:"valkey_failure_threshold"`
+
+	// Time to serve without Valkey after it fails. E.g., 30s
+	ValkeyCooldown string `yaml:"valkey_cooldown"`
+
+	// Prefix of every key in Valkey, so that the deployments sharing it, such
+	// as staging and production, keep their cache and rate limits apart.
+	// Defaults to ogem. E.g., prod-eu
+	StateNamespace string `yaml:"state_namespace"`
+
+	// Whether the cached entries missing from state_namespace, such as the
+	// responses and the key revocations, are looked up under the default
+	// namespace. Turn on while moving a deployment to a new namespace so that
+	// they are still found.
+	StateNamespaceFallback bool `yaml:"state_namespace_fallback"`
+
 	// API key to access the Ogem service. The user should provide this key in the Authorization header with the Bearer scheme.
+	// Grants admin access, the same as an entry of ApiKeys with admin set.
 	OgemApiKey string
 
+	// Named API keys to access the Ogem service, accepted in addition to OgemApiKey.
+	// Configure both the old and the new key to rotate a key without downtime.
+	ApiKeys []ApiKey `yaml:"api_keys"`
+
 	// Project ID of the Google Cloud project to use Vertex AI.
 	// E.g., my-project-12345
 	GoogleCloudProject string `yaml:"google_cloud_project"`
@@ -59,19 +97,279 @@ type Config struct {
 	// API key to access the Claude service.
 	ClaudeApiKey string
 
+	// API key to access the OpenRouter service.
+	OpenRouterApiKey string
+
+	// API key to access the Voyage AI embeddings.
+	VoyageApiKey string
+
+	// API key to access the Cohere embeddings.
+	CohereApiKey string
+
+	// Model name -> OpenRouter model ID, for the models of the openrouter
+	// provider. The names not in it are sent as the model ID as is.
+	// E.g., llama-3.1-70b: meta-llama/llama-3.1-70b-instruct
+	OpenRouterModelIds map[string]string `yaml:"openrouter_model_ids"`
+
+	// Model name -> Bedrock model ID, for the models of the bedrock provider.
+	// The names not in it are sent as the model ID as is.
+	// E.g., claude-3-5-sonnet: anthropic.claude-3-5-sonnet-20240620-v1:0
+	BedrockModelIds map[string]string `yaml:"bedrock_model_ids"`
+
+	// ARN of the IAM role to assume for Bedrock with the AWS credentials of
+	// the environment. Empty to use the credentials as they are.
+	// E.g., arn:aws:iam::123456789012:role/ogem-bedrock
+	BedrockRoleArn string `yaml:"bedrock_role_arn"`
+
 	// Interval to retry when no available endpoints are found. E.g., 10m
 	RetryInterval string `yaml:"retry_interval"`
 
 	// Interval to update the status of the providers. E.g., 1h30m
 	PingInterval string `yaml:"ping_interval"`
 
+	// Whether to also generate a one-token completion with a model of every
+	// region on every deepHealthCheckRounds-th ping. The regular ping only
+	// checks that the provider is reachable and accepts the credentials.
+	DeepHealthCheck bool `yaml:"deep_health_check"`
+
+	// Number of the endpoints to ping at once. Defaults to 16.
+	PingConcurrency int `yaml:"ping_concurrency"`
+
+	// Interval to save the results of the health checks in the state
+	// manager, from which the restarted instances start. Zero to disable.
+	// Defaults to 1m.
+	StatusPersistInterval string `yaml:"status_persist_interval"`
+
+	// Maximum age of the saved results of the health checks to start from.
+	// Defaults to 10m.
+	StatusMaxAge string `yaml:"status_max_age"`
+
+	// Maximum duration to disable an endpoint after consecutive quota errors,
+	// which also caps the retry hints of the providers. E.g., 1h
+	// Defaults to 1h, also when set to 0.
+	MaxDisableDuration string `yaml:"max_disable_duration"`
+
 	// Port to listen for incoming requests.
 	Port int `yaml:"port"`
 
+	// Whether to rewrite the model field of responses to the model requested by
+	// the caller instead of the concrete model that served it. The served model
+	// is always reported in the X-Ogem-Resolved-Model header. Defaults to true.
+	EchoRequestedModel *bool `yaml:"echo_requested_model"`
+
+	// How Claude models receive the system messages after the start of the
+	// conversation, since they only accept a system prompt before it. One of
+	// inline (default) to send them as user messages in a <system> tag, merge
+	// to append them to the system prompt, or error to reject the request.
+	ClaudeMidSystemMessages string `yaml:"claude_mid_system_messages"`
+
+	// Whether to emulate n greater than 1 for the models that cannot generate
+	// multiple choices, such as Claude, by sending n requests in parallel.
+	// Multiplies the cost of those requests by n. If false, such requests are
+	// only routed to the models that support n.
+	EmulateMultipleChoices bool `yaml:"emulate_n"`
+
+	// Whether to reject the requests whose max_tokens exceeds the maximum
+	// output tokens of every endpoint of the model. If false, max_tokens is
+	// lowered to the maximum of the endpoint that serves the request. The
+	// X-Ogem-Max-Tokens header of a request overrides it.
+	StrictMaxTokens bool `yaml:"strict_max_tokens"`
+
+	// Time to wait for an endpoint before sending the same request to the next
+	// endpoint as well, returning whichever responds first. Only the requests
+	// with temperature 0 or an Idempotency-Key header are hedged, and never
+	// the streaming ones. Empty to disable. E.g., 2s
+	HedgeAfter string `yaml:"hedge_after"`
+
+	// Maximum number of backup requests sent for a request. Defaults to 1.
+	MaxHedges int `yaml:"max_hedges"`
+
+	// Whether the usage of the hedged requests that complete after the winner
+	// is added to the end user usage of the request, as their providers bill
+	// them too. Otherwise, it is only logged.
+	ChargeHedgeLosers bool `yaml:"charge_hedge_losers"`
+
+	// Number of recently completed requests kept in memory for the admin
+	// activity endpoints. Defaults to 1000.
+	ActivityBufferSize int `yaml:"activity_buffer_size"`
+
+	// Whether to route the requests of a session to the endpoint that served
+	// its previous request. The session is identified by the X-Ogem-Session
+	// header or the user field of the request.
+	SessionAffinity bool `yaml:"session_affinity"`
+
+	// Time after the last request of a session to forget its endpoint. E.g., 10m
+	AffinityTtl string `yaml:"affinity_ttl"`
+
+	// Time to keep the response of a request with an Idempotency-Key header
+	// for its retries. E.g., 24h
+	IdempotencyTtl string `yaml:"idempotency_ttl"`
+
+	// Compression of the responses.
+	Compression CompressionConfig `yaml:"compression"`
+
+	// Client addresses allowed to call the proxy.
+	IpFilter IpFilterConfig `yaml:"ip_filter"`
+
+	// Webhooks to notify about endpoint outages.
+	Notifications notify.Config `yaml:"notifications"`
+
+	// Mirroring of a sample of the requests to a candidate model.
+	Shadow ShadowConfig `yaml:"shadow"`
+
+	// Models retired by their providers, with the models that replace them.
+	Deprecations []Deprecation `yaml:"deprecations"`
+
+	// Aliases whose requests are split between models by weight, for gradual
+	// rollouts.
+	TrafficSplits []TrafficSplit `yaml:"traffic_splits"`
+
+	// Chat completion requests run in the background.
+	Async AsyncConfig `yaml:"async"`
+
+	// Conversations whose history is kept by the proxy.
+	Conversations ConversationsConfig `yaml:"conversations"`
+
+	// Response cache in memory, in front of the one of the state manager.
+	LocalCache LocalCacheConfig `yaml:"local_cache"`
+
+	// Hooks that transform the requests and the responses, in order.
+	Hooks []hooks.Config `yaml:"hooks"`
+
+	// Daily limits of the usage of each end user, identified by the user
+	// field of the requests.
+	EndUserLimits EndUserLimitsConfig `yaml:"end_user_limits"`
+
+	// Labels read from the requests for the request activity.
+	Labels LabelsConfig `yaml:"labels"`
+
+	// Rejection of the requests beyond what the instance can serve.
+	LoadShedding LoadSheddingConfig `yaml:"load_shedding"`
+
+	// Smoothing of the ping latencies by which the regions are ordered.
+	LatencySmoothing LatencySmoothingConfig `yaml:"latency_smoothing"`
+
+	// Capture of the conversations of the flagged API keys.
+	Transcripts TranscriptsConfig `yaml:"transcripts"`
+
+	// Line for each request to the API, apart from the logs of the proxy.
+	AccessLog AccessLogConfig `yaml:"access_log"`
+
+	// Checks of the endpoints on startup, before the proxy reports ready.
+	Warmup WarmupConfig `yaml:"warmup"`
+
 	// Configuration for each provider.
 	Providers ogem.ProvidersStatus `yaml:"providers"`
+
+	// Whether to reject unknown keys in the config file instead of ignoring
+	// them.
+	StrictConfig bool `yaml:"strict_config"`
+
+	// Whether to log at debug level, including the requests sent to the
+	// providers. Long message contents and credentials are redacted.
+	Debug bool `yaml:"debug"`
+}
+
+const (
+	// Duration to disable an endpoint for on the first quota error without a
+	// retry hint. Doubles on every consecutive error.
+	initialDisableDuration = time.Minute
+
+	defaultMaxDisableDuration = time.Hour
+
+	defaultAffinityTtl = 10 * time.Minute
+
+	// Number of pings per deep health check, which costs a completion.
+	deepHealthCheckRounds = 6
+
+	// Maximum time that a request holds the lock of its cache key, and that
+	// the identical requests wait for it to cache the response.
+	cacheLockDuration = 30 * time.Second
+
+	// Interval at which the waiting requests check the cache.
+	cacheLockPollInterval = 50 * time.Millisecond
+
+	// Number of times an endpoint is retried for a request after failing
+	// temporarily, such as with 503, before it is given up on.
+	maxTransientRetries = 1
+)
+
+// Order of the endpoints by the result of the last health check.
+type endpointHealth int
+
+const (
+	endpointHealthy endpointHealth = iota
+	endpointUnchecked
+	endpointUnhealthy
+)
+
+func (h endpointHealth) String() string {
+	switch h {
+	case endpointHealthy:
+		return "healthy"
+	case endpointUnchecked:
+		return "unchecked"
+	default:
+		return "unhealthy"
+	}
+}
+
+type ApiKey struct {
+	// Name of the key owner, recorded in the logs. E.g., search-team
+	Name string `yaml:"name"`
+
+	// Secret that the owner sends in the Authorization header.
+	Key string `yaml:"key"`
+
+	// Whether the key can access the admin endpoints.
+	Admin bool `yaml:"admin"`
+
+	// Whether to reject the requests of this key that restrict the providers
+	// with the X-Ogem-Only-Providers or X-Ogem-Exclude-Providers headers, so
+	// that untrusted callers cannot steer away from the cheap providers.
+	ForbidProviderFilter bool `yaml:"forbid_provider_filter"`
+
+	// Addresses or CIDRs of the clients that can use this key, in addition to
+	// the global ip_filter. Empty to allow every client. E.g., ["10.1.0.0/16"]
+	AllowedCidrs []string `yaml:"allowed_cidrs"`
+
+	// Time from which the key is rejected, in RFC 3339. Empty if it never
+	// expires. E.g., 2025-12-31T23:59:59Z
+	ExpiresAt string `yaml:"expires_at"`
+
+	// Whether the key can ask for the routing trace with the
+	// X-Ogem-Debug-Routing header. Admin keys always can.
+	DebugRouting bool `yaml:"debug_routing"`
+
+	// Secret to sign the callbacks of the async jobs of this key with
+	// HMAC-SHA256. Jobs with a callback URL are rejected without it.
+	CallbackSecret string `yaml:"callback_secret"`
+
+	// Default tool validation mode of the requests of this key, either
+	// annotate or repair. Empty to validate only the requests that ask for it
+	// with the X-Ogem-Validate-Tools header.
+	ValidateTools string `yaml:"validate_tools"`
+
+	// Priority of the requests of this key under load, either high or
+	// normal. The requests of high priority keys are shed last. Defaults to
+	// normal.
+	Priority string `yaml:"priority"`
+
+	// API keys of the providers to send the requests of this key with instead
+	// of those of the proxy, so that they are billed to the account of the
+	// key owner, by provider name. Only the openai, claude and openrouter
+	// providers and the custom endpoints support it. ${NAME} is replaced with
+	// the environment variable NAME. E.g., {openai: "${SEARCH_OPENAI_KEY}"}
+	ProviderKeys map[string]string `yaml:"provider_keys"`
+
+	// Time until which the messages and the responses of the requests of this
+	// key are stored for review, in RFC 3339. Empty to not capture them
+	// unless set through the admin endpoint. E.g., 2025-07-01T00:00:00Z
+	CaptureTranscriptsUntil string `yaml:"capture_transcripts_until"`
 }
 
+type apiKeyContextKey struct{}
+
 type endpointStatus struct {
 	// Endpoint to use for generating completions.
 	endpoint provider.AiEndpoint
@@ -79,6 +377,24 @@ type endpointStatus struct {
 	// Latency of the endpoint.
 	latency time.Duration
 
+	// Result of the last health check.
+	health endpointHealth
+
+	// Weight and priority of the region.
+	weight   float64
+	priority int
+
+	// Whether the endpoints of the priority are ordered by weight rather
+	// than latency.
+	weighted bool
+
+	// Factor by which the endpoint is ranked lower for missing the latency
+	// objective of its model. 1 if it meets it.
+	sloPenalty float64
+
+	// Maximum number of requests in flight to the region. Zero if unlimited.
+	maxConcurrentRequests int
+
 	// Model status (latency and rate limiting information) of the endpoint.
 	modelStatus *ogem.SupportedModel
 }
@@ -102,51 +418,232 @@ type ModelProxy struct {
 	// Interval to retry when no available endpoints are found.
 	retryInterval time.Duration
 
-	// Interval to update the status of the providers.
-	pingInterval time.Duration
+	// Health checks of the endpoints on the ping interval.
+	pings pingLoop
+
+	// Interval to save the status of the regions, and the maximum age of the
+	// saved status to start from.
+	statusPersistInterval time.Duration
+	statusMaxAge          time.Duration
+
+	// Maximum duration of the exponential backoff after quota errors.
+	maxDisableDuration time.Duration
+
+	// Time after the last request of a session to forget its endpoint.
+	affinityTtl time.Duration
+
+	// Time to keep the responses of the requests with an Idempotency-Key.
+	idempotencyTtl time.Duration
+
+	// Time to wait for an endpoint before hedging the request. Zero if
+	// disabled.
+	hedgeAfter time.Duration
+
+	// Maximum number of backup requests of a hedged request.
+	maxHedges int
+
+	// Requests in flight to each endpoint, for the concurrency limits of the
+	// regions.
+	inFlight inFlightRequests
+
+	// Latencies of the models with a latency objective in each region.
+	slo sloTracker
+
+	// Time that the requests slept in the failover loop, by model.
+	queueWaits queueWaitTable
+
+	// Responses served from the cache and the idempotency store, by API key.
+	cacheSavings cacheSavingsTable
+
+	// In-flight and recently completed requests.
+	activity *activityTracker
+
+	// Client addresses allowed to call the proxy.
+	ipFilter ipFilter
+
+	// Mirror of the requests to the shadow model. Nil if disabled.
+	shadow *shadowMirror
+
+	// Deprecated models and the requests for them. Nil if none is configured.
+	deprecations *deprecationTable
+
+	// Split aliases and the requests served by their arms. Nil if none is
+	// configured.
+	trafficSplits *trafficSplitTable
+
+	// Workers of the async jobs. Nil if disabled.
+	async *asyncQueue
+
+	// Limits of the conversations kept by the proxy. Nil if disabled.
+	conversations *conversationStore
+
+	// Response cache in memory, in front of the state manager. Nil if
+	// disabled.
+	localCache *localCache
+
+	// Lookups of the response cache that reached the state manager.
+	stateCacheHits   atomic.Int64
+	stateCacheMisses atomic.Int64
+
+	// Daily limits of the end users. Nil if disabled.
+	endUsers *endUserLimiter
+
+	// Rejection of the requests under load. Nil if disabled.
+	loadShedder *loadShedder
+
+	// Transcripts of the flagged API keys.
+	transcripts *transcriptStore
+
+	// Logger of the access log. Nil if disabled.
+	accessLogger *zap.Logger
+
+	// Maximum duration of the warm-up, and whether it is still running.
+	warmupTimeout time.Duration
+	warming       atomic.Bool
+
+	// Key (provider:region:model) -> duration to disable the endpoint for on
+	// the next quota error without a retry hint. Reset on success.
+	disableBackoff      map[string]time.Duration
+	disableBackoffMutex sync.Mutex
+
+	// API keys by the SHA-256 hash of their secrets. Empty if authentication
+	// is disabled.
+	apiKeyIndex map[[sha256.Size]byte]ApiKey
+
+	// Revocation keys of the API keys revoked on this instance.
+	revokedKeys      map[string]bool
+	revokedKeysMutex sync.Mutex
 
 	// Configuration for the proxy server.
 	config Config
 
+	// Dispatcher of the outage notifications. Nil if not configured.
+	notifier *notify.Dispatcher
+
+	// Hooks run on each chat completion request and its response.
+	hooks *hooks.Chain
+
+	// Random source to shuffle the endpoints of equal latency. Not safe for
+	// concurrent use, so guarded by randomMutex.
+	random      *rand.Rand
+	randomMutex sync.Mutex
+
 	// Logger for the proxy server.
 	logger *zap.SugaredLogger
 }
 
-func newEndpoint(provider string, region string, config *Config) (provider.AiEndpoint, error) {
+// Project and credentials of the Google Cloud endpoints of a provider.
+type googleAuth struct {
+	project     string
+	credentials *google.Credentials
+}
+
+// Returns the project and the credentials of the provider for Vertex AI. The
+// project of the provider comes first, then the one of its credentials file,
+// and then the global one.
+func newGoogleAuth(providerData ogem.ProviderStatus, config *Config) (*googleAuth, error) {
+	credentials, err := provider.GoogleCredentials(context.Background(), providerData.CredentialsFile, providerData.ImpersonateServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	project := providerData.GoogleCloudProject
+	if project == "" {
+		project = credentials.ProjectID
+	}
+	if project == "" {
+		project = config.GoogleCloudProject
+	}
+	if project == "" {
+		return nil, fmt.Errorf("google_cloud_project is required")
+	}
+	return &googleAuth{project: project, credentials: credentials}, nil
+}
+
+func newEndpoint(provider string, region string, config *Config, auth func() (*googleAuth, error), logger *zap.SugaredLogger) (provider.AiEndpoint, error) {
 	switch provider {
 	case "claude":
 		if region != "claude" {
 			return nil, fmt.Errorf("region is not supported for claude provider")
 		}
-		return claude.NewEndpoint(config.ClaudeApiKey)
+		return claude.NewEndpoint(config.ClaudeApiKey, config.ClaudeMidSystemMessages, logger)
 	case "vclaude":
-		return vclaude.NewEndpoint(config.GoogleCloudProject, region)
+		auth, err := auth()
+		if err != nil {
+			return nil, err
+		}
+		return vclaude.NewEndpoint(auth.project, region, auth.credentials, config.ClaudeMidSystemMessages, logger)
+	case "bedrock":
+		return bedrock.NewEndpoint(region, config.BedrockModelIds, config.BedrockRoleArn, logger)
 	case "vertex":
-		return vertex.NewEndpoint(config.GoogleCloudProject, region)
+		auth, err := auth()
+		if err != nil {
+			return nil, err
+		}
+		return vertex.NewEndpoint(auth.project, region, auth.credentials, logger)
 	case "studio":
 		if region != "studio" {
 			return nil, fmt.Errorf("region is not supported for studio provider")
 		}
-		return studio.NewEndpoint(config.GenaiStudioApiKey)
+		return studio.NewEndpoint(config.GenaiStudioApiKey, logger)
 	case "openai":
 		if region != "openai" {
 			return nil, fmt.Errorf("region is not supported for openai provider")
 		}
-		return openaiProvider.NewEndpoint("openai", "openai", "https://api.openai.com/v1", config.OpenAiApiKey)
+		return openaiProvider.NewEndpoint("openai", "openai", "https://api.openai.com/v1", config.OpenAiApiKey, logger)
+	case "voyage":
+		if region != "voyage" {
+			return nil, fmt.Errorf("region is not supported for voyage provider")
+		}
+		return voyage.NewEndpoint("https://api.voyageai.com/v1", config.VoyageApiKey, logger)
+	case "cohere":
+		if region != "cohere" {
+			return nil, fmt.Errorf("region is not supported for cohere provider")
+		}
+		return cohere.NewEndpoint("https://api.cohere.com", config.CohereApiKey, logger)
+	case "openrouter":
+		if region != "openrouter" {
+			return nil, fmt.Errorf("region is not supported for openrouter provider")
+		}
+		return openaiProvider.NewEndpoint(
+			"openrouter",
+			"openrouter",
+			"https://openrouter.ai/api/v1",
+			config.OpenRouterApiKey,
+			logger,
+			openaiProvider.WithSystemRoleOnly(),
+			openaiProvider.WithOpenRouter(config.OpenRouterModelIds),
+		)
 	default:
 		return nil, fmt.Errorf("unsupported provider: %s", provider)
 	}
 }
 
-func newCustomEndpoint(providerName string, protocol string, baseUrl string, apiKeyEnv string, region string) (provider.AiEndpoint, error) {
-	switch protocol {
+func newCustomEndpoint(providerName string, providerData ogem.ProviderStatus, region string, logger *zap.SugaredLogger) (provider.AiEndpoint, error) {
+	switch providerData.Protocol {
 	case "openai":
 		if region != providerName {
 			return nil, fmt.Errorf("region is not supported for custom openai provider; region field must match provider name")
 		}
-		return openaiProvider.NewEndpoint(providerName, region, baseUrl, env.RequiredStringVariable(apiKeyEnv))
+		extraHeaders, err := env.InterpolateMap(providerData.ExtraHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra header: %v", err)
+		}
+		extraQuery, err := env.InterpolateMap(providerData.ExtraQuery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra query: %v", err)
+		}
+		return openaiProvider.NewEndpoint(
+			providerName,
+			region,
+			providerData.BaseUrl,
+			env.RequiredStringVariable(providerData.ApiKeyEnv),
+			logger,
+			openaiProvider.WithExtraHeaders(extraHeaders),
+			openaiProvider.WithExtraQuery(extraQuery),
+			openaiProvider.WithSystemRoleOnly(),
+		)
 	default:
-		return nil, fmt.Errorf("unsupported protocol: %s, only openai is supported", protocol)
+		return nil, fmt.Errorf("unsupported protocol: %s, only openai is supported", providerData.Protocol)
 	}
 }
 
@@ -161,31 +658,116 @@ func NewProxyServer(stateManager state.Manager, cleanup func(), config Config, l
 		return nil, fmt.Errorf("invalid ping interval: %v", err)
 	}
 
+	maxDisableDuration := defaultMaxDisableDuration
+	if config.MaxDisableDuration != "" {
+		maxDisableDuration, err = time.ParseDuration(config.MaxDisableDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max disable duration: %v", err)
+		}
+		// Without a cap, the backoff would keep doubling until it overflows.
+		if maxDisableDuration == 0 {
+			maxDisableDuration = defaultMaxDisableDuration
+		}
+	}
+
+	affinityTtl := defaultAffinityTtl
+	if config.AffinityTtl != "" {
+		affinityTtl, err = time.ParseDuration(config.AffinityTtl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid affinity ttl: %v", err)
+		}
+	}
+
+	idempotencyTtl := defaultIdempotencyTtl
+	if config.IdempotencyTtl != "" {
+		idempotencyTtl, err = time.ParseDuration(config.IdempotencyTtl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idempotency ttl: %v", err)
+		}
+	}
+
+	var hedgeAfter time.Duration
+	if config.HedgeAfter != "" {
+		hedgeAfter, err = time.ParseDuration(config.HedgeAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hedge after: %v", err)
+		}
+	}
+	maxHedges := defaultMaxHedges
+	if config.MaxHedges > 0 {
+		maxHedges = config.MaxHedges
+	}
+
+	statusPersistInterval := defaultStatusPersistInterval
+	if config.StatusPersistInterval != "" {
+		statusPersistInterval, err = time.ParseDuration(config.StatusPersistInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status persist interval: %v", err)
+		}
+	}
+	statusMaxAge := defaultStatusMaxAge
+	if config.StatusMaxAge != "" {
+		statusMaxAge, err = time.ParseDuration(config.StatusMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status max age: %v", err)
+		}
+	}
+
+	warmupTimeout := defaultWarmupTimeout
+	if config.Warmup.Timeout != "" {
+		warmupTimeout, err = time.ParseDuration(config.Warmup.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid warm-up timeout: %v", err)
+		}
+	}
+
+	ipFilter, err := newIpFilter(config.IpFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	deprecations, err := newDeprecationTable(config.Deprecations)
+	if err != nil {
+		return nil, err
+	}
+
 	endpointStatus, err := copy.Deep(config.Providers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to deep copy provider status: %v", err)
 	}
 
+	// The regions of a provider share its credentials, and so their tokens.
+	googleAuths := map[string]*googleAuth{}
 	endpoints := []provider.AiEndpoint{}
 	endpointStatus.ForEach(func(
 		providerName string,
 		providerData ogem.ProviderStatus,
 		region string,
-		_ ogem.RegionStatus,
+		regionStatus ogem.RegionStatus,
 		models []*ogem.SupportedModel,
 	) bool {
 		var endpoint provider.AiEndpoint
 		var err error
-		if providerData.BaseUrl == "" {
-			endpoint, err = newEndpoint(providerName, region, &config)
+		endpointLogger := logger.With("provider", providerName, "region", region)
+		if providerName == "fake" {
+			endpoint, err = fake.NewEndpoint(region, regionStatus.Fake, endpointLogger)
+		} else if providerName == "ollama" {
+			endpoint, err = ollama.NewEndpoint(region, regionStatus.Ollama, endpointLogger)
+		} else if providerData.BaseUrl == "" {
+			auth := func() (*googleAuth, error) {
+				if auth, found := googleAuths[providerName]; found {
+					return auth, nil
+				}
+				auth, err := newGoogleAuth(providerData, &config)
+				if err != nil {
+					return nil, err
+				}
+				googleAuths[providerName] = auth
+				return auth, nil
+			}
+			endpoint, err = newEndpoint(providerName, region, &config, auth, endpointLogger)
 		} else {
-			endpoint, err = newCustomEndpoint(
-				providerName,
-				providerData.Protocol,
-				providerData.BaseUrl,
-				providerData.ApiKeyEnv,
-				region,
-			)
+			endpoint, err = newCustomEndpoint(providerName, providerData, region, endpointLogger)
 		}
 		if err != nil {
 			logger.Warnw("Failed to create endpoint", "provider", providerName, "region", region, "error", err)
@@ -195,117 +777,450 @@ func NewProxyServer(stateManager state.Manager, cleanup func(), config Config, l
 		return false
 	})
 
-	return &ModelProxy{
+	notifier, err := notify.NewDispatcher(config.Notifications, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notifier: %v", err)
+	}
+
+	hookChain, err := hooks.NewChain(config.Hooks, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hooks: %v", err)
+	}
+
+	transcripts, err := newTranscriptStore(config.Transcripts)
+	if err != nil {
+		return nil, err
+	}
+
+	accessLogger, err := newAccessLogger(config.AccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access logger: %v", err)
+	}
+
+	proxy := &ModelProxy{
 		endpoints:      endpoints,
 		endpointStatus: endpointStatus,
 		stateManager:   stateManager,
 		cleanup:        cleanup,
 		retryInterval:  retryInterval,
-		pingInterval:   pingInterval,
 		config:         config,
+		notifier:       notifier,
+		hooks:          hookChain,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
 		logger:         logger,
-	}, nil
+
+		maxDisableDuration: maxDisableDuration,
+		disableBackoff:     make(map[string]time.Duration),
+		revokedKeys:        make(map[string]bool),
+		affinityTtl:        affinityTtl,
+		idempotencyTtl:     idempotencyTtl,
+		hedgeAfter:         hedgeAfter,
+		maxHedges:          maxHedges,
+		activity:           newActivityTracker(config.ActivityBufferSize),
+		ipFilter:           ipFilter,
+		shadow:             newShadowMirror(config.Shadow),
+		deprecations:       deprecations,
+		trafficSplits:      newTrafficSplitTable(config.TrafficSplits),
+		async:              newAsyncQueue(config.Async),
+		conversations:      newConversationStore(config.Conversations),
+		localCache:         newLocalCache(config.LocalCache),
+		endUsers:           newEndUserLimiter(config.EndUserLimits),
+		loadShedder:        newLoadShedder(config.LoadShedding),
+		transcripts:        transcripts,
+		accessLogger:       accessLogger,
+		warmupTimeout:      warmupTimeout,
+
+		statusPersistInterval: statusPersistInterval,
+		statusMaxAge:          statusMaxAge,
+	}
+	proxy.pings.interval = pingInterval
+	proxy.warming.Store(config.Warmup.Enabled)
+	proxy.indexApiKeys()
+	if proxy.async != nil {
+		proxy.async.start(proxy.runAsyncJob)
+	}
+	return proxy, nil
 }
 
 func (s *ModelProxy) HandleChatCompletions(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	if wantsAsync(httpRequest) {
+		s.HandleAsyncChatCompletions(httpResponse, httpRequest)
+		return
+	}
 	defer httpRequest.Body.Close()
 
 	bodyBytes, err := io.ReadAll(httpRequest.Body)
 	if err != nil {
 		s.logger.Warnw("Failed to read request body", "error", err)
-		http.Error(httpResponse, "Invalid request body", http.StatusBadRequest)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+
+	httpResponse, storeResponse, proceed := s.handleIdempotencyKey(httpResponse, httpRequest, bodyBytes)
+	if !proceed {
 		return
 	}
+	defer storeResponse()
 
 	var openAiRequest openai.ChatCompletionRequest
 	if err := json.Unmarshal(bodyBytes, &openAiRequest); err != nil {
 		s.logger.Warnw("Invalid request body", "error", err, "body", string(bodyBytes))
-		http.Error(httpResponse, "Invalid request body", http.StatusBadRequest)
+		writeBodyError(httpResponse, err)
+		return
+	}
+
+	hookContext := hooks.WithKeyName(httpRequest.Context(), apiKeyName(httpRequest.Context()))
+	if err := s.hooks.PreRequest(hookContext, &openAiRequest); err != nil {
+		s.logger.Warnw("Request rejected by a hook", "error", err, "api_key", apiKeyName(httpRequest.Context()))
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+	// After the hooks, which may add messages of their own.
+	if err := openai.ValidateMessages(openAiRequest.Messages); err != nil {
+		s.logger.Warnw("Invalid messages", "error", err, "api_key", apiKeyName(httpRequest.Context()))
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "invalid_messages", fmt.Sprintf("Invalid messages: %v", err))
 		return
 	}
 
 	models := strings.Split(openAiRequest.Model, ",")
-	s.logger.Infow("Received chat completions request", "models", models)
+	labels := parseLabels(s.config.Labels, httpRequest, bodyBytes)
+	s.logger.Infow("Received chat completions request", "models", models, "api_key", apiKeyName(httpRequest.Context()), "client_ip", clientIpFrom(httpRequest.Context()), "labels", labels)
+
+	fields, err := parseExtensionFields(bodyBytes)
+	if err != nil {
+		s.logger.Warnw("Invalid extension fields", "error", err)
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+
+	filter := parseProviderFilter(httpRequest, fields)
+	if apiKey, found := apiKeyFrom(httpRequest.Context()); found && apiKey.ForbidProviderFilter && !filter.empty() {
+		writeAuthError(httpResponse, http.StatusForbidden, "provider_filter_forbidden", "API key is not allowed to restrict the providers")
+		return
+	}
+
+	var trace *RoutingTrace
+	if wantsRoutingTrace(httpRequest) {
+		if !canTraceRouting(httpRequest.Context()) {
+			writeAuthError(httpResponse, http.StatusForbidden, "debug_routing_forbidden", "API key is not allowed to see the routing trace")
+			return
+		}
+		trace = &RoutingTrace{Models: []*ModelTrace{}}
+	}
+
+	truncation, err := parseTruncation(httpRequest, fields)
+	if err != nil {
+		s.logger.Warnw("Invalid truncation mode", "error", err)
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+
+	transforms, err := parsePostprocess(httpRequest, fields)
+	if err != nil {
+		s.logger.Warnw("Invalid postprocess transforms", "error", err)
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+
+	toolValidation, err := parseToolValidation(httpRequest, fields)
+	if err != nil {
+		s.logger.Warnw("Invalid tool validation mode", "error", err)
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+
+	strictMaxTokens, err := parseStrictMaxTokens(httpRequest, s.config.StrictMaxTokens)
+	if err != nil {
+		s.logger.Warnw("Invalid max tokens mode", "error", err)
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+
+	ctx := withSession(httpRequest.Context(), sessionKey(httpRequest, openAiRequest.User))
+	ctx = withProviderFilter(ctx, filter)
+	ctx = withTruncation(ctx, truncation)
+	ctx = withPostprocess(ctx, transforms)
+	ctx = withToolValidation(ctx, toolValidation)
+	ctx = withIdempotent(ctx, isIdempotent(httpRequest))
+	ctx = withRoutingTrace(ctx, trace)
+	ctx = withLabels(ctx, labels)
+	wait := &queueWait{}
+	ctx = withQueueWait(ctx, wait)
+	saving := &cacheSaving{}
+	ctx = withCacheSaving(ctx, saving)
+	tokens := &maxTokens{strict: strictMaxTokens}
+	ctx = withMaxTokens(ctx, tokens)
+	if name := parseGeminiCache(httpRequest, fields); name != "" {
+		ctx = withGeminiCache(ctx, s.lookUpGeminiCache(ctx, name))
+	}
+
+	start := time.Now()
+	activityId := s.activity.start(apiKeyName(ctx), clientIpFrom(ctx), openAiRequest.Model, labels)
+	httpResponse.Header().Set("X-Ogem-Request-Id", activityId)
 
 	var openAiResponse *openai.ChatCompletionResponse
+	var requestedModel string
+	var resolvedModel string
 	var lastError error
 	lastIndex := len(models) - 1
+	var servingModel string
+	// Arm of the split alias that was tried last, which is the one that
+	// served the request if any did.
+	var trafficArm *trafficArm
 	for index, model := range models {
 		openAiRequest.Model = strings.TrimSpace(model)
-		openAiResponse, err = s.generateChatCompletion(httpRequest.Context(), &openAiRequest, index == lastIndex)
+		trafficArm = s.applyTrafficSplit(ctx, httpResponse, &openAiRequest)
+		if trafficArm != nil {
+			s.activity.annotate(activityId, func(activity *RequestActivity) {
+				activity.TrafficArm = openAiRequest.Model
+			})
+		}
+		if err := s.applyDeprecation(ctx, httpResponse, &openAiRequest); err != nil {
+			s.logger.Warnw("Rejected deprecated model", "error", err, "model", model)
+			lastError = err
+			continue
+		}
+		openAiResponse, resolvedModel, err = s.generateChatCompletion(ctx, &openAiRequest, index == lastIndex)
 		if err != nil {
 			s.logger.Warnw("Failed to get chat completions", "error", err, "model", model)
 			lastError = err
 			continue
 		}
+		// Echoes the model as requested even if it was redirected, so that
+		// the callers of a retired model see no difference.
+		requestedModel = strings.TrimSpace(model)
+		servingModel = openAiRequest.Model
 
-		if len(openAiResponse.Choices) > 0 && openAiResponse.Choices[0].FinishReason == "stop" {
+		if allChoicesStopped(openAiResponse) {
 			break
 		}
 	}
 
+	s.activity.annotate(activityId, func(activity *RequestActivity) {
+		activity.QueueMs = wait.milliseconds()
+		activity.CacheHit, activity.CostSaved = saving.result()
+	})
+	activity := s.finishActivity(activityId, resolvedModel, openAiResponse, lastError)
+	accessRecordFrom(ctx).setActivity(activity)
+	writeQueueWait(httpResponse, wait)
+	writeClampedMaxTokens(httpResponse, tokens)
+	if trafficArm != nil {
+		s.trafficSplits.record(trafficArm, activity)
+	}
+	if err := writeRoutingTrace(httpResponse, trace); err != nil {
+		s.logger.Warnw("Failed to write routing trace", "error", err)
+	}
 	if openAiResponse == nil {
 		handleError(httpResponse, lastError)
 		return
 	}
+	s.hooks.PostResponse(hookContext, &openAiRequest, openAiResponse)
+
+	if resolvedModel != "" {
+		httpResponse.Header().Set("X-Ogem-Resolved-Model", resolvedModelHeader(resolvedModel, openAiResponse))
+	} else if cachedModel := saving.servedModel(); cachedModel != "" {
+		httpResponse.Header().Set("X-Ogem-Resolved-Model", resolvedModelHeader(cachedModel, openAiResponse))
+	}
+	if len(truncation.dropped) > 0 {
+		httpResponse.Header().Set("X-Ogem-Truncated-Messages", truncation.String())
+	}
+	if openAiResponse.Usage.Estimated {
+		httpResponse.Header().Set("X-Ogem-Usage-Estimated", "true")
+	}
+	writeGeminiCacheStatus(httpResponse, geminiCacheFrom(ctx), openAiResponse)
+	if s.config.EchoRequestedModel == nil || *s.config.EchoRequestedModel {
+		responseCopy := *openAiResponse
+		responseCopy.Model = requestedModel
+		openAiResponse = &responseCopy
+	}
 
+	latency := time.Since(start)
 	httpResponse.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(httpResponse).Encode(openAiResponse); err != nil {
 		s.logger.Errorw("Failed to encode response", "error", err)
-		http.Error(httpResponse, "Internal server error", http.StatusInternalServerError)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+	s.captureTranscript(ctx, activityId, &openAiRequest, openAiResponse)
+
+	shadowRequest := openAiRequest
+	shadowRequest.Model = servingModel
+	s.mirrorToShadow(ctx, shadowRequest, openAiResponse, latency)
+}
+
+func (s *ModelProxy) HandleTokenCount(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+
+	bodyBytes, err := io.ReadAll(httpRequest.Body)
+	if err != nil {
+		s.logger.Warnw("Failed to read request body", "error", err)
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+
+	var openAiRequest openai.ChatCompletionRequest
+	if err := json.Unmarshal(bodyBytes, &openAiRequest); err != nil {
+		s.logger.Warnw("Invalid request body", "error", err, "body", string(bodyBytes))
+		writeBodyError(httpResponse, err)
+		return
+	}
+
+	// Counts with the first model of the fallback chain since it is the one
+	// that is tried first.
+	openAiRequest.Model = strings.TrimSpace(strings.Split(openAiRequest.Model, ",")[0])
+	countResponse, err := s.countTokens(httpRequest.Context(), &openAiRequest)
+	if err != nil {
+		handleError(httpResponse, err)
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(countResponse); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
 	}
 }
 
 func (s *ModelProxy) HandleAuthentication(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handler, false)
+}
+
+// Same as HandleAuthentication, but only accepts the admin keys.
+func (s *ModelProxy) HandleAdminAuthentication(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handler, true)
+}
+
+func (s *ModelProxy) authenticate(handler http.HandlerFunc, adminOnly bool) http.HandlerFunc {
 	return func(httpResponse http.ResponseWriter, httpRequest *http.Request) {
-		if s.config.OgemApiKey == "" {
+		clientIp := s.ipFilter.clientIp(httpRequest)
+		if !s.ipFilter.allows(clientIp) {
+			s.logger.Warnw("Rejected request from disallowed address", "client_ip", clientIp)
+			writeAuthError(httpResponse, http.StatusForbidden, "ip_not_allowed", fmt.Sprintf("Client address %s is not allowed", clientIp))
+			return
+		}
+		httpRequest = httpRequest.WithContext(withClientIp(httpRequest.Context(), clientIp))
+
+		if len(s.apiKeyIndex) == 0 {
 			handler(httpResponse, httpRequest)
 			return
 		}
 
-		headerSplit := strings.Split(httpRequest.Header.Get("Authorization"), " ")
-		if len(headerSplit) != 2 ||
-			strings.ToLower(headerSplit[0]) != "bearer" ||
-			(headerSplit[1] != "" && headerSplit[1] != s.config.OgemApiKey) {
-			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+		authorization := httpRequest.Header.Get("Authorization")
+		if authorization == "" {
+			writeAuthError(httpResponse, http.StatusUnauthorized, "missing_api_key", "Missing API key in the Authorization header")
+			return
+		}
+		headerSplit := strings.Split(authorization, " ")
+		if len(headerSplit) != 2 || strings.ToLower(headerSplit[0]) != "bearer" || headerSplit[1] == "" {
+			writeAuthError(httpResponse, http.StatusUnauthorized, "invalid_authorization", "Authorization header must be \"Bearer <API key>\"")
+			return
+		}
+		apiKey, found := s.findApiKey(headerSplit[1])
+		if !found {
+			writeAuthError(httpResponse, http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
+			return
+		}
+		if s.isRevoked(httpRequest.Context(), apiKey) {
+			s.logger.Warnw("Rejected revoked API key", "api_key", apiKey.Name)
+			writeAuthError(httpResponse, http.StatusUnauthorized, "key_revoked", "API key has been revoked")
+			return
+		}
+		if apiKey.expired(time.Now()) {
+			s.logger.Warnw("Rejected expired API key", "api_key", apiKey.Name, "expires_at", apiKey.ExpiresAt)
+			writeAuthError(httpResponse, http.StatusUnauthorized, "key_expired", fmt.Sprintf("API key expired at %s", apiKey.ExpiresAt))
+			return
+		}
+		if adminOnly && !apiKey.Admin {
+			writeAuthError(httpResponse, http.StatusForbidden, "admin_required", "API key is not allowed to access admin endpoints")
+			return
+		}
+		if !apiKey.allowsClient(clientIp) {
+			s.logger.Warnw("Rejected API key from disallowed address", "api_key", apiKey.Name, "client_ip", clientIp)
+			writeAuthError(httpResponse, http.StatusForbidden, "ip_not_allowed", fmt.Sprintf("API key is not allowed from client address %s", clientIp))
 			return
 		}
 
-		handler(httpResponse, httpRequest)
+		accessRecordFrom(httpRequest.Context()).setApiKey(apiKey.Name)
+		handler(httpResponse, httpRequest.WithContext(withApiKey(httpRequest.Context(), apiKey)))
 	}
 }
 
-func (s *ModelProxy) PingInterval() time.Duration {
-	return s.pingInterval
+// Returns the configured API keys including the legacy OgemApiKey.
+func (s *ModelProxy) apiKeys() []ApiKey {
+	apiKeys := array.Filter(s.config.ApiKeys, func(apiKey ApiKey) bool {
+		return apiKey.Key != ""
+	})
+	if s.config.OgemApiKey != "" {
+		apiKeys = append(apiKeys, ApiKey{Key: s.config.OgemApiKey, Admin: true})
+	}
+	return apiKeys
 }
 
-func (s *ModelProxy) StartPingLoop(ctx context.Context) {
-	if s.pingInterval <= 0 {
-		return
+// Indexes the configured API keys by the hash of their secrets, so that
+// authenticating a request takes the same time for any number of keys. Must
+// be called again after the keys of the config change.
+func (s *ModelProxy) indexApiKeys() {
+	index := make(map[[sha256.Size]byte]ApiKey)
+	for _, apiKey := range s.apiKeys() {
+		hash := sha256.Sum256([]byte(apiKey.Key))
+		// The config validation rejects the same secret twice, except for the
+		// legacy key, which comes last.
+		if _, found := index[hash]; !found {
+			// Resolved once here rather than on every request. The config
+			// validation rejects the unset variables.
+			if len(apiKey.ProviderKeys) > 0 {
+				apiKey.ProviderKeys, _ = env.InterpolateMap(apiKey.ProviderKeys)
+			}
+			index[hash] = apiKey
+		}
 	}
+	s.apiKeyIndex = index
+}
 
-	ticker := time.NewTicker(s.pingInterval)
-	defer ticker.Stop()
+// Returns the configured key with the secret. Looking up the hash does not
+// reveal the secrets through the timing, unlike comparing them as they are.
+func (s *ModelProxy) findApiKey(token string) (ApiKey, bool) {
+	apiKey, found := s.apiKeyIndex[sha256.Sum256([]byte(token))]
+	return apiKey, found
+}
 
-	// This ensures we have initial data without waiting for the first tick,
-	// which occurs after a full interval.
-	s.pingAllEndpoints(ctx)
+// Returns the name of the API key that authenticated the request. Empty if
+// the key has no name or authentication is disabled.
+func apiKeyName(ctx context.Context) string {
+	apiKey, _ := apiKeyFrom(ctx)
+	return apiKey.Name
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			s.pingAllEndpoints(ctx)
-		}
+func withApiKey(ctx context.Context, apiKey ApiKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, apiKey)
+}
+
+// Returns the API key that authenticated the request. False if
+// authentication is disabled.
+func apiKeyFrom(ctx context.Context) (ApiKey, bool) {
+	apiKey, found := ctx.Value(apiKeyContextKey{}).(ApiKey)
+	return apiKey, found
+}
+
+// Adds a hook that runs after the configured ones on every chat completion
+// request. Must be called before the proxy serves requests.
+func (s *ModelProxy) AddHook(name string, hook hooks.Hook) {
+	if s.hooks == nil {
+		s.hooks, _ = hooks.NewChain(nil, s.logger)
 	}
+	s.hooks.Add(name, hook)
 }
 
 func (s *ModelProxy) Shutdown() {
 	s.logger.Info("Shutting down ModelProxy")
+	s.StopPingLoop()
 	if s.cleanup != nil {
 		s.cleanup()
 	}
+	s.notifier.Shutdown()
+	s.async.shutdown()
+	if s.accessLogger != nil {
+		s.accessLogger.Sync()
+	}
 	for _, endpoint := range s.endpoints {
 		if err := endpoint.Shutdown(); err != nil {
 			s.logger.Warnw("Failed to shutdown endpoint", "error", err)
@@ -313,97 +1228,207 @@ func (s *ModelProxy) Shutdown() {
 	}
 }
 
-func handleError(w http.ResponseWriter, err error) {
-	switch err.(type) {
-	case BadRequestError:
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-	case UnavailableError:
-		http.Error(w, "No available endpoints", http.StatusServiceUnavailable)
-	case RateLimitError:
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-	case RequestTimeoutError:
-		http.Error(w, "Request timed out", http.StatusRequestTimeout)
-	case InternalServerError:
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	default:
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
-}
-
-func (s *ModelProxy) generateChatCompletion(ctx context.Context, openAiRequest *openai.ChatCompletionRequest, keepRetry bool) (*openai.ChatCompletionResponse, error) {
+// Returns the response and the concrete "provider/region/model" that served
+// it. The served model is empty for cached responses.
+func (s *ModelProxy) generateChatCompletion(ctx context.Context, openAiRequest *openai.ChatCompletionRequest, keepRetry bool) (*openai.ChatCompletionResponse, string, error) {
 	endpointProvider, endpointRegion, modelOrAlias, err := parseModelIdentifier(openAiRequest.Model)
 	if err != nil {
 		s.logger.Warnw("Invalid model name", "error", err, "model", openAiRequest.Model)
-		return nil, BadRequestError{fmt.Errorf("invalid model name: %s", openAiRequest.Model)}
+		return nil, "", BadRequestError{fmt.Errorf("invalid model name: %s", openAiRequest.Model)}
 	}
 
 	if len(openAiRequest.Messages) == 0 {
 		s.logger.Warn("No messages provided")
-		return nil, BadRequestError{fmt.Errorf("no messages provided")}
+		return nil, "", BadRequestError{fmt.Errorf("no messages provided")}
 	}
 
-	cacheable := openAiRequest.Temperature != nil && math.Abs(float64(*openAiRequest.Temperature)-float64(0)) < math.SmallestNonzeroFloat32
-
-	if cacheable {
-		cachedResponse, err := s.cachedResponse(ctx, openAiRequest)
-		if err != nil {
-			s.logger.Warnw("Failed to get cached response", "error", err)
-		} else if cachedResponse != nil {
-			s.logger.Infow("Returning cached response", "model", openAiRequest.Model)
-			return cachedResponse, nil
-		}
+	if err := s.checkEndUserQuota(ctx, openAiRequest); err != nil {
+		s.logger.Warnw("Rejected by the end user limits", "error", err)
+		return nil, "", err
 	}
 
 	endpoints, err := s.sortedEndpoints(endpointProvider, endpointRegion, modelOrAlias)
 	if err != nil || len(endpoints) == 0 {
+		// Not notified, since the model comes from the client and is more
+		// likely a typo than an outage.
 		s.logger.Warnw("Failed to select endpoint", "error", err, "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias)
-		return nil, UnavailableError{fmt.Errorf("no available endpoints")}
+		routingTraceFrom(ctx).begin(openAiRequest.Model, nil).failed(fmt.Errorf("no endpoint is configured for the model"))
+		return nil, "", UnavailableError{fmt.Errorf("no available endpoints")}
 	}
 
+	modelTrace := routingTraceFrom(ctx).begin(openAiRequest.Model, endpoints)
+
+	if endpoints = filterEndpoints(ctx, endpoints); len(endpoints) == 0 {
+		s.logger.Warnw("No endpoints allowed by the provider filter", "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias, "filter", providerFilterFrom(ctx).String())
+		err := BadRequestError{fmt.Errorf("no endpoints of %s are left after the provider filter (%s)", openAiRequest.Model, providerFilterFrom(ctx))}
+		modelTrace.skip(endpoints, "provider_filter")
+		modelTrace.failed(err)
+		return nil, "", err
+	}
+	modelTrace.skip(endpoints, "provider_filter")
+
+	// Waiting for a disabled endpoint takes as long as it is disabled, so
+	// the chain moves on to the next model right away. The last model still
+	// waits for the endpoints to keep retrying.
+	if !keepRetry && s.allDisabled(ctx, endpoints, modelOrAlias) {
+		s.logger.Infow("Skipping model with all endpoints disabled", "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias)
+		modelTrace.skip(nil, "disabled")
+		modelTrace.failed(fmt.Errorf("all endpoints are disabled"))
+		return nil, "", UnavailableError{fmt.Errorf("no available endpoints")}
+	}
+
+	endpoints, missing := capableEndpoints(openAiRequest, endpoints, s.config.EmulateMultipleChoices, maxTokensFrom(ctx).isStrict())
+	modelTrace.skip(endpoints, "missing capabilities: "+strings.Join(missing, ", "))
+	if len(endpoints) == 0 {
+		s.logger.Warnw("No endpoints support the request", "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias, "missing", missing)
+		err := BadRequestError{fmt.Errorf("no endpoints of %s support the request; missing capabilities: %s", openAiRequest.Model, strings.Join(missing, ", "))}
+		modelTrace.failed(err)
+		return nil, "", err
+	}
+
+	endpoints, openAiRequest, err = fitContextWindow(ctx, openAiRequest, endpoints)
+	if err != nil {
+		s.logger.Warnw("Request exceeds the context window", "error", err, "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias)
+		modelTrace.failed(err)
+		return nil, "", err
+	}
+	modelTrace.skip(endpoints, "context_window")
+
+	firstEndpoint := endpoints[0]
+	endpoints = s.preferSessionEndpoint(ctx, openAiRequest.Model, endpoints)
+	modelTrace.order(endpoints, endpoints[0] != firstEndpoint)
+
+	cacheable := !shadowFrom(ctx) && openAiRequest.Temperature != nil && math.Abs(float64(*openAiRequest.Temperature)-float64(0)) < math.SmallestNonzeroFloat32
+	hedge := s.hedgeable(ctx, openAiRequest, cacheable)
+
+	modelTrace.setCache("disabled")
+	accessRecordFrom(ctx).setCache("disabled")
+	// A cached response may have come from a provider that the filter of the
+	// request excludes, so the filtered requests only store their responses.
+	if cacheable && providerFilterFrom(ctx).empty() {
+		cachedResponse, release, err := s.awaitCachedResponse(ctx, openAiRequest)
+		if err != nil {
+			modelTrace.failed(err)
+			return nil, "", err
+		}
+		defer release()
+		if cachedResponse != nil {
+			s.logger.Infow("Returning cached response", "model", openAiRequest.Model)
+			modelTrace.setCache("hit")
+			accessRecordFrom(ctx).setCache("hit")
+			cachedResponse = s.validateToolCalls(ctx, nil, openAiRequest, cachedResponse)
+			served := servedEndpoint(endpoints, cachedResponse)
+			s.recordEndUserUsage(ctx, openAiRequest, cachedResponse, served.modelStatus, true)
+			s.recordCacheHit(ctx, cachedResponse, served)
+			postprocessResponse(ctx, openAiRequest, cachedResponse, served.modelStatus)
+			return cachedResponse, "", nil
+		}
+		modelTrace.setCache("miss")
+		accessRecordFrom(ctx).setCache("miss")
+	}
+
+	// Temporary failures of each endpoint, which are not disabled for them.
+	transientFailures := map[*endpointStatus]int{}
+	var transientError error
 	for {
 		var bestEndpoint *endpointStatus
 		var shortestWaiting time.Duration
-		for _, endpoint := range endpoints {
+		exhausted := 0
+		for index, endpoint := range endpoints {
 			if ctx.Err() != nil {
 				s.logger.Warn("Request canceled")
-				return nil, RequestTimeoutError{fmt.Errorf("request canceled")}
+				modelTrace.failed(ctx.Err())
+				return nil, "", RequestTimeoutError{fmt.Errorf("request canceled")}
+			}
+			if transientFailures[endpoint] > maxTransientRetries {
+				exhausted++
+				continue
+			}
+
+			// Checked before the rate limit so that a busy endpoint does not
+			// consume it. The slot is released when the attempt finishes.
+			if !s.inFlight.acquire(endpoint) {
+				if bestEndpoint == nil || busyEndpointWait < shortestWaiting {
+					bestEndpoint = endpoint
+					shortestWaiting = busyEndpointWait
+				}
+				s.logger.Infow("Endpoint busy", "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", modelOrAlias, "max_concurrent_requests", endpoint.maxConcurrentRequests)
+				modelTrace.busy(endpoint, busyEndpointWait)
+				continue
 			}
 
+			allowStart := time.Now()
 			accepted, waiting, err := s.stateManager.Allow(
 				ctx,
 				endpoint.endpoint.Provider(),
 				endpoint.endpoint.Region(),
-				modelOrAlias,
+				rateLimitModel(ctx, endpoint, modelOrAlias),
 				requestInterval(endpoint.modelStatus),
+				requestBurst(endpoint.modelStatus),
 			)
+			s.loadShedder.observeState(time.Since(allowStart))
 			if err != nil {
+				s.inFlight.release(endpoint)
 				s.logger.Warnw("Failed to check rate limit", "error", err, "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", modelOrAlias)
-				return nil, InternalServerError{fmt.Errorf("rate limit check failed")}
+				return nil, "", InternalServerError{fmt.Errorf("rate limit check failed")}
 			}
 			if !accepted {
+				s.inFlight.release(endpoint)
 				if bestEndpoint == nil || waiting < shortestWaiting {
 					bestEndpoint = endpoint
 					shortestWaiting = waiting
 				}
 				s.logger.Infow("Rate limit exceeded", "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", modelOrAlias, "waiting", waiting)
+				modelTrace.rateLimited(endpoint, waiting)
 				continue
 			}
 
-			openAiRequest.Model = endpoint.modelStatus.Name
-			openAiResponse, err := endpoint.endpoint.GenerateChatCompletion(ctx, openAiRequest)
-			if err != nil {
-				loweredError := strings.ToLower(err.Error())
-				if strings.Contains(loweredError, "429") ||
-					strings.Contains(loweredError, "quota") ||
-					strings.Contains(loweredError, "exceeded") ||
-					strings.Contains(loweredError, "throughput") ||
-					strings.Contains(loweredError, "exhausted") {
-					s.stateManager.Disable(ctx, endpoint.endpoint.Provider(), endpoint.endpoint.Region(), modelOrAlias, 1*time.Minute)
+			backups := []*endpointStatus{}
+			if hedge {
+				backups = endpoints[index+1:]
+			}
+			// A backup endpoint may have served the request.
+			result := s.generateHedged(ctx, endpoint, backups, openAiRequest, modelOrAlias)
+			if result.err != nil {
+				disabled := s.disableOnQuotaError(ctx, endpoint, modelOrAlias, result.err)
+				modelTrace.called(endpoint, result, disabled)
+				if disabled {
+					continue
+				}
+				class := provider.ClassifyError(result.err)
+				if class == provider.RetryableTransient {
+					s.logger.Warnw("Endpoint failed temporarily, trying the others", "error", result.err, "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", modelOrAlias)
+					transientFailures[endpoint]++
+					transientError = result.err
 					continue
 				}
-				s.logger.Warnw("Failed to generate completion", "error", err, "request", openAiRequest, "response", openAiResponse)
-				return nil, InternalServerError{fmt.Errorf("failed to generate completion")}
+				modelTrace.failed(result.err)
+				s.logger.Warnw("Failed to generate completion", "error", result.err, "class", class, "request", provider.RedactRequest(result.request), "response", result.response)
+				var modelNotFound *provider.ModelNotFoundError
+				if errors.As(result.err, &modelNotFound) {
+					return nil, "", ModelNotFoundError{fmt.Errorf("model %s is not available on %s/%s", modelNotFound.Model, endpoint.endpoint.Provider(), endpoint.endpoint.Region())}
+				}
+				var invalidRequest *provider.InvalidRequestError
+				if errors.As(result.err, &invalidRequest) {
+					return nil, "", BadRequestError{invalidRequest}
+				}
+				var notSupported *provider.NotSupportedError
+				if errors.As(result.err, &notSupported) {
+					return nil, "", BadRequestError{fmt.Errorf("%s/%s cannot serve %s: %v", endpoint.endpoint.Provider(), endpoint.endpoint.Region(), modelOrAlias, notSupported)}
+				}
+				if class == provider.NonRetryableBadRequest {
+					return nil, "", BadRequestError{result.err}
+				}
+				return nil, "", InternalServerError{fmt.Errorf("failed to generate completion")}
 			}
+			modelTrace.called(endpoint, result, false)
+			endpoint = result.endpoint
+			endpointRequest, openAiResponse := result.request, result.response
+			backfillUsage(endpointRequest, openAiResponse)
+			maxTokensFrom(ctx).served(openAiRequest, endpointRequest)
+
+			s.resetDisableBackoff(endpoint.endpoint, rateLimitModel(ctx, endpoint, modelOrAlias))
+			s.storeSessionEndpoint(ctx, openAiRequest.Model, endpoint)
 
 			if cacheable {
 				// Caching should be done even if the request has been canceled.
@@ -412,19 +1437,249 @@ func (s *ModelProxy) generateChatCompletion(ctx context.Context, openAiRequest *
 					s.logger.Warnw("Failed to cache response", "error", err)
 				}
 			}
-			return openAiResponse, nil
+			// After caching so that a cached response is validated again for
+			// the requests that ask for it.
+			openAiResponse = s.validateToolCalls(ctx, endpoint, endpointRequest, openAiResponse)
+			s.recordEndUserUsage(ctx, openAiRequest, openAiResponse, endpoint.modelStatus, false)
+			// After caching so that the cache keeps the content as generated
+			// for the requests with other transforms.
+			postprocessResponse(ctx, openAiRequest, openAiResponse, endpoint.modelStatus)
+			return openAiResponse, fmt.Sprintf("%s/%s/%s", endpoint.endpoint.Provider(), endpoint.endpoint.Region(), endpointRequest.Model), nil
+		}
+		if exhausted == len(endpoints) {
+			s.logger.Warnw("Every endpoint kept failing temporarily", "error", transientError, "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias)
+			s.notifier.Publish(notify.Event{
+				Type:     notify.EventEndpointsUnavailable,
+				Provider: endpointProvider,
+				Region:   endpointRegion,
+				Model:    modelOrAlias,
+				Message:  fmt.Sprintf("All %d endpoints of the model failed temporarily: %v", len(endpoints), transientError),
+			})
+			modelTrace.failed(transientError)
+			return nil, "", UnavailableError{fmt.Errorf("every endpoint failed temporarily: %v", transientError)}
 		}
 		if bestEndpoint == nil {
+			s.notifier.Publish(notify.Event{
+				Type:     notify.EventEndpointsUnavailable,
+				Provider: endpointProvider,
+				Region:   endpointRegion,
+				Model:    modelOrAlias,
+				Message:  fmt.Sprintf("All %d endpoints of the model are unavailable", len(endpoints)),
+			})
 			if keepRetry {
 				s.logger.Warnw("No available endpoints", "waiting", s.retryInterval)
-				time.Sleep(s.retryInterval)
+				modelTrace.waited()
+				s.sleepInQueue(ctx, endpointProvider, modelOrAlias, queueWaitRetry, s.retryInterval)
 				continue
 			}
 			s.logger.Warn("No available endpoints")
-			return nil, UnavailableError{fmt.Errorf("no available endpoints")}
+			modelTrace.failed(fmt.Errorf("no available endpoints"))
+			return nil, "", UnavailableError{fmt.Errorf("no available endpoints")}
+		}
+		modelTrace.waited()
+		s.sleepInQueue(ctx, bestEndpoint.endpoint.Provider(), modelOrAlias, queueWaitEndpoint, shortestWaiting)
+	}
+}
+
+// Returns whether every endpoint is disabled for the model. Accepting a
+// request blocks an endpoint for at most one request interval, so only a
+// longer wait means it is disabled. Endpoints whose state cannot be read are
+// considered available.
+func (s *ModelProxy) allDisabled(ctx context.Context, endpoints []*endpointStatus, modelOrAlias string) bool {
+	for _, endpoint := range endpoints {
+		wait, err := s.stateManager.Peek(ctx, endpoint.endpoint.Provider(), endpoint.endpoint.Region(), rateLimitModel(ctx, endpoint, modelOrAlias))
+		if err != nil || wait <= requestInterval(endpoint.modelStatus) {
+			return false
+		}
+	}
+	return true
+}
+
+// Disables the endpoint if the error is classified as a quota error. Returns
+// whether it was.
+func (s *ModelProxy) disableOnQuotaError(ctx context.Context, endpoint *endpointStatus, modelOrAlias string, err error) bool {
+	if provider.ClassifyError(err) != provider.Retryable429 {
+		return false
+	}
+	limitedModel := rateLimitModel(ctx, endpoint, modelOrAlias)
+	duration := s.disableDuration(endpoint.endpoint, limitedModel, err)
+	s.logger.Infow("Disabling endpoint", "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", limitedModel, "duration", duration, "error", err)
+	s.stateManager.Disable(ctx, endpoint.endpoint.Provider(), endpoint.endpoint.Region(), limitedModel, duration)
+	s.notifier.Publish(notify.Event{
+		Type:     notify.EventEndpointDisabled,
+		Provider: endpoint.endpoint.Provider(),
+		Region:   endpoint.endpoint.Region(),
+		Model:    modelOrAlias,
+		Message:  fmt.Sprintf("Endpoint disabled for %v: %v", duration, err),
+	})
+	return true
+}
+
+// Returns the duration to disable the endpoint for after the quota error.
+// Uses the retry hint of the provider if any, otherwise backs off
+// exponentially. Either way, up to the maximum disable duration.
+func (s *ModelProxy) disableDuration(endpoint provider.AiEndpoint, model string, err error) time.Duration {
+	var quotaError *provider.QuotaError
+	if errors.As(err, &quotaError) && quotaError.RetryAfter > 0 {
+		return min(quotaError.RetryAfter, s.maxDisableDuration)
+	}
+
+	key := fmt.Sprintf("%s:%s:%s", endpoint.Provider(), endpoint.Region(), model)
+	s.disableBackoffMutex.Lock()
+	defer s.disableBackoffMutex.Unlock()
+
+	duration, found := s.disableBackoff[key]
+	if !found {
+		duration = initialDisableDuration
+	}
+	duration = min(duration, s.maxDisableDuration)
+	s.disableBackoff[key] = min(duration*2, s.maxDisableDuration)
+	return duration
+}
+
+func (s *ModelProxy) resetDisableBackoff(endpoint provider.AiEndpoint, model string) {
+	key := fmt.Sprintf("%s:%s:%s", endpoint.Provider(), endpoint.Region(), model)
+	s.disableBackoffMutex.Lock()
+	defer s.disableBackoffMutex.Unlock()
+	delete(s.disableBackoff, key)
+}
+
+// Returns the endpoint that generated the cached response, which may be any
+// of the alias. The first endpoint if none serves its model.
+func servedEndpoint(endpoints []*endpointStatus, response *openai.ChatCompletionResponse) *endpointStatus {
+	for _, endpoint := range endpoints {
+		if endpoint.modelStatus.Name == response.Model {
+			return endpoint
+		}
+	}
+	return endpoints[0]
+}
+
+// Returns a copy of the request with the unset fields filled by the model
+// defaults. The original request is never modified.
+func applyModelDefaults(request *openai.ChatCompletionRequest, defaults *ogem.ModelDefaults) *openai.ChatCompletionRequest {
+	requestCopy := *request
+	if defaults == nil {
+		return &requestCopy
+	}
+
+	if requestCopy.Temperature == nil && defaults.Temperature != nil {
+		requestCopy.Temperature = utils.ToPtr(*defaults.Temperature)
+	}
+	if requestCopy.TopP == nil && defaults.TopP != nil {
+		requestCopy.TopP = utils.ToPtr(*defaults.TopP)
+	}
+	if requestCopy.MaxTokens == nil && requestCopy.MaxCompletionTokens == nil && defaults.MaxTokens != nil {
+		requestCopy.MaxTokens = utils.ToPtr(*defaults.MaxTokens)
+	}
+	if requestCopy.FrequencyPenalty == nil && defaults.FrequencyPenalty != nil {
+		requestCopy.FrequencyPenalty = utils.ToPtr(*defaults.FrequencyPenalty)
+	}
+	if requestCopy.PresencePenalty == nil && defaults.PresencePenalty != nil {
+		requestCopy.PresencePenalty = utils.ToPtr(*defaults.PresencePenalty)
+	}
+	if requestCopy.StopSequences == nil && len(defaults.Stop) > 0 {
+		requestCopy.StopSequences = &openai.StopSequences{
+			Sequences: append([]string{}, defaults.Stop...),
 		}
-		time.Sleep(shortestWaiting)
 	}
+	if defaults.SystemPromptPrefix != "" {
+		requestCopy.Messages = prependSystemPrompt(requestCopy.Messages, defaults.SystemPromptPrefix)
+	}
+	return &requestCopy
+}
+
+// Removes the sampling parameters that reasoning models reject, and moves
+// max_tokens to max_completion_tokens which they expect instead.
+func toReasoningRequest(request *openai.ChatCompletionRequest) {
+	request.Temperature = nil
+	request.TopP = nil
+	request.FrequencyPenalty = nil
+	request.PresencePenalty = nil
+	request.Logprobs = nil
+	request.TopLogprobs = nil
+	if request.MaxCompletionTokens == nil {
+		request.MaxCompletionTokens = request.MaxTokens
+	}
+	request.MaxTokens = nil
+}
+
+// Prepends the prompt to the first system or developer message, or adds a new
+// system message if there is none. Returns a new slice without modifying the given
+// messages.
+func prependSystemPrompt(messages []openai.Message, prompt string) []openai.Message {
+	result := make([]openai.Message, 0, len(messages)+1)
+	for index, message := range messages {
+		if !message.IsSystem() {
+			continue
+		}
+		result = append(result, messages[:index]...)
+		merged := message
+		switch {
+		case message.Content == nil:
+			merged.Content = &openai.MessageContent{String: utils.ToPtr(prompt)}
+		case message.Content.String != nil:
+			merged.Content = &openai.MessageContent{
+				String: utils.ToPtr(prompt + "\n\n" + *message.Content.String),
+			}
+		default:
+			parts := make([]openai.Part, 0, len(message.Content.Parts)+1)
+			parts = append(parts, openai.Part{
+				Type:    "text",
+				Content: openai.Content{TextContent: &openai.TextContent{Text: prompt}},
+			})
+			merged.Content = &openai.MessageContent{Parts: append(parts, message.Content.Parts...)}
+		}
+		result = append(result, merged)
+		return append(result, messages[index+1:]...)
+	}
+
+	result = append(result, openai.Message{
+		Role:    "system",
+		Content: &openai.MessageContent{String: utils.ToPtr(prompt)},
+	})
+	return append(result, messages...)
+}
+
+// Counts the prompt tokens with the tokenizer of the endpoint that chat
+// completions would be routed to. Falls back to the heuristic estimation if
+// no endpoint can count tokens for the model.
+func (s *ModelProxy) countTokens(ctx context.Context, openAiRequest *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	endpointProvider, endpointRegion, modelOrAlias, err := parseModelIdentifier(openAiRequest.Model)
+	if err != nil {
+		s.logger.Warnw("Invalid model name", "error", err, "model", openAiRequest.Model)
+		return nil, BadRequestError{fmt.Errorf("invalid model name: %s", openAiRequest.Model)}
+	}
+
+	endpoints, err := s.sortedEndpoints(endpointProvider, endpointRegion, modelOrAlias)
+	if err != nil {
+		s.logger.Warnw("Failed to select endpoint", "error", err, "provider", endpointProvider, "region", endpointRegion, "model", modelOrAlias)
+	}
+
+	for _, endpoint := range endpoints {
+		if countResponse := s.countEndpointTokens(ctx, endpoint, openAiRequest); countResponse != nil {
+			return countResponse, nil
+		}
+	}
+
+	return tokenizer.Estimate(openAiRequest), nil
+}
+
+// Counts the prompt tokens with the tokenizer of the endpoint. Nil if the
+// endpoint cannot count tokens for the model.
+func (s *ModelProxy) countEndpointTokens(ctx context.Context, endpoint *endpointStatus, openAiRequest *openai.ChatCompletionRequest) *openai.TokenCountResponse {
+	counter, ok := endpoint.endpoint.(provider.TokenCounter)
+	if !ok {
+		return nil
+	}
+	endpointRequest := *openAiRequest
+	endpointRequest.Model = endpoint.modelStatus.Name
+	countResponse, err := counter.CountTokens(ctx, &endpointRequest)
+	if err != nil {
+		s.logger.Warnw("Failed to count tokens", "error", err, "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", endpointRequest.Model)
+		return nil
+	}
+	return countResponse
 }
 
 func parseModelIdentifier(modelIdentifier string) (provider string, region string, model string, err error) {
@@ -447,6 +1702,9 @@ func (s *ModelProxy) sortedEndpoints(desiredProvider string, desiredRegion strin
 	defer s.mutex.RUnlock()
 
 	endpoints := []*endpointStatus{}
+	// Priorities in which any endpoint has a weight. Their endpoints are
+	// ordered by weighted random sampling instead of latency.
+	weighted := map[int]bool{}
 	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, regionStatus ogem.RegionStatus, models []*ogem.SupportedModel) bool {
 		if desiredProvider != "" && desiredProvider != provider {
 			return false
@@ -466,16 +1724,65 @@ func (s *ModelProxy) sortedEndpoints(desiredProvider string, desiredRegion strin
 			s.logger.Warnw("Failed to get endpoint", "provider", provider, "region", region, "error", err)
 			return false
 		}
+		health := regionHealth(regionStatus)
+		if regionStatus.Weight > 0 {
+			weighted[regionStatus.Priority] = true
+		}
 		endpoints = append(endpoints, &endpointStatus{
 			endpoint:    endpoint,
 			latency:     regionStatus.Latency,
+			health:      health,
+			weight:      regionStatus.EffectiveWeight(),
+			priority:    regionStatus.Priority,
 			modelStatus: modelStatus,
+
+			maxConcurrentRequests: regionStatus.MaxConcurrentRequests,
 		})
 		return false
 	})
 
+	// Sorts by name first so that the order only depends on the random source,
+	// then shuffles so that the replicas do not all pick the same endpoint
+	// among the ones of equal latency. The unhealthy endpoints come last, and
+	// the others by priority. Within a priority, the endpoints that have not
+	// been checked yet come after the healthy ones in random order.
 	sort.Slice(endpoints, func(i, j int) bool {
-		return endpoints[i].latency < endpoints[j].latency
+		return endpointKey(endpoints[i]) < endpointKey(endpoints[j])
+	})
+	for _, endpoint := range endpoints {
+		endpoint.sloPenalty = s.slo.penalty(endpoint)
+	}
+	weightKeys := make(map[*endpointStatus]float64, len(endpoints))
+	s.randomMutex.Lock()
+	s.random.Shuffle(len(endpoints), func(i, j int) {
+		endpoints[i], endpoints[j] = endpoints[j], endpoints[i]
+	})
+	for _, endpoint := range endpoints {
+		if weighted[endpoint.priority] {
+			// Smallest first is a weighted random order (Efraimidis-Spirakis).
+			weightKeys[endpoint] = -math.Log(1-s.random.Float64()) / (endpoint.weight / endpoint.sloPenalty)
+		}
+	}
+	s.randomMutex.Unlock()
+	for _, endpoint := range endpoints {
+		endpoint.weighted = weighted[endpoint.priority]
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		iUnhealthy := endpoints[i].health == endpointUnhealthy
+		jUnhealthy := endpoints[j].health == endpointUnhealthy
+		if iUnhealthy != jUnhealthy {
+			return jUnhealthy
+		}
+		if endpoints[i].priority != endpoints[j].priority {
+			return endpoints[i].priority > endpoints[j].priority
+		}
+		if endpoints[i].health != endpoints[j].health {
+			return endpoints[i].health < endpoints[j].health
+		}
+		if weighted[endpoints[i].priority] {
+			return weightKeys[endpoints[i]] < weightKeys[endpoints[j]]
+		}
+		return float64(endpoints[i].latency)*endpoints[i].sloPenalty < float64(endpoints[j].latency)*endpoints[j].sloPenalty
 	})
 
 	s.logger.Infow("Selected endpoint", "endpoints", array.Map(endpoints, func(e *endpointStatus) string {
@@ -484,6 +1791,21 @@ func (s *ModelProxy) sortedEndpoints(desiredProvider string, desiredRegion strin
 	return endpoints, nil
 }
 
+// Returns the result of the last health check of the region.
+func regionHealth(regionStatus ogem.RegionStatus) endpointHealth {
+	if regionStatus.LastChecked.IsZero() {
+		return endpointUnchecked
+	}
+	if !regionStatus.Healthy() {
+		return endpointUnhealthy
+	}
+	return endpointHealthy
+}
+
+func endpointKey(endpoint *endpointStatus) string {
+	return endpoint.endpoint.Provider() + "/" + endpoint.endpoint.Region()
+}
+
 func (s *ModelProxy) endpoint(provider string, region string) (provider.AiEndpoint, error) {
 	for _, endpoint := range s.endpoints {
 		if endpoint.Provider() == provider && endpoint.Region() == region {
@@ -493,41 +1815,145 @@ func (s *ModelProxy) endpoint(provider string, region string) (provider.AiEndpoi
 	return nil, fmt.Errorf("endpoint not found for provider: %s, region: %s", provider, region)
 }
 
-func (s *ModelProxy) pingAllEndpoints(ctx context.Context) {
-	for _, endpoint := range s.endpoints {
-		latency, err := endpoint.Ping(ctx)
-		if err != nil {
-			s.logger.Warnw("Failed to ping endpoint", "provider", endpoint.Provider(), "region", endpoint.Region(), "error", err)
-			continue
+// Generates a one-token completion with the first model of the region that
+// is not served by the batch API. Does nothing if there is no such model.
+func (s *ModelProxy) checkCompletion(ctx context.Context, endpoint provider.AiEndpoint) error {
+	var model *ogem.SupportedModel
+	s.mutex.RLock()
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, _ ogem.RegionStatus, models []*ogem.SupportedModel) bool {
+		if provider != endpoint.Provider() || region != endpoint.Region() {
+			return false
 		}
-		s.updateEndpointStatus(endpoint.Provider(), endpoint.Region(), latency)
+		model, _ = array.Find(models, func(m *ogem.SupportedModel) bool {
+			return !strings.HasSuffix(m.Name, "@batch")
+		})
+		return true
+	})
+	s.mutex.RUnlock()
+	if model == nil {
+		return nil
+	}
+
+	if err := generateOneToken(ctx, endpoint, model); err != nil {
+		return fmt.Errorf("health check completion with %s failed: %w", model.Name, err)
 	}
+	return nil
 }
 
-func (s *ModelProxy) updateEndpointStatus(provider string, region string, latency time.Duration) {
+func generateOneToken(ctx context.Context, endpoint provider.AiEndpoint, model *ogem.SupportedModel) error {
+	request := &openai.ChatCompletionRequest{
+		Model: model.Name,
+		Messages: []openai.Message{{
+			Role:    "user",
+			Content: &openai.MessageContent{String: utils.ToPtr("Ping")},
+		}},
+		MaxTokens: utils.ToPtr(int32(1)),
+	}
+	if model.Reasoning {
+		toReasoningRequest(request)
+	}
+	_, err := endpoint.GenerateChatCompletion(ctx, request)
+	return err
+}
+
+// Records the result of the health check. The latency is kept on failures
+// since the region is deprioritized by its error anyway.
+func (s *ModelProxy) updateEndpointStatus(endpointProvider string, region string, latency time.Duration, err error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.endpointStatus.Update(provider, region, func(regionStatus *ogem.RegionStatus) error {
-		regionStatus.Latency = latency
+	s.endpointStatus.Update(endpointProvider, region, func(regionStatus *ogem.RegionStatus) error {
 		regionStatus.LastChecked = time.Now()
+		if err != nil {
+			var authError *provider.AuthError
+			regionStatus.LastError = err.Error()
+			regionStatus.Unauthorized = errors.As(err, &authError)
+			return nil
+		}
+		switch s.config.LatencySmoothing.observe(regionStatus, latency) {
+		case latencyRejected:
+			s.logger.Infow("Ignored outlier latency", "provider", endpointProvider, "region", region, "latency", latency, "average", regionStatus.Latency)
+		case latencyDegraded:
+			s.logger.Warnw("Latency degraded", "provider", endpointProvider, "region", region, "latency", latency)
+		}
+		regionStatus.LastError = ""
+		regionStatus.Unauthorized = false
 		return nil
 	})
 }
 
-func (s *ModelProxy) cachedResponse(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
-	cacheKey, err := generateCacheKey(request)
+// Returns the cached response of the request. On a miss, only one of the
+// identical requests, across all instances sharing the state manager, gets the
+// lock of the cache key and calls the provider. The others wait for it to
+// cache the response, and call the provider themselves only if it failed or
+// took longer than cacheLockDuration. The returned function releases the lock
+// and must be called once the response is cached.
+func (s *ModelProxy) awaitCachedResponse(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, func(), error) {
+	noop := func() {}
+	cacheKey, err := CanonicalCacheKey(request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build cache key: %v", err)
+		s.logger.Warnw("Failed to build cache key", "error", err)
+		return nil, noop, nil
 	}
 	s.logger.Infow("Checking cache", "key", cacheKey)
 
-	data, err := s.stateManager.LoadCache(ctx, cacheKey)
-	if err != nil {
-		return nil, err
+	lockKey := cacheKey + ":lock"
+	waitUntil := time.Now().Add(cacheLockDuration)
+	for {
+		cachedResponse, err := s.cachedResponse(ctx, cacheKey)
+		if err != nil {
+			s.logger.Warnw("Failed to get cached response", "error", err)
+			return nil, noop, nil
+		}
+		if cachedResponse != nil {
+			return cachedResponse, noop, nil
+		}
+
+		acquired, err := s.stateManager.AcquireLock(ctx, lockKey, cacheLockDuration)
+		if err != nil {
+			s.logger.Warnw("Failed to acquire cache lock", "error", err, "key", lockKey)
+			return nil, noop, nil
+		}
+		if acquired {
+			return nil, func() {
+				// Releasing should be done even if the request has been canceled.
+				if err := s.stateManager.ReleaseLock(context.Background(), lockKey); err != nil {
+					s.logger.Warnw("Failed to release cache lock", "error", err, "key", lockKey)
+				}
+			}, nil
+		}
+		if time.Now().After(waitUntil) {
+			s.logger.Warnw("Timed out waiting for the cache", "key", cacheKey)
+			return nil, noop, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.logger.Warn("Request canceled while waiting for the cache")
+			return nil, noop, RequestTimeoutError{fmt.Errorf("request canceled")}
+		case <-time.After(cacheLockPollInterval):
+		}
 	}
+}
+
+// Looks up the local tier first, and then the state manager, whose hits are
+// kept in the local tier for the next lookups.
+func (s *ModelProxy) cachedResponse(ctx context.Context, cacheKey string) (*openai.ChatCompletionResponse, error) {
+	data := s.localCache.get(cacheKey)
 	if data == nil {
-		return nil, nil
+		start := time.Now()
+		var err error
+		data, err = s.stateManager.LoadCache(ctx, cacheKey)
+		s.loadShedder.observeState(time.Since(start))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			s.stateCacheMisses.Add(1)
+			return nil, nil
+		}
+		s.stateCacheHits.Add(1)
+		s.localCache.put(cacheKey, data)
 	}
 
 	var cachedResponse openai.ChatCompletionResponse
@@ -538,7 +1964,7 @@ func (s *ModelProxy) cachedResponse(ctx context.Context, request *openai.ChatCom
 }
 
 func (s *ModelProxy) storeResponseInCache(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error {
-	cacheKey, err := generateCacheKey(request)
+	cacheKey, err := CanonicalCacheKey(request)
 	if err != nil {
 		return fmt.Errorf("failed to build cache key: %v", err)
 	}
@@ -548,18 +1974,11 @@ func (s *ModelProxy) storeResponseInCache(ctx context.Context, request *openai.C
 		return fmt.Errorf("failed to marshal response for caching: %v", err)
 	}
 
-	return s.stateManager.SaveCache(ctx, cacheKey, jsonBytes, 24*time.Hour)
-}
-
-func generateCacheKey(request *openai.ChatCompletionRequest) (string, error) {
-	hasher := sha256.New()
-	requestBytes, err := json.Marshal(request)
-	if err != nil {
-		return "", err
+	if err := s.stateManager.SaveCache(ctx, cacheKey, jsonBytes, responseCacheTtl); err != nil {
+		return err
 	}
-	hasher.Write(requestBytes)
-	hash := hex.EncodeToString(hasher.Sum(nil))
-	return fmt.Sprintf("ogem:cache:%s", hash), nil
+	s.localCache.put(cacheKey, jsonBytes)
+	return nil
 }
 
 func requestInterval(modelStatus *ogem.SupportedModel) time.Duration {
@@ -568,3 +1987,11 @@ func requestInterval(modelStatus *ogem.SupportedModel) time.Duration {
 	}
 	return time.Duration(time.Minute.Nanoseconds() / int64(modelStatus.MaxRequestsPerMinute))
 }
+
+// Number of requests that can be sent to the model at once. At least 1.
+func requestBurst(modelStatus *ogem.SupportedModel) int {
+	if modelStatus == nil {
+		return 1
+	}
+	return max(modelStatus.Burst, 1)
+}
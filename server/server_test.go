@@ -0,0 +1,1374 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/hooks"
+	"github.com/yanolja/ogem/notify"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+	"github.com/yanolja/ogem/state"
+	"github.com/yanolja/ogem/utils"
+)
+
+type fakeEndpoint struct {
+	provider string
+	region   string
+
+	// Generates the response for the request. Returns a "stop" response with
+	// the model name as content if nil.
+	generate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)
+
+	// Result of the ping. Succeeds with zero latency if nil.
+	ping func(ctx context.Context) (time.Duration, error)
+
+	mutex    sync.Mutex
+	requests []*openai.ChatCompletionRequest
+}
+
+func (e *fakeEndpoint) GenerateChatCompletion(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	e.mutex.Lock()
+	e.requests = append(e.requests, request)
+	e.mutex.Unlock()
+
+	if e.generate != nil {
+		return e.generate(ctx, request)
+	}
+	return &openai.ChatCompletionResponse{
+		Model: request.Model,
+		Choices: []openai.Choice{{
+			Message: openai.Message{
+				Role:    "assistant",
+				Content: &openai.MessageContent{String: utils.ToPtr(request.Model)},
+			},
+			FinishReason: "stop",
+		}},
+	}, nil
+}
+
+func (e *fakeEndpoint) Ping(ctx context.Context) (time.Duration, error) {
+	if e.ping != nil {
+		return e.ping(ctx)
+	}
+	return 0, nil
+}
+
+func (e *fakeEndpoint) Provider() string {
+	return e.provider
+}
+
+func (e *fakeEndpoint) Region() string {
+	return e.region
+}
+
+func (e *fakeEndpoint) Shutdown() error {
+	return nil
+}
+
+func (e *fakeEndpoint) receivedRequests() []*openai.ChatCompletionRequest {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*openai.ChatCompletionRequest{}, e.requests...)
+}
+
+// Builds a proxy serving the given endpoints with the defaults of the
+// config. The providers must contain the status of every endpoint.
+func newTestProxy(t *testing.T, providers ogem.ProvidersStatus, endpoints ...provider.AiEndpoint) *ModelProxy {
+	stateManager, cleanup := state.NewMemoryManager(1024 * 1024)
+	t.Cleanup(cleanup)
+	proxy, err := NewProxyServer(stateManager, cleanup, Config{RetryInterval: "1ms", PingInterval: "0s"}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(proxy.notifier.Shutdown)
+	// The fakes stand in for the endpoints that the config would create.
+	proxy.endpoints = endpoints
+	proxy.endpointStatus = providers
+	proxy.random = rand.New(rand.NewSource(1))
+	return proxy
+}
+
+func userMessage(text string) openai.Message {
+	return openai.Message{
+		Role:    "user",
+		Content: &openai.MessageContent{String: utils.ToPtr(text)},
+	}
+}
+
+// Builds a proxy with a single endpoint serving the model, whose provider and
+// region are both named providerName. The endpoint replies with the model
+// name if generate is nil.
+func newSingleEndpointProxy(
+	t *testing.T,
+	providerName string,
+	model *ogem.SupportedModel,
+	generate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error),
+) (*ModelProxy, *fakeEndpoint) {
+	endpoint := &fakeEndpoint{provider: providerName, region: providerName, generate: generate}
+	proxy := newTestProxy(t, ogem.ProvidersStatus{providerName: {Regions: map[string]*ogem.RegionStatus{
+		providerName: {Models: []*ogem.SupportedModel{model}},
+	}}}, endpoint)
+	return proxy, endpoint
+}
+
+// Returns a generate function for fakeEndpoint that replies with the content
+// and reports the usage.
+func replyWith(content string, usage openai.Usage) func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	return func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		return &openai.ChatCompletionResponse{
+			Model: request.Model,
+			Choices: []openai.Choice{{
+				Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr(content)}},
+				FinishReason: "stop",
+			}},
+			Usage: usage,
+		}, nil
+	}
+}
+
+// Sends the body to the chat completions handler of the proxy with the
+// headers, and returns the recorded response. The API key, if any, is set on
+// the request as if it had authenticated with it.
+func sendChatCompletions(proxy *ModelProxy, body string, headers map[string]string, apiKey *ApiKey) *httptest.ResponseRecorder {
+	httpRequest := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	for name, value := range headers {
+		httpRequest.Header.Set(name, value)
+	}
+	if apiKey != nil {
+		httpRequest = httpRequest.WithContext(withApiKey(httpRequest.Context(), *apiKey))
+	}
+	recorder := httptest.NewRecorder()
+	proxy.HandleChatCompletions(recorder, httpRequest)
+	return recorder
+}
+
+// Decodes the chat completion in the recorded response. Empty if it is an
+// error.
+func decodeChatCompletion(recorder *httptest.ResponseRecorder) openai.ChatCompletionResponse {
+	var response openai.ChatCompletionResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response
+}
+
+func TestApplyModelDefaults(t *testing.T) {
+	defaults := &ogem.ModelDefaults{
+		Temperature:        utils.ToPtr(float32(0.2)),
+		TopP:               utils.ToPtr(float32(0.9)),
+		MaxTokens:          utils.ToPtr(int32(2048)),
+		FrequencyPenalty:   utils.ToPtr(float32(0.1)),
+		PresencePenalty:    utils.ToPtr(float32(0.3)),
+		Stop:               []string{"\n\n"},
+		SystemPromptPrefix: "Be concise.",
+	}
+
+	t.Run("Fills unset fields", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Model:    "gemini-1.5-flash",
+			Messages: []openai.Message{userMessage("Hello")},
+		}
+
+		result := applyModelDefaults(request, defaults)
+
+		assert.Equal(t, float32(0.2), *result.Temperature)
+		assert.Equal(t, float32(0.9), *result.TopP)
+		assert.Equal(t, int32(2048), *result.MaxTokens)
+		assert.Equal(t, float32(0.1), *result.FrequencyPenalty)
+		assert.Equal(t, float32(0.3), *result.PresencePenalty)
+		assert.Equal(t, []string{"\n\n"}, result.StopSequences.Sequences)
+		assert.Len(t, result.Messages, 2)
+		assert.Equal(t, "system", result.Messages[0].Role)
+		assert.Equal(t, "Be concise.", *result.Messages[0].Content.String)
+
+		// The original request must stay untouched.
+		assert.Nil(t, request.Temperature)
+		assert.Len(t, request.Messages, 1)
+	})
+
+	t.Run("Keeps explicit fields", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Model:               "gemini-1.5-flash",
+			Messages:            []openai.Message{userMessage("Hello")},
+			Temperature:         utils.ToPtr(float32(1)),
+			MaxCompletionTokens: utils.ToPtr(int32(10)),
+			StopSequences:       &openai.StopSequences{Sequences: []string{"END"}},
+		}
+
+		result := applyModelDefaults(request, defaults)
+
+		assert.Equal(t, float32(1), *result.Temperature)
+		assert.Nil(t, result.MaxTokens)
+		assert.Equal(t, int32(10), *result.MaxCompletionTokens)
+		assert.Equal(t, []string{"END"}, result.StopSequences.Sequences)
+	})
+
+	t.Run("Merges into the first system message", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Model: "gemini-1.5-flash",
+			Messages: []openai.Message{
+				userMessage("Hello"),
+				{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("You are a bot.")}},
+			},
+		}
+
+		result := applyModelDefaults(request, defaults)
+
+		assert.Len(t, result.Messages, 2)
+		assert.Equal(t, "Be concise.\n\nYou are a bot.", *result.Messages[1].Content.String)
+		assert.Equal(t, "You are a bot.", *request.Messages[1].Content.String)
+	})
+
+	t.Run("Merges into the developer message", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Model: "o3",
+			Messages: []openai.Message{
+				{Role: "developer", Content: &openai.MessageContent{String: utils.ToPtr("You are a bot.")}},
+				userMessage("Hello"),
+			},
+		}
+
+		result := applyModelDefaults(request, defaults)
+
+		assert.Len(t, result.Messages, 2)
+		assert.Equal(t, "developer", result.Messages[0].Role)
+		assert.Equal(t, "Be concise.\n\nYou are a bot.", *result.Messages[0].Content.String)
+	})
+
+	t.Run("No defaults", func(t *testing.T) {
+		request := &openai.ChatCompletionRequest{
+			Model:    "gemini-1.5-flash",
+			Messages: []openai.Message{userMessage("Hello")},
+		}
+
+		result := applyModelDefaults(request, nil)
+
+		assert.Equal(t, request, result)
+		assert.NotSame(t, request, result)
+	})
+
+	t.Run("Fallback models get their own defaults", func(t *testing.T) {
+		endpoint := &fakeEndpoint{
+			provider: "fake",
+			region:   "fake",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return &openai.ChatCompletionResponse{
+					Choices: []openai.Choice{{FinishReason: "length"}},
+				}, nil
+			},
+		}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"fake": {Regions: map[string]*ogem.RegionStatus{
+				"fake": {Models: []*ogem.SupportedModel{
+					{Name: "model-a", Defaults: &ogem.ModelDefaults{Temperature: utils.ToPtr(float32(0.2))}},
+					{Name: "model-b"},
+				}},
+			}},
+		}, endpoint)
+
+		request := &openai.ChatCompletionRequest{
+			Model:    "model-a",
+			Messages: []openai.Message{userMessage("Hello")},
+		}
+		_, _, err := proxy.generateChatCompletion(context.Background(), request, false)
+		assert.NoError(t, err)
+		request.Model = "model-b"
+		_, _, err = proxy.generateChatCompletion(context.Background(), request, false)
+		assert.NoError(t, err)
+
+		requests := endpoint.receivedRequests()
+		assert.Len(t, requests, 2)
+		assert.Equal(t, float32(0.2), *requests[0].Temperature)
+		assert.Nil(t, requests[1].Temperature)
+	})
+
+	t.Run("Endpoints of an alias get the defaults of their own model", func(t *testing.T) {
+		failing := &fakeEndpoint{
+			provider: "fake",
+			region:   "a",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, provider.NewProviderError(http.StatusServiceUnavailable, "", errors.New("overloaded"))
+			},
+		}
+		serving := &fakeEndpoint{provider: "fake", region: "b"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"fake": {Regions: map[string]*ogem.RegionStatus{
+				"a": {Priority: 1, Models: []*ogem.SupportedModel{
+					{Name: "model-a", OtherNames: []string{"chat"}, Defaults: &ogem.ModelDefaults{Temperature: utils.ToPtr(float32(0.2))}},
+				}},
+				"b": {Models: []*ogem.SupportedModel{
+					{Name: "model-b", OtherNames: []string{"chat"}, Defaults: &ogem.ModelDefaults{Temperature: utils.ToPtr(float32(0.7)), SystemPromptPrefix: "Be brief."}},
+				}},
+			}},
+		}, failing, serving)
+
+		request := &openai.ChatCompletionRequest{
+			Model:    "chat",
+			Messages: []openai.Message{userMessage("Hello")},
+		}
+		_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "fake/b/model-b", resolvedModel)
+
+		assert.Len(t, failing.receivedRequests(), 1)
+		assert.Equal(t, float32(0.2), *failing.receivedRequests()[0].Temperature)
+		assert.Len(t, failing.receivedRequests()[0].Messages, 1)
+		assert.Len(t, serving.receivedRequests(), 1)
+		assert.Equal(t, float32(0.7), *serving.receivedRequests()[0].Temperature)
+		assert.Equal(t, "Be brief.", *serving.receivedRequests()[0].Messages[0].Content.String)
+		assert.Nil(t, request.Temperature)
+	})
+}
+
+type fakeCountingEndpoint struct {
+	*fakeEndpoint
+}
+
+func (e *fakeCountingEndpoint) CountTokens(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	return &openai.TokenCountResponse{PromptTokens: 42, Tokenizer: "fake/" + request.Model}, nil
+}
+
+func TestHandleTokenCount(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model-001", OtherNames: []string{"fake-model"}}}},
+		}},
+	}
+	proxy := newTestProxy(t, providers, &fakeCountingEndpoint{&fakeEndpoint{provider: "fake", region: "fake"}})
+
+	countTokens := func(body string) (int, openai.TokenCountResponse) {
+		recorder := httptest.NewRecorder()
+		proxy.HandleTokenCount(recorder, httptest.NewRequest("POST", "/v1/tokens/count", strings.NewReader(body)))
+		var response openai.TokenCountResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	t.Run("Uses the tokenizer of the routed endpoint", func(t *testing.T) {
+		status, response := countTokens(`{"model": "fake-model,other", "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, int32(42), response.PromptTokens)
+		assert.Equal(t, "fake/fake-model-001", response.Tokenizer)
+		assert.False(t, response.Estimated)
+	})
+
+	t.Run("Estimates unknown models", func(t *testing.T) {
+		status, response := countTokens(`{"model": "unknown", "messages": [{"role": "user", "content": "Hello, world!"}]}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, response.Estimated)
+		assert.Equal(t, []int32{8}, response.PerMessage)
+		assert.Equal(t, int32(11), response.PromptTokens)
+	})
+
+	t.Run("Rejects invalid bodies", func(t *testing.T) {
+		status, _ := countTokens(`{"model": `)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+}
+
+func TestHandleChatCompletionsModelField(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model-001", OtherNames: []string{"fake-model"}}}},
+		}},
+	}
+
+	chatCompletions := func(proxy *ModelProxy, body string) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder, decodeChatCompletion(recorder)
+	}
+
+	t.Run("Echoes the requested model", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		recorder, response := chatCompletions(proxy, `{"model": "unknown, fake-model", "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "fake-model", response.Model)
+		assert.Equal(t, "fake/fake/fake-model-001", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Keeps the served model", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{provider: "fake", region: "fake"})
+		proxy.config.EchoRequestedModel = utils.ToPtr(false)
+
+		recorder, response := chatCompletions(proxy, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "fake-model-001", response.Model)
+		assert.Equal(t, "fake/fake/fake-model-001", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Reports the served model of cached responses", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "fake", region: "fake"}
+		proxy := newTestProxy(t, providers, endpoint)
+		body := `{"model": "fake-model", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+
+		chatCompletions(proxy, body)
+		recorder, response := chatCompletions(proxy, body)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, endpoint.receivedRequests(), 1)
+		assert.Equal(t, "fake-model", response.Model)
+		assert.Equal(t, "fake/fake/fake-model-001", recorder.Header().Get("X-Ogem-Resolved-Model"))
+	})
+
+	t.Run("Rejects requests the provider finds invalid", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{provider: "fake", region: "fake", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return nil, provider.NewInvalidRequestError(errors.New("arguments of tool call call_1 must be a JSON object"))
+		}})
+
+		recorder, _ := chatCompletions(proxy, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "arguments of tool call call_1 must be a JSON object")
+	})
+}
+
+func TestFallbackChainSkipsDisabledModels(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"vertex": {Regions: map[string]*ogem.RegionStatus{
+			"us-central1": {Models: []*ogem.SupportedModel{{Name: "gemini-1.5-pro"}}},
+		}},
+		"openai": {Regions: map[string]*ogem.RegionStatus{
+			"openai": {Models: []*ogem.SupportedModel{{Name: "gpt-4o"}}},
+		}},
+	}
+	newProxy := func(t *testing.T) (*ModelProxy, *fakeEndpoint, *fakeEndpoint) {
+		vertex := &fakeEndpoint{provider: "vertex", region: "us-central1"}
+		gpt := &fakeEndpoint{provider: "openai", region: "openai"}
+		proxy := newTestProxy(t, providers, vertex, gpt)
+		proxy.retryInterval = time.Millisecond
+		return proxy, vertex, gpt
+	}
+	chatCompletions := func(proxy *ModelProxy, model string) *httptest.ResponseRecorder {
+		body := `{"model": "` + model + `", "messages": [{"role": "user", "content": "Hi"}]}`
+		return sendChatCompletions(proxy, body, map[string]string{"X-Ogem-Debug-Routing": "true"}, nil)
+	}
+
+	t.Run("Moves on to the next model without waiting", func(t *testing.T) {
+		proxy, vertex, gpt := newProxy(t)
+		proxy.stateManager.Disable(context.Background(), "vertex", "us-central1", "gemini-1.5-pro", time.Hour)
+
+		started := time.Now()
+		recorder := chatCompletions(proxy, "gemini-1.5-pro,gpt-4o")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Less(t, time.Since(started), time.Second)
+		assert.Equal(t, "openai/openai/gpt-4o", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Empty(t, vertex.receivedRequests())
+		assert.Len(t, gpt.receivedRequests(), 1)
+
+		var trace RoutingTrace
+		assert.NoError(t, json.Unmarshal([]byte(recorder.Header().Get("X-Ogem-Routing-Trace")), &trace))
+		assert.Equal(t, "disabled", trace.Models[0].Candidates[0].Skipped)
+		assert.Empty(t, trace.Models[0].Attempts)
+	})
+
+	t.Run("Tries the model with a rate limited endpoint", func(t *testing.T) {
+		proxy, vertex, gpt := newProxy(t)
+		accepted, _, err := proxy.stateManager.Allow(context.Background(), "vertex", "us-central1", "gemini-1.5-pro", time.Millisecond, 1)
+		assert.NoError(t, err)
+		assert.True(t, accepted)
+
+		recorder := chatCompletions(proxy, "gemini-1.5-pro,gpt-4o")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "vertex/us-central1/gemini-1.5-pro", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Len(t, vertex.receivedRequests(), 1)
+		assert.Empty(t, gpt.receivedRequests())
+	})
+
+	t.Run("Keeps the last model waiting for its endpoints", func(t *testing.T) {
+		proxy, _, gpt := newProxy(t)
+		proxy.stateManager.Disable(context.Background(), "openai", "openai", "gpt-4o", 20*time.Millisecond)
+
+		recorder := chatCompletions(proxy, "gpt-4o")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, gpt.receivedRequests(), 1)
+	})
+}
+
+// Fails every response, which must only be logged.
+type failingHook struct{}
+
+func (failingHook) PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	return nil
+}
+
+func (failingHook) PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error {
+	return errors.New("broken hook")
+}
+
+// Records the name of the API key that the hooks see.
+type keyNameHook struct {
+	names []string
+}
+
+func (h *keyNameHook) PreRequest(ctx context.Context, request *openai.ChatCompletionRequest) error {
+	h.names = append(h.names, hooks.KeyName(ctx))
+	return nil
+}
+
+func (h *keyNameHook) PostResponse(ctx context.Context, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) error {
+	h.names = append(h.names, hooks.KeyName(ctx))
+	return nil
+}
+
+func TestHandleChatCompletionsApiKeyContext(t *testing.T) {
+	var generateKeyName string
+	var generateFound bool
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+		}},
+	}, &fakeEndpoint{provider: "fake", region: "fake", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		var apiKey ApiKey
+		apiKey, generateFound = apiKeyFrom(ctx)
+		generateKeyName = apiKey.Name
+		return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hi")}}}}}, nil
+	}})
+	proxy.config.ApiKeys = []ApiKey{{Name: "search-team", Key: "key-1"}}
+	proxy.indexApiKeys()
+	hook := &keyNameHook{}
+	proxy.AddHook("key_name", hook)
+
+	request := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`))
+	request.Header.Set("Authorization", "Bearer key-1")
+	recorder := httptest.NewRecorder()
+	proxy.HandleAuthentication(proxy.HandleChatCompletions)(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, generateFound)
+	assert.Equal(t, "search-team", generateKeyName)
+	assert.Equal(t, []string{"search-team", "search-team"}, hook.names)
+
+	t.Run("Reports a missing key without panicking", func(t *testing.T) {
+		_, found := apiKeyFrom(context.WithValue(context.Background(), apiKeyContextKey{}, "search-team"))
+		assert.False(t, found)
+		assert.Empty(t, apiKeyName(context.Background()))
+	})
+}
+
+func TestHandleChatCompletionsHooks(t *testing.T) {
+	chatCompletions := func(proxy *ModelProxy, apiKey ApiKey, body string) *httptest.ResponseRecorder {
+		return sendChatCompletions(proxy, body, nil, &apiKey)
+	}
+	newProxy := func(t *testing.T, config string) (*ModelProxy, *fakeEndpoint) {
+		var configs []hooks.Config
+		assert.NoError(t, yaml.Unmarshal([]byte(config), &configs))
+		chain, err := hooks.NewChain(configs, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, nil)
+		proxy.hooks = chain
+		return proxy, endpoint
+	}
+	config := `
+- name: system_prompt
+  settings:
+    prompt: Never share the personal data of the guests.
+- name: tool_allowlist
+  keys: [partner]
+  settings:
+    tools: [search_hotels]
+`
+
+	t.Run("Transforms the request before it is routed", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, config)
+
+		recorder := chatCompletions(proxy, ApiKey{Name: "partner"}, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}], "tools": [
+			{"type": "function", "function": {"name": "search_hotels"}},
+			{"type": "function", "function": {"name": "cancel_reservation"}}
+		]}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		sent := endpoint.receivedRequests()[0]
+		assert.Equal(t, "Never share the personal data of the guests.", *sent.Messages[0].Content.String)
+		assert.Len(t, sent.Tools, 1)
+		assert.Equal(t, "search_hotels", sent.Tools[0].Function.Name)
+
+		recorder = chatCompletions(proxy, ApiKey{Name: "search-team"}, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}], "tools": [
+			{"type": "function", "function": {"name": "cancel_reservation"}}
+		]}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, endpoint.receivedRequests()[1].Tools, 1)
+	})
+
+	t.Run("Rejects the request on an error of a hook", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, config)
+
+		recorder := chatCompletions(proxy, ApiKey{Name: "partner"}, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}],
+			"tools": [{"type": "function", "function": {"name": "cancel_reservation"}}],
+			"tool_choice": {"type": "function", "function": {"name": "cancel_reservation"}}}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "tool_allowlist: tool cancel_reservation is not allowed")
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+
+	t.Run("Returns the response despite an error of a hook", func(t *testing.T) {
+		proxy, _ := newProxy(t, config)
+		proxy.AddHook("failing", failingHook{})
+
+		recorder := chatCompletions(proxy, ApiKey{Name: "partner"}, `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
+
+func TestHandleChatCompletionsIntegerFields(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+		}},
+	}
+
+	chatCompletions := func(proxy *ModelProxy, fields string) (int, openai.ErrorResponse) {
+		body := `{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}], ` + fields + `}`
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		var response openai.ErrorResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	t.Run("Accepts integral floats and 64-bit seeds", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "fake", region: "fake"}
+		proxy := newTestProxy(t, providers, endpoint)
+
+		status, _ := chatCompletions(proxy, `"max_tokens": 1024.0, "n": 1e0, "seed": 9007199254740993`)
+		assert.Equal(t, http.StatusOK, status)
+		requests := endpoint.receivedRequests()
+		assert.Len(t, requests, 1)
+		assert.Equal(t, int32(1024), *requests[0].MaxTokens)
+		assert.Equal(t, int32(1), *requests[0].CandidateCount)
+		assert.Equal(t, int64(9007199254740993), *requests[0].Seed)
+	})
+
+	t.Run("Names the field of an invalid value", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{provider: "fake", region: "fake"})
+
+		status, response := chatCompletions(proxy, `"max_tokens": 1024.5`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "Invalid request body: max_tokens must be an integer, got 1024.5", response.Error.Message)
+
+		status, response = chatCompletions(proxy, `"max_completion_tokens": 2147483648`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, response.Error.Message, "max_completion_tokens must be between 1 and 2147483647")
+	})
+}
+
+func TestHandleChatCompletionsMessageValidation(t *testing.T) {
+	endpoint := &fakeEndpoint{provider: "fake", region: "fake"}
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+		}},
+	}, endpoint)
+
+	body := `{"model": "fake-model", "messages": [{"role": "user", "content": " "}, {"role": "tool", "tool_call_id": "call_1", "content": "Sunny"}]}`
+	recorder := sendChatCompletions(proxy, body, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	var response openai.ErrorResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(t, "invalid_messages", response.Error.Code)
+	assert.Equal(t, `Invalid messages: messages[0].content must not be empty; messages[1].tool_call_id must be the id of a tool call of an earlier assistant message, got "call_1"`, response.Error.Message)
+	assert.Empty(t, endpoint.receivedRequests())
+}
+
+func TestReasoningModels(t *testing.T) {
+	endpoint := &fakeEndpoint{provider: "fake", region: "fake"}
+	proxy := newTestProxy(t, ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{
+				{Name: "o3", Reasoning: true},
+				{Name: "gpt-4o"},
+			}},
+		}},
+	}, endpoint)
+
+	newRequest := func(model string) *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{
+			Model:            model,
+			Messages:         []openai.Message{userMessage("Hello")},
+			Temperature:      utils.ToPtr(float32(0.7)),
+			TopP:             utils.ToPtr(float32(0.9)),
+			PresencePenalty:  utils.ToPtr(float32(0.1)),
+			FrequencyPenalty: utils.ToPtr(float32(0.1)),
+			MaxTokens:        utils.ToPtr(int32(100)),
+			ReasoningEffort:  utils.ToPtr("high"),
+		}
+	}
+
+	_, _, err := proxy.generateChatCompletion(context.Background(), newRequest("o3"), false)
+	assert.NoError(t, err)
+	_, _, err = proxy.generateChatCompletion(context.Background(), newRequest("gpt-4o"), false)
+	assert.NoError(t, err)
+
+	requests := endpoint.receivedRequests()
+	assert.Len(t, requests, 2)
+
+	t.Run("Strips sampling parameters", func(t *testing.T) {
+		reasoningRequest := requests[0]
+		assert.Nil(t, reasoningRequest.Temperature)
+		assert.Nil(t, reasoningRequest.TopP)
+		assert.Nil(t, reasoningRequest.PresencePenalty)
+		assert.Nil(t, reasoningRequest.FrequencyPenalty)
+		assert.Nil(t, reasoningRequest.MaxTokens)
+		assert.Equal(t, int32(100), *reasoningRequest.MaxCompletionTokens)
+		assert.Equal(t, "high", *reasoningRequest.ReasoningEffort)
+	})
+
+	t.Run("Keeps parameters of other models", func(t *testing.T) {
+		assert.Equal(t, float32(0.7), *requests[1].Temperature)
+		assert.Equal(t, int32(100), *requests[1].MaxTokens)
+		assert.Nil(t, requests[1].MaxCompletionTokens)
+	})
+}
+
+func TestNewGoogleAuth(t *testing.T) {
+	writeKeyFile := func(t *testing.T, project string) string {
+		key := fmt.Sprintf(`{
+			"type": "service_account",
+			"project_id": %q,
+			"private_key_id": "key-1",
+			"private_key": "unused",
+			"client_email": "ogem@%s.iam.gserviceaccount.com",
+			"token_uri": "http://127.0.0.1/token"
+		}`, project, project)
+		path := filepath.Join(t.TempDir(), "key.json")
+		assert.NoError(t, os.WriteFile(path, []byte(key), 0o600))
+		return path
+	}
+	config := &Config{GoogleCloudProject: "global-project"}
+
+	t.Run("Prefers the project of the provider", func(t *testing.T) {
+		auth, err := newGoogleAuth(ogem.ProviderStatus{
+			GoogleCloudProject: "provider-project",
+			CredentialsFile:    writeKeyFile(t, "key-project"),
+		}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, "provider-project", auth.project)
+	})
+
+	t.Run("Falls back to the project of the key file", func(t *testing.T) {
+		auth, err := newGoogleAuth(ogem.ProviderStatus{CredentialsFile: writeKeyFile(t, "key-project")}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, "key-project", auth.project)
+	})
+
+	t.Run("Falls back to the global project", func(t *testing.T) {
+		auth, err := newGoogleAuth(ogem.ProviderStatus{CredentialsFile: writeKeyFile(t, "")}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, "global-project", auth.project)
+	})
+
+	t.Run("Fails without a project", func(t *testing.T) {
+		_, err := newGoogleAuth(ogem.ProviderStatus{CredentialsFile: writeKeyFile(t, "")}, &Config{})
+		assert.ErrorContains(t, err, "google_cloud_project is required")
+	})
+}
+
+func TestDisableDuration(t *testing.T) {
+	providers := ogem.ProvidersStatus{
+		"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: []*ogem.SupportedModel{{Name: "fake-model"}}},
+		}},
+	}
+	request := &openai.ChatCompletionRequest{
+		Model:    "fake-model",
+		Messages: []openai.Message{userMessage("Hello")},
+	}
+
+	// Sends a request and returns how long the endpoint has been disabled for.
+	disabledFor := func(t *testing.T, proxy *ModelProxy) time.Duration {
+		proxy.generateChatCompletion(context.Background(), request, false)
+		wait, err := proxy.stateManager.Peek(context.Background(), "fake", "fake", "fake-model")
+		assert.NoError(t, err)
+		// Forgets the disabling so that the next request reaches the endpoint.
+		proxy.stateManager.Disable(context.Background(), "fake", "fake", "fake-model", 0)
+		return wait
+	}
+
+	t.Run("Uses the retry hint of the provider", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{
+			provider: "fake",
+			region:   "fake",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, provider.NewQuotaError(fmt.Errorf("quota"), 5*time.Minute)
+			},
+		})
+
+		assert.InDelta(t, 5*time.Minute, disabledFor(t, proxy), float64(time.Second))
+	})
+
+	t.Run("Caps the retry hint of the provider", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{
+			provider: "fake",
+			region:   "fake",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, provider.NewQuotaError(fmt.Errorf("daily quota"), 5*time.Hour)
+			},
+		})
+		proxy.maxDisableDuration = 3 * time.Minute
+
+		assert.InDelta(t, 3*time.Minute, disabledFor(t, proxy), float64(time.Second))
+	})
+
+	t.Run("Backs off exponentially without a hint", func(t *testing.T) {
+		failing := true
+		proxy := newTestProxy(t, providers, &fakeEndpoint{
+			provider: "fake",
+			region:   "fake",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				if failing {
+					return nil, fmt.Errorf("429 Too Many Requests")
+				}
+				return &openai.ChatCompletionResponse{Choices: []openai.Choice{{FinishReason: "stop"}}}, nil
+			},
+		})
+		proxy.maxDisableDuration = 3 * time.Minute
+
+		for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+			assert.InDelta(t, expected, disabledFor(t, proxy), float64(time.Second))
+		}
+
+		// A successful request resets the backoff.
+		failing = false
+		disabledFor(t, proxy)
+		failing = true
+		assert.InDelta(t, time.Minute, disabledFor(t, proxy), float64(time.Second))
+	})
+
+	t.Run("Stops doubling at the cap", func(t *testing.T) {
+		proxy := newTestProxy(t, providers, &fakeEndpoint{
+			provider: "fake",
+			region:   "fake",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, fmt.Errorf("429 Too Many Requests")
+			},
+		})
+		proxy.maxDisableDuration = 3 * time.Minute
+
+		for range 100 {
+			disabledFor(t, proxy)
+		}
+		assert.Equal(t, map[string]time.Duration{"fake:fake:fake-model": 3 * time.Minute}, proxy.disableBackoff)
+		assert.InDelta(t, 3*time.Minute, disabledFor(t, proxy), float64(time.Second))
+	})
+
+	t.Run("Uses the default cap for zero", func(t *testing.T) {
+		stateManager, cleanup := state.NewMemoryManager(1024 * 1024)
+		t.Cleanup(cleanup)
+		config := Config{
+			Port:               8080,
+			RetryInterval:      "1ms",
+			PingInterval:       "1h",
+			MaxDisableDuration: "0",
+			Providers:          providers,
+		}
+		assert.NoError(t, config.Validate())
+		proxy, err := NewProxyServer(stateManager, cleanup, config, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+
+		assert.Equal(t, defaultMaxDisableDuration, proxy.maxDisableDuration)
+	})
+}
+
+func TestErrorClassFailover(t *testing.T) {
+	models := []*ogem.SupportedModel{{Name: "fake-model", MaxRequestsPerMinute: 600_000_000}}
+	request := &openai.ChatCompletionRequest{Model: "fake-model", Messages: []openai.Message{userMessage("Hi")}}
+
+	// Sends a request to the preferred endpoint failing with the error, and
+	// returns the resolved model, whether it has been disabled, and the error.
+	send := func(t *testing.T, failure error) (string, bool, error) {
+		preferred := &fakeEndpoint{
+			provider: "fake",
+			region:   "preferred",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, failure
+			},
+		}
+		fallback := &fakeEndpoint{provider: "fake", region: "fallback"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: map[string]*ogem.RegionStatus{
+			"preferred": {Priority: 1, Models: models},
+			"fallback":  {Models: models},
+		}}}, preferred, fallback)
+
+		_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request, false)
+		wait, peekErr := proxy.stateManager.Peek(context.Background(), "fake", "preferred", "fake-model")
+		assert.NoError(t, peekErr)
+		return resolvedModel, wait > time.Second, err
+	}
+
+	t.Run("Rate limit without quota words disables the endpoint", func(t *testing.T) {
+		resolvedModel, disabled, err := send(t, provider.NewProviderError(http.StatusTooManyRequests, "", errors.New("rate limit reached")))
+		assert.NoError(t, err)
+		assert.Equal(t, "fake/fallback/fake-model", resolvedModel)
+		assert.True(t, disabled)
+	})
+
+	t.Run("Transient error fails over without disabling", func(t *testing.T) {
+		resolvedModel, disabled, err := send(t, provider.NewProviderError(529, "overloaded_error", errors.New("Overloaded")))
+		assert.NoError(t, err)
+		assert.Equal(t, "fake/fallback/fake-model", resolvedModel)
+		assert.False(t, disabled)
+	})
+
+	t.Run("Transient errors are retried a limited number of times", func(t *testing.T) {
+		failing := &fakeEndpoint{
+			provider: "fake",
+			region:   "fake",
+			generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, provider.NewProviderError(http.StatusServiceUnavailable, "", errors.New("upstream unavailable"))
+			},
+		}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: map[string]*ogem.RegionStatus{
+			"fake": {Models: models},
+		}}}, failing)
+
+		// The only model of the request keeps retrying its endpoints, unlike
+		// the models earlier in a chain.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+			`{"model": "fake-model", "messages": [{"role": "user", "content": "Hi"}]}`,
+		)).WithContext(ctx))
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		assert.Len(t, failing.receivedRequests(), 1+maxTransientRetries)
+	})
+
+	t.Run("Bad request with quota words is rejected", func(t *testing.T) {
+		_, disabled, err := send(t, provider.NewProviderError(http.StatusBadRequest, "invalid_request_error", errors.New("prompt exceeded maximum length")))
+		assert.IsType(t, BadRequestError{}, err)
+		assert.ErrorContains(t, err, "prompt exceeded maximum length")
+		assert.False(t, disabled)
+	})
+
+	t.Run("Auth error is not retried", func(t *testing.T) {
+		_, disabled, err := send(t, provider.NewProviderError(http.StatusUnauthorized, "authentication_error", errors.New("invalid x-api-key")))
+		assert.IsType(t, InternalServerError{}, err)
+		assert.False(t, disabled)
+	})
+}
+
+func TestHandleAuthentication(t *testing.T) {
+	// Returns the status code and the key name seen by the handler.
+	authenticate := func(proxy *ModelProxy, admin bool, authorization string) (int, string) {
+		var keyName string
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			keyName = apiKeyName(r.Context())
+		}
+		wrapped := proxy.HandleAuthentication(handler)
+		if admin {
+			wrapped = proxy.HandleAdminAuthentication(handler)
+		}
+
+		request := httptest.NewRequest("GET", "/", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		wrapped(recorder, request)
+		return recorder.Code, keyName
+	}
+
+	t.Run("Accepts any configured key", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "old-search", Key: "key-1"},
+			{Name: "new-search", Key: "key-2"},
+		}
+		proxy.indexApiKeys()
+
+		status, keyName := authenticate(proxy, false, "Bearer key-1")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "old-search", keyName)
+
+		status, keyName = authenticate(proxy, false, "bearer key-2")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "new-search", keyName)
+
+		status, _ = authenticate(proxy, false, "Bearer key-3")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		status, _ = authenticate(proxy, false, "Bearer ")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		status, _ = authenticate(proxy, false, "")
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Gates admin endpoints", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "ops", Key: "admin-key", Admin: true},
+			{Name: "search", Key: "user-key"},
+		}
+		proxy.indexApiKeys()
+
+		status, keyName := authenticate(proxy, true, "Bearer admin-key")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "ops", keyName)
+
+		status, _ = authenticate(proxy, true, "Bearer user-key")
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Legacy single key is an admin key", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+		proxy.config.OgemApiKey = "legacy-key"
+		proxy.config.ApiKeys = []ApiKey{{Name: "search", Key: "user-key"}}
+		proxy.indexApiKeys()
+
+		status, keyName := authenticate(proxy, true, "Bearer legacy-key")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "", keyName)
+
+		status, _ = authenticate(proxy, false, "Bearer user-key")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("No keys disable authentication", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+
+		status, _ := authenticate(proxy, true, "")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Finds the key among many", func(t *testing.T) {
+		proxy := newTestProxy(t, ogem.ProvidersStatus{})
+		proxy.config.ApiKeys = manyApiKeys(10_000)
+		proxy.config.ApiKeys[9_999].ExpiresAt = "2000-01-01T00:00:00Z"
+		proxy.indexApiKeys()
+
+		status, keyName := authenticate(proxy, false, "Bearer key-5000")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "team-5000", keyName)
+
+		status, _ = authenticate(proxy, false, "Bearer key-9999")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		status, _ = authenticate(proxy, false, "Bearer key-10000")
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+}
+
+func manyApiKeys(count int) []ApiKey {
+	apiKeys := make([]ApiKey, count)
+	for index := range apiKeys {
+		apiKeys[index] = ApiKey{Name: fmt.Sprintf("team-%d", index), Key: fmt.Sprintf("key-%d", index)}
+	}
+	return apiKeys
+}
+
+func BenchmarkHandleAuthentication(b *testing.B) {
+	stateManager, cleanup := state.NewMemoryManager(1024 * 1024)
+	b.Cleanup(cleanup)
+	proxy := &ModelProxy{
+		stateManager: stateManager,
+		revokedKeys:  make(map[string]bool),
+		logger:       zap.NewNop().Sugar(),
+	}
+	proxy.config.ApiKeys = manyApiKeys(10_000)
+	proxy.indexApiKeys()
+	handler := proxy.HandleAuthentication(func(w http.ResponseWriter, r *http.Request) {})
+
+	// The last key is the slowest to find by scanning the keys.
+	request := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	request.Header.Set("Authorization", "Bearer key-9999")
+	b.ResetTimer()
+	for range b.N {
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("status %d", recorder.Code)
+		}
+	}
+}
+
+func TestHandleAuthenticationCombinations(t *testing.T) {
+	headers := map[string]string{
+		"absent":      "",
+		"empty token": "Bearer ",
+		"wrong key":   "Bearer wrong-key",
+		"master key":  "Bearer master-key",
+		"named key":   "Bearer named-key",
+	}
+
+	tests := []struct {
+		masterKey     bool
+		namedKeys     bool
+		header        string
+		expectedCode  int
+		expectedError string
+	}{
+		{false, false, "absent", http.StatusOK, ""},
+		{false, false, "empty token", http.StatusOK, ""},
+		{false, false, "wrong key", http.StatusOK, ""},
+		{true, false, "absent", http.StatusUnauthorized, "missing_api_key"},
+		{true, false, "empty token", http.StatusUnauthorized, "invalid_authorization"},
+		{true, false, "wrong key", http.StatusUnauthorized, "invalid_api_key"},
+		{true, false, "master key", http.StatusOK, ""},
+		{true, false, "named key", http.StatusUnauthorized, "invalid_api_key"},
+		{false, true, "absent", http.StatusUnauthorized, "missing_api_key"},
+		{false, true, "empty token", http.StatusUnauthorized, "invalid_authorization"},
+		{false, true, "wrong key", http.StatusUnauthorized, "invalid_api_key"},
+		{false, true, "master key", http.StatusUnauthorized, "invalid_api_key"},
+		{false, true, "named key", http.StatusOK, ""},
+		{true, true, "absent", http.StatusUnauthorized, "missing_api_key"},
+		{true, true, "empty token", http.StatusUnauthorized, "invalid_authorization"},
+		{true, true, "wrong key", http.StatusUnauthorized, "invalid_api_key"},
+		{true, true, "master key", http.StatusOK, ""},
+		{true, true, "named key", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprintf("master key %v, named keys %v, header %s", test.masterKey, test.namedKeys, test.header)
+		t.Run(name, func(t *testing.T) {
+			proxy := newTestProxy(t, ogem.ProvidersStatus{})
+			if test.masterKey {
+				proxy.config.OgemApiKey = "master-key"
+			}
+			if test.namedKeys {
+				proxy.config.ApiKeys = []ApiKey{{Name: "named", Key: "named-key"}}
+			}
+			proxy.indexApiKeys()
+
+			request := httptest.NewRequest("GET", "/", nil)
+			if headers[test.header] != "" {
+				request.Header.Set("Authorization", headers[test.header])
+			}
+			recorder := httptest.NewRecorder()
+			proxy.HandleAuthentication(func(w http.ResponseWriter, r *http.Request) {})(recorder, request)
+
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			if test.expectedError == "" {
+				return
+			}
+			var response openai.ErrorResponse
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+			assert.Equal(t, "authentication_error", response.Error.Type)
+			assert.Equal(t, test.expectedError, response.Error.Code)
+			assert.NotEmpty(t, response.Error.Message)
+		})
+	}
+}
+
+func TestSortedEndpoints(t *testing.T) {
+	models := []*ogem.SupportedModel{{Name: "fake-model"}}
+	newProxy := func(t *testing.T, regions map[string]*ogem.RegionStatus) *ModelProxy {
+		endpoints := []provider.AiEndpoint{}
+		for region := range regions {
+			endpoints = append(endpoints, &fakeEndpoint{provider: "fake", region: region})
+		}
+		return newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: regions}}, endpoints...)
+	}
+	regionsOf := func(endpoints []*endpointStatus) []string {
+		regions := []string{}
+		for _, endpoint := range endpoints {
+			regions = append(regions, endpoint.endpoint.Region())
+		}
+		return regions
+	}
+
+	t.Run("Spreads the first position among equal latencies", func(t *testing.T) {
+		now := time.Now()
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"a":    {Latency: 10 * time.Millisecond, LastChecked: now, Models: models},
+			"b":    {Latency: 10 * time.Millisecond, LastChecked: now, Models: models},
+			"c":    {Latency: 10 * time.Millisecond, LastChecked: now, Models: models},
+			"slow": {Latency: 20 * time.Millisecond, LastChecked: now, Models: models},
+		})
+
+		firsts := map[string]int{}
+		for range 1000 {
+			endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+			assert.NoError(t, err)
+			assert.Equal(t, "slow", endpoints[3].endpoint.Region())
+			firsts[endpoints[0].endpoint.Region()]++
+		}
+		for _, region := range []string{"a", "b", "c"} {
+			assert.InDelta(t, 333, firsts[region], 60, "region %s", region)
+		}
+	})
+
+	t.Run("Puts the endpoints that are not pinged last", func(t *testing.T) {
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"new-1":  {Models: models},
+			"new-2":  {Models: models},
+			"pinged": {Latency: time.Second, LastChecked: time.Now(), Models: models},
+		})
+
+		unpingedFirsts := map[string]int{}
+		for range 100 {
+			endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+			assert.NoError(t, err)
+			assert.Equal(t, "pinged", endpoints[0].endpoint.Region())
+			unpingedFirsts[endpoints[1].endpoint.Region()]++
+		}
+		assert.Greater(t, unpingedFirsts["new-1"], 0)
+		assert.Greater(t, unpingedFirsts["new-2"], 0)
+	})
+
+	t.Run("Puts the unhealthy endpoints after the ones not pinged", func(t *testing.T) {
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"failing": {Latency: time.Millisecond, LastChecked: time.Now(), LastError: "down", Models: models},
+			"new":     {Models: models},
+			"healthy": {Latency: time.Second, LastChecked: time.Now(), Models: models},
+		})
+
+		for range 10 {
+			endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"healthy", "new", "failing"}, regionsOf(endpoints))
+		}
+	})
+
+	t.Run("Distributes the first position by weight", func(t *testing.T) {
+		now := time.Now()
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"vertex": {Latency: 20 * time.Millisecond, LastChecked: now, Weight: 80, Models: models},
+			"openai": {Latency: 10 * time.Millisecond, LastChecked: now, Weight: 20, Models: models},
+		})
+
+		firsts := map[string]int{}
+		for range 1000 {
+			endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+			assert.NoError(t, err)
+			firsts[endpoints[0].endpoint.Region()]++
+		}
+		assert.InDelta(t, 800, firsts["vertex"], 60)
+		assert.InDelta(t, 200, firsts["openai"], 60)
+	})
+
+	t.Run("Tries higher priorities first", func(t *testing.T) {
+		now := time.Now()
+		proxy := newProxy(t, map[string]*ogem.RegionStatus{
+			"fast":      {Latency: 10 * time.Millisecond, LastChecked: now, Models: models},
+			"preferred": {Latency: 30 * time.Millisecond, LastChecked: now, Priority: 1, Models: models},
+			"new":       {Priority: 1, Models: models},
+			"failing":   {LastChecked: now, LastError: "down", Priority: 2, Models: models},
+		})
+
+		endpoints, err := proxy.sortedEndpoints("", "", "fake-model")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"preferred", "new", "fast", "failing"}, regionsOf(endpoints))
+	})
+
+	t.Run("Is deterministic under a seeded random source", func(t *testing.T) {
+		regions := map[string]*ogem.RegionStatus{
+			"a": {Models: models},
+			"b": {Models: models},
+			"c": {Models: models},
+			"d": {Models: models},
+		}
+		first := newProxy(t, regions)
+		second := newProxy(t, regions)
+		for range 10 {
+			firstEndpoints, _ := first.sortedEndpoints("", "", "fake-model")
+			secondEndpoints, _ := second.sortedEndpoints("", "", "fake-model")
+			assert.Equal(t, regionsOf(firstEndpoints), regionsOf(secondEndpoints))
+		}
+	})
+}
+
+func TestPrioritySpillOver(t *testing.T) {
+	models := []*ogem.SupportedModel{{Name: "fake-model", MaxRequestsPerMinute: 600_000_000}}
+	newProxy := func(t *testing.T) (*ModelProxy, *fakeEndpoint, *fakeEndpoint) {
+		preferred := &fakeEndpoint{provider: "fake", region: "preferred"}
+		fallback := &fakeEndpoint{provider: "fake", region: "fallback"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: map[string]*ogem.RegionStatus{
+			"preferred": {Latency: time.Second, LastChecked: time.Now(), Priority: 1, Models: models},
+			"fallback":  {Latency: time.Millisecond, LastChecked: time.Now(), Models: models},
+		}}}, preferred, fallback)
+		return proxy, preferred, fallback
+	}
+	request := func() *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{Model: "fake-model", Messages: []openai.Message{userMessage("Hi")}}
+	}
+
+	t.Run("Stays on the higher priority while it is available", func(t *testing.T) {
+		proxy, preferred, fallback := newProxy(t)
+		for range 5 {
+			_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request(), false)
+			assert.NoError(t, err)
+			assert.Equal(t, "fake/preferred/fake-model", resolvedModel)
+		}
+		assert.Len(t, preferred.receivedRequests(), 5)
+		assert.Empty(t, fallback.receivedRequests())
+	})
+
+	t.Run("Spills over when the higher priority is disabled", func(t *testing.T) {
+		proxy, preferred, _ := newProxy(t)
+		proxy.stateManager.Disable(context.Background(), "fake", "preferred", "fake-model", time.Minute)
+
+		_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request(), false)
+		assert.NoError(t, err)
+		assert.Equal(t, "fake/fallback/fake-model", resolvedModel)
+		assert.Empty(t, preferred.receivedRequests())
+	})
+
+	t.Run("Spills over when the higher priority is unhealthy", func(t *testing.T) {
+		proxy, preferred, _ := newProxy(t)
+		proxy.updateEndpointStatus("fake", "preferred", 0, errors.New("connection refused"))
+
+		_, resolvedModel, err := proxy.generateChatCompletion(context.Background(), request(), false)
+		assert.NoError(t, err)
+		assert.Equal(t, "fake/fallback/fake-model", resolvedModel)
+		assert.Empty(t, preferred.receivedRequests())
+	})
+}
+
+func TestUnavailableNotifications(t *testing.T) {
+	events := make(chan notify.Event, 8)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+
+	newProxy := func(t *testing.T, generate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)) *ModelProxy {
+		proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, generate)
+		notifier, err := notify.NewDispatcher(notify.Config{Webhooks: []notify.WebhookConfig{{Url: receiver.URL}}}, zap.NewNop().Sugar())
+		assert.NoError(t, err)
+		t.Cleanup(notifier.Shutdown)
+		proxy.notifier = notifier
+		return proxy
+	}
+	request := func(model string) *openai.ChatCompletionRequest {
+		return &openai.ChatCompletionRequest{Model: model, Messages: []openai.Message{userMessage("Hi")}}
+	}
+
+	t.Run("Unknown models are not notified", func(t *testing.T) {
+		proxy := newProxy(t, nil)
+
+		_, _, err := proxy.generateChatCompletion(context.Background(), request("fake-modle"), false)
+		assert.IsType(t, UnavailableError{}, err)
+		select {
+		case event := <-events:
+			t.Fatalf("unexpected notification: %+v", event)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("Notifies once the endpoints are exhausted", func(t *testing.T) {
+		proxy := newProxy(t, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return nil, provider.NewProviderError(http.StatusServiceUnavailable, "", errors.New("upstream unavailable"))
+		})
+
+		_, _, err := proxy.generateChatCompletion(context.Background(), request("fake-model"), true)
+		assert.IsType(t, UnavailableError{}, err)
+		select {
+		case event := <-events:
+			assert.Equal(t, notify.EventEndpointsUnavailable, event.Type)
+			assert.Equal(t, "fake-model", event.Model)
+		case <-time.After(time.Second):
+			t.Fatal("no notification received")
+		}
+	})
+}
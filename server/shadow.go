@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+type ShadowConfig struct {
+	// Whether to mirror the sampled requests to the shadow model.
+	Enabled bool `yaml:"enabled"`
+
+	// Pattern of the models whose requests are mirrored, matched against the
+	// model of the fallback chain that served the request. E.g., gpt-4o*
+	SourceModel string `yaml:"source_model"`
+
+	// Model that receives the mirrored requests, in any form accepted in
+	// requests. E.g., claude/claude-3-5-sonnet
+	Model string `yaml:"model"`
+
+	// Percentage of the matching requests to mirror, from 0 to 100. E.g., 5
+	Percent float64 `yaml:"percent"`
+
+	// Maximum number of shadow requests at a time. The requests sampled
+	// beyond it are skipped. Zero uses the default.
+	MaxConcurrent int `yaml:"max_concurrent"`
+}
+
+const (
+	// Default maximum number of shadow requests at a time.
+	defaultMaxConcurrentShadows = 4
+
+	// Maximum time of a shadow request, including its waits for the rate
+	// limits of the shadow model.
+	shadowTimeout = 2 * time.Minute
+)
+
+type shadowContextKey struct{}
+
+// Results of the shadow requests since the start of this instance. The
+// primary requests are not included.
+type ShadowStats struct {
+	SourceModel string `json:"source_model"`
+	Model       string `json:"model"`
+
+	// Number of the sampled requests that were mirrored, and that were
+	// skipped at the concurrency limit.
+	Mirrored int64 `json:"mirrored"`
+	Skipped  int64 `json:"skipped"`
+
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+
+	// Finish reason of the first choice -> number of the shadow responses.
+	FinishReasons map[string]int64 `json:"finish_reasons"`
+
+	// Averages over the succeeded requests. Similarity is of the words of the
+	// shadow and primary responses, from 0 (disjoint) to 1 (same words).
+	AverageLatencyMs  int64   `json:"average_latency_ms"`
+	AverageSimilarity float64 `json:"average_similarity"`
+}
+
+// Mirrors a sample of the requests to a candidate model in the background and
+// records how it compares, so that a model can be evaluated on production
+// traffic before it serves it. Nil if shadowing is disabled.
+type shadowMirror struct {
+	config ShadowConfig
+
+	// Holds a value for each running shadow request.
+	slots chan struct{}
+
+	stats           ShadowStats
+	totalLatency    time.Duration
+	totalSimilarity float64
+	statsMutex      sync.Mutex
+}
+
+func newShadowMirror(config ShadowConfig) *shadowMirror {
+	if !config.Enabled {
+		return nil
+	}
+	maxConcurrent := config.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentShadows
+	}
+	return &shadowMirror{
+		config: config,
+		slots:  make(chan struct{}, maxConcurrent),
+		stats: ShadowStats{
+			SourceModel:   config.SourceModel,
+			Model:         config.Model,
+			FinishReasons: map[string]int64{},
+		},
+	}
+}
+
+func withShadow(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shadowContextKey{}, true)
+}
+
+func shadowFrom(ctx context.Context) bool {
+	shadow, _ := ctx.Value(shadowContextKey{}).(bool)
+	return shadow
+}
+
+// The pattern is validated with the config, so an invalid one matches
+// nothing here.
+func (m *shadowMirror) matches(model string) bool {
+	matched, err := path.Match(m.config.SourceModel, model)
+	return err == nil && matched
+}
+
+// Takes a slot for a shadow request. False if all slots are taken.
+func (m *shadowMirror) acquire() bool {
+	select {
+	case m.slots <- struct{}{}:
+		m.statsMutex.Lock()
+		m.stats.Mirrored++
+		m.statsMutex.Unlock()
+		return true
+	default:
+		m.statsMutex.Lock()
+		m.stats.Skipped++
+		m.statsMutex.Unlock()
+		return false
+	}
+}
+
+func (m *shadowMirror) release() {
+	<-m.slots
+}
+
+func (m *shadowMirror) recordSuccess(response *openai.ChatCompletionResponse, latency time.Duration, cost float64, similarity float64) {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+
+	m.stats.Succeeded++
+	m.stats.PromptTokens += int64(response.Usage.PromptTokens)
+	m.stats.CompletionTokens += int64(response.Usage.CompletionTokens)
+	m.stats.Cost += cost
+	if len(response.Choices) > 0 {
+		m.stats.FinishReasons[response.Choices[0].FinishReason]++
+	}
+	m.totalLatency += latency
+	m.totalSimilarity += similarity
+}
+
+func (m *shadowMirror) recordFailure() {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	m.stats.Failed++
+}
+
+func (m *shadowMirror) snapshot() ShadowStats {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+
+	stats := m.stats
+	stats.FinishReasons = make(map[string]int64, len(m.stats.FinishReasons))
+	for reason, count := range m.stats.FinishReasons {
+		stats.FinishReasons[reason] = count
+	}
+	if stats.Succeeded > 0 {
+		stats.AverageLatencyMs = m.totalLatency.Milliseconds() / stats.Succeeded
+		stats.AverageSimilarity = m.totalSimilarity / float64(stats.Succeeded)
+	}
+	return stats
+}
+
+// Whether to mirror a matching request, drawn with the configured percentage.
+func (s *ModelProxy) sampleShadow() bool {
+	s.randomMutex.Lock()
+	defer s.randomMutex.Unlock()
+	return s.random.Float64()*100 < s.shadow.config.Percent
+}
+
+// Sends the request that the model served to the shadow model in the
+// background, if the model matches and the request is sampled. The primary
+// request neither waits for it nor sees its errors. The shadow request is not
+// cached and does not read the cache, but is rate limited as any request to
+// the shadow model.
+func (s *ModelProxy) mirrorToShadow(ctx context.Context, request openai.ChatCompletionRequest, primaryResponse *openai.ChatCompletionResponse, primaryLatency time.Duration) {
+	if s.shadow == nil || !s.shadow.matches(request.Model) || !s.sampleShadow() {
+		return
+	}
+	if !s.shadow.acquire() {
+		s.logger.Infow("Skipped shadow request at the concurrency limit", "model", s.shadow.config.Model)
+		return
+	}
+
+	sourceModel := request.Model
+	request.Model = s.shadow.config.Model
+	activityId := s.activity.startShadow(apiKeyName(ctx), clientIpFrom(ctx), request.Model, labelsFrom(ctx))
+	go func() {
+		defer s.shadow.release()
+
+		shadowCtx, cancel := context.WithTimeout(withShadow(context.Background()), shadowTimeout)
+		defer cancel()
+
+		start := time.Now()
+		response, resolvedModel, err := s.generateChatCompletion(shadowCtx, &request, false)
+		latency := time.Since(start)
+		s.finishActivity(activityId, resolvedModel, response, err)
+		if err != nil {
+			s.shadow.recordFailure()
+			s.logger.Warnw("Shadow request failed", "error", err, "source_model", sourceModel, "shadow_model", request.Model)
+			return
+		}
+
+		cost := 0.0
+		if resolvedModel != "" {
+			cost = responseCost(s.servedModel(resolvedModel), response.Usage)
+		}
+		similarity := textSimilarity(firstChoiceText(primaryResponse), firstChoiceText(response))
+		s.shadow.recordSuccess(response, latency, cost, similarity)
+		s.logger.Infow(
+			"Shadow request completed",
+			"source_model", sourceModel,
+			"shadow_model", request.Model,
+			"resolved_model", resolvedModel,
+			"latency_ms", latency.Milliseconds(),
+			"primary_latency_ms", primaryLatency.Milliseconds(),
+			"finish_reason", firstFinishReason(response),
+			"primary_finish_reason", firstFinishReason(primaryResponse),
+			"prompt_tokens", response.Usage.PromptTokens,
+			"completion_tokens", response.Usage.CompletionTokens,
+			"cost", cost,
+			"similarity", similarity,
+		)
+	}()
+}
+
+func (s *ModelProxy) HandleShadowStats(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	if s.shadow == nil {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "shadow_disabled", "Shadow traffic is not enabled")
+		return
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(s.shadow.snapshot()); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+func firstChoiceText(response *openai.ChatCompletionResponse) string {
+	if len(response.Choices) == 0 {
+		return ""
+	}
+	return contentText(response.Choices[0].Message.Content)
+}
+
+func firstFinishReason(response *openai.ChatCompletionResponse) string {
+	if len(response.Choices) == 0 {
+		return ""
+	}
+	return response.Choices[0].FinishReason
+}
+
+// Returns the Jaccard similarity of the sets of the lowercased words of the
+// texts. 1 if both are empty.
+func textSimilarity(first string, second string) float64 {
+	words := func(text string) map[string]bool {
+		set := map[string]bool{}
+		for _, word := range strings.Fields(strings.ToLower(text)) {
+			set[word] = true
+		}
+		return set
+	}
+	firstWords, secondWords := words(first), words(second)
+	if len(firstWords) == 0 && len(secondWords) == 0 {
+		return 1
+	}
+	common := 0
+	for word := range firstWords {
+		if secondWords[word] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(firstWords)+len(secondWords)-common)
+}
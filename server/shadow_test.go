@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestShadowTraffic(t *testing.T) {
+	newProxy := func(t *testing.T, config ShadowConfig, shadowGenerate func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)) (*ModelProxy, *fakeEndpoint, *fakeEndpoint) {
+		primary := &fakeEndpoint{provider: "openai", region: "openai"}
+		shadow := &fakeEndpoint{provider: "claude", region: "claude", generate: shadowGenerate}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"openai": {Regions: map[string]*ogem.RegionStatus{"openai": {
+				Models: []*ogem.SupportedModel{{Name: "gpt-4o"}, {Name: "gpt-4o-mini"}},
+			}}},
+			"claude": {Regions: map[string]*ogem.RegionStatus{"claude": {
+				Models: []*ogem.SupportedModel{{Name: "claude-3-5-sonnet", InputPrice: 3, OutputPrice: 15}},
+			}}},
+		}, primary, shadow)
+		config.Enabled = true
+		config.Model = "claude-3-5-sonnet"
+		proxy.shadow = newShadowMirror(config)
+		return proxy, primary, shadow
+	}
+	respond := func(delay time.Duration, text string) func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		return func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			time.Sleep(delay)
+			return &openai.ChatCompletionResponse{
+				Model: request.Model,
+				Choices: []openai.Choice{{
+					Message:      openai.Message{Role: "assistant", Content: &openai.MessageContent{String: &text}},
+					FinishReason: "length",
+				}},
+				Usage: openai.Usage{PromptTokens: 1_000_000, CompletionTokens: 0, TotalTokens: 1_000_000},
+			}, nil
+		}
+	}
+	chatCompletions := func(proxy *ModelProxy, model string) *httptest.ResponseRecorder {
+		body := `{"model": "` + model + `", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+		recorder := sendChatCompletions(proxy, body, nil, nil)
+		return recorder
+	}
+
+	t.Run("Primary does not wait for the shadow", func(t *testing.T) {
+		proxy, primary, shadow := newProxy(t, ShadowConfig{SourceModel: "gpt-4o", Percent: 100}, respond(300*time.Millisecond, "gpt-4o"))
+		// Warms up the tokenizer with a model that is not mirrored.
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "gpt-4o-mini").Code)
+
+		start := time.Now()
+		recorder := chatCompletions(proxy, "gpt-4o")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		assert.Len(t, primary.receivedRequests(), 2)
+
+		assert.Eventually(t, func() bool { return proxy.shadow.snapshot().Succeeded == 1 }, time.Second, 10*time.Millisecond)
+		assert.Len(t, shadow.receivedRequests(), 1)
+		assert.Equal(t, "claude-3-5-sonnet", shadow.receivedRequests()[0].Model)
+
+		stats := proxy.shadow.snapshot()
+		assert.Equal(t, int64(1), stats.Mirrored)
+		assert.Equal(t, int64(1_000_000), stats.PromptTokens)
+		assert.Equal(t, 3.0, stats.Cost)
+		assert.Equal(t, map[string]int64{"length": 1}, stats.FinishReasons)
+		assert.GreaterOrEqual(t, stats.AverageLatencyMs, int64(300))
+		// The fake primary answers with its model name.
+		assert.Equal(t, 1.0, stats.AverageSimilarity)
+
+		shadows := []RequestActivity{}
+		for _, activity := range proxy.activity.list(requestSuccess, "", 0) {
+			if activity.Shadow {
+				shadows = append(shadows, activity)
+			}
+		}
+		assert.Len(t, shadows, 1)
+		assert.Equal(t, "claude/claude/claude-3-5-sonnet", shadows[0].Endpoint)
+	})
+
+	t.Run("Shadow failures do not affect the primary", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, ShadowConfig{SourceModel: "gpt-4o", Percent: 100}, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return nil, errors.New("shadow error")
+		})
+
+		recorder := chatCompletions(proxy, "gpt-4o")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Eventually(t, func() bool { return proxy.shadow.snapshot().Failed == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Only matching models are mirrored", func(t *testing.T) {
+		proxy, _, shadow := newProxy(t, ShadowConfig{SourceModel: "gpt-4o", Percent: 100}, nil)
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "gpt-4o-mini").Code)
+		assert.Equal(t, int64(0), proxy.shadow.snapshot().Mirrored)
+		assert.Empty(t, shadow.receivedRequests())
+	})
+
+	t.Run("Skips the requests beyond the concurrency limit", func(t *testing.T) {
+		release := make(chan struct{})
+		proxy, _, _ := newProxy(t, ShadowConfig{SourceModel: "gpt-4o", Percent: 100, MaxConcurrent: 1}, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			<-release
+			return respond(0, "")(ctx, request)
+		})
+
+		for range 3 {
+			assert.Equal(t, http.StatusOK, chatCompletions(proxy, "gpt-4o").Code)
+		}
+		close(release)
+
+		assert.Eventually(t, func() bool { return proxy.shadow.snapshot().Succeeded == 1 }, time.Second, 10*time.Millisecond)
+		stats := proxy.shadow.snapshot()
+		assert.Equal(t, int64(1), stats.Mirrored)
+		assert.Equal(t, int64(2), stats.Skipped)
+	})
+
+	t.Run("Samples the configured percentage", func(t *testing.T) {
+		proxy, _, _ := newProxy(t, ShadowConfig{SourceModel: "*", Percent: 30}, nil)
+
+		sampled := 0
+		for range 10_000 {
+			if proxy.sampleShadow() {
+				sampled++
+			}
+		}
+		assert.InDelta(t, 3_000, sampled, 300)
+	})
+}
+
+func TestTextSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, textSimilarity("", ""))
+	assert.Equal(t, 1.0, textSimilarity("Hello world", "hello  WORLD"))
+	assert.Equal(t, 0.0, textSimilarity("Hello", "Bye"))
+	assert.InDelta(t, 1.0/3, textSimilarity("a b", "b c"), 1e-9)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yanolja/ogem"
+)
+
+const (
+	defaultSloWindow  = 10 * time.Minute
+	defaultSloPenalty = 4
+
+	// Number of latencies below which a region is not judged, so that a few
+	// slow requests after a quiet period do not move the traffic.
+	minSloSamples = 10
+
+	// Number of the latest latencies kept for each region and model, which
+	// bounds the memory of the busy ones.
+	maxSloSamples = 1000
+)
+
+// Latency objective of a model in a region, as reported by the limits
+// endpoint.
+type SloStatus struct {
+	Percentile  float64 `json:"percentile"`
+	ThresholdMs int64   `json:"threshold_ms"`
+
+	// Latency at the percentile over the window, and the number of the
+	// requests that it is taken from.
+	LatencyMs int64 `json:"latency_ms"`
+	Samples   int   `json:"samples"`
+
+	// Whether the region misses the objective and is ranked lower.
+	Breaching bool `json:"breaching"`
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// Latencies of the successful requests of each region and model with a
+// latency objective, over the window of the objective. Only counts the
+// requests of this instance. The zero value is ready to use.
+type sloTracker struct {
+	mutex   sync.Mutex
+	samples map[string][]latencySample
+
+	// Returns the current time. Replaced in tests to age the samples.
+	now func() time.Time
+}
+
+func sloKey(provider string, region string, model string) string {
+	return provider + "/" + region + "/" + model
+}
+
+func (t *sloTracker) currentTime() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// Records the latency of a successful request to the endpoint. Does nothing
+// if its model has no objective.
+func (t *sloTracker) record(endpoint *endpointStatus, latency time.Duration) {
+	if endpoint.modelStatus == nil || endpoint.modelStatus.Slo == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.samples == nil {
+		t.samples = map[string][]latencySample{}
+	}
+	key := sloKey(endpoint.endpoint.Provider(), endpoint.endpoint.Region(), endpoint.modelStatus.Name)
+	samples := append(t.samples[key], latencySample{at: t.currentTime(), latency: latency})
+	if len(samples) > maxSloSamples {
+		samples = slices.Delete(samples, 0, len(samples)-maxSloSamples)
+	}
+	t.samples[key] = samples
+}
+
+// Returns the status of the objective of the model in the region. Nil if the
+// model has none.
+func (t *sloTracker) status(provider string, region string, model *ogem.SupportedModel) *SloStatus {
+	if model == nil || model.Slo == nil {
+		return nil
+	}
+	// The config has been validated.
+	threshold, _ := time.ParseDuration(model.Slo.Threshold)
+	window := defaultSloWindow
+	if model.Slo.Window != "" {
+		window, _ = time.ParseDuration(model.Slo.Window)
+	}
+
+	t.mutex.Lock()
+	key := sloKey(provider, region, model.Name)
+	cutoff := t.currentTime().Add(-window)
+	samples := t.samples[key]
+	firstRecent, _ := slices.BinarySearchFunc(samples, cutoff, func(sample latencySample, cutoff time.Time) int {
+		return sample.at.Compare(cutoff)
+	})
+	samples = samples[firstRecent:]
+	if len(samples) == 0 {
+		delete(t.samples, key)
+	} else {
+		t.samples[key] = samples
+	}
+	latencies := make([]time.Duration, len(samples))
+	for index, sample := range samples {
+		latencies[index] = sample.latency
+	}
+	t.mutex.Unlock()
+
+	status := &SloStatus{Percentile: model.Slo.Percentile, ThresholdMs: threshold.Milliseconds(), Samples: len(latencies)}
+	if len(latencies) == 0 {
+		return status
+	}
+	slices.Sort(latencies)
+	// Nearest rank, so that p95 of 20 latencies is the 19th.
+	rank := int(math.Ceil(model.Slo.Percentile / 100 * float64(len(latencies))))
+	latency := latencies[max(rank, 1)-1]
+	status.LatencyMs = latency.Milliseconds()
+	status.Breaching = len(latencies) >= minSloSamples && latency > threshold
+	return status
+}
+
+// Returns the factor by which the endpoint is ranked lower for missing its
+// latency objective. 1 if it meets it or has none.
+func (t *sloTracker) penalty(endpoint *endpointStatus) float64 {
+	status := t.status(endpoint.endpoint.Provider(), endpoint.endpoint.Region(), endpoint.modelStatus)
+	if status == nil || !status.Breaching {
+		return 1
+	}
+	if endpoint.modelStatus.Slo.Penalty > 0 {
+		return endpoint.modelStatus.Slo.Penalty
+	}
+	return defaultSloPenalty
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestLatencySlo(t *testing.T) {
+	newProxy := func(t *testing.T, slo *ogem.LatencySlo) *ModelProxy {
+		region := func(latency time.Duration) *ogem.RegionStatus {
+			return &ogem.RegionStatus{
+				Latency:     latency,
+				LastChecked: time.Now(),
+				Models:      []*ogem.SupportedModel{{Name: "llama", Slo: slo}},
+			}
+		}
+		return newTestProxy(t, ogem.ProvidersStatus{"vllm": {Regions: map[string]*ogem.RegionStatus{
+			"fast": region(10 * time.Millisecond),
+			"slow": region(30 * time.Millisecond),
+		}}}, &fakeEndpoint{provider: "vllm", region: "fast"}, &fakeEndpoint{provider: "vllm", region: "slow"})
+	}
+	order := func(t *testing.T, proxy *ModelProxy) []string {
+		endpoints, err := proxy.sortedEndpoints("", "", "llama")
+		assert.NoError(t, err)
+		regions := []string{}
+		for _, endpoint := range endpoints {
+			regions = append(regions, endpoint.endpoint.Region())
+		}
+		return regions
+	}
+	// Records the latencies as the requests to the region would.
+	record := func(t *testing.T, proxy *ModelProxy, region string, latencies ...time.Duration) {
+		endpoints, err := proxy.sortedEndpoints("", region, "llama")
+		assert.NoError(t, err)
+		for _, latency := range latencies {
+			proxy.slo.record(endpoints[0], latency)
+		}
+	}
+	repeat := func(latency time.Duration, count int) []time.Duration {
+		latencies := make([]time.Duration, count)
+		for index := range latencies {
+			latencies[index] = latency
+		}
+		return latencies
+	}
+	slo := &ogem.LatencySlo{Percentile: 90, Threshold: "1s", Window: "10m"}
+
+	t.Run("Ranks the breaching region lower until it recovers", func(t *testing.T) {
+		proxy := newProxy(t, slo)
+		now := time.Now()
+		proxy.slo.now = func() time.Time { return now }
+		assert.Equal(t, []string{"fast", "slow"}, order(t, proxy))
+
+		// 2 of 10 over the threshold miss p90.
+		record(t, proxy, "fast", append(repeat(100*time.Millisecond, 8), repeat(3*time.Second, 2)...)...)
+		assert.Equal(t, []string{"slow", "fast"}, order(t, proxy))
+		status := proxy.slo.status("vllm", "fast", proxy.endpointStatus["vllm"].Regions["fast"].Models[0])
+		assert.Equal(t, &SloStatus{Percentile: 90, ThresholdMs: 1000, LatencyMs: 3000, Samples: 10, Breaching: true}, status)
+
+		// The slow latencies fall out of the window.
+		now = now.Add(10*time.Minute + time.Second)
+		record(t, proxy, "fast", repeat(100*time.Millisecond, 10)...)
+		assert.Equal(t, []string{"fast", "slow"}, order(t, proxy))
+	})
+
+	t.Run("Judges only with enough latencies", func(t *testing.T) {
+		proxy := newProxy(t, slo)
+
+		record(t, proxy, "fast", repeat(3*time.Second, minSloSamples-1)...)
+		assert.Equal(t, []string{"fast", "slow"}, order(t, proxy))
+	})
+
+	t.Run("Applies the penalty to the score only", func(t *testing.T) {
+		// A penalty of 2 leaves the fast region ahead, at 20ms against 30ms.
+		proxy := newProxy(t, &ogem.LatencySlo{Percentile: 90, Threshold: "1s", Penalty: 2})
+
+		record(t, proxy, "fast", repeat(3*time.Second, minSloSamples)...)
+		assert.Equal(t, []string{"fast", "slow"}, order(t, proxy))
+
+		endpoints, err := proxy.sortedEndpoints("", "", "llama")
+		assert.NoError(t, err)
+		assert.Equal(t, 2.0, endpoints[0].sloPenalty)
+		assert.Equal(t, 1.0, endpoints[1].sloPenalty)
+	})
+
+	t.Run("Records the latencies of the requests", func(t *testing.T) {
+		proxy := newProxy(t, slo)
+
+		recorder := sendChatCompletions(proxy, `{"model": "llama", "messages": [{"role": "user", "content": "Hi"}]}`, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		limits, err := proxy.limits(context.Background())
+		assert.NoError(t, err)
+		samples := 0
+		for _, modelLimits := range limits {
+			samples += modelLimits.Slo.Samples
+		}
+		assert.Equal(t, 1, samples)
+	})
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/jsonschema"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils/orderedmap"
+)
+
+type toolValidationContextKey struct{}
+
+const (
+	// Reports the invalid tool calls in the ogem extension of the response.
+	toolValidationAnnotate = "annotate"
+
+	// Asks the endpoint once more with the problems of the invalid tool
+	// calls, and annotates the ones that are still invalid.
+	toolValidationRepair = "repair"
+
+	// Turns off the validation that the API key enables.
+	toolValidationOff = "off"
+)
+
+// Returns the tool validation mode of the request, or the default of the API
+// key if the request does not set it. The X-Ogem-Validate-Tools header takes
+// precedence over the ogem_validate_tools field of the body. Empty if the
+// tool calls are not validated.
+func parseToolValidation(httpRequest *http.Request, fields ogemExtensionFields) (string, error) {
+	value := strings.TrimSpace(fields.ValidateTools)
+	if header := httpRequest.Header.Get("X-Ogem-Validate-Tools"); header != "" {
+		value = strings.TrimSpace(header)
+	}
+	if value == "" {
+		apiKey, _ := apiKeyFrom(httpRequest.Context())
+		value = apiKey.ValidateTools
+	}
+	return toolValidationMode(value)
+}
+
+// Normalizes the mode, in which true is the same as annotate and false the
+// same as off. Off is returned as empty.
+func toolValidationMode(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", "false", toolValidationOff:
+		return "", nil
+	case "true", toolValidationAnnotate:
+		return toolValidationAnnotate, nil
+	case toolValidationRepair:
+		return toolValidationRepair, nil
+	}
+	return "", fmt.Errorf("unsupported tool validation mode %q; must be one of true, false, %s, %s, %s", value, toolValidationAnnotate, toolValidationRepair, toolValidationOff)
+}
+
+func withToolValidation(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, toolValidationContextKey{}, mode)
+}
+
+// Returns the tool validation mode of the request. Empty if the tool calls
+// are not validated.
+func toolValidationFrom(ctx context.Context) string {
+	mode, _ := ctx.Value(toolValidationContextKey{}).(string)
+	return mode
+}
+
+// Returns the tool calls of the response whose arguments do not match the
+// parameters of their tool in the request. Calls of the tools without
+// parameters are not checked, since any arguments are valid for them.
+func invalidToolCalls(request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) []openai.ToolCallError {
+	// Nil for the tools without parameters.
+	schemas := map[string][]byte{}
+	addSchema := func(name string, parameters *orderedmap.Map) {
+		schemas[name] = nil
+		if parameters != nil {
+			if schema, err := json.Marshal(parameters); err == nil {
+				schemas[name] = schema
+			}
+		}
+	}
+	for _, tool := range request.Tools {
+		addSchema(tool.Function.Name, tool.Function.Parameters)
+	}
+	for _, function := range request.Functions {
+		addSchema(function.Name, function.Parameters)
+	}
+
+	check := func(choice openai.Choice, id string, call *openai.FunctionCall) *openai.ToolCallError {
+		if call == nil {
+			return nil
+		}
+		schema, found := schemas[call.Name]
+		if !found {
+			return &openai.ToolCallError{ChoiceIndex: choice.Index, ToolCallId: id, Function: call.Name, Problems: []string{fmt.Sprintf("unknown function %q", call.Name)}}
+		}
+		if schema == nil {
+			return nil
+		}
+		problems, err := jsonschema.Validate(schema, []byte(call.Arguments))
+		if err != nil {
+			problems = []string{err.Error()}
+		}
+		if len(problems) == 0 {
+			return nil
+		}
+		return &openai.ToolCallError{ChoiceIndex: choice.Index, ToolCallId: id, Function: call.Name, Problems: problems}
+	}
+
+	invalid := []openai.ToolCallError{}
+	for _, choice := range response.Choices {
+		for _, toolCall := range choice.Message.ToolCalls {
+			if toolCallError := check(choice, toolCall.Id, toolCall.Function); toolCallError != nil {
+				invalid = append(invalid, *toolCallError)
+			}
+		}
+		if toolCallError := check(choice, "", choice.Message.FunctionCall); toolCallError != nil {
+			invalid = append(invalid, *toolCallError)
+		}
+	}
+	return invalid
+}
+
+// Describes the invalid tool calls to the model so that it calls the tools
+// again with valid arguments.
+func repairPrompt(invalid []openai.ToolCallError) string {
+	var builder strings.Builder
+	builder.WriteString("The arguments of your previous tool calls did not match the parameters of the tools:\n")
+	for _, toolCallError := range invalid {
+		for _, problem := range toolCallError.Problems {
+			fmt.Fprintf(&builder, "- %s: %s\n", toolCallError.Function, problem)
+		}
+	}
+	builder.WriteString("Call the tools again with arguments that match their parameters exactly.")
+	return builder.String()
+}
+
+// Validates the tool calls of the response if the request asks for it. In
+// the repair mode, asks the endpoint once more with the problems appended as
+// a system message and returns its response, whose usage includes that of
+// the invalid one since both are billed. Without an endpoint, such as for a
+// cached response, the problems are only annotated.
+func (s *ModelProxy) validateToolCalls(
+	ctx context.Context,
+	endpoint *endpointStatus,
+	endpointRequest *openai.ChatCompletionRequest,
+	response *openai.ChatCompletionResponse,
+) *openai.ChatCompletionResponse {
+	mode := toolValidationFrom(ctx)
+	if mode == "" {
+		return response
+	}
+	invalid := invalidToolCalls(endpointRequest, response)
+	if len(invalid) == 0 {
+		return response
+	}
+
+	repaired := false
+	// A busy endpoint is not asked again, so that the repair never exceeds
+	// the concurrency limit of the region.
+	if mode == toolValidationRepair && endpoint != nil && s.inFlight.acquire(endpoint) {
+		s.logger.Infow("Repairing invalid tool calls", "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region(), "model", endpointRequest.Model, "invalid", invalid)
+		prompt := repairPrompt(invalid)
+		repairRequest := *endpointRequest
+		repairRequest.Messages = append(slices.Clone(endpointRequest.Messages), openai.Message{
+			Role:    "system",
+			Content: &openai.MessageContent{String: &prompt},
+		})
+		repairResponse, err := generateChoices(ctx, endpoint, &repairRequest)
+		s.inFlight.release(endpoint)
+		if err != nil {
+			s.logger.Warnw("Failed to repair tool calls", "error", err, "provider", endpoint.endpoint.Provider(), "region", endpoint.endpoint.Region())
+		} else {
+			backfillUsage(&repairRequest, repairResponse)
+			addUsage(&repairResponse.Usage, response.Usage)
+			response = repairResponse
+			invalid = invalidToolCalls(endpointRequest, response)
+			repaired = true
+		}
+	}
+
+	if len(invalid) > 0 {
+		s.logger.Warnw("Returning invalid tool calls", "model", endpointRequest.Model, "invalid", invalid, "repaired", repaired)
+	}
+	if response.Ogem == nil {
+		response.Ogem = &openai.ResponseMetadata{}
+	}
+	response.Ogem.ToolValidation = &openai.ToolValidation{Repaired: repaired, Errors: invalid}
+	return response
+}
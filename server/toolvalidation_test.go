@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestToolValidation(t *testing.T) {
+	model := &ogem.SupportedModel{Name: "fake-model"}
+	const body = `{
+		"model": "fake-model",
+		"messages": [{"role": "user", "content": "What's the weather in Seoul?"}],
+		"tools": [{"type": "function", "function": {
+			"name": "get_weather",
+			"parameters": {
+				"type": "object",
+				"properties": {"city": {"type": "string"}, "unit": {"type": "string", "enum": ["celsius", "fahrenheit"]}},
+				"required": ["city"]
+			}
+		}}]
+	}`
+	// Returns the arguments in order, and the last ones from then on.
+	callWith := func(arguments ...string) func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+		calls := 0
+		return func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			argument := arguments[min(calls, len(arguments)-1)]
+			calls++
+			return &openai.ChatCompletionResponse{
+				Model: request.Model,
+				Choices: []openai.Choice{{
+					Message: openai.Message{
+						Role:      "assistant",
+						ToolCalls: []openai.ToolCall{{Id: "call_1", Type: "function", Function: &openai.FunctionCall{Name: "get_weather", Arguments: argument}}},
+					},
+					FinishReason: "tool_calls",
+				}},
+				Usage: openai.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110},
+			}, nil
+		}
+	}
+	chatCompletions := func(proxy *ModelProxy, mode string, apiKey *ApiKey) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		headers := map[string]string{}
+		if mode != "" {
+			headers["X-Ogem-Validate-Tools"] = mode
+		}
+		recorder := sendChatCompletions(proxy, body, headers, apiKey)
+		return recorder, decodeChatCompletion(recorder)
+	}
+
+	t.Run("Repairs the invalid arguments", func(t *testing.T) {
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", model, callWith(`{"location": "Seoul"}`, `{"city": "Seoul"}`))
+
+		recorder, response := chatCompletions(proxy, "repair", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, `{"city": "Seoul"}`, response.Choices[0].Message.ToolCalls[0].Function.Arguments)
+		assert.Equal(t, &openai.ToolValidation{Repaired: true, Errors: []openai.ToolCallError{}}, response.Ogem.ToolValidation)
+		// Both responses are billed.
+		assert.Equal(t, openai.Usage{PromptTokens: 200, CompletionTokens: 20, TotalTokens: 220}, response.Usage)
+
+		requests := endpoint.receivedRequests()
+		assert.Len(t, requests, 2)
+		repairMessage := requests[1].Messages[len(requests[1].Messages)-1]
+		assert.Equal(t, "system", repairMessage.Role)
+		assert.Contains(t, *repairMessage.Content.String, `get_weather: $: missing required property "city"`)
+		assert.Len(t, requests[0].Messages, 1)
+	})
+
+	t.Run("Annotates the arguments that are still invalid", func(t *testing.T) {
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", model, callWith(`{"city": "Seoul", "unit": "kelvin"}`))
+
+		recorder, response := chatCompletions(proxy, "repair", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, endpoint.receivedRequests(), 2)
+		assert.Equal(t, &openai.ToolValidation{Repaired: true, Errors: []openai.ToolCallError{{
+			ToolCallId: "call_1",
+			Function:   "get_weather",
+			Problems:   []string{`$.unit: must be one of "celsius", "fahrenheit"`},
+		}}}, response.Ogem.ToolValidation)
+	})
+
+	t.Run("Only annotates without repair", func(t *testing.T) {
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", model, callWith(`{"city": `))
+
+		recorder, response := chatCompletions(proxy, "true", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, endpoint.receivedRequests(), 1)
+		assert.False(t, response.Ogem.ToolValidation.Repaired)
+		assert.Len(t, response.Ogem.ToolValidation.Errors, 1)
+		assert.Contains(t, response.Ogem.ToolValidation.Errors[0].Problems[0], "invalid JSON")
+	})
+
+	t.Run("Reports unknown functions", func(t *testing.T) {
+		proxy, _ := newSingleEndpointProxy(t, "fake", model, func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.Message{
+				Role:      "assistant",
+				ToolCalls: []openai.ToolCall{{Id: "call_1", Type: "function", Function: &openai.FunctionCall{Name: "get_time", Arguments: `{}`}}},
+			}}}}, nil
+		})
+
+		_, response := chatCompletions(proxy, "annotate", nil)
+		assert.Equal(t, []string{`unknown function "get_time"`}, response.Ogem.ToolValidation.Errors[0].Problems)
+	})
+
+	t.Run("Follows the default of the API key", func(t *testing.T) {
+		proxy, _ := newSingleEndpointProxy(t, "fake", model, callWith(`{}`, `{"city": "Seoul"}`))
+
+		_, response := chatCompletions(proxy, "", &ApiKey{Name: "agents", ValidateTools: "repair"})
+		assert.True(t, response.Ogem.ToolValidation.Repaired)
+
+		// The request can turn it off.
+		_, response = chatCompletions(proxy, "false", &ApiKey{Name: "agents", ValidateTools: "repair"})
+		assert.Nil(t, response.Ogem)
+	})
+
+	t.Run("Leaves the responses without validation as they are", func(t *testing.T) {
+		proxy, endpoint := newSingleEndpointProxy(t, "fake", model, callWith(`{}`))
+
+		recorder, response := chatCompletions(proxy, "", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Nil(t, response.Ogem)
+		assert.NotContains(t, recorder.Body.String(), `"ogem"`)
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Rejects unknown modes", func(t *testing.T) {
+		proxy, _ := newSingleEndpointProxy(t, "fake", model, nil)
+
+		recorder, _ := chatCompletions(proxy, "always", nil)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "unsupported tool validation mode")
+	})
+}
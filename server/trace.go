@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+type routingTraceContextKey struct{}
+
+// How the proxy routed a request, for support engineers to see why it landed
+// on an endpoint without correlating the logs. Only built for the requests
+// that ask for it with the X-Ogem-Debug-Routing header.
+type RoutingTrace struct {
+	// One for each model of the fallback chain that was tried, in order.
+	Models []*ModelTrace `json:"models"`
+}
+
+type ModelTrace struct {
+	Model string `json:"model"`
+
+	// How the first endpoint was chosen among the healthy ones of the highest
+	// priority: latency, weighted (random by weight), or session (the
+	// endpoint that served the previous request of the session).
+	Strategy string `json:"strategy,omitempty"`
+
+	// Either hit, miss, or disabled if the request is not cacheable.
+	Cache string `json:"cache,omitempty"`
+
+	// Endpoints that serve the model, in the order they are tried.
+	Candidates []CandidateTrace `json:"candidates"`
+
+	Attempts []AttemptTrace `json:"attempts,omitempty"`
+
+	// Number of the provider calls after the first one, and of the waits for
+	// the rate limits of every endpoint.
+	Retries int `json:"retries"`
+	Waits   int `json:"waits"`
+
+	// Error of the model if it was not served.
+	Error string `json:"error,omitempty"`
+}
+
+type CandidateTrace struct {
+	// E.g., openai/openai
+	Endpoint  string  `json:"endpoint"`
+	LatencyMs int64   `json:"latency_ms"`
+	Health    string  `json:"health"`
+	Priority  int     `json:"priority"`
+	Weight    float64 `json:"weight"`
+
+	// Why the endpoint was not tried at all. Empty if it was a candidate
+	// until the end.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+type AttemptTrace struct {
+	Endpoint string `json:"endpoint"`
+
+	// One of success, rate_limited (including the disabled endpoints), busy
+	// (at the concurrency limit of the region), quota_error (disabled and
+	// failed over), or error.
+	Result string `json:"result"`
+
+	// Time until the endpoint accepts a request, if it was rate limited.
+	WaitMs int64 `json:"wait_ms,omitempty"`
+
+	// Endpoint that served the request instead, if a hedged backup won.
+	ServedBy string `json:"served_by,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Whether the request asks for the routing trace.
+func wantsRoutingTrace(httpRequest *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(httpRequest.Header.Get("X-Ogem-Debug-Routing")), "true")
+}
+
+// Whether the key that authenticated the request can see the routing trace,
+// which reveals the configured endpoints.
+func canTraceRouting(ctx context.Context) bool {
+	apiKey, found := apiKeyFrom(ctx)
+	return !found || apiKey.Admin || apiKey.DebugRouting
+}
+
+func withRoutingTrace(ctx context.Context, trace *RoutingTrace) context.Context {
+	return context.WithValue(ctx, routingTraceContextKey{}, trace)
+}
+
+// Nil if the request does not ask for the trace. The trace is only written
+// by the goroutine of the request, so it needs no lock.
+func routingTraceFrom(ctx context.Context) *RoutingTrace {
+	trace, _ := ctx.Value(routingTraceContextKey{}).(*RoutingTrace)
+	return trace
+}
+
+// Starts the trace of the model with its candidates. Returns nil if the
+// request is not traced, and every method of ModelTrace does nothing on nil.
+func (t *RoutingTrace) begin(model string, endpoints []*endpointStatus) *ModelTrace {
+	if t == nil {
+		return nil
+	}
+	modelTrace := &ModelTrace{Model: model, Candidates: make([]CandidateTrace, len(endpoints))}
+	for index, endpoint := range endpoints {
+		modelTrace.Candidates[index] = CandidateTrace{
+			Endpoint:  endpointKey(endpoint),
+			LatencyMs: endpoint.latency.Milliseconds(),
+			Health:    endpoint.health.String(),
+			Priority:  endpoint.priority,
+			Weight:    endpoint.weight,
+		}
+	}
+	t.Models = append(t.Models, modelTrace)
+	return modelTrace
+}
+
+// Marks the candidates that are not in the remaining endpoints as skipped
+// for the reason, unless they were already skipped.
+func (t *ModelTrace) skip(remaining []*endpointStatus, reason string) {
+	if t == nil {
+		return
+	}
+	kept := make(map[string]bool, len(remaining))
+	for _, endpoint := range remaining {
+		kept[endpointKey(endpoint)] = true
+	}
+	for index := range t.Candidates {
+		if !kept[t.Candidates[index].Endpoint] && t.Candidates[index].Skipped == "" {
+			t.Candidates[index].Skipped = reason
+		}
+	}
+}
+
+// Records the strategy that chose the first endpoint, and orders the
+// candidates as the endpoints are tried, with the skipped ones last.
+func (t *ModelTrace) order(endpoints []*endpointStatus, sessionPreferred bool) {
+	if t == nil || len(endpoints) == 0 {
+		return
+	}
+	switch {
+	case sessionPreferred:
+		t.Strategy = "session"
+	case endpoints[0].weighted:
+		t.Strategy = "weighted"
+	default:
+		t.Strategy = "latency"
+	}
+
+	candidates := make(map[string]CandidateTrace, len(t.Candidates))
+	for _, candidate := range t.Candidates {
+		candidates[candidate.Endpoint] = candidate
+	}
+	ordered := make([]CandidateTrace, 0, len(t.Candidates))
+	for _, endpoint := range endpoints {
+		ordered = append(ordered, candidates[endpointKey(endpoint)])
+		delete(candidates, endpointKey(endpoint))
+	}
+	for _, candidate := range t.Candidates {
+		if _, left := candidates[candidate.Endpoint]; left {
+			ordered = append(ordered, candidate)
+		}
+	}
+	t.Candidates = ordered
+}
+
+func (t *ModelTrace) setCache(cache string) {
+	if t == nil {
+		return
+	}
+	t.Cache = cache
+}
+
+func (t *ModelTrace) rateLimited(endpoint *endpointStatus, waiting time.Duration) {
+	if t == nil {
+		return
+	}
+	t.Attempts = append(t.Attempts, AttemptTrace{Endpoint: endpointKey(endpoint), Result: "rate_limited", WaitMs: waiting.Milliseconds()})
+}
+
+func (t *ModelTrace) busy(endpoint *endpointStatus, waiting time.Duration) {
+	if t == nil {
+		return
+	}
+	t.Attempts = append(t.Attempts, AttemptTrace{Endpoint: endpointKey(endpoint), Result: "busy", WaitMs: waiting.Milliseconds()})
+}
+
+// Records the call to the endpoint. The result is an error if err is set, and
+// a quota error if the endpoint was disabled for it.
+func (t *ModelTrace) called(endpoint *endpointStatus, result attempt, disabled bool) {
+	if t == nil {
+		return
+	}
+	trace := AttemptTrace{Endpoint: endpointKey(endpoint), Result: "success"}
+	if result.endpoint != nil && result.endpoint != endpoint {
+		trace.ServedBy = endpointKey(result.endpoint)
+	}
+	if result.err != nil {
+		trace.Result = "error"
+		if disabled {
+			trace.Result = "quota_error"
+		}
+		trace.Error = result.err.Error()
+	}
+	for _, previous := range t.Attempts {
+		if previous.Result != "rate_limited" && previous.Result != "busy" {
+			t.Retries++
+			break
+		}
+	}
+	t.Attempts = append(t.Attempts, trace)
+}
+
+func (t *ModelTrace) waited() {
+	if t == nil {
+		return
+	}
+	t.Waits++
+}
+
+func (t *ModelTrace) failed(err error) {
+	if t == nil {
+		return
+	}
+	t.Error = err.Error()
+}
+
+// Sets the trace in the X-Ogem-Routing-Trace header as compact JSON. Must be
+// called before the status is written.
+func writeRoutingTrace(httpResponse http.ResponseWriter, trace *RoutingTrace) error {
+	if trace == nil {
+		return nil
+	}
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return fmt.Errorf("failed to marshal routing trace: %v", err)
+	}
+	httpResponse.Header().Set("X-Ogem-Routing-Trace", string(data))
+	return nil
+}
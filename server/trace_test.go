@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+func TestRoutingTrace(t *testing.T) {
+	newProxy := func(t *testing.T) *ModelProxy {
+		status := func(latency time.Duration) *ogem.RegionStatus {
+			return &ogem.RegionStatus{
+				Models:      []*ogem.SupportedModel{{Name: "gpt-4o"}},
+				Latency:     latency,
+				LastChecked: time.Now(),
+			}
+		}
+		return newTestProxy(t, ogem.ProvidersStatus{
+			"openai": {Regions: map[string]*ogem.RegionStatus{"openai": status(10 * time.Millisecond)}},
+			"claude": {Regions: map[string]*ogem.RegionStatus{"claude": status(50 * time.Millisecond)}},
+			"studio": {Regions: map[string]*ogem.RegionStatus{"studio": status(5 * time.Millisecond)}},
+		},
+			&fakeEndpoint{provider: "openai", region: "openai", generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+				return nil, provider.NewQuotaError(errors.New("daily quota"), time.Hour)
+			}},
+			&fakeEndpoint{provider: "claude", region: "claude"},
+			&fakeEndpoint{provider: "studio", region: "studio"},
+		)
+	}
+	chatCompletions := func(proxy *ModelProxy, apiKey string, debug bool) *httptest.ResponseRecorder {
+		body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+		httpRequest := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		httpRequest.Header.Set("X-Ogem-Exclude-Providers", "studio")
+		if apiKey != "" {
+			httpRequest.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		if debug {
+			httpRequest.Header.Set("X-Ogem-Debug-Routing", "true")
+		}
+		recorder := httptest.NewRecorder()
+		proxy.HandleAuthentication(proxy.HandleChatCompletions)(recorder, httpRequest)
+		return recorder
+	}
+
+	t.Run("Traces the failover", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), "", true)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var trace RoutingTrace
+		assert.NoError(t, json.Unmarshal([]byte(recorder.Header().Get("X-Ogem-Routing-Trace")), &trace))
+		assert.Equal(t, RoutingTrace{Models: []*ModelTrace{{
+			Model:    "gpt-4o",
+			Strategy: "latency",
+			Cache:    "disabled",
+			Candidates: []CandidateTrace{
+				{Endpoint: "openai/openai", LatencyMs: 10, Health: "healthy", Weight: 1},
+				{Endpoint: "claude/claude", LatencyMs: 50, Health: "healthy", Weight: 1},
+				{Endpoint: "studio/studio", LatencyMs: 5, Health: "healthy", Weight: 1, Skipped: "provider_filter"},
+			},
+			Attempts: []AttemptTrace{
+				{Endpoint: "openai/openai", Result: "quota_error", Error: "quota exceeded: daily quota"},
+				{Endpoint: "claude/claude", Result: "success"},
+			},
+			Retries: 1,
+		}}}, trace)
+	})
+
+	t.Run("Is not built without the header", func(t *testing.T) {
+		recorder := chatCompletions(newProxy(t), "", false)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Routing-Trace"))
+	})
+
+	t.Run("Requires the permission of the key", func(t *testing.T) {
+		proxy := newProxy(t)
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "search", Key: "user-key"},
+			{Name: "support", Key: "support-key", DebugRouting: true},
+			{Name: "admin", Key: "admin-key", Admin: true},
+		}
+		proxy.indexApiKeys()
+
+		recorder := chatCompletions(proxy, "user-key", true)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		var response openai.ErrorResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, "debug_routing_forbidden", response.Error.Code)
+
+		for _, apiKey := range []string{"support-key", "admin-key"} {
+			recorder := chatCompletions(proxy, apiKey, true)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.NotEmpty(t, recorder.Header().Get("X-Ogem-Routing-Trace"))
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Gradual rollout of a model to a share of the requests for an alias, such as
+// 5% of default-chat to gpt-4.1 while the rest stays on gpt-4o.
+type TrafficSplit struct {
+	// Model name that the requests ask for. E.g., default-chat
+	Alias string `yaml:"alias"`
+
+	// Models that serve the alias. Their weights sum to 100.
+	Arms []TrafficArm `yaml:"arms"`
+}
+
+type TrafficArm struct {
+	// Model in any form accepted in requests, except a fallback chain.
+	// E.g., openai/gpt-4.1
+	Model string `yaml:"model"`
+
+	// Percentage of the requests for the alias. E.g., 5
+	Weight float64 `yaml:"weight"`
+}
+
+// Requests served by an arm since the start of this instance.
+type TrafficArmStats struct {
+	Alias  string  `json:"alias"`
+	Model  string  `json:"model"`
+	Weight float64 `json:"weight"`
+
+	Requests  int64 `json:"requests"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+
+	// Average over the succeeded requests.
+	AverageLatencyMs int64 `json:"average_latency_ms"`
+}
+
+type TrafficSplitsResponse struct {
+	Arms []TrafficArmStats `json:"arms"`
+}
+
+type trafficArm struct {
+	config TrafficArm
+
+	stats          TrafficArmStats
+	totalLatencyMs int64
+}
+
+// Arms of the configured splits by alias. Nil if none is configured.
+type trafficSplitTable struct {
+	splits map[string][]*trafficArm
+	mutex  sync.Mutex
+}
+
+// The config must have been validated.
+func newTrafficSplitTable(configs []TrafficSplit) *trafficSplitTable {
+	if len(configs) == 0 {
+		return nil
+	}
+	table := &trafficSplitTable{splits: map[string][]*trafficArm{}}
+	for _, config := range configs {
+		for _, arm := range config.Arms {
+			table.splits[config.Alias] = append(table.splits[config.Alias], &trafficArm{
+				config: arm,
+				stats:  TrafficArmStats{Alias: config.Alias, Model: arm.Model, Weight: arm.Weight},
+			})
+		}
+	}
+	return table
+}
+
+// Returns the arm of the alias for the request. A session always falls on
+// the same arm as long as the weights do not change, so that a user does not
+// switch between the models; the requests without one are drawn at random.
+// Nil if the alias is not split.
+func (t *trafficSplitTable) pick(alias string, session string, draw func() float64) *trafficArm {
+	if t == nil {
+		return nil
+	}
+	arms := t.splits[alias]
+	if len(arms) == 0 {
+		return nil
+	}
+
+	var point float64
+	if session != "" {
+		hash := sha256.Sum256([]byte(alias + "\x00" + session))
+		point = float64(binary.BigEndian.Uint64(hash[:8])) / math.MaxUint64 * 100
+	} else {
+		point = draw() * 100
+	}
+	cumulative := 0.0
+	for _, arm := range arms {
+		cumulative += arm.config.Weight
+		if point < cumulative {
+			return arm
+		}
+	}
+	// Only reached by rounding at the upper end.
+	return arms[len(arms)-1]
+}
+
+// Records the result of a request served by the arm.
+func (t *trafficSplitTable) record(arm *trafficArm, activity RequestActivity) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	arm.stats.Requests++
+	if activity.Status != requestSuccess {
+		arm.stats.Failed++
+		return
+	}
+	arm.stats.Succeeded++
+	arm.stats.PromptTokens += int64(activity.PromptTokens)
+	arm.stats.CompletionTokens += int64(activity.CompletionTokens)
+	arm.stats.Cost += activity.Cost
+	arm.totalLatencyMs += activity.DurationMs
+}
+
+// Returns the stats of every arm, sorted by alias and in the order of the
+// config within an alias.
+func (t *trafficSplitTable) snapshot() []TrafficArmStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	aliases := make([]string, 0, len(t.splits))
+	for alias := range t.splits {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	stats := []TrafficArmStats{}
+	for _, alias := range aliases {
+		for _, arm := range t.splits[alias] {
+			armStats := arm.stats
+			if armStats.Succeeded > 0 {
+				armStats.AverageLatencyMs = arm.totalLatencyMs / armStats.Succeeded
+			}
+			stats = append(stats, armStats)
+		}
+	}
+	return stats
+}
+
+// Draws a number in [0, 1) for the requests without a session.
+func (s *ModelProxy) drawTrafficSplit() float64 {
+	s.randomMutex.Lock()
+	defer s.randomMutex.Unlock()
+	return s.random.Float64()
+}
+
+// Rewrites the model of the request to the arm it falls on, if it asks for a
+// split alias, before it is routed. The arm is reported in the
+// X-Ogem-Traffic-Arm header. Returns nil if the model is not split.
+func (s *ModelProxy) applyTrafficSplit(ctx context.Context, httpResponse http.ResponseWriter, request *openai.ChatCompletionRequest) *trafficArm {
+	arm := s.trafficSplits.pick(request.Model, sessionFrom(ctx), s.drawTrafficSplit)
+	if arm == nil {
+		return nil
+	}
+	s.logger.Infow("Assigned traffic split arm", "alias", request.Model, "model", arm.config.Model, "api_key", apiKeyName(ctx))
+	httpResponse.Header().Set("X-Ogem-Traffic-Arm", arm.config.Model)
+	request.Model = arm.config.Model
+	return arm
+}
+
+func (s *ModelProxy) HandleTrafficSplits(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	response := TrafficSplitsResponse{Arms: []TrafficArmStats{}}
+	if s.trafficSplits != nil {
+		response.Arms = s.trafficSplits.snapshot()
+	}
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(response); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
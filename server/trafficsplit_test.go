@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestTrafficSplits(t *testing.T) {
+	canary := TrafficSplit{Alias: "default-chat", Arms: []TrafficArm{{Model: "gpt-4o", Weight: 95}, {Model: "gpt-4.1", Weight: 5}}}
+
+	t.Run("Splits the requests by weight", func(t *testing.T) {
+		table := newTrafficSplitTable([]TrafficSplit{canary})
+		random := rand.New(rand.NewSource(1))
+
+		counts := map[string]int{}
+		for range 10000 {
+			counts[table.pick("default-chat", "", random.Float64).config.Model]++
+		}
+		assert.InDelta(t, 500, counts["gpt-4.1"], 100)
+		assert.Equal(t, 10000, counts["gpt-4o"]+counts["gpt-4.1"])
+
+		assert.Nil(t, table.pick("gpt-4o", "", random.Float64))
+		var none *trafficSplitTable
+		assert.Nil(t, none.pick("default-chat", "", random.Float64))
+	})
+
+	t.Run("Keeps a session on the same arm", func(t *testing.T) {
+		table := newTrafficSplitTable([]TrafficSplit{canary})
+		panicking := func() float64 { panic("sessions must not be drawn at random") }
+
+		counts := map[string]int{}
+		for index := range 10000 {
+			session := fmt.Sprintf("user-%d", index)
+			arm := table.pick("default-chat", session, panicking)
+			for range 3 {
+				assert.Same(t, arm, table.pick("default-chat", session, panicking))
+			}
+			counts[arm.config.Model]++
+		}
+		// The sessions are still split by weight.
+		assert.InDelta(t, 500, counts["gpt-4.1"], 100)
+	})
+
+	t.Run("Serves the alias with the arm and records it", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "openai", region: "openai"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"openai": {Regions: map[string]*ogem.RegionStatus{
+				"openai": {Models: []*ogem.SupportedModel{{Name: "gpt-4o", InputPrice: 1}, {Name: "gpt-4.1", InputPrice: 2}}},
+			}},
+		}, endpoint)
+		proxy.trafficSplits = newTrafficSplitTable([]TrafficSplit{
+			{Alias: "default-chat", Arms: []TrafficArm{{Model: "gpt-4o", Weight: 50}, {Model: "gpt-4.1", Weight: 50}}},
+		})
+		chatCompletions := func(session string) *httptest.ResponseRecorder {
+			recorder := sendChatCompletions(proxy, `{"model": "default-chat", "messages": [{"role": "user", "content": "Hi"}]}`, map[string]string{"X-Ogem-Session": session}, nil)
+			assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+			return recorder
+		}
+
+		arms := map[string]string{}
+		for index := range 20 {
+			session := fmt.Sprintf("user-%d", index)
+			for range 2 {
+				recorder := chatCompletions(session)
+				arm := recorder.Header().Get("X-Ogem-Traffic-Arm")
+				assert.Equal(t, "openai/openai/"+arm, recorder.Header().Get("X-Ogem-Resolved-Model"))
+				if previous, found := arms[session]; found {
+					assert.Equal(t, previous, arm, session)
+				}
+				arms[session] = arm
+			}
+		}
+
+		recent := proxy.activity.list("", "", 1)
+		assert.Equal(t, arms["user-19"], recent[0].TrafficArm)
+		assert.Equal(t, "default-chat", recent[0].RequestedModel)
+
+		recorder := httptest.NewRecorder()
+		proxy.HandleTrafficSplits(recorder, httptest.NewRequest("GET", "/v1/admin/traffic-splits", nil))
+		var response TrafficSplitsResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Len(t, response.Arms, 2)
+		total := int64(0)
+		for _, stats := range response.Arms {
+			assert.Equal(t, "default-chat", stats.Alias)
+			assert.Equal(t, stats.Requests, stats.Succeeded)
+			assert.Positive(t, stats.Requests, stats.Model)
+			total += stats.Requests
+		}
+		assert.Equal(t, int64(40), total)
+	})
+}
@@ -0,0 +1,453 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Capture of the conversations of the API keys flagged with
+// capture_transcripts_until, for the reviews of trust and safety.
+type TranscriptsConfig struct {
+	// Time to keep a captured transcript, after which it is purged. Defaults
+	// to 168h.
+	Ttl string `yaml:"ttl"`
+
+	// Name of the environment variable with the key to encrypt the
+	// transcripts with AES-256-GCM, as 32 bytes in base64. Empty to store
+	// them unencrypted. E.g., OGEM_TRANSCRIPT_KEY
+	EncryptionKeyEnv string `yaml:"encryption_key_env"`
+}
+
+const (
+	defaultTranscriptTtl = 7 * 24 * time.Hour
+
+	// Span of the transcripts indexed together. Listing a range reads the
+	// index of each span in it.
+	transcriptBucket = time.Hour
+
+	// Time for which an instance uses the capture flag that it has read from
+	// the state manager, so that the flagged keys do not cost a read on
+	// every request.
+	transcriptCaptureRefresh = 10 * time.Second
+
+	defaultTranscriptPageSize = 50
+	maxTranscriptPageSize     = 500
+)
+
+// Conversation of a request of a flagged key.
+type Transcript struct {
+	// Position of the transcript in the index. E.g., 483921.3
+	Id        string    `json:"id"`
+	ApiKey    string    `json:"api_key"`
+	RequestId string    `json:"request_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Messages []openai.Message               `json:"messages"`
+	Response *openai.ChatCompletionResponse `json:"response"`
+}
+
+type TranscriptsResponse struct {
+	Name        string       `json:"name"`
+	Transcripts []Transcript `json:"transcripts"`
+
+	// Cursor of the next page. Empty if this is the last one.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type CaptureTranscriptsRequest struct {
+	// Time until which the transcripts of the key are captured, in RFC 3339.
+	// Empty to stop capturing.
+	Until string `json:"until"`
+}
+
+type CaptureTranscriptsResponse struct {
+	Name                    string `json:"name"`
+	CaptureTranscriptsUntil string `json:"capture_transcripts_until"`
+}
+
+// Capture flag of a key as last read from the state manager.
+type transcriptCapture struct {
+	// Time set through the admin endpoint. Zero if capturing is stopped.
+	until time.Time
+
+	// Whether it has been set, which overrides the config.
+	found     bool
+	checkedAt time.Time
+}
+
+type transcriptStore struct {
+	ttl time.Duration
+
+	// Cipher of the transcripts at rest. Nil if they are not encrypted.
+	aead cipher.AEAD
+
+	mutex    sync.Mutex
+	captures map[string]transcriptCapture
+
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+}
+
+// Reads the encryption key from the environment. The config must have been
+// validated.
+func newTranscriptStore(config TranscriptsConfig) (*transcriptStore, error) {
+	store := &transcriptStore{ttl: defaultTranscriptTtl, captures: map[string]transcriptCapture{}, now: time.Now}
+	if config.Ttl != "" {
+		ttl, err := time.ParseDuration(config.Ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transcripts ttl: %v", err)
+		}
+		store.ttl = ttl
+	}
+	if config.EncryptionKeyEnv != "" {
+		aead, err := transcriptCipher(os.Getenv(config.EncryptionKeyEnv))
+		if err != nil {
+			return nil, fmt.Errorf("invalid transcript encryption key: %v", err)
+		}
+		store.aead = aead
+	}
+	return store, nil
+}
+
+func transcriptCipher(encodedKey string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("must be in base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the data with a random nonce prepended, if encryption is enabled.
+func (t *transcriptStore) seal(data []byte) ([]byte, error) {
+	if t.aead == nil {
+		return data, nil
+	}
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (t *transcriptStore) open(data []byte) ([]byte, error) {
+	if t.aead == nil {
+		return data, nil
+	}
+	if len(data) < t.aead.NonceSize() {
+		return nil, fmt.Errorf("transcript too short to decrypt")
+	}
+	nonce, sealed := data[:t.aead.NonceSize()], data[t.aead.NonceSize():]
+	return t.aead.Open(nil, nonce, sealed, nil)
+}
+
+// The transcripts are kept apart from the cached responses, under their own
+// prefixes, so that the cache never serves them. Key names are escaped so
+// that they cannot reach into the keys of another name.
+func transcriptKey(name string, bucket int64, sequence int64) string {
+	return fmt.Sprintf("transcript:%s:%d:%d", url.QueryEscape(name), bucket, sequence)
+}
+
+func transcriptIndexKey(name string, bucket int64) string {
+	return fmt.Sprintf("transcript_index:%s:%d", url.QueryEscape(name), bucket)
+}
+
+func transcriptCaptureKey(name string) string {
+	return "transcript_capture:" + url.QueryEscape(name)
+}
+
+func transcriptBucketOf(at time.Time) int64 {
+	return at.Unix() / int64(transcriptBucket/time.Second)
+}
+
+// Returns the time until which the transcripts of the key are captured. The
+// time set through the admin endpoint overrides the config. Zero if they are
+// not captured.
+func (s *ModelProxy) captureTranscriptsUntil(ctx context.Context, apiKey ApiKey) time.Time {
+	now := s.transcripts.now()
+	s.transcripts.mutex.Lock()
+	capture, cached := s.transcripts.captures[apiKey.Name]
+	s.transcripts.mutex.Unlock()
+
+	if !cached || now.Sub(capture.checkedAt) >= transcriptCaptureRefresh {
+		capture = transcriptCapture{checkedAt: now}
+		data, err := s.stateManager.LoadCache(ctx, transcriptCaptureKey(apiKey.Name))
+		if err != nil {
+			s.logger.Warnw("Failed to check transcript capture", "error", err, "api_key", apiKey.Name)
+		} else if data != nil {
+			var request CaptureTranscriptsRequest
+			if err := json.Unmarshal(data, &request); err == nil {
+				capture.found = true
+				capture.until, _ = time.Parse(time.RFC3339, request.Until)
+			}
+		}
+		s.transcripts.mutex.Lock()
+		s.transcripts.captures[apiKey.Name] = capture
+		s.transcripts.mutex.Unlock()
+	}
+
+	if capture.found {
+		return capture.until
+	}
+	// The config has been validated.
+	until, _ := time.Parse(time.RFC3339, apiKey.CaptureTranscriptsUntil)
+	return until
+}
+
+// Stores the conversation if the key of the request is flagged. Unnamed keys
+// are never captured, since the transcripts are retrieved by name.
+func (s *ModelProxy) captureTranscript(ctx context.Context, requestId string, request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) {
+	apiKey, found := apiKeyFrom(ctx)
+	if !found || apiKey.Name == "" {
+		return
+	}
+	now := s.transcripts.now()
+	if !now.Before(s.captureTranscriptsUntil(ctx, apiKey)) {
+		return
+	}
+
+	// Storing should be done even if the request has been canceled.
+	ctx = context.WithoutCancel(ctx)
+	bucket := transcriptBucketOf(now)
+	counters, err := s.stateManager.AddCounters(ctx, transcriptIndexKey(apiKey.Name, bucket), map[string]float64{"count": 1}, s.transcripts.ttl+transcriptBucket)
+	if err != nil {
+		s.logger.Warnw("Failed to index transcript", "error", err, "api_key", apiKey.Name)
+		return
+	}
+	sequence := int64(counters["count"])
+	transcript := Transcript{
+		Id:        fmt.Sprintf("%d.%d", bucket, sequence),
+		ApiKey:    apiKey.Name,
+		RequestId: requestId,
+		CreatedAt: now.UTC(),
+		Messages:  request.Messages,
+		Response:  response,
+	}
+	data, err := json.Marshal(transcript)
+	if err != nil {
+		s.logger.Errorw("Failed to encode transcript", "error", err)
+		return
+	}
+	if data, err = s.transcripts.seal(data); err != nil {
+		s.logger.Errorw("Failed to encrypt transcript", "error", err)
+		return
+	}
+	if err := s.stateManager.SaveCache(ctx, transcriptKey(apiKey.Name, bucket, sequence), data, s.transcripts.ttl); err != nil {
+		s.logger.Warnw("Failed to save transcript", "error", err, "api_key", apiKey.Name)
+	}
+}
+
+// Parses the cursor of a page, which is the id of its first transcript.
+func parseTranscriptCursor(cursor string) (int64, int64, error) {
+	bucketText, sequenceText, found := strings.Cut(cursor, ".")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	bucket, err := strconv.ParseInt(bucketText, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	sequence, err := strconv.ParseInt(sequenceText, 10, 64)
+	if err != nil || sequence < 1 {
+		return 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return bucket, sequence, nil
+}
+
+// Returns the transcripts of the key created in [from, to], oldest first, up
+// to the limit, and the cursor of the next page.
+func (s *ModelProxy) listTranscripts(ctx context.Context, name string, from time.Time, to time.Time, cursor string, limit int) ([]Transcript, string, error) {
+	now := s.transcripts.now()
+	// The older ones have been purged.
+	from = maxTime(from, now.Add(-s.transcripts.ttl))
+	startBucket, endBucket := transcriptBucketOf(from), transcriptBucketOf(to)
+	startSequence := int64(1)
+	if cursor != "" {
+		bucket, sequence, err := parseTranscriptCursor(cursor)
+		if err != nil {
+			return nil, "", BadRequestError{err}
+		}
+		startBucket = max(startBucket, bucket)
+		if bucket == startBucket {
+			startSequence = sequence
+		}
+	}
+
+	transcripts := []Transcript{}
+	for bucket := startBucket; bucket <= endBucket; bucket++ {
+		counters, err := s.stateManager.AddCounters(ctx, transcriptIndexKey(name, bucket), nil, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		count := int64(counters["count"])
+		for sequence := startSequence; sequence <= count; sequence++ {
+			if len(transcripts) == limit {
+				return transcripts, fmt.Sprintf("%d.%d", bucket, sequence), nil
+			}
+			data, err := s.stateManager.LoadCache(ctx, transcriptKey(name, bucket, sequence))
+			if err != nil {
+				return nil, "", err
+			}
+			if data == nil {
+				continue
+			}
+			if data, err = s.transcripts.open(data); err != nil {
+				s.logger.Warnw("Failed to decrypt transcript", "error", err, "api_key", name)
+				continue
+			}
+			var transcript Transcript
+			if err := json.Unmarshal(data, &transcript); err != nil {
+				s.logger.Warnw("Failed to decode transcript", "error", err, "api_key", name)
+				continue
+			}
+			// The state manager may return an entry just past its expiry.
+			if transcript.CreatedAt.Before(from) || transcript.CreatedAt.After(to) {
+				continue
+			}
+			transcripts = append(transcripts, transcript)
+		}
+		startSequence = 1
+	}
+	return transcripts, "", nil
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Whether a key with the name is configured. Unnamed keys cannot be flagged.
+func (s *ModelProxy) hasApiKeyNamed(name string) bool {
+	for _, apiKey := range s.apiKeys() {
+		if apiKey.Name != "" && apiKey.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Starts or stops capturing the transcripts of the keys with the name in the
+// path, on every instance sharing the state manager within
+// transcriptCaptureRefresh. Overrides capture_transcripts_until of the config.
+func (s *ModelProxy) HandleCaptureTranscripts(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	defer httpRequest.Body.Close()
+	name := httpRequest.PathValue("name")
+	if !s.hasApiKeyNamed(name) {
+		writeError(httpResponse, http.StatusNotFound, errorTypeInvalidRequest, "key_not_found", fmt.Sprintf("No API key is named %q", name))
+		return
+	}
+	var request CaptureTranscriptsRequest
+	if err := json.NewDecoder(httpRequest.Body).Decode(&request); err != nil {
+		writeError(httpResponse, http.StatusBadRequest, errorTypeInvalidRequest, "", "Invalid request body")
+		return
+	}
+	var until time.Time
+	if request.Until != "" {
+		var err error
+		if until, err = time.Parse(time.RFC3339, request.Until); err != nil {
+			handleError(httpResponse, BadRequestError{fmt.Errorf("until must be in RFC 3339: %q", request.Until)})
+			return
+		}
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	// Kept as long as the revocations, since it overrides the config until
+	// it is set again.
+	if err := s.stateManager.SaveCache(httpRequest.Context(), transcriptCaptureKey(name), data, revocationTtl); err != nil {
+		s.logger.Warnw("Failed to save transcript capture", "error", err, "api_key", name)
+		handleError(httpResponse, InternalServerError{err})
+		return
+	}
+	s.transcripts.mutex.Lock()
+	s.transcripts.captures[name] = transcriptCapture{until: until, found: true, checkedAt: s.transcripts.now()}
+	s.transcripts.mutex.Unlock()
+	s.logger.Infow("Set transcript capture", "api_key", name, "until", request.Until)
+
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(CaptureTranscriptsResponse{Name: name, CaptureTranscriptsUntil: request.Until}); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
+
+// Lists the captured transcripts of the keys with the name in the path. Takes
+// from and to in RFC 3339, which default to the retention and now, and limit
+// and cursor for the pages.
+func (s *ModelProxy) HandleTranscripts(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	name := httpRequest.PathValue("name")
+	query := httpRequest.URL.Query()
+	parseTime := func(field string, fallback time.Time) (time.Time, error) {
+		value := query.Get(field)
+		if value == "" {
+			return fallback, nil
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s must be in RFC 3339: %q", field, value)
+		}
+		return parsed, nil
+	}
+	now := s.transcripts.now()
+	from, err := parseTime("from", now.Add(-s.transcripts.ttl))
+	if err != nil {
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+	to, err := parseTime("to", now)
+	if err != nil {
+		handleError(httpResponse, BadRequestError{err})
+		return
+	}
+	if to.Before(from) {
+		handleError(httpResponse, BadRequestError{fmt.Errorf("to must not be before from")})
+		return
+	}
+	limit := defaultTranscriptPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTranscriptPageSize {
+			handleError(httpResponse, BadRequestError{fmt.Errorf("limit must be between 1 and %d", maxTranscriptPageSize)})
+			return
+		}
+	}
+
+	transcripts, nextCursor, err := s.listTranscripts(httpRequest.Context(), name, from, to, query.Get("cursor"), limit)
+	if err != nil {
+		s.logger.Warnw("Failed to list transcripts", "error", err, "api_key", name)
+		handleError(httpResponse, err)
+		return
+	}
+	httpResponse.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(httpResponse).Encode(TranscriptsResponse{Name: name, Transcripts: transcripts, NextCursor: nextCursor}); err != nil {
+		s.logger.Errorw("Failed to encode response", "error", err)
+		writeError(httpResponse, http.StatusInternalServerError, errorTypeServer, "", "Internal server error")
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+)
+
+func TestTranscripts(t *testing.T) {
+	flagUntil := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	newProxy := func(t *testing.T, config TranscriptsConfig) (*ModelProxy, *time.Time) {
+		proxy, _ := newSingleEndpointProxy(t, "fake", &ogem.SupportedModel{Name: "fake-model"}, nil)
+		proxy.config.ApiKeys = []ApiKey{
+			{Name: "admin", Key: "admin-key", Admin: true},
+			{Name: "flagged", Key: "key-1", CaptureTranscriptsUntil: flagUntil.Format(time.RFC3339)},
+			{Name: "other", Key: "key-2"},
+		}
+		proxy.indexApiKeys()
+		transcripts, err := newTranscriptStore(config)
+		assert.NoError(t, err)
+		now := flagUntil.Add(-time.Hour)
+		transcripts.now = func() time.Time { return now }
+		proxy.transcripts = transcripts
+		return proxy, &now
+	}
+	chatCompletions := func(proxy *ModelProxy, name string, content string) {
+		var caller *ApiKey
+		for _, apiKey := range proxy.config.ApiKeys {
+			if apiKey.Name == name {
+				caller = &apiKey
+			}
+		}
+		recorder := sendChatCompletions(proxy, fmt.Sprintf(`{"model": "fake-model", "messages": [{"role": "user", "content": %q}]}`, content), nil, caller)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	admin := func(proxy *ModelProxy, method string, target string, body string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		mux.HandleFunc("PUT /v1/admin/keys/{name}/capture-transcripts", proxy.HandleAdminAuthentication(proxy.HandleCaptureTranscripts))
+		mux.HandleFunc("GET /v1/admin/keys/{name}/transcripts", proxy.HandleAdminAuthentication(proxy.HandleTranscripts))
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer admin-key")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	list := func(proxy *ModelProxy, query string) TranscriptsResponse {
+		recorder := admin(proxy, "GET", "/v1/admin/keys/flagged/transcripts"+query, "")
+		assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		var response TranscriptsResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		return response
+	}
+	contents := func(transcripts []Transcript) []string {
+		result := []string{}
+		for _, transcript := range transcripts {
+			result = append(result, *transcript.Messages[0].Content.String)
+		}
+		return result
+	}
+
+	t.Run("Captures the requests of a flagged key until the time", func(t *testing.T) {
+		proxy, now := newProxy(t, TranscriptsConfig{})
+
+		*now = flagUntil.Add(-time.Second)
+		chatCompletions(proxy, "flagged", "before")
+		chatCompletions(proxy, "other", "unflagged")
+		// Past the cached flag, so that the boundary is read again.
+		*now = flagUntil
+		chatCompletions(proxy, "flagged", "at the end")
+
+		response := list(proxy, "")
+		assert.Equal(t, []string{"before"}, contents(response.Transcripts))
+		transcript := response.Transcripts[0]
+		assert.Equal(t, "flagged", transcript.ApiKey)
+		assert.NotEmpty(t, transcript.RequestId)
+		assert.Equal(t, "fake-model", *transcript.Response.Choices[0].Message.Content.String)
+		assert.Empty(t, response.NextCursor)
+
+		recorder := admin(proxy, "GET", "/v1/admin/keys/other/transcripts", "")
+		assert.Contains(t, recorder.Body.String(), `"transcripts":[]`)
+	})
+
+	t.Run("Overrides the config through the admin endpoint", func(t *testing.T) {
+		proxy, now := newProxy(t, TranscriptsConfig{})
+
+		recorder := admin(proxy, "PUT", "/v1/admin/keys/flagged/capture-transcripts", `{"until": ""}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		chatCompletions(proxy, "flagged", "stopped")
+
+		until := now.Add(time.Minute).Format(time.RFC3339)
+		recorder = admin(proxy, "PUT", "/v1/admin/keys/flagged/capture-transcripts", fmt.Sprintf(`{"until": %q}`, until))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), until)
+		chatCompletions(proxy, "flagged", "resumed")
+
+		assert.Equal(t, []string{"resumed"}, contents(list(proxy, "").Transcripts))
+
+		assert.Equal(t, http.StatusNotFound, admin(proxy, "PUT", "/v1/admin/keys/unknown/capture-transcripts", `{"until": ""}`).Code)
+		assert.Equal(t, http.StatusBadRequest, admin(proxy, "PUT", "/v1/admin/keys/flagged/capture-transcripts", `{"until": "tomorrow"}`).Code)
+	})
+
+	t.Run("Lists the transcripts in pages", func(t *testing.T) {
+		proxy, now := newProxy(t, TranscriptsConfig{})
+		start := flagUntil.Add(-3 * time.Hour)
+		// Spans two buckets of the index.
+		for index := range 5 {
+			*now = start.Add(time.Duration(index) * 20 * time.Minute)
+			chatCompletions(proxy, "flagged", fmt.Sprintf("message %d", index))
+		}
+		*now = start.Add(time.Hour + 30*time.Minute)
+
+		pages := [][]string{}
+		cursor := ""
+		for {
+			response := list(proxy, "?limit=2&cursor="+cursor)
+			pages = append(pages, contents(response.Transcripts))
+			if response.NextCursor == "" {
+				break
+			}
+			cursor = response.NextCursor
+		}
+		assert.Equal(t, [][]string{{"message 0", "message 1"}, {"message 2", "message 3"}, {"message 4"}}, pages)
+
+		from := start.Add(30 * time.Minute).Format(time.RFC3339)
+		to := start.Add(time.Hour).Format(time.RFC3339)
+		assert.Equal(t, []string{"message 2", "message 3"}, contents(list(proxy, "?from="+from+"&to="+to).Transcripts))
+
+		for _, query := range []string{"?limit=0", "?limit=501", "?cursor=abc", "?from=yesterday", "?from=" + to + "&to=" + from} {
+			assert.Equal(t, http.StatusBadRequest, admin(proxy, "GET", "/v1/admin/keys/flagged/transcripts"+strings.ReplaceAll(query, "+", "%2B"), "").Code, query)
+		}
+	})
+
+	t.Run("Purges the transcripts at the ttl", func(t *testing.T) {
+		proxy, now := newProxy(t, TranscriptsConfig{Ttl: "50ms"})
+		chatCompletions(proxy, "flagged", "short-lived")
+		assert.Len(t, list(proxy, "").Transcripts, 1)
+
+		time.Sleep(100 * time.Millisecond)
+		*now = now.Add(100 * time.Millisecond)
+		assert.Empty(t, list(proxy, "").Transcripts)
+		data, err := proxy.stateManager.LoadCache(context.Background(), transcriptKey("flagged", transcriptBucketOf(*now), 1))
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+	})
+
+	t.Run("Encrypts the transcripts at rest", func(t *testing.T) {
+		t.Setenv("OGEM_TEST_TRANSCRIPT_KEY", base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+		proxy, now := newProxy(t, TranscriptsConfig{EncryptionKeyEnv: "OGEM_TEST_TRANSCRIPT_KEY"})
+		chatCompletions(proxy, "flagged", "confidential words")
+
+		data, err := proxy.stateManager.LoadCache(context.Background(), transcriptKey("flagged", transcriptBucketOf(*now), 1))
+		assert.NoError(t, err)
+		assert.NotEmpty(t, data)
+		assert.NotContains(t, string(data), "confidential words")
+		assert.Equal(t, []string{"confidential words"}, contents(list(proxy, "").Transcripts))
+	})
+
+	t.Run("Keeps the transcripts out of the response cache", func(t *testing.T) {
+		assert.False(t, strings.HasPrefix(transcriptKey("flagged", 1, 1), "cache:"))
+		assert.NotEqual(t, transcriptKey("a:1", 2, 3), transcriptKey("a", 1, 2))
+	})
+}
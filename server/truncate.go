@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/tokenizer"
+	"github.com/yanolja/ogem/utils/array"
+)
+
+type truncationContextKey struct{}
+
+// Drops the oldest messages until the request fits the context window.
+const truncateOldest = "oldest"
+
+// How a request that exceeds the context window of every endpoint is handled,
+// and what was dropped to make it fit.
+type truncation struct {
+	// Either truncateOldest or empty to reject the request.
+	mode string
+
+	// Indices of the messages dropped by the last attempt, in the messages
+	// sent by the caller.
+	dropped []int
+}
+
+// Returns the truncation mode of the request. The X-Ogem-Truncate header takes
+// precedence over the ogem_truncate field of the body.
+func parseTruncation(httpRequest *http.Request, fields ogemExtensionFields) (*truncation, error) {
+	mode := strings.TrimSpace(fields.Truncate)
+	if header := httpRequest.Header.Get("X-Ogem-Truncate"); header != "" {
+		mode = strings.TrimSpace(header)
+	}
+	if mode != "" && mode != truncateOldest {
+		return nil, fmt.Errorf("unsupported truncation mode %q; must be %s", mode, truncateOldest)
+	}
+	return &truncation{mode: mode}, nil
+}
+
+func withTruncation(ctx context.Context, state *truncation) context.Context {
+	return context.WithValue(ctx, truncationContextKey{}, state)
+}
+
+// Returns the truncation of the request. Nil if the request does not allow
+// truncation.
+func truncationFrom(ctx context.Context) *truncation {
+	state, _ := ctx.Value(truncationContextKey{}).(*truncation)
+	return state
+}
+
+// Describes the dropped messages for the X-Ogem-Truncated-Messages header.
+// E.g., "1,2,3"
+func (t *truncation) String() string {
+	return strings.Join(array.Map(t.dropped, strconv.Itoa), ",")
+}
+
+// Counts the prompt tokens with the local tokenizer, the same one the token
+// count endpoint uses for OpenAI models. Other models are approximated by it
+// since a remote count would cost a round trip before every request.
+func localPromptTokens(request *openai.ChatCompletionRequest) int {
+	countResponse, err := tokenizer.CountOpenAi(request)
+	if err != nil {
+		countResponse = tokenizer.Estimate(request)
+	}
+	return int(countResponse.PromptTokens)
+}
+
+// Returns the tokens reserved for the output of the request on the endpoint.
+func reservedOutputTokens(request *openai.ChatCompletionRequest, endpoint *endpointStatus) int {
+	if maxTokens := requestedMaxTokens(request); maxTokens > 0 {
+		return maxTokens
+	}
+	if defaults := endpoint.modelStatus.Defaults; defaults != nil && defaults.MaxTokens != nil {
+		return int(*defaults.MaxTokens)
+	}
+	return 0
+}
+
+// Returns the tokens that the endpoint has for the prompt of the request, or
+// -1 if its context window is unknown.
+func availablePromptTokens(request *openai.ChatCompletionRequest, endpoint *endpointStatus) int {
+	maxContextTokens := endpoint.modelStatus.ResolvedCapabilities().MaxContextTokens
+	if maxContextTokens == 0 {
+		return -1
+	}
+	return maxContextTokens - reservedOutputTokens(request, endpoint)
+}
+
+func fittingEndpoints(request *openai.ChatCompletionRequest, promptTokens int, endpoints []*endpointStatus) []*endpointStatus {
+	return array.Filter(endpoints, func(endpoint *endpointStatus) bool {
+		available := availablePromptTokens(request, endpoint)
+		return available < 0 || promptTokens <= available
+	})
+}
+
+// Removes the endpoints whose context window cannot hold the prompt and the
+// reserved output tokens, keeping the order of the others. If no endpoint is
+// left, drops the oldest messages when the request allows it, or rejects it.
+func fitContextWindow(ctx context.Context, request *openai.ChatCompletionRequest, endpoints []*endpointStatus) ([]*endpointStatus, *openai.ChatCompletionRequest, error) {
+	state := truncationFrom(ctx)
+	if state != nil {
+		state.dropped = nil
+	}
+
+	unlimited := array.Filter(endpoints, func(endpoint *endpointStatus) bool {
+		return availablePromptTokens(request, endpoint) < 0
+	})
+	if len(unlimited) == len(endpoints) {
+		return endpoints, request, nil
+	}
+
+	promptTokens := localPromptTokens(request)
+	if fitting := fittingEndpoints(request, promptTokens, endpoints); len(fitting) > 0 {
+		return fitting, request, nil
+	}
+
+	// Every endpoint has a context window here, otherwise it would fit.
+	largest := endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		if availablePromptTokens(request, endpoint) > availablePromptTokens(request, largest) {
+			largest = endpoint
+		}
+	}
+	available := availablePromptTokens(request, largest)
+	overage := fmt.Errorf(
+		"prompt of %d tokens and %d tokens reserved for the output exceed the context window of %s (%d tokens) by %d tokens",
+		promptTokens,
+		reservedOutputTokens(request, largest),
+		largest.modelStatus.Name,
+		largest.modelStatus.ResolvedCapabilities().MaxContextTokens,
+		promptTokens-available,
+	)
+	if state == nil || state.mode != truncateOldest {
+		return nil, nil, BadRequestError{overage}
+	}
+
+	truncated, dropped := dropOldestMessages(request, available)
+	if truncated == nil {
+		return nil, nil, BadRequestError{fmt.Errorf("%v, even after dropping all but the system messages and the last message", overage)}
+	}
+	state.dropped = dropped
+	return fittingEndpoints(truncated, localPromptTokens(truncated), endpoints), truncated, nil
+}
+
+// Drops the oldest messages until the prompt takes at most maxPromptTokens.
+// System messages and the last message are always kept, and an assistant
+// message is dropped together with the results of its tool calls. Returns
+// nil if the prompt does not fit even then.
+func dropOldestMessages(request *openai.ChatCompletionRequest, maxPromptTokens int) (*openai.ChatCompletionRequest, []int) {
+	groups := messageGroups(request.Messages)
+	dropped := []int{}
+	for _, group := range groups[:max(len(groups)-1, 0)] {
+		dropped = append(dropped, group...)
+
+		truncated := *request
+		truncated.Messages = []openai.Message{}
+		for index, message := range request.Messages {
+			if !array.Contains(dropped, index) {
+				truncated.Messages = append(truncated.Messages, message)
+			}
+		}
+		if localPromptTokens(&truncated) <= maxPromptTokens {
+			return &truncated, dropped
+		}
+	}
+	return nil, nil
+}
+
+// Groups the indices of the messages that must be dropped together, from the
+// oldest. A tool or function result belongs to the group of the assistant
+// message that called it, since providers reject results without their call
+// and calls without their results. System messages are not in any group.
+func messageGroups(messages []openai.Message) [][]int {
+	groups := [][]int{}
+	callOpen := false
+	for index, message := range messages {
+		switch {
+		case message.IsSystem():
+			continue
+		case (message.Role == "tool" || message.Role == "function") && callOpen:
+			groups[len(groups)-1] = append(groups[len(groups)-1], index)
+		default:
+			groups = append(groups, []int{index})
+			callOpen = message.Role == "assistant" && (len(message.ToolCalls) > 0 || message.FunctionCall != nil)
+		}
+	}
+	return groups
+}
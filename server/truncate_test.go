@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestContextWindow(t *testing.T) {
+	// About 100 tokens, so that it never fits a context window of 60.
+	long := strings.Repeat("hello ", 100)
+
+	newProxy := func(t *testing.T, maxContextTokens int) (*ModelProxy, *fakeEndpoint) {
+		model := &ogem.SupportedModel{Name: "small", Capabilities: &ogem.Capabilities{MaxContextTokens: maxContextTokens}}
+		return newSingleEndpointProxy(t, "fake", model, nil)
+	}
+	chatCompletions := func(proxy *ModelProxy, header string, request openai.ChatCompletionRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal(request)
+		assert.NoError(t, err)
+		headers := map[string]string{}
+		if header != "" {
+			headers["X-Ogem-Truncate"] = header
+		}
+		return sendChatCompletions(proxy, string(body), headers, nil)
+	}
+	assistantMessage := func(text string) openai.Message {
+		return openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr(text)}}
+	}
+
+	t.Run("Rejects the request with the overage", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, 60)
+
+		recorder := chatCompletions(proxy, "", openai.ChatCompletionRequest{
+			Model:    "small",
+			Messages: []openai.Message{userMessage(long)},
+		})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "exceed the context window of small (60 tokens) by")
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+
+	t.Run("Reserves the output tokens", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, 60)
+		request := openai.ChatCompletionRequest{Model: "small", Messages: []openai.Message{userMessage("Hi")}}
+
+		assert.Equal(t, http.StatusOK, chatCompletions(proxy, "", request).Code)
+
+		request.MaxCompletionTokens = utils.ToPtr(int32(58))
+		recorder := chatCompletions(proxy, "", request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "58 tokens reserved for the output")
+		assert.Len(t, endpoint.receivedRequests(), 1)
+	})
+
+	t.Run("Routes to the endpoint with a large enough window", func(t *testing.T) {
+		small := &fakeEndpoint{provider: "small", region: "small"}
+		large := &fakeEndpoint{provider: "large", region: "large"}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{
+			"small": {Regions: map[string]*ogem.RegionStatus{"small": {Models: []*ogem.SupportedModel{
+				{Name: "small", OtherNames: []string{"chat"}, Capabilities: &ogem.Capabilities{MaxContextTokens: 60}},
+			}}}},
+			"large": {Regions: map[string]*ogem.RegionStatus{"large": {Models: []*ogem.SupportedModel{
+				{Name: "large", OtherNames: []string{"chat"}, Capabilities: &ogem.Capabilities{MaxContextTokens: 1000}},
+			}}}},
+		}, small, large)
+
+		recorder := chatCompletions(proxy, "", openai.ChatCompletionRequest{Model: "chat", Messages: []openai.Message{userMessage(long)}})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "large/large/large", recorder.Header().Get("X-Ogem-Resolved-Model"))
+		assert.Empty(t, small.receivedRequests())
+	})
+
+	t.Run("Drops the oldest messages if asked", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, 60)
+
+		recorder := chatCompletions(proxy, "oldest", openai.ChatCompletionRequest{
+			Model: "small",
+			Messages: []openai.Message{
+				{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("Be brief.")}},
+				userMessage(long),
+				assistantMessage(long),
+				userMessage("Hi"),
+			},
+		})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "1,2", recorder.Header().Get("X-Ogem-Truncated-Messages"))
+
+		requests := endpoint.receivedRequests()
+		assert.Len(t, requests, 1)
+		assert.Len(t, requests[0].Messages, 2)
+		assert.Equal(t, "system", requests[0].Messages[0].Role)
+		assert.Equal(t, "Hi", *requests[0].Messages[1].Content.String)
+	})
+
+	t.Run("Keeps the tool calls with their results", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, 60)
+
+		recorder := chatCompletions(proxy, "oldest", openai.ChatCompletionRequest{
+			Model: "small",
+			Messages: []openai.Message{
+				userMessage("Search"),
+				{Role: "assistant", ToolCalls: []openai.ToolCall{{Id: "call_1", Type: "function", Function: &openai.FunctionCall{Name: "search", Arguments: "{}"}}}},
+				{Role: "tool", ToolCallId: utils.ToPtr("call_1"), Content: &openai.MessageContent{String: utils.ToPtr(long)}},
+				assistantMessage("Found it."),
+				userMessage("Hi"),
+			},
+		})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		// Dropping the call alone would fit, but would leave its result behind.
+		assert.Equal(t, "0,1,2", recorder.Header().Get("X-Ogem-Truncated-Messages"))
+
+		requests := endpoint.receivedRequests()
+		assert.Len(t, requests, 1)
+		for _, message := range requests[0].Messages {
+			assert.NotEqual(t, "tool", message.Role)
+		}
+	})
+
+	t.Run("Rejects the request if the last message does not fit", func(t *testing.T) {
+		proxy, endpoint := newProxy(t, 60)
+
+		recorder := chatCompletions(proxy, "oldest", openai.ChatCompletionRequest{
+			Model:    "small",
+			Messages: []openai.Message{userMessage("Hi"), userMessage(long)},
+		})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "even after dropping")
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+
+	t.Run("Rejects unknown modes", func(t *testing.T) {
+		proxy, _ := newProxy(t, 60)
+
+		recorder := chatCompletions(proxy, "newest", openai.ChatCompletionRequest{Model: "small", Messages: []openai.Message{userMessage("Hi")}})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+}
+
+func TestMessageGroups(t *testing.T) {
+	messages := []openai.Message{
+		{Role: "system"},
+		{Role: "user"},
+		{Role: "assistant", ToolCalls: []openai.ToolCall{{Id: "call_1"}, {Id: "call_2"}}},
+		{Role: "tool"},
+		{Role: "tool"},
+		{Role: "assistant", FunctionCall: &openai.FunctionCall{Name: "search"}},
+		{Role: "function"},
+		{Role: "assistant"},
+		{Role: "user"},
+	}
+	assert.Equal(t, [][]int{{1}, {2, 3, 4}, {5, 6}, {7}, {8}}, messageGroups(messages))
+}
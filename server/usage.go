@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/tokenizer"
+)
+
+// Fills in the usage of the response with the local tokenizer if the provider
+// reported none, as some OpenAI-compatible servers do, so that the cost of
+// the request is not recorded as zero. The request is the one sent to the
+// endpoint.
+func backfillUsage(request *openai.ChatCompletionRequest, response *openai.ChatCompletionResponse) {
+	usage := &response.Usage
+	if usage.PromptTokens != 0 || usage.CompletionTokens != 0 || usage.TotalTokens != 0 {
+		return
+	}
+
+	completionTokens, err := tokenizer.CountOpenAiCompletion(request.Model, response.Choices)
+	if err != nil {
+		completionTokens = tokenizer.EstimateCompletion(response.Choices)
+	}
+	usage.PromptTokens = int32(localPromptTokens(request))
+	usage.CompletionTokens = completionTokens
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	usage.Estimated = true
+}
+
+// Adds the usage of a response to the total, for the responses of the
+// requests that are billed together.
+func addUsage(total *openai.Usage, usage openai.Usage) {
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	total.TotalTokens += usage.TotalTokens
+	total.CompletionTokensDetails.ReasoningTokens += usage.CompletionTokensDetails.ReasoningTokens
+	if usage.PromptTokensDetails != nil {
+		if total.PromptTokensDetails == nil {
+			total.PromptTokensDetails = &openai.PromptTokensDetails{}
+		}
+		total.PromptTokensDetails.CachedTokens += usage.PromptTokensDetails.CachedTokens
+	}
+	total.Estimated = total.Estimated || usage.Estimated
+	if usage.Cost != nil {
+		cost := *usage.Cost
+		if total.Cost != nil {
+			cost += *total.Cost
+		}
+		total.Cost = &cost
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+)
+
+func TestUsageBackfill(t *testing.T) {
+	newProxy := func(t *testing.T, usage openai.Usage) *ModelProxy {
+		model := &ogem.SupportedModel{Name: "llama-3-70b", InputPrice: 1, OutputPrice: 2}
+		proxy, _ := newSingleEndpointProxy(t, "vllm", model, replyWith("Hello! How can I help you today?", usage))
+		return proxy
+	}
+	chatCompletions := func(proxy *ModelProxy) (*httptest.ResponseRecorder, openai.ChatCompletionResponse) {
+		recorder := sendChatCompletions(proxy, `{"model": "llama-3-70b", "messages": [{"role": "user", "content": "Hello, world!"}]}`, nil, nil)
+		return recorder, decodeChatCompletion(recorder)
+	}
+
+	t.Run("Estimates the usage that the provider omitted", func(t *testing.T) {
+		proxy := newProxy(t, openai.Usage{})
+
+		recorder, response := chatCompletions(proxy)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "true", recorder.Header().Get("X-Ogem-Usage-Estimated"))
+		assert.True(t, response.Usage.Estimated)
+		// "Hello, world!" (4) + "user" (1) + 3 per message + 3 for the reply
+		assert.Equal(t, int32(11), response.Usage.PromptTokens)
+		assert.Equal(t, int32(9), response.Usage.CompletionTokens)
+		assert.Equal(t, int32(20), response.Usage.TotalTokens)
+
+		activity := proxy.activity.list(requestSuccess, "", 1)[0]
+		assert.Equal(t, int32(11), activity.PromptTokens)
+		assert.Equal(t, int32(9), activity.CompletionTokens)
+		assert.InDelta(t, (11*1+9*2)/1e6, activity.Cost, 1e-12)
+	})
+
+	t.Run("Keeps the usage that the provider reported", func(t *testing.T) {
+		proxy := newProxy(t, openai.Usage{PromptTokens: 5, CompletionTokens: 7, TotalTokens: 12})
+
+		recorder, response := chatCompletions(proxy)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Ogem-Usage-Estimated"))
+		assert.Equal(t, openai.Usage{PromptTokens: 5, CompletionTokens: 7, TotalTokens: 12}, response.Usage)
+	})
+}
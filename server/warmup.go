@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/provider"
+)
+
+const defaultWarmupTimeout = 30 * time.Second
+
+// Checks every endpoint once on startup so that the first requests are
+// routed by measured latencies instead of at random.
+type WarmupConfig struct {
+	// Whether to warm up the endpoints on startup. The readiness endpoint
+	// responds with 503 until the warm-up ends.
+	Enabled bool `yaml:"enabled"`
+
+	// Maximum duration of the warm-up. The endpoints that have not answered
+	// by then are tried last until they pass a health check. Defaults to 30s.
+	Timeout string `yaml:"timeout"`
+}
+
+// Pings every endpoint in parallel and generates a one-token completion with
+// each of their models flagged with warmup. The latencies and errors are
+// recorded as those of a health check, so that the endpoints that fail are
+// tried last from the first request. Does nothing unless enabled, and must
+// run before the ping loop.
+func (s *ModelProxy) Warmup(ctx context.Context) {
+	if !s.config.Warmup.Enabled {
+		return
+	}
+	defer s.warming.Store(false)
+
+	ctx, cancel := context.WithTimeout(ctx, s.warmupTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var failed atomic.Int32
+	var wait sync.WaitGroup
+	for _, endpoint := range s.endpoints {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			latency, err := endpoint.Ping(ctx)
+			if err == nil {
+				err = s.warmupCompletions(ctx, endpoint)
+			}
+			if err != nil {
+				failed.Add(1)
+				s.logger.Warnw("Failed to warm up endpoint", "provider", endpoint.Provider(), "region", endpoint.Region(), "error", err)
+			}
+			s.updateEndpointStatus(endpoint.Provider(), endpoint.Region(), latency, err)
+		}()
+	}
+	wait.Wait()
+	s.logger.Infow("Warmed up endpoints", "endpoints", len(s.endpoints), "failed", failed.Load(), "duration", time.Since(start))
+}
+
+// Generates a one-token completion with each model of the region flagged
+// with warmup, and stops at the first that fails.
+func (s *ModelProxy) warmupCompletions(ctx context.Context, endpoint provider.AiEndpoint) error {
+	var models []*ogem.SupportedModel
+	s.mutex.RLock()
+	s.endpointStatus.ForEach(func(provider string, _ ogem.ProviderStatus, region string, _ ogem.RegionStatus, regionModels []*ogem.SupportedModel) bool {
+		if provider != endpoint.Provider() || region != endpoint.Region() {
+			return false
+		}
+		for _, model := range regionModels {
+			if model.Warmup && !strings.HasSuffix(model.Name, "@batch") {
+				models = append(models, model)
+			}
+		}
+		return true
+	})
+	s.mutex.RUnlock()
+
+	for _, model := range models {
+		if err := generateOneToken(ctx, endpoint, model); err != nil {
+			return fmt.Errorf("warm-up completion with %s failed: %w", model.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem"
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/provider"
+)
+
+func TestWarmup(t *testing.T) {
+	newProxy := func(t *testing.T, endpoints map[*fakeEndpoint][]*ogem.SupportedModel) *ModelProxy {
+		regions := map[string]*ogem.RegionStatus{}
+		aiEndpoints := []provider.AiEndpoint{}
+		for endpoint, models := range endpoints {
+			regions[endpoint.region] = &ogem.RegionStatus{Models: models}
+			aiEndpoints = append(aiEndpoints, endpoint)
+		}
+		proxy := newTestProxy(t, ogem.ProvidersStatus{"fake": {Regions: regions}}, aiEndpoints...)
+		proxy.SetPingInterval(time.Hour)
+		proxy.config.Warmup = WarmupConfig{Enabled: true}
+		proxy.warmupTimeout = time.Second
+		proxy.warming.Store(true)
+		return proxy
+	}
+	pingAfter := func(latency time.Duration) func(ctx context.Context) (time.Duration, error) {
+		return func(ctx context.Context) (time.Duration, error) {
+			return latency, nil
+		}
+	}
+	regionStatus := func(proxy *ModelProxy, region string) *ogem.RegionStatus {
+		return proxy.endpointStatus["fake"].Regions[region]
+	}
+
+	t.Run("Seeds the latencies and tries the failed endpoints last", func(t *testing.T) {
+		fast := &fakeEndpoint{provider: "fake", region: "fast", ping: pingAfter(10 * time.Millisecond)}
+		slow := &fakeEndpoint{provider: "fake", region: "slow", ping: pingAfter(50 * time.Millisecond)}
+		broken := &fakeEndpoint{provider: "fake", region: "broken", ping: pingAfter(time.Millisecond), generate: func(ctx context.Context, request *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+			return nil, errors.New("model not deployed")
+		}}
+		down := &fakeEndpoint{provider: "fake", region: "down", ping: func(ctx context.Context) (time.Duration, error) {
+			return 0, errors.New("connection refused")
+		}}
+		warmed := []*ogem.SupportedModel{{Name: "chat@batch", Warmup: true}, {Name: "chat", Warmup: true}}
+		proxy := newProxy(t, map[*fakeEndpoint][]*ogem.SupportedModel{
+			fast:   warmed,
+			slow:   {{Name: "chat"}},
+			broken: warmed,
+			down:   warmed,
+		})
+
+		proxy.Warmup(context.Background())
+
+		assert.Equal(t, 10*time.Millisecond, regionStatus(proxy, "fast").Latency)
+		assert.Equal(t, 50*time.Millisecond, regionStatus(proxy, "slow").Latency)
+		assert.True(t, regionStatus(proxy, "fast").Healthy())
+		assert.True(t, regionStatus(proxy, "slow").Healthy())
+		assert.False(t, regionStatus(proxy, "broken").Healthy())
+		assert.Contains(t, regionStatus(proxy, "broken").LastError, "warm-up completion with chat failed: model not deployed")
+		assert.False(t, regionStatus(proxy, "down").Healthy())
+
+		// Only the flagged models that are not served by the batch API.
+		assert.Len(t, fast.receivedRequests(), 1)
+		assert.Equal(t, "chat", fast.receivedRequests()[0].Model)
+		assert.Equal(t, int32(1), *fast.receivedRequests()[0].MaxTokens)
+		assert.Empty(t, slow.receivedRequests())
+		assert.Empty(t, down.receivedRequests())
+
+		for range 10 {
+			endpoints, err := proxy.sortedEndpoints("", "", "chat")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"fake/fast", "fake/slow"}, []string{endpointKey(endpoints[0]), endpointKey(endpoints[1])})
+		}
+	})
+
+	t.Run("Is not ready until warmed up", func(t *testing.T) {
+		release := make(chan struct{})
+		proxy := newProxy(t, map[*fakeEndpoint][]*ogem.SupportedModel{
+			{provider: "fake", region: "slow", ping: func(ctx context.Context) (time.Duration, error) {
+				<-release
+				return time.Millisecond, nil
+			}}: {{Name: "chat"}},
+		})
+
+		done := make(chan struct{})
+		go func() {
+			proxy.Warmup(context.Background())
+			close(done)
+		}()
+
+		status, response := readiness(proxy)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.False(t, response.Ready)
+		assert.True(t, response.Warming)
+
+		close(release)
+		<-done
+		status, response = readiness(proxy)
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, response.Ready)
+		assert.False(t, response.Warming)
+	})
+
+	t.Run("Gives up on the endpoints at the timeout", func(t *testing.T) {
+		proxy := newProxy(t, map[*fakeEndpoint][]*ogem.SupportedModel{
+			{provider: "fake", region: "hanging", ping: func(ctx context.Context) (time.Duration, error) {
+				<-ctx.Done()
+				return 0, ctx.Err()
+			}}: {{Name: "chat"}},
+			{provider: "fake", region: "fast", ping: pingAfter(time.Millisecond)}: {{Name: "chat"}},
+		})
+		proxy.warmupTimeout = 10 * time.Millisecond
+
+		proxy.Warmup(context.Background())
+
+		assert.False(t, regionStatus(proxy, "hanging").Healthy())
+		assert.Contains(t, regionStatus(proxy, "hanging").LastError, "deadline exceeded")
+		assert.True(t, regionStatus(proxy, "fast").Healthy())
+		_, response := readiness(proxy)
+		assert.True(t, response.Ready)
+	})
+
+	t.Run("Does nothing unless enabled", func(t *testing.T) {
+		endpoint := &fakeEndpoint{provider: "fake", region: "fast"}
+		proxy := newProxy(t, map[*fakeEndpoint][]*ogem.SupportedModel{endpoint: {{Name: "chat", Warmup: true}}})
+		proxy.config.Warmup.Enabled = false
+		proxy.warming.Store(false)
+
+		proxy.Warmup(context.Background())
+
+		assert.True(t, regionStatus(proxy, "fast").LastChecked.IsZero())
+		assert.Empty(t, endpoint.receivedRequests())
+	})
+}
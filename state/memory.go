@@ -3,6 +3,7 @@ package state
 import (
 	"context"
 	"fmt"
+	"maps"
 	"sync"
 	"time"
 
@@ -33,9 +34,28 @@ type cacheEntry struct {
 	readCount int64
 }
 
+// Token bucket of a model, kept as the time at which it is full again, which
+// moves forward by the interval for each accepted request. A request is
+// accepted while that time is at most the tolerance ahead, so that the bucket
+// still has a request left.
+type rateLimit struct {
+	// Unix nanoseconds.
+	fullAt int64
+
+	// (burst - 1) * interval in nanoseconds, as of the last accepted request.
+	tolerance int64
+}
+
+type counters struct {
+	values map[string]float64
+
+	// Unix nanoseconds.
+	expiry int64
+}
+
 type MemoryManager struct {
-	// Key (provider:region:model) -> disabled_until (unix nanoseconds)
-	state   map[string]int64
+	// Key (provider:region:model) -> token bucket
+	state   map[string]rateLimit
 	stateMu sync.RWMutex
 
 	// Any string key -> cache entry
@@ -53,6 +73,14 @@ type MemoryManager struct {
 	// Current size of the cache in bytes
 	cacheUsage int64
 
+	// Lock key -> expiry (unix nanoseconds)
+	locks   map[string]int64
+	locksMu sync.Mutex
+
+	// Counters key -> counters
+	counters   map[string]*counters
+	countersMu sync.Mutex
+
 	// Clock interface for time-related operations. Must use this to avoid
 	// flakiness in tests.
 	clock clock.Clock
@@ -67,8 +95,10 @@ func newMemoryManagerWithClock(
 	clk clock.Clock,
 ) (*MemoryManager, func()) {
 	m := &MemoryManager{
-		state:         make(map[string]int64),
+		state:         make(map[string]rateLimit),
 		cache:         make(map[string]*cacheEntry),
+		locks:         make(map[string]int64),
+		counters:      make(map[string]*counters),
 		cacheMaxBytes: cacheMaxBytes,
 		cacheUsage:    0,
 		clock:         clk,
@@ -91,24 +121,43 @@ func newMemoryManagerWithClock(
 
 func (m *MemoryManager) Allow(
 	ctx context.Context, provider string, region string, model string,
-	// Interval between model uses.
+	// Time to refill a request.
 	interval time.Duration,
+	// Number of requests that the bucket holds. Less than 1 is taken as 1.
+	burst int,
 ) (bool, time.Duration, error) {
 	key := getKey(provider, region, model)
 	now := m.clock.Now().UnixNano()
+	tolerance := int64(max(burst, 1)-1) * interval.Nanoseconds()
 
 	m.stateMu.Lock()
 	defer m.stateMu.Unlock()
 
-	if disabledUntil, exists := m.state[key]; exists && disabledUntil > now {
-		waitDuration := time.Duration(disabledUntil - now)
-		return false, waitDuration, nil
+	fullAt := max(m.state[key].fullAt, now)
+	if fullAt-now > tolerance {
+		return false, time.Duration(fullAt - tolerance - now), nil
 	}
 
-	m.state[key] = now + interval.Nanoseconds()
+	m.state[key] = rateLimit{fullAt: fullAt + interval.Nanoseconds(), tolerance: tolerance}
 	return true, 0, nil
 }
 
+func (m *MemoryManager) Peek(
+	ctx context.Context, provider string, region string, model string,
+) (time.Duration, error) {
+	key := getKey(provider, region, model)
+	now := m.clock.Now().UnixNano()
+
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+
+	limit := m.state[key]
+	if allowedAt := limit.fullAt - limit.tolerance; allowedAt > now {
+		return time.Duration(allowedAt - now), nil
+	}
+	return 0, nil
+}
+
 func (m *MemoryManager) Disable(
 	ctx context.Context, provider string, region string, model string,
 	duration time.Duration,
@@ -119,7 +168,10 @@ func (m *MemoryManager) Disable(
 	m.stateMu.Lock()
 	defer m.stateMu.Unlock()
 
-	m.state[key] = disabledUntil
+	// Empties the bucket until the end of the duration, so that it refills
+	// from then on.
+	tolerance := m.state[key].tolerance
+	m.state[key] = rateLimit{fullAt: disabledUntil + tolerance, tolerance: tolerance}
 	return nil
 }
 
@@ -184,6 +236,52 @@ func (m *MemoryManager) LoadCache(
 	return entry.value, nil
 }
 
+func (m *MemoryManager) AcquireLock(
+	ctx context.Context, key string, duration time.Duration,
+) (bool, error) {
+	now := m.clock.Now().UnixNano()
+
+	m.locksMu.Lock()
+	defer m.locksMu.Unlock()
+
+	if expiry, exists := m.locks[key]; exists && expiry > now {
+		return false, nil
+	}
+	m.locks[key] = now + duration.Nanoseconds()
+	return true, nil
+}
+
+func (m *MemoryManager) ReleaseLock(ctx context.Context, key string) error {
+	m.locksMu.Lock()
+	defer m.locksMu.Unlock()
+
+	delete(m.locks, key)
+	return nil
+}
+
+func (m *MemoryManager) AddCounters(
+	ctx context.Context, key string, increments map[string]float64,
+	duration time.Duration,
+) (map[string]float64, error) {
+	now := m.clock.Now().UnixNano()
+
+	m.countersMu.Lock()
+	defer m.countersMu.Unlock()
+
+	entry, exists := m.counters[key]
+	if !exists || entry.expiry <= now {
+		if len(increments) == 0 {
+			return map[string]float64{}, nil
+		}
+		entry = &counters{values: map[string]float64{}, expiry: now + duration.Nanoseconds()}
+		m.counters[key] = entry
+	}
+	for field, increment := range increments {
+		entry.values[field] += increment
+	}
+	return maps.Clone(entry.values), nil
+}
+
 func getKey(provider string, region string, model string) string {
 	return fmt.Sprintf("%s:%s:%s", provider, region, model)
 }
@@ -216,13 +314,29 @@ func (m *MemoryManager) cleanup() {
 	now := m.clock.Now().UnixNano()
 
 	m.stateMu.Lock()
-	for key, disabledUntil := range m.state {
-		if disabledUntil <= now {
+	for key, limit := range m.state {
+		if limit.fullAt <= now {
 			delete(m.state, key)
 		}
 	}
 	m.stateMu.Unlock()
 
+	m.locksMu.Lock()
+	for key, expiry := range m.locks {
+		if expiry <= now {
+			delete(m.locks, key)
+		}
+	}
+	m.locksMu.Unlock()
+
+	m.countersMu.Lock()
+	for key, entry := range m.counters {
+		if entry.expiry <= now {
+			delete(m.counters, key)
+		}
+	}
+	m.countersMu.Unlock()
+
 	m.cacheMu.Lock()
 	var expiredEntries []*cacheEntry
 	for _, entry := range m.cache {
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -34,13 +36,13 @@ func TestMemoryManager(t *testing.T) {
 		interval := 100 * time.Millisecond
 
 		// Initial request should be allowed
-		allowed, wait, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.True(t, allowed)
 		assert.Equal(t, time.Duration(0), wait)
 
 		// Request within interval should not be allowed
-		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.False(t, allowed)
 		assert.True(t, wait > 0)
@@ -49,7 +51,7 @@ func TestMemoryManager(t *testing.T) {
 		mockClock.Add(interval)
 
 		// Request after interval should be allowed
-		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.True(t, allowed)
 		assert.Equal(t, time.Duration(0), wait)
@@ -60,7 +62,7 @@ func TestMemoryManager(t *testing.T) {
 		assert.NoError(t, err)
 
 		// Request while disabled should not be allowed
-		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.False(t, allowed)
 		assert.True(t, wait > 0)
@@ -69,12 +71,160 @@ func TestMemoryManager(t *testing.T) {
 		mockClock.Add(disableDuration)
 
 		// Request after disable period should be allowed
-		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.True(t, allowed)
 		assert.Equal(t, time.Duration(0), wait)
 	})
 
+	t.Run("Peek", func(t *testing.T) {
+		mockClock := clock.NewMock()
+		manager, cleanup := newMemoryManagerWithClock(1024, mockClock)
+		defer cleanup()
+
+		ctx := context.Background()
+
+		// Unknown model is available
+		wait, err := manager.Peek(ctx, "openai", "us-east-1", "gpt-4")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+
+		err = manager.Disable(ctx, "openai", "us-east-1", "gpt-4", time.Minute)
+		assert.NoError(t, err)
+		mockClock.Add(10 * time.Second)
+
+		// Peeking does not consume the model
+		for range 2 {
+			wait, err = manager.Peek(ctx, "openai", "us-east-1", "gpt-4")
+			assert.NoError(t, err)
+			assert.Equal(t, 50*time.Second, wait)
+		}
+
+		mockClock.Add(50 * time.Second)
+		wait, err = manager.Peek(ctx, "openai", "us-east-1", "gpt-4")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+
+		// The model is still allowed after peeking
+		allowed, _, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", time.Second, 1)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	})
+
+	t.Run("Burst", func(t *testing.T) {
+		mockClock := clock.NewMock()
+		manager, cleanup := newMemoryManagerWithClock(1024, mockClock)
+		defer cleanup()
+
+		ctx := context.Background()
+		interval := time.Second
+
+		// Concurrent requests are accepted up to the burst
+		var accepted atomic.Int32
+		var waitGroup sync.WaitGroup
+		for range 50 {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				allowed, _, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 10)
+				assert.NoError(t, err)
+				if allowed {
+					accepted.Add(1)
+				}
+			}()
+		}
+		waitGroup.Wait()
+		assert.Equal(t, int32(10), accepted.Load())
+
+		allowed, wait, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 10)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, interval, wait)
+
+		// One request is refilled every interval
+		mockClock.Add(2500 * time.Millisecond)
+		for range 2 {
+			allowed, _, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 10)
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+		}
+		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 10)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 500*time.Millisecond, wait)
+
+		// The bucket refills to the burst, not beyond
+		mockClock.Add(time.Hour)
+		for range 10 {
+			allowed, _, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 10)
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+		}
+		allowed, _, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 10)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+	})
+
+	t.Run("Lock operations", func(t *testing.T) {
+		mockClock := clock.NewMock()
+		manager, cleanup := newMemoryManagerWithClock(1024, mockClock)
+		defer cleanup()
+
+		ctx := context.Background()
+
+		acquired, err := manager.AcquireLock(ctx, "lock", time.Second)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		// Held until released
+		acquired, err = manager.AcquireLock(ctx, "lock", time.Second)
+		assert.NoError(t, err)
+		assert.False(t, acquired)
+
+		assert.NoError(t, manager.ReleaseLock(ctx, "lock"))
+		acquired, err = manager.AcquireLock(ctx, "lock", time.Second)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		// Or until expired
+		mockClock.Add(time.Second)
+		acquired, err = manager.AcquireLock(ctx, "lock", time.Second)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+	})
+
+	t.Run("Counters", func(t *testing.T) {
+		mockClock := clock.NewMock()
+		manager, cleanup := newMemoryManagerWithClock(1024, mockClock)
+		defer cleanup()
+
+		ctx := context.Background()
+
+		// Reading does not create them.
+		values, err := manager.AddCounters(ctx, "usage", nil, time.Hour)
+		assert.NoError(t, err)
+		assert.Empty(t, values)
+		assert.Empty(t, manager.counters)
+
+		values, err = manager.AddCounters(ctx, "usage", map[string]float64{"tokens": 100, "cost": 0.25}, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"tokens": 100, "cost": 0.25}, values)
+
+		// Kept for the duration from the first increment.
+		mockClock.Add(30 * time.Minute)
+		values, err = manager.AddCounters(ctx, "usage", map[string]float64{"tokens": 50, "requests": 1}, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"tokens": 150, "cost": 0.25, "requests": 1}, values)
+
+		mockClock.Add(30 * time.Minute)
+		values, err = manager.AddCounters(ctx, "usage", nil, time.Hour)
+		assert.NoError(t, err)
+		assert.Empty(t, values)
+		values, err = manager.AddCounters(ctx, "usage", map[string]float64{"tokens": 10}, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"tokens": 10}, values)
+	})
+
 	t.Run("Cache operations", func(t *testing.T) {
 		mockClock := clock.NewMock()
 		manager, cleanup := newMemoryManagerWithClock(1024, mockClock)
@@ -212,20 +362,20 @@ func TestMemoryManager(t *testing.T) {
 		interval := 100 * time.Millisecond
 
 		// Initial request
-		allowed, _, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, _, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.True(t, allowed)
 
 		// Request exactly 50ms after
 		mockClock.Add(50 * time.Millisecond)
-		allowed, wait, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err := manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.False(t, allowed)
 		assert.Equal(t, 50*time.Millisecond, wait)
 
 		// Request exactly at interval boundary
 		mockClock.Add(50 * time.Millisecond)
-		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval)
+		allowed, wait, err = manager.Allow(ctx, "openai", "us-east-1", "gpt-4", interval, 1)
 		assert.NoError(t, err)
 		assert.True(t, allowed)
 		assert.Equal(t, time.Duration(0), wait)
@@ -0,0 +1,233 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultCooldown         = 30 * time.Second
+
+	// Maximum time of a backend call. The Valkey client retries read
+	// commands until the context is done, which would block the request
+	// forever while Valkey is down.
+	defaultCallTimeout = time.Second
+)
+
+// Wraps a manager whose backend may become unreachable, such as Valkey, so
+// that requests are served without it instead of failing. On a connection
+// error, the call falls back to memory: cache lookups miss, cache saves are
+// dropped, and rate limits are kept in a local memory manager. After
+// failureThreshold consecutive connection errors, the backend is not called
+// at all for the cooldown, and then tried again.
+type ResilientManager struct {
+	backend  Manager
+	fallback *MemoryManager
+
+	failureThreshold int
+	cooldown         time.Duration
+	callTimeout      time.Duration
+
+	// Consecutive connection errors of the backend.
+	failures int
+
+	// Time until which the backend is not called. Zero if not degraded.
+	degradedUntil time.Time
+	mutex         sync.Mutex
+
+	logger *zap.SugaredLogger
+
+	// Clock interface for time-related operations. Must use this to avoid
+	// flakiness in tests.
+	clock clock.Clock
+}
+
+// Zero failureThreshold and cooldown use the defaults.
+func NewResilientManager(backend Manager, failureThreshold int, cooldown time.Duration, logger *zap.SugaredLogger) (*ResilientManager, func()) {
+	return newResilientManagerWithClock(backend, failureThreshold, cooldown, logger, clock.New())
+}
+
+func newResilientManagerWithClock(
+	backend Manager,
+	failureThreshold int,
+	cooldown time.Duration,
+	logger *zap.SugaredLogger,
+	clk clock.Clock,
+) (*ResilientManager, func()) {
+	if failureThreshold <= 0 {
+		failureThreshold = DefaultFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+
+	// Only rate limits are kept in memory, so the cache size does not matter.
+	fallback, cleanup := newMemoryManagerWithClock(0, clk)
+	return &ResilientManager{
+		backend:          backend,
+		fallback:         fallback,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		callTimeout:      defaultCallTimeout,
+		logger:           logger,
+		clock:            clk,
+	}, cleanup
+}
+
+// Whether the backend is skipped because of consecutive connection errors.
+func (m *ResilientManager) Degraded() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.clock.Now().Before(m.degradedUntil)
+}
+
+// Records the result of a backend call. Returns whether the call failed to
+// reach the backend, in which case the caller falls back to memory.
+func (m *ResilientManager) record(err error) bool {
+	connectionError := isConnectionError(err)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !connectionError {
+		if m.failures >= m.failureThreshold {
+			m.logger.Infow("State backend recovered; leaving degraded mode")
+		}
+		m.failures = 0
+		m.degradedUntil = time.Time{}
+		return false
+	}
+
+	m.failures++
+	if m.failures >= m.failureThreshold {
+		m.degradedUntil = m.clock.Now().Add(m.cooldown)
+		m.logger.Errorw(
+			"State backend is unreachable; serving without cache and with in-memory rate limits",
+			"error", err,
+			"consecutive_failures", m.failures,
+			"cooldown", m.cooldown,
+		)
+	} else {
+		m.logger.Warnw("Failed to reach state backend", "error", err, "consecutive_failures", m.failures)
+	}
+	return true
+}
+
+// Whether the error means that the backend could not be reached, as opposed
+// to an error reply or a cache miss. Canceled requests do not count.
+func isConnectionError(err error) bool {
+	if err == nil || valkey.IsValkeyNil(err) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	_, isReply := valkey.IsValkeyErr(err)
+	return !isReply
+}
+
+func (m *ResilientManager) Allow(ctx context.Context, provider string, region string, model string, interval time.Duration, burst int) (bool, time.Duration, error) {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		allowed, wait, err := m.backend.Allow(callCtx, provider, region, model, interval, burst)
+		cancel()
+		if !m.record(err) {
+			return allowed, wait, err
+		}
+	}
+	return m.fallback.Allow(ctx, provider, region, model, interval, burst)
+}
+
+func (m *ResilientManager) Peek(ctx context.Context, provider string, region string, model string) (time.Duration, error) {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		wait, err := m.backend.Peek(callCtx, provider, region, model)
+		cancel()
+		if !m.record(err) {
+			return wait, err
+		}
+	}
+	return m.fallback.Peek(ctx, provider, region, model)
+}
+
+func (m *ResilientManager) Disable(ctx context.Context, provider string, region string, model string, duration time.Duration) error {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		err := m.backend.Disable(callCtx, provider, region, model, duration)
+		cancel()
+		if !m.record(err) {
+			return err
+		}
+	}
+	return m.fallback.Disable(ctx, provider, region, model, duration)
+}
+
+func (m *ResilientManager) SaveCache(ctx context.Context, key string, value []byte, duration time.Duration) error {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		err := m.backend.SaveCache(callCtx, key, value, duration)
+		cancel()
+		if !m.record(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ResilientManager) LoadCache(ctx context.Context, key string) ([]byte, error) {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		value, err := m.backend.LoadCache(callCtx, key)
+		cancel()
+		if !m.record(err) {
+			return value, err
+		}
+	}
+	return nil, nil
+}
+
+// Falls back to the memory locks, which still keep the identical requests of
+// this instance from calling the provider at once.
+func (m *ResilientManager) AcquireLock(ctx context.Context, key string, duration time.Duration) (bool, error) {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		acquired, err := m.backend.AcquireLock(callCtx, key, duration)
+		cancel()
+		if !m.record(err) {
+			return acquired, err
+		}
+	}
+	return m.fallback.AcquireLock(ctx, key, duration)
+}
+
+func (m *ResilientManager) ReleaseLock(ctx context.Context, key string) error {
+	// The lock may have been acquired from either of them.
+	fallbackErr := m.fallback.ReleaseLock(ctx, key)
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		err := m.backend.ReleaseLock(callCtx, key)
+		cancel()
+		if !m.record(err) {
+			return err
+		}
+	}
+	return fallbackErr
+}
+
+// Falls back to the memory counters, so that each instance counts on its own
+// until the backend is back.
+func (m *ResilientManager) AddCounters(ctx context.Context, key string, increments map[string]float64, duration time.Duration) (map[string]float64, error) {
+	if !m.Degraded() {
+		callCtx, cancel := context.WithTimeout(ctx, m.callTimeout)
+		values, err := m.backend.AddCounters(callCtx, key, increments, duration)
+		cancel()
+		if !m.record(err) {
+			return values, err
+		}
+	}
+	return m.fallback.AddCounters(ctx, key, increments, duration)
+}
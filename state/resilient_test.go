@@ -0,0 +1,145 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/valkey-io/valkey-go"
+	"go.uber.org/zap"
+)
+
+func TestResilientManager(t *testing.T) {
+	newManager := func(t *testing.T) (*ResilientManager, *miniredis.Miniredis, *clock.Mock) {
+		server := miniredis.RunT(t)
+		client, err := valkey.NewClient(valkey.ClientOption{
+			InitAddress:  []string{server.Addr()},
+			DisableCache: true,
+		})
+		assert.NoError(t, err)
+		t.Cleanup(client.Close)
+
+		mockClock := clock.NewMock()
+		manager, cleanup := newResilientManagerWithClock(NewValkeyManager(client), 2, time.Minute, zap.NewNop().Sugar(), mockClock)
+		t.Cleanup(cleanup)
+		manager.callTimeout = 100 * time.Millisecond
+		return manager, server, mockClock
+	}
+
+	t.Run("Uses Valkey while it is reachable", func(t *testing.T) {
+		manager, server, _ := newManager(t)
+		ctx := context.Background()
+
+		assert.NoError(t, manager.SaveCache(ctx, "key", []byte("value"), time.Minute))
+		value, err := server.Get("ogem:key")
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+
+		cached, err := manager.LoadCache(ctx, "key")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), cached)
+
+		missing, err := manager.LoadCache(ctx, "missing")
+		assert.NoError(t, err)
+		assert.Nil(t, missing)
+		assert.False(t, manager.Degraded())
+	})
+
+	t.Run("Serves without Valkey and recovers", func(t *testing.T) {
+		manager, server, mockClock := newManager(t)
+		ctx := context.Background()
+		assert.NoError(t, manager.SaveCache(ctx, "key", []byte("value"), time.Hour))
+
+		server.Close()
+
+		// Every call succeeds as if there was no cache.
+		cached, err := manager.LoadCache(ctx, "key")
+		assert.NoError(t, err)
+		assert.Nil(t, cached)
+		assert.False(t, manager.Degraded())
+
+		assert.NoError(t, manager.SaveCache(ctx, "other", []byte("value"), time.Hour))
+		assert.True(t, manager.Degraded())
+
+		// The rate limits are kept in memory.
+		allowed, _, err := manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Minute, 1)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		allowed, wait, err := manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Minute, 1)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, time.Minute, wait)
+
+		assert.NoError(t, server.Restart())
+		// Valkey is not called until the cooldown is over.
+		cached, err = manager.LoadCache(ctx, "key")
+		assert.NoError(t, err)
+		assert.Nil(t, cached)
+
+		mockClock.Add(time.Minute)
+		cached, err = manager.LoadCache(ctx, "key")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), cached)
+		assert.False(t, manager.Degraded())
+
+		assert.NoError(t, manager.SaveCache(ctx, "other", []byte("value"), time.Hour))
+		assert.True(t, server.Exists("ogem:other"))
+	})
+
+	t.Run("Counts in memory without Valkey", func(t *testing.T) {
+		manager, server, _ := newManager(t)
+		ctx := context.Background()
+
+		values, err := manager.AddCounters(ctx, "usage", map[string]float64{"requests": 1}, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"requests": 1}, values)
+		assert.True(t, server.Exists("ogem:usage"))
+
+		server.Close()
+
+		// Starts over on this instance, since the shared counters are out of
+		// reach.
+		for range 2 {
+			values, err = manager.AddCounters(ctx, "usage", map[string]float64{"requests": 1}, time.Hour)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, map[string]float64{"requests": 2}, values)
+		assert.True(t, manager.Degraded())
+	})
+
+	t.Run("Keeps the locks in memory without Valkey", func(t *testing.T) {
+		manager, server, _ := newManager(t)
+		ctx := context.Background()
+
+		acquired, err := manager.AcquireLock(ctx, "lock", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+		assert.True(t, server.Exists("ogem:lock"))
+		acquired, err = manager.AcquireLock(ctx, "lock", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, acquired)
+		assert.NoError(t, manager.ReleaseLock(ctx, "lock"))
+		assert.False(t, server.Exists("ogem:lock"))
+
+		server.Close()
+
+		acquired, err = manager.AcquireLock(ctx, "lock", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+		acquired, err = manager.AcquireLock(ctx, "lock", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, acquired)
+	})
+}
+
+func TestIsConnectionError(t *testing.T) {
+	assert.False(t, isConnectionError(nil))
+	assert.False(t, isConnectionError(valkey.Nil))
+	assert.False(t, isConnectionError(context.Canceled))
+	assert.True(t, isConnectionError(valkey.ErrClosing))
+	assert.True(t, isConnectionError(errors.New("dial tcp: connection refused")))
+}
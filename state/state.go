@@ -5,10 +5,20 @@ import (
 	"time"
 )
 
+// Keys are relative to the namespace of the manager, if it has one. E.g.,
+// "cache:<hash>"
 type Manager interface {
-	// Checks if the model in the region of the provider is allowed to be used.
-	// If not, returns false and the duration to wait before retrying.
-	Allow(ctx context.Context, provider string, region string, model string, interval time.Duration) (bool, time.Duration, error)
+	// Checks if the model in the region of the provider is allowed to be used,
+	// and if so consumes a request. The requests are limited by a token bucket
+	// that holds burst requests and refills one every interval, so a burst of
+	// 1 spaces the requests by the interval. If not allowed, returns false and
+	// the duration to wait before retrying.
+	Allow(ctx context.Context, provider string, region string, model string, interval time.Duration, burst int) (bool, time.Duration, error)
+
+	// Returns the duration to wait before the model in the region of the
+	// provider is allowed to be used, without consuming a request. Zero if it
+	// is allowed now.
+	Peek(ctx context.Context, provider string, region string, model string) (time.Duration, error)
 
 	// Disables the model in the region of the provider for a given duration.
 	Disable(ctx context.Context, provider string, region string, model string, duration time.Duration) error
@@ -18,4 +28,24 @@ type Manager interface {
 
 	// Loads the cache for a given key.
 	LoadCache(ctx context.Context, key string) ([]byte, error)
+
+	// Acquires the lock of a given key for at most a given duration. Returns
+	// false if another caller holds it.
+	AcquireLock(ctx context.Context, key string, duration time.Duration) (bool, error)
+
+	// Releases the lock of a given key, even if it has been acquired by
+	// another caller after expiring.
+	ReleaseLock(ctx context.Context, key string) error
+
+	// Adds the increments to the counters of a given key and returns all its
+	// counters. The counters are created with the first increment and kept
+	// for the duration from then. Without increments, only reads them.
+	AddCounters(ctx context.Context, key string, increments map[string]float64, duration time.Duration) (map[string]float64, error)
+}
+
+// Implemented by the managers that may serve from a fallback when their
+// backend is unreachable.
+type DegradationReporter interface {
+	// Whether the manager currently serves from its fallback.
+	Degraded() bool
 }
@@ -3,38 +3,92 @@ package state
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/valkey-io/valkey-go"
 )
 
+// Namespace of the keys before it was configurable.
+const DefaultNamespace = "ogem"
+
 type ValkeyManager struct {
 	client valkey.Client
+
+	// Prepended to every key with a colon.
+	namespace string
+
+	// Whether LoadCache falls back to the key in DefaultNamespace.
+	legacyReads bool
+}
+
+type ValkeyOptions struct {
+	// Prepended to every key with a colon, so that the deployments sharing
+	// Valkey keep their state apart. Defaults to DefaultNamespace. E.g., "prod-eu"
+	Namespace string
+
+	// Whether LoadCache reads the key in DefaultNamespace if it is missing in
+	// Namespace. Keeps the responses cached before moving to a namespace
+	// while the new one fills.
+	LegacyReads bool
 }
 
 func NewValkeyManager(client valkey.Client) *ValkeyManager {
-	return &ValkeyManager{client: client}
+	return NewValkeyManagerWithOptions(client, ValkeyOptions{})
+}
+
+func NewValkeyManagerWithOptions(client valkey.Client, options ValkeyOptions) *ValkeyManager {
+	namespace := options.Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &ValkeyManager{
+		client:      client,
+		namespace:   namespace,
+		legacyReads: options.LegacyReads && namespace != DefaultNamespace,
+	}
+}
+
+func (r *ValkeyManager) Namespace() string {
+	return r.namespace
+}
+
+func (r *ValkeyManager) key(key string) string {
+	return r.namespace + ":" + key
 }
 
-func (r *ValkeyManager) Allow(ctx context.Context, provider string, region string, model string, interval time.Duration) (bool, time.Duration, error) {
-	key := fmt.Sprintf("ogem:disabled:%s:%s:%s", provider, region, model)
+// Token bucket of a model, kept in a hash as the time at which it is full
+// again (full_at), which moves forward by the interval for each accepted
+// request, and (burst - 1) * interval (tolerance), both in microseconds. A
+// request is accepted while full_at is at most the tolerance ahead. The key
+// expires when the bucket is full.
+func (r *ValkeyManager) bucketKey(provider string, region string, model string) string {
+	return r.key(fmt.Sprintf("bucket:%s:%s:%s", provider, region, model))
+}
 
+func (r *ValkeyManager) Allow(ctx context.Context, provider string, region string, model string, interval time.Duration, burst int) (bool, time.Duration, error) {
 	script := `
-		local current_time_micro = redis.call('TIME')[1] * 1000000 + redis.call('TIME')[2]
-		local disabled_until_micro = redis.call('GET', KEYS[1])
-
-		if not disabled_until_micro or tonumber(disabled_until_micro) <= current_time_micro then
-			local new_disabled_until_micro = current_time_micro + tonumber(ARGV[1]) * 1000
-			redis.call('SET', KEYS[1], new_disabled_until_micro)
-			redis.call('PEXPIRE', KEYS[1], ARGV[1])
-			return {1}
-		else
-			return {0, tonumber(disabled_until_micro) - current_time_micro}
+		local time = redis.call('TIME')
+		local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+		local interval = tonumber(ARGV[1])
+		local tolerance = tonumber(ARGV[2])
+		local full_at = math.max(tonumber(redis.call('HGET', KEYS[1], 'full_at') or 0), now)
+
+		if full_at - now > tolerance then
+			return {0, full_at - tolerance - now}
 		end
+		full_at = full_at + interval
+		redis.call('HSET', KEYS[1], 'full_at', string.format('%d', full_at), 'tolerance', string.format('%d', tolerance))
+		redis.call('PEXPIRE', KEYS[1], math.ceil((full_at - now) / 1000))
+		return {1}
 	`
 
-	resp := r.client.Do(ctx, r.client.B().Eval().Script(script).Numkeys(1).Key(key).Arg(
-		fmt.Sprintf("%d", interval.Milliseconds()),
+	tolerance := time.Duration(max(burst, 1)-1) * interval
+	resp := r.client.Do(ctx, r.client.B().Eval().Script(script).Numkeys(1).Key(r.bucketKey(provider, region, model)).Arg(
+		fmt.Sprintf("%d", interval.Microseconds()),
+		fmt.Sprintf("%d", tolerance.Microseconds()),
 	).Build())
 
 	result, err := resp.AsIntSlice()
@@ -49,19 +103,39 @@ func (r *ValkeyManager) Allow(ctx context.Context, provider string, region strin
 	}
 }
 
-func (r *ValkeyManager) Disable(ctx context.Context, provider string, region string, model string, duration time.Duration) error {
-	key := fmt.Sprintf("ogem:disabled:%s:%s:%s", provider, region, model)
+func (r *ValkeyManager) Peek(ctx context.Context, provider string, region string, model string) (time.Duration, error) {
+	script := `
+		local time = redis.call('TIME')
+		local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+		local bucket = redis.call('HMGET', KEYS[1], 'full_at', 'tolerance')
+		if not bucket[1] then
+			return 0
+		end
+		return math.max(tonumber(bucket[1]) - tonumber(bucket[2] or 0) - now, 0)
+	`
 
+	wait, err := r.client.Do(ctx, r.client.B().Eval().Script(script).Numkeys(1).Key(r.bucketKey(provider, region, model)).Build()).AsInt64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Microsecond, nil
+}
+
+// Empties the bucket until the end of the duration, keeping its tolerance, so
+// that it refills from then on.
+func (r *ValkeyManager) Disable(ctx context.Context, provider string, region string, model string, duration time.Duration) error {
 	script := `
-		local current_time_micro = redis.call('TIME')[1] * 1000000 + redis.call('TIME')[2]
-		local new_disabled_until_micro = current_time_micro + tonumber(ARGV[1]) * 1000
-		redis.call('SET', KEYS[1], new_disabled_until_micro)
-		redis.call('PEXPIRE', KEYS[1], ARGV[1])
-		return new_disabled_until_micro
+		local time = redis.call('TIME')
+		local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+		local tolerance = tonumber(redis.call('HGET', KEYS[1], 'tolerance') or 0)
+		local full_at = now + tonumber(ARGV[1]) + tolerance
+		redis.call('HSET', KEYS[1], 'full_at', string.format('%d', full_at), 'tolerance', string.format('%d', tolerance))
+		redis.call('PEXPIRE', KEYS[1], math.ceil((full_at - now) / 1000))
+		return full_at
 	`
 
-	resp := r.client.Do(ctx, r.client.B().Eval().Script(script).Numkeys(1).Key(key).Arg(
-		fmt.Sprintf("%d", duration.Milliseconds()),
+	resp := r.client.Do(ctx, r.client.B().Eval().Script(script).Numkeys(1).Key(r.bucketKey(provider, region, model)).Arg(
+		fmt.Sprintf("%d", duration.Microseconds()),
 	).Build())
 
 	return resp.Error()
@@ -72,7 +146,7 @@ func (r *ValkeyManager) SaveCache(
 ) error {
 	return r.client.Do(
 		ctx, r.client.B().Set().
-			Key(key).
+			Key(r.key(key)).
 			Value(valkey.BinaryString(value)).
 			Ex(duration).
 			Build(),
@@ -80,6 +154,15 @@ func (r *ValkeyManager) SaveCache(
 }
 
 func (r *ValkeyManager) LoadCache(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.get(ctx, r.key(key))
+	if value != nil || err != nil || !r.legacyReads {
+		return value, err
+	}
+	return r.get(ctx, DefaultNamespace+":"+key)
+}
+
+// Returns nil if the key does not exist.
+func (r *ValkeyManager) get(ctx context.Context, key string) ([]byte, error) {
 	valkeyResponse := r.client.Do(ctx, r.client.B().Get().Key(key).Build())
 	if err := valkeyResponse.Error(); err != nil {
 		if valkey.IsValkeyNil(err) {
@@ -89,3 +172,59 @@ func (r *ValkeyManager) LoadCache(ctx context.Context, key string) ([]byte, erro
 	}
 	return valkeyResponse.AsBytes()
 }
+
+func (r *ValkeyManager) AcquireLock(ctx context.Context, key string, duration time.Duration) (bool, error) {
+	err := r.client.Do(
+		ctx, r.client.B().Set().
+			Key(r.key(key)).
+			Value("1").
+			Nx().
+			Px(duration).
+			Build(),
+	).Error()
+	if err != nil {
+		// NX replies nil if the key exists.
+		if valkey.IsValkeyNil(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *ValkeyManager) ReleaseLock(ctx context.Context, key string) error {
+	return r.client.Do(ctx, r.client.B().Del().Key(r.key(key)).Build()).Error()
+}
+
+// Counters are kept in a hash, whose expiry is set when it is created.
+func (r *ValkeyManager) AddCounters(ctx context.Context, key string, increments map[string]float64, duration time.Duration) (map[string]float64, error) {
+	script := `
+		for i = 1, #ARGV - 1, 2 do
+			redis.call('HINCRBYFLOAT', KEYS[1], ARGV[i], ARGV[i + 1])
+		end
+		if #ARGV > 1 and redis.call('PTTL', KEYS[1]) == -1 then
+			redis.call('PEXPIRE', KEYS[1], ARGV[#ARGV])
+		end
+		return redis.call('HGETALL', KEYS[1])
+	`
+
+	args := []string{}
+	for _, field := range slices.Sorted(maps.Keys(increments)) {
+		args = append(args, field, strconv.FormatFloat(increments[field], 'f', -1, 64))
+	}
+	args = append(args, fmt.Sprintf("%d", duration.Milliseconds()))
+
+	result, err := r.client.Do(ctx, r.client.B().Eval().Script(script).Numkeys(1).Key(r.key(key)).Arg(args...).Build()).AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for index := 0; index+1 < len(result); index += 2 {
+		value, err := strconv.ParseFloat(result[index+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter %s: %v", result[index], err)
+		}
+		values[result[index]] = value
+	}
+	return values, nil
+}
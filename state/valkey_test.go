@@ -6,7 +6,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/valkey-io/valkey-go"
 	valkeymock "github.com/valkey-io/valkey-go/mock"
 	"go.uber.org/mock/gomock"
 )
@@ -25,13 +27,14 @@ func TestValkeyManager(t *testing.T) {
 			mockClient.EXPECT().
 				Do(ctx, valkeymock.MatchFn(func(cmd []string) bool {
 					return cmd[0] == "EVAL" &&
-						cmd[len(cmd)-2] == "ogem:disabled:openai:us-east1:gpt4" &&
-						cmd[len(cmd)-1] == "100"
-				}, "EVAL script with correct key and interval")).
+						cmd[len(cmd)-3] == "ogem:bucket:openai:us-east1:gpt4" &&
+						cmd[len(cmd)-2] == "100000" &&
+						cmd[len(cmd)-1] == "0"
+				}, "EVAL script with correct key, interval and tolerance")).
 				Return(mockResponse)
 
 			allowed, wait, err := manager.Allow(
-				ctx, "openai", "us-east1", "gpt4", 100*time.Millisecond)
+				ctx, "openai", "us-east1", "gpt4", 100*time.Millisecond, 1)
 
 			assert.NoError(t, err)
 			assert.True(t, allowed)
@@ -54,15 +57,16 @@ func TestValkeyManager(t *testing.T) {
 			mockClient.EXPECT().
 				Do(ctx, valkeymock.MatchFn(func(cmd []string) bool {
 					return cmd[0] == "EVAL" &&
-						cmd[len(cmd)-2] == "ogem:disabled:openai:us-east1:gpt4" &&
-						cmd[len(cmd)-1] == "100"
-				}, "EVAL script with correct key and interval")).
+						cmd[len(cmd)-3] == "ogem:bucket:openai:us-east1:gpt4" &&
+						cmd[len(cmd)-2] == "100000" &&
+						cmd[len(cmd)-1] == "0"
+				}, "EVAL script with correct key, interval and tolerance")).
 				Return(mockResponse)
 
 			// Parameters here do not matter because the mock response is always
 			// the same.
 			allowed, wait, err := manager.Allow(
-				ctx, "openai", "us-east1", "gpt4", 100*time.Millisecond)
+				ctx, "openai", "us-east1", "gpt4", 100*time.Millisecond, 1)
 
 			assert.NoError(t, err)
 			assert.False(t, allowed)
@@ -81,7 +85,7 @@ func TestValkeyManager(t *testing.T) {
 				Do(ctx, gomock.Any()).
 				Return(valkeymock.ErrorResult(fmt.Errorf("redis error")))
 
-			allowed, wait, err := manager.Allow(ctx, "openai", "us-east1", "gpt4", 100*time.Millisecond)
+			allowed, wait, err := manager.Allow(ctx, "openai", "us-east1", "gpt4", 100*time.Millisecond, 1)
 
 			assert.Error(t, err)
 			assert.False(t, allowed)
@@ -89,6 +93,196 @@ func TestValkeyManager(t *testing.T) {
 		})
 	})
 
+	t.Run("Peek method", func(t *testing.T) {
+		t.Run("returns the time until a request is left", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := valkeymock.NewClient(ctrl)
+			manager := NewValkeyManager(mockClient)
+			ctx := context.Background()
+
+			mockClient.EXPECT().
+				Do(ctx, valkeymock.MatchFn(func(cmd []string) bool {
+					return cmd[0] == "EVAL" && cmd[len(cmd)-1] == "ogem:bucket:openai:us-east1:gpt4"
+				}, "EVAL script with correct key")).
+				Return(valkeymock.Result(valkeymock.ValkeyInt64(1500000)))
+
+			wait, err := manager.Peek(ctx, "openai", "us-east1", "gpt4")
+
+			assert.NoError(t, err)
+			assert.Equal(t, 1500*time.Millisecond, wait)
+		})
+	})
+
+	t.Run("Token bucket", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		client, err := valkey.NewClient(valkey.ClientOption{
+			InitAddress:  []string{server.Addr()},
+			DisableCache: true,
+		})
+		assert.NoError(t, err)
+		t.Cleanup(client.Close)
+		manager := NewValkeyManager(client)
+		ctx := context.Background()
+		start := time.Unix(1700000000, 0)
+		server.SetTime(start)
+
+		// A burst of 3 is accepted at once, and the fourth request waits for
+		// a refill.
+		for range 3 {
+			allowed, _, err := manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Second, 3)
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+		}
+		allowed, wait, err := manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Second, 3)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, time.Second, wait)
+		wait, err = manager.Peek(ctx, "openai", "openai", "gpt-4o")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Second, wait)
+
+		// One request is refilled every interval.
+		server.SetTime(start.Add(1500 * time.Millisecond))
+		allowed, _, err = manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Second, 3)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		allowed, wait, err = manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Second, 3)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 500*time.Millisecond, wait)
+
+		// Disabling empties the bucket until the end.
+		assert.NoError(t, manager.Disable(ctx, "openai", "openai", "gpt-4o", time.Minute))
+		wait, err = manager.Peek(ctx, "openai", "openai", "gpt-4o")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Minute, wait)
+		server.SetTime(start.Add(1500*time.Millisecond + time.Minute))
+		allowed, _, err = manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Second, 3)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+
+		wait, err = manager.Peek(ctx, "openai", "unknown", "gpt-4o")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	})
+
+	t.Run("Namespace", func(t *testing.T) {
+		newManager := func(t *testing.T, options ValkeyOptions) (*ValkeyManager, *miniredis.Miniredis) {
+			server := miniredis.RunT(t)
+			client, err := valkey.NewClient(valkey.ClientOption{
+				InitAddress:  []string{server.Addr()},
+				DisableCache: true,
+			})
+			assert.NoError(t, err)
+			t.Cleanup(client.Close)
+			server.SetTime(time.Unix(1700000000, 0))
+			return NewValkeyManagerWithOptions(client, options), server
+		}
+		ctx := context.Background()
+
+		t.Run("Prefixes every key", func(t *testing.T) {
+			manager, server := newManager(t, ValkeyOptions{Namespace: "prod-eu"})
+			assert.Equal(t, "prod-eu", manager.Namespace())
+
+			_, _, err := manager.Allow(ctx, "openai", "openai", "gpt-4o", time.Second, 1)
+			assert.NoError(t, err)
+			assert.NoError(t, manager.Disable(ctx, "vertex", "us-central1", "gemini", time.Minute))
+			assert.NoError(t, manager.SaveCache(ctx, "cache:abc", []byte("response"), time.Minute))
+			_, err = manager.AcquireLock(ctx, "cache:abc:lock", time.Minute)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{
+				"prod-eu:bucket:openai:openai:gpt-4o",
+				"prod-eu:bucket:vertex:us-central1:gemini",
+				"prod-eu:cache:abc",
+				"prod-eu:cache:abc:lock",
+			}, server.Keys())
+
+			wait, err := manager.Peek(ctx, "vertex", "us-central1", "gemini")
+			assert.NoError(t, err)
+			assert.Equal(t, time.Minute, wait)
+			value, err := manager.LoadCache(ctx, "cache:abc")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("response"), value)
+			assert.NoError(t, manager.ReleaseLock(ctx, "cache:abc:lock"))
+			assert.False(t, server.Exists("prod-eu:cache:abc:lock"))
+		})
+
+		t.Run("Defaults to ogem", func(t *testing.T) {
+			manager, server := newManager(t, ValkeyOptions{})
+			assert.NoError(t, manager.SaveCache(ctx, "cache:abc", []byte("response"), time.Minute))
+			assert.Equal(t, []string{"ogem:cache:abc"}, server.Keys())
+		})
+
+		t.Run("Keeps the namespaces apart", func(t *testing.T) {
+			manager, server := newManager(t, ValkeyOptions{Namespace: "staging"})
+			server.Set("ogem:cache:abc", "legacy")
+			server.Set("prod:cache:abc", "prod")
+
+			value, err := manager.LoadCache(ctx, "cache:abc")
+			assert.NoError(t, err)
+			assert.Nil(t, value)
+		})
+
+		t.Run("Falls back to the legacy key on reads if enabled", func(t *testing.T) {
+			manager, server := newManager(t, ValkeyOptions{Namespace: "prod", LegacyReads: true})
+			server.Set("ogem:cache:abc", "legacy")
+
+			value, err := manager.LoadCache(ctx, "cache:abc")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("legacy"), value)
+
+			// The namespaced key takes precedence once written, and writes
+			// never go to the legacy key.
+			assert.NoError(t, manager.SaveCache(ctx, "cache:abc", []byte("new"), time.Minute))
+			value, err = manager.LoadCache(ctx, "cache:abc")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("new"), value)
+			legacy, err := server.Get("ogem:cache:abc")
+			assert.NoError(t, err)
+			assert.Equal(t, "legacy", legacy)
+
+			value, err = manager.LoadCache(ctx, "cache:missing")
+			assert.NoError(t, err)
+			assert.Nil(t, value)
+		})
+	})
+
+	t.Run("Counters", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		client, err := valkey.NewClient(valkey.ClientOption{
+			InitAddress:  []string{server.Addr()},
+			DisableCache: true,
+		})
+		assert.NoError(t, err)
+		t.Cleanup(client.Close)
+		manager := NewValkeyManager(client)
+		ctx := context.Background()
+
+		values, err := manager.AddCounters(ctx, "usage", nil, time.Hour)
+		assert.NoError(t, err)
+		assert.Empty(t, values)
+		assert.False(t, server.Exists("ogem:usage"))
+
+		values, err = manager.AddCounters(ctx, "usage", map[string]float64{"tokens": 100, "cost": 0.25}, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"tokens": 100, "cost": 0.25}, values)
+		assert.Equal(t, time.Hour, server.TTL("ogem:usage"))
+
+		// The expiry is kept from the first increment.
+		server.FastForward(30 * time.Minute)
+		values, err = manager.AddCounters(ctx, "usage", map[string]float64{"tokens": 50, "requests": 1}, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"tokens": 150, "cost": 0.25, "requests": 1}, values)
+		assert.Equal(t, 30*time.Minute, server.TTL("ogem:usage"))
+
+		server.FastForward(30 * time.Minute)
+		values, err = manager.AddCounters(ctx, "usage", nil, time.Hour)
+		assert.NoError(t, err)
+		assert.Empty(t, values)
+	})
+
 	t.Run("Cache operations", func(t *testing.T) {
 		t.Run("SaveCache success", func(t *testing.T) {
 			ctrl := gomock.NewController(t)
@@ -99,7 +293,7 @@ func TestValkeyManager(t *testing.T) {
 			ctx := context.Background()
 
 			mockClient.EXPECT().
-				Do(ctx, valkeymock.Match("SET", "test-key", "test-value", "EX", "1")).
+				Do(ctx, valkeymock.Match("SET", "ogem:test-key", "test-value", "EX", "1")).
 				Return(valkeymock.Result(valkeymock.ValkeyString("OK")))
 
 			err := manager.SaveCache(ctx, "test-key", []byte("test-value"), time.Second)
@@ -116,7 +310,7 @@ func TestValkeyManager(t *testing.T) {
 
 			expectedValue := []byte("test-value")
 			mockClient.EXPECT().
-				Do(ctx, valkeymock.Match("GET", "test-key")).
+				Do(ctx, valkeymock.Match("GET", "ogem:test-key")).
 				Return(valkeymock.Result(valkeymock.ValkeyBlobString(string(expectedValue))))
 
 			value, err := manager.LoadCache(ctx, "test-key")
@@ -133,7 +327,7 @@ func TestValkeyManager(t *testing.T) {
 			ctx := context.Background()
 
 			mockClient.EXPECT().
-				Do(ctx, valkeymock.Match("GET", "test-key")).
+				Do(ctx, valkeymock.Match("GET", "ogem:test-key")).
 				Return(valkeymock.Result(valkeymock.ValkeyNil()))
 
 			value, err := manager.LoadCache(ctx, "test-key")
@@ -142,6 +336,47 @@ func TestValkeyManager(t *testing.T) {
 		})
 	})
 
+	t.Run("Lock operations", func(t *testing.T) {
+		t.Run("AcquireLock sets the key only if it does not exist", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := valkeymock.NewClient(ctrl)
+			manager := NewValkeyManager(mockClient)
+			ctx := context.Background()
+
+			mockClient.EXPECT().
+				Do(ctx, valkeymock.Match("SET", "ogem:test-lock", "1", "NX", "PX", "30000")).
+				Return(valkeymock.Result(valkeymock.ValkeyString("OK")))
+			mockClient.EXPECT().
+				Do(ctx, valkeymock.Match("SET", "ogem:test-lock", "1", "NX", "PX", "30000")).
+				Return(valkeymock.Result(valkeymock.ValkeyNil()))
+
+			acquired, err := manager.AcquireLock(ctx, "test-lock", 30*time.Second)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+
+			acquired, err = manager.AcquireLock(ctx, "test-lock", 30*time.Second)
+			assert.NoError(t, err)
+			assert.False(t, acquired)
+		})
+
+		t.Run("ReleaseLock deletes the key", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockClient := valkeymock.NewClient(ctrl)
+			manager := NewValkeyManager(mockClient)
+			ctx := context.Background()
+
+			mockClient.EXPECT().
+				Do(ctx, valkeymock.Match("DEL", "ogem:test-lock")).
+				Return(valkeymock.Result(valkeymock.ValkeyInt64(1)))
+
+			assert.NoError(t, manager.ReleaseLock(ctx, "test-lock"))
+		})
+	})
+
 	t.Run("Edge cases", func(t *testing.T) {
 		t.Run("context cancellation", func(t *testing.T) {
 			ctrl := gomock.NewController(t)
@@ -170,7 +405,7 @@ func TestValkeyManager(t *testing.T) {
 			ctx := context.Background()
 
 			mockClient.EXPECT().
-				Do(ctx, valkeymock.Match("SET", "test-key", "test-value", "EX", "0")).
+				Do(ctx, valkeymock.Match("SET", "ogem:test-key", "test-value", "EX", "0")).
 				Return(valkeymock.Result(valkeymock.ValkeyString("OK")))
 
 			err := manager.SaveCache(ctx, "test-key", []byte("test-value"), 0)
@@ -189,7 +424,7 @@ func TestValkeyManager(t *testing.T) {
 			mockClient.EXPECT().
 				Do(ctx, valkeymock.MatchFn(func(cmd []string) bool {
 					return cmd[0] == "SET" &&
-						cmd[1] == "test-key" &&
+						cmd[1] == "ogem:test-key" &&
 						len(cmd[2]) == 1024*1024 &&
 						cmd[3] == "EX" &&
 						cmd[4] == "1"
@@ -0,0 +1,213 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenLoader "github.com/pkoukk/tiktoken-go-loader"
+
+	"github.com/yanolja/ogem/openai"
+)
+
+// Name of the tokenizer used when the count is a rough estimation.
+const HeuristicTokenizer = "heuristic"
+
+// Number of characters per token assumed by the heuristic tokenizer.
+const charsPerToken = 4
+
+// Tokens taken by a low detail image in OpenAI models. Also used for the
+// heuristic since there is no better guess without downloading the image.
+const imageTokens = 85
+
+// Tokens added to each message by the OpenAI chat format, and tokens added
+// once to prime the assistant reply.
+// See https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+var loaderOnce sync.Once
+
+// Encodings loaded so far, keyed by name. Loading one takes hundreds of
+// milliseconds, which is too slow for every request.
+var (
+	encodings      = map[string]*tiktoken.Tiktoken{}
+	encodingsMutex sync.Mutex
+)
+
+// Counts the prompt tokens of the request with the tiktoken encoding of the
+// OpenAI model. Unknown models fall back to the o200k_base encoding.
+func CountOpenAi(request *openai.ChatCompletionRequest) (*openai.TokenCountResponse, error) {
+	loaderOnce.Do(func() {
+		// Avoids downloading the encodings at runtime.
+		tiktoken.SetBpeLoader(tiktokenLoader.NewOfflineLoader())
+	})
+
+	encodingName := encodingNameFor(request.Model)
+	encoding, err := getEncoding(encodingName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s encoding: %v", encodingName, err)
+	}
+
+	return count(request, "tiktoken/"+encodingName, func(text string) int32 {
+		return int32(len(encoding.EncodeOrdinary(text)))
+	})
+}
+
+func getEncoding(name string) (*tiktoken.Tiktoken, error) {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+
+	if encoding, found := encodings[name]; found {
+		return encoding, nil
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	encodings[name] = encoding
+	return encoding, nil
+}
+
+// Counts the completion tokens of the choices with the tiktoken encoding of
+// the OpenAI model, for the responses whose provider did not report them.
+func CountOpenAiCompletion(model string, choices []openai.Choice) (int32, error) {
+	loaderOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktokenLoader.NewOfflineLoader())
+	})
+
+	encodingName := encodingNameFor(model)
+	encoding, err := getEncoding(encodingName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load %s encoding: %v", encodingName, err)
+	}
+	return countCompletion(choices, func(text string) int32 {
+		return int32(len(encoding.EncodeOrdinary(text)))
+	}), nil
+}
+
+// Estimates the completion tokens of the choices assuming four characters per
+// token.
+func EstimateCompletion(choices []openai.Choice) int32 {
+	return countCompletion(choices, EstimateText)
+}
+
+func countCompletion(choices []openai.Choice, countText func(string) int32) int32 {
+	tokens := int32(0)
+	for _, choice := range choices {
+		texts, _ := messageTexts(choice.Message)
+		for _, text := range texts {
+			tokens += countText(text)
+		}
+	}
+	return tokens
+}
+
+// Estimates the prompt tokens of the request assuming four characters per
+// token. Used when the real tokenizer of the model is not available.
+func Estimate(request *openai.ChatCompletionRequest) *openai.TokenCountResponse {
+	// Never fails because the heuristic counter does not return errors.
+	response, _ := count(request, HeuristicTokenizer, EstimateText)
+	response.Estimated = true
+	return response
+}
+
+// Estimates the number of tokens in the text assuming four characters per
+// token, rounding up.
+func EstimateText(text string) int32 {
+	characters := len([]rune(text))
+	return int32((characters + charsPerToken - 1) / charsPerToken)
+}
+
+func count(request *openai.ChatCompletionRequest, tokenizerName string, countText func(string) int32) (*openai.TokenCountResponse, error) {
+	response := &openai.TokenCountResponse{
+		PerMessage: make([]int32, len(request.Messages)),
+		Tokenizer:  tokenizerName,
+	}
+
+	for index, message := range request.Messages {
+		tokens := int32(tokensPerMessage) + countText(message.Role)
+		if message.Name != nil {
+			tokens += tokensPerName + countText(*message.Name)
+		}
+		texts, images := messageTexts(message)
+		for _, text := range texts {
+			tokens += countText(text)
+		}
+		tokens += int32(images * imageTokens)
+		response.PerMessage[index] = tokens
+		response.PromptTokens += tokens
+	}
+
+	if len(request.Tools) > 0 {
+		toolsJson, err := json.Marshal(request.Tools)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tools: %v", err)
+		}
+		response.PromptTokens += countText(string(toolsJson))
+	}
+	if len(request.Functions) > 0 {
+		functionsJson, err := json.Marshal(request.Functions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal functions: %v", err)
+		}
+		response.PromptTokens += countText(string(functionsJson))
+	}
+
+	response.PromptTokens += tokensPerReply
+	return response, nil
+}
+
+// Returns the texts in the message that are sent to the model, and the number
+// of images.
+func messageTexts(message openai.Message) ([]string, int) {
+	texts := []string{}
+	images := 0
+	if message.Content != nil {
+		if message.Content.String != nil {
+			texts = append(texts, *message.Content.String)
+		}
+		for _, part := range message.Content.Parts {
+			if part.Content.TextContent != nil {
+				texts = append(texts, part.Content.TextContent.Text)
+			}
+			if part.Content.ImageContent != nil {
+				images++
+			}
+		}
+	}
+	if message.Refusal != nil {
+		texts = append(texts, *message.Refusal)
+	}
+	if message.FunctionCall != nil {
+		texts = append(texts, message.FunctionCall.Name, message.FunctionCall.Arguments)
+	}
+	for _, toolCall := range message.ToolCalls {
+		if toolCall.Function != nil {
+			texts = append(texts, toolCall.Function.Name, toolCall.Function.Arguments)
+		}
+	}
+	return texts, images
+}
+
+// Returns the tiktoken encoding name of the model, preferring the longest
+// matching prefix for versioned model names. E.g., "gpt-4o-2024-08-06"
+func encodingNameFor(model string) string {
+	if encodingName, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return encodingName
+	}
+	encodingName := tiktoken.MODEL_O200K_BASE
+	longestPrefix := ""
+	for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(longestPrefix) {
+			longestPrefix = prefix
+			encodingName = name
+		}
+	}
+	return encodingName
+}
@@ -0,0 +1,86 @@
+package tokenizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yanolja/ogem/openai"
+	"github.com/yanolja/ogem/utils"
+)
+
+func TestTokenizer(t *testing.T) {
+	messages := []openai.Message{
+		{Role: "system", Content: &openai.MessageContent{String: utils.ToPtr("You are a helpful assistant.")}},
+		{Role: "user", Content: &openai.MessageContent{String: utils.ToPtr("Hello, world!")}},
+	}
+
+	t.Run("Counts OpenAI tokens with cl100k_base", func(t *testing.T) {
+		response, err := CountOpenAi(&openai.ChatCompletionRequest{Model: "gpt-4-0613", Messages: messages})
+		assert.NoError(t, err)
+
+		// "You are a helpful assistant." is 6 tokens and "Hello, world!" is 4
+		// tokens. Each message adds 3 tokens and 1 token for the role.
+		assert.Equal(t, []int32{10, 8}, response.PerMessage)
+		assert.Equal(t, int32(21), response.PromptTokens)
+		assert.Equal(t, "tiktoken/cl100k_base", response.Tokenizer)
+		assert.False(t, response.Estimated)
+	})
+
+	t.Run("Counts OpenAI tokens with o200k_base", func(t *testing.T) {
+		response, err := CountOpenAi(&openai.ChatCompletionRequest{Model: "gpt-4o-2024-08-06", Messages: messages})
+		assert.NoError(t, err)
+		assert.Equal(t, []int32{10, 8}, response.PerMessage)
+		assert.Equal(t, "tiktoken/o200k_base", response.Tokenizer)
+	})
+
+	t.Run("Counts tool definitions", func(t *testing.T) {
+		withoutTools, err := CountOpenAi(&openai.ChatCompletionRequest{Model: "gpt-4o", Messages: messages})
+		assert.NoError(t, err)
+		withTools, err := CountOpenAi(&openai.ChatCompletionRequest{
+			Model:    "gpt-4o",
+			Messages: messages,
+			Tools:    []openai.Tool{{Type: "function", Function: openai.FunctionTool{Name: "get_weather"}}},
+		})
+		assert.NoError(t, err)
+		assert.Greater(t, withTools.PromptTokens, withoutTools.PromptTokens)
+		assert.Equal(t, withoutTools.PerMessage, withTools.PerMessage)
+	})
+
+	t.Run("Estimates unknown models", func(t *testing.T) {
+		response := Estimate(&openai.ChatCompletionRequest{Model: "unknown", Messages: messages})
+
+		// ceil(28 / 4) + "system" (2) + 3 = 12, ceil(13 / 4) + "user" (1) + 3 = 8
+		assert.Equal(t, []int32{12, 8}, response.PerMessage)
+		assert.Equal(t, int32(23), response.PromptTokens)
+		assert.Equal(t, HeuristicTokenizer, response.Tokenizer)
+		assert.True(t, response.Estimated)
+	})
+
+	t.Run("Estimates text", func(t *testing.T) {
+		assert.Equal(t, int32(0), EstimateText(""))
+		assert.Equal(t, int32(1), EstimateText("abc"))
+		assert.Equal(t, int32(2), EstimateText("abcde"))
+		assert.Equal(t, int32(1), EstimateText("안녕"))
+	})
+
+	t.Run("Counts completions", func(t *testing.T) {
+		choices := []openai.Choice{
+			{Message: openai.Message{Role: "assistant", Content: &openai.MessageContent{String: utils.ToPtr("Hello, world!")}}},
+			{Message: openai.Message{Role: "assistant", ToolCalls: []openai.ToolCall{{
+				Function: &openai.FunctionCall{Name: "get_weather", Arguments: "{}"},
+			}}}},
+		}
+
+		tokens, err := CountOpenAiCompletion("gpt-4-0613", choices[:1])
+		assert.NoError(t, err)
+		assert.Equal(t, int32(4), tokens)
+
+		withToolCall, err := CountOpenAiCompletion("gpt-4-0613", choices)
+		assert.NoError(t, err)
+		assert.Greater(t, withToolCall, tokens)
+
+		// ceil(13 / 4) + ceil(11 / 4) + ceil(2 / 4)
+		assert.Equal(t, int32(4+3+1), EstimateCompletion(choices))
+	})
+}
@@ -28,3 +28,14 @@ func Find[T any](array []T, predicate func(T) bool) (T, bool) {
 	var zero T
 	return zero, false
 }
+
+// Returns a new array with the elements that satisfy the predicate.
+func Filter[T any](array []T, predicate func(T) bool) []T {
+	result := []T{}
+	for _, elem := range array {
+		if predicate(elem) {
+			result = append(result, elem)
+		}
+	}
+	return result
+}
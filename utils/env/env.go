@@ -1,6 +1,7 @@
 package env
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -38,3 +39,32 @@ func HasEnv(name string) bool {
 	_, ok := os.LookupEnv(name)
 	return ok
 }
+
+// Replaces ${NAME} in the value with the environment variable NAME. Returns an
+// error if any of the variables does not exist.
+func Interpolate(value string) (string, error) {
+	missing := []string{}
+	result := os.Expand(value, func(name string) string {
+		if !HasEnv(name) {
+			missing = append(missing, name)
+		}
+		return os.Getenv(name)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables are not set: %v", missing)
+	}
+	return result, nil
+}
+
+// Interpolates every value of the map. See Interpolate.
+func InterpolateMap(values map[string]string) (map[string]string, error) {
+	result := make(map[string]string, len(values))
+	for key, value := range values {
+		interpolated, err := Interpolate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		result[key] = interpolated
+	}
+	return result, nil
+}